@@ -0,0 +1,201 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/* environment variables for the admin API */
+const (
+	ADMINTOKEN = "ADMIN_TOKEN" // environment variable containing the bearer token required by the admin API
+)
+
+var (
+	adminAddr string               // address of the admin listener. The admin API is disabled if empty
+	adminMux  = http.NewServeMux() // handlers of the admin API
+)
+
+/* Status of a trigger as reported by the admin API */
+type triggerStatus struct {
+	Name        string `json:"name"`
+	Collection  string `json:"collection"`
+	EventSource string `json:"eventSource"`
+	Enabled     bool   `json:"enabled"`
+	*triggerActivity
+}
+
+/* Return the processors of all loaded trigger collections */
+func loadedTriggerProcessors() []*triggerProcessor {
+	active, canary, shadow := currentCollections()
+	processors := []*triggerProcessor{active}
+	if canary != nil {
+		processors = append(processors, canary)
+	}
+	if shadow != nil {
+		processors = append(processors, shadow)
+	}
+	return processors
+}
+
+/* Start the admin listener. It is only meant to be reachable from within the cluster. */
+func newAdminListener() error {
+	handlers := map[string]http.HandlerFunc{
+		"/admin/triggers":      adminTriggersHandler,
+		"/admin/triggers/":     adminTriggerHandler,
+		"/admin/metrics":       expvar.Handler().ServeHTTP,
+		"/admin/schema":        adminSchemaHandler,
+		"/admin/deadletters":   adminDeadLettersHandler,
+		"/admin/deadletters/":  adminDeadLettersHandler,
+		"/admin/bundle":        adminBundleHandler,
+		"/admin/selftest":      adminSelfTestHandler,
+		"/admin/events":        adminEventsHandler,
+		"/admin/diagnostics":   adminDiagnosticsHandler,
+		"/admin/providers":     adminProvidersHandler,
+		"/admin/destinations":  adminDestinationsHandler,
+		"/admin/recent-events": adminRecentEventsHandler,
+		"/admin/reload":        adminReloadHandler,
+		"/admin/simulate":      adminSimulateHandler,
+		"/admin/events/stream": adminEventStreamHandler,
+		"/admin/backfill":      adminBackfillHandler,
+	}
+	for pattern, handler := range handlers {
+		if err := handleWithMiddleware(adminMux, pattern, adminMiddleware, adminHandler(handler)); err != nil {
+			return err
+		}
+	}
+
+	if adminSocket != "" {
+		if adminAddr == "" {
+			return serveUnixSocket(adminSocket, adminMux)
+		}
+		go func() {
+			klog.Fatal(serveUnixSocket(adminSocket, adminMux))
+		}()
+	}
+
+	klog.Infof("Starting admin listener on %v", adminAddr)
+	listener, err := listenTCP(adminAddr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, adminMux)
+}
+
+/* Wrap an admin handler to check the bearer token, if one is configured */
+func adminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if os.Getenv(ADMINTOKEN) != "" && !adminAuthorized(req) {
+			writeError(writer, req, codeUnauthorized, "unauthorized")
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+/* Return whether a request has the admin bearer token. Never true if the token is not set */
+func adminAuthorized(req *http.Request) bool {
+	token := os.Getenv(ADMINTOKEN)
+	auth := req.Header.Get("Authorization")
+	return token != "" && strings.HasPrefix(auth, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+/* Write a value as the JSON response */
+func writeJSON(writer http.ResponseWriter, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		klog.Errorf("Unable to write JSON response: %v", err)
+	}
+}
+
+/* GET /admin/triggers lists the triggers of the collection, whether they are enabled, and the events they matched */
+func adminTriggersHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	statuses := make([]triggerStatus, 0)
+	for _, tp := range loadedTriggerProcessors() {
+		for eventSource, triggers := range tp.triggerDef.eventTriggers {
+			for _, trigger := range triggers {
+				name := triggerName(trigger)
+				activity := triggerActivityOf(tp.name, name)
+				statuses = append(statuses, triggerStatus{Name: name, Collection: tp.name, EventSource: eventSource, Enabled: tp.isTriggerEnabled(name), triggerActivity: &activity})
+			}
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Name == statuses[j].Name {
+			return statuses[i].Collection < statuses[j].Collection
+		}
+		return statuses[i].Name < statuses[j].Name
+	})
+	writeJSON(writer, statuses)
+}
+
+/* POST /admin/triggers/<name>/enable or /admin/triggers/<name>/disable switches a trigger on or off in all collection versions */
+func adminTriggerHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/admin/triggers/")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 {
+		http.NotFound(writer, req)
+		return
+	}
+	name, action := path[:slash], path[slash+1:]
+
+	var enabled bool
+	switch action {
+	case "enable":
+		enabled = true
+	case "disable":
+		enabled = false
+	default:
+		http.NotFound(writer, req)
+		return
+	}
+	/* switch the trigger in every collection version that has it */
+	statuses := make([]triggerStatus, 0)
+	for _, tp := range loadedTriggerProcessors() {
+		trigger := tp.triggerDef.findTrigger(name)
+		if trigger == nil {
+			continue
+		}
+		if err := tp.setTriggerEnabled(name, enabled); err != nil {
+			writeError(writer, req, codeInternalError, err.Error())
+			return
+		}
+		statuses = append(statuses, triggerStatus{Name: name, Collection: tp.name, EventSource: trigger[EVENTSOURCE].(string), Enabled: enabled})
+	}
+	if len(statuses) == 0 {
+		writeError(writer, req, codeNotFound, "trigger "+name+" not found")
+		return
+	}
+	writeJSON(writer, statuses)
+}
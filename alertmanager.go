@@ -0,0 +1,175 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Prometheus Alertmanager webhooks. The notifications of an Alertmanager webhook receiver pointed to /alertmanager are
+normalized into one alert event per alert, so that triggers may respond to the alerts of the cluster, such as by
+scaling a build pool or opening an issue, as they respond to webhooks. The labels and annotations common to the alerts
+of a notification are merged into those of each alert, and the alertname and severity labels are also set on the body
+of the event. The group of the notification is kept.
+*/
+
+const (
+	ALERTMANAGERTOKEN   = "ALERTMANAGER_TOKEN" // environment variable containing the bearer token of Alertmanager webhook requests
+	alertmanagerVersion = "4"                  // version of the webhook payload of Alertmanager
+	alertmanagerFiring  = "firing"
+
+	defaultAlertmanagerMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,alertmanagerAuth"
+)
+
+var alertmanagerMiddleware string // comma separated middleware chain of the Alertmanager webhook endpoint
+
+/*
+Middleware verifying the bearer token of Alertmanager webhook requests, set with the authorization or basic_auth
+settings of the http_config of the receiver, against the token in the environment variable ALERTMANAGER_TOKEN.
+Requests are not verified if the variable is not set.
+*/
+func alertmanagerAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		token := os.Getenv(ALERTMANAGERTOKEN)
+		if token == "" {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := req.BasicAuth(); ok {
+			given = password
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeInvalidToken, "invalid token")
+			return
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* HTTP listener of Alertmanager webhooks */
+func alertmanagerListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, bodies, err := normalizeAlertmanagerNotification(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process Alertmanager webhook: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	for _, body := range bodies {
+		eventHeader := make(http.Header)
+		for key, values := range header {
+			eventHeader[key] = values
+		}
+		/* each alert has its own ID, the same for the notifications repeated until it is resolved */
+		if fingerprint, _ := body["fingerprint"].(string); fingerprint != "" {
+			eventHeader.Set("X-Github-Delivery", fmt.Sprintf("%v-%v", fingerprint, body["status"]))
+		}
+		if body["firing"] == true {
+			incrementMetric("alertmanager.firing")
+		} else {
+			incrementMetric("alertmanager.resolved")
+		}
+		logReceivedEvent(assignEventID(eventHeader), "Alertmanager listener received alert", req.URL.Path, eventHeader, body)
+		if err = sendWebhookMessage(eventHeader, body); err != nil {
+			break
+		}
+	}
+	respondWebhook(writer, req, err)
+}
+
+/* Return a copy of the string values of a map of labels or annotations, merged over those of defaults */
+func mergeAlertLabels(defaults interface{}, labels interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, source := range []interface{}{defaults, labels} {
+		values, _ := source.(map[string]interface{})
+		for key, value := range values {
+			if text, ok := value.(string); ok {
+				merged[key] = text
+			}
+		}
+	}
+	return merged
+}
+
+/* Normalize an Alertmanager notification into alert events, returning their header and bodies */
+func normalizeAlertmanagerNotification(alertmanagerHeader http.Header, notification map[string]interface{}) (http.Header, []map[string]interface{}, error) {
+	if version, ok := notification["version"].(string); ok && version != alertmanagerVersion {
+		return nil, nil, fmt.Errorf("unsupported version '%v' of Alertmanager notification", version)
+	}
+	alerts, ok := notification["alerts"].([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("Alertmanager notification does not contain alerts")
+	}
+
+	header := make(http.Header)
+	for key, values := range alertmanagerHeader {
+		if http.CanonicalHeaderKey(key) == "Authorization" {
+			/* secrets are not passed on to triggers */
+			continue
+		}
+		header[key] = values
+	}
+	header.Set("X-Github-Event", eventKindAlert)
+
+	group := map[string]interface{}{
+		"receiver":        notification["receiver"],
+		"status":          notification["status"],
+		"groupKey":        notification["groupKey"],
+		"groupLabels":     mergeAlertLabels(nil, notification["groupLabels"]),
+		"externalURL":     notification["externalURL"],
+		"truncatedAlerts": notification["truncatedAlerts"],
+		"alerts":          len(alerts),
+	}
+	bodies := make([]map[string]interface{}, 0, len(alerts))
+	for _, alertObj := range alerts {
+		alert, ok := alertObj.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("alert of Alertmanager notification is not a JSON object")
+		}
+		body := make(map[string]interface{}, len(alert)+5)
+		for key, value := range alert {
+			body[key] = value
+		}
+		labels := mergeAlertLabels(notification["commonLabels"], alert["labels"])
+		body["labels"] = labels
+		body["annotations"] = mergeAlertLabels(notification["commonAnnotations"], alert["annotations"])
+		for _, name := range []string{"alertname", "severity"} {
+			if value, ok := labels[name]; ok {
+				body[name] = value
+			}
+		}
+		if status, _ := body["status"].(string); status == "" {
+			body["status"] = notification["status"]
+		}
+		body["firing"] = body["status"] == alertmanagerFiring
+		body["group"] = group
+		bodies = append(bodies, body)
+	}
+	return header, bodies, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAlertmanagerNotification(t *testing.T) {
+	notification := readGitLabEvent(t, "test_data/alertmanager0/notification.json")
+	header, bodies, err := normalizeAlertmanagerNotification(http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer secret"}}, notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("Authorization") != "" {
+		t.Fatalf("credentials passed on in header %v", header)
+	}
+	if header.Get("X-Github-Event") != eventKindAlert || len(bodies) != 2 {
+		t.Fatalf("unexpected header %v, or %v alerts", header, len(bodies))
+	}
+
+	firing := bodies[0]
+	labels := firing["labels"].(map[string]interface{})
+	annotations := firing["annotations"].(map[string]interface{})
+	if firing["alertname"] != "KabaneroBuildQueueHigh" || firing["severity"] != "warning" || firing["firing"] != true || labels["pool"] != "builds" {
+		t.Fatalf("unexpected alert %v", firing)
+	}
+	if annotations["runbook_url"] != "https://runbooks.example.com/build-queue" || annotations["summary"] != "12 PipelineRuns are queued in pool builds" {
+		t.Fatalf("common annotations not merged: %v", annotations)
+	}
+	group := firing["group"].(map[string]interface{})
+	if group["receiver"] != "kabanero-events" || group["alerts"] != 2 || group["groupLabels"].(map[string]interface{})["alertname"] != "KabaneroBuildQueueHigh" {
+		t.Fatalf("unexpected group %v", group)
+	}
+	/* the labels of an alert take precedence over the common labels */
+	if resolved := bodies[1]; resolved["firing"] != false || resolved["severity"] != "critical" || resolved["status"] != "resolved" {
+		t.Fatalf("unexpected resolved alert %v", resolved)
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"version": "3", "alerts": []interface{}{}},
+		{"version": "4"},
+		{"version": "4", "alerts": []interface{}{"alert"}},
+	} {
+		if _, _, err = normalizeAlertmanagerNotification(http.Header{}, invalid); err == nil {
+			t.Errorf("notification %v was accepted", invalid)
+		}
+	}
+}
+
+func TestAlertmanagerListenerHandler(t *testing.T) {
+	webhook := &failingProvider{}
+	defer setupDeadLetters(t, webhook, &failingProvider{})()
+	os.Setenv(ALERTMANAGERTOKEN, "token")
+	defer os.Unsetenv(ALERTMANAGERTOKEN)
+	handler, err := chainMiddleware(defaultAlertmanagerMiddleware, http.HandlerFunc(alertmanagerListenerHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile("test_data/alertmanager0/notification.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for authorization, expected := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer token": http.StatusOK} {
+		req := httptest.NewRequest("POST", "/alertmanager", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("authorization '%v': status %v, expected %v", authorization, recorder.Code, expected)
+		}
+	}
+	req := httptest.NewRequest("POST", "/alertmanager", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("alertmanager", "token")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("basic authentication: status %v", recorder.Code)
+	}
+
+	/* each alert is a message with the ID of its fingerprint and status */
+	messages, _ := webhook.sent()
+	if len(messages) != 4 {
+		t.Fatalf("%v messages sent", len(messages))
+	}
+	message := make(map[string]interface{})
+	if err = json.Unmarshal(messages[1], &message); err != nil {
+		t.Fatal(err)
+	}
+	if message[EVENTID] != "9e8d7c6b5a493827-resolved" {
+		t.Fatalf("unexpected message %v", message)
+	}
+}
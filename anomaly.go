@@ -0,0 +1,163 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Anomaly detection of webhook traffic. The baseline rate and size of the events of each repository are tracked as
+exponentially weighted moving averages. An event that is much larger than the baseline size, or a minute with many more
+events than the baseline rate, is reported as a warning event to the anomaly destination. A sudden change is often the
+first sign of a misconfigured webhook, or of an attack on the shared endpoint.
+*/
+
+const (
+	anomalyWindow = time.Minute // period over which the rate of events is measured
+	anomalyAlpha  = 0.2         // weight of the latest measurement in the moving averages
+
+	anomalyStatsIdle = 24 * time.Hour // statistics of repositories without events for this long are forgotten
+	maxAnomalyStats  = 10000          // maximum number of repositories whose statistics are kept
+)
+
+var (
+	anomalyDestination string  // eventDestination of the warning events. Anomaly detection is disabled if empty
+	anomalyFactor      float64 // how many times the baseline a measurement must be to be reported
+	anomalyMinEvents   int     // number of events of a repository before its baseline is considered established
+
+	anomalyMutex     sync.Mutex
+	anomalyStats     = make(map[string]*trafficStats)
+	anomalyLastSweep time.Time
+)
+
+/* Traffic statistics of a repository */
+type trafficStats struct {
+	events       int       // events observed so far
+	lastEvent    time.Time // time of the latest event
+	windowStart  time.Time // start of the current window
+	windowCount  int       // events in the current window
+	rateBaseline float64   // moving average of events per window
+	sizeBaseline float64   // moving average of event size
+	rateReported bool      // whether a rate anomaly was already reported in the current window
+}
+
+/* A warning event sent to the anomaly destination */
+type anomalyEvent struct {
+	Type       string    `json:"type"`
+	Kind       string    `json:"kind"` // rate or size
+	Repository string    `json:"repository"`
+	Value      float64   `json:"value"`
+	Baseline   float64   `json:"baseline"`
+	Time       time.Time `json:"time"`
+}
+
+/* Observe an event of a repository, and report it if it is anomalous */
+func observeTraffic(repository string, size int) {
+	if anomalyDestination == "" {
+		return
+	}
+	for _, event := range detectAnomalies(repository, size, time.Now()) {
+		reportAnomaly(event)
+	}
+}
+
+/* Update the statistics of a repository with an event, and return the anomalies detected */
+func detectAnomalies(repository string, size int, now time.Time) []anomalyEvent {
+	if repository == "" {
+		repository = "unknown"
+	}
+	anomalyMutex.Lock()
+	defer anomalyMutex.Unlock()
+
+	stats, ok := anomalyStats[repository]
+	if !ok {
+		if now.Sub(anomalyLastSweep) > anomalyWindow || len(anomalyStats) >= maxAnomalyStats {
+			sweepAnomalyStats(now)
+		}
+		stats = &trafficStats{windowStart: now}
+		anomalyStats[repository] = stats
+	}
+	stats.lastEvent = now
+
+	/* close the windows that have elapsed. Windows without events count as 0. */
+	if elapsed := int(now.Sub(stats.windowStart) / anomalyWindow); elapsed > 0 {
+		stats.rateBaseline = anomalyAlpha*float64(stats.windowCount) + (1-anomalyAlpha)*stats.rateBaseline
+		stats.rateBaseline *= math.Pow(1-anomalyAlpha, float64(elapsed-1))
+		stats.windowStart = stats.windowStart.Add(time.Duration(elapsed) * anomalyWindow)
+		stats.windowCount = 0
+		stats.rateReported = false
+	}
+
+	anomalies := make([]anomalyEvent, 0)
+	established := stats.events >= anomalyMinEvents
+	stats.events++
+	stats.windowCount++
+
+	/* a rate of 1 event per window is never anomalous */
+	rateBaseline := math.Max(stats.rateBaseline, 1)
+	if established && !stats.rateReported && float64(stats.windowCount) > anomalyFactor*rateBaseline {
+		stats.rateReported = true
+		anomalies = append(anomalies, anomalyEvent{Type: "anomaly", Kind: "rate", Repository: repository, Value: float64(stats.windowCount), Baseline: stats.rateBaseline, Time: now})
+	}
+	if established && float64(size) > anomalyFactor*stats.sizeBaseline {
+		anomalies = append(anomalies, anomalyEvent{Type: "anomaly", Kind: "size", Repository: repository, Value: float64(size), Baseline: stats.sizeBaseline, Time: now})
+	}
+
+	if stats.events == 1 {
+		stats.sizeBaseline = float64(size)
+	} else {
+		stats.sizeBaseline = anomalyAlpha*float64(size) + (1-anomalyAlpha)*stats.sizeBaseline
+	}
+	return anomalies
+}
+
+/* Forget the statistics of idle repositories, and of the least recently active if there are still too many. Called with the lock held */
+func sweepAnomalyStats(now time.Time) {
+	anomalyLastSweep = now
+	var oldestRepository string
+	var oldest time.Time
+	for repository, stats := range anomalyStats {
+		if now.Sub(stats.lastEvent) > anomalyStatsIdle {
+			delete(anomalyStats, repository)
+		} else if oldestRepository == "" || stats.lastEvent.Before(oldest) {
+			oldestRepository, oldest = repository, stats.lastEvent
+		}
+	}
+	if len(anomalyStats) >= maxAnomalyStats {
+		delete(anomalyStats, oldestRepository)
+	}
+}
+
+/* Log an anomaly and send it to the anomaly destination */
+func reportAnomaly(event anomalyEvent) {
+	klog.Warningf("Anomalous %v of events from %v: %v, baseline %.1f", event.Kind, event.Repository, event.Value, event.Baseline)
+	incrementMetric("anomaly." + event.Kind)
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		klog.Errorf("Unable to marshal anomaly event: %v", err)
+		return
+	}
+	if err = sendToDestination(anomalyDestination, bytes, nil); err != nil {
+		klog.Errorf("Unable to send anomaly event to %v: %v", anomalyDestination, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDetectAnomalies(t *testing.T) {
+	savedFactor, savedMinEvents := anomalyFactor, anomalyMinEvents
+	defer func() { anomalyFactor, anomalyMinEvents = savedFactor, savedMinEvents }()
+	anomalyFactor = 5
+	anomalyMinEvents = 10
+
+	repo := "https://github.com/org/anomaly"
+	now := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+
+	/* establish a baseline of 2 events of 1000 bytes per minute */
+	for minute := 0; minute < 10; minute++ {
+		for i := 0; i < 2; i++ {
+			if anomalies := detectAnomalies(repo, 1000, now); len(anomalies) != 0 {
+				t.Fatalf("unexpected anomalies during baseline: %v", anomalies)
+			}
+		}
+		now = now.Add(time.Minute)
+	}
+
+	anomalies := detectAnomalies(repo, 100000, now)
+	if len(anomalies) != 1 || anomalies[0].Kind != "size" {
+		t.Fatalf("expected size anomaly, got %v", anomalies)
+	}
+
+	/* a burst within one minute is reported once */
+	rateAnomalies := 0
+	for i := 0; i < 50; i++ {
+		for _, anomaly := range detectAnomalies(repo, 1000, now) {
+			if anomaly.Kind == "rate" {
+				rateAnomalies++
+			}
+		}
+	}
+	if rateAnomalies != 1 {
+		t.Fatalf("expected one rate anomaly for burst, got %v", rateAnomalies)
+	}
+
+	/* a new repository has no baseline */
+	if anomalies := detectAnomalies("https://github.com/org/new", 100000, now); len(anomalies) != 0 {
+		t.Fatalf("unexpected anomalies for new repository: %v", anomalies)
+	}
+}
+
+func TestAnomalyStatsBounded(t *testing.T) {
+	anomalyMutex.Lock()
+	savedStats, savedSweep := anomalyStats, anomalyLastSweep
+	anomalyStats, anomalyLastSweep = make(map[string]*trafficStats), time.Time{}
+	anomalyMutex.Unlock()
+	defer func() {
+		anomalyMutex.Lock()
+		anomalyStats, anomalyLastSweep = savedStats, savedSweep
+		anomalyMutex.Unlock()
+	}()
+
+	/* the least recently active repository is forgotten once there are too many */
+	now := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+	for i := 0; i <= maxAnomalyStats; i++ {
+		detectAnomalies(fmt.Sprintf("https://github.com/org/repo%v", i), 1000, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if _, ok := anomalyStats["https://github.com/org/repo0"]; ok || len(anomalyStats) != maxAnomalyStats {
+		t.Fatalf("%v repositories tracked, least recently active one kept: %v", len(anomalyStats), ok)
+	}
+
+	/* idle repositories are forgotten */
+	detectAnomalies("https://github.com/org/active", 1000, now.Add(anomalyStatsIdle+time.Minute))
+	if len(anomalyStats) != 1 {
+		t.Fatalf("%v repositories tracked after they were idle", len(anomalyStats))
+	}
+}
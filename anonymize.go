@@ -0,0 +1,168 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+Payload anonymization. Messages sent to an eventDestination with anonymize set, such as analytics or staging replicas,
+are stripped of personal data first: email addresses, the names and logins of people, and private URLs, that is
+URLs of hosts that are not public, or of private repositories, are replaced by pseudonyms. Pseudonyms are the hash of
+the value with a salt, so that the same person or URL has the same pseudonym in all messages.
+*/
+
+const (
+	ANONYMIZESALT = "ANONYMIZE_SALT" // salt of the pseudonyms. Random for each run if not set
+
+	anonymizedDomain = "anonymized.invalid"
+)
+
+var (
+	anonymizePublicHosts string // comma separated hosts whose URLs are public
+
+	anonymizeSaltOnce sync.Once
+	anonymizeSalt     []byte
+
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	urlPattern   = regexp.MustCompile(`\b[a-z][a-z0-9+.-]*://[^\s"'<>]+`)
+)
+
+/* Keys of the objects describing people, such as the author of a commit */
+var personKeys = map[string]bool{
+	"author": true, "committer": true, "pusher": true, "sender": true, "user": true, "owner": true, "actor": true,
+	"merged_by": true, "assignee": true, "assignees": true, "requested_reviewers": true, "reviewers": true,
+}
+
+/* Keys whose value identifies a person, wherever they are */
+var personValueKeys = map[string]bool{
+	"login": true, "username": true, "display_name": true, "nickname": true, "email": true,
+	"user_name": true, "user_username": true, "user_email": true, "author_name": true, "author_email": true,
+	"committer_name": true, "committer_email": true,
+}
+
+/* Return the pseudonym of a value */
+func pseudonym(value string) string {
+	anonymizeSaltOnce.Do(func() {
+		if salt := os.Getenv(ANONYMIZESALT); salt != "" {
+			anonymizeSalt = []byte(salt)
+			return
+		}
+		anonymizeSalt = make([]byte, 32)
+		rand.Read(anonymizeSalt)
+	})
+	hash := sha256.New()
+	hash.Write(anonymizeSalt)
+	hash.Write([]byte(value))
+	return "anon-" + hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+/* Return true if the URLs of a host are public */
+func isPublicHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, public := range strings.Split(anonymizePublicHosts, ",") {
+		public = strings.ToLower(strings.TrimSpace(public))
+		if public != "" && (host == public || strings.HasSuffix(host, "."+public)) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Replace the email addresses, and the private URLs, of a string */
+func anonymizeString(value string, privateRepository bool) string {
+	value = urlPattern.ReplaceAllStringFunc(value, func(match string) string {
+		parsed, err := url.Parse(match)
+		if err != nil || parsed.Host == "" || (!privateRepository && isPublicHost(parsed.Hostname())) {
+			return match
+		}
+		return "https://" + anonymizedDomain + "/" + pseudonym(match)
+	})
+	return emailPattern.ReplaceAllStringFunc(value, func(match string) string {
+		return pseudonym(strings.ToLower(match)) + "@" + anonymizedDomain
+	})
+}
+
+/* Anonymize a value of a payload. person is set for the values describing people */
+func anonymizeValue(value interface{}, person bool, privateRepository bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		return anonymizeString(v, privateRepository)
+	case map[string]interface{}:
+		for key, element := range v {
+			if str, ok := element.(string); ok && (personValueKeys[key] || (person && key == NAME)) {
+				if strings.Contains(str, "@") {
+					v[key] = anonymizeString(str, privateRepository)
+				} else if str != "" {
+					v[key] = pseudonym(str)
+				}
+				continue
+			}
+			v[key] = anonymizeValue(element, personKeys[key], privateRepository)
+		}
+	case []interface{}:
+		for index, element := range v {
+			v[index] = anonymizeValue(element, person, privateRepository)
+		}
+	}
+	return value
+}
+
+/* Return true if the repository of a message is not public */
+func isPrivateRepository(message map[string]interface{}) bool {
+	body, _ := message[BODY].(map[string]interface{})
+	for _, key := range []string{"repository", "project"} {
+		repository, ok := body[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if private, ok := repository["private"].(bool); ok && private {
+			return true
+		}
+		if visibility, ok := repository["visibility"].(string); ok && visibility != "" && visibility != "public" {
+			return true
+		}
+		if level, ok := repository["visibility_level"].(float64); ok && level < 20 {
+			/* GitLab: 0 is private, 10 internal, and 20 public */
+			return true
+		}
+	}
+	return false
+}
+
+/* Anonymize a message sent to an eventDestination. Messages that are not JSON objects are anonymized as strings */
+func anonymizeMessage(payload []byte) ([]byte, error) {
+	message := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return []byte(anonymizeString(string(payload), true)), nil
+	}
+	private := isPrivateRepository(message)
+	if body, ok := message[BODY]; ok {
+		message[BODY] = anonymizeValue(body, false, private)
+	}
+	incrementMetric("anonymize.messages")
+	return json.Marshal(message)
+}
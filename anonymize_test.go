@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeMessage(t *testing.T) {
+	message := `{"header":{"X-Github-Event":["push"]},"body":{
+		"ref":"refs/heads/master",
+		"repository":{"name":"appsody","html_url":"https://github.com/kabanero-io/appsody","private":false},
+		"pusher":{"name":"Jane Doe","email":"jane@example.com"},
+		"head_commit":{"message":"Fix build, see https://intranet.example.com/wiki. Thanks bob@example.com",
+			"author":{"name":"Jane Doe","username":"jdoe"}},
+		"compare":"https://github.ibm.com/kabanero-io/appsody/compare/abc"}}`
+	anonymized, err := anonymizeMessage([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"Jane Doe", "jane@example.com", "jdoe", "bob@example.com", "intranet.example.com", "github.ibm.com"} {
+		if strings.Contains(string(anonymized), leaked) {
+			t.Errorf("anonymized message contains %v: %s", leaked, anonymized)
+		}
+	}
+	for _, kept := range []string{"refs/heads/master", `"name":"appsody"`, "https://github.com/kabanero-io/appsody", "Fix build"} {
+		if !strings.Contains(string(anonymized), kept) {
+			t.Errorf("anonymized message does not contain %v: %s", kept, anonymized)
+		}
+	}
+
+	/* the same value has the same pseudonym everywhere */
+	parsed := make(map[string]interface{})
+	if err := json.Unmarshal(anonymized, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	body := parsed[BODY].(map[string]interface{})
+	pusher := body["pusher"].(map[string]interface{})
+	author := body["head_commit"].(map[string]interface{})["author"].(map[string]interface{})
+	if pusher[NAME] != author[NAME] || !strings.HasPrefix(pusher[NAME].(string), "anon-") {
+		t.Errorf("pseudonyms of the same name differ: %v %v", pusher[NAME], author[NAME])
+	}
+}
+
+func TestAnonymizePrivateRepository(t *testing.T) {
+	message := `{"body":{"repository":{"html_url":"https://github.com/kabanero-io/secret","private":true}}}`
+	anonymized, err := anonymizeMessage([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(anonymized), "kabanero-io/secret") {
+		t.Fatalf("URL of a private repository was kept: %s", anonymized)
+	}
+}
+
+func TestSendToAnonymizedDestination(t *testing.T) {
+	provider := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": provider}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{
+		{Name: "analytics", ProviderRef: "capture", Anonymize: true},
+		{Name: "production", ProviderRef: "capture"},
+	}}
+
+	message := []byte(`{"body":{"sender":{"login":"jdoe"}}}`)
+	for _, destination := range []string{"analytics", "production"} {
+		if err := sendToDestinationNow(destination, message, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(provider.messages) != 2 || strings.Contains(string(provider.messages[0]), "jdoe") || !strings.Contains(string(provider.messages[1]), "jdoe") {
+		t.Fatalf("unexpected messages %q", provider.messages)
+	}
+}
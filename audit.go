@@ -0,0 +1,89 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Audit records of the messages processed by trigger collections, kept in the retention store for debugging and
+queried through the admin API. The most recent records are exported in support bundles.
+*/
+
+const (
+	auditOutcomeActions = "actions" // the message triggered actions
+	auditOutcomeNone    = "none"    // the message did not trigger any action
+	auditOutcomeError   = "error"   // the processing of the message failed
+)
+
+var auditSize = 200 // number of audit records kept
+
+/* The processing of a message */
+type auditRecord struct {
+	Time        time.Time         `json:"time"`
+	EventID     string            `json:"eventID,omitempty"`
+	EventSource string            `json:"eventSource"`
+	Collection  string            `json:"collection"`
+	Repository  string            `json:"repository,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Triggers    []string          `json:"triggers"`
+	Actions     []string          `json:"actions"`
+	Outcome     string            `json:"outcome"`
+	Error       string            `json:"error,omitempty"`
+	Retry       *retryHint        `json:"retry,omitempty"`
+	Rendered    []*dryRunResource `json:"dryRunResources,omitempty"`
+}
+
+/* Record the processing of a message in the retention store */
+func recordAudit(message map[string]interface{}, eventSource string, collection string, result *evalResult, err error) {
+	record := &auditRecord{Time: time.Now().UTC(), EventSource: eventSource, Collection: collection, Repository: messageRepositoryName(message),
+		User: messageSenderName(message), Triggers: make([]string, 0), Actions: make([]string, 0), Outcome: auditOutcomeNone}
+	record.EventID, _ = message[EVENTID].(string)
+	if result != nil {
+		record.Actions = result.actions
+		record.Retry = result.retry
+		record.Rendered = result.rendered
+		if result.triggers != nil {
+			record.Triggers = result.triggers
+		}
+		if len(record.Actions) > 0 {
+			record.Outcome = auditOutcomeActions
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+		record.Outcome = auditOutcomeError
+	}
+	if storeErr := auditStore.add(record); storeErr != nil {
+		klog.Errorf("Unable to store the audit record of event %v: %v", record.EventID, storeErr)
+		incrementMetric("retention.errors")
+	}
+	publishAudit(record)
+}
+
+/* Return the most recent audit records, oldest first */
+func recentAuditRecords() []*auditRecord {
+	records, err := auditStore.query(auditQuery{Limit: auditSize})
+	if err != nil {
+		klog.Errorf("Unable to query the audit records: %v", err)
+		return make([]*auditRecord, 0)
+	}
+	return records
+}
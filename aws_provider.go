@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// The AWS provider publishes messages to SNS topics, and receives event sources from SQS queues, such as the queues
+// subscribed to those topics, so that clusters on EKS can wire events into AWS-native tooling. The topic of an event
+// destination is the ARN or the name of an SNS topic, and the queue of an event source is the SQS queue of the same
+// name, unless aws.queues maps it to another queue name or URL. Messages are received in batches with long polling,
+// hidden from other consumers for the visibility timeout while they are processed, and deleted once processed, so
+// that messages that were not processed are received again. SNS notifications are unwrapped, so that queues do not
+// need raw message delivery. The SNS and SQS Query APIs are called with requests signed with Signature Version 4,
+// with the static credentials of a Secret, of the environment, or of the IAM role of the pod.
+
+const (
+	awsAccessKeyID     = "accessKeyId"
+	awsSecretAccessKey = "secretAccessKey"
+	awsSessionToken    = "sessionToken"
+
+	defaultAWSTimeout     = 10 * time.Second
+	defaultAWSWaitTime    = 20 * time.Second // maximum of long polling
+	defaultAWSMaxMessages = 10               // maximum of a batch
+	awsCredentialsMargin  = 5 * time.Minute  // temporary credentials are renewed before they expire
+	awsSecretRefresh      = 5 * time.Minute
+	awsSigningAlgorithm   = "AWS4-HMAC-SHA256"
+	awsTimeFormat         = "20060102T150405Z"
+	awsDateFormat         = "20060102"
+)
+
+// Credentials of AWS.
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expiration      time.Time // zero if they do not expire
+	source          string
+}
+
+// An error returned by an AWS Query API.
+type awsError struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+	status  int
+}
+
+func (err *awsError) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("http status %d", err.status)
+	}
+	return fmt.Sprintf("%s: %s (http status %d)", err.Code, err.Message, err.status)
+}
+
+// A message received from SQS.
+type sqsMessage struct {
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	Body          string `xml:"Body"`
+}
+
+// The messages of an eventSource received but not yet returned by Receive.
+type sqsPending struct {
+	mutex    sync.Mutex // held by Receive while it reads and refills messages
+	messages []*sqsMessage
+}
+
+// The notification of a message published to SNS, as received by SQS queues without raw message delivery.
+type snsNotification struct {
+	Type     string `json:"Type"`
+	TopicArn string `json:"TopicArn"`
+	Message  string `json:"Message"`
+}
+
+type awsProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	aws                       *AWSDefinition
+	client                    *http.Client
+	mutex                     sync.Mutex
+	credentials               *awsCredentials
+	readTime                  time.Time
+	pending                   map[string]*sqsPending // messages received but not yet returned by Receive, by eventSource
+}
+
+func (provider *awsProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	provider.aws = mpd.AWS
+	if provider.aws == nil || provider.aws.Region == "" {
+		return fmt.Errorf("AWS provider '%s' has no aws region", mpd.Name)
+	}
+	if provider.aws.WaitTime < 0 || provider.aws.WaitTime > defaultAWSWaitTime {
+		return fmt.Errorf("aws waitTime of AWS provider '%s' is not between 0 and %v", mpd.Name, defaultAWSWaitTime)
+	}
+	if provider.aws.MaxMessages < 0 || provider.aws.MaxMessages > defaultAWSMaxMessages {
+		return fmt.Errorf("aws maxMessages of AWS provider '%s' is not between 1 and %d", mpd.Name, defaultAWSMaxMessages)
+	}
+	if provider.aws.VisibilityTimeout < 0 || provider.aws.VisibilityTimeout > 12*time.Hour {
+		return fmt.Errorf("aws visibilityTimeout of AWS provider '%s' is not between 0 and 12h", mpd.Name)
+	}
+	if mpd.URL != "" {
+		if parsed, err := url.Parse(mpd.URL); err != nil || parsed.Host == "" {
+			return fmt.Errorf("url '%s' of AWS provider '%s' is not a URL", redactURL(mpd.URL), mpd.Name)
+		}
+	}
+	provider.pending = make(map[string]*sqsPending)
+	provider.client = &http.Client{Transport: withUserAgent(nil), Timeout: provider.timeout() + provider.waitTime()}
+	return nil
+}
+
+func (provider *awsProvider) timeout() time.Duration {
+	if provider.messageProviderDefinition.Timeout > 0 {
+		return provider.messageProviderDefinition.Timeout
+	}
+	return defaultAWSTimeout
+}
+
+func (provider *awsProvider) waitTime() time.Duration {
+	if provider.aws.WaitTime > 0 {
+		return provider.aws.WaitTime
+	}
+	return defaultAWSWaitTime
+}
+
+// Return the endpoint of a service: the URL of the provider, such as that of LocalStack, or the regional endpoint.
+func (provider *awsProvider) endpoint(service string) string {
+	if provider.messageProviderDefinition.URL != "" {
+		return strings.TrimSuffix(provider.messageProviderDefinition.URL, "/") + "/"
+	}
+	return "https://" + service + "." + provider.aws.Region + ".amazonaws.com/"
+}
+
+// Return the ARN of the SNS topic of an eventDestination.
+func (provider *awsProvider) topicARN(node *EventNode) (string, error) {
+	if strings.HasPrefix(node.Topic, "arn:") {
+		return node.Topic, nil
+	}
+	if provider.aws.AccountID == "" {
+		return "", fmt.Errorf("topic '%s' of eventDestination '%s' is not an ARN, and AWS provider '%s' has no aws accountID",
+			node.Topic, node.Name, provider.messageProviderDefinition.Name)
+	}
+	return "arn:aws:sns:" + provider.aws.Region + ":" + provider.aws.AccountID + ":" + node.Topic, nil
+}
+
+// Return the URL of the SQS queue of an eventSource.
+func (provider *awsProvider) queueURL(node *EventNode) (string, error) {
+	queue := node.Topic
+	if mapped, ok := provider.aws.Queues[node.Name]; ok {
+		queue = mapped
+	} else if strings.HasPrefix(queue, "arn:") {
+		/* the queue subscribed to a topic is named after it */
+		queue = queue[strings.LastIndex(queue, ":")+1:]
+	}
+	if strings.HasPrefix(queue, "https://") || strings.HasPrefix(queue, "http://") {
+		return queue, nil
+	}
+	if provider.aws.AccountID == "" {
+		return "", fmt.Errorf("queue '%s' of eventSource '%s' is not a URL, and AWS provider '%s' has no aws accountID",
+			queue, node.Name, provider.messageProviderDefinition.Name)
+	}
+	return provider.endpoint("sqs") + provider.aws.AccountID + "/" + queue, nil
+}
+
+// Return the credentials of the provider, renewing them before they expire.
+func (provider *awsProvider) currentCredentials() (*awsCredentials, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	creds := provider.credentials
+	if creds != nil {
+		stale := !creds.expiration.IsZero() && time.Now().Add(awsCredentialsMargin).After(creds.expiration)
+		if provider.messageProviderDefinition.SecretRef != "" && time.Since(provider.readTime) > awsSecretRefresh {
+			stale = true
+		}
+		if !stale {
+			return creds, nil
+		}
+	}
+	creds, err := provider.resolveCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the credentials of AWS provider '%s': %v", provider.messageProviderDefinition.Name, err)
+	}
+	if klog.V(5) && (provider.credentials == nil || provider.credentials.source != creds.source) {
+		klog.Infof("AWS provider '%s' uses the credentials of %s", provider.messageProviderDefinition.Name, creds.source)
+	}
+	provider.credentials, provider.readTime = creds, time.Now()
+	return creds, nil
+}
+
+// Resolve the credentials: those of the secretRef, of the environment, of the web identity of the pod, or of the
+// container credentials endpoint of EKS Pod Identity.
+func (provider *awsProvider) resolveCredentials() (*awsCredentials, error) {
+	mpd := provider.messageProviderDefinition
+	if mpd.SecretRef != "" {
+		secret, err := readProviderSecret(mpd.SecretRef)
+		if err != nil {
+			return nil, err
+		}
+		creds := &awsCredentials{accessKeyID: strings.TrimSpace(string(secret[awsAccessKeyID])), secretAccessKey: strings.TrimSpace(string(secret[awsSecretAccessKey])),
+			sessionToken: strings.TrimSpace(string(secret[awsSessionToken])), source: "secret " + mpd.SecretRef}
+		if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+			return nil, fmt.Errorf("secret %s has no %s or %s", mpd.SecretRef, awsAccessKeyID, awsSecretAccessKey)
+		}
+		return creds, nil
+	}
+	if id, key := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && key != "" {
+		return &awsCredentials{accessKeyID: id, secretAccessKey: key, sessionToken: os.Getenv("AWS_SESSION_TOKEN"), source: "the environment"}, nil
+	}
+	roleARN, tokenFile := provider.aws.RoleARN, os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" {
+		roleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+	if roleARN != "" && tokenFile != "" {
+		return provider.assumeRoleWithWebIdentity(roleARN, tokenFile)
+	}
+	if endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); endpoint != "" {
+		return provider.containerCredentials(endpoint)
+	}
+	return nil, fmt.Errorf("no secretRef, AWS_ACCESS_KEY_ID, web identity, or container credentials")
+}
+
+// Exchange the projected service account token of the pod for the temporary credentials of an IAM role, as set up
+// by IAM roles for service accounts.
+func (provider *awsProvider) assumeRoleWithWebIdentity(roleARN string, tokenFile string) (*awsCredentials, error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "kabanero-events"
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	/* the request is authenticated by the token, and is not signed */
+	resp, err := provider.client.PostForm(provider.endpoint("sts"), form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeAWSError(resp.StatusCode, body)
+	}
+	var result struct {
+		AccessKeyID     string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>AccessKeyId"`
+		SecretAccessKey string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>SecretAccessKey"`
+		SessionToken    string    `xml:"AssumeRoleWithWebIdentityResult>Credentials>SessionToken"`
+		Expiration      time.Time `xml:"AssumeRoleWithWebIdentityResult>Credentials>Expiration"`
+	}
+	if err = xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("unable to decode the response of AssumeRoleWithWebIdentity: %v", err)
+	}
+	return &awsCredentials{accessKeyID: result.AccessKeyID, secretAccessKey: result.SecretAccessKey, sessionToken: result.SessionToken,
+		expiration: result.Expiration, source: "role " + roleARN}, nil
+}
+
+// Get the temporary credentials of the container credentials endpoint, as set up by EKS Pod Identity.
+func (provider *awsProvider) containerCredentials(endpoint string) (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", strings.TrimSpace(string(token)))
+	}
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("container credentials endpoint returned http status %s", resp.Status)
+	}
+	var result struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("unable to decode the container credentials: %v", err)
+	}
+	return &awsCredentials{accessKeyID: result.AccessKeyID, secretAccessKey: result.SecretAccessKey, sessionToken: result.Token,
+		expiration: result.Expiration, source: "the container credentials endpoint"}, nil
+}
+
+// Return the URI encoding of Signature Version 4: every byte but the unreserved characters is percent encoded.
+func awsURIEncode(value string) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign a request with Signature Version 4, for a service of a region, at a time.
+func signAWSRequest(req *http.Request, body []byte, creds *awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsTimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+			values[lower] = strings.Join(strings.Fields(req.Header.Get(name)), " ")
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parameters := make([]string, 0)
+	for _, key := range keys {
+		queryValues := query[key]
+		sort.Strings(queryValues)
+		for _, value := range queryValues {
+			parameters = append(parameters, awsURIEncode(key)+"="+awsURIEncode(value))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{req.Method, path, strings.Join(parameters, "&"), canonicalHeaders.String(), signedHeaders, sha256Hex(body)}, "\n")
+
+	date := now.UTC().Format(awsDateFormat)
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{awsSigningAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", awsSigningAlgorithm, creds.accessKeyID, scope,
+		signedHeaders, signature))
+}
+
+// Decode the error of a response of a Query API.
+func decodeAWSError(status int, body []byte) error {
+	apiErr := &awsError{status: status}
+	xml.Unmarshal(body, apiErr)
+	return apiErr
+}
+
+// Call an action of the Query API of a service, and decode its XML response into result if not nil.
+func (provider *awsProvider) call(service string, endpoint string, parameters url.Values, result interface{}, timeout time.Duration) error {
+	creds, err := provider.currentCredentials()
+	if err != nil {
+		return err
+	}
+	body := []byte(parameters.Encode())
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, creds, provider.aws.Region, service, time.Now())
+	client := *provider.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := decodeAWSError(resp.StatusCode, responseBody)
+		if resp.StatusCode == http.StatusForbidden {
+			/* the credentials may have been rotated or revoked: resolve them again for the next call */
+			provider.mutex.Lock()
+			provider.credentials = nil
+			provider.mutex.Unlock()
+		}
+		return apiErr
+	}
+	if result != nil {
+		return xml.Unmarshal(responseBody, result)
+	}
+	return nil
+}
+
+// Subscribe checks that the queue of an eventSource exists.
+func (provider *awsProvider) Subscribe(node *EventNode) error {
+	queueURL, err := provider.queueURL(node)
+	if err != nil {
+		return err
+	}
+	parameters := url.Values{"Action": {"GetQueueAttributes"}, "Version": {"2012-11-05"}, "QueueUrl": {queueURL}, "AttributeName.1": {"QueueArn"}}
+	if err = provider.call("sqs", queueURL, parameters, nil, provider.timeout()); err != nil {
+		return fmt.Errorf("unable to subscribe to SQS queue %s of AWS provider '%s': %v", queueURL, provider.messageProviderDefinition.Name, err)
+	}
+	if klog.V(6) {
+		klog.Infof("Subscribed to SQS queue %s", queueURL)
+	}
+	return nil
+}
+
+// Publish a message to the SNS topic of an eventDestination.
+func (provider *awsProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	if klog.V(6) {
+		klog.Infof("awsProvider: Sending %s", string(payload))
+	}
+	topicARN, err := provider.topicARN(node)
+	if err != nil {
+		return err
+	}
+	parameters := url.Values{"Action": {"Publish"}, "Version": {"2010-03-31"}, "TopicArn": {topicARN}, "Message": {string(payload)}}
+	var result struct {
+		MessageID string `xml:"PublishResult>MessageId"`
+	}
+	if err = provider.call("sns", provider.endpoint("sns"), parameters, &result, provider.timeout()); err != nil {
+		return fmt.Errorf("awsProvider Send to %v failed: %v", topicARN, err)
+	}
+	if klog.V(8) {
+		klog.Infof("awsProvider: message published to %s as %s", topicARN, result.MessageID)
+	}
+	return nil
+}
+
+// Receive a batch of messages of the queue of an eventSource, waiting for up to wait for one.
+func (provider *awsProvider) receive(node *EventNode, wait time.Duration) ([]*sqsMessage, error) {
+	queueURL, err := provider.queueURL(node)
+	if err != nil {
+		return nil, err
+	}
+	maxMessages := provider.aws.MaxMessages
+	if maxMessages == 0 {
+		maxMessages = defaultAWSMaxMessages
+	}
+	parameters := url.Values{
+		"Action":              {"ReceiveMessage"},
+		"Version":             {"2012-11-05"},
+		"QueueUrl":            {queueURL},
+		"MaxNumberOfMessages": {strconv.Itoa(maxMessages)},
+		"WaitTimeSeconds":     {strconv.Itoa(int(wait / time.Second))},
+	}
+	if provider.aws.VisibilityTimeout > 0 {
+		parameters.Set("VisibilityTimeout", strconv.Itoa(int(provider.aws.VisibilityTimeout/time.Second)))
+	}
+	var result struct {
+		Messages []*sqsMessage `xml:"ReceiveMessageResult>Message"`
+	}
+	if err = provider.call("sqs", queueURL, parameters, &result, wait+provider.timeout()); err != nil {
+		return nil, err
+	}
+	return result.Messages, nil
+}
+
+// Delete a message once processed, so that it is not received again.
+func (provider *awsProvider) delete(node *EventNode, message *sqsMessage) {
+	queueURL, err := provider.queueURL(node)
+	if err == nil {
+		parameters := url.Values{"Action": {"DeleteMessage"}, "Version": {"2012-11-05"}, "QueueUrl": {queueURL}, "ReceiptHandle": {message.ReceiptHandle}}
+		err = provider.call("sqs", queueURL, parameters, nil, provider.timeout())
+	}
+	if err != nil {
+		klog.Errorf("Unable to delete SQS message of eventSource '%s': %v", node.Name, err)
+	}
+}
+
+// Return the payload of a message: the message of an SNS notification, or the body of the message.
+func sqsMessagePayload(message *sqsMessage) []byte {
+	notification := &snsNotification{}
+	if json.Unmarshal([]byte(message.Body), notification) == nil && notification.Type == "Notification" && notification.TopicArn != "" {
+		return []byte(notification.Message)
+	}
+	return []byte(message.Body)
+}
+
+// Receive a message from an eventSource, deleting it at once.
+func (provider *awsProvider) Receive(node *EventNode) ([]byte, error) {
+	provider.mutex.Lock()
+	pending, ok := provider.pending[node.Name]
+	if !ok {
+		pending = &sqsPending{}
+		provider.pending[node.Name] = pending
+	}
+	provider.mutex.Unlock()
+
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	if len(pending.messages) == 0 {
+		wait := provider.timeout()
+		if wait > provider.waitTime() {
+			wait = provider.waitTime()
+		}
+		messages, err := provider.receive(node, wait)
+		if err != nil {
+			return nil, err
+		}
+		pending.messages = messages
+	}
+	if len(pending.messages) == 0 {
+		return nil, fmt.Errorf("awsProvider: timed out receiving from eventSource %s", node.Name)
+	}
+	message := pending.messages[0]
+	pending.messages = pending.messages[1:]
+	provider.delete(node, message)
+	return sqsMessagePayload(message), nil
+}
+
+// ListenAndServe listens for new events on some eventSource and calls the ReceiverFunc on the message payload.
+// Messages are deleted once the ReceiverFunc returns.
+func (provider *awsProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	if klog.V(5) {
+		klog.Infof("awsProvider: Starting to listen for events of eventSource %s", node.Name)
+	}
+	for {
+		messages, err := provider.receive(node, provider.waitTime())
+		if err != nil {
+			klog.Errorf("Unable to receive SQS messages of eventSource '%s': %v", node.Name, err)
+			time.Sleep(provider.timeout())
+			continue
+		}
+		for _, message := range messages {
+			payload := sqsMessagePayload(message)
+			if klog.V(8) {
+				klog.Infof("Received message of eventSource %s: %s", node.Name, payload)
+			}
+			receiver(payload)
+			provider.delete(node, message)
+		}
+	}
+}
+
+func init() {
+	RegisterMessageProvider("aws", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newAWSProvider(mpd)
+	})
+}
+
+func newAWSProvider(mpd *MessageProviderDefinition) (*awsProvider, error) {
+	provider := new(awsProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
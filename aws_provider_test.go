@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* An SQS and SNS endpoint with one queue subscribed to every topic */
+type fakeAWS struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	queue    []string          // bodies of the messages not yet received
+	inFlight map[string]string // bodies of the messages received but not deleted, by receipt handle
+	receipts int
+	requests []string
+}
+
+func newFakeAWS(t *testing.T) *fakeAWS {
+	fake := &fakeAWS{inFlight: make(map[string]string)}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (fake *fakeAWS) serve(writer http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	action := req.Form.Get("Action")
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.requests = append(fake.requests, action)
+	if action == "AssumeRoleWithWebIdentity" {
+		if req.Form.Get("WebIdentityToken") != "token" {
+			writer.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(writer, "<ErrorResponse><Error><Code>InvalidIdentityToken</Code><Message>invalid token</Message></Error></ErrorResponse>")
+			return
+		}
+		fmt.Fprintf(writer, "<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials><AccessKeyId>ASIAROLE</AccessKeyId>"+
+			"<SecretAccessKey>role</SecretAccessKey><SessionToken>session</SessionToken><Expiration>%s</Expiration></Credentials>"+
+			"</AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		return
+	}
+	if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, awsSigningAlgorithm+" Credential=AKIDTEST/") && !strings.Contains(auth, "ASIAROLE") {
+		writer.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(writer, "<ErrorResponse><Error><Code>InvalidClientTokenId</Code><Message>invalid key</Message></Error></ErrorResponse>")
+		return
+	}
+	switch action {
+	case "GetQueueAttributes":
+		if !strings.HasSuffix(req.Form.Get("QueueUrl"), "/123456789012/github") {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(writer, "<ErrorResponse><Error><Code>AWS.SimpleQueueService.NonExistentQueue</Code><Message>no queue</Message></Error></ErrorResponse>")
+			return
+		}
+		fmt.Fprint(writer, "<GetQueueAttributesResponse></GetQueueAttributesResponse>")
+	case "Publish":
+		notification, _ := json.Marshal(&snsNotification{Type: "Notification", TopicArn: req.Form.Get("TopicArn"), Message: req.Form.Get("Message")})
+		fake.queue = append(fake.queue, string(notification))
+		fmt.Fprint(writer, "<PublishResponse><PublishResult><MessageId>1</MessageId></PublishResult></PublishResponse>")
+	case "ReceiveMessage":
+		fmt.Fprint(writer, "<ReceiveMessageResponse><ReceiveMessageResult>")
+		for len(fake.queue) > 0 && len(fake.inFlight) < 2 {
+			fake.receipts++
+			handle := fmt.Sprintf("receipt-%d", fake.receipts)
+			fake.inFlight[handle] = fake.queue[0]
+			fake.queue = fake.queue[1:]
+			fmt.Fprintf(writer, "<Message><ReceiptHandle>%s</ReceiptHandle><Body>", handle)
+			xml.EscapeText(writer, []byte(fake.inFlight[handle]))
+			fmt.Fprint(writer, "</Body></Message>")
+		}
+		fmt.Fprint(writer, "</ReceiveMessageResult></ReceiveMessageResponse>")
+	case "DeleteMessage":
+		delete(fake.inFlight, req.Form.Get("ReceiptHandle"))
+		fmt.Fprint(writer, "<DeleteMessageResponse></DeleteMessageResponse>")
+	default:
+		writer.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	/* the example of the Signature Version 4 documentation */
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	now, _ := time.Parse(awsTimeFormat, "20150830T123600Z")
+	signAWSRequest(req, nil, &awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, "us-east-1", "iam", now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Fatalf("unexpected authorization %s", auth)
+	}
+	if encoded := awsURIEncode("a b/c~"); encoded != "a%20b%2Fc~" {
+		t.Fatalf("unexpected encoding %s", encoded)
+	}
+}
+
+func TestAWSProviderValidation(t *testing.T) {
+	for _, mpd := range []*MessageProviderDefinition{
+		{Name: "aws"},
+		{Name: "aws", AWS: &AWSDefinition{Region: "us-east-1", WaitTime: time.Minute}},
+		{Name: "aws", AWS: &AWSDefinition{Region: "us-east-1", MaxMessages: 11}},
+		{Name: "aws", URL: "localstack", AWS: &AWSDefinition{Region: "us-east-1"}},
+	} {
+		if _, err := newAWSProvider(mpd); err == nil {
+			t.Errorf("provider %+v was accepted", mpd)
+		}
+	}
+	provider, err := newAWSProvider(&MessageProviderDefinition{Name: "aws", AWS: &AWSDefinition{Region: "eu-west-1", AccountID: "123456789012",
+		Queues: map[string]string{"quay": "https://sqs.eu-west-1.amazonaws.com/123456789012/images"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arn, _ := provider.topicARN(&EventNode{Name: "github", Topic: "github"}); arn != "arn:aws:sns:eu-west-1:123456789012:github" {
+		t.Fatalf("unexpected topic ARN %s", arn)
+	}
+	tests := map[string]string{
+		"github": "https://sqs.eu-west-1.amazonaws.com/123456789012/github",
+		"quay":   "https://sqs.eu-west-1.amazonaws.com/123456789012/images",
+		"docker": "https://sqs.eu-west-1.amazonaws.com/123456789012/docker",
+	}
+	for name, expected := range tests {
+		topic := name
+		if name == "docker" {
+			topic = "arn:aws:sns:eu-west-1:123456789012:docker"
+		}
+		if queueURL, _ := provider.queueURL(&EventNode{Name: name, Topic: topic}); queueURL != expected {
+			t.Errorf("queue of %s is %s, expected %s", name, queueURL, expected)
+		}
+	}
+}
+
+func TestAWSProvider(t *testing.T) {
+	fake := newFakeAWS(t)
+	defer fake.server.Close()
+	savedReader := readProviderSecret
+	defer func() { readProviderSecret = savedReader }()
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{awsAccessKeyID: []byte("AKIDTEST"), awsSecretAccessKey: []byte("secret")}, nil
+	}
+
+	mpd := &MessageProviderDefinition{Name: "aws", URL: fake.server.URL, SecretRef: "aws-credentials", Timeout: time.Second,
+		AWS: &AWSDefinition{Region: "us-east-1", AccountID: "123456789012", WaitTime: time.Second, VisibilityTimeout: time.Minute}}
+	provider, err := newAWSProvider(mpd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &EventNode{Name: "github", Topic: "github"}
+	if err = provider.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+	if err = provider.Subscribe(&EventNode{Name: "missing", Topic: "missing"}); err == nil || !strings.Contains(err.Error(), "NonExistentQueue") {
+		t.Fatalf("unexpected error subscribing to a missing queue: %v", err)
+	}
+	for _, message := range []string{`{"id":1}`, `{"id":2}`, `{"id":3}`} {
+		if err = provider.Send(node, []byte(message), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* a batch of two is received, and the second message is returned without receiving again */
+	for _, expected := range []string{`{"id":1}`, `{"id":2}`} {
+		if data, err := provider.Receive(node); err != nil || string(data) != expected {
+			t.Fatalf("unexpected message %s: %v", data, err)
+		}
+	}
+	if receives := strings.Count(strings.Join(fake.requests, ","), "ReceiveMessage"); receives != 1 {
+		t.Fatalf("%d batches received", receives)
+	}
+
+	received := make(chan string, 10)
+	go provider.ListenAndServe(node, func(data []byte) { received <- string(data) })
+	select {
+	case got := <-received:
+		if got != `{"id":3}` {
+			t.Fatalf("unexpected message %s", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not received")
+	}
+	waitFor(t, func() bool {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		return len(fake.inFlight) == 0 && len(fake.queue) == 0
+	})
+
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{awsAccessKeyID: []byte("AKIDWRONG"), awsSecretAccessKey: []byte("secret")}, nil
+	}
+	wrong, _ := newAWSProvider(mpd)
+	if err = wrong.Send(node, []byte("{}"), nil); err == nil || !strings.Contains(err.Error(), "InvalidClientTokenId") {
+		t.Fatalf("unexpected error sending with wrong credentials: %v", err)
+	}
+}
+
+func TestAWSWebIdentityCredentials(t *testing.T) {
+	fake := newFakeAWS(t)
+	defer fake.server.Close()
+	dir, err := ioutil.TempDir("", "aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("token\n"), 0600)
+	for name, value := range map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": "", "AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/events",
+		"AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile} {
+		saved, set := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer func(name string) {
+			if set {
+				os.Setenv(name, saved)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+
+	provider, err := newAWSProvider(&MessageProviderDefinition{Name: "aws", URL: fake.server.URL, AWS: &AWSDefinition{Region: "us-east-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := provider.currentCredentials()
+	if err != nil || creds.accessKeyID != "ASIAROLE" || creds.sessionToken != "session" {
+		t.Fatalf("unexpected credentials %+v: %v", creds, err)
+	}
+	/* the credentials are cached until they are about to expire */
+	provider.currentCredentials()
+	if assumed := strings.Count(strings.Join(fake.requests, ","), "AssumeRoleWithWebIdentity"); assumed != 1 {
+		t.Fatalf("role assumed %d times", assumed)
+	}
+	if err = provider.Send(&EventNode{Name: "github", Topic: "arn:aws:sns:us-east-1:123456789012:github"}, []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(tokenFile, []byte("expired"), 0600)
+	other, _ := newAWSProvider(provider.messageProviderDefinition)
+	if _, err = other.currentCredentials(); err == nil || !strings.Contains(err.Error(), "InvalidIdentityToken") {
+		t.Fatalf("unexpected error assuming the role with an invalid token: %v", err)
+	}
+}
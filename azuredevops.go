@@ -0,0 +1,290 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Azure DevOps webhooks. The git.push, git.pullrequest.created, and git.pullrequest.updated events of the Web Hooks
+service hooks of Azure DevOps Services and Azure DevOps Server (TFS) received on /azuredevops are normalized into the
+message envelope of GitHub webhooks, as GitLab events are. The repositories of Azure DevOps belong to projects, which
+are their owner. A push of several refs is normalized into one push event per ref, as for Bitbucket. The original
+fields, such as eventType and resource, are kept.
+*/
+
+const (
+	AZUREDEVOPSUSERNAME = "AZURE_DEVOPS_USERNAME" // environment variable containing the username of Azure DevOps webhook requests
+	AZUREDEVOPSPASSWORD = "AZURE_DEVOPS_PASSWORD" // environment variable containing the password of Azure DevOps webhook requests
+
+	defaultAzureDevOpsMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,azureDevOpsAuth"
+)
+
+var azureDevOpsMiddleware string // comma separated middleware chain of the Azure DevOps webhook endpoint
+
+/* GitHub event equivalent to each Azure DevOps eventType */
+var azureDevOpsEventTypes = map[string]string{
+	"git.push":                "push",
+	"git.pullrequest.created": "pull_request",
+	"git.pullrequest.updated": "pull_request",
+}
+
+/*
+Middleware verifying the basic authentication of Azure DevOps webhook requests, set in the settings of the service
+hook, against the password in the environment variable AZURE_DEVOPS_PASSWORD, and the username in
+AZURE_DEVOPS_USERNAME if it is set. Requests are not verified if the password is not set.
+*/
+func azureDevOpsAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		password := os.Getenv(AZUREDEVOPSPASSWORD)
+		if password == "" {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		username := os.Getenv(AZUREDEVOPSUSERNAME)
+		givenUsername, givenPassword, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(givenPassword), []byte(password)) != 1 ||
+			(username != "" && subtle.ConstantTimeCompare([]byte(givenUsername), []byte(username)) != 1) {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeUnauthorized, "invalid credentials")
+			return
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* HTTP listener of Azure DevOps webhooks */
+func azureDevOpsListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, bodies, err := normalizeAzureDevOpsEvent(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process Azure DevOps webhook: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	/* the events of a push are of the same repository */
+	if !allowRepositoryEvent(writer, req, bodies[0]) {
+		return
+	}
+	delivery := header.Get("X-Github-Delivery")
+	for index, body := range bodies {
+		eventHeader := header
+		if index > 0 && delivery != "" {
+			/* each event of a push of several refs has its own ID */
+			eventHeader = make(http.Header)
+			for key, values := range header {
+				eventHeader[key] = values
+			}
+			eventHeader.Set("X-Github-Delivery", fmt.Sprintf("%v-%v", delivery, index))
+		}
+		logReceivedEvent(assignEventID(eventHeader), "Azure DevOps listener received event", req.URL.Path, eventHeader, body)
+		if err = sendWebhookMessage(eventHeader, body); err != nil {
+			break
+		}
+	}
+	respondWebhook(writer, req, err)
+}
+
+/* Normalize an Azure DevOps event into GitHub events, returning their header and bodies */
+func normalizeAzureDevOpsEvent(azureHeader http.Header, body map[string]interface{}) (http.Header, []map[string]interface{}, error) {
+	azureEvent, _ := body["eventType"].(string)
+	eventType, ok := azureDevOpsEventTypes[azureEvent]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported Azure DevOps eventType '%v'", azureEvent)
+	}
+
+	header := make(http.Header)
+	for key, values := range azureHeader {
+		if http.CanonicalHeaderKey(key) == "Authorization" {
+			/* credentials are not passed on to triggers */
+			continue
+		}
+		header[key] = values
+	}
+	header.Set("X-Github-Event", eventType)
+	if id, ok := body["id"].(string); ok && header.Get("X-Github-Delivery") == "" {
+		header.Set("X-Github-Delivery", id)
+	}
+
+	resource, _ := body["resource"].(map[string]interface{})
+	repository, _ := resource["repository"].(map[string]interface{})
+	if repository == nil {
+		return nil, nil, fmt.Errorf("Azure DevOps %v event does not contain resource.repository", azureEvent)
+	}
+	body["repository"] = azureDevOpsRepository(repository)
+
+	if eventType == "pull_request" {
+		normalizeAzureDevOpsPullRequest(body, resource, azureEvent)
+		return header, []map[string]interface{}{body}, nil
+	}
+	if pushedBy, ok := resource["pushedBy"].(map[string]interface{}); ok {
+		body["sender"] = map[string]interface{}{"login": pushedBy["uniqueName"]}
+		body["pusher"] = map[string]interface{}{"name": pushedBy["displayName"], "email": pushedBy["uniqueName"]}
+	}
+	bodies := azureDevOpsPushes(body, resource)
+	if len(bodies) == 0 {
+		return nil, nil, fmt.Errorf("Azure DevOps %v event does not contain refUpdates", azureEvent)
+	}
+	return header, bodies, nil
+}
+
+/* Return an Azure DevOps repository, with the fields of a GitHub repository added */
+func azureDevOpsRepository(repository map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(repository)+5)
+	for key, value := range repository {
+		normalized[key] = value
+	}
+	name, _ := repository["name"].(string)
+	project, _ := repository["project"].(map[string]interface{})
+	projectName, _ := project["name"].(string)
+	normalized["full_name"] = projectName + "/" + name
+	normalized["owner"] = map[string]interface{}{"login": projectName}
+	if remoteURL, ok := repository["remoteUrl"].(string); ok {
+		/* the remote URL of Azure DevOps Services may contain the organization as user */
+		if parsed, err := url.Parse(remoteURL); err == nil {
+			parsed.User = nil
+			remoteURL = parsed.String()
+		}
+		normalized["html_url"] = remoteURL
+		normalized["clone_url"] = remoteURL
+	}
+	if sshURL, ok := repository["sshUrl"].(string); ok {
+		normalized["ssh_url"] = sshURL
+	}
+	if defaultBranch, ok := repository["defaultBranch"].(string); ok {
+		normalized["default_branch"] = strings.TrimPrefix(defaultBranch, "refs/heads/")
+	}
+	return normalized
+}
+
+/* Return one GitHub push event per ref updated by an Azure DevOps push */
+func azureDevOpsPushes(body map[string]interface{}, resource map[string]interface{}) []map[string]interface{} {
+	refUpdates, _ := resource["refUpdates"].([]interface{})
+	commits, _ := resource["commits"].([]interface{})
+	bodies := make([]map[string]interface{}, 0, len(refUpdates))
+	for _, updateObj := range refUpdates {
+		update, ok := updateObj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref, _ := update["name"].(string)
+		before, _ := update["oldObjectId"].(string)
+		after, _ := update["newObjectId"].(string)
+		if ref == "" {
+			continue
+		}
+		if before == "" {
+			before = zeroSHA
+		}
+		if after == "" {
+			after = zeroSHA
+		}
+
+		pushBody := make(map[string]interface{}, len(body)+6)
+		for key, value := range body {
+			pushBody[key] = value
+		}
+		pushBody["ref"] = ref
+		pushBody["before"] = before
+		pushBody["after"] = after
+		pushBody["created"] = before == zeroSHA
+		pushBody["deleted"] = after == zeroSHA
+		if after != zeroSHA {
+			pushBody["head_commit"] = azureDevOpsCommit(commits, after)
+		}
+		bodies = append(bodies, pushBody)
+	}
+	return bodies
+}
+
+/* Return the GitHub commit of an Azure DevOps commit of a push, or only its ID if it is not in the commits */
+func azureDevOpsCommit(commits []interface{}, id string) map[string]interface{} {
+	for _, commitObj := range commits {
+		commit, ok := commitObj.(map[string]interface{})
+		if !ok || commit["commitId"] != id {
+			continue
+		}
+		headCommit := map[string]interface{}{"id": id, "message": commit["comment"], "url": commit["url"]}
+		if author, ok := commit["author"].(map[string]interface{}); ok {
+			headCommit["author"] = map[string]interface{}{"name": author["name"], "email": author["email"]}
+			headCommit["timestamp"] = author["date"]
+		}
+		return headCommit
+	}
+	return map[string]interface{}{"id": id}
+}
+
+/* Add the fields of a GitHub pull_request event to an Azure DevOps pull request event */
+func normalizeAzureDevOpsPullRequest(body map[string]interface{}, resource map[string]interface{}, azureEvent string) {
+	status, _ := resource["status"].(string)
+	action, state := "synchronize", "open"
+	switch {
+	case status == "completed" || status == "abandoned":
+		action, state = "closed", "closed"
+	case azureEvent == "git.pullrequest.created":
+		action = "opened"
+	}
+	body["action"] = action
+
+	user := map[string]interface{}{}
+	if createdBy, ok := resource["createdBy"].(map[string]interface{}); ok {
+		user["login"] = createdBy["uniqueName"]
+		body["sender"] = map[string]interface{}{"login": createdBy["uniqueName"]}
+	}
+	repository := body["repository"].(map[string]interface{})
+	htmlURL := fmt.Sprintf("%v/pullrequest/%v", repository["html_url"], resource["pullRequestId"])
+	if links, ok := resource["_links"].(map[string]interface{}); ok {
+		if web, ok := links["web"].(map[string]interface{}); ok {
+			if href, ok := web["href"].(string); ok {
+				htmlURL = href
+			}
+		}
+	}
+	body["number"] = resource["pullRequestId"]
+	body["pull_request"] = map[string]interface{}{
+		"number":   resource["pullRequestId"],
+		"title":    resource["title"],
+		"body":     resource["description"],
+		"state":    state,
+		"html_url": htmlURL,
+		"merged":   status == "completed",
+		"user":     user,
+		"head":     azureDevOpsPullRequestRef(resource["sourceRefName"], resource["lastMergeSourceCommit"], repository),
+		"base":     azureDevOpsPullRequestRef(resource["targetRefName"], resource["lastMergeTargetCommit"], repository),
+	}
+}
+
+/* Return the GitHub head or base of an Azure DevOps pull request, from its ref name and last merged commit */
+func azureDevOpsPullRequestRef(refName interface{}, commitObj interface{}, repository map[string]interface{}) map[string]interface{} {
+	name, _ := refName.(string)
+	ref := map[string]interface{}{"ref": strings.TrimPrefix(name, "refs/heads/"), "repo": repository}
+	if commit, ok := commitObj.(map[string]interface{}); ok {
+		ref["sha"] = commit["commitId"]
+	}
+	return ref
+}
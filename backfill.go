@@ -0,0 +1,389 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"k8s.io/klog"
+)
+
+/*
+Backfilling events. POST /admin/backfill lists the branches and the open pull requests of GitHub repositories, and
+synthesizes the push and pull_request events GitHub would have sent for them: a push creating each branch whose last
+commit is recent enough, and the opening of each pull request updated recently enough. The events are sent as webhook
+messages, so that onboarding an existing repository triggers an initial build of its active branches. Synthesized
+events have the header X-Kabanero-Backfill. The repositories are those of the request, or of -backfillRepositories.
+*/
+
+const (
+	backfillHeader    = "X-Kabanero-Backfill"
+	backfillPageSize  = 100
+	backfillPushEvent = "push"
+	backfillPullEvent = "pull_request"
+)
+
+var (
+	backfillRepositories string        // comma separated URLs of the repositories to backfill by default
+	backfillSince        time.Duration // default age of the oldest activity backfilled
+)
+
+/* The body of a backfill request */
+type backfillRequest struct {
+	Repositories []string `json:"repositories,omitempty"`
+	Since        string   `json:"since,omitempty"`
+	Events       []string `json:"events,omitempty"`
+	DryRun       bool     `json:"dryRun,omitempty"`
+}
+
+/* An event synthesized by a backfill */
+type backfillEvent struct {
+	Repository string                 `json:"repository"`
+	Event      string                 `json:"event"`
+	Ref        string                 `json:"ref"`
+	SHA        string                 `json:"sha"`
+	EventID    string                 `json:"eventID,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+	Body       map[string]interface{} `json:"body,omitempty"`
+	header     http.Header
+}
+
+/* The result of a backfill */
+type backfillResult struct {
+	Events []*backfillEvent  `json:"events"`
+	Sent   int               `json:"sent"`
+	Errors map[string]string `json:"errors,omitempty"`
+	Retry  *retryHint        `json:"retry,omitempty"`
+}
+
+/* Return a GitHub client of a repository, with the credentials of the repository if there are some */
+func newBackfillClient(repoURL string) (*github.Client, string, error) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil || parsed.Host == "" {
+		return nil, "", fmt.Errorf("invalid URL %s of a repository", redactURL(repoURL))
+	}
+	apiURL, host := gitHubAPIURL(parsed.Scheme + "://" + parsed.Host)
+	var transport http.RoundTripper = withUserAgent(nil)
+	username, token, credentialsSource, err := resolveGitCredentials(repoURL)
+	if err == nil {
+		klog.Infof("Backfilling repository %s with the credentials of %s", repoURL, credentialsSource)
+		transport = &github.BasicAuthTransport{Username: username, Password: token, Transport: transport}
+	} else {
+		/* public repositories do not need credentials */
+		klog.Infof("Backfilling repository %s anonymously: %v", repoURL, err)
+	}
+	client, err := github.NewEnterpriseClient(apiURL, apiURL, &http.Client{Transport: transport, Timeout: indexTimeout})
+	if err != nil {
+		return nil, "", err
+	}
+	client.UserAgent = userAgent()
+	return client, host, nil
+}
+
+/* Convert a value returned by the GitHub API into the JSON object of a webhook body */
+func backfillObject(value interface{}) map[string]interface{} {
+	object := make(map[string]interface{})
+	if data, err := json.Marshal(value); err == nil {
+		json.Unmarshal(data, &object)
+	}
+	return object
+}
+
+/* Return the header of a synthesized event */
+func backfillEventHeader(event string, host string) http.Header {
+	header := make(http.Header)
+	header.Set("X-Github-Event", event)
+	header.Set(backfillHeader, "true")
+	if host != "github.com" && host != "www.github.com" {
+		header.Set("X-Github-Enterprise-Host", host)
+	}
+	return header
+}
+
+/* Synthesize the push events creating the branches of a repository with a commit since a time */
+func backfillPushes(ctx context.Context, client *github.Client, host string, repository *github.Repository, since time.Time) ([]*backfillEvent, error) {
+	owner, name := repository.GetOwner().GetLogin(), repository.GetName()
+	repositoryObject := backfillObject(repository)
+	events := make([]*backfillEvent, 0)
+	options := &github.ListOptions{PerPage: backfillPageSize}
+	for {
+		branches, resp, err := client.Repositories.ListBranches(ctx, owner, name, options)
+		if err != nil {
+			return events, gitHubCallError(resp, err, fmt.Sprintf("unable to list the branches of %s", repository.GetHTMLURL()))
+		}
+		for _, branch := range branches {
+			/* the commits of listed branches only have their SHA */
+			commit, resp, err := client.Repositories.GetCommit(ctx, owner, name, branch.GetCommit().GetSHA())
+			if err != nil {
+				return events, gitHubCallError(resp, err, fmt.Sprintf("unable to get the last commit of branch %s of %s", branch.GetName(), repository.GetHTMLURL()))
+			}
+			date := commit.GetCommit().GetCommitter().GetDate()
+			if date.Before(since) {
+				continue
+			}
+			headCommit := map[string]interface{}{
+				"id":        commit.GetSHA(),
+				"message":   commit.GetCommit().GetMessage(),
+				"timestamp": date.Format(time.RFC3339),
+				"url":       commit.GetHTMLURL(),
+				"author":    backfillObject(commit.GetCommit().GetAuthor()),
+				"committer": backfillObject(commit.GetCommit().GetCommitter()),
+			}
+			ref := "refs/heads/" + branch.GetName()
+			body := map[string]interface{}{
+				"ref":         ref,
+				"before":      zeroSHA,
+				"after":       commit.GetSHA(),
+				"created":     true,
+				"deleted":     false,
+				"forced":      false,
+				"compare":     repository.GetHTMLURL() + "/commit/" + commit.GetSHA(),
+				"head_commit": headCommit,
+				"commits":     []interface{}{headCommit},
+				"repository":  repositoryObject,
+			}
+			if commit.Author != nil {
+				body["sender"] = backfillObject(commit.Author)
+			}
+			events = append(events, &backfillEvent{Repository: repository.GetHTMLURL(), Event: backfillPushEvent, Ref: ref, SHA: commit.GetSHA(),
+				Body: body, header: backfillEventHeader(backfillPushEvent, host)})
+		}
+		if resp.NextPage == 0 {
+			return events, nil
+		}
+		options.Page = resp.NextPage
+	}
+}
+
+/* Synthesize the events opening the open pull requests of a repository updated since a time */
+func backfillPullRequests(ctx context.Context, client *github.Client, host string, repository *github.Repository, since time.Time) ([]*backfillEvent, error) {
+	owner, name := repository.GetOwner().GetLogin(), repository.GetName()
+	repositoryObject := backfillObject(repository)
+	events := make([]*backfillEvent, 0)
+	options := &github.PullRequestListOptions{State: "open", Sort: "updated", Direction: "desc", ListOptions: github.ListOptions{PerPage: backfillPageSize}}
+	for {
+		pulls, resp, err := client.PullRequests.List(ctx, owner, name, options)
+		if err != nil {
+			return events, gitHubCallError(resp, err, fmt.Sprintf("unable to list the pull requests of %s", repository.GetHTMLURL()))
+		}
+		for _, pull := range pulls {
+			/* the pull requests are sorted by the time of their last update, most recent first */
+			if pull.GetUpdatedAt().Before(since) {
+				return events, nil
+			}
+			body := map[string]interface{}{
+				"action":       "opened",
+				"number":       pull.GetNumber(),
+				"pull_request": backfillObject(pull),
+				"repository":   repositoryObject,
+				"sender":       backfillObject(pull.GetUser()),
+			}
+			events = append(events, &backfillEvent{Repository: repository.GetHTMLURL(), Event: backfillPullEvent, Ref: "refs/pull/" + fmt.Sprint(pull.GetNumber()) + "/head",
+				SHA: pull.GetHead().GetSHA(), Body: body, header: backfillEventHeader(backfillPullEvent, host)})
+		}
+		if resp.NextPage == 0 {
+			return events, nil
+		}
+		options.Page = resp.NextPage
+	}
+}
+
+/* Synthesize the events of a repository */
+func backfillRepository(ctx context.Context, repoURL string, since time.Time, eventTypes map[string]bool) ([]*backfillEvent, error) {
+	client, host, err := newBackfillClient(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	owner, name := repositoryOwnerAndName(repoURL)
+	if owner == "" || name == "" {
+		return nil, fmt.Errorf("URL %s of a repository has no owner and repository", redactURL(repoURL))
+	}
+	repository, resp, err := client.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return nil, gitHubCallError(resp, err, fmt.Sprintf("unable to get repository %s", repoURL))
+	}
+
+	events := make([]*backfillEvent, 0)
+	if eventTypes[backfillPushEvent] {
+		pushes, err := backfillPushes(ctx, client, host, repository, since)
+		events = append(events, pushes...)
+		if err != nil {
+			return events, err
+		}
+	}
+	if eventTypes[backfillPullEvent] {
+		pulls, err := backfillPullRequests(ctx, client, host, repository, since)
+		events = append(events, pulls...)
+		if err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+/* Synthesize the events of the repositories of a backfill request, and send them unless it is a dry-run */
+func backfill(ctx context.Context, request *backfillRequest, now time.Time) (*backfillResult, error) {
+	repositories := request.Repositories
+	if len(repositories) == 0 {
+		repositories = splitIndexURLs(backfillRepositories)
+	}
+	if len(repositories) == 0 {
+		return nil, fmt.Errorf("no repository to backfill")
+	}
+	since := now.Add(-backfillSince)
+	if request.Since != "" {
+		var err error
+		if since, err = parseQueryTime(request.Since, now); err != nil {
+			return nil, fmt.Errorf("invalid since %v: %v", request.Since, err)
+		}
+	}
+	eventTypes := map[string]bool{backfillPushEvent: len(request.Events) == 0, backfillPullEvent: len(request.Events) == 0}
+	for _, event := range request.Events {
+		if _, ok := eventTypes[event]; !ok {
+			return nil, fmt.Errorf("unable to backfill %v events, only push and pull_request events", event)
+		}
+		eventTypes[event] = true
+	}
+
+	result := &backfillResult{Events: make([]*backfillEvent, 0)}
+	for _, repoURL := range repositories {
+		events, err := backfillRepository(ctx, strings.TrimSuffix(repoURL, "/"), since, eventTypes)
+		if err != nil {
+			klog.Errorf("Unable to backfill repository %s: %v", redactURL(repoURL), err)
+			incrementMetric("backfill.errors")
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[repoURL] = err.Error()
+			result.Retry = mergeRetryHints(result.Retry, retryHintOf(err))
+		}
+		result.Events = append(result.Events, events...)
+	}
+
+	for _, event := range result.Events {
+		event.EventID = assignEventID(event.header)
+		if request.DryRun {
+			continue
+		}
+		logReceivedEvent(event.EventID, "Backfill synthesized event", "/admin/backfill", event.header, event.Body)
+		if err := sendInteractiveWebhookMessage(event.header, event.Body); err != nil {
+			event.Error = err.Error()
+			incrementMetric("backfill.errors")
+		} else {
+			result.Sent++
+			incrementMetric("backfill.events." + event.Event)
+		}
+		/* the bodies of sent events are in their messages */
+		event.Body = nil
+	}
+	return result, nil
+}
+
+/* POST /admin/backfill synthesizes and sends the events of the branches and pull requests of repositories */
+func adminBackfillHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	request := &backfillRequest{}
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		writeError(writer, req, codeInvalidJSON, fmt.Sprintf("the backfill request is not JSON: %v", err))
+		return
+	}
+	result, err := backfill(req.Context(), request, time.Now())
+	if err != nil {
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	writeJSON(writer, result)
+}
+
+/*
+backfillCommand implements "kabanero-events backfill [-admin <url>] [-since <time|duration>] [-events push,pull_request]
+[-dry-run] [repository ...]". It asks the admin API to backfill the events of the repositories, or of those of
+-backfillRepositories of the server if none are given, and prints the events synthesized.
+*/
+func backfillCommand(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	admin := flags.String("admin", "http://localhost:9091", "URL of the admin API")
+	since := flags.String("since", "", "only the branches and pull requests active since the given time or duration")
+	events := flags.String("events", "", "comma separated types of the events to synthesize: push, pull_request")
+	dryRun := flags.Bool("dry-run", false, "print the events without sending them")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kabanero-events backfill [-admin <url>] [-since <time|duration>] [-events push,pull_request] [-dry-run] [repository ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	request, err := json.Marshal(&backfillRequest{Repositories: flags.Args(), Since: *since, Events: strings.FieldsFunc(*events, func(r rune) bool { return r == ',' }), DryRun: *dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 2
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*admin, "/")+"/admin/backfill", bytes.NewReader(request))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 2
+	}
+	if token := os.Getenv(ADMINTOKEN); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "backfill: request failed with status %v: %s %v\n", resp.Status, strings.TrimSpace(string(body)), err)
+		return 1
+	}
+	result := &backfillResult{}
+	if err = json.Unmarshal(body, result); err != nil {
+		fmt.Fprintf(os.Stderr, "backfill: %v\n", err)
+		return 1
+	}
+	code := 0
+	for _, event := range result.Events {
+		outcome := "sent"
+		if *dryRun {
+			outcome = "dry-run"
+		} else if event.Error != "" {
+			outcome, code = "failed", 1
+		}
+		fmt.Printf("%-8s %-12s %s %s %s\n", outcome, event.Event, event.Repository, event.Ref, event.SHA)
+	}
+	for repository, message := range result.Errors {
+		fmt.Fprintf(os.Stderr, "backfill: %s: %s\n", repository, message)
+		code = 1
+	}
+	return code
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* A GitHub API serving a repository with an active and a stale branch, and an active and a stale pull request */
+func fakeBackfillGitHub(t *testing.T, now time.Time) *httptest.Server {
+	recent, stale := now.Add(-time.Hour).Format(time.RFC3339), now.Add(-90*24*time.Hour).Format(time.RFC3339)
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") == "" {
+			t.Errorf("request %v without credentials", req.URL.Path)
+		}
+		var response string
+		switch req.URL.Path {
+		case "/api/v3/repos/owner/repo":
+			response = `{"name":"repo","full_name":"owner/repo","html_url":"` + server.URL + `/owner/repo","owner":{"login":"owner"}}`
+		case "/api/v3/repos/owner/repo/branches":
+			if req.URL.Query().Get("page") == "" {
+				writer.Header().Set("Link", `<`+server.URL+`/api/v3/repos/owner/repo/branches?page=2>; rel="next"`)
+				response = `[{"name":"master","commit":{"sha":"a1"}}]`
+			} else {
+				response = `[{"name":"stale","commit":{"sha":"b2"}}]`
+			}
+		case "/api/v3/repos/owner/repo/commits/a1":
+			response = `{"sha":"a1","commit":{"message":"fix","committer":{"name":"dev","date":"` + recent + `"}},"author":{"login":"dev"}}`
+		case "/api/v3/repos/owner/repo/commits/b2":
+			response = `{"sha":"b2","commit":{"message":"old","committer":{"name":"dev","date":"` + stale + `"}}}`
+		case "/api/v3/repos/owner/repo/pulls":
+			response = `[{"number":7,"updated_at":"` + recent + `","head":{"ref":"feature","sha":"c3"},"base":{"ref":"master"},"user":{"login":"dev"}},
+				{"number":3,"updated_at":"` + stale + `","head":{"ref":"old","sha":"d4"}}]`
+		case "/api/v3/repos/owner/missing":
+			http.Error(writer, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		default:
+			t.Errorf("unexpected request %v", req.URL)
+			http.NotFound(writer, req)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(writer, response)
+	}))
+	return server
+}
+
+func TestBackfill(t *testing.T) {
+	savedAuth := gitAuth
+	defer func() { gitAuth = savedAuth }()
+	gitAuth = &gitAuthChains{providers: map[string]gitAuthProvider{"test": &testAuthProvider{creds: &gitCredentials{username: "user", token: "token", source: "test"}}},
+		hosts: map[string][]string{gitAuthAnyHost: {"test"}}}
+	webhook := &failingProvider{}
+	defer setupDeadLetters(t, webhook, &failingProvider{})()
+	now := time.Now()
+	server := fakeBackfillGitHub(t, now)
+	defer server.Close()
+
+	/* a dry-run returns the events without sending them */
+	result, err := backfill(context.Background(), &backfillRequest{Repositories: []string{server.URL + "/owner/repo"}, Since: "720h", DryRun: true}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Events) != 2 || result.Sent != 0 || len(result.Errors) != 0 {
+		t.Fatalf("unexpected result of a dry-run: %+v", result)
+	}
+	push, pull := result.Events[0], result.Events[1]
+	if push.Event != "push" || push.Ref != "refs/heads/master" || push.SHA != "a1" || push.Body["after"] != "a1" || push.Body["before"] != zeroSHA {
+		t.Fatalf("unexpected push event %+v", push)
+	}
+	if repository, _ := push.Body["repository"].(map[string]interface{}); repository["full_name"] != "owner/repo" {
+		t.Fatalf("unexpected repository of push event %v", push.Body["repository"])
+	}
+	if pull.Event != "pull_request" || pull.SHA != "c3" || pull.Body["action"] != "opened" || pull.Body["number"] != 7 {
+		t.Fatalf("unexpected pull_request event %+v", pull)
+	}
+	if push.header.Get("X-Github-Event") != "push" || push.header.Get(backfillHeader) != "true" || push.header.Get("X-Github-Enterprise-Host") == "" {
+		t.Fatalf("unexpected header %v", push.header)
+	}
+	if messages, _ := webhook.sent(); len(messages) != 0 {
+		t.Fatalf("dry-run sent messages %s", messages)
+	}
+
+	/* repositories are those of the flag by default, and errors of a repository do not stop the others */
+	savedRepositories := backfillRepositories
+	defer func() { backfillRepositories = savedRepositories }()
+	backfillRepositories = server.URL + "/owner/missing," + server.URL + "/owner/repo"
+	result, err = backfill(context.Background(), &backfillRequest{Events: []string{"push"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Events) != 1 || result.Sent != 1 || len(result.Errors) != 1 || result.Events[0].Body != nil {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	messages, _ := webhook.sent()
+	if len(messages) != 1 || !strings.Contains(string(messages[0]), `"X-Kabanero-Backfill":["true"]`) || !strings.Contains(string(messages[0]), `"ref":"refs/heads/master"`) {
+		t.Fatalf("unexpected messages %s", messages)
+	}
+
+	for _, request := range []*backfillRequest{{}, {Repositories: []string{server.URL + "/owner/repo"}, Events: []string{"issues"}},
+		{Repositories: []string{server.URL + "/owner/repo"}, Since: "yesterday"}} {
+		backfillRepositories = ""
+		if _, err = backfill(context.Background(), request, now); err == nil {
+			t.Errorf("expected an error backfilling %+v", request)
+		}
+	}
+}
+
+func TestAdminBackfill(t *testing.T) {
+	defer setupDeadLetters(t, &failingProvider{}, &failingProvider{})()
+	now := time.Now()
+	server := fakeBackfillGitHub(t, now)
+	defer server.Close()
+	savedAuth := gitAuth
+	defer func() { gitAuth = savedAuth }()
+	gitAuth = &gitAuthChains{providers: map[string]gitAuthProvider{"test": &testAuthProvider{creds: &gitCredentials{username: "user", token: "token", source: "test"}}},
+		hosts: map[string][]string{gitAuthAnyHost: {"test"}}}
+
+	recorder := httptest.NewRecorder()
+	body := `{"repositories":["` + server.URL + `/owner/repo"],"events":["pull_request"],"dryRun":true}`
+	adminBackfillHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/backfill", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("backfill returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+	result := &backfillResult{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil || len(result.Events) != 1 || result.Events[0].EventID == "" {
+		t.Fatalf("unexpected result %s: %v", recorder.Body.String(), err)
+	}
+
+	recorder = httptest.NewRecorder()
+	adminBackfillHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/backfill", strings.NewReader("{")))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("backfill of invalid JSON returned %v", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	adminBackfillHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/backfill", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET of backfill returned %v", recorder.Code)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Bitbucket webhooks. Push and pull request events of Bitbucket Cloud and Bitbucket Server received on /bitbucket are
+normalized into the message envelope of GitHub webhooks, as GitLab events are. A push of several refs is normalized
+into one push event per ref, as GitHub sends them. The original Bitbucket fields are kept.
+*/
+
+const (
+	bitbucketEventHeader = "X-Event-Key"
+	bitbucketPingEvent   = "diagnostics:ping" // sent by Bitbucket Server to test a webhook
+	zeroSHA              = "0000000000000000000000000000000000000000"
+)
+
+/* GitHub event and pull_request action equivalent to each Bitbucket event key, of Bitbucket Cloud then Server */
+var bitbucketEventTypes = map[string][2]string{
+	"repo:push":             {"push", ""},
+	"pullrequest:created":   {"pull_request", "opened"},
+	"pullrequest:updated":   {"pull_request", "synchronize"},
+	"pullrequest:fulfilled": {"pull_request", "closed"},
+	"pullrequest:rejected":  {"pull_request", "closed"},
+	"repo:refs_changed":     {"push", ""},
+	"pr:opened":             {"pull_request", "opened"},
+	"pr:from_ref_updated":   {"pull_request", "synchronize"},
+	"pr:modified":           {"pull_request", "edited"},
+	"pr:merged":             {"pull_request", "closed"},
+	"pr:declined":           {"pull_request", "closed"},
+	"pr:deleted":            {"pull_request", "closed"},
+}
+
+/*
+Middleware verifying the X-Hub-Signature header of Bitbucket webhook requests: the HMAC SHA256 of the body, keyed with
+the secret in the environment variable BITBUCKET_SECRET. Requests are not verified if the variable is not set.
+*/
+func bitbucketAuthMiddleware(next http.Handler) http.Handler {
+	return hmacVerifier{secretEnv: BITBUCKETSECRET, headers: []string{"X-Hub-Signature"}, prefix: "sha256=", hash: sha256.New}.middleware(next)
+}
+
+/* HTTP listener of Bitbucket webhooks */
+func bitbucketListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, bodies, err := normalizeBitbucketEvent(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process Bitbucket webhook: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	/* the events of a push are of the same repository */
+	if len(bodies) > 0 && !allowRepositoryEvent(writer, req, bodies[0]) {
+		return
+	}
+	delivery := header.Get("X-Github-Delivery")
+	for index, body := range bodies {
+		eventHeader := header
+		if index > 0 && delivery != "" {
+			/* each event of a push of several refs has its own ID */
+			eventHeader = make(http.Header)
+			for key, values := range header {
+				eventHeader[key] = values
+			}
+			eventHeader.Set("X-Github-Delivery", fmt.Sprintf("%v-%v", delivery, index))
+		}
+		logReceivedEvent(assignEventID(eventHeader), "Bitbucket listener received event", req.URL.Path, eventHeader, body)
+		if err = sendWebhookMessage(eventHeader, body); err != nil {
+			break
+		}
+	}
+	respondWebhook(writer, req, err)
+}
+
+/*
+Normalize a Bitbucket event into GitHub events, returning their header and bodies. Pings are normalized into no
+events.
+*/
+func normalizeBitbucketEvent(bitbucketHeader http.Header, body map[string]interface{}) (http.Header, []map[string]interface{}, error) {
+	eventKey := bitbucketHeader.Get(bitbucketEventHeader)
+	if eventKey == "" {
+		eventKey, _ = body["eventKey"].(string)
+	}
+	if eventKey == bitbucketPingEvent {
+		return nil, nil, nil
+	}
+	eventType, ok := bitbucketEventTypes[eventKey]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported Bitbucket event '%v'", eventKey)
+	}
+	/* the events of Bitbucket Cloud are repo:push and pullrequest:*, those of Bitbucket Server repo:refs_changed and pr:* */
+	server := eventKey == "repo:refs_changed" || strings.HasPrefix(eventKey, "pr:")
+
+	header := make(http.Header)
+	for key, values := range bitbucketHeader {
+		header[key] = values
+	}
+	header.Set("X-Github-Event", eventType[0])
+	for _, name := range []string{"X-Request-Uuid", "X-Request-Id"} {
+		if id := bitbucketHeader.Get(name); id != "" && header.Get("X-Github-Delivery") == "" {
+			header.Set("X-Github-Delivery", id)
+		}
+	}
+
+	repository, _ := body["repository"].(map[string]interface{})
+	if repository == nil {
+		return nil, nil, fmt.Errorf("Bitbucket %v event does not contain repository", eventKey)
+	}
+	body["repository"] = bitbucketRepository(repository, server)
+	if actor, ok := body["actor"].(map[string]interface{}); ok {
+		body["sender"] = map[string]interface{}{"login": bitbucketLogin(actor, server)}
+	}
+
+	if eventType[0] == "pull_request" {
+		if err := normalizeBitbucketPullRequest(body, eventType[1], server); err != nil {
+			return nil, nil, err
+		}
+		return header, []map[string]interface{}{body}, nil
+	}
+	bodies := bitbucketPushes(body, server)
+	if len(bodies) == 0 {
+		return nil, nil, fmt.Errorf("Bitbucket %v event does not contain changes", eventKey)
+	}
+	return header, bodies, nil
+}
+
+/* Return the login of a Bitbucket user */
+func bitbucketLogin(user map[string]interface{}, server bool) interface{} {
+	if server {
+		if slug, ok := user["slug"]; ok {
+			return slug
+		}
+		return user["name"]
+	}
+	if nickname, ok := user["nickname"]; ok {
+		return nickname
+	}
+	return user["display_name"]
+}
+
+/* Return a Bitbucket repository, with the fields of a GitHub repository added */
+func bitbucketRepository(repository map[string]interface{}, server bool) map[string]interface{} {
+	links, _ := repository["links"].(map[string]interface{})
+	if server {
+		/* repositories of Bitbucket Server belong to projects, and have a slug unique within the project */
+		slug, _ := repository["slug"].(string)
+		project, _ := repository["project"].(map[string]interface{})
+		key, _ := project["key"].(string)
+		repository["full_name"] = key + "/" + slug
+		repository["name"] = slug
+		repository["owner"] = map[string]interface{}{"login": key}
+		if self, ok := links["self"].([]interface{}); ok && len(self) > 0 {
+			if link, ok := self[0].(map[string]interface{}); ok {
+				repository["html_url"] = link["href"]
+			}
+		}
+		if clones, ok := links["clone"].([]interface{}); ok {
+			for _, clone := range clones {
+				link, _ := clone.(map[string]interface{})
+				switch link["name"] {
+				case "http", "https":
+					repository["clone_url"] = link["href"]
+				case "ssh":
+					repository["ssh_url"] = link["href"]
+				}
+			}
+		}
+		return repository
+	}
+
+	fullName, _ := repository["full_name"].(string)
+	if slash := strings.LastIndex(fullName, "/"); slash > 0 {
+		repository["name"] = fullName[slash+1:]
+		repository["owner"] = map[string]interface{}{"login": fullName[:slash]}
+	}
+	if html, ok := links["html"].(map[string]interface{}); ok {
+		if href, ok := html["href"].(string); ok {
+			repository["html_url"] = href
+			repository["clone_url"] = href + ".git"
+			if parsed, err := url.Parse(href); err == nil && parsed.Host != "" {
+				repository["ssh_url"] = "git@" + parsed.Host + ":" + fullName + ".git"
+			}
+		}
+	}
+	if mainBranch, ok := repository["mainbranch"].(map[string]interface{}); ok {
+		repository["default_branch"] = mainBranch["name"]
+	}
+	return repository
+}
+
+/* Return one GitHub push event per ref changed by a Bitbucket push */
+func bitbucketPushes(body map[string]interface{}, server bool) []map[string]interface{} {
+	var changes []interface{}
+	if server {
+		changes, _ = body["changes"].([]interface{})
+	} else if push, ok := body["push"].(map[string]interface{}); ok {
+		changes, _ = push["changes"].([]interface{})
+	}
+
+	bodies := make([]map[string]interface{}, 0, len(changes))
+	for _, changeObj := range changes {
+		change, ok := changeObj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var ref, before, after string
+		if server {
+			refMap, _ := change["ref"].(map[string]interface{})
+			ref, _ = refMap["id"].(string)
+			before, _ = change["fromHash"].(string)
+			after, _ = change["toHash"].(string)
+		} else {
+			ref, before = bitbucketChangeRef(change["old"])
+			var newRef string
+			newRef, after = bitbucketChangeRef(change["new"])
+			if newRef != "" {
+				ref = newRef
+			}
+		}
+		if ref == "" {
+			continue
+		}
+		if before == "" {
+			before = zeroSHA
+		}
+		if after == "" {
+			after = zeroSHA
+		}
+
+		pushBody := make(map[string]interface{}, len(body)+6)
+		for key, value := range body {
+			pushBody[key] = value
+		}
+		pushBody["ref"] = ref
+		pushBody["before"] = before
+		pushBody["after"] = after
+		pushBody["created"] = before == zeroSHA
+		pushBody["deleted"] = after == zeroSHA
+		if after != zeroSHA {
+			pushBody["head_commit"] = map[string]interface{}{"id": after}
+		}
+		bodies = append(bodies, pushBody)
+	}
+	return bodies
+}
+
+/* Return the full ref name and commit of the old or new state of a ref changed by a Bitbucket Cloud push */
+func bitbucketChangeRef(stateObj interface{}) (string, string) {
+	state, ok := stateObj.(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	name, _ := state["name"].(string)
+	target, _ := state["target"].(map[string]interface{})
+	hash, _ := target["hash"].(string)
+	switch state["type"] {
+	case "branch":
+		return "refs/heads/" + name, hash
+	case "tag":
+		return "refs/tags/" + name, hash
+	}
+	return "", hash
+}
+
+/* Add the fields of a GitHub pull_request event to a Bitbucket pull request event */
+func normalizeBitbucketPullRequest(body map[string]interface{}, action string, server bool) error {
+	var pullRequest, head, base map[string]interface{}
+	var htmlURL interface{}
+	if server {
+		pullRequest, _ = body["pullRequest"].(map[string]interface{})
+		if pullRequest == nil {
+			return fmt.Errorf("Bitbucket pull request event does not contain pullRequest")
+		}
+		head = bitbucketServerPullRequestRef(pullRequest["fromRef"])
+		base = bitbucketServerPullRequestRef(pullRequest["toRef"])
+		if links, ok := pullRequest["links"].(map[string]interface{}); ok {
+			if self, ok := links["self"].([]interface{}); ok && len(self) > 0 {
+				if link, ok := self[0].(map[string]interface{}); ok {
+					htmlURL = link["href"]
+				}
+			}
+		}
+	} else {
+		pullRequest, _ = body["pullrequest"].(map[string]interface{})
+		if pullRequest == nil {
+			return fmt.Errorf("Bitbucket pull request event does not contain pullrequest")
+		}
+		head = bitbucketCloudPullRequestRef(pullRequest["source"])
+		base = bitbucketCloudPullRequestRef(pullRequest["destination"])
+		if links, ok := pullRequest["links"].(map[string]interface{}); ok {
+			if html, ok := links["html"].(map[string]interface{}); ok {
+				htmlURL = html["href"]
+			}
+		}
+	}
+
+	state := "open"
+	if bitbucketState, _ := pullRequest["state"].(string); bitbucketState != "OPEN" {
+		state = "closed"
+	}
+	body["action"] = action
+	body["number"] = pullRequest["id"]
+	body["pull_request"] = map[string]interface{}{
+		"number":   pullRequest["id"],
+		"title":    pullRequest["title"],
+		"state":    state,
+		"html_url": htmlURL,
+		"merged":   pullRequest["state"] == "MERGED",
+		"head":     head,
+		"base":     base,
+	}
+	return nil
+}
+
+/* Return the GitHub head or base of the source or destination of a Bitbucket Cloud pull request */
+func bitbucketCloudPullRequestRef(endpointObj interface{}) map[string]interface{} {
+	ref := make(map[string]interface{})
+	endpoint, _ := endpointObj.(map[string]interface{})
+	if branch, ok := endpoint["branch"].(map[string]interface{}); ok {
+		ref["ref"] = branch["name"]
+	}
+	if commit, ok := endpoint["commit"].(map[string]interface{}); ok {
+		ref["sha"] = commit["hash"]
+	}
+	if repository, ok := endpoint["repository"].(map[string]interface{}); ok {
+		ref["repo"] = bitbucketRepository(repository, false)
+	}
+	return ref
+}
+
+/* Return the GitHub head or base of the fromRef or toRef of a Bitbucket Server pull request */
+func bitbucketServerPullRequestRef(refObj interface{}) map[string]interface{} {
+	ref := make(map[string]interface{})
+	prRef, _ := refObj.(map[string]interface{})
+	ref["ref"] = prRef["displayId"]
+	ref["sha"] = prRef["latestCommit"]
+	if repository, ok := prRef["repository"].(map[string]interface{}); ok {
+		ref["repo"] = bitbucketRepository(repository, true)
+	}
+	return ref
+}
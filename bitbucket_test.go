@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeBitbucketCloudPush(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/bitbucket0/cloud_push.json")
+	header, bodies, err := normalizeBitbucketEvent(http.Header{"X-Event-Key": {"repo:push"}, "X-Request-Uuid": {"a1b2c3"}}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "push" || header.Get("X-Github-Delivery") != "a1b2c3" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("push of 2 refs normalized into %v events", len(bodies))
+	}
+
+	owner, name, htmlURL, ref, err := getRepositoryInfo(bodies[0], "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "kabanero-team" || name != "appsody-hello" || htmlURL != "https://bitbucket.org/kabanero-team/appsody-hello" || ref != "7a6b2f6d1c0e4b3f9a8d5e2c1b0a9f8e7d6c5b4a" {
+		t.Fatalf("unexpected repository info: %v %v %v %v", owner, name, htmlURL, ref)
+	}
+	repository := bodies[0]["repository"].(map[string]interface{})
+	if repository["ssh_url"] != "git@bitbucket.org:kabanero-team/appsody-hello.git" || repository["default_branch"] != "master" {
+		t.Fatalf("unexpected repository: %v", repository)
+	}
+	if bodies[0]["ref"] != "refs/heads/master" || bodies[0]["before"] != "1f2e3d4c5b6a79880f1e2d3c4b5a69788f9e0d1c" || bodies[0]["sender"].(map[string]interface{})["login"] != "jdoe" {
+		t.Fatalf("unexpected push: %v", bodies[0])
+	}
+	if bodies[1]["ref"] != "refs/tags/v1.0.0" || bodies[1]["before"] != zeroSHA || bodies[1]["created"] != true {
+		t.Fatalf("unexpected tag push: %v", bodies[1])
+	}
+	if _, ok := bodies[1]["push"]; !ok {
+		t.Fatal("Bitbucket fields were not kept")
+	}
+}
+
+func TestNormalizeBitbucketServerPush(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/bitbucket0/server_refs_changed.json")
+	header, bodies, err := normalizeBitbucketEvent(http.Header{"X-Event-Key": {"repo:refs_changed"}, "X-Request-Id": {"d4e5f6"}}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "push" || header.Get("X-Github-Delivery") != "d4e5f6" || len(bodies) != 1 {
+		t.Fatalf("unexpected header %v, or %v events", header, len(bodies))
+	}
+	message := map[string]interface{}{BODY: bodies[0]}
+	if messageRepositoryName(message) != "KAB/appsody-hello" {
+		t.Fatalf("unexpected repository name %v", messageRepositoryName(message))
+	}
+	repository := bodies[0]["repository"].(map[string]interface{})
+	if repository["clone_url"] != "https://bitbucket.example.com/scm/kab/appsody-hello.git" || repository["ssh_url"] != "ssh://git@bitbucket.example.com:7999/kab/appsody-hello.git" {
+		t.Fatalf("unexpected repository: %v", repository)
+	}
+	if bodies[0]["ref"] != "refs/heads/master" || bodies[0]["after"] != "7a6b2f6d1c0e4b3f9a8d5e2c1b0a9f8e7d6c5b4a" || bodies[0]["deleted"] != false {
+		t.Fatalf("unexpected push: %v", bodies[0])
+	}
+}
+
+func TestNormalizeBitbucketPullRequest(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/bitbucket0/cloud_pullrequest.json")
+	header, bodies, err := normalizeBitbucketEvent(http.Header{"X-Event-Key": {"pullrequest:created"}}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "pull_request" || len(bodies) != 1 || body["action"] != "opened" {
+		t.Fatalf("unexpected event %v, action %v", header.Get("X-Github-Event"), body["action"])
+	}
+	_, _, _, ref, err := getRepositoryInfo(body, "pull_request")
+	if err != nil || ref != "9c8b7a6f5e4d" {
+		t.Fatalf("unexpected ref %v: %v", ref, err)
+	}
+	pr := body["pull_request"].(map[string]interface{})
+	if pr["state"] != "open" || pr["head"].(map[string]interface{})["ref"] != "health" || pr["base"].(map[string]interface{})["repo"].(map[string]interface{})["full_name"] != "kabanero-team/appsody-hello" {
+		t.Fatalf("unexpected pull_request: %v", pr)
+	}
+
+	/* the event key of Bitbucket Server is also in the body */
+	body = readGitLabEvent(t, "test_data/bitbucket0/server_pr_merged.json")
+	if _, _, err = normalizeBitbucketEvent(http.Header{}, body); err != nil {
+		t.Fatal(err)
+	}
+	pr = body["pull_request"].(map[string]interface{})
+	if body["action"] != "closed" || pr["merged"] != true || pr["state"] != "closed" || pr["head"].(map[string]interface{})["sha"] != "9c8b7a6f5e4d3c2b1a09f8e7d6c5b4a392817065" || pr["base"].(map[string]interface{})["ref"] != "master" {
+		t.Fatalf("unexpected pull_request: %v", pr)
+	}
+
+	if _, bodies, err = normalizeBitbucketEvent(http.Header{"X-Event-Key": {"diagnostics:ping"}}, map[string]interface{}{}); err != nil || len(bodies) != 0 {
+		t.Fatalf("ping normalized into %v events: %v", len(bodies), err)
+	}
+	if _, _, err = normalizeBitbucketEvent(http.Header{"X-Event-Key": {"repo:fork"}}, map[string]interface{}{}); err == nil {
+		t.Fatal("expected error normalizing an unsupported event")
+	}
+}
+
+func TestBitbucketAuthMiddleware(t *testing.T) {
+	os.Setenv(BITBUCKETSECRET, "secret")
+	defer os.Unsetenv(BITBUCKETSECRET)
+	handler := bitbucketAuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+
+	body := `{"eventKey":"repo:refs_changed"}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	for signature, expected := range map[string]int{valid: http.StatusOK, "sha256=0123": http.StatusUnauthorized, "": http.StatusUnauthorized} {
+		req := httptest.NewRequest("POST", "/bitbucket", strings.NewReader(body))
+		if signature != "" {
+			req.Header.Set("X-Hub-Signature", signature)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("signature '%v': status %v, expected %v", signature, recorder.Code, expected)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Support bundles. GET /admin/bundle returns a gzipped tar of the state of the instance for remote debugging: the
+recent audit records, the configuration, with secrets redacted, the digests of the loaded trigger collections, a
+snapshot of the metrics, and a dump of the goroutines.
+*/
+
+const redactedURLPart = "REDACTED" // replaces credentials in URLs, where the brackets of redacted would be escaped
+
+/* Environment variables whose value is included in bundles. The others are only reported as set or not */
+var bundleEnvironment = []string{KABANEROINDEXURL, CANARYKABANEROINDEXURL, SHADOWKABANEROINDEXURL, KUBENAMESPACE, "GH_URL", "GH_USER"}
+
+/* Environment variables holding secrets */
+var bundleSecretEnvironment = []string{WEBHOOKSECRET, GITLABTOKEN, BITBUCKETSECRET, GITEASECRET, AZUREDEVOPSPASSWORD, REGISTRYTOKEN, SLACKSIGNINGSECRET, ALERTMANAGERTOKEN, CLOUDEVENTSTOKEN, ADMINTOKEN, ENVELOPESIGNINGKEY, ANONYMIZESALT, "GH_TOKEN"}
+
+/* A loaded trigger collection, as reported in bundles */
+type bundleCollection struct {
+	Name     string   `json:"name"`
+	Digest   string   `json:"digest"`
+	Triggers []string `json:"triggers"`
+	Disabled []string `json:"disabled"`
+}
+
+/* Remove the credentials and query of a URL, which may contain tokens */
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" {
+		return value
+	}
+	if parsed.User != nil {
+		parsed.User = url.User(redactedURLPart)
+	}
+	if parsed.RawQuery != "" {
+		parsed.RawQuery = redactedURLPart
+	}
+	return parsed.String()
+}
+
+/* Remove the path of a URL, as well as its credentials and query, for webhook URLs whose path is their token */
+func redactURLPath(value string) string {
+	parsed, err := url.Parse(redactURL(value))
+	if err != nil {
+		return redacted
+	}
+	if parsed.Path != "" && parsed.Path != "/" {
+		parsed.Path, parsed.RawPath = "/"+redactedURLPart, ""
+	}
+	return parsed.String()
+}
+
+/* Return a message provider definition with its URLs, header values, and config values redacted */
+func redactMessageProvider(mpd *MessageProviderDefinition) MessageProviderDefinition {
+	provider := *mpd
+	redactProviderURL := redactURL
+	if mpd.ProviderType == "notification" {
+		/* the path of Slack and Teams webhooks is their credential */
+		redactProviderURL = redactURLPath
+	}
+	provider.URL = redactProviderURL(provider.URL)
+	provider.URLs = make([]string, len(mpd.URLs))
+	for index, value := range mpd.URLs {
+		provider.URLs[index] = redactProviderURL(value)
+	}
+	if mpd.Headers != nil {
+		provider.Headers = make(map[string]string, len(mpd.Headers))
+		for name := range mpd.Headers {
+			provider.Headers[name] = redacted
+		}
+	}
+	if mpd.Config != nil {
+		provider.Config = make(map[string]interface{}, len(mpd.Config))
+		for name := range mpd.Config {
+			provider.Config[name] = redacted
+		}
+	}
+	return provider
+}
+
+/* Return the configuration of the instance, with secrets redacted */
+func bundleConfiguration() map[string]interface{} {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = redactURL(f.Value.String())
+	})
+	environment := make(map[string]string)
+	for _, name := range bundleEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			environment[name] = redactURL(value)
+		}
+	}
+	for _, name := range bundleSecretEnvironment {
+		if _, ok := os.LookupEnv(name); ok {
+			environment[name] = redacted
+		}
+	}
+
+	providers := make([]MessageProviderDefinition, 0)
+	destinations := make([]*EventNode, 0)
+	if ed := currentEventProviders(); ed != nil {
+		for _, mpd := range ed.MessageProviders {
+			providers = append(providers, redactMessageProvider(mpd))
+		}
+		destinations = ed.EventDestinations
+	}
+	return map[string]interface{}{
+		"flags":             flags,
+		"environment":       environment,
+		"messageProviders":  providers,
+		"eventDestinations": destinations,
+	}
+}
+
+/* Return the loaded trigger collections */
+func bundleCollections() []bundleCollection {
+	collections := make([]bundleCollection, 0)
+	for _, tp := range loadedTriggerProcessors() {
+		if tp == nil || tp.triggerDef == nil {
+			continue
+		}
+		collection := bundleCollection{Name: tp.name, Digest: tp.digest, Triggers: make([]string, 0), Disabled: make([]string, 0)}
+		for _, triggers := range tp.triggerDef.eventTriggers {
+			for _, trigger := range triggers {
+				name := triggerName(trigger)
+				collection.Triggers = append(collection.Triggers, name)
+				if !tp.isTriggerEnabled(name) {
+					collection.Disabled = append(collection.Disabled, name)
+				}
+			}
+		}
+		collections = append(collections, collection)
+	}
+	return collections
+}
+
+/* Return a snapshot of the exported variables, such as the metrics and memory statistics */
+func bundleMetrics() map[string]json.RawMessage {
+	snapshot := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		/* the command line is in the configuration, redacted */
+		if kv.Key != "cmdline" {
+			snapshot[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+	return snapshot
+}
+
+/* Write a support bundle as a gzipped tar */
+func writeBundle(writer *bytes.Buffer, now time.Time) error {
+	gz := gzip.NewWriter(writer)
+	archive := tar.NewWriter(gz)
+	dir := "kabanero-events-" + now.UTC().Format("20060102T150405Z") + "/"
+
+	addFile := func(name string, data []byte) error {
+		header := &tar.Header{Name: dir + name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+	addJSON := func(name string, value interface{}) error {
+		data, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return fmt.Errorf("unable to marshal %v: %v", name, err)
+		}
+		return addFile(name, data)
+	}
+
+	hostname, _ := os.Hostname()
+	info := map[string]interface{}{"time": now.UTC(), "hostname": hostname, "goVersion": runtime.Version(), "goroutines": runtime.NumGoroutine()}
+	if err := addJSON("bundle.json", info); err != nil {
+		return err
+	}
+	if err := addJSON("audit.json", recentAuditRecords()); err != nil {
+		return err
+	}
+	if err := addJSON("config.json", bundleConfiguration()); err != nil {
+		return err
+	}
+	if err := addJSON("collections.json", bundleCollections()); err != nil {
+		return err
+	}
+	if err := addJSON("metrics.json", bundleMetrics()); err != nil {
+		return err
+	}
+	var goroutines bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, 2); err != nil {
+		return err
+	}
+	if err := addFile("goroutines.txt", goroutines.Bytes()); err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+/* GET /admin/bundle exports a support bundle */
+func adminBundleHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	now := time.Now()
+	var bundle bytes.Buffer
+	if err := writeBundle(&bundle, now); err != nil {
+		klog.Errorf("Unable to write support bundle: %v", err)
+		writeError(writer, req, codeInternalError, err.Error())
+		return
+	}
+	incrementMetric("admin.bundles")
+	writer.Header().Set("Content-Type", "application/gzip")
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=kabanero-events-%v.tar.gz", now.UTC().Format("20060102T150405Z")))
+	writer.Write(bundle.Bytes())
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Time windows and freeze calendars. Triggers check with inTimeWindow whether an event is received within a window,
+such as business hours, and with inFreeze whether it is received during a change freeze, to suppress automatic
+deployments without changing the collection. The freeze calendars are the keys of the ConfigMap named by
+-freezeConfigMap, in the namespace of kabanero-events, which is read again every minute so that freezes are declared
+without restarting. Each key holds the list of periods of its calendar. Checking a calendar that can not be read is
+an error, so that deployments are not made because a freeze could not be checked.
+*/
+
+const freezeRefreshInterval = time.Minute
+
+var freezeConfigMap string // name of the ConfigMap holding the freeze calendars
+
+/* Return the current time. Replaced in tests */
+var calendarNow = time.Now
+
+/* A period of a freeze calendar */
+type freezePeriod struct {
+	Start  time.Time `yaml:"start"`
+	End    time.Time `yaml:"end"`
+	Reason string    `yaml:"reason,omitempty"`
+}
+
+/* The freeze calendars, by name */
+type freezeCalendars struct {
+	mutex     sync.Mutex
+	calendars map[string][]freezePeriod
+	err       error // error reading the ConfigMap, if it could not be read
+}
+
+var calendars = &freezeCalendars{}
+
+/* Parse the data of the freeze ConfigMap */
+func parseFreezeCalendars(data map[string]interface{}) (map[string][]freezePeriod, error) {
+	parsed := make(map[string][]freezePeriod)
+	for name, value := range data {
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("freeze calendar %s is not a string", name)
+		}
+		periods := make([]freezePeriod, 0)
+		if err := yaml.Unmarshal([]byte(str), &periods); err != nil {
+			return nil, fmt.Errorf("unable to parse freeze calendar %s: %v", name, err)
+		}
+		for _, period := range periods {
+			if period.Start.IsZero() || period.End.IsZero() || !period.End.After(period.Start) {
+				return nil, fmt.Errorf("period %v - %v of freeze calendar %s does not end after it starts", period.Start, period.End, name)
+			}
+		}
+		parsed[name] = periods
+	}
+	return parsed, nil
+}
+
+func (fc *freezeCalendars) set(parsed map[string][]freezePeriod, err error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if err != nil {
+		fc.err = err
+		return
+	}
+	fc.calendars, fc.err = parsed, nil
+}
+
+/* Return the period of a calendar including a time, or nil if the time is not in a freeze */
+func (fc *freezeCalendars) freeze(name string, now time.Time) (*freezePeriod, error) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	if fc.err != nil {
+		return nil, fc.err
+	}
+	if fc.calendars == nil && freezeConfigMap == "" {
+		return nil, fmt.Errorf("no freeze calendars are configured. Set -freezeConfigMap")
+	}
+	if fc.calendars == nil {
+		return nil, fmt.Errorf("the freeze calendars of ConfigMap %s are not loaded yet", freezeConfigMap)
+	}
+	periods, ok := fc.calendars[name]
+	if !ok {
+		return nil, fmt.Errorf("freeze calendar %s is not defined in ConfigMap %s", name, freezeConfigMap)
+	}
+	for index := range periods {
+		if !now.Before(periods[index].Start) && now.Before(periods[index].End) {
+			return &periods[index], nil
+		}
+	}
+	return nil, nil
+}
+
+/* Read the freeze calendars from their ConfigMap every minute. Does not return */
+func watchFreezeCalendars(dynInterf dynamic.Interface, namespace string) {
+	gvr := schema.GroupVersionResource{
+		Group:    "",
+		Version:  V1,
+		Resource: CONFIGMAPS,
+	}
+	intf := dynInterf.Resource(gvr).Namespace(namespace)
+	for {
+		obj, err := intf.Get(freezeConfigMap, metav1.GetOptions{})
+		if err != nil {
+			klog.Errorf("Unable to read the freeze calendars of ConfigMap %v: %v", freezeConfigMap, err)
+			calendars.set(nil, err)
+		} else {
+			data, _ := obj.Object[DATA].(map[string]interface{})
+			parsed, err := parseFreezeCalendars(data)
+			if err != nil {
+				klog.Errorf("Unable to read the freeze calendars of ConfigMap %v: %v", freezeConfigMap, err)
+			} else if klog.V(4) {
+				klog.Infof("Read %v freeze calendars from ConfigMap %v", len(parsed), freezeConfigMap)
+			}
+			calendars.set(parsed, err)
+		}
+		time.Sleep(freezeRefreshInterval)
+	}
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+/* Parse the days of a time window, such as Mon-Fri or Sat,Sun */
+func parseWeekdays(days string) (map[time.Weekday]bool, error) {
+	parsed := make(map[time.Weekday]bool)
+	for _, item := range strings.Split(strings.ToLower(days), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return nil, fmt.Errorf("unknown day %q", bounds[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			parsed[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return parsed, nil
+}
+
+/* Parse a time of day, such as 09:30, as minutes since midnight */
+func parseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("time %q is not HH:MM", value)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+/*
+Return whether a time is in a window: optional days, a time range, and an optional time zone, such as
+"Mon-Fri 09:00-17:00 America/New_York". A range ending before it starts, such as 22:00-06:00, ends the next day.
+*/
+func inTimeWindow(window string, now time.Time) (bool, error) {
+	fields := strings.Fields(window)
+	if len(fields) == 0 || len(fields) > 3 {
+		return false, fmt.Errorf("time window %q is not [days] HH:MM-HH:MM [time zone]", window)
+	}
+	var days map[time.Weekday]bool
+	var err error
+	if !strings.Contains(fields[0], ":") {
+		if days, err = parseWeekdays(fields[0]); err != nil {
+			return false, fmt.Errorf("time window %q: %v", window, err)
+		}
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return false, fmt.Errorf("time window %q has no time range", window)
+	}
+	bounds := strings.SplitN(fields[0], "-", 2)
+	if len(bounds) != 2 {
+		return false, fmt.Errorf("time window %q has no time range", window)
+	}
+	start, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return false, fmt.Errorf("time window %q: %v", window, err)
+	}
+	end, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return false, fmt.Errorf("time window %q: %v", window, err)
+	}
+	location := time.UTC
+	if len(fields) == 2 {
+		if location, err = time.LoadLocation(fields[1]); err != nil {
+			return false, fmt.Errorf("time window %q: %v", window, err)
+		}
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if end <= start && minute < end {
+		/* in the part of the range after midnight, which starts the previous day */
+		day = (day + 6) % 7
+	}
+	if days != nil && !days[day] {
+		return false, nil
+	}
+	if end > start {
+		return minute >= start && minute < end, nil
+	}
+	return minute >= start || minute < end, nil
+}
+
+/* implementation of inTimeWindow for CEL */
+func inTimeWindowCEL(param ref.Val) ref.Val {
+	window, ok := param.(types.String)
+	if !ok {
+		return types.ValOrErr(param, "unexpected type '%v' passed to inTimeWindow", param.Type())
+	}
+	in, err := inTimeWindow(string(window), calendarNow())
+	if err != nil {
+		return types.NewErr("inTimeWindow: %v", err)
+	}
+	return types.Bool(in)
+}
+
+/* implementation of inFreeze for CEL */
+func inFreezeCEL(param ref.Val) ref.Val {
+	name, ok := param.(types.String)
+	if !ok {
+		return types.ValOrErr(param, "unexpected type '%v' passed to inFreeze", param.Type())
+	}
+	period, err := calendars.freeze(string(name), calendarNow())
+	if err != nil {
+		return types.NewErr("inFreeze: %v", err)
+	}
+	if period != nil && klog.V(4) {
+		klog.Infof("In freeze %v - %v of calendar %v: %v", period.Start, period.End, name, period.Reason)
+	}
+	return types.Bool(period != nil)
+}
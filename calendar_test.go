@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/cel-go/common/types"
+)
+
+func TestInTimeWindow(t *testing.T) {
+	/* Wednesday */
+	now := time.Date(2019, time.November, 6, 14, 30, 0, 0, time.UTC)
+	for window, expected := range map[string]bool{
+		"09:00-17:00":                        true,
+		"Mon-Fri 09:00-17:00":                true,
+		"Sat,Sun 09:00-17:00":                false,
+		"Mon-Fri 09:00-17:00 Asia/Tokyo":     false,
+		"Wed 22:00-06:00 America/New_York":   false,
+		"Wed 22:00-06:00 Pacific/Kiritimati": true,
+		"Fri-Mon 00:00-23:59":                false,
+	} {
+		in, err := inTimeWindow(window, now)
+		if err != nil || in != expected {
+			t.Errorf("inTimeWindow(%q) returned %v, %v instead of %v", window, in, err, expected)
+		}
+	}
+	for _, invalid := range []string{"", "Mon-Fri", "Monday 09:00-17:00", "9-17", "09:00-17:00 Mars/Olympus"} {
+		if _, err := inTimeWindow(invalid, now); err == nil {
+			t.Errorf("time window %q was accepted", invalid)
+		}
+	}
+}
+
+func TestFreezeCalendars(t *testing.T) {
+	savedCalendars, savedConfigMap, savedNow := calendars, freezeConfigMap, calendarNow
+	defer func() { calendars, freezeConfigMap, calendarNow = savedCalendars, savedConfigMap, savedNow }()
+	calendars, freezeConfigMap = &freezeCalendars{}, "freezes"
+
+	if _, err := calendars.freeze("production", time.Now()); err == nil {
+		t.Fatal("a calendar was checked before the ConfigMap was read")
+	}
+	parsed, err := parseFreezeCalendars(map[string]interface{}{
+		"production": "- start: 2019-12-20T00:00:00Z\n  end: 2020-01-06T00:00:00Z\n  reason: year end\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calendars.set(parsed, nil)
+
+	for now, expected := range map[time.Time]bool{
+		time.Date(2019, time.December, 24, 0, 0, 0, 0, time.UTC): true,
+		time.Date(2020, time.January, 6, 0, 0, 0, 0, time.UTC):   false,
+	} {
+		calendarNow = func() time.Time { return now }
+		if in := inFreezeCEL(types.String("production")); in != types.Bool(expected) {
+			t.Errorf("inFreeze returned %v at %v", in, now)
+		}
+	}
+
+	/* unknown calendars and unreadable ConfigMaps are errors */
+	if _, err = calendars.freeze("staging", time.Now()); err == nil {
+		t.Error("an unknown calendar was checked")
+	}
+	calendars.set(nil, fmt.Errorf("configmaps \"freezes\" is forbidden"))
+	if _, err = calendars.freeze("production", time.Now()); err == nil {
+		t.Error("a calendar was checked after the ConfigMap could not be read")
+	}
+	if _, err = parseFreezeCalendars(map[string]interface{}{"production": "- start: 2020-01-06T00:00:00Z\n  end: 2019-12-20T00:00:00Z\n"}); err == nil {
+		t.Error("a period ending before it starts was accepted")
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/* environment variables for canary rollout */
+const (
+	CANARYKABANEROINDEXURL = "CANARY_KABANERO_INDEX_URL" // use the given URL to fetch the kabanero index of the canary collection
+)
+
+var (
+	canaryIndexURL string            // URL of the Kabanero index of the canary collection
+	canaryPercent  int               // percentage of repositories whose events are processed by the canary collection
+	canaryRepos    string            // comma separated list of repository URLs whose events are processed by the canary collection
+	canaryRepoSet  map[string]bool   // canaryRepos, parsed
+	canaryProc     *triggerProcessor // processor of the canary collection. nil if there is no canary
+)
+
+/* Validate and parse the canary routing flags */
+func initializeCanaryRouting() error {
+	if canaryPercent < 0 || canaryPercent > 100 {
+		return fmt.Errorf("canaryPercent must be between 0 and 100, but is %v", canaryPercent)
+	}
+	canaryRepoSet = make(map[string]bool)
+	for _, repo := range strings.Split(canaryRepos, ",") {
+		repo = strings.TrimSuffix(strings.TrimSpace(repo), "/")
+		if repo != "" {
+			canaryRepoSet[strings.ToLower(repo)] = true
+		}
+	}
+	klog.Infof("Routing %v%% of repositories and repositories %v through the canary trigger collection", canaryPercent, canaryRepos)
+	return nil
+}
+
+/*
+Select the processor for a message received from an event source.
+Messages routed to another Kabanero instance are processed by its collection.
+Messages are routed to the canary collection if it has triggers for the event source, and either the repository of the
+message is listed in canaryRepos, or the repository falls within canaryPercent. Routing is by repository so that all
+events of a repository are processed by the same collection version.
+*/
+func selectTriggerProcessor(message map[string]interface{}, eventSource string) *triggerProcessor {
+	if instance := selectKabaneroInstance(message); instance != nil {
+		return instance.proc
+	}
+	triggerProc, canaryProc, _ := currentCollections()
+	if canaryProc == nil {
+		return triggerProc
+	}
+	if _, ok := canaryProc.triggerDef.eventTriggers[eventSource]; !ok {
+		return triggerProc
+	}
+
+	repo := strings.ToLower(strings.TrimSuffix(messageRepositoryURL(message), "/"))
+	if repo == "" {
+		return triggerProc
+	}
+	if canaryRepoSet[repo] {
+		return canaryProc
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(repo))
+	if int(hash.Sum32()%100) < canaryPercent {
+		return canaryProc
+	}
+	return triggerProc
+}
+
+/* Return the URL of the repository of a webhook message, or empty string if unknown */
+func messageRepositoryURL(message map[string]interface{}) string {
+	body, ok := message[BODY].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	repository, ok := body["repository"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	htmlURL, _ := repository["html_url"].(string)
+	return htmlURL
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func canaryTestMessage(repo string) map[string]interface{} {
+	return map[string]interface{}{
+		HEADER: map[string]interface{}{},
+		BODY: map[string]interface{}{
+			"repository": map[string]interface{}{"html_url": repo},
+		},
+	}
+}
+
+func TestSelectTriggerProcessor(t *testing.T) {
+	savedTriggerProc, savedCanaryProc, savedPercent, savedRepos := triggerProc, canaryProc, canaryPercent, canaryRepos
+	defer func() {
+		triggerProc, canaryProc, canaryPercent, canaryRepos = savedTriggerProc, savedCanaryProc, savedPercent, savedRepos
+	}()
+
+	triggerProc = newTriggerProcessor()
+	if err := triggerProc.initialize(TRIGGER10); err != nil {
+		t.Fatal(err)
+	}
+	canaryProc = newTriggerProcessor()
+	canaryProc.name = "canary"
+	if err := canaryProc.initialize(TRIGGER10); err != nil {
+		t.Fatal(err)
+	}
+
+	/* only listed repositories */
+	canaryPercent = 0
+	canaryRepos = "https://github.com/org/canary/, https://github.com/org/other"
+	if err := initializeCanaryRouting(); err != nil {
+		t.Fatal(err)
+	}
+	if tp := selectTriggerProcessor(canaryTestMessage("https://github.com/Org/canary"), "default"); tp != canaryProc {
+		t.Fatalf("Expected listed repository to be routed to the canary, but got %v", tp.name)
+	}
+	if tp := selectTriggerProcessor(canaryTestMessage("https://github.com/org/stable"), "default"); tp != triggerProc {
+		t.Fatalf("Expected unlisted repository to be routed to the active collection, but got %v", tp.name)
+	}
+	if tp := selectTriggerProcessor(canaryTestMessage("https://github.com/org/canary"), "unknown"); tp != triggerProc {
+		t.Fatalf("Expected event source without canary triggers to be routed to the active collection, but got %v", tp.name)
+	}
+
+	/* percentages */
+	canaryRepos = ""
+	for _, percent := range []int{0, 100} {
+		canaryPercent = percent
+		if err := initializeCanaryRouting(); err != nil {
+			t.Fatal(err)
+		}
+		expected := triggerProc
+		if percent == 100 {
+			expected = canaryProc
+		}
+		if tp := selectTriggerProcessor(canaryTestMessage("https://github.com/org/stable"), "default"); tp != expected {
+			t.Fatalf("Expected %v with canaryPercent %v, but got %v", expected.name, percent, tp.name)
+		}
+	}
+
+	canaryPercent = 101
+	if err := initializeCanaryRouting(); err == nil {
+		t.Fatal("Expected error for canaryPercent greater than 100")
+	}
+}
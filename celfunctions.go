@@ -0,0 +1,281 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
+)
+
+/*
+String, encoding and time functions of triggers. regexCaptures returns the capture groups of a regular expression,
+base64Encode and base64Decode convert strings to and from base64, jsonPath extracts a field of a message, or of a JSON
+string, by a path such as body.commits[0].id, parseURL splits a URL into its parts, hash returns the hex digest of a
+string, and formatTime formats a timestamp, or an RFC 3339 string, with a Go layout.
+*/
+
+var (
+	regexpMutex     sync.Mutex
+	compiledRegexps = make(map[string]*regexp.Regexp) // by pattern
+)
+
+/* Algorithms of the hash function */
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+/* Return a regular expression, compiling it the first time */
+func getCompiledRegexp(pattern string) (*regexp.Regexp, error) {
+	regexpMutex.Lock()
+	defer regexpMutex.Unlock()
+	if re, ok := compiledRegexps[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	compiledRegexps[pattern] = re
+	return re, nil
+}
+
+/* Decode base64, standard or URL safe, with or without padding */
+func decodeBase64(str string) ([]byte, error) {
+	/* line breaks, as in the content of files returned by GitHub, are ignored */
+	str = strings.TrimRight(strings.NewReplacer("\n", "", "\r", "").Replace(str), "=")
+	decoded, err := base64.RawStdEncoding.DecodeString(str)
+	if err != nil {
+		decoded, err = base64.RawURLEncoding.DecodeString(str)
+	}
+	return decoded, err
+}
+
+/* Split a path such as body.commits[0].id into the keys of maps and the indexes of lists */
+func splitJSONPath(path string) ([]interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	elements := make([]interface{}, 0)
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		index := ""
+		if bracket := strings.Index(part, "["); bracket >= 0 {
+			key, index = part[:bracket], part[bracket:]
+		}
+		if key != "" {
+			elements = append(elements, key)
+		} else if index == "" {
+			return nil, fmt.Errorf("path %q has an empty element", path)
+		}
+		for index != "" {
+			end := strings.Index(index, "]")
+			if !strings.HasPrefix(index, "[") || end < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index", path)
+			}
+			i, err := strconv.Atoi(index[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index %q", path, index[1:end])
+			}
+			elements = append(elements, i)
+			index = index[end+1:]
+		}
+	}
+	return elements, nil
+}
+
+/* Return the value at a path, or false if the value does not have the path */
+func lookupJSONPath(value ref.Val, elements []interface{}) (ref.Val, bool) {
+	for _, element := range elements {
+		switch key := element.(type) {
+		case string:
+			mapper, ok := value.(traits.Mapper)
+			if !ok {
+				return nil, false
+			}
+			if value, ok = mapper.Find(types.String(key)); !ok {
+				return nil, false
+			}
+		case int:
+			lister, ok := value.(traits.Lister)
+			if !ok || int64(key) >= int64(lister.Size().(types.Int)) {
+				return nil, false
+			}
+			value = lister.Get(types.Int(key))
+		}
+	}
+	return value, true
+}
+
+/* implementation of regexCaptures for CEL */
+func regexCapturesCEL(strVal ref.Val, patternVal ref.Val) ref.Val {
+	str, ok := strVal.(types.String)
+	if !ok {
+		return types.ValOrErr(strVal, "unexpected type '%v' passed as first parameter to function regexCaptures", strVal.Type())
+	}
+	pattern, ok := patternVal.(types.String)
+	if !ok {
+		return types.ValOrErr(patternVal, "unexpected type '%v' passed as second parameter to function regexCaptures", patternVal.Type())
+	}
+	re, err := getCompiledRegexp(string(pattern))
+	if err != nil {
+		return types.NewErr("regexCaptures: %v", err)
+	}
+	captures := re.FindStringSubmatch(string(str))
+	if captures == nil {
+		captures = []string{}
+	}
+	return types.NewStringList(types.DefaultTypeAdapter, captures)
+}
+
+/* implementation of base64Encode for CEL */
+func base64EncodeCEL(param ref.Val) ref.Val {
+	str, ok := param.(types.String)
+	if !ok {
+		return types.ValOrErr(param, "unexpected type '%v' passed to base64Encode", param.Type())
+	}
+	return types.String(base64.StdEncoding.EncodeToString([]byte(str)))
+}
+
+/* implementation of base64Decode for CEL */
+func base64DecodeCEL(param ref.Val) ref.Val {
+	str, ok := param.(types.String)
+	if !ok {
+		return types.ValOrErr(param, "unexpected type '%v' passed to base64Decode", param.Type())
+	}
+	decoded, err := decodeBase64(string(str))
+	if err != nil {
+		return types.NewErr("base64Decode: %v", err)
+	}
+	return types.String(decoded)
+}
+
+/* implementation of jsonPath for CEL, with an optional default value for missing paths */
+func jsonPathCEL(values ...ref.Val) ref.Val {
+	if len(values) != 2 && len(values) != 3 {
+		return types.NewErr("unexpected number of parameters %v passed to function jsonPath", len(values))
+	}
+	path, ok := values[1].(types.String)
+	if !ok {
+		return types.ValOrErr(values[1], "unexpected type '%v' passed as second parameter to function jsonPath", values[1].Type())
+	}
+	elements, err := splitJSONPath(string(path))
+	if err != nil {
+		return types.NewErr("jsonPath: %v", err)
+	}
+	value := values[0]
+	if str, ok := value.(types.String); ok {
+		var parsed interface{}
+		if err = json.Unmarshal([]byte(str), &parsed); err != nil {
+			return types.NewErr("jsonPath: %v", err)
+		}
+		value = types.DefaultTypeAdapter.NativeToValue(parsed)
+	}
+	if found, ok := lookupJSONPath(value, elements); ok {
+		return found
+	}
+	if len(values) == 3 {
+		return values[2]
+	}
+	return types.NewErr("jsonPath: no value at path %v", path)
+}
+
+/* implementation of parseURL for CEL */
+func parseURLCEL(param ref.Val) ref.Val {
+	str, ok := param.(types.String)
+	if !ok {
+		return types.ValOrErr(param, "unexpected type '%v' passed to parseURL", param.Type())
+	}
+	parsed, err := url.Parse(string(str))
+	if err != nil {
+		return types.NewErr("parseURL: %v", err)
+	}
+	query := make(map[string]interface{})
+	for key, values := range parsed.Query() {
+		query[key] = values
+	}
+	ret := map[string]interface{}{
+		"scheme":   parsed.Scheme,
+		"user":     parsed.User.Username(),
+		"host":     parsed.Host,
+		"hostname": parsed.Hostname(),
+		"port":     parsed.Port(),
+		"path":     parsed.Path,
+		"query":    query,
+		"fragment": parsed.Fragment,
+	}
+	return types.NewDynamicMap(types.DefaultTypeAdapter, ret)
+}
+
+/* implementation of hash for CEL */
+func hashCEL(strVal ref.Val, algorithmVal ref.Val) ref.Val {
+	str, ok := strVal.(types.String)
+	if !ok {
+		return types.ValOrErr(strVal, "unexpected type '%v' passed as first parameter to function hash", strVal.Type())
+	}
+	algorithm, ok := algorithmVal.(types.String)
+	if !ok {
+		return types.ValOrErr(algorithmVal, "unexpected type '%v' passed as second parameter to function hash", algorithmVal.Type())
+	}
+	newHash, ok := hashAlgorithms[strings.ToLower(string(algorithm))]
+	if !ok {
+		return types.NewErr("hash: unknown algorithm %q", string(algorithm))
+	}
+	h := newHash()
+	h.Write([]byte(str))
+	return types.String(hex.EncodeToString(h.Sum(nil)))
+}
+
+/* implementation of formatTime for CEL */
+func formatTimeCEL(timeVal ref.Val, layoutVal ref.Val) ref.Val {
+	layout, ok := layoutVal.(types.String)
+	if !ok {
+		return types.ValOrErr(layoutVal, "unexpected type '%v' passed as second parameter to function formatTime", layoutVal.Type())
+	}
+	var t time.Time
+	var err error
+	switch value := timeVal.(type) {
+	case types.Timestamp:
+		t, err = ptypes.Timestamp(value.Timestamp)
+	case types.String:
+		t, err = time.Parse(time.RFC3339, string(value))
+	default:
+		return types.ValOrErr(timeVal, "unexpected type '%v' passed as first parameter to function formatTime", timeVal.Type())
+	}
+	if err != nil {
+		return types.NewErr("formatTime: %v", err)
+	}
+	return types.String(t.UTC().Format(string(layout)))
+}
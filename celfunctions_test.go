@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+/* Evaluate the body of a trigger for a message, returning its variables */
+func evaluateFunctionsTrigger(body []interface{}, message map[string]interface{}) (map[string]interface{}, error) {
+	trigger := map[interface{}]interface{}{
+		NAME:        "functions",
+		EVENTSOURCE: "default",
+		INPUT:       MESSAGE,
+		BODY:        body,
+	}
+	tp := &triggerProcessor{name: "functions"}
+	tp.triggerDef = &eventTriggerDefinition{
+		setting:       []map[interface{}]interface{}{{"dryrun": true}},
+		eventTriggers: map[string][]map[interface{}]interface{}{"default": {trigger}},
+		functions:     make(map[string]map[interface{}]interface{}),
+		macros:        make(map[string]*celMacro),
+	}
+	result, err := tp.evaluateMessage(message, "default", evalOptions{dryrun: true})
+	if err != nil {
+		return nil, err
+	}
+	return result.variables[0], nil
+}
+
+func TestStringFunctionsCEL(t *testing.T) {
+	message := map[string]interface{}{
+		"ref":     "refs/tags/v1.2.3",
+		"content": "c3RhY2s6IG5vZGVqcw==\n",
+		"url":     "https://user@github.example.com:8443/org/app.git?ref=main&ref=dev#readme",
+		"body": map[string]interface{}{
+			"commits": []interface{}{map[string]interface{}{"id": "abc"}, map[string]interface{}{"id": "def"}},
+			"payload": `{"labels": [{"name": "deploy"}]}`,
+		},
+		"created": "2019-12-11T15:04:05-05:00",
+	}
+	variables, err := evaluateFunctionsTrigger([]interface{}{
+		map[interface{}]interface{}{"tag": `regexCaptures(message.ref, "^refs/tags/v([0-9]+)\\.([0-9]+)")[2]`},
+		map[interface{}]interface{}{"noMatch": `size(regexCaptures(message.ref, "^refs/heads/")) == 0`},
+		map[interface{}]interface{}{"encoded": `base64Encode("stack: nodejs")`},
+		map[interface{}]interface{}{"decoded": `base64Decode(message.content)`},
+		map[interface{}]interface{}{"commit": `jsonPath(message, "body.commits[1].id")`},
+		map[interface{}]interface{}{"label": `jsonPath(message.body.payload, "$.labels[0].name")`},
+		map[interface{}]interface{}{"missing": `jsonPath(message, "body.commits[2].id", "none")`},
+		map[interface{}]interface{}{"host": `parseURL(message.url).hostname + ":" + parseURL(message.url).port`},
+		map[interface{}]interface{}{"branches": `parseURL(message.url).query.ref[1]`},
+		map[interface{}]interface{}{"digest": `hash("kabanero", "sha256")`},
+		map[interface{}]interface{}{"day": `formatTime(message.created, "2006-01-02 15:04")`},
+		map[interface{}]interface{}{"epoch": `formatTime(timestamp("1970-01-01T00:00:00Z"), "Jan 2 2006")`},
+	}, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"tag":      "2",
+		"noMatch":  true,
+		"encoded":  "c3RhY2s6IG5vZGVqcw==",
+		"decoded":  "stack: nodejs",
+		"commit":   "def",
+		"label":    "deploy",
+		"missing":  "none",
+		"host":     "github.example.com:8443",
+		"branches": "dev",
+		"digest":   "f0aa2fe44e07102aa4e1fea7511438d8120edece114dd091c0f48d5d353b1d7d",
+		"day":      "2019-12-11 20:04",
+		"epoch":    "Jan 1 1970",
+	}
+	for name, value := range expected {
+		if variables[name] != value {
+			t.Errorf("variable %s is %v, expected %v", name, variables[name], value)
+		}
+	}
+
+	/* invalid parameters are errors */
+	for _, expression := range []string{
+		`regexCaptures(message.ref, "(")`,
+		`base64Decode("not base64!")`,
+		`jsonPath(message, "body.commits[2].id")`,
+		`jsonPath(message, "body..id")`,
+		`hash(message.ref, "crc32")`,
+		`formatTime("yesterday", "2006")`,
+	} {
+		if _, err = evaluateFunctionsTrigger([]interface{}{map[interface{}]interface{}{"result": expression}}, message); err == nil {
+			t.Errorf("expression %s was evaluated", expression)
+		}
+	}
+}
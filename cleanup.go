@@ -0,0 +1,176 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Cleanup of the resources created by triggers. Resources with the standard labels are deleted once they are older than
+the retention of their kind. Resources without the labels, including those created before the labels were introduced,
+are never deleted.
+*/
+
+var (
+	cleanupRetention  string        // comma separated <apiVersion>/<kind>=<duration>. Cleanup is disabled if empty
+	cleanupInterval   time.Duration // time between cleanups
+	cleanupNamespaces string        // comma separated namespaces to clean up. All namespaces if empty
+)
+
+/* Retention of a kind of resource */
+type retentionPolicy struct {
+	gvr       schema.GroupVersionResource // resource guessed from the kind. The resource resolved through discovery is used to clean up
+	kind      string
+	retention time.Duration
+}
+
+/* Parse the retention flag, such as tekton.dev/v1alpha1/PipelineRun=72h,v1/ConfigMap=24h */
+func parseRetention(value string) ([]*retentionPolicy, error) {
+	policies := make([]*retentionPolicy, 0)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equals := strings.Index(entry, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("retention %v is not of the form <apiVersion>/<kind>=<duration>", entry)
+		}
+		typeName, durationStr := entry[:equals], entry[equals+1:]
+		retention, err := time.ParseDuration(durationStr)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("retention %v does not have a positive duration", entry)
+		}
+		slash := strings.LastIndex(typeName, "/")
+		if slash <= 0 || slash == len(typeName)-1 {
+			return nil, fmt.Errorf("retention %v is not of the form <apiVersion>/<kind>=<duration>", entry)
+		}
+		apiVersion, kind := typeName[:slash], typeName[slash+1:]
+		gv, err := schema.ParseGroupVersion(apiVersion)
+		if err != nil {
+			return nil, fmt.Errorf("retention %v has an invalid apiVersion: %v", entry, err)
+		}
+		policies = append(policies, &retentionPolicy{gvr: gv.WithResource(kindToPlural(kind)), kind: kind, retention: retention})
+	}
+	return policies, nil
+}
+
+/* Return the resources created by triggers that are older than the retention */
+func expiredResources(items []unstructured.Unstructured, retention time.Duration, now time.Time) []unstructured.Unstructured {
+	expired := make([]unstructured.Unstructured, 0)
+	for _, item := range items {
+		if _, ok := item.GetLabels()[LABELCOLLECTION]; !ok {
+			continue
+		}
+		created := item.GetCreationTimestamp()
+		if created.IsZero() || now.Sub(created.Time) < retention {
+			continue
+		}
+		expired = append(expired, item)
+	}
+	return expired
+}
+
+/* Delete the expired resources of one kind */
+func cleanupKind(client dynamic.Interface, policy *retentionPolicy, namespace string, now time.Time) (int, error) {
+	mapping, err := resolveResource(policy.gvr.GroupVersion().WithKind(policy.kind))
+	if err != nil {
+		return 0, err
+	}
+	gvr := mapping.gvr
+	list, err := client.Resource(gvr).Namespace(namespace).List(metav1.ListOptions{LabelSelector: LABELCOLLECTION})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	propagation := metav1.DeletePropagationBackground
+	for _, item := range expiredResources(list.Items, policy.retention, now) {
+		err = client.Resource(gvr).Namespace(item.GetNamespace()).Delete(item.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil {
+			klog.Errorf("Unable to delete %v %v/%v: %v", policy.kind, item.GetNamespace(), item.GetName(), err)
+			incrementMetric("cleanup.errors")
+			continue
+		}
+		if klog.V(2) {
+			klog.Infof("Deleted %v %v/%v created at %v", policy.kind, item.GetNamespace(), item.GetName(), item.GetCreationTimestamp())
+		}
+		deleted++
+	}
+	metrics.Add("cleanup."+policy.kind+".deleted", int64(deleted))
+	return deleted, nil
+}
+
+/* Delete the expired resources of all kinds with a retention, in all namespaces to clean up */
+func cleanup(client dynamic.Interface, policies []*retentionPolicy, namespaces []string) {
+	incrementMetric("cleanup.runs")
+	now := time.Now()
+	for _, policy := range policies {
+		for _, namespace := range namespaces {
+			deleted, err := cleanupKind(client, policy, namespace, now)
+			if err != nil {
+				klog.Errorf("Unable to clean up %v in namespace '%v': %v", policy.kind, namespace, err)
+				incrementMetric("cleanup.errors")
+				continue
+			}
+			if deleted > 0 {
+				klog.Infof("Cleaned up %v %v older than %v in namespace '%v'", deleted, policy.kind, policy.retention, namespace)
+			}
+		}
+	}
+}
+
+/* Start the cleanup controller, if a retention is configured */
+func startCleanupController(client dynamic.Interface) error {
+	policies, err := parseRetention(cleanupRetention)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	if cleanupInterval <= 0 {
+		return fmt.Errorf("cleanupInterval must be positive, not %v", cleanupInterval)
+	}
+	namespaces := make([]string, 0)
+	for _, namespace := range strings.Split(cleanupNamespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	if len(namespaces) == 0 {
+		/* the empty namespace lists all namespaces */
+		namespaces = append(namespaces, metav1.NamespaceAll)
+	}
+
+	klog.Infof("Starting cleanup of resources created by triggers every %v", cleanupInterval)
+	go func() {
+		for {
+			cleanup(client, policies, namespaces)
+			time.Sleep(cleanupInterval)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestParseRetention(t *testing.T) {
+	policies, err := parseRetention("tekton.dev/v1alpha1/PipelineRun=72h, v1/ConfigMap=30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("expected 2 retention policies, got %v", len(policies))
+	}
+	if policies[0].gvr.Group != "tekton.dev" || policies[0].gvr.Version != "v1alpha1" || policies[0].gvr.Resource != "pipelineruns" || policies[0].retention != 72*time.Hour {
+		t.Fatalf("unexpected retention policy %v", policies[0])
+	}
+	if policies[1].gvr.Group != "" || policies[1].gvr.Version != "v1" || policies[1].gvr.Resource != "configmaps" {
+		t.Fatalf("unexpected retention policy %v", policies[1])
+	}
+
+	for _, invalid := range []string{"PipelineRun=72h", "v1/ConfigMap", "v1/ConfigMap=forever", "v1/ConfigMap=-1h"} {
+		if _, err = parseRetention(invalid); err == nil {
+			t.Errorf("expected error parsing retention %v", invalid)
+		}
+	}
+}
+
+func TestExpiredResources(t *testing.T) {
+	now := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+	newItem := func(name string, age time.Duration, labeled bool) unstructured.Unstructured {
+		item := unstructured.Unstructured{Object: map[string]interface{}{"kind": "PipelineRun"}}
+		item.SetName(name)
+		item.SetCreationTimestamp(metav1.NewTime(now.Add(-age)))
+		if labeled {
+			item.SetLabels(map[string]string{LABELCOLLECTION: "active"})
+		}
+		return item
+	}
+	items := []unstructured.Unstructured{
+		newItem("old", 100*time.Hour, true),
+		newItem("new", time.Hour, true),
+		newItem("unlabeled", 100*time.Hour, false),
+	}
+	expired := expiredResources(items, 72*time.Hour, now)
+	if len(expired) != 1 || expired[0].GetName() != "old" {
+		t.Fatalf("unexpected expired resources %v", expired)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Client address behind proxies. When kabanero-events runs behind an OpenShift route or a load balancer, the address of
+the connection is that of the proxy. The address of the real sender is taken from the X-Forwarded-For header, or from
+the PROXY protocol header sent by the load balancer, but only if the connection comes from a trusted proxy, since
+anyone can set the header otherwise.
+*/
+
+const proxyHeaderTimeout = 5 * time.Second // time allowed for a trusted proxy to send the PROXY protocol header
+
+var (
+	trustedProxies  string       // comma separated addresses or CIDRs of the trusted proxies
+	proxyProtocol   bool         // accept the PROXY protocol header on connections from trusted proxies
+	trustedProxyNet []*net.IPNet // parsed trustedProxies
+)
+
+/* Parse the trusted proxies flag */
+func initializeTrustedProxies() error {
+	trustedProxyNet = make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(trustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("trusted proxy %v is not an IP address or CIDR", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			trustedProxyNet = append(trustedProxyNet, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("trusted proxy %v is not an IP address or CIDR: %v", entry, err)
+		}
+		trustedProxyNet = append(trustedProxyNet, ipNet)
+	}
+	return nil
+}
+
+/* Return whether an address, with or without port, is that of a trusted proxy */
+func isTrustedProxy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(strings.TrimSpace(host))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxyNet {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Return the address of the client of a request. If the request comes from a trusted proxy, X-Forwarded-For is walked from
+the right, skipping trusted proxies, and the first untrusted address is the client.
+*/
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		host = addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return host
+}
+
+/* Replace the remote address of requests with the address of the client, so that the middleware after it see the real sender */
+func clientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if len(trustedProxyNet) > 0 {
+			client := clientIP(req)
+			if klog.V(5) {
+				klog.Infof("Client of request from %v is %v", req.RemoteAddr, client)
+			}
+			req.RemoteAddr = net.JoinHostPort(client, "0")
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* Listen on a TCP address, accepting the PROXY protocol from trusted proxies if enabled */
+func listenTCP(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol {
+		return newProxyListener(listener), nil
+	}
+	return listener, nil
+}
+
+/*
+A listener that reads the PROXY protocol version 1 header of connections from trusted proxies. Headers are read in a
+goroutine per connection, so that a slow proxy does not hold up accepting other connections. The goroutines end with
+the context of the listener, cancelled when it is closed, closing the connections that were not accepted.
+*/
+type proxyListener struct {
+	net.Listener
+	conns  chan net.Conn
+	errs   chan error
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newProxyListener(listener net.Listener) *proxyListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	pl := &proxyListener{Listener: listener, conns: make(chan net.Conn), errs: make(chan error), ctx: ctx, cancel: cancel}
+	go pl.acceptLoop()
+	return pl
+}
+
+/* Close the listener, ending the goroutines reading the headers of connections */
+func (pl *proxyListener) Close() error {
+	pl.cancel()
+	return pl.Listener.Close()
+}
+
+func (pl *proxyListener) acceptLoop() {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			select {
+			case pl.errs <- err:
+			case <-pl.ctx.Done():
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go func() {
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				klog.Errorf("Closing connection from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			select {
+			case pl.conns <- proxied:
+			case <-pl.ctx.Done():
+				proxied.Close()
+			}
+		}()
+	}
+}
+
+/* Accept returns the next connection whose PROXY protocol header, if any, has been read */
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+/* A connection whose remote address was given by the PROXY protocol header */
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (conn *proxyConn) Read(buf []byte) (int, error) {
+	return conn.reader.Read(buf)
+}
+
+func (conn *proxyConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+/* Read the PROXY protocol header of a connection from a trusted proxy, such as "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n" */
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if !isTrustedProxy(conn.RemoteAddr().String()) {
+		return conn, nil
+	}
+	reader := bufio.NewReader(conn)
+	pc := &proxyConn{Conn: conn, reader: reader, remoteAddr: conn.RemoteAddr()}
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read PROXY protocol header: %v", err)
+	}
+	if string(prefix) != "PROXY " {
+		/* the proxy did not send a header */
+		return pc, nil
+	}
+	/* the header is at most 107 bytes */
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > 107 {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	fields := strings.Fields(strings.TrimRight(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return pc, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", string(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", string(line))
+	}
+	pc.remoteAddr = &net.TCPAddr{IP: ip, Port: port}
+	return pc, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	savedTrustedProxies := trustedProxies
+	defer func() {
+		trustedProxies = savedTrustedProxies
+		initializeTrustedProxies()
+	}()
+	trustedProxies = "10.0.0.0/8, 192.168.1.1"
+	if err := initializeTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"203.0.113.5:1234", "", "203.0.113.5"},
+		/* not from a trusted proxy, so the header is ignored */
+		{"203.0.113.5:1234", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:1234", "198.51.100.7", "198.51.100.7"},
+		/* a client can prepend anything, so only the addresses added by trusted proxies count */
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.7, 192.168.1.1", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "10.1.2.3"},
+		{"10.1.2.3:1234", "not-an-ip", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/webhook", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if client := clientIP(req); client != test.expected {
+			t.Errorf("remote %v, X-Forwarded-For %v: expected %v, got %v", test.remoteAddr, test.forwarded, test.expected, client)
+		}
+	}
+
+	trustedProxies = "not-a-cidr"
+	if err := initializeTrustedProxies(); err == nil {
+		t.Fatal("expected error for invalid trusted proxy")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	savedTrustedProxies := trustedProxies
+	defer func() {
+		trustedProxies = savedTrustedProxies
+		initializeTrustedProxies()
+	}()
+	trustedProxies = "127.0.0.1"
+	initializeTrustedProxies()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newProxyListener(raw)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 198.51.100.7 10.0.0.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != "198.51.100.7:56324" {
+		t.Fatalf("unexpected remote address from PROXY header: %v", conn.RemoteAddr())
+	}
+	buf := make([]byte, 3)
+	if _, err = conn.Read(buf); err != nil || string(buf) != "GET" {
+		t.Fatalf("data after PROXY header not readable: %q %v", buf, err)
+	}
+}
+
+func TestProxyListenerClose(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newProxyListener(raw)
+
+	/* a connection that is never accepted is closed with the listener */
+	client, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	listener.Close()
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection not closed with the listener")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection left open after the listener was closed")
+	}
+	if _, err = listener.Accept(); err == nil {
+		t.Fatal("accepted a connection from a closed listener")
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+CloudEvents. Messages sent through a message provider may be wrapped in a CloudEvents 1.0 event, so that
+kabanero-events plugs into brokers such as those of Knative Eventing. In structured mode, the event, with the message
+as its data, is sent as the message. In binary mode, the message is sent as is, and the attributes of the event are
+sent as ce- headers, which only REST providers support; other providers use structured mode. CloudEvents received by
+providers are unwrapped, and CloudEvents are accepted on the /cloudevents endpoint of the listener, authenticated with
+a bearer token.
+*/
+
+const (
+	cloudEventsStructured  = "structured"
+	cloudEventsBinary      = "binary"
+	cloudEventsNone        = "none"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsTypePrefix  = "io.kabanero.events."
+
+	CLOUDEVENTSTOKEN = "CLOUDEVENTS_TOKEN" // environment variable containing the bearer token of CloudEvents requests
+
+	defaultCloudEventsMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,cloudEventsAuth"
+)
+
+/* Key of the context value marking the CloudEvents requests authenticated with the token */
+type cloudEventsAuthKey struct{}
+
+var (
+	cloudEventsMode       string // default CloudEvents mode of message providers: structured, binary, or none if empty
+	cloudEventsMiddleware string // comma separated middleware chain of the CloudEvents endpoint
+)
+
+/* Attributes of a CloudEvent, other than its data */
+type cloudEventAttributes struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Subject         string `json:"subject,omitempty"`
+	Time            string `json:"time,omitempty"`
+	DataContentType string `json:"datacontenttype,omitempty"`
+}
+
+/* A structured CloudEvent */
+type cloudEvent struct {
+	cloudEventAttributes
+	Data       json.RawMessage `json:"data,omitempty"`
+	DataBase64 []byte          `json:"data_base64,omitempty"`
+}
+
+/* Wrap the message providers in CloudEvents */
+func initializeCloudEvents(ed *EventDefinition, providers map[string]MessageProvider) error {
+	for _, mpd := range ed.MessageProviders {
+		mode := mpd.CloudEvents
+		if mode == "" {
+			mode = cloudEventsMode
+		}
+		switch mode {
+		case "", cloudEventsNone:
+			continue
+		case cloudEventsStructured, cloudEventsBinary:
+		default:
+			return fmt.Errorf("CloudEvents mode '%s' of messageProvider '%s' is not structured, binary, or none", mode, mpd.Name)
+		}
+		provider := providers[mpd.Name]
+		/* peers receive webhook messages, the backends of failover providers wrap their own messages, and notifications are for people */
+		if provider == nil || mpd.ProviderType == "peer" || mpd.ProviderType == "failover" || mpd.ProviderType == "notification" {
+			continue
+		}
+		if mode == cloudEventsBinary && mpd.ProviderType != "rest" && mpd.ProviderType != "http" {
+			klog.Warningf("messageProvider '%s' does not support CloudEvents binary mode. Using structured mode", mpd.Name)
+			mode = cloudEventsStructured
+		}
+		if klog.V(5) {
+			klog.Infof("Sending CloudEvents in %s mode through messageProvider '%s'", mode, mpd.Name)
+		}
+		providers[mpd.Name] = &cloudEventsProvider{MessageProvider: provider, mode: mode}
+	}
+	return nil
+}
+
+/* Return the attributes of the CloudEvent of a message sent to an eventDestination */
+func messageCloudEventAttributes(node *EventNode, payload []byte) cloudEventAttributes {
+	attributes := cloudEventAttributes{
+		SpecVersion:     cloudEventsSpecVersion,
+		Type:            cloudEventsTypePrefix + node.Name,
+		Source:          "/kabanero-events/" + node.Name,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+	}
+	message := make(map[string]interface{})
+	if json.Unmarshal(payload, &message) == nil {
+		if header, err := convertToHeaderMap(message[HEADER]); err == nil {
+			if eventType := http.Header(header).Get("X-Github-Event"); eventType != "" {
+				attributes.Type = cloudEventsTypePrefix + "github." + eventType
+			}
+		}
+		if url := messageRepositoryURL(message); url != "" {
+			attributes.Source = url
+		}
+		attributes.Subject = messageRepositoryName(message)
+		attributes.ID, _ = message[EVENTID].(string)
+	}
+	if attributes.ID == "" {
+		attributes.ID = newRequestID()
+	}
+	return attributes
+}
+
+/* Wrap a message in a structured CloudEvent */
+func structuredCloudEvent(attributes cloudEventAttributes, payload []byte) ([]byte, error) {
+	event := cloudEvent{cloudEventAttributes: attributes}
+	if json.Valid(payload) {
+		event.Data = payload
+	} else {
+		event.DataContentType = "application/octet-stream"
+		event.DataBase64 = payload
+	}
+	return json.Marshal(event)
+}
+
+/* Return the ce- headers of the attributes of a binary CloudEvent, added to a header */
+func binaryCloudEventHeader(attributes cloudEventAttributes, header interface{}) (map[string][]string, error) {
+	headerMap, err := convertToHeaderMap(header)
+	if err != nil {
+		return nil, err
+	}
+	ceHeader := make(http.Header)
+	for key, values := range headerMap {
+		ceHeader[key] = values
+	}
+	ceHeader.Set("Ce-Specversion", attributes.SpecVersion)
+	ceHeader.Set("Ce-Id", attributes.ID)
+	ceHeader.Set("Ce-Source", attributes.Source)
+	ceHeader.Set("Ce-Type", attributes.Type)
+	ceHeader.Set("Ce-Time", attributes.Time)
+	if attributes.Subject != "" {
+		ceHeader.Set("Ce-Subject", attributes.Subject)
+	}
+	ceHeader.Set("Content-Type", attributes.DataContentType)
+	return map[string][]string(ceHeader), nil
+}
+
+/* Return the data of a structured CloudEvent, or the message itself if it is not a CloudEvent */
+func unwrapCloudEvent(data []byte) ([]byte, error) {
+	event := cloudEvent{}
+	if json.Unmarshal(data, &event) != nil || event.SpecVersion == "" {
+		return data, nil
+	}
+	if event.DataBase64 != nil {
+		return event.DataBase64, nil
+	}
+	if event.Data == nil {
+		return nil, fmt.Errorf("CloudEvent %s from %s does not contain data", event.ID, event.Source)
+	}
+	var text string
+	if !strings.Contains(event.DataContentType, "json") && json.Unmarshal(event.Data, &text) == nil {
+		return []byte(text), nil
+	}
+	return event.Data, nil
+}
+
+/* A message provider wrapping the messages it sends in CloudEvents, and unwrapping those it receives */
+type cloudEventsProvider struct {
+	MessageProvider
+	mode string
+}
+
+/* Close the wrapped provider */
+func (cp *cloudEventsProvider) Close() error {
+	return closeMessageProvider(cp.MessageProvider)
+}
+
+func (cp *cloudEventsProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	attributes := messageCloudEventAttributes(node, payload)
+	if cp.mode == cloudEventsBinary {
+		ceHeader, err := binaryCloudEventHeader(attributes, header)
+		if err != nil {
+			return err
+		}
+		return cp.MessageProvider.Send(node, payload, ceHeader)
+	}
+	event, err := structuredCloudEvent(attributes, payload)
+	if err != nil {
+		return err
+	}
+	headerMap, err := convertToHeaderMap(header)
+	if err != nil {
+		return err
+	}
+	ceHeader := make(http.Header)
+	for key, values := range headerMap {
+		ceHeader[key] = values
+	}
+	ceHeader.Set("Content-Type", cloudEventsContentType)
+	return cp.MessageProvider.Send(node, event, map[string][]string(ceHeader))
+}
+
+func (cp *cloudEventsProvider) Receive(node *EventNode) ([]byte, error) {
+	data, err := cp.MessageProvider.Receive(node)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapCloudEvent(data)
+}
+
+func (cp *cloudEventsProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	cp.MessageProvider.ListenAndServe(node, func(data []byte) {
+		message, err := unwrapCloudEvent(data)
+		if err != nil {
+			klog.Errorf("Dropping message received from eventDestination '%s': %v", node.Name, err)
+			return
+		}
+		receiver(message)
+	})
+}
+
+/*
+Middleware verifying the bearer token of CloudEvents requests against the token in the environment variable
+CLOUDEVENTS_TOKEN. As the endpoint accepts the messages sent by kabanero-events, which bypass the verification of
+the webhook signature, requests are rejected if the variable is not set while WEBHOOK_SECRET is. Requests are not
+verified if neither variable is set.
+*/
+func cloudEventsAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		token := os.Getenv(CLOUDEVENTSTOKEN)
+		if token == "" {
+			if os.Getenv(WEBHOOKSECRET) != "" {
+				incrementMetric("http." + metricRoute(req) + ".unauthorized")
+				writeError(writer, req, codeUnauthorized, CLOUDEVENTSTOKEN+" is not set")
+				return
+			}
+			next.ServeHTTP(writer, req)
+			return
+		}
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeInvalidToken, "invalid token")
+			return
+		}
+		next.ServeHTTP(writer, req.WithContext(context.WithValue(req.Context(), cloudEventsAuthKey{}, true)))
+	})
+}
+
+/*
+HTTP listener of CloudEvents, in binary or structured mode. The data of each event is either a message sent by
+kabanero-events, which is sent as is if the request was authenticated with the token, or the body of a webhook. The attributes of the event are added to the header
+of the message as ce- headers, and events whose type is io.kabanero.events.github.<event> are GitHub events.
+*/
+func cloudEventsListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/cloudevents-batch+json" {
+		writeError(writer, req, codeInvalidCloudEvent, "batched CloudEvents are not supported")
+		return
+	}
+	structured := mediaType == cloudEventsContentType
+	if !structured && req.Header.Get("Ce-Specversion") == "" {
+		writeError(writer, req, codeInvalidCloudEvent, "request is not a CloudEvent")
+		return
+	}
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+
+	header := make(http.Header)
+	for key, values := range req.Header {
+		if http.CanonicalHeaderKey(key) == "Authorization" {
+			continue
+		}
+		header[key] = values
+	}
+	if structured {
+		for _, attribute := range []string{"specversion", "id", "source", "type", "subject", "time"} {
+			if value, ok := bodyMap[attribute].(string); ok {
+				header.Set("Ce-"+attribute, value)
+			}
+		}
+		data, ok := bodyMap["data"].(map[string]interface{})
+		if !ok {
+			writeError(writer, req, codeInvalidCloudEvent, "data of CloudEvent is not a JSON object")
+			return
+		}
+		bodyMap = data
+	}
+	if header.Get("Ce-Specversion") != cloudEventsSpecVersion || header.Get("Ce-Id") == "" || header.Get("Ce-Source") == "" || header.Get("Ce-Type") == "" {
+		writeError(writer, req, codeInvalidCloudEvent, "CloudEvent is not a valid CloudEvents 1.0 event")
+		return
+	}
+
+	/* a message sent by kabanero-events is sent as is, only from authenticated senders, as its header is trusted */
+	authenticated, _ := req.Context().Value(cloudEventsAuthKey{}).(bool)
+	if messageBody, ok := bodyMap[BODY].(map[string]interface{}); ok && authenticated {
+		if messageHeader, err := convertToHeaderMap(bodyMap[HEADER]); err == nil {
+			header = http.Header(messageHeader)
+			bodyMap = messageBody
+		}
+	}
+	if eventType := strings.TrimPrefix(header.Get("Ce-Type"), cloudEventsTypePrefix+"github."); eventType != header.Get("Ce-Type") && header.Get("X-Github-Event") == "" {
+		header.Set("X-Github-Event", eventType)
+	}
+	if header.Get("X-Github-Delivery") == "" && header.Get("Ce-Id") != "" {
+		header.Set("X-Github-Delivery", header.Get("Ce-Id"))
+	}
+	if !allowRepositoryEvent(writer, req, bodyMap) {
+		return
+	}
+	logReceivedEvent(assignEventID(header), "CloudEvents listener received event", req.URL.Path, header, bodyMap)
+	respondWebhookMessage(writer, req, WEBHOOKDESTINATION, "", header, bodyMap)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const cloudEventsTestMessage = `{"eventID":"1a2b","header":{"X-Github-Event":["push"]},"body":{"repository":{"full_name":"kabanero-io/appsody","html_url":"https://github.com/kabanero-io/appsody"}}}`
+
+func TestStructuredCloudEvent(t *testing.T) {
+	captured := &capturingProvider{}
+	provider := &cloudEventsProvider{MessageProvider: captured, mode: cloudEventsStructured}
+	node := &EventNode{Name: "github", Topic: "github"}
+	if err := provider.Send(node, []byte(cloudEventsTestMessage), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	event := cloudEvent{}
+	if err := json.Unmarshal(captured.messages[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.SpecVersion != "1.0" || event.ID != "1a2b" || event.Type != "io.kabanero.events.github.push" || event.Source != "https://github.com/kabanero-io/appsody" ||
+		event.Subject != "kabanero-io/appsody" || event.Time == "" || event.DataContentType != "application/json" {
+		t.Fatalf("unexpected CloudEvent attributes %+v", event.cloudEventAttributes)
+	}
+	data, err := unwrapCloudEvent(captured.messages[0])
+	if err != nil || string(data) != cloudEventsTestMessage {
+		t.Fatalf("unexpected data %s: %v", data, err)
+	}
+
+	/* messages that are not JSON are base64 encoded */
+	if err = provider.Send(node, []byte("not json"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = unwrapCloudEvent(captured.messages[1]); err != nil || string(data) != "not json" {
+		t.Fatalf("unexpected data %s: %v", data, err)
+	}
+	/* messages that are not CloudEvents are received as is */
+	if data, err = unwrapCloudEvent([]byte(cloudEventsTestMessage)); err != nil || string(data) != cloudEventsTestMessage {
+		t.Fatalf("unexpected data %s: %v", data, err)
+	}
+}
+
+func TestBinaryCloudEvent(t *testing.T) {
+	var received *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		received = req
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer server.Close()
+
+	rest, _ := newRESTProvider(&MessageProviderDefinition{Name: "broker", ProviderType: "rest", URL: server.URL})
+	provider := &cloudEventsProvider{MessageProvider: rest, mode: cloudEventsBinary}
+	err := provider.Send(&EventNode{Name: "github"}, []byte(cloudEventsTestMessage), map[string][]string{"X-Custom": {"value"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != cloudEventsTestMessage {
+		t.Fatalf("unexpected body %s", body)
+	}
+	if received.Header.Get("Ce-Specversion") != "1.0" || received.Header.Get("Ce-Id") != "1a2b" || received.Header.Get("Ce-Type") != "io.kabanero.events.github.push" ||
+		received.Header.Get("Content-Type") != "application/json" || received.Header.Get("X-Custom") != "value" || len(received.Header["Content-Type"]) != 1 {
+		t.Fatalf("unexpected header %v", received.Header)
+	}
+}
+
+func TestCloudEventsListener(t *testing.T) {
+	captured := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": captured}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "capture"}}}
+	os.Setenv(CLOUDEVENTSTOKEN, "secret")
+	defer os.Unsetenv(CLOUDEVENTSTOKEN)
+	handler := cloudEventsAuthMiddleware(http.HandlerFunc(cloudEventsListenerHandler))
+
+	/* a structured event of a message sent by kabanero-events */
+	structured := `{"specversion":"1.0","id":"1a2b","source":"https://github.com/kabanero-io/appsody","type":"io.kabanero.events.github.push","data":` + cloudEventsTestMessage + `}`
+	req := httptest.NewRequest("POST", "/cloudevents", strings.NewReader(structured))
+	req.Header.Set("Content-Type", "application/cloudevents+json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK || len(captured.messages) != 1 {
+		t.Fatalf("structured CloudEvent returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+
+	/* a binary event of a push webhook */
+	req = httptest.NewRequest("POST", "/cloudevents", strings.NewReader(`{"ref":"refs/heads/master"}`))
+	for key, value := range map[string]string{"Ce-Specversion": "1.0", "Ce-Id": "3c4d", "Ce-Source": "/github", "Ce-Type": "io.kabanero.events.github.push", "Content-Type": "application/json"} {
+		req.Header.Set(key, value)
+	}
+	recorder = httptest.NewRecorder()
+	cloudEventsListenerHandler(recorder, req)
+	if recorder.Code != http.StatusOK || len(captured.messages) != 2 {
+		t.Fatalf("binary CloudEvent returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+
+	for index, expectedBody := range []string{`{"repository":{"full_name":"kabanero-io/appsody","html_url":"https://github.com/kabanero-io/appsody"}}`, `{"ref":"refs/heads/master"}`} {
+		message := make(map[string]interface{})
+		if err := json.Unmarshal(captured.messages[index], &message); err != nil {
+			t.Fatal(err)
+		}
+		header, _ := convertToHeaderMap(message[HEADER])
+		body, _ := json.Marshal(message[BODY])
+		if http.Header(header).Get("X-Github-Event") != "push" || string(body) != expectedBody {
+			t.Errorf("unexpected message %v", message)
+		}
+	}
+
+	for _, contentType := range []string{"application/json", "application/cloudevents-batch+json"} {
+		req = httptest.NewRequest("POST", "/cloudevents", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", contentType)
+		recorder = httptest.NewRecorder()
+		cloudEventsListenerHandler(recorder, req)
+		if recorder.Code == http.StatusOK {
+			t.Errorf("request of content type %v was accepted", contentType)
+		}
+	}
+}
+
+func TestCloudEventsAuthMiddleware(t *testing.T) {
+	captured := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": captured}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "capture"}}}
+	handler := cloudEventsAuthMiddleware(http.HandlerFunc(cloudEventsListenerHandler))
+	structured := `{"specversion":"1.0","id":"1a2b","source":"https://github.com/kabanero-io/appsody","type":"io.kabanero.events.github.push","data":` + cloudEventsTestMessage + `}`
+	send := func(authorization string) int {
+		req := httptest.NewRequest("POST", "/cloudevents", strings.NewReader(structured))
+		req.Header.Set("Content-Type", "application/cloudevents+json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	/* without any secret, the message is not trusted, and is sent as the body of a webhook */
+	if code := send(""); code != http.StatusOK || len(captured.messages) != 1 {
+		t.Fatalf("unauthenticated CloudEvent returned %v", code)
+	}
+	message := make(map[string]interface{})
+	if err := json.Unmarshal(captured.messages[0], &message); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := message[BODY].(map[string]interface{}); body == nil || body[HEADER] == nil {
+		t.Fatalf("message of an unauthenticated CloudEvent was trusted: %v", message)
+	}
+
+	/* the endpoint does not bypass the webhook secret */
+	os.Setenv(WEBHOOKSECRET, "webhook")
+	defer os.Unsetenv(WEBHOOKSECRET)
+	if code := send(""); code != http.StatusUnauthorized {
+		t.Fatalf("CloudEvent without token returned %v with a webhook secret", code)
+	}
+	os.Setenv(CLOUDEVENTSTOKEN, "secret")
+	defer os.Unsetenv(CLOUDEVENTSTOKEN)
+	for authorization, expected := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "Bearer secret": http.StatusOK} {
+		if code := send(authorization); code != expected {
+			t.Errorf("CloudEvent with authorization '%v' returned %v, expected %v", authorization, code, expected)
+		}
+	}
+}
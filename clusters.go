@@ -0,0 +1,132 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+)
+
+/*
+Remote clusters. A central instance of kabanero-events may create the resources of triggers in other clusters, such
+as spoke clusters running the builds. Each remote cluster is registered with a kubeconfig file, named after the
+cluster, in the remote clusters directory, for example mounted from a Secret with one key per cluster. Triggers
+target a remote cluster by name with applyResourcesToCluster.
+*/
+
+const localClusterName = "local" // name of the local cluster in policies
+
+var (
+	remoteClustersDir string                  // directory of the kubeconfig files of the remote clusters. No remote clusters if empty
+	remoteClusters    = map[string]*cluster{} // remote clusters, by name
+)
+
+/* A cluster where resources are created */
+type cluster struct {
+	name          string // empty for the local cluster
+	dynamicClient dynamic.Interface
+	mapper        *cachedMapper
+}
+
+/* Load the kubeconfig files of the remote clusters */
+func loadRemoteClusters(dir string) (map[string]*cluster, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	clusters := make(map[string]*cluster)
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") {
+			/* such as the ..data directory of mounted Secrets */
+			continue
+		}
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if toDomainName(name) != name || name == localClusterName {
+			return nil, fmt.Errorf("name of remote cluster %v is not a valid DNS name, other than %v", name, localClusterName)
+		}
+		config, err := clientcmd.BuildConfigFromFlags("", path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the kubeconfig of remote cluster %v: %v", name, err)
+		}
+		config.UserAgent = userAgent()
+		dynamicClient, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the client of remote cluster %v: %v", name, err)
+		}
+		discClient, err := discovery.NewDiscoveryClientForConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create the discovery client of remote cluster %v: %v", name, err)
+		}
+		clusters[name] = &cluster{name: name, dynamicClient: dynamicClient, mapper: newCachedMapper(discClient)}
+		if klog.V(2) {
+			klog.Infof("Registered remote cluster %v at %v", name, config.Host)
+		}
+	}
+	return clusters, nil
+}
+
+/* Load the remote clusters, and keep their discovery caches up to date */
+func initializeRemoteClusters() error {
+	if remoteClustersDir == "" {
+		return nil
+	}
+	clusters, err := loadRemoteClusters(remoteClustersDir)
+	if err != nil {
+		return err
+	}
+	for _, remote := range clusters {
+		go watchCRDs(remote.dynamicClient, remote.mapper)
+	}
+	remoteClusters = clusters
+	return nil
+}
+
+/* Return the name of a cluster in policies */
+func clusterName(name string) string {
+	if name == "" {
+		return localClusterName
+	}
+	return name
+}
+
+/* Return the cluster of a name: the local cluster if empty, or the remote cluster registered with that name */
+func targetCluster(name string) (*cluster, error) {
+	if name == "" {
+		return &cluster{dynamicClient: dynamicClient, mapper: restMapper}, nil
+	}
+	remote, ok := remoteClusters[name]
+	if !ok {
+		return nil, fmt.Errorf("remote cluster %v is not registered", name)
+	}
+	return remote, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: spoke
+  cluster:
+    server: SERVER
+contexts:
+- name: spoke
+  context:
+    cluster: spoke
+    user: spoke
+current-context: spoke
+users:
+- name: spoke
+  user:
+    token: token
+`
+
+func TestRemoteClusters(t *testing.T) {
+	server := httptest.NewServer(&fakeDiscoveryServer{installed: true})
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "clusters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := []byte(strings.Replace(testKubeconfig, "SERVER", server.URL, 1))
+	if err = ioutil.WriteFile(filepath.Join(dir, "spoke-1"), kubeconfig, 0600); err != nil {
+		t.Fatal(err)
+	}
+	/* hidden files, such as those of mounted Secrets, are ignored */
+	if err = os.Mkdir(filepath.Join(dir, "..data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := loadRemoteClusters(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 1 || clusters["spoke-1"] == nil {
+		t.Fatalf("unexpected remote clusters: %v", clusters)
+	}
+	remoteClusters = clusters
+	defer func() { remoteClusters = map[string]*cluster{} }()
+
+	/* the kinds of a remote cluster are resolved through its own discovery */
+	target, err := targetCluster("spoke-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := target.mapper.resolve(schema.GroupVersionKind{Group: "tekton.dev", Version: "v1alpha1", Kind: "PipelineRun"})
+	if err != nil || mapping.gvr.Resource != "pipelineruns" {
+		t.Fatalf("unexpected mapping in remote cluster: %v, %v", mapping, err)
+	}
+	if _, err = targetCluster("spoke-2"); err == nil {
+		t.Fatal("expected error getting an unregistered cluster")
+	}
+	local, err := targetCluster("")
+	if err != nil || local.name != "" {
+		t.Fatalf("unexpected local cluster: %v, %v", local, err)
+	}
+
+	/* resources are not applied to unregistered clusters, even in dry-run */
+	variables := map[string]interface{}{"attr1": "string1"}
+	err = applyResourcesHelper("test_data/trigger11", nil, "resources", variables, &resourceAction{trigger: "t", cluster: "spoke-2", dryrun: true})
+	if err == nil {
+		t.Fatal("expected error applying resources to an unregistered cluster")
+	}
+	err = applyResourcesHelper("test_data/trigger11", nil, "resources", variables, &resourceAction{trigger: "t", cluster: "spoke-1", dryrun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* triggers target a remote cluster by name */
+	tp := newTriggerProcessor()
+	if err = tp.initialize("test_data/trigger14"); err != nil {
+		t.Fatal(err)
+	}
+	for cluster, expected := range map[string]bool{"spoke-1": true, "spoke-2": false} {
+		result, err := tp.evaluateMessage(map[string]interface{}{"attr1": "string1", "cluster": cluster}, "default", evalOptions{dryrun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok := result.variables[0]["result"] == ""; ok != expected {
+			t.Errorf("applyResourcesToCluster to %v: unexpected result '%v'", cluster, result.variables[0]["result"])
+		}
+	}
+
+	/* the policy may restrict the clusters */
+	policy := &resourcePolicyDef{Rules: []*resourcePolicyRule{{Clusters: []string{"local"}}}}
+	if !policy.allows(&resourceAction{}, "ConfigMap", "default", false) {
+		t.Fatal("expected the local cluster to be allowed")
+	}
+	if policy.allows(&resourceAction{cluster: "spoke-1"}, "ConfigMap", "default", false) {
+		t.Fatal("expected the remote cluster not to be allowed")
+	}
+
+	/* the name of the local cluster can not be used by a remote cluster */
+	if err = ioutil.WriteFile(filepath.Join(dir, localClusterName), kubeconfig, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadRemoteClusters(dir); err == nil {
+		t.Fatal("expected error loading a remote cluster named local")
+	}
+}
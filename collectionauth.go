@@ -0,0 +1,263 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Authenticated downloads of trigger collections. With -collectionAuth, the Kabanero index and the trigger collection
+are downloaded with the credentials of the -collectionSecret Secret, in the namespace of kabanero-events: a bearer
+token, basic credentials, or a GitHub token. Credentials are only sent to the host of the index and the hosts of
+-collectionAuthHosts, so that an index can not send them elsewhere. With github auth, URLs of release assets, such as
+https://github.com/<owner>/<repo>/releases/download/<tag>/<asset>, are downloaded through the releases API, since the
+assets of private repositories can not be downloaded from their browser URL. The asset is then served from a redirect
+to a storage host, to which the credentials are not forwarded.
+*/
+
+const (
+	collectionAuthBearer = "bearer"
+	collectionAuthBasic  = "basic"
+	collectionAuthGitHub = "github"
+)
+
+var (
+	collectionAuth      string // how the trigger collections are downloaded: bearer, basic, github, or anonymously if empty
+	collectionSecret    string // Secret holding the credentials of the downloads of the trigger collections
+	collectionAuthHosts string // comma separated hosts, besides that of the index, the credentials are sent to
+)
+
+/* The credentials of the downloads of a trigger collection */
+type collectionCredentials struct {
+	auth     string
+	token    string
+	username string
+	password string
+	hosts    map[string]bool // hosts the credentials are sent to
+}
+
+/* Validate the collection auth flags */
+func checkCollectionAuth() error {
+	switch collectionAuth {
+	case "":
+		return nil
+	case collectionAuthBearer, collectionAuthBasic, collectionAuthGitHub:
+	default:
+		return fmt.Errorf("-collectionAuth %s is not %s, %s or %s", collectionAuth, collectionAuthBearer, collectionAuthBasic, collectionAuthGitHub)
+	}
+	if collectionSecret == "" {
+		return fmt.Errorf("-collectionAuth %s requires -collectionSecret", collectionAuth)
+	}
+	return nil
+}
+
+/* Read the credentials of the downloads of the collection of an index. nil if downloaded anonymously */
+func readCollectionCredentials(indexURL string) (*collectionCredentials, error) {
+	if collectionAuth == "" {
+		return nil, nil
+	}
+	secret, err := readProviderSecret(collectionSecret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the secret %s of the trigger collection: %v", collectionSecret, err)
+	}
+	creds := &collectionCredentials{auth: collectionAuth, hosts: make(map[string]bool)}
+	switch collectionAuth {
+	case collectionAuthBasic:
+		username, usernameOK := secret[USERNAME]
+		password, passwordOK := secret[PASSWORD]
+		if !usernameOK || !passwordOK {
+			return nil, fmt.Errorf("secret %s of the trigger collection has no %s or %s", collectionSecret, USERNAME, PASSWORD)
+		}
+		creds.username, creds.password = string(bytes.TrimSpace(username)), string(bytes.TrimSpace(password))
+	default:
+		token, ok := secret[httpToken]
+		if !ok {
+			return nil, fmt.Errorf("secret %s of the trigger collection has no %s", collectionSecret, httpToken)
+		}
+		creds.token = string(bytes.TrimSpace(token))
+	}
+
+	scheme := "https"
+	if parsed, err := url.Parse(indexURL); err == nil && parsed.Host != "" {
+		scheme = parsed.Scheme
+		creds.hosts[strings.ToLower(parsed.Host)] = true
+	}
+	for _, host := range strings.Split(collectionAuthHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			creds.hosts[host] = true
+		}
+	}
+	if collectionAuth == collectionAuthGitHub {
+		/* the index and the assets are read through the API of the GitHub hosts */
+		for host := range creds.hosts {
+			if apiURL, _ := gitHubAPIURL(scheme + "://" + host); apiURL != "" {
+				if parsed, err := url.Parse(apiURL); err == nil {
+					creds.hosts[strings.ToLower(parsed.Host)] = true
+				}
+			}
+		}
+	}
+	return creds, nil
+}
+
+/* Set the credentials of a request, if its host is one they are sent to */
+func (creds *collectionCredentials) authorize(req *http.Request) {
+	if creds == nil || !creds.hosts[strings.ToLower(req.URL.Host)] {
+		return
+	}
+	switch creds.auth {
+	case collectionAuthBasic:
+		req.SetBasicAuth(creds.username, creds.password)
+	case collectionAuthGitHub:
+		req.Header.Set("Authorization", "token "+creds.token)
+	default:
+		req.Header.Set("Authorization", "Bearer "+creds.token)
+	}
+}
+
+/* Follow redirects, removing the credentials from those to other hosts, such as the storage of release assets */
+func (creds *collectionCredentials) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	if creds == nil || !creds.hosts[strings.ToLower(req.URL.Host)] {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+/* Return the owner, repository, tag and name of the asset of a release asset URL, and whether it is one */
+func parseReleaseAssetURL(parsed *url.URL) (string, string, string, string, bool) {
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(segments) != 6 || segments[2] != "releases" || segments[3] != "download" {
+		return "", "", "", "", false
+	}
+	return segments[0], segments[1], segments[4], segments[5], true
+}
+
+/* Return the API URL of a release asset of a GitHub repository */
+func (creds *collectionCredentials) releaseAssetURL(parsed *url.URL) (string, error) {
+	owner, repository, tag, name, _ := parseReleaseAssetURL(parsed)
+	apiURL, _ := gitHubAPIURL(parsed.Scheme + "://" + parsed.Host)
+	releaseURL := fmt.Sprintf("%srepos/%s/%s/releases/tags/%s", apiURL, owner, repository, url.PathEscape(tag))
+	resp, err := creds.get(releaseURL, "application/vnd.github.v3+json")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	release := struct {
+		Assets []struct {
+			Name string `json:"name"`
+			URL  string `json:"url"`
+		} `json:"assets"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", fmt.Errorf("unable to read release %s of %s/%s: %v", tag, owner, repository, err)
+	}
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s of %s/%s has no asset %s", tag, owner, repository, name)
+}
+
+/* GET a URL with the credentials, returning the response if successful */
+func (creds *collectionCredentials) get(rawURL string, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	creds.authorize(req)
+	client := http.Client{Transport: withUserAgent(nil), CheckRedirect: creds.checkRedirect, Timeout: indexTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to read from url %s, http status: %s", redactURL(rawURL), resp.Status)
+	}
+	return resp, nil
+}
+
+/* Open a file of a trigger collection, resolving the URLs of release assets with github auth */
+func (creds *collectionCredentials) open(rawURL string) (io.ReadCloser, error) {
+	if creds != nil && creds.auth == collectionAuthGitHub {
+		if parsed, err := url.Parse(rawURL); err == nil && creds.hosts[strings.ToLower(parsed.Host)] {
+			if _, _, _, _, ok := parseReleaseAssetURL(parsed); ok {
+				assetURL, err := creds.releaseAssetURL(parsed)
+				if err != nil {
+					return nil, err
+				}
+				if klog.V(5) {
+					klog.Infof("Downloading release asset %s from %s", rawURL, assetURL)
+				}
+				resp, err := creds.get(assetURL, "application/octet-stream")
+				if err != nil {
+					return nil, err
+				}
+				return resp.Body, nil
+			}
+		}
+	}
+	resp, err := creds.get(rawURL, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+/* Read a file of a trigger collection */
+func (creds *collectionCredentials) read(rawURL string) ([]byte, error) {
+	readCloser, err := creds.open(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer readCloser.Close()
+	return ioutil.ReadAll(readCloser)
+}
+
+/* Download a file of a trigger collection to a path */
+func (creds *collectionCredentials) downloadTo(rawURL string, path string) error {
+	readCloser, err := creds.open(rawURL)
+	if err != nil {
+		return err
+	}
+	defer readCloser.Close()
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, readCloser)
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadTriggerFromPrivateRelease(t *testing.T) {
+	savedAuth, savedSecret, savedHosts, savedRead := collectionAuth, collectionSecret, collectionAuthHosts, readProviderSecret
+	defer func() {
+		collectionAuth, collectionSecret, collectionAuthHosts, readProviderSecret = savedAuth, savedSecret, savedHosts, savedRead
+	}()
+	collectionAuth, collectionSecret = collectionAuthGitHub, "collection-token"
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		if name != "collection-token" {
+			return nil, fmt.Errorf("unexpected secret %v", name)
+		}
+		return map[string][]byte{httpToken: []byte("secret-token\n")}, nil
+	}
+
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chkSum, err := sha256sum(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the storage of the release assets must not receive the credentials */
+	storage := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("the credentials were sent to the storage of the asset")
+		}
+		writer.Write(archive)
+	}))
+	defer storage.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "token secret-token" {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.URL.Path {
+		case "/owner/collections/index.yaml":
+			fmt.Fprintf(writer, "triggers:\n - url: %s/owner/collections/releases/download/v1/triggers.tar.gz\n   sha256: %s\n", server.URL, chkSum)
+		case "/api/v3/repos/owner/collections/releases/tags/v1":
+			fmt.Fprintf(writer, `{"assets": [{"name": "other.tar.gz", "url": "%s/api/v3/repos/owner/collections/releases/assets/1"}, {"name": "triggers.tar.gz", "url": "%s/api/v3/repos/owner/collections/releases/assets/2"}]}`, server.URL, server.URL)
+		case "/api/v3/repos/owner/collections/releases/assets/2":
+			if req.Header.Get("Accept") != "application/octet-stream" {
+				t.Errorf("unexpected Accept header %v of the asset", req.Header.Get("Accept"))
+			}
+			http.Redirect(writer, req, storage.URL+"/triggers.tar.gz", http.StatusFound)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "collectionauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := downloadTrigger(server.URL+"/owner/collections/index.yaml", dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "incubator.trigger.tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+
+	/* without credentials the collection can not be read */
+	collectionAuth = ""
+	if err := downloadTrigger(server.URL+"/owner/collections/index.yaml", dir); err == nil {
+		t.Fatal("downloaded a private collection anonymously")
+	}
+}
+
+func TestCollectionCredentialHosts(t *testing.T) {
+	savedAuth, savedSecret, savedHosts, savedRead := collectionAuth, collectionSecret, collectionAuthHosts, readProviderSecret
+	defer func() {
+		collectionAuth, collectionSecret, collectionAuthHosts, readProviderSecret = savedAuth, savedSecret, savedHosts, savedRead
+	}()
+	collectionAuth, collectionSecret, collectionAuthHosts = collectionAuthBasic, "collection-credentials", "mirror.example.com"
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{USERNAME: []byte("user"), PASSWORD: []byte("password")}, nil
+	}
+	creds, err := readCollectionCredentials("https://index.example.com/kabanero-index.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{"index.example.com": true, "mirror.example.com": true, "other.example.com": false} {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+host+"/triggers.tar.gz", nil)
+		creds.authorize(req)
+		if username, password, ok := req.BasicAuth(); ok != expected || (ok && (username != "user" || password != "password")) {
+			t.Errorf("unexpected credentials %v %v sent to %v", username, password, host)
+		}
+	}
+
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{USERNAME: []byte("user")}, nil
+	}
+	if _, err := readCollectionCredentials("https://index.example.com/kabanero-index.yaml"); err == nil {
+		t.Fatal("read credentials without a password")
+	}
+	collectionSecret = ""
+	if err := checkCollectionAuth(); err == nil {
+		t.Fatal("accepted -collectionAuth without -collectionSecret")
+	}
+}
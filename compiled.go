@@ -0,0 +1,203 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"k8s.io/klog"
+)
+
+/*
+Compiled trigger cache. The CEL expressions of the triggers of a collection are parsed, and its resource templates
+are parsed with its template library, once rather than for every event. The compiled expressions and templates are
+kept by digest of the collection, so that a collection loaded again with the same digest, such as a canary or shadow
+collection identical to the active one, reuses them. Collections are precompiled when loaded, the canary and shadow
+collections in the background, so that the first events after a load do not pay for the compilation.
+*/
+
+var compiledCacheSize = 4 // number of collection digests whose compiled expressions and templates are kept
+
+/* The compiled expressions and templates of a collection */
+type compiledCollection struct {
+	digest      string
+	mutex       sync.RWMutex
+	expressions map[string]cel.Ast            // parsed CEL expressions, by source
+	templates   map[string]*template.Template // templates parsed with the library of the collection, by source
+	lastUsed    time.Time                     // when the collection was last loaded
+}
+
+var (
+	compiledMutex       sync.Mutex
+	compiledCollections = make(map[string]*compiledCollection) // by digest
+)
+
+/* Return the compiled expressions and templates of the collection with a digest, evicting the least recently loaded */
+func compiledCollectionFor(digest string) *compiledCollection {
+	compiledMutex.Lock()
+	defer compiledMutex.Unlock()
+	if cc, ok := compiledCollections[digest]; ok {
+		cc.lastUsed = time.Now()
+		incrementMetric("compiledCache.reused")
+		return cc
+	}
+	for len(compiledCollections) >= compiledCacheSize && len(compiledCollections) > 0 {
+		var oldest *compiledCollection
+		for _, cc := range compiledCollections {
+			if oldest == nil || cc.lastUsed.Before(oldest.lastUsed) {
+				oldest = cc
+			}
+		}
+		delete(compiledCollections, oldest.digest)
+	}
+	cc := &compiledCollection{digest: digest, expressions: make(map[string]cel.Ast), templates: make(map[string]*template.Template), lastUsed: time.Now()}
+	compiledCollections[digest] = cc
+	return cc
+}
+
+/*
+Parse a CEL expression, or return its cached parse. Parsing does not depend on the declarations of the environment, so
+that the parse is shared by all evaluations, whatever the variables they declare. A nil collection does not cache.
+*/
+func (cc *compiledCollection) parse(env cel.Env, expression string) (cel.Ast, cel.Issues) {
+	if cc == nil {
+		return env.Parse(expression)
+	}
+	cc.mutex.RLock()
+	parsed, ok := cc.expressions[expression]
+	cc.mutex.RUnlock()
+	if ok {
+		incrementMetric("compiledCache.hits")
+		return parsed, nil
+	}
+	incrementMetric("compiledCache.misses")
+	parsed, issues := env.Parse(expression)
+	if issues != nil && issues.Err() != nil {
+		return parsed, issues
+	}
+	cc.mutex.Lock()
+	cc.expressions[expression] = parsed
+	cc.mutex.Unlock()
+	return parsed, issues
+}
+
+/* Parse a template with a library, that may be nil, or return its cached parse. A nil collection does not cache */
+func (cc *compiledCollection) template(library *template.Template, templateStr string) (*template.Template, error) {
+	if cc == nil {
+		return parseTemplate(library, templateStr)
+	}
+	cc.mutex.RLock()
+	parsed, ok := cc.templates[templateStr]
+	cc.mutex.RUnlock()
+	if ok {
+		incrementMetric("compiledCache.hits")
+		return parsed, nil
+	}
+	incrementMetric("compiledCache.misses")
+	parsed, err := parseTemplate(library, templateStr)
+	if err != nil {
+		return nil, err
+	}
+	/* a parsed template may be executed concurrently */
+	cc.mutex.Lock()
+	cc.templates[templateStr] = parsed
+	cc.mutex.Unlock()
+	return parsed, nil
+}
+
+/* Parse a template that may refer to the named templates defined in a library. The library may be nil */
+func parseTemplate(library *template.Template, templateStr string) (*template.Template, error) {
+	if library == nil {
+		return template.New("kabanero").Parse(templateStr)
+	}
+	t, err := library.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return t.New("kabanero").Parse(templateStr)
+}
+
+/* Collect the strings of a trigger body, which are the CEL expressions of its statements */
+func collectExpressions(value interface{}, expressions map[string]bool) {
+	switch typed := value.(type) {
+	case string:
+		/* assignments are parsed without their surrounding spaces */
+		expressions[typed] = true
+		expressions[strings.Trim(typed, " ")] = true
+	case []interface{}:
+		for _, element := range typed {
+			collectExpressions(element, expressions)
+		}
+	case map[interface{}]interface{}:
+		for _, element := range typed {
+			collectExpressions(element, expressions)
+		}
+	}
+}
+
+/*
+Compile the expressions of the triggers and functions of the collection, and its resource templates. Strings that are
+not expressions, such as the names of the input variables, or files that are not templates, fail to parse and are
+skipped: they are reported when evaluated, as without a cache.
+*/
+func (tp *triggerProcessor) precompile() {
+	if tp.compiled == nil {
+		return
+	}
+	start := time.Now()
+	env, err := tp.initializeEmptyCELEnv()
+	if err != nil {
+		klog.Warningf("Unable to precompile the triggers of the %v collection: %v", tp.name, err)
+		return
+	}
+	expressions := make(map[string]bool)
+	for _, triggers := range tp.triggerDef.eventTriggers {
+		for _, trigger := range triggers {
+			collectExpressions(trigger[BODY], expressions)
+		}
+	}
+	for _, function := range tp.triggerDef.functions {
+		collectExpressions(function[BODY], expressions)
+	}
+	compiled := 0
+	for expression := range expressions {
+		if _, issues := tp.compiled.parse(env, expression); issues == nil || issues.Err() == nil {
+			compiled++
+		}
+	}
+
+	files, err := findFiles(tp.triggerDir, []string{".yaml", ".yml"})
+	if err != nil {
+		klog.Warningf("Unable to precompile the resources of the %v collection: %v", tp.name, err)
+	}
+	for _, fileName := range files {
+		bytes, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			continue
+		}
+		if _, err = tp.compiled.template(tp.templates, string(bytes)); err == nil {
+			compiled++
+		}
+	}
+	incrementMetric("compiledCache.precompiled")
+	klog.Infof("Precompiled %v expressions and templates of the %v collection in %v", compiled, tp.name, time.Since(start))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/google/cel-go/cel"
+)
+
+func TestCompiledCollectionFor(t *testing.T) {
+	savedCollections, savedSize := compiledCollections, compiledCacheSize
+	defer func() { compiledCollections, compiledCacheSize = savedCollections, savedSize }()
+	compiledCollections, compiledCacheSize = make(map[string]*compiledCollection), 2
+
+	first := compiledCollectionFor("a")
+	if compiledCollectionFor("a") != first {
+		t.Fatal("the compiled collection of a digest was not reused")
+	}
+	compiledCollectionFor("b")
+	compiledCollectionFor("a")
+	/* b is the least recently loaded */
+	compiledCollectionFor("c")
+	if _, ok := compiledCollections["b"]; ok || len(compiledCollections) != 2 || compiledCollectionFor("a") != first {
+		t.Fatalf("unexpected compiled collections %v", compiledCollections)
+	}
+}
+
+func TestCompiledCollectionCache(t *testing.T) {
+	tp := newTriggerProcessor()
+	env, err := tp.initializeEmptyCELEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &compiledCollection{expressions: make(map[string]cel.Ast), templates: make(map[string]*template.Template)}
+	parsed, issues := cc.parse(env, `event.attr1 == "string1"`)
+	if issues != nil && issues.Err() != nil {
+		t.Fatal(issues.Err())
+	}
+	if again, _ := cc.parse(env, `event.attr1 == "string1"`); again != parsed {
+		t.Fatal("the parse of the expression was not cached")
+	}
+	if _, issues = cc.parse(env, `event.attr1 ==`); issues == nil || issues.Err() == nil || len(cc.expressions) != 1 {
+		t.Fatalf("unexpected parse of an invalid expression: %v", cc.expressions)
+	}
+
+	library := template.Must(template.New("library").Parse(`{{define "name"}}{{.name}}{{end}}`))
+	for i := 0; i < 2; i++ {
+		substituted, err := substituteCompiledTemplate(cc, library, `name: {{template "name" .}}`, map[string]string{"name": "test"})
+		if err != nil || substituted != "name: test" {
+			t.Fatalf("unexpected substitution %v: %v", substituted, err)
+		}
+	}
+	if len(cc.templates) != 1 {
+		t.Fatalf("the template was not cached: %v", cc.templates)
+	}
+}
+
+func TestPrecompile(t *testing.T) {
+	savedCollections := compiledCollections
+	defer func() { compiledCollections = savedCollections }()
+	compiledCollections = make(map[string]*compiledCollection)
+
+	tp := newTriggerProcessor()
+	if err := tp.initialize(TRIGGER10); err != nil {
+		t.Fatal(err)
+	}
+	tp.precompile()
+	if _, ok := tp.compiled.expressions[`"first"`]; !ok {
+		t.Fatalf("the expressions were not precompiled: %v", tp.compiled.expressions)
+	}
+	/* the same collection loaded again reuses the compiled expressions */
+	other := newTriggerProcessor()
+	if err := other.initialize(TRIGGER10); err != nil {
+		t.Fatal(err)
+	}
+	if other.compiled != tp.compiled {
+		t.Fatal("the compiled collection was not shared by collections with the same digest")
+	}
+	result, err := other.evaluateMessage(map[string]interface{}{"attr1": "string1"}, "default", evalOptions{dryrun: true})
+	if err != nil || len(result.variables) != 2 || result.variables[0]["result"] != "first" {
+		t.Fatalf("unexpected result %v: %v", result, err)
+	}
+}
@@ -0,0 +1,482 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Configuration from custom resources. With -crdConfig, the messageProviders and eventDestinations of
+eventDefinitions.yaml may also be defined by the EventProvider and EventDestination CRs of the namespace, and the
+active trigger collection by its EventTrigger CRs, so that the configuration is GitOps friendly and validated by the
+OpenAPI schemas of the CRDs, which the crds subcommand generates from the definitions of eventDefinitions.yaml. The CRs
+are watched, and their changes applied without restarting: the providers that are added or changed are created, and
+listeners are started for the new event sources, while the trigger files of the EventTriggers are written to a local
+trigger directory that is reloaded when they change. A CR takes precedence over the definition of the same name in
+eventDefinitions.yaml.
+*/
+
+const (
+	EVENTPROVIDERS        = "eventproviders"
+	EVENTDESTINATIONS     = "eventdestinations"
+	EVENTTRIGGERRESOURCES = "eventtriggers"
+
+	crdConfigSettleDelay = time.Second // delay to apply the changes of several CRs at once
+)
+
+var (
+	crdConfig    bool   // whether the configuration is also read from CRs
+	crdConfigDir string // local trigger directory of the EventTriggers, if they are the active collection
+
+	eventProvidersGVR    = schema.GroupVersionResource{Group: KABANEROIO, Version: V1ALPHA1, Resource: EVENTPROVIDERS}
+	eventDestinationsGVR = schema.GroupVersionResource{Group: KABANEROIO, Version: V1ALPHA1, Resource: EVENTDESTINATIONS}
+	eventTriggersGVR     = schema.GroupVersionResource{Group: KABANEROIO, Version: V1ALPHA1, Resource: EVENTTRIGGERRESOURCES}
+
+	crdConfigMutex          sync.Mutex        // one application of the CRs at a time
+	currentCRDConfig        *crdConfiguration // configuration of the CRs last applied
+	fileEventDefinition     *EventDefinition  // eventDefinitions.yaml, without the CRs
+	crdTriggersFailedDigest string            // digest of the trigger files that failed to load
+)
+
+/* The configuration of the CRs of a namespace */
+type crdConfiguration struct {
+	Providers    []*MessageProviderDefinition `yaml:"providers"`
+	Destinations []*EventNode                 `yaml:"destinations"`
+	Triggers     map[string]string            `yaml:"triggers"` // content of the trigger file of each EventTrigger, by file name
+}
+
+/* Decode the spec of a CR into a definition of eventDefinitions.yaml */
+func decodeCRSpec(cr *unstructured.Unstructured, definition interface{}) error {
+	spec, _, _ := unstructured.NestedMap(cr.Object, SPEC)
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(data, definition); err != nil {
+		return fmt.Errorf("invalid spec of %s %s: %v", cr.GetKind(), cr.GetName(), err)
+	}
+	return nil
+}
+
+/* List the CRs of a resource of a namespace, sorted by name */
+func listConfigCRs(dynInterf dynamic.Interface, gvr schema.GroupVersionResource, namespace string) ([]unstructured.Unstructured, error) {
+	list, err := dynInterf.Resource(gvr).Namespace(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s in namespace %s: %v", gvr.Resource, namespace, err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].GetName() < list.Items[j].GetName() })
+	return list.Items, nil
+}
+
+/* Read the configuration of the CRs of a namespace */
+func readCRDConfiguration(dynInterf dynamic.Interface, namespace string) (*crdConfiguration, error) {
+	config := &crdConfiguration{Providers: make([]*MessageProviderDefinition, 0), Destinations: make([]*EventNode, 0), Triggers: make(map[string]string)}
+	providers, err := listConfigCRs(dynInterf, eventProvidersGVR, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for index := range providers {
+		provider := &MessageProviderDefinition{}
+		if err = decodeCRSpec(&providers[index], provider); err != nil {
+			return nil, err
+		}
+		provider.Name = providers[index].GetName()
+		config.Providers = append(config.Providers, provider)
+	}
+	destinations, err := listConfigCRs(dynInterf, eventDestinationsGVR, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for index := range destinations {
+		destination := &EventNode{}
+		if err = decodeCRSpec(&destinations[index], destination); err != nil {
+			return nil, err
+		}
+		destination.Name = destinations[index].GetName()
+		config.Destinations = append(config.Destinations, destination)
+	}
+	triggers, err := listConfigCRs(dynInterf, eventTriggersGVR, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for index := range triggers {
+		spec, _, _ := unstructured.NestedMap(triggers[index].Object, SPEC)
+		data, err := yaml.Marshal(spec)
+		if err != nil {
+			return nil, err
+		}
+		config.Triggers[triggers[index].GetName()+".yaml"] = string(data)
+	}
+	return config, nil
+}
+
+/* Return the digest of a definition */
+func definitionDigest(definition interface{}) string {
+	data, _ := yaml.Marshal(definition)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/* Return a copy of an eventDefinitions.yaml with the providers and destinations of the CRs, which take precedence */
+func mergeCRDConfiguration(ed *EventDefinition, config *crdConfiguration) *EventDefinition {
+	merged := *ed
+	merged.MessageProviders = make([]*MessageProviderDefinition, 0, len(ed.MessageProviders)+len(config.Providers))
+	defined := make(map[string]bool)
+	for _, provider := range config.Providers {
+		defined[provider.Name] = true
+	}
+	for _, provider := range ed.MessageProviders {
+		if !defined[provider.Name] {
+			merged.MessageProviders = append(merged.MessageProviders, provider)
+		}
+	}
+	merged.MessageProviders = append(merged.MessageProviders, config.Providers...)
+
+	merged.EventDestinations = make([]*EventNode, 0, len(ed.EventDestinations)+len(config.Destinations))
+	defined = make(map[string]bool)
+	for _, destination := range config.Destinations {
+		defined[destination.Name] = true
+	}
+	for _, destination := range ed.EventDestinations {
+		if !defined[destination.Name] {
+			merged.EventDestinations = append(merged.EventDestinations, destination)
+		}
+	}
+	merged.EventDestinations = append(merged.EventDestinations, config.Destinations...)
+	return &merged
+}
+
+/* Write the trigger files of the EventTriggers to a directory, removing those of the deleted EventTriggers */
+func writeCRDTriggers(dir string, triggers map[string]string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := triggers[file.Name()]; !ok && strings.HasSuffix(file.Name(), ".yaml") {
+			if err = os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	for name, content := range triggers {
+		path := filepath.Join(dir, name)
+		if existing, err := ioutil.ReadFile(path); err == nil && string(existing) == content {
+			continue
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Read the CRs of a namespace before the collections and eventDefinitions.yaml are loaded. If the namespace has
+EventTriggers and no -triggerDir is set, their trigger files are written to a local trigger directory, which becomes
+the active collection. EventTriggers are refused if signed collections are required.
+*/
+func initializeCRDConfig(dynInterf dynamic.Interface, namespace string) error {
+	config, err := readCRDConfiguration(dynInterf, namespace)
+	if err != nil {
+		return err
+	}
+	currentCRDConfig = config
+	klog.Infof("Read %v EventProviders, %v EventDestinations, and %v EventTriggers of namespace %s", len(config.Providers), len(config.Destinations), len(config.Triggers), namespace)
+	if len(config.Triggers) == 0 {
+		return nil
+	}
+	if triggerDir != "" {
+		klog.Warningf("The EventTriggers of namespace %s are ignored, since the trigger directory %s is set", namespace, triggerDir)
+		return nil
+	}
+	/* EventTriggers are not signed, and would replace the verified collection */
+	if err = checkCRDTriggersSupported(namespace); err != nil {
+		return err
+	}
+	crdConfigDir, err = ioutil.TempDir("", "eventtriggers")
+	if err != nil {
+		return err
+	}
+	if err = writeCRDTriggers(crdConfigDir, config.Triggers); err != nil {
+		return fmt.Errorf("unable to write the trigger files of the EventTriggers: %v", err)
+	}
+	triggerDir = crdConfigDir
+	return nil
+}
+
+/* Apply the changes of the CRs of a namespace */
+func applyCRDConfig(dynInterf dynamic.Interface, namespace string) error {
+	crdConfigMutex.Lock()
+	defer crdConfigMutex.Unlock()
+	config, err := readCRDConfiguration(dynInterf, namespace)
+	if err != nil {
+		return err
+	}
+	if currentCRDConfig != nil && definitionDigest(config) == definitionDigest(currentCRDConfig) {
+		return nil
+	}
+	incrementMetric("crdConfig.changes")
+
+	if crdConfigDir != "" && triggerDir == crdConfigDir {
+		if err = writeCRDTriggers(crdConfigDir, config.Triggers); err != nil {
+			return fmt.Errorf("unable to write the trigger files of the EventTriggers: %v", err)
+		}
+		if len(config.Triggers) > 0 {
+			crdTriggersFailedDigest = reloadChangedTriggerDir(crdTriggersFailedDigest)
+		}
+	}
+
+	previous := currentEventProviders()
+	merged := mergeCRDConfiguration(fileEventDefinition, config)
+	providers, created := make(map[string]MessageProvider), make(map[string]MessageProvider)
+	for _, definition := range merged.MessageProviders {
+		existing := previous.GetMessageProviderDefinition(definition.Name)
+		if mp := lookupMessageProvider(definition.Name); mp != nil && existing != nil && definitionDigest(existing) == definitionDigest(definition) {
+			providers[definition.Name] = mp
+			continue
+		}
+		mp, err := createMessageProvider(definition)
+		if err != nil {
+			klog.Warningf("Unable to create messageProvider %s: %v", definition.Name, err)
+			continue
+		}
+		klog.Infof("Created messageProvider %s", definition.Name)
+		created[definition.Name] = mp
+	}
+	/* the created providers are wrapped as those of eventDefinitions.yaml are, the kept ones already are */
+	if err = initializeProviders(merged, created); err != nil {
+		for name, mp := range created {
+			if closeErr := closeMessageProvider(mp); closeErr != nil {
+				klog.Warningf("Unable to close the messageProvider %s: %v", name, closeErr)
+			}
+		}
+		return err
+	}
+	for name, mp := range created {
+		providers[name] = mp
+	}
+	/* the providers are replaced at once, since messages are being sent through them */
+	replaced := replaceEventProviders(merged, providers)
+	currentCRDConfig = config
+
+	if listenersStarted {
+		active, canary, shadow := currentCollections()
+		err = startListeners(merged, active, canary, shadow)
+	}
+	/* the replaced providers are closed once the listeners receiving from them are restarted */
+	for name, mp := range replaced {
+		if providers[name] == mp {
+			continue
+		}
+		if closeErr := closeMessageProvider(mp); closeErr != nil {
+			klog.Warningf("Unable to close the replaced messageProvider %s: %v", name, closeErr)
+		}
+	}
+	return err
+}
+
+/* Watch the CRs of a resource of a namespace, signaling their changes. Does not return */
+func watchCRDConfigResource(dynInterf dynamic.Interface, gvr schema.GroupVersionResource, namespace string, changes chan<- struct{}) {
+	for {
+		/* a watch without resource version starts with the existing CRs */
+		watcher, err := dynInterf.Resource(gvr).Namespace(namespace).Watch(metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("Unable to watch %s in namespace %s: %v", gvr.Resource, namespace, err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		for range watcher.ResultChan() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+		watcher.Stop()
+	}
+}
+
+/* Watch the CRs of a namespace, and apply their changes. Does not return */
+func watchCRDConfig(dynInterf dynamic.Interface, namespace string) {
+	changes := make(chan struct{}, 1)
+	for _, gvr := range []schema.GroupVersionResource{eventProvidersGVR, eventDestinationsGVR, eventTriggersGVR} {
+		go watchCRDConfigResource(dynInterf, gvr, namespace, changes)
+	}
+	for range changes {
+		time.Sleep(crdConfigSettleDelay)
+		if err := applyCRDConfig(dynInterf, namespace); err != nil {
+			incrementMetric("crdConfig.errors")
+			klog.Errorf("Unable to apply the EventProviders, EventDestinations, and EventTriggers of namespace %s: %v", namespace, err)
+		}
+	}
+}
+
+/* Generate the OpenAPI v3 schema of a definition of eventDefinitions.yaml, or of the spec of a CR */
+func openAPISchemaOf(typ reflect.Type) map[string]interface{} {
+	if typ == reflect.TypeOf(time.Duration(0)) {
+		/* durations are written as 30s or 5m */
+		return map[string]interface{}{"x-kubernetes-int-or-string": true}
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return openAPISchemaOf(typ.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": openAPISchemaOf(typ.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": openAPISchemaOf(typ.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{"x-kubernetes-preserve-unknown-fields": true}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			/* the definitions of eventDefinitions.yaml have YAML names, the specs of CRs JSON names */
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.Split(field.Tag.Get("json"), ",")[0]
+			}
+			if name == "" || name == "-" {
+				continue
+			}
+			properties[name] = openAPISchemaOf(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
+
+/* Return a CustomResourceDefinition of the kabanero.io group */
+func kabaneroCRD(kind string, plural string, spec map[string]interface{}, status bool) map[string]interface{} {
+	properties := map[string]interface{}{SPEC: spec}
+	version := map[string]interface{}{"name": V1ALPHA1, "served": true, "storage": true}
+	if status {
+		properties["status"] = map[string]interface{}{"type": "object", "x-kubernetes-preserve-unknown-fields": true}
+		version["subresources"] = map[string]interface{}{"status": map[string]interface{}{}}
+	}
+	version["schema"] = map[string]interface{}{"openAPIV3Schema": map[string]interface{}{
+		"type":       "object",
+		"required":   []interface{}{SPEC},
+		"properties": properties,
+	}}
+	return map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"kind":       "CustomResourceDefinition",
+		"metadata":   map[string]interface{}{"name": plural + "." + KABANEROIO},
+		SPEC: map[string]interface{}{
+			"group":    KABANEROIO,
+			"scope":    "Namespaced",
+			"names":    map[string]interface{}{"kind": kind, "plural": plural, "singular": strings.ToLower(kind), "listKind": kind + "List"},
+			"versions": []interface{}{version},
+		},
+	}
+}
+
+/* Generate the CustomResourceDefinitions of the configuration of kabanero-events */
+func configurationCRDs() []map[string]interface{} {
+	/* the name of a definition is that of its CR */
+	providerSpec := openAPISchemaOf(reflect.TypeOf(MessageProviderDefinition{}))
+	delete(providerSpec["properties"].(map[string]interface{}), "name")
+	providerSpec["required"] = []interface{}{"providerType"}
+	providerTypes := make([]interface{}, 0)
+	for _, providerType := range messageProviderTypes() {
+		providerTypes = append(providerTypes, providerType)
+	}
+	providerSpec["properties"].(map[string]interface{})["providerType"].(map[string]interface{})["enum"] = providerTypes
+
+	destinationSpec := openAPISchemaOf(reflect.TypeOf(EventNode{}))
+	delete(destinationSpec["properties"].(map[string]interface{}), "name")
+	destinationSpec["required"] = []interface{}{"topic", "providerRef"}
+
+	/* a trigger file, whose statements are free form */
+	triggerSpec := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{EVENTTRIGGERS},
+		"properties": map[string]interface{}{
+			EVENTTRIGGERS: map[string]interface{}{"type": "array", "items": map[string]interface{}{
+				"type":     "object",
+				"required": []interface{}{NAME, EVENTSOURCE, INPUT, BODY},
+				"properties": map[string]interface{}{
+					NAME:        map[string]interface{}{"type": "string"},
+					EVENTSOURCE: map[string]interface{}{"type": "string"},
+					INPUT:       map[string]interface{}{"type": "string"},
+					BODY:        map[string]interface{}{"type": "array", "items": map[string]interface{}{"x-kubernetes-preserve-unknown-fields": true}},
+				},
+				"x-kubernetes-preserve-unknown-fields": true,
+			}},
+		},
+		"x-kubernetes-preserve-unknown-fields": true,
+	}
+
+	mediatorSpec := openAPISchemaOf(reflect.TypeOf(eventMediatorSpec{}))
+	mediatorSpec["properties"].(map[string]interface{})["tls"].(map[string]interface{})["properties"].(map[string]interface{})["mode"].(map[string]interface{})["enum"] = []interface{}{tlsModeServiceCA, tlsModeCertManager, tlsModeSecret, tlsModeNone}
+
+	return []map[string]interface{}{
+		kabaneroCRD("EventProvider", EVENTPROVIDERS, providerSpec, false),
+		kabaneroCRD("EventDestination", EVENTDESTINATIONS, destinationSpec, false),
+		kabaneroCRD("EventTrigger", EVENTTRIGGERRESOURCES, triggerSpec, false),
+		kabaneroCRD(EVENTMEDIATOR, EVENTMEDIATORS, mediatorSpec, true),
+	}
+}
+
+/*
+crdsCommand implements "kabanero-events crds".
+It prints the CustomResourceDefinitions of the EventProvider, EventDestination, EventTrigger, and EventMediator CRs.
+*/
+func crdsCommand(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: kabanero-events crds\n")
+		return 2
+	}
+	for _, crd := range configurationCRDs() {
+		bytes, err := yaml.Marshal(crd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "crds: %v\n", err)
+			return 1
+		}
+		fmt.Printf("---\n%s", bytes)
+	}
+	return 0
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+func newConfigCR(kind string, name string, spec map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": KABANEROIO + "/" + V1ALPHA1,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "kabanero"},
+		SPEC:         spec,
+	}
+}
+
+func TestApplyCRDConfig(t *testing.T) {
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventproviders/webhook-http": newConfigCR("EventProvider", "webhook-http", map[string]interface{}{
+			"providerType": "http", "url": "http://localhost:1/events", "timeout": "5s",
+		}),
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventdestinations/github": newConfigCR("EventDestination", "github", map[string]interface{}{
+			"topic": "github-events", "providerRef": "webhook-http", "accepts": []interface{}{"push"},
+		}),
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventtriggers/build": newConfigCR("EventTrigger", "build", map[string]interface{}{
+			EVENTTRIGGERS: []interface{}{map[string]interface{}{NAME: "build", EVENTSOURCE: "github", INPUT: "message", BODY: []interface{}{"x = 1"}}},
+		}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	dir, err := ioutil.TempDir("", "eventtriggers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	captured := &capturingProvider{}
+	savedProviders, savedDefinitions, savedFile, savedConfig := messageProviders, eventProviders, fileEventDefinition, currentCRDConfig
+	savedDir, savedTriggerDir, savedStarted := crdConfigDir, triggerDir, listenersStarted
+	defer func() {
+		messageProviders, eventProviders, fileEventDefinition, currentCRDConfig = savedProviders, savedDefinitions, savedFile, savedConfig
+		crdConfigDir, triggerDir, listenersStarted = savedDir, savedTriggerDir, savedStarted
+	}()
+	crdConfigDir, triggerDir, listenersStarted, currentCRDConfig = dir, dir, false, nil
+	fileEventDefinition = &EventDefinition{
+		MessageProviders:  []*MessageProviderDefinition{{Name: "captured", ProviderType: "nats"}},
+		EventDestinations: []*EventNode{{Name: "github", Topic: "github", ProviderRef: "captured"}, {Name: "audit", Topic: "audit", ProviderRef: "captured"}},
+	}
+	eventProviders = fileEventDefinition
+	messageProviders = map[string]MessageProvider{"captured": captured}
+
+	if err = applyCRDConfig(client, "kabanero"); err != nil {
+		t.Fatal(err)
+	}
+	/* the providers of eventDefinitions.yaml are kept, and the destinations of the CRs take precedence */
+	if messageProviders["captured"] != captured || messageProviders["webhook-http"] == nil {
+		t.Fatalf("unexpected providers %v", messageProviders)
+	}
+	destination := eventProviders.GetEventDestination("github")
+	if destination.Topic != "github-events" || destination.ProviderRef != "webhook-http" || len(eventProviders.EventDestinations) != 2 {
+		t.Fatalf("unexpected destinations %v", eventProviders.EventDestinations)
+	}
+	if provider := eventProviders.GetMessageProviderDefinition("webhook-http"); provider.Timeout != 5*time.Second {
+		t.Fatalf("unexpected timeout %v", provider.Timeout)
+	}
+	triggers, err := ioutil.ReadFile(filepath.Join(dir, "build.yaml"))
+	if err != nil || !strings.Contains(string(triggers), "eventSource: github") {
+		t.Fatalf("unexpected trigger file %q: %v", triggers, err)
+	}
+
+	/* unchanged providers are not created again */
+	created := messageProviders["webhook-http"]
+	fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventdestinations/github"][SPEC].(map[string]interface{})["topic"] = "events"
+	delete(fake.objects, "/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventtriggers/build")
+	if err = applyCRDConfig(client, "kabanero"); err != nil {
+		t.Fatal(err)
+	}
+	if messageProviders["webhook-http"] != created || eventProviders.GetEventDestination("github").Topic != "events" {
+		t.Fatalf("unexpected providers %v, or destination %v", messageProviders, eventProviders.GetEventDestination("github"))
+	}
+	if _, err = os.Stat(filepath.Join(dir, "build.yaml")); !os.IsNotExist(err) {
+		t.Fatalf("trigger file of a deleted EventTrigger: %v", err)
+	}
+	fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventproviders/webhook-http"][SPEC].(map[string]interface{})["timeout"] = "10s"
+	if err = applyCRDConfig(client, "kabanero"); err != nil {
+		t.Fatal(err)
+	}
+	if messageProviders["webhook-http"] == created {
+		t.Fatalf("changed provider was not created again")
+	}
+
+	fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventproviders/webhook-http"][SPEC].(map[string]interface{})["timeout"] = []interface{}{}
+	if err = applyCRDConfig(client, "kabanero"); err == nil {
+		t.Fatalf("invalid EventProvider was applied")
+	}
+}
+
+func TestApplyCRDConfigRestartsListeners(t *testing.T) {
+	crPath := "/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventproviders/brokers"
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		crPath: newConfigCR("EventProvider", "brokers", map[string]interface{}{"providerType": "failover", "backends": []interface{}{"primary"}, "retryInterval": "1s"}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	primary := newBrokerProvider()
+	primary.timeout = true
+	savedProviders, savedDefinitions, savedFile, savedConfig := messageProviders, eventProviders, fileEventDefinition, currentCRDConfig
+	savedDir, savedStarted, savedProc, savedListening := crdConfigDir, listenersStarted, triggerProc, listening
+	defer func() {
+		for _, listener := range listening {
+			close(listener.stop)
+			closeMessageProvider(listener.provider)
+		}
+		messageProviders, eventProviders, fileEventDefinition, currentCRDConfig = savedProviders, savedDefinitions, savedFile, savedConfig
+		crdConfigDir, listenersStarted, triggerProc, listening = savedDir, savedStarted, savedProc, savedListening
+	}()
+	crdConfigDir, listenersStarted, currentCRDConfig = "", true, nil
+	listening = make(map[string]*sourceListener)
+	triggerProc = &triggerProcessor{name: "active", triggerDef: &eventTriggerDefinition{eventTriggers: map[string][]map[interface{}]interface{}{"github": nil}}}
+	fileEventDefinition = &EventDefinition{
+		MessageProviders:  []*MessageProviderDefinition{{Name: "primary", ProviderType: "nats"}},
+		EventDestinations: []*EventNode{{Name: "github", Topic: "github", ProviderRef: "brokers"}},
+	}
+	eventProviders = fileEventDefinition
+	messageProviders = map[string]MessageProvider{"primary": primary}
+
+	if err := applyCRDConfig(client, "kabanero"); err != nil {
+		t.Fatal(err)
+	}
+	first, ok := lookupMessageProvider("brokers").(*failoverProvider)
+	if !ok || listening["github"] == nil || listening["github"].provider != first {
+		t.Fatalf("the listener of github does not receive from the EventProvider: %v", listening)
+	}
+
+	/* the listener receiving from a changed provider is restarted, and the replaced provider closed */
+	fake.objects[crPath][SPEC].(map[string]interface{})["retryInterval"] = "2s"
+	if err := applyCRDConfig(client, "kabanero"); err != nil {
+		t.Fatal(err)
+	}
+	second := lookupMessageProvider("brokers")
+	if second == first || listening["github"].provider != second {
+		t.Fatalf("the listener of github was not restarted with the changed provider")
+	}
+	if !first.stopped() {
+		t.Fatal("the replaced provider was not closed")
+	}
+}
+
+func TestApplyCRDConfigSignsEnvelopes(t *testing.T) {
+	crPath := "/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventproviders/kafka"
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		crPath: newConfigCR("EventProvider", "kafka", map[string]interface{}{"providerType": "kafka-rest", "url": "http://localhost:1", "timeout": "1s"}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	savedProviders, savedDefinitions, savedFile, savedConfig := messageProviders, eventProviders, fileEventDefinition, currentCRDConfig
+	savedDir, savedStarted, savedKey := crdConfigDir, listenersStarted, os.Getenv(ENVELOPESIGNINGKEY)
+	defer func() {
+		messageProviders, eventProviders, fileEventDefinition, currentCRDConfig = savedProviders, savedDefinitions, savedFile, savedConfig
+		crdConfigDir, listenersStarted = savedDir, savedStarted
+		os.Setenv(ENVELOPESIGNINGKEY, savedKey)
+	}()
+	crdConfigDir, listenersStarted, currentCRDConfig = "", false, nil
+	os.Setenv(ENVELOPESIGNINGKEY, "key")
+	fileEventDefinition = &EventDefinition{EventDestinations: []*EventNode{{Name: "github", Topic: "github", ProviderRef: "kafka"}}}
+	eventProviders = fileEventDefinition
+	messageProviders = map[string]MessageProvider{}
+
+	/* providers created from a CR, or swapped in once it changes, sign and verify envelopes */
+	for _, timeout := range []string{"1s", "2s"} {
+		fake.objects[crPath][SPEC].(map[string]interface{})["timeout"] = timeout
+		if err := applyCRDConfig(client, "kabanero"); err != nil {
+			t.Fatal(err)
+		}
+		signing, ok := lookupMessageProvider("kafka").(*signingProvider)
+		if !ok {
+			t.Fatalf("provider of the EventProvider does not sign envelopes: %T", lookupMessageProvider("kafka"))
+		}
+		if _, ok = signing.MessageProvider.(*kafkaProvider); !ok {
+			t.Fatalf("unexpected provider wrapped: %T", signing.MessageProvider)
+		}
+	}
+}
+
+func TestInitializeCRDConfigSignatures(t *testing.T) {
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventtriggers/build": newConfigCR("EventTrigger", "build", map[string]interface{}{
+			EVENTTRIGGERS: []interface{}{map[string]interface{}{NAME: "build", EVENTSOURCE: "github", INPUT: "message", BODY: []interface{}{"x = 1"}}},
+		}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+	savedConfig, savedDir, savedTriggerDir, savedSecret := currentCRDConfig, crdConfigDir, triggerDir, signatureKeysSecret
+	defer func() {
+		currentCRDConfig, crdConfigDir, triggerDir, signatureKeysSecret = savedConfig, savedDir, savedTriggerDir, savedSecret
+	}()
+	crdConfigDir, triggerDir = "", ""
+
+	/* the unsigned EventTriggers do not replace the signed collection */
+	signatureKeysSecret = "trigger-keys"
+	if err := initializeCRDConfig(client, "kabanero"); err == nil || triggerDir != "" {
+		t.Fatalf("EventTriggers were loaded with signatures required: %v", err)
+	}
+	signatureKeysSecret = ""
+	if err := initializeCRDConfig(client, "kabanero"); err != nil || triggerDir == "" {
+		t.Fatalf("EventTriggers were not loaded: %v", err)
+	}
+	os.RemoveAll(triggerDir)
+}
+
+func TestConfigurationCRDs(t *testing.T) {
+	crds := configurationCRDs()
+	if len(crds) != 4 {
+		t.Fatalf("%v CRDs", len(crds))
+	}
+	spec := func(crd map[string]interface{}) map[string]interface{} {
+		version := crd[SPEC].(map[string]interface{})["versions"].([]interface{})[0].(map[string]interface{})
+		return version["schema"].(map[string]interface{})["openAPIV3Schema"].(map[string]interface{})["properties"].(map[string]interface{})[SPEC].(map[string]interface{})
+	}
+	provider := spec(crds[0])["properties"].(map[string]interface{})
+	if _, ok := provider["name"]; ok {
+		t.Fatalf("the name of an EventProvider is in its spec")
+	}
+	if len(provider["providerType"].(map[string]interface{})["enum"].([]interface{})) != len(messageProviderTypes()) || provider["timeout"].(map[string]interface{})["x-kubernetes-int-or-string"] != true {
+		t.Fatalf("unexpected schema %v", provider)
+	}
+	if redis := provider["redis"].(map[string]interface{}); redis["type"] != "object" || redis["properties"].(map[string]interface{})["maxLen"] == nil {
+		t.Fatalf("unexpected redis schema %v", redis)
+	}
+	if required := spec(crds[1])["required"].([]interface{}); len(required) != 2 {
+		t.Fatalf("unexpected required fields %v", required)
+	}
+	if mode := spec(crds[3])["properties"].(map[string]interface{})["tls"].(map[string]interface{})["properties"].(map[string]interface{})["mode"]; len(mode.(map[string]interface{})["enum"].([]interface{})) != 4 {
+		t.Fatalf("unexpected tls mode %v", mode)
+	}
+	if crds[3][SPEC].(map[string]interface{})["versions"].([]interface{})[0].(map[string]interface{})["subresources"] == nil {
+		t.Fatalf("EventMediator has no status subresource")
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Retries and dead-lettering of webhook messages that could not be sent. A failed send is queued, and retried in the
+background with exponential backoff by a fixed number of workers. If the queue is full, the message is dead-lettered
+without being retried. Once the retries are exhausted, the message is dead-lettered: written to the dead-letter spool
+directory, from which it can be replayed through the admin API, and/or sent to the dead-letter destination.
+*/
+
+const (
+	deadLetterSuffix = ".json"
+	retryQueueSize   = 1000 // failed sends waiting to be retried, beyond which messages are dead-lettered
+	retryWorkers     = 8    // failed sends retried at the same time
+)
+
+var (
+	sendRetries           int           // retries of a failed send before the message is dead-lettered
+	sendRetryBackoff      time.Duration // delay before the first retry, doubled for each retry
+	deadLetterDestination string        // eventDestination receiving dead-lettered messages. None if empty
+	deadLetterDir         string        // directory where dead-lettered messages are spooled. None if empty
+
+	retryQueue     chan *failedSend
+	retryQueueOnce sync.Once
+)
+
+/* A send waiting to be retried */
+type failedSend struct {
+	destination string
+	message     []byte
+	err         error
+}
+
+/* A message that could not be sent */
+type deadLetter struct {
+	ID          string          `json:"id"`
+	Destination string          `json:"destination"`
+	Error       string          `json:"error"`
+	Attempts    int             `json:"attempts"`
+	Time        time.Time       `json:"time"`
+	Message     json.RawMessage `json:"message"`
+}
+
+/* Send a message to a destination. If it fails, the send is retried in the background before the message is dead-lettered. */
+func sendWithRetry(destination string, message []byte) error {
+	err := sendToDestination(destination, message, nil)
+	if err == nil {
+		return nil
+	}
+	incrementMetric("send.failures")
+	queueRetry(&failedSend{destination: destination, message: message, err: err})
+	return err
+}
+
+/* Queue a failed send to be retried, starting the retry workers on first use. Dead-letters the message if the queue is full */
+func queueRetry(send *failedSend) {
+	retryQueueOnce.Do(func() {
+		queue := make(chan *failedSend, retryQueueSize)
+		retryQueue = queue
+		for i := 0; i < retryWorkers; i++ {
+			go func() {
+				for send := range queue {
+					retrySend(send.destination, send.message, send.err)
+				}
+			}()
+		}
+	})
+	select {
+	case retryQueue <- send:
+	default:
+		incrementMetric("send.retryQueueFull")
+		deadLetterMessage(&deadLetter{ID: newRequestID(), Destination: send.destination, Error: send.err.Error(), Attempts: 1, Time: time.Now().UTC(), Message: send.message})
+	}
+}
+
+/* Retry a failed send with exponential backoff, and dead-letter the message if all retries fail */
+func retrySend(destination string, message []byte, err error) {
+	backoff := sendRetryBackoff
+	attempts := 1
+	for retry := 0; retry < sendRetries; retry++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		attempts++
+		if err = sendToDestination(destination, message, nil); err == nil {
+			incrementMetric("send.retried")
+			if klog.V(2) {
+				klog.Infof("Sent message to %v after %v attempts", destination, attempts)
+			}
+			return
+		}
+		klog.Warningf("Attempt %v of sending message to %v failed: %v", attempts, destination, err)
+	}
+	deadLetterMessage(&deadLetter{ID: newRequestID(), Destination: destination, Error: err.Error(), Attempts: attempts, Time: time.Now().UTC(), Message: message})
+}
+
+/* Spool a dead-lettered message, and send it to the dead-letter destination */
+func deadLetterMessage(letter *deadLetter) {
+	incrementMetric("deadLetter.messages")
+	if !json.Valid(letter.Message) {
+		/* keep the message, even though it is not a JSON message such as those of the webhook */
+		quoted, _ := json.Marshal(string(letter.Message))
+		letter.Message = quoted
+	}
+	bytes, err := json.Marshal(letter)
+	if err != nil {
+		klog.Errorf("Unable to marshal dead-lettered message to %v: %v", letter.Destination, err)
+		return
+	}
+	kept := false
+	if deadLetterDir != "" {
+		if err = writeDeadLetter(letter.ID, bytes); err != nil {
+			klog.Errorf("Unable to spool dead-lettered message to %v: %v", letter.Destination, err)
+		} else {
+			kept = true
+		}
+	}
+	if deadLetterDestination != "" && deadLetterDestination != letter.Destination {
+		if err = sendToDestination(deadLetterDestination, bytes, nil); err != nil {
+			klog.Errorf("Unable to send dead-lettered message to %v: %v", deadLetterDestination, err)
+		} else {
+			kept = true
+		}
+	}
+	if !kept {
+		incrementMetric("deadLetter.dropped")
+		klog.Errorf("Dropped message to %v after %v attempts: %v", letter.Destination, letter.Attempts, letter.Error)
+		return
+	}
+	klog.Warningf("Dead-lettered message %v to %v after %v attempts: %v", letter.ID, letter.Destination, letter.Attempts, letter.Error)
+}
+
+/* Write a dead-lettered message to the spool, atomically so that partial messages are not replayed */
+func writeDeadLetter(id string, bytes []byte) error {
+	if err := os.MkdirAll(deadLetterDir, 0700); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(deadLetterDir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(bytes)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(deadLetterDir, id+deadLetterSuffix))
+}
+
+/* Return whether a string is the ID of a dead-lettered message, so that it can not name other files */
+func validDeadLetterID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return id != "" && err == nil
+}
+
+/* Read a dead-lettered message from the spool */
+func readDeadLetter(id string) (*deadLetter, error) {
+	if !validDeadLetterID(id) {
+		return nil, fmt.Errorf("invalid dead letter ID %v", id)
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(deadLetterDir, id+deadLetterSuffix))
+	if err != nil {
+		return nil, err
+	}
+	letter := &deadLetter{}
+	if err = json.Unmarshal(bytes, letter); err != nil {
+		return nil, fmt.Errorf("unable to parse dead letter %v: %v", id, err)
+	}
+	return letter, nil
+}
+
+/* List the dead-lettered messages of the spool, oldest first */
+func listDeadLetters() ([]*deadLetter, error) {
+	letters := make([]*deadLetter, 0)
+	if deadLetterDir == "" {
+		return letters, nil
+	}
+	files, err := ioutil.ReadDir(deadLetterDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return letters, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), deadLetterSuffix)
+		if !file.Mode().IsRegular() || id == file.Name() || !validDeadLetterID(id) {
+			continue
+		}
+		letter, err := readDeadLetter(id)
+		if err != nil {
+			klog.Errorf("Unable to read dead letter %v: %v", id, err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	return letters, nil
+}
+
+/* Send a dead-lettered message to its destination again, and remove it from the spool if sent */
+func replayDeadLetter(id string) error {
+	letter, err := readDeadLetter(id)
+	if err != nil {
+		return err
+	}
+	if err = sendToDestination(letter.Destination, interactiveMessage(letter.Message), nil); err != nil {
+		return err
+	}
+	incrementMetric("deadLetter.replayed")
+	return os.Remove(filepath.Join(deadLetterDir, id+deadLetterSuffix))
+}
+
+/*
+Return a dead-lettered message marked as interactive, as its replay is requested by a user. Messages that are not
+JSON objects are returned unchanged.
+*/
+func interactiveMessage(data []byte) []byte {
+	message := make(map[string]interface{})
+	if err := json.Unmarshal(data, &message); err != nil {
+		return data
+	}
+	message[INTERACTIVE] = true
+	marked, err := json.Marshal(message)
+	if err != nil {
+		return data
+	}
+	return marked
+}
+
+/*
+GET /admin/deadletters lists the dead-lettered messages.
+POST /admin/deadletters/replay replays all of them, and POST /admin/deadletters/<id>/replay replays one.
+DELETE /admin/deadletters/<id> discards one.
+*/
+func adminDeadLettersHandler(writer http.ResponseWriter, req *http.Request) {
+	if deadLetterDir == "" {
+		writeError(writer, req, codeNotFound, "dead-letter spool is not configured")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/deadletters"), "/")
+	switch {
+	case path == "" && req.Method == http.MethodGet:
+		letters, err := listDeadLetters()
+		if err != nil {
+			writeError(writer, req, codeInternalError, err.Error())
+			return
+		}
+		writeJSON(writer, letters)
+	case path == "replay" && req.Method == http.MethodPost:
+		letters, err := listDeadLetters()
+		if err != nil {
+			writeError(writer, req, codeInternalError, err.Error())
+			return
+		}
+		results := make(map[string]string)
+		for _, letter := range letters {
+			results[letter.ID] = "replayed"
+			if err := replayDeadLetter(letter.ID); err != nil {
+				results[letter.ID] = err.Error()
+			}
+		}
+		writeJSON(writer, results)
+	case strings.HasSuffix(path, "/replay") && req.Method == http.MethodPost:
+		id := strings.TrimSuffix(path, "/replay")
+		if !validDeadLetterID(id) {
+			http.NotFound(writer, req)
+			return
+		}
+		if err := replayDeadLetter(id); err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(writer, req)
+				return
+			}
+			writeError(writer, req, codeBadGateway, err.Error())
+			return
+		}
+		writeJSON(writer, map[string]string{id: "replayed"})
+	case validDeadLetterID(path) && req.Method == http.MethodDelete:
+		if err := os.Remove(filepath.Join(deadLetterDir, path+deadLetterSuffix)); err != nil {
+			if os.IsNotExist(err) {
+				http.NotFound(writer, req)
+				return
+			}
+			writeError(writer, req, codeInternalError, err.Error())
+			return
+		}
+		writeJSON(writer, map[string]string{path: "deleted"})
+	default:
+		writeError(writer, req, codeNotFound, "not found")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+/* A message provider failing the first sends */
+type failingProvider struct {
+	mutex    sync.Mutex
+	failures int
+	sends    int
+	messages [][]byte
+}
+
+func (provider *failingProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.sends++
+	if provider.sends <= provider.failures {
+		return fmt.Errorf("send %v failed", provider.sends)
+	}
+	provider.messages = append(provider.messages, payload)
+	return nil
+}
+func (provider *failingProvider) Subscribe(node *EventNode) error                       { return nil }
+func (provider *failingProvider) Receive(node *EventNode) ([]byte, error)               { return nil, nil }
+func (provider *failingProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {}
+
+func (provider *failingProvider) sent() ([][]byte, int) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	return provider.messages, provider.sends
+}
+
+/* Set up the webhook and dead-letter destinations, and the retries, restoring them when done */
+func setupDeadLetters(t *testing.T, webhook MessageProvider, dlq MessageProvider) func() {
+	dir, err := ioutil.TempDir("", "deadletters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	savedRetries, savedBackoff, savedDestination, savedDir := sendRetries, sendRetryBackoff, deadLetterDestination, deadLetterDir
+	messageProviders = map[string]MessageProvider{"webhook": webhook, "dlq": dlq}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "webhook"}, {Name: "dlq", ProviderRef: "dlq"}}}
+	sendRetries, sendRetryBackoff, deadLetterDestination, deadLetterDir = 2, time.Millisecond, "dlq", dir
+	return func() {
+		messageProviders, eventProviders = savedProviders, savedDefinitions
+		sendRetries, sendRetryBackoff, deadLetterDestination, deadLetterDir = savedRetries, savedBackoff, savedDestination, savedDir
+		os.RemoveAll(dir)
+	}
+}
+
+/* Wait for a condition, failing after a second */
+func waitFor(t *testing.T, condition func() bool) {
+	for start := time.Now(); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	webhook := &failingProvider{failures: 2}
+	dlq := &capturingProvider{}
+	defer setupDeadLetters(t, webhook, dlq)()
+
+	if err := sendWithRetry(WEBHOOKDESTINATION, []byte(`{"eventID":"1"}`)); err == nil {
+		t.Fatal("first send did not fail")
+	}
+	waitFor(t, func() bool { messages, _ := webhook.sent(); return len(messages) == 1 })
+	if _, sends := webhook.sent(); sends != 3 {
+		t.Errorf("message sent %v times, expected 3", sends)
+	}
+	letters, err := listDeadLetters()
+	if err != nil || len(letters) != 0 || len(dlq.messages) != 0 {
+		t.Errorf("message was dead-lettered after a successful retry: %v, %v", letters, err)
+	}
+}
+
+func TestRetryQueueFull(t *testing.T) {
+	webhook := &failingProvider{}
+	dlq := &capturingProvider{}
+	defer setupDeadLetters(t, webhook, dlq)()
+
+	/* once the workers are started, a queue without room or workers */
+	queueRetry(&failedSend{destination: WEBHOOKDESTINATION, message: []byte(`{"eventID":"0"}`), err: fmt.Errorf("send 0 failed")})
+	waitFor(t, func() bool { messages, _ := webhook.sent(); return len(messages) == 1 })
+	webhook.failures = 2
+	savedQueue := retryQueue
+	defer func() { retryQueue = savedQueue }()
+	retryQueue = make(chan *failedSend)
+
+	sendWithRetry(WEBHOOKDESTINATION, []byte(`{"eventID":"1"}`))
+	letters, err := listDeadLetters()
+	if err != nil || len(letters) != 1 || letters[0].Attempts != 1 {
+		t.Fatalf("message was not dead-lettered when the retry queue was full: %v, %v", letters, err)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	webhook := &failingProvider{failures: 3}
+	dlq := &capturingProvider{}
+	defer setupDeadLetters(t, webhook, dlq)()
+
+	message := `{"eventID":"1"}`
+	sendWithRetry(WEBHOOKDESTINATION, []byte(message))
+	var letters []*deadLetter
+	waitFor(t, func() bool { letters, _ = listDeadLetters(); return len(letters) == 1 })
+	letter := letters[0]
+	if letter.Destination != WEBHOOKDESTINATION || letter.Attempts != 3 || string(letter.Message) != message || letter.Error != "send 3 failed" {
+		t.Fatalf("unexpected dead letter %+v", letter)
+	}
+	waitFor(t, func() bool { dlq.mutex.Lock(); defer dlq.mutex.Unlock(); return len(dlq.messages) == 1 })
+	sentLetter := &deadLetter{}
+	if err := json.Unmarshal(dlq.messages[0], sentLetter); err != nil || sentLetter.ID != letter.ID {
+		t.Errorf("unexpected message sent to the dead-letter destination: %s, %v", dlq.messages[0], err)
+	}
+
+	/* replay through the admin API */
+	recorder := httptest.NewRecorder()
+	adminDeadLettersHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/deadletters/"+letter.ID+"/replay", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("replay returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+	if messages, _ := webhook.sent(); len(messages) != 1 || string(messages[0]) != `{"eventID":"1","interactive":true}` {
+		t.Errorf("unexpected replayed messages %s", messages)
+	}
+	if letters, _ = listDeadLetters(); len(letters) != 0 {
+		t.Errorf("replayed message was not removed from the spool: %v", letters)
+	}
+	recorder = httptest.NewRecorder()
+	adminDeadLettersHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/deadletters/"+letter.ID+"/replay", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("replay of a replayed message returned %v", recorder.Code)
+	}
+}
+
+/* The resources of the triggers of a replayed message are created with the interactive priority */
+func TestReplayedDeadLetterPriority(t *testing.T) {
+	webhook := &failingProvider{failures: 3}
+	dlq := &capturingProvider{}
+	defer setupDeadLetters(t, webhook, dlq)()
+	tp := newTriggerProcessor()
+	if err := tp.initialize("test_data/trigger11"); err != nil {
+		t.Fatal(err)
+	}
+	var priorities []int
+	savedFilters, savedDryRun := resourceFilters, dryRun
+	defer func() { resourceFilters, dryRun = savedFilters, savedDryRun }()
+	resourceFilters = append(resourceFilters, func(action *resourceAction, resource *unstructured.Unstructured) error {
+		priorities = append(priorities, action.priority)
+		return nil
+	})
+	dryRun = true
+
+	message := `{"eventID":"1","attr1":"string1"}`
+	sendWithRetry(WEBHOOKDESTINATION, []byte(message))
+	var letters []*deadLetter
+	waitFor(t, func() bool { letters, _ = listDeadLetters(); return len(letters) == 1 })
+	if err := replayDeadLetter(letters[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range [][]byte{[]byte(message), webhook.messages[0]} {
+		event := make(map[string]interface{})
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tp.processWithDeadline(event, "default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(priorities) != 2 || priorities[0] != priorityBulk || priorities[1] != priorityInteractive {
+		t.Errorf("unexpected priorities of the original and replayed messages: %v", priorities)
+	}
+}
+
+func TestDeadLettersHandler(t *testing.T) {
+	webhook := &failingProvider{failures: 1}
+	defer setupDeadLetters(t, webhook, &capturingProvider{})()
+
+	for _, id := range []string{"0a", "0b"} {
+		deadLetterMessage(&deadLetter{ID: id, Destination: WEBHOOKDESTINATION, Attempts: 3, Time: time.Now(), Message: []byte(`{}`)})
+	}
+	recorder := httptest.NewRecorder()
+	adminDeadLettersHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/deadletters", nil))
+	letters := make([]*deadLetter, 0)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &letters); err != nil || len(letters) != 2 || letters[0].ID != "0a" {
+		t.Fatalf("unexpected dead letters %s: %v", recorder.Body.String(), err)
+	}
+
+	/* the first replay fails, so one message is left */
+	recorder = httptest.NewRecorder()
+	adminDeadLettersHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/deadletters/replay", nil))
+	results := make(map[string]string)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil || results["0a"] != "send 1 failed" || results["0b"] != "replayed" {
+		t.Errorf("unexpected replay results %s: %v", recorder.Body.String(), err)
+	}
+
+	recorder = httptest.NewRecorder()
+	adminDeadLettersHandler(recorder, httptest.NewRequest(http.MethodDelete, "/admin/deadletters/0a", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("delete returned %v", recorder.Code)
+	}
+	if letters, _ := listDeadLetters(); len(letters) != 0 {
+		t.Errorf("dead letters left: %v", letters)
+	}
+
+	for _, path := range []string{"/admin/deadletters/..%2Fpasswd/replay", "/admin/deadletters/unknown"} {
+		recorder = httptest.NewRecorder()
+		adminDeadLettersHandler(recorder, httptest.NewRequest(http.MethodDelete, path, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%v returned %v", path, recorder.Code)
+		}
+	}
+}
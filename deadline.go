@@ -0,0 +1,119 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Deadline of the processing of an event. An event whose triggers are not evaluated within the deadline is recorded with a
+Timeout outcome, and the listener moves on to the next event. The evaluation is cancelled: actions not yet executed when
+the deadline passes are not executed. Events that fail or time out are reported to the failure destination.
+*/
+
+/* outcomes of the processing of an event */
+const (
+	outcomeSuccess = "Success"
+	outcomeError   = "Error"
+	outcomeTimeout = "Timeout"
+)
+
+var (
+	eventDeadline      time.Duration // deadline of the processing of an event. Unbounded if 0
+	failureDestination string        // eventDestination to report events that failed or timed out to. Not reported if empty
+)
+
+/* Report sent to the failure destination */
+type eventOutcome struct {
+	Outcome     string    `json:"outcome"`
+	EventID     string    `json:"eventID"`
+	EventSource string    `json:"eventSource"`
+	Collection  string    `json:"collection"`
+	Error       string    `json:"error"`
+	Time        time.Time `json:"time"`
+}
+
+/* Return an error if a context is done. A nil context is never done. */
+func checkContext(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("processing of event cancelled: %v", err)
+	}
+	return nil
+}
+
+/* Evaluate a message within the event deadline, and report its outcome if it failed or timed out */
+func (tp *triggerProcessor) processWithDeadline(message map[string]interface{}, eventSource string) (*evalResult, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if eventDeadline > 0 {
+		ctx, cancel = context.WithTimeout(ctx, eventDeadline)
+	}
+	defer cancel()
+
+	type evalReturn struct {
+		result *evalResult
+		err    error
+	}
+	done := make(chan evalReturn, 1)
+	go func() {
+		result, err := tp.evaluateMessage(message, eventSource, evalOptions{ctx: ctx, interactive: messageInteractive(message)})
+		done <- evalReturn{result: result, err: err}
+	}()
+
+	var ret evalReturn
+	select {
+	case ret = <-done:
+	case <-ctx.Done():
+		/* the evaluation stops at its next statement or action */
+		ret.err = fmt.Errorf("processing of event exceeded the deadline of %v", eventDeadline)
+	}
+
+	outcome := outcomeSuccess
+	if ret.err != nil {
+		outcome = outcomeError
+		if ctx.Err() == context.DeadlineExceeded {
+			outcome = outcomeTimeout
+			incrementMetric("triggerProcessor." + tp.name + ".timeouts")
+		}
+		reportOutcome(&eventOutcome{Outcome: outcome, EventID: messageEventID(message), EventSource: eventSource, Collection: tp.name, Error: ret.err.Error(), Time: time.Now()})
+	}
+	return ret.result, ret.err
+}
+
+/* Send the outcome of an event to the failure destination */
+func reportOutcome(outcome *eventOutcome) {
+	klog.Warningf("Event %v from %v: %v: %v", outcome.EventID, outcome.EventSource, outcome.Outcome, outcome.Error)
+	if failureDestination == "" {
+		return
+	}
+	bytes, err := json.Marshal(outcome)
+	if err != nil {
+		klog.Errorf("Unable to marshal outcome of event %v: %v", outcome.EventID, err)
+		return
+	}
+	if err = sendToDestination(failureDestination, bytes, nil); err != nil {
+		klog.Errorf("Unable to report outcome of event %v to %v: %v", outcome.EventID, failureDestination, err)
+	}
+}
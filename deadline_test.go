@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventDeadline(t *testing.T) {
+	tp := newTriggerProcessor()
+	err := tp.initialize("test_data/trigger11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := map[string]interface{}{"attr1": "string1"}
+
+	/* no action is executed once the deadline has passed */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := tp.evaluateMessage(event, "default", evalOptions{dryrun: true, ctx: ctx})
+	if err == nil {
+		t.Fatal("expected error evaluating with a cancelled context")
+	}
+	if result != nil && len(result.actions) != 0 {
+		t.Fatalf("actions executed after the deadline: %v", result.actions)
+	}
+
+	savedDeadline := eventDeadline
+	defer func() { eventDeadline = savedDeadline }()
+	eventDeadline = time.Nanosecond
+	/* the event does not match, so that no resource would be created if the deadline were not exceeded */
+	if _, err = tp.processWithDeadline(map[string]interface{}{"attr1": "other"}, "default"); err == nil {
+		t.Fatal("expected processing to exceed the deadline")
+	}
+	if metrics.Get("triggerProcessor.active.timeouts") == nil {
+		t.Fatal("timeout not counted")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Deprecation warnings. Deprecated configuration keys, trigger syntax, and provider options are registered in
+deprecations, and reported where they are read. Each usage is logged once as a warning, counted by the metric
+deprecation.<id>, listed in the configuration diagnostics, and set as the DeprecatedConfiguration condition of the
+status of the Kabanero CR. With -strict, kabanero-events refuses to start if any deprecated setting is in use, to
+enforce migrations before the deprecated forms are removed.
+*/
+
+const (
+	deprecationRESTProvider           = "providerType.rest"
+	deprecationDestinationTLSVerify   = "eventDestination.skipTLSVerify"
+	deprecationUnnamedTrigger         = "eventTrigger.unnamed"
+	deprecatedConfigurationCondition  = "DeprecatedConfiguration"
+	deprecatedConfigurationReason     = "DeprecatedSettingsInUse"
+	deprecatedConfigurationNoneReason = "NoDeprecatedSettings"
+)
+
+var strictMode bool // refuse to start if deprecated settings are in use
+
+/* A deprecated setting */
+type deprecation struct {
+	Description string // what is deprecated
+	Replacement string // what to use instead
+}
+
+/* The deprecated settings, by ID */
+var deprecations = map[string]deprecation{
+	deprecationRESTProvider:         {"messageProviders of providerType rest", "providerType http, which accepts any 2xx response, and supports retries and authentication"},
+	deprecationDestinationTLSVerify: {"skipTLSVerify in eventDestinations, which is ignored", "skipTLSVerify of the messageProvider"},
+	deprecationUnnamedTrigger:       {"eventTriggers without a name, which are named after their position", "a name for every eventTrigger, so that it can be disabled and audited"},
+}
+
+/* A use of a deprecated setting */
+type deprecationUsage struct {
+	ID          string `json:"id"`
+	Subject     string `json:"subject"` // where the setting is used
+	Description string `json:"description"`
+	Replacement string `json:"replacement"`
+}
+
+func (usage deprecationUsage) String() string {
+	return fmt.Sprintf("%s: %s is deprecated. Use %s", usage.Subject, usage.Description, usage.Replacement)
+}
+
+var (
+	deprecationMutex  sync.Mutex
+	deprecationUsages = make(map[string]deprecationUsage) // by ID and subject
+)
+
+/* Report a use of a deprecated setting. Each use is reported once */
+func reportDeprecated(id string, subject string) {
+	d, ok := deprecations[id]
+	if !ok {
+		klog.Errorf("Unknown deprecation %v reported for %v", id, subject)
+		return
+	}
+	key := id + "\x00" + subject
+	deprecationMutex.Lock()
+	defer deprecationMutex.Unlock()
+	if _, reported := deprecationUsages[key]; reported {
+		return
+	}
+	usage := deprecationUsage{ID: id, Subject: subject, Description: d.Description, Replacement: d.Replacement}
+	deprecationUsages[key] = usage
+	incrementMetric("deprecation." + id)
+	klog.Warningf("Deprecated: %v", usage)
+}
+
+/* Return the uses of deprecated settings, sorted by ID and subject */
+func deprecatedUsages() []deprecationUsage {
+	deprecationMutex.Lock()
+	defer deprecationMutex.Unlock()
+	usages := make([]deprecationUsage, 0, len(deprecationUsages))
+	for _, usage := range deprecationUsages {
+		usages = append(usages, usage)
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].ID == usages[j].ID {
+			return usages[i].Subject < usages[j].Subject
+		}
+		return usages[i].ID < usages[j].ID
+	})
+	return usages
+}
+
+/* Report the deprecated settings of an eventDefinitions.yaml, including the keys that are ignored */
+func checkEventDefinitionDeprecations(fileName string, data []byte, ed *EventDefinition) {
+	for _, mpd := range ed.MessageProviders {
+		if mpd.ProviderType == "rest" {
+			reportDeprecated(deprecationRESTProvider, fmt.Sprintf("%s: messageProvider '%s'", fileName, mpd.Name))
+		}
+	}
+	raw := struct {
+		EventDestinations []map[string]interface{} `yaml:"eventDestinations"`
+	}{}
+	if yaml.Unmarshal(data, &raw) != nil {
+		return
+	}
+	for _, destination := range raw.EventDestinations {
+		if _, ok := destination["skipTLSVerify"]; ok {
+			reportDeprecated(deprecationDestinationTLSVerify, fmt.Sprintf("%s: eventDestination '%v'", fileName, destination[NAME]))
+		}
+	}
+}
+
+/* Fail in strict mode if deprecated settings are in use */
+func checkStrictMode() error {
+	usages := deprecatedUsages()
+	if !strictMode || len(usages) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(usages))
+	for _, usage := range usages {
+		messages = append(messages, usage.String())
+	}
+	return fmt.Errorf("refusing to start with deprecated settings in -strict mode:\n%s", strings.Join(messages, "\n"))
+}
+
+/* Return the conditions of a status, with the DeprecatedConfiguration condition set */
+func setDeprecationCondition(conditions []interface{}, usages []deprecationUsage, now time.Time) []interface{} {
+	condition := map[string]interface{}{
+		"type":    deprecatedConfigurationCondition,
+		"status":  "False",
+		"reason":  deprecatedConfigurationNoneReason,
+		"message": "no deprecated settings are in use",
+	}
+	if len(usages) > 0 {
+		messages := make([]string, 0, len(usages))
+		for _, usage := range usages {
+			messages = append(messages, usage.String())
+		}
+		condition["status"] = "True"
+		condition["reason"] = deprecatedConfigurationReason
+		condition["message"] = strings.Join(messages, "; ")
+	}
+	return setStatusCondition(conditions, condition, now)
+}
+
+/* Return the conditions of a status, with a condition set. Its transition time is kept if its status did not change */
+func setStatusCondition(conditions []interface{}, condition map[string]interface{}, now time.Time) []interface{} {
+	updated := make([]interface{}, 0, len(conditions)+1)
+	condition["lastTransitionTime"] = now.UTC().Format(time.RFC3339)
+	for _, existing := range conditions {
+		existingMap, ok := existing.(map[string]interface{})
+		if !ok || existingMap["type"] != condition["type"] {
+			updated = append(updated, existing)
+			continue
+		}
+		if existingMap["status"] == condition["status"] && existingMap["lastTransitionTime"] != nil {
+			condition["lastTransitionTime"] = existingMap["lastTransitionTime"]
+		}
+	}
+	return append(updated, condition)
+}
+
+/* Set the DeprecatedConfiguration condition of the Kabanero CRs of a namespace */
+func updateDeprecationCondition(dynInterf dynamic.Interface, namespace string) {
+	usages := deprecatedUsages()
+	updateKabaneroCondition(dynInterf, namespace, deprecatedConfigurationCondition, func(conditions []interface{}) []interface{} {
+		return setDeprecationCondition(conditions, usages, time.Now())
+	})
+}
+
+/* Set a condition of the status of the Kabanero CRs of a namespace, as returned by set from their conditions */
+func updateKabaneroCondition(dynInterf dynamic.Interface, namespace string, conditionType string, set func([]interface{}) []interface{}) {
+	updateKabaneroStatus(dynInterf, namespace, "the "+conditionType+" condition", func(status map[string]interface{}) {
+		conditions, _, _ := unstructured.NestedSlice(status, "conditions")
+		status["conditions"] = set(conditions)
+	})
+}
+
+const kabaneroStatusRetries = 3 // updates of the status of a Kabanero CR retried after a conflict
+
+/*
+Update the status of the Kabanero CRs of a namespace, as changed by set. The status of a CR is read again and changed
+again if it was updated concurrently, such as by the other replicas of kabanero-events.
+*/
+func updateKabaneroStatus(dynInterf dynamic.Interface, namespace string, what string, set func(map[string]interface{})) {
+	gvr := schema.GroupVersionResource{
+		Group:    KABANEROIO,
+		Version:  V1ALPHA1,
+		Resource: KABANEROS,
+	}
+	intf := dynInterf.Resource(gvr).Namespace(namespace)
+	list, err := intf.List(metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("Unable to list the Kabanero CRs to set %v: %v", what, err)
+		return
+	}
+	for index := range list.Items {
+		obj := &list.Items[index]
+		for attempt := 0; ; attempt++ {
+			status, _, _ := unstructured.NestedMap(obj.Object, "status")
+			if status == nil {
+				status = make(map[string]interface{})
+			}
+			set(status)
+			if err = unstructured.SetNestedMap(obj.Object, status, "status"); err != nil {
+				klog.Warningf("Unable to set %v of Kabanero CR %v: %v", what, obj.GetName(), err)
+				break
+			}
+			_, err = intf.UpdateStatus(obj, metav1.UpdateOptions{})
+			if err == nil || !apierrors.IsConflict(err) || attempt >= kabaneroStatusRetries {
+				break
+			}
+			if obj, err = intf.Get(obj.GetName(), metav1.GetOptions{}); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			klog.Warningf("Unable to update the status of Kabanero CR %v: %v", list.Items[index].GetName(), err)
+		}
+	}
+}
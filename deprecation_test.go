@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetDeprecations() func() {
+	deprecationMutex.Lock()
+	saved := deprecationUsages
+	deprecationUsages = make(map[string]deprecationUsage)
+	deprecationMutex.Unlock()
+	return func() {
+		deprecationMutex.Lock()
+		deprecationUsages = saved
+		deprecationMutex.Unlock()
+	}
+}
+
+func TestDeprecatedEventDefinition(t *testing.T) {
+	defer resetDeprecations()()
+	dir, err := ioutil.TempDir("", "deprecation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "eventDefinitions.yaml")
+	err = ioutil.WriteFile(fileName, []byte(`messageProviders:
+- name: sink
+  providerType: rest
+  url: https://sink.example.com
+- name: nats
+  providerType: nats
+  url: nats://127.0.0.1:4222
+eventDestinations:
+- name: github
+  providerRef: sink
+  skipTLSVerify: true
+- name: events
+  providerRef: nats
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readEventDefinition(fileName); err != nil {
+		t.Fatal(err)
+	}
+	readEventDefinition(fileName)
+
+	usages := deprecatedUsages()
+	if len(usages) != 2 || usages[0].ID != deprecationDestinationTLSVerify || !strings.Contains(usages[0].Subject, "'github'") ||
+		usages[1].ID != deprecationRESTProvider || !strings.Contains(usages[1].Subject, "'sink'") {
+		t.Fatalf("unexpected deprecations %+v", usages)
+	}
+
+	savedStrict := strictMode
+	defer func() { strictMode = savedStrict }()
+	strictMode = false
+	if err = checkStrictMode(); err != nil {
+		t.Fatalf("deprecations failed outside of strict mode: %v", err)
+	}
+	strictMode = true
+	if err = checkStrictMode(); err == nil || !strings.Contains(err.Error(), "providerType http") {
+		t.Fatalf("unexpected strict mode error %v", err)
+	}
+}
+
+func TestDeprecatedUnnamedTrigger(t *testing.T) {
+	defer resetDeprecations()()
+	dir, err := ioutil.TempDir("", "deprecation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "triggers.yaml")
+	err = ioutil.WriteFile(fileName, []byte(`eventTriggers:
+- eventSource: github
+  name: build
+  body: []
+- eventSource: github
+  body: []
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := &eventTriggerDefinition{eventTriggers: make(map[string][]map[interface{}]interface{})}
+	if err = readTriggerDefinition(fileName, td); err != nil {
+		t.Fatal(err)
+	}
+	usages := deprecatedUsages()
+	if len(usages) != 1 || usages[0].ID != deprecationUnnamedTrigger || usages[0].Subject != "triggers.yaml: eventTrigger github-1" {
+		t.Fatalf("unexpected deprecations %+v", usages)
+	}
+}
+
+func TestDeprecationCondition(t *testing.T) {
+	then := time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC)
+	conditions := []interface{}{map[string]interface{}{"type": "Ready", "status": "True"}}
+	usages := []deprecationUsage{{ID: deprecationRESTProvider, Subject: "messageProvider 'sink'"}}
+
+	conditions = setDeprecationCondition(conditions, usages, then)
+	if len(conditions) != 2 {
+		t.Fatalf("unexpected conditions %v", conditions)
+	}
+	condition := conditions[1].(map[string]interface{})
+	if condition["status"] != "True" || condition["reason"] != deprecatedConfigurationReason || !strings.Contains(condition["message"].(string), "'sink'") {
+		t.Fatalf("unexpected condition %v", condition)
+	}
+
+	/* the transition time only changes with the status */
+	conditions = setDeprecationCondition(conditions, usages, then.Add(time.Hour))
+	if condition = conditions[1].(map[string]interface{}); len(conditions) != 2 || condition["lastTransitionTime"] != then.Format(time.RFC3339) {
+		t.Fatalf("unexpected conditions %v", conditions)
+	}
+	conditions = setDeprecationCondition(conditions, nil, then.Add(time.Hour))
+	if condition = conditions[1].(map[string]interface{}); condition["status"] != "False" || condition["lastTransitionTime"] == then.Format(time.RFC3339) {
+		t.Fatalf("unexpected condition %v", condition)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Configuration diagnostics. Once its listeners are started, kabanero-events logs a report of its effective
+configuration: the index URL and digest of each loaded trigger collection, the message providers and their health, the
+endpoints and how their requests are authenticated, and the deprecated or insecure settings in use. The same report is
+returned by GET /admin/diagnostics. URLs are redacted as in support bundles.
+*/
+
+/* A loaded trigger collection */
+type diagnosticsCollection struct {
+	Name         string              `json:"name"`
+	IndexURL     string              `json:"indexURL"`
+	Digest       string              `json:"digest"`
+	Triggers     int                 `json:"triggers"`
+	IndexSources []indexSourceHealth `json:"indexSources,omitempty"`
+}
+
+/* A message provider, and its health */
+type diagnosticsProvider struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	URLs   []string `json:"urls,omitempty"`
+	Health string   `json:"health"`
+}
+
+/* An endpoint, and how its requests are authenticated */
+type diagnosticsEndpoint struct {
+	Address     string `json:"address"`
+	Path        string `json:"path"`
+	Destination string `json:"destination,omitempty"`
+	Middleware  string `json:"middleware,omitempty"`
+	Auth        string `json:"auth"`
+}
+
+/* The report of the effective configuration */
+type diagnosticsReport struct {
+	Time         time.Time               `json:"time"`
+	Namespace    string                  `json:"namespace"`
+	Collections  []diagnosticsCollection `json:"collections"`
+	Providers    []diagnosticsProvider   `json:"providers"`
+	Destinations []*EventNode            `json:"destinations"`
+	Endpoints    []diagnosticsEndpoint   `json:"endpoints"`
+	Deprecated   []string                `json:"deprecated"`
+	Warnings     []string                `json:"warnings"`
+}
+
+/* The authenticating middleware, and the environment variable holding its secret */
+var authMiddlewareModes = map[string]struct{ env, mode string }{
+	"auth":             {WEBHOOKSECRET, "HMAC SHA1 signature"},
+	"gitlabAuth":       {GITLABTOKEN, "GitLab token"},
+	"bitbucketAuth":    {BITBUCKETSECRET, "HMAC SHA256 signature"},
+	"giteaAuth":        {GITEASECRET, "HMAC SHA256 signature"},
+	"azureDevOpsAuth":  {AZUREDEVOPSPASSWORD, "basic authentication"},
+	"registryAuth":     {REGISTRYTOKEN, "token"},
+	"slackAuth":        {SLACKSIGNINGSECRET, "Slack signature"},
+	"alertmanagerAuth": {ALERTMANAGERTOKEN, "bearer token"},
+	"cloudEventsAuth":  {CLOUDEVENTSTOKEN, "bearer token"},
+	"interceptorAuth":  {INTERCEPTORTOKEN, "bearer token"},
+}
+
+/* Return how the requests of an endpoint with a middleware chain are authenticated */
+func middlewareAuth(chain string) string {
+	for _, name := range strings.Split(chain, ",") {
+		mode, ok := authMiddlewareModes[strings.TrimSpace(name)]
+		if !ok {
+			continue
+		}
+		if os.Getenv(mode.env) == "" {
+			return "none (" + mode.env + " is not set)"
+		}
+		return mode.mode
+	}
+	return "none"
+}
+
+/* Return the endpoints of the webhook listener and admin API */
+func diagnosticsEndpoints() []diagnosticsEndpoint {
+	address := net.JoinHostPort(bindAddress, strconv.Itoa(listenTLSPort))
+	if disableTLS {
+		address = net.JoinHostPort(bindAddress, strconv.Itoa(listenPort))
+	}
+	endpoints := make([]diagnosticsEndpoint, 0)
+	paths, err := webhookPaths()
+	if err != nil {
+		klog.Warningf("Unable to list the webhook paths: %v", err)
+	}
+	for _, path := range paths {
+		endpoints = append(endpoints, diagnosticsEndpoint{Address: address, Path: path.Path, Destination: path.Destination, Middleware: path.MiddlewareChain(), Auth: middlewareAuth(path.MiddlewareChain())})
+	}
+	if interceptorMode {
+		endpoints = append(endpoints, diagnosticsEndpoint{Address: address, Path: interceptorPath, Middleware: interceptorMiddleware, Auth: middlewareAuth(interceptorMiddleware)})
+	}
+	peerAuth := "none (-peerCAFile is not set)"
+	if peerCAFile != "" && !disableTLS {
+		peerAuth = "client certificate"
+	}
+	endpoints = append(endpoints,
+		diagnosticsEndpoint{Address: address, Path: "/gitlab", Destination: WEBHOOKDESTINATION, Middleware: gitlabMiddleware, Auth: middlewareAuth(gitlabMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/bitbucket", Destination: WEBHOOKDESTINATION, Middleware: bitbucketMiddleware, Auth: middlewareAuth(bitbucketMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/gitea", Destination: WEBHOOKDESTINATION, Middleware: giteaMiddleware, Auth: middlewareAuth(giteaMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/azuredevops", Destination: WEBHOOKDESTINATION, Middleware: azureDevOpsMiddleware, Auth: middlewareAuth(azureDevOpsMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/registry", Destination: WEBHOOKDESTINATION, Middleware: registryMiddleware, Auth: middlewareAuth(registryMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/slack", Destination: WEBHOOKDESTINATION, Middleware: slackMiddleware, Auth: middlewareAuth(slackMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/alertmanager", Destination: WEBHOOKDESTINATION, Middleware: alertmanagerMiddleware, Auth: middlewareAuth(alertmanagerMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/cloudevents", Destination: WEBHOOKDESTINATION, Middleware: cloudEventsMiddleware, Auth: middlewareAuth(cloudEventsMiddleware)},
+		diagnosticsEndpoint{Address: address, Path: "/peer", Destination: WEBHOOKDESTINATION, Middleware: peerMiddleware, Auth: peerAuth},
+		diagnosticsEndpoint{Address: address, Path: "/healthz", Auth: "none"},
+		diagnosticsEndpoint{Address: address, Path: "/readyz", Auth: "none"},
+	)
+	if adminAddr != "" || adminSocket != "" {
+		adminAuth := "none (" + ADMINTOKEN + " is not set)"
+		if os.Getenv(ADMINTOKEN) != "" {
+			adminAuth = "bearer token"
+		}
+		for _, admin := range []string{adminAddr, adminSocket} {
+			if admin != "" {
+				endpoints = append(endpoints, diagnosticsEndpoint{Address: admin, Path: "/admin/", Middleware: adminMiddleware, Auth: adminAuth})
+			}
+		}
+	}
+	return endpoints
+}
+
+/* Return the deprecated settings in use, and the insecure ones */
+func diagnosticsSettings() ([]string, []string) {
+	deprecated := make([]string, 0)
+	for _, usage := range deprecatedUsages() {
+		deprecated = append(deprecated, usage.String())
+	}
+	warnings := make([]string, 0)
+	if ed := currentEventProviders(); ed != nil {
+		for _, mpd := range ed.MessageProviders {
+			if mpd.SkipTLSVerify {
+				warnings = append(warnings, "messageProvider '"+mpd.Name+"' does not verify TLS certificates")
+			}
+		}
+	}
+	if disableTLS {
+		warnings = append(warnings, "the listener does not use TLS (-disableTLS)")
+	}
+	if skipChkSumVerify {
+		warnings = append(warnings, "the checksum of the trigger collection is not verified (-skipChecksumVerify)")
+	}
+	return deprecated, warnings
+}
+
+/* Build the report of the effective configuration */
+func buildDiagnostics() *diagnosticsReport {
+	report := &diagnosticsReport{
+		Time:         time.Now().UTC(),
+		Namespace:    webhookNamespace,
+		Collections:  make([]diagnosticsCollection, 0),
+		Providers:    make([]diagnosticsProvider, 0),
+		Destinations: make([]*EventNode, 0),
+		Endpoints:    diagnosticsEndpoints(),
+	}
+	for _, tp := range loadedTriggerProcessors() {
+		if tp == nil || tp.triggerDef == nil {
+			continue
+		}
+		triggers := 0
+		for _, eventTriggers := range tp.triggerDef.eventTriggers {
+			triggers += len(eventTriggers)
+		}
+		collection := diagnosticsCollection{Name: tp.name, IndexURL: redactURL(tp.indexURL), Digest: tp.digest, Triggers: triggers}
+		if len(tp.indexURLs) > 1 {
+			collection.IndexSources = indexSourcesHealth(tp.indexURLs)
+		}
+		report.Collections = append(report.Collections, collection)
+	}
+	if ed := currentEventProviders(); ed != nil {
+		for _, mpd := range ed.MessageProviders {
+			provider := diagnosticsProvider{Name: mpd.Name, Type: mpd.ProviderType, Health: healthOK}
+			/* the path of notification URLs is their credential */
+			redacted := redactMessageProvider(mpd)
+			for _, value := range append([]string{redacted.URL}, redacted.URLs...) {
+				if value != "" {
+					provider.URLs = append(provider.URLs, value)
+				}
+			}
+			if mp := lookupMessageProvider(mpd.Name); mp == nil {
+				provider.Health = "not registered"
+			} else if err := providerHealth(mp); err != nil {
+				provider.Health = err.Error()
+			}
+			report.Providers = append(report.Providers, provider)
+		}
+		report.Destinations = ed.EventDestinations
+	}
+	report.Deprecated, report.Warnings = diagnosticsSettings()
+	return report
+}
+
+/* Log the report of the effective configuration */
+func logDiagnostics() {
+	report := buildDiagnostics()
+	data, err := json.Marshal(report)
+	if err != nil {
+		klog.Errorf("Unable to marshal the configuration diagnostics: %v", err)
+		return
+	}
+	klog.Infof("Configuration diagnostics: %s", data)
+	for _, warning := range report.Warnings {
+		klog.Warningf("Insecure setting: %v", warning)
+	}
+}
+
+/* GET /admin/diagnostics returns the report of the effective configuration */
+func adminDiagnosticsHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(writer, buildDiagnostics())
+}
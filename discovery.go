@@ -0,0 +1,131 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog"
+)
+
+/*
+Resolution of the resources created by triggers. Templates only specify the apiVersion and kind of a resource. The
+resource, and whether it is namespaced, are resolved through a RESTMapper backed by cached discovery. The cache is
+reset whenever a CustomResourceDefinition changes, and when a kind can not be resolved, so that kinds of newly
+installed CRDs are found.
+*/
+
+/* minimum time between resets of the discovery cache caused by kinds that can not be resolved */
+const discoveryMissResetInterval = 30 * time.Second
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1beta1", Resource: "customresourcedefinitions"}
+
+/* A RESTMapper backed by discovery cached in memory */
+type cachedMapper struct {
+	mapper        *restmapper.DeferredDiscoveryRESTMapper
+	mutex         sync.Mutex
+	lastMissReset time.Time
+}
+
+var restMapper *cachedMapper // mapper of the local cluster. nil until initialized, in which case kinds are resolved by kindToPlural
+
+/* A resolved kind */
+type resourceMapping struct {
+	gvr        schema.GroupVersionResource
+	namespaced bool
+}
+
+func newCachedMapper(discClient discovery.DiscoveryInterface) *cachedMapper {
+	return &cachedMapper{mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discClient))}
+}
+
+/* Create the RESTMapper of the local cluster */
+func initializeRESTMapper(discClient discovery.DiscoveryInterface) {
+	restMapper = newCachedMapper(discClient)
+}
+
+/* Reset the discovery cache */
+func (cm *cachedMapper) reset() {
+	cm.mapper.Reset()
+	incrementMetric("discovery.resets")
+}
+
+/* Reset the discovery cache after a kind could not be resolved, unless it was recently reset */
+func (cm *cachedMapper) resetAfterMiss(now time.Time) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	if now.Sub(cm.lastMissReset) < discoveryMissResetInterval {
+		return false
+	}
+	cm.lastMissReset = now
+	cm.reset()
+	return true
+}
+
+/* Resolve the resource of a kind. A nil mapper guesses the resource from the kind. */
+func (cm *cachedMapper) resolve(gvk schema.GroupVersionKind) (*resourceMapping, error) {
+	if cm == nil {
+		return &resourceMapping{gvr: gvk.GroupVersion().WithResource(kindToPlural(gvk.Kind)), namespaced: true}, nil
+	}
+	mapping, err := cm.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil && meta.IsNoMatchError(err) && cm.resetAfterMiss(time.Now()) {
+		mapping, err = cm.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resourceMapping{gvr: mapping.Resource, namespaced: mapping.Scope.Name() == meta.RESTScopeNameNamespace}, nil
+}
+
+/* Resolve the resource of a kind in the local cluster */
+func resolveResource(gvk schema.GroupVersionKind) (*resourceMapping, error) {
+	return restMapper.resolve(gvk)
+}
+
+/* Reset the discovery cache of a cluster whenever a CustomResourceDefinition is added, changed, or deleted */
+func watchCRDs(client dynamic.Interface, cm *cachedMapper) {
+	for {
+		list, err := client.Resource(crdGVR).List(metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("Unable to list CustomResourceDefinitions: %v", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		watcher, err := client.Resource(crdGVR).Watch(metav1.ListOptions{ResourceVersion: list.GetResourceVersion()})
+		if err != nil {
+			klog.Errorf("Unable to watch CustomResourceDefinitions: %v", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		/* the discovery information may have changed while not watching */
+		cm.reset()
+		for event := range watcher.ResultChan() {
+			if klog.V(4) {
+				klog.Infof("CustomResourceDefinition %v. Resetting the discovery cache", event.Type)
+			}
+			cm.reset()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+/* A fake API server serving discovery. The tekton.dev group is served once installed is set. */
+type fakeDiscoveryServer struct {
+	mutex     sync.Mutex
+	installed bool
+}
+
+func (server *fakeDiscoveryServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch req.URL.Path {
+	case "/api":
+		w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+	case "/api/v1":
+		w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[
+			{"name":"configmaps","singularName":"","namespaced":true,"kind":"ConfigMap","verbs":["create"]},
+			{"name":"namespaces","singularName":"","namespaced":false,"kind":"Namespace","verbs":["create"]}]}`))
+	case "/apis":
+		if server.installed {
+			w.Write([]byte(`{"kind":"APIGroupList","groups":[{"name":"tekton.dev","versions":[{"groupVersion":"tekton.dev/v1alpha1","version":"v1alpha1"}],
+				"preferredVersion":{"groupVersion":"tekton.dev/v1alpha1","version":"v1alpha1"}}]}`))
+		} else {
+			w.Write([]byte(`{"kind":"APIGroupList","groups":[]}`))
+		}
+	case "/apis/tekton.dev/v1alpha1":
+		w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"tekton.dev/v1alpha1","resources":[
+			{"name":"pipelineruns","singularName":"pipelinerun","namespaced":true,"kind":"PipelineRun","verbs":["create"]}]}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestResolveResource(t *testing.T) {
+	fake := &fakeDiscoveryServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	/* without discovery, the resource is guessed from the kind */
+	restMapper = nil
+	mapping, err := resolveResource(schema.GroupVersionKind{Group: "tekton.dev", Version: "v1alpha1", Kind: "PipelineRun"})
+	if err != nil || mapping.gvr.Resource != "pipelineruns" || !mapping.namespaced {
+		t.Fatalf("unexpected mapping without discovery: %v, %v", mapping, err)
+	}
+
+	initializeRESTMapper(discovery.NewDiscoveryClientForConfigOrDie(&rest.Config{Host: server.URL}))
+	defer func() { restMapper = nil }()
+
+	mapping, err = resolveResource(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.gvr.Resource != "namespaces" || mapping.namespaced {
+		t.Fatalf("unexpected mapping of Namespace: %v", mapping)
+	}
+	mapping, err = resolveResource(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"})
+	if err != nil || mapping.gvr.Resource != "configmaps" || !mapping.namespaced {
+		t.Fatalf("unexpected mapping of ConfigMap: %v, %v", mapping, err)
+	}
+
+	/* kinds of CRDs installed after the cache was filled are found by resetting the cache */
+	fake.mutex.Lock()
+	fake.installed = true
+	fake.mutex.Unlock()
+	restMapper.lastMissReset = time.Time{}
+	mapping, err = resolveResource(schema.GroupVersionKind{Group: "tekton.dev", Version: "v1alpha1", Kind: "PipelineRun"})
+	if err != nil || mapping.gvr.Resource != "pipelineruns" {
+		t.Fatalf("unexpected mapping of PipelineRun: %v, %v", mapping, err)
+	}
+
+	/* unknown kinds do not reset the cache again until some time has passed */
+	if _, err = resolveResource(schema.GroupVersionKind{Group: "tekton.dev", Version: "v1alpha1", Kind: "Unknown"}); err == nil {
+		t.Fatal("expected error resolving an unknown kind")
+	}
+	if restMapper.resetAfterMiss(time.Now()) {
+		t.Fatal("expected the cache not to be reset right after a reset")
+	}
+}
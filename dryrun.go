@@ -0,0 +1,95 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+/*
+Dry-run of triggers. With -dryRun, no trigger executes its actions. Otherwise the dryrun setting of a collection applies
+to its triggers, unless a trigger sets its own dryrun attribute. In dry-run, the resources of applyResources are
+rendered, and pass the same filters and policies as when created, but are logged and recorded in the audit record of
+the event rather than created. With -serverDryRun, they are also submitted to their cluster with a server-side
+dry-run, so that admission, validation and quota are checked without persisting the resources. Evaluations that are
+always in dry-run, such as those of the shadow collection or of the Tekton interceptor, are not submitted.
+*/
+
+const DRYRUN = "dryrun" // attribute of a trigger overriding the dryrun setting of its collection
+
+var (
+	dryRun       bool // no trigger executes its actions
+	serverDryRun bool // the resources rendered in dry-run are submitted with a server-side dry-run
+)
+
+/* A resource rendered by a trigger in dry-run */
+type dryRunResource struct {
+	Trigger      string                 `json:"trigger"`
+	Cluster      string                 `json:"cluster,omitempty"`
+	Kind         string                 `json:"kind"`
+	Name         string                 `json:"name"`
+	Namespace    string                 `json:"namespace,omitempty"`
+	Resource     map[string]interface{} `json:"resource"`
+	ServerDryRun bool                   `json:"serverDryRun,omitempty"` // submitted with a server-side dry-run
+	Error        string                 `json:"error,omitempty"`        // error of the server-side dry-run
+}
+
+/* Return the dryrun attribute of a trigger, nil if not set */
+func triggerDryRun(trigger map[interface{}]interface{}) *bool {
+	if b, ok := trigger[DRYRUN].(bool); ok {
+		return &b
+	}
+	return nil
+}
+
+/* Record a resource rendered in dry-run, and submit it with a server-side dry-run if requested */
+func (action *resourceAction) renderDryRun(resource *unstructured.Unstructured, target *cluster) error {
+	rendered := &dryRunResource{Trigger: action.trigger, Cluster: action.cluster, Kind: resource.GetKind(), Name: resource.GetName(),
+		Namespace: resource.GetNamespace(), Resource: resource.DeepCopy().Object}
+	action.rendered = append(action.rendered, rendered)
+	incrementMetric("dryRun.resources")
+	fields := logFields{"trigger": action.trigger, "collection": action.collection, "kind": rendered.Kind, "name": rendered.Name, "namespace": rendered.Namespace, "cluster": action.cluster}
+	if klog.V(3) {
+		if yamlBytes, err := yaml.Marshal(resource.Object); err == nil {
+			fields["resource"] = string(yamlBytes)
+		}
+	}
+	eventInfo(action.eventID, "Rendered resource in dry-run", fields)
+	if !action.serverDryRun {
+		return nil
+	}
+
+	rendered.ServerDryRun = true
+	var err error
+	if target.dynamicClient == nil {
+		err = fmt.Errorf("no client of the cluster to submit a server-side dry-run")
+	} else if err = checkContext(action.ctx); err == nil {
+		err = createResourceWithOptions(resource, target, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	}
+	if err != nil {
+		rendered.Error = err.Error()
+		incrementMetric("dryRun.server.rejected")
+		return fmt.Errorf("server-side dry-run of %v %v rejected: %v", rendered.Kind, rendered.Name, err)
+	}
+	incrementMetric("dryRun.server.accepted")
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+/* An API server recording the creations of resources */
+type fakeCreateServer struct {
+	mutex   sync.Mutex
+	creates []string // dryRun parameter of each creation
+	reject  bool     // reject server-side dry-runs
+}
+
+func (server *fakeCreateServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method != http.MethodPost || req.URL.Path != "/api/v1/namespaces/default/configmaps" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	dryRunParam := req.URL.Query().Get("dryRun")
+	server.creates = append(server.creates, dryRunParam)
+	if server.reject && dryRunParam != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"admission webhook denied the request","reason":"Invalid","code":422}`))
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+func (server *fakeCreateServer) takeCreates() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	creates := server.creates
+	server.creates = nil
+	return creates
+}
+
+func TestDryRun(t *testing.T) {
+	fake := &fakeCreateServer{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	savedClient, savedDryRun, savedServerDryRun := dynamicClient, dryRun, serverDryRun
+	defer func() { dynamicClient, dryRun, serverDryRun = savedClient, savedDryRun, savedServerDryRun }()
+	dynamicClient = dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	tp := newTriggerProcessor()
+	if err := tp.initialize("test_data/trigger16"); err != nil {
+		t.Fatal(err)
+	}
+	evaluate := func(opts evalOptions) *evalResult {
+		result, err := tp.evaluateMessage(map[string]interface{}{"name": "config"}, "default", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	/* the trigger in dry-run renders its resources, the other creates them */
+	result := evaluate(evalOptions{})
+	if creates := fake.takeCreates(); len(creates) != 1 || creates[0] != "" {
+		t.Fatalf("unexpected creations %v", creates)
+	}
+	if len(result.rendered) != 1 || result.rendered[0].Trigger != "render" || result.rendered[0].Kind != "ConfigMap" || result.rendered[0].Name != "config" {
+		t.Fatalf("unexpected rendered resources %v", result.rendered)
+	}
+	if len(result.actions) != 2 {
+		t.Fatalf("unexpected actions %v", result.actions)
+	}
+
+	/* the rendered resources are submitted with a server-side dry-run */
+	serverDryRun = true
+	evaluate(evalOptions{})
+	if creates := fake.takeCreates(); len(creates) != 2 || creates[0] != "All" || creates[1] != "" {
+		t.Fatalf("unexpected creations %v", creates)
+	}
+
+	/* -dryRun applies to all triggers, whatever their dryrun attribute */
+	dryRun = true
+	result = evaluate(evalOptions{})
+	if creates := fake.takeCreates(); len(creates) != 2 || creates[0] != "All" || creates[1] != "All" || len(result.rendered) != 2 {
+		t.Fatalf("unexpected creations %v, rendered %v", creates, result.rendered)
+	}
+
+	/* evaluations always in dry-run are not submitted */
+	result = evaluate(evalOptions{dryrun: true})
+	if creates := fake.takeCreates(); len(creates) != 0 || len(result.rendered) != 2 {
+		t.Fatalf("unexpected creations %v, rendered %v", creates, result.rendered)
+	}
+
+	/* a rejected server-side dry-run fails the applyResources */
+	fake.reject = true
+	result = evaluate(evalOptions{})
+	if result.rendered[0].Error == "" || !result.rendered[0].ServerDryRun {
+		t.Fatalf("the rejection was not recorded: %+v", result.rendered[0])
+	}
+	if message, _ := result.variables[0]["result"].(string); !strings.Contains(message, "admission webhook denied") {
+		t.Fatalf("unexpected result %v", result.variables[0]["result"])
+	}
+}
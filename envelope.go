@@ -0,0 +1,166 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Signed message envelopes. When a signing key is configured, messages sent through the message brokers are wrapped in an
+envelope with the HMAC SHA256 of the message, and messages received without a valid signature are dropped. A client of
+the broker that does not have the key can then not inject events that would create resources. Messages sent to REST
+providers are not wrapped, as they are meant for services outside of kabanero-events.
+*/
+
+/* environment variables for envelope signing */
+const (
+	ENVELOPESIGNINGKEY = "ENVELOPE_SIGNING_KEY" // environment variable containing the key used to sign envelopes
+)
+
+var envelopeKeyFile string // file containing the key used to sign envelopes, such as a mounted Secret. Overrides ENVELOPE_SIGNING_KEY
+
+/* A signed message */
+type signedEnvelope struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+/* Read the envelope signing key from the key file or the environment. An empty key disables signing. */
+func envelopeSigningKey() ([]byte, error) {
+	if envelopeKeyFile != "" {
+		key, err := ioutil.ReadFile(envelopeKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read envelope key file %v: %v", envelopeKeyFile, err)
+		}
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("envelope key file %v is empty", envelopeKeyFile)
+		}
+		return key, nil
+	}
+	return []byte(strings.TrimSpace(os.Getenv(ENVELOPESIGNINGKEY))), nil
+}
+
+/* Wrap the message providers of the brokers so that they sign and verify envelopes, if a key is configured */
+func initializeEnvelopeSigning(ed *EventDefinition, providers map[string]MessageProvider) error {
+	key, err := envelopeSigningKey()
+	if err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	for _, mpd := range ed.MessageProviders {
+		provider := providers[mpd.Name]
+		/* peers are authenticated with mTLS, and receive messages as webhook messages. The backends of failover providers sign their own messages */
+		if provider == nil || mpd.ProviderType == "rest" || mpd.ProviderType == "http" || mpd.ProviderType == "notification" || mpd.ProviderType == "peer" || mpd.ProviderType == "failover" {
+			continue
+		}
+		if klog.V(5) {
+			klog.Infof("Signing envelopes of messageProvider '%s'", mpd.Name)
+		}
+		providers[mpd.Name] = &signingProvider{MessageProvider: provider, key: key}
+	}
+	return nil
+}
+
+/* Compute the signature of a payload */
+func envelopeSignature(key []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/* Wrap a JSON message in a signed envelope */
+func sealEnvelope(key []byte, message []byte) ([]byte, error) {
+	/* the payload is compacted, as it is when marshaled as part of the envelope, so the signature is of the bytes sent */
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, message); err != nil {
+		return nil, fmt.Errorf("unable to sign message that is not JSON: %v", err)
+	}
+	return json.Marshal(signedEnvelope{Payload: payload.Bytes(), Signature: envelopeSignature(key, payload.Bytes())})
+}
+
+/* Verify a signed envelope and return the message inside */
+func openEnvelope(key []byte, data []byte) ([]byte, error) {
+	var envelope signedEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("message is not a signed envelope: %v", err)
+	}
+	if envelope.Signature == "" || len(envelope.Payload) == 0 {
+		return nil, fmt.Errorf("message is not a signed envelope")
+	}
+	if !hmac.Equal([]byte(envelope.Signature), []byte(envelopeSignature(key, envelope.Payload))) {
+		return nil, fmt.Errorf("invalid envelope signature")
+	}
+	return envelope.Payload, nil
+}
+
+/* A message provider that signs the messages it sends, and verifies the messages it receives */
+type signingProvider struct {
+	MessageProvider
+	key []byte
+}
+
+/* Close the wrapped provider */
+func (sp *signingProvider) Close() error {
+	return closeMessageProvider(sp.MessageProvider)
+}
+
+func (sp *signingProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	sealed, err := sealEnvelope(sp.key, payload)
+	if err != nil {
+		return err
+	}
+	return sp.MessageProvider.Send(node, sealed, header)
+}
+
+func (sp *signingProvider) Receive(node *EventNode) ([]byte, error) {
+	data, err := sp.MessageProvider.Receive(node)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := openEnvelope(sp.key, data)
+	if err != nil {
+		incrementMetric("envelope.rejected")
+		return nil, fmt.Errorf("message received from eventDestination '%s' rejected: %v", node.Name, err)
+	}
+	return payload, nil
+}
+
+func (sp *signingProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	sp.MessageProvider.ListenAndServe(node, func(data []byte) {
+		payload, err := openEnvelope(sp.key, data)
+		if err != nil {
+			incrementMetric("envelope.rejected")
+			klog.Errorf("Dropping message received from eventDestination '%s': %v", node.Name, err)
+			return
+		}
+		receiver(payload)
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	key := []byte("key")
+	sealed, err := sealEnvelope(key, []byte(`{ "header": {}, "body": {"ref": "refs/heads/master"} }`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := openEnvelope(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `{"header":{},"body":{"ref":"refs/heads/master"}}` {
+		t.Fatalf("unexpected payload: %v", string(payload))
+	}
+
+	if _, err = openEnvelope([]byte("other key"), sealed); err == nil {
+		t.Fatal("expected error for envelope signed with another key")
+	}
+	if _, err = openEnvelope(key, []byte(`{"header": {}, "body": {}}`)); err == nil {
+		t.Fatal("expected error for unsigned message")
+	}
+	tampered := []byte(`{"payload":{"header":{},"body":{"ref":"refs/heads/evil"}},"signature":"` + envelopeSignature(key, payload) + `"}`)
+	if _, err = openEnvelope(key, tampered); err == nil {
+		t.Fatal("expected error for tampered payload")
+	}
+}
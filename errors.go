@@ -0,0 +1,189 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Error responses. The listener and the admin API return errors as JSON objects with a stable code, a message, the
+correlation ID of the request, which is the event ID that is logged, and a reference to the documentation of the
+code, so that API consumers and UIs can render actionable errors:
+
+	{"code":"invalid_signature","message":"invalid signature","correlationId":"...","docsRef":"..."}
+
+The messages are in English, unless the -errorMessagesFile maps the code to a message in a language of the
+Accept-Language header of the request. The English message is then kept as the detail of the error.
+*/
+
+/* The code of an error, and the status of the response */
+type errorCode struct {
+	name   string
+	status int
+}
+
+var (
+	codeBadRequest           = errorCode{"bad_request", http.StatusBadRequest}
+	codeInvalidJSON          = errorCode{"invalid_json", http.StatusBadRequest}
+	codeInvalidCloudEvent    = errorCode{"invalid_cloudevent", http.StatusBadRequest}
+	codeInvalidParameter     = errorCode{"invalid_parameter", http.StatusBadRequest}
+	codeUnauthorized         = errorCode{"unauthorized", http.StatusUnauthorized}
+	codeInvalidSignature     = errorCode{"invalid_signature", http.StatusUnauthorized}
+	codeInvalidToken         = errorCode{"invalid_token", http.StatusUnauthorized}
+	codeVetoed               = errorCode{"vetoed", http.StatusForbidden}
+	codeNotFound             = errorCode{"not_found", http.StatusNotFound}
+	codeMethodNotAllowed     = errorCode{"method_not_allowed", http.StatusMethodNotAllowed}
+	codeRequestTimeout       = errorCode{"request_timeout", http.StatusRequestTimeout}
+	codePayloadTooLarge      = errorCode{"payload_too_large", http.StatusRequestEntityTooLarge}
+	codeUnsupportedMediaType = errorCode{"unsupported_media_type", http.StatusUnsupportedMediaType}
+	codeTooManyRequests      = errorCode{"too_many_requests", http.StatusTooManyRequests}
+	codeInternalError        = errorCode{"internal_error", http.StatusInternalServerError}
+	codeBadGateway           = errorCode{"bad_gateway", http.StatusBadGateway}
+	codeUnavailable          = errorCode{"unavailable", http.StatusServiceUnavailable}
+)
+
+var (
+	errorDocsURL      string // URL of the documentation of the error codes, the code is its fragment
+	errorMessagesFile string // YAML file of the messages of the error codes, by language
+
+	errorMessages = make(map[string]map[string]string) // by language and code
+)
+
+/* The body of an error response */
+type errorResponse struct {
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	Detail        string `json:"detail,omitempty"`
+	CorrelationID string `json:"correlationId"`
+	DocsRef       string `json:"docsRef,omitempty"`
+}
+
+/* Load the -errorMessagesFile */
+func loadErrorMessages() error {
+	if errorMessagesFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(errorMessagesFile)
+	if err != nil {
+		return err
+	}
+	messages := make(map[string]map[string]string)
+	if err = yaml.Unmarshal(data, &messages); err != nil {
+		return fmt.Errorf("unable to read the error messages of %s: %v", errorMessagesFile, err)
+	}
+	errorMessages = make(map[string]map[string]string)
+	for language, codes := range messages {
+		errorMessages[strings.ToLower(language)] = codes
+	}
+	return nil
+}
+
+/* Return the languages of an Accept-Language header, by decreasing preference */
+func acceptedLanguages(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	languages := make([]language, 0)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].quality > languages[j].quality })
+	tags := make([]string, 0, len(languages))
+	for _, l := range languages {
+		tags = append(tags, l.tag)
+	}
+	return tags
+}
+
+/* Return the message of a code in the preferred language of a request that has one, and the language */
+func localizedMessage(req *http.Request, code string) (string, string) {
+	if len(errorMessages) == 0 {
+		return "", ""
+	}
+	for _, tag := range acceptedLanguages(req.Header.Get("Accept-Language")) {
+		/* fr-CA falls back to fr */
+		for _, candidate := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			if message, ok := errorMessages[candidate][code]; ok && message != "" {
+				return message, candidate
+			}
+		}
+	}
+	return "", ""
+}
+
+/* Write an error response */
+func writeError(writer http.ResponseWriter, req *http.Request, code errorCode, message string) {
+	response := errorResponse{Code: code.name, Message: message, CorrelationID: correlationID(writer, req)}
+	if errorDocsURL != "" {
+		response.DocsRef = errorDocsURL + "#" + code.name
+	}
+	if localized, language := localizedMessage(req, code.name); localized != "" {
+		response.Message = localized
+		if localized != message {
+			response.Detail = message
+		}
+		writer.Header().Set("Content-Language", language)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(code.status)
+	writeJSON(writer, response)
+}
+
+/*
+Return the correlation ID of a request: its event ID, the ID of its trace, or a new ID returned in the request ID
+header of the response.
+*/
+func correlationID(writer http.ResponseWriter, req *http.Request) string {
+	if id := req.Header.Get("X-Github-Delivery"); validRequestID(id) {
+		return id
+	}
+	if id := req.Header.Get(REQUESTIDHEADER); validRequestID(id) {
+		return id
+	}
+	if sc := parseTraceparent(req.Header.Get(TRACEPARENT)); sc.valid() {
+		return sc.traceparent()[3:35]
+	}
+	id := newRequestID()
+	writer.Header().Set(REQUESTIDHEADER, id)
+	return id
+}
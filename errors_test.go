@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	saved := errorDocsURL
+	defer func() { errorDocsURL = saved }()
+	errorDocsURL = "https://example.com/errors"
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set("X-Github-Delivery", "delivery-1")
+	recorder := httptest.NewRecorder()
+	writeError(recorder, req, codeInvalidSignature, "invalid signature")
+	if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %v %v", recorder.Code, recorder.Header())
+	}
+	response := errorResponse{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != "invalid_signature" || response.Message != "invalid signature" || response.CorrelationID != "delivery-1" ||
+		response.DocsRef != "https://example.com/errors#invalid_signature" || response.Detail != "" {
+		t.Fatalf("unexpected error %+v", response)
+	}
+
+	/* a new ID is returned in the header, so that it can be found in the logs */
+	req = httptest.NewRequest(http.MethodGet, "/admin/triggers", nil)
+	recorder = httptest.NewRecorder()
+	writeError(recorder, req, codeNotFound, "not found")
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.CorrelationID == "" || recorder.Header().Get(REQUESTIDHEADER) != response.CorrelationID {
+		t.Fatalf("unexpected correlation ID %v, header %v", response.CorrelationID, recorder.Header().Get(REQUESTIDHEADER))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/triggers", nil)
+	req.Header.Set(TRACEPARENT, testTraceparent)
+	recorder = httptest.NewRecorder()
+	writeError(recorder, req, codeNotFound, "not found")
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.CorrelationID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected correlation ID %v", response.CorrelationID)
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedFile, savedMessages := errorMessagesFile, errorMessages
+	defer func() { errorMessagesFile, errorMessages = savedFile, savedMessages }()
+	errorMessagesFile = filepath.Join(dir, "messages.yaml")
+	ioutil.WriteFile(errorMessagesFile, []byte("FR:\n  method_not_allowed: méthode non autorisée\nde:\n  not_found: nicht gefunden\n"), 0600)
+	if err = loadErrorMessages(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/triggers", nil)
+	req.Header.Set("Accept-Language", "en-US;q=0.5, fr-CA, de;q=0.8")
+	recorder := httptest.NewRecorder()
+	writeError(recorder, req, codeMethodNotAllowed, "method not allowed")
+	response := errorResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.Message != "méthode non autorisée" || response.Detail != "method not allowed" || recorder.Header().Get("Content-Language") != "fr" {
+		t.Fatalf("unexpected error %+v", response)
+	}
+
+	/* codes without a message in the accepted languages are in English */
+	recorder = httptest.NewRecorder()
+	writeError(recorder, req, codeInternalError, "internal server error")
+	response = errorResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.Message != "internal server error" || response.Detail != "" || recorder.Header().Get("Content-Language") != "" {
+		t.Fatalf("unexpected error %+v", response)
+	}
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	if languages := acceptedLanguages("da, en-GB;q=0.8, en;q=0.7, *;q=0.5, fr;q=0"); strings.Join(languages, ",") != "da,en-gb,en" {
+		t.Fatalf("unexpected languages %v", languages)
+	}
+	if languages := acceptedLanguages(""); len(languages) != 0 {
+		t.Fatalf("unexpected languages %v", languages)
+	}
+}
@@ -0,0 +1,526 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Controller of the deployment of kabanero-events. The controller subcommand reconciles the Deployment, Service,
+ConfigMap of eventDefinitions.yaml, and optionally the Route and cert-manager Certificate of each EventMediator CR of
+a namespace, so that installing and reconfiguring kabanero-events is declarative. The resources are owned by the CR,
+so that they are deleted with it, and are updated when they differ from those the spec of the CR describes, as
+recorded by a hash of their desired state. The outcome is reported by the Reconciled condition of the status of the
+CR, with the number of ready replicas.
+*/
+
+const (
+	EVENTMEDIATORS   = "eventmediators"
+	EVENTMEDIATOR    = "EventMediator"
+	DEPLOYMENTS      = "deployments"
+	SERVICES         = "services"
+	ROUTES           = "routes"
+	CERTIFICATES     = "certificates"
+	eventMediatorApp = "kabanero-events"
+
+	mediatorHashAnnotation     = "kabanero.io/spec-hash"
+	mediatorServingCertAnnot   = "service.beta.openshift.io/serving-cert-secret-name"
+	mediatorReconciledType     = "Reconciled"
+	mediatorProvidersFile      = "eventDefinitions.yaml"
+	mediatorProvidersMountPath = "/etc/kabanero-events"
+	mediatorTLSMountPath       = "/etc/tls"
+
+	tlsModeServiceCA   = "service-ca"   // certificate of the OpenShift service CA
+	tlsModeCertManager = "cert-manager" // certificate issued by cert-manager
+	tlsModeSecret      = "secret"       // certificate of an existing Secret
+	tlsModeNone        = "none"         // no TLS, with -disableTLS
+)
+
+var (
+	deploymentsGVR  = schema.GroupVersionResource{Group: "apps", Version: V1, Resource: DEPLOYMENTS}
+	servicesGVR     = schema.GroupVersionResource{Group: "", Version: V1, Resource: SERVICES}
+	configMapsGVR   = schema.GroupVersionResource{Group: "", Version: V1, Resource: CONFIGMAPS}
+	routesGVR       = schema.GroupVersionResource{Group: "route.openshift.io", Version: V1, Resource: ROUTES}
+	certificatesGVR = schema.GroupVersionResource{Group: "cert-manager.io", Version: V1, Resource: CERTIFICATES}
+	mediatorsGVR    = schema.GroupVersionResource{Group: KABANEROIO, Version: V1ALPHA1, Resource: EVENTMEDIATORS}
+)
+
+/* The spec of an EventMediator CR */
+type eventMediatorSpec struct {
+	Replicas           *int64                   `json:"replicas,omitempty"`
+	Image              string                   `json:"image,omitempty"`
+	ServiceAccountName string                   `json:"serviceAccountName,omitempty"`
+	TLS                eventMediatorTLS         `json:"tls,omitempty"`
+	Route              eventMediatorRoute       `json:"route,omitempty"`
+	Providers          map[string]interface{}   `json:"providers,omitempty"` // the content of eventDefinitions.yaml
+	Args               []string                 `json:"args,omitempty"`
+	Env                []map[string]interface{} `json:"env,omitempty"`
+}
+
+type eventMediatorTLS struct {
+	Mode       string                 `json:"mode,omitempty"`
+	SecretName string                 `json:"secretName,omitempty"`
+	IssuerRef  map[string]interface{} `json:"issuerRef,omitempty"`
+}
+
+type eventMediatorRoute struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Host    string `json:"host,omitempty"`
+}
+
+/* A resource reconciled for an EventMediator */
+type mediatorResource struct {
+	gvr    schema.GroupVersionResource
+	name   string
+	object *unstructured.Unstructured // nil if the resource must not exist
+}
+
+/* Decode the spec of an EventMediator, with its defaults */
+func decodeEventMediatorSpec(cr *unstructured.Unstructured, defaultImage string) (*eventMediatorSpec, error) {
+	spec := &eventMediatorSpec{}
+	if specObj, ok := cr.Object[SPEC]; ok {
+		data, err := json.Marshal(specObj)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, spec); err != nil {
+			return nil, fmt.Errorf("invalid spec: %v", err)
+		}
+	}
+	if spec.Replicas == nil {
+		one := int64(1)
+		spec.Replicas = &one
+	}
+	if *spec.Replicas < 0 {
+		return nil, fmt.Errorf("replicas %d is negative", *spec.Replicas)
+	}
+	if spec.Image == "" {
+		spec.Image = defaultImage
+	}
+	if spec.Image == "" {
+		return nil, fmt.Errorf("no image, and -image is not set")
+	}
+	switch spec.TLS.Mode {
+	case "":
+		spec.TLS.Mode = tlsModeServiceCA
+	case tlsModeServiceCA, tlsModeNone:
+	case tlsModeCertManager:
+		if name, _ := spec.TLS.IssuerRef["name"].(string); name == "" {
+			return nil, fmt.Errorf("tls mode %s requires tls.issuerRef.name", tlsModeCertManager)
+		}
+	case tlsModeSecret:
+		if spec.TLS.SecretName == "" {
+			return nil, fmt.Errorf("tls mode %s requires tls.secretName", tlsModeSecret)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tls mode %q, expected %s, %s, %s, or %s", spec.TLS.Mode, tlsModeServiceCA, tlsModeCertManager, tlsModeSecret, tlsModeNone)
+	}
+	if spec.TLS.SecretName == "" {
+		spec.TLS.SecretName = cr.GetName() + "-tls"
+	}
+	return spec, nil
+}
+
+/* Return the labels of the resources of an EventMediator, also selecting its pods */
+func mediatorLabels(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"app.kubernetes.io/name":       eventMediatorApp,
+		"app.kubernetes.io/instance":   name,
+		"app.kubernetes.io/managed-by": eventMediatorApp + "-controller",
+	}
+}
+
+/* Return a new resource of an EventMediator */
+func newMediatorObject(cr *unstructured.Unstructured, apiVersion string, kind string, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": cr.GetNamespace(),
+			"labels":    mediatorLabels(cr.GetName()),
+			"ownerReferences": []interface{}{map[string]interface{}{
+				"apiVersion":         cr.GetAPIVersion(),
+				"kind":               cr.GetKind(),
+				"name":               cr.GetName(),
+				"uid":                string(cr.GetUID()),
+				"controller":         true,
+				"blockOwnerDeletion": true,
+			}},
+		},
+	}}
+	for key, value := range spec {
+		obj.Object[key] = value
+	}
+	return obj
+}
+
+/* Return the resources of an EventMediator: those that must exist, and those that must not */
+func eventMediatorResources(cr *unstructured.Unstructured, spec *eventMediatorSpec) ([]*mediatorResource, error) {
+	name := cr.GetName()
+	tls := spec.TLS.Mode != tlsModeNone
+	port, scheme := int64(9443), "HTTPS"
+	args := make([]string, 0)
+	if !tls {
+		port, scheme = 9080, "HTTP"
+		args = append(args, "-disableTLS")
+	}
+
+	resources := make([]*mediatorResource, 0)
+	volumes := make([]interface{}, 0)
+	mounts := make([]interface{}, 0)
+	podAnnotations := make(map[string]interface{})
+	configMapName := name + "-providers"
+	configMap := &mediatorResource{gvr: configMapsGVR, name: configMapName}
+	if len(spec.Providers) > 0 {
+		providers, err := yaml.Marshal(spec.Providers)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode the providers: %v", err)
+		}
+		configMap.object = newMediatorObject(cr, V1, "ConfigMap", configMapName, map[string]interface{}{
+			DATA: map[string]interface{}{mediatorProvidersFile: string(providers)},
+		})
+		args = append(args, "-providercfg="+mediatorProvidersMountPath+"/"+mediatorProvidersFile)
+		volumes = append(volumes, map[string]interface{}{"name": "providers", "configMap": map[string]interface{}{"name": configMapName}})
+		mounts = append(mounts, map[string]interface{}{"name": "providers", "mountPath": mediatorProvidersMountPath, "readOnly": true})
+		/* the pods are restarted when the providers change, since they are read at startup */
+		digest := sha256.Sum256(providers)
+		podAnnotations[mediatorHashAnnotation] = hex.EncodeToString(digest[:8])
+	}
+	resources = append(resources, configMap)
+	if tls {
+		volumes = append(volumes, map[string]interface{}{"name": "tls", "secret": map[string]interface{}{"secretName": spec.TLS.SecretName}})
+		mounts = append(mounts, map[string]interface{}{"name": "tls", "mountPath": mediatorTLSMountPath, "readOnly": true})
+	}
+	for _, arg := range spec.Args {
+		args = append(args, arg)
+	}
+
+	env := []interface{}{map[string]interface{}{
+		"name":      KUBENAMESPACE,
+		"valueFrom": map[string]interface{}{"fieldRef": map[string]interface{}{"fieldPath": "metadata.namespace"}},
+	}, map[string]interface{}{
+		"name":      "POD_NAME",
+		"valueFrom": map[string]interface{}{"fieldRef": map[string]interface{}{"fieldPath": "metadata.name"}},
+	}}
+	for _, variable := range spec.Env {
+		env = append(env, variable)
+	}
+	probe := func(path string) map[string]interface{} {
+		return map[string]interface{}{"httpGet": map[string]interface{}{"path": path, "port": port, "scheme": scheme}}
+	}
+	container := map[string]interface{}{
+		"name":           eventMediatorApp,
+		"image":          spec.Image,
+		"args":           toInterfaces(args),
+		"env":            env,
+		"ports":          []interface{}{map[string]interface{}{"name": "listener", "containerPort": port}},
+		"volumeMounts":   mounts,
+		"readinessProbe": probe("/readyz"),
+		"livenessProbe":  probe("/healthz"),
+	}
+	podSpec := map[string]interface{}{"containers": []interface{}{container}, "volumes": volumes}
+	if spec.ServiceAccountName != "" {
+		podSpec["serviceAccountName"] = spec.ServiceAccountName
+	}
+	resources = append(resources, &mediatorResource{gvr: deploymentsGVR, name: name, object: newMediatorObject(cr, "apps/v1", "Deployment", name, map[string]interface{}{
+		SPEC: map[string]interface{}{
+			"replicas": *spec.Replicas,
+			"selector": map[string]interface{}{"matchLabels": mediatorLabels(name)},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": mediatorLabels(name), ANNOTATIONS: podAnnotations},
+				SPEC:       podSpec,
+			},
+		},
+	})})
+
+	servicePort := int64(443)
+	if !tls {
+		servicePort = 80
+	}
+	service := newMediatorObject(cr, V1, "Service", name, map[string]interface{}{
+		SPEC: map[string]interface{}{
+			"selector": mediatorLabels(name),
+			"ports":    []interface{}{map[string]interface{}{"name": "listener", "port": servicePort, "targetPort": port}},
+		},
+	})
+	if spec.TLS.Mode == tlsModeServiceCA {
+		service.SetAnnotations(map[string]string{mediatorServingCertAnnot: spec.TLS.SecretName})
+	}
+	resources = append(resources, &mediatorResource{gvr: servicesGVR, name: name, object: service})
+
+	route := &mediatorResource{gvr: routesGVR, name: name}
+	if spec.Route.Enabled {
+		routeSpec := map[string]interface{}{
+			"to":   map[string]interface{}{"kind": "Service", "name": name},
+			"port": map[string]interface{}{"targetPort": "listener"},
+		}
+		switch spec.TLS.Mode {
+		case tlsModeServiceCA:
+			/* the router trusts the service CA */
+			routeSpec["tls"] = map[string]interface{}{"termination": "reencrypt"}
+		case tlsModeNone:
+			routeSpec["tls"] = map[string]interface{}{"termination": "edge"}
+		default:
+			routeSpec["tls"] = map[string]interface{}{"termination": "passthrough"}
+		}
+		if spec.Route.Host != "" {
+			routeSpec["host"] = spec.Route.Host
+		}
+		route.object = newMediatorObject(cr, "route.openshift.io/v1", "Route", name, map[string]interface{}{SPEC: routeSpec})
+	}
+	resources = append(resources, route)
+
+	certificate := &mediatorResource{gvr: certificatesGVR, name: name}
+	if spec.TLS.Mode == tlsModeCertManager {
+		dnsNames := []interface{}{name + "." + cr.GetNamespace() + ".svc", name + "." + cr.GetNamespace() + ".svc.cluster.local"}
+		if spec.Route.Enabled && spec.Route.Host != "" {
+			dnsNames = append(dnsNames, spec.Route.Host)
+		}
+		certificate.object = newMediatorObject(cr, "cert-manager.io/v1", "Certificate", name, map[string]interface{}{
+			SPEC: map[string]interface{}{"secretName": spec.TLS.SecretName, "dnsNames": dnsNames, "issuerRef": spec.TLS.IssuerRef},
+		})
+	}
+	resources = append(resources, certificate)
+
+	for _, resource := range resources {
+		if resource.object != nil {
+			hash, err := mediatorObjectHash(resource.object)
+			if err != nil {
+				return nil, err
+			}
+			annotations := resource.object.GetAnnotations()
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[mediatorHashAnnotation] = hash
+			resource.object.SetAnnotations(annotations)
+		}
+	}
+	return resources, nil
+}
+
+func toInterfaces(values []string) []interface{} {
+	converted := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		converted = append(converted, value)
+	}
+	return converted
+}
+
+/* Return the hash of the desired state of a resource */
+func mediatorObjectHash(obj *unstructured.Unstructured) (string, error) {
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:8]), nil
+}
+
+/* Return whether a resource is owned by an EventMediator */
+func ownedByMediator(obj *unstructured.Unstructured, cr *unstructured.Unstructured) bool {
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.UID == cr.GetUID() {
+			return true
+		}
+	}
+	return false
+}
+
+/* Create, update, or delete a resource of an EventMediator. Returns what was done, empty if nothing */
+func reconcileMediatorResource(dynInterf dynamic.Interface, cr *unstructured.Unstructured, resource *mediatorResource) (string, error) {
+	intf := dynInterf.Resource(resource.gvr).Namespace(cr.GetNamespace())
+	existing, err := intf.Get(resource.name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return "", err
+	}
+	exists := err == nil
+	if resource.object == nil {
+		/* resources that were not created for the CR are left alone */
+		if !exists || !ownedByMediator(existing, cr) {
+			return "", nil
+		}
+		if err = intf.Delete(resource.name, &metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return "", err
+		}
+		return "deleted", nil
+	}
+	if !exists {
+		if _, err = intf.Create(resource.object, metav1.CreateOptions{}); err != nil {
+			return "", err
+		}
+		return "created", nil
+	}
+	if !ownedByMediator(existing, cr) {
+		return "", fmt.Errorf("%s %s exists and is not owned by EventMediator %s", existing.GetKind(), resource.name, cr.GetName())
+	}
+	if existing.GetAnnotations()[mediatorHashAnnotation] == resource.object.GetAnnotations()[mediatorHashAnnotation] {
+		return "", nil
+	}
+	resource.object.SetResourceVersion(existing.GetResourceVersion())
+	if resource.gvr == servicesGVR {
+		/* the cluster IP of a service can not be changed */
+		if clusterIP, found, _ := unstructured.NestedString(existing.Object, SPEC, "clusterIP"); found {
+			unstructured.SetNestedField(resource.object.Object, clusterIP, SPEC, "clusterIP")
+		}
+	}
+	if _, err = intf.Update(resource.object, metav1.UpdateOptions{}); err != nil {
+		return "", err
+	}
+	return "updated", nil
+}
+
+/* Set the Reconciled condition of an EventMediator, keeping its transition time if its status did not change */
+func setMediatorCondition(conditions []interface{}, err error, now time.Time) []interface{} {
+	condition := map[string]interface{}{
+		"type":               mediatorReconciledType,
+		"status":             "True",
+		"reason":             "Reconciled",
+		"message":            "the resources of the EventMediator are up to date",
+		"lastTransitionTime": now.UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		condition["status"], condition["reason"], condition["message"] = "False", "Failed", err.Error()
+	}
+	updated := make([]interface{}, 0, len(conditions)+1)
+	for _, existingObj := range conditions {
+		existing, ok := existingObj.(map[string]interface{})
+		if !ok || existing["type"] != mediatorReconciledType {
+			updated = append(updated, existingObj)
+			continue
+		}
+		if existing["status"] == condition["status"] {
+			condition["lastTransitionTime"] = existing["lastTransitionTime"]
+		}
+	}
+	return append(updated, condition)
+}
+
+/* Reconcile the resources of an EventMediator, and report the outcome in its status */
+func reconcileEventMediator(dynInterf dynamic.Interface, cr *unstructured.Unstructured, defaultImage string) error {
+	spec, err := decodeEventMediatorSpec(cr, defaultImage)
+	var resources []*mediatorResource
+	if err == nil {
+		resources, err = eventMediatorResources(cr, spec)
+	}
+	for _, resource := range resources {
+		done, resourceErr := reconcileMediatorResource(dynInterf, cr, resource)
+		if resourceErr != nil {
+			err = fmt.Errorf("unable to reconcile %s %s: %v", resource.gvr.Resource, resource.name, resourceErr)
+			break
+		}
+		if done != "" {
+			klog.Infof("EventMediator %s/%s: %s %s %s", cr.GetNamespace(), cr.GetName(), done, resource.gvr.Resource, resource.name)
+		}
+	}
+
+	status, _, _ := unstructured.NestedMap(cr.Object, "status")
+	if status == nil {
+		status = make(map[string]interface{})
+	}
+	conditions, _, _ := unstructured.NestedSlice(cr.Object, "status", "conditions")
+	status["conditions"] = setMediatorCondition(conditions, err, time.Now())
+	status["observedGeneration"] = cr.GetGeneration()
+	if deployment, getErr := dynInterf.Resource(deploymentsGVR).Namespace(cr.GetNamespace()).Get(cr.GetName(), metav1.GetOptions{}); getErr == nil {
+		readyReplicas, _, _ := unstructured.NestedInt64(deployment.Object, "status", "readyReplicas")
+		status["readyReplicas"] = readyReplicas
+	}
+	cr.Object["status"] = status
+	if _, statusErr := dynInterf.Resource(mediatorsGVR).Namespace(cr.GetNamespace()).UpdateStatus(cr, metav1.UpdateOptions{}); statusErr != nil {
+		klog.Warningf("Unable to update the status of EventMediator %s/%s: %v", cr.GetNamespace(), cr.GetName(), statusErr)
+	}
+	return err
+}
+
+/* Reconcile the EventMediators of a namespace, of every namespace if empty. Returns the number that failed */
+func reconcileEventMediators(dynInterf dynamic.Interface, namespace string, defaultImage string) (int, error) {
+	list, err := dynInterf.Resource(mediatorsGVR).Namespace(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("unable to list the EventMediators: %v", err)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].GetName() < list.Items[j].GetName() })
+	failed := 0
+	for index := range list.Items {
+		cr := &list.Items[index]
+		if cr.GetDeletionTimestamp() != nil {
+			/* its resources are garbage collected */
+			continue
+		}
+		if err = reconcileEventMediator(dynInterf, cr, defaultImage); err != nil {
+			klog.Errorf("Unable to reconcile EventMediator %s/%s: %v", cr.GetNamespace(), cr.GetName(), err)
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+/* The controller subcommand: reconcile the EventMediators of a namespace every interval, or once */
+func controllerCommand(args []string) int {
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	namespace := flags.String("namespace", os.Getenv(KUBENAMESPACE), "namespace of the EventMediators, every namespace if empty")
+	interval := flags.Duration("interval", 30*time.Second, "interval between reconciliations")
+	image := flags.String("image", os.Getenv("KABANERO_EVENTS_IMAGE"), "image of kabanero-events, for the EventMediators that do not set one")
+	once := flags.Bool("once", false, "reconcile once and exit, with status 1 if an EventMediator could not be reconciled")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kabanero-events controller [-namespace <namespace>] [-interval <duration>] [-image <image>] [-once]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := newKubeConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "controller: %v\n", err)
+		return 2
+	}
+	cfg.UserAgent = userAgent()
+	dynInterf, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "controller: %v\n", err)
+		return 2
+	}
+	klog.Infof("Reconciling the EventMediators of namespace %q every %v", *namespace, *interval)
+	for {
+		failed, err := reconcileEventMediators(dynInterf, *namespace, *image)
+		if err != nil {
+			klog.Error(err)
+		}
+		if *once {
+			if err != nil || failed > 0 {
+				return 1
+			}
+			return 0
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+/* An API server storing the resources created by their path */
+type fakeObjectServer struct {
+	mutex     sync.Mutex
+	objects   map[string]map[string]interface{}
+	methods   []string // method and path of each request changing a resource
+	conflicts int      // number of updates to reject with a conflict
+}
+
+func (server *fakeObjectServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.TrimSuffix(req.URL.Path, "/status")
+	switch req.Method {
+	case http.MethodGet:
+		if obj, ok := server.objects[path]; ok {
+			json.NewEncoder(w).Encode(obj)
+			return
+		}
+		/* items are listed by name, as by the API server */
+		keys := make([]string, 0)
+		for key := range server.objects {
+			if strings.HasPrefix(key, path+"/") && !strings.Contains(strings.TrimPrefix(key, path+"/"), "/") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		items := make([]interface{}, 0)
+		for _, key := range keys {
+			items = append(items, server.objects[key])
+		}
+		if len(items) == 0 && !isFakeCollection(path) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items})
+	case http.MethodPost, http.MethodPut:
+		if req.Method == http.MethodPut && server.conflicts > 0 {
+			server.conflicts--
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Conflict","code":409}`))
+			return
+		}
+		obj := make(map[string]interface{})
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &obj)
+		if req.Method == http.MethodPost {
+			path += "/" + obj["metadata"].(map[string]interface{})["name"].(string)
+		}
+		server.objects[path] = obj
+		server.methods = append(server.methods, req.Method+" "+req.URL.Path)
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodDelete:
+		delete(server.objects, path)
+		server.methods = append(server.methods, req.Method+" "+req.URL.Path)
+		w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Success"}`))
+	}
+}
+
+/* Return whether a path is that of the CRs that may be listed when there are none */
+func isFakeCollection(path string) bool {
+	for _, resource := range []string{EVENTMEDIATORS, EVENTPROVIDERS, EVENTDESTINATIONS, EVENTTRIGGERRESOURCES} {
+		if strings.HasSuffix(path, "/"+resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *fakeObjectServer) takeMethods() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	methods := server.methods
+	server.methods = nil
+	return methods
+}
+
+func newEventMediator(spec map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": KABANEROIO + "/" + V1ALPHA1,
+		"kind":       EVENTMEDIATOR,
+		"metadata":   map[string]interface{}{"name": "events", "namespace": "kabanero", "uid": "1234", "generation": 3},
+		SPEC:         spec,
+	}
+}
+
+func TestEventMediatorResources(t *testing.T) {
+	cr := &unstructured.Unstructured{Object: newEventMediator(map[string]interface{}{
+		"replicas":  2,
+		"tls":       map[string]interface{}{"mode": tlsModeCertManager, "issuerRef": map[string]interface{}{"name": "ca", "kind": "ClusterIssuer"}},
+		"route":     map[string]interface{}{"enabled": true, "host": "events.example.com"},
+		"providers": map[string]interface{}{"eventDestinations": []interface{}{map[string]interface{}{"name": "dest", "topic": "dest", "providerRef": "nats"}}},
+	})}
+	spec, err := decodeEventMediatorSpec(cr, "kabanero/kabanero-events:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources, err := eventMediatorResources(cr, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byResource := make(map[string]*unstructured.Unstructured)
+	for _, resource := range resources {
+		if resource.object == nil {
+			t.Fatalf("%s %s is not desired", resource.gvr.Resource, resource.name)
+		}
+		byResource[resource.gvr.Resource] = resource.object
+	}
+	if providers, _, _ := unstructured.NestedString(byResource[CONFIGMAPS].Object, DATA, mediatorProvidersFile); !strings.Contains(providers, "providerRef: nats") {
+		t.Fatalf("unexpected providers %q", providers)
+	}
+	deployment := byResource[DEPLOYMENTS]
+	if replicas, _, _ := unstructured.NestedInt64(deployment.Object, SPEC, "replicas"); replicas != 2 {
+		t.Fatalf("%v replicas", replicas)
+	}
+	containers, _, _ := unstructured.NestedSlice(deployment.Object, SPEC, "template", SPEC, "containers")
+	container := containers[0].(map[string]interface{})
+	if container["image"] != "kabanero/kabanero-events:latest" || container["args"].([]interface{})[0] != "-providercfg=/etc/kabanero-events/eventDefinitions.yaml" {
+		t.Fatalf("unexpected container %v", container)
+	}
+	if termination, _, _ := unstructured.NestedString(byResource[ROUTES].Object, SPEC, "tls", "termination"); termination != "passthrough" {
+		t.Fatalf("route termination %s", termination)
+	}
+	if secretName, _, _ := unstructured.NestedString(byResource[CERTIFICATES].Object, SPEC, "secretName"); secretName != "events-tls" {
+		t.Fatalf("certificate secret %s", secretName)
+	}
+	if deployment.GetOwnerReferences()[0].UID != "1234" || deployment.GetAnnotations()[mediatorHashAnnotation] == "" {
+		t.Fatalf("unexpected metadata %v", deployment.Object["metadata"])
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"tls": map[string]interface{}{"mode": "mutual"}},
+		{"tls": map[string]interface{}{"mode": tlsModeSecret}},
+		{"replicas": -1},
+	} {
+		if _, err = decodeEventMediatorSpec(&unstructured.Unstructured{Object: newEventMediator(invalid)}, "image"); err == nil {
+			t.Errorf("spec %v was accepted", invalid)
+		}
+	}
+}
+
+func TestReconcileEventMediators(t *testing.T) {
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventmediators/events": newEventMediator(map[string]interface{}{
+			"route": map[string]interface{}{"enabled": true},
+		}),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	if failed, err := reconcileEventMediators(client, "kabanero", "image"); err != nil || failed != 0 {
+		t.Fatalf("%v failed: %v", failed, err)
+	}
+	created := fake.takeMethods()
+	if len(created) != 4 || created[0] != "POST /apis/apps/v1/namespaces/kabanero/deployments" || created[3] != "PUT /apis/kabanero.io/v1alpha1/namespaces/kabanero/eventmediators/events/status" {
+		t.Fatalf("unexpected requests %v", created)
+	}
+	if annotation := fake.objects["/api/v1/namespaces/kabanero/services/events"]["metadata"].(map[string]interface{})[ANNOTATIONS].(map[string]interface{})[mediatorServingCertAnnot]; annotation != "events-tls" {
+		t.Fatalf("serving certificate annotation %v", annotation)
+	}
+	conditions, _, _ := unstructured.NestedSlice(fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventmediators/events"], "status", "conditions")
+	if len(conditions) != 1 || conditions[0].(map[string]interface{})["status"] != "True" {
+		t.Fatalf("unexpected conditions %v", conditions)
+	}
+
+	/* nothing changes until the spec does */
+	fake.objects["/api/v1/namespaces/kabanero/services/events"][SPEC].(map[string]interface{})["clusterIP"] = "10.0.0.1"
+	reconcileEventMediators(client, "kabanero", "image")
+	if methods := fake.takeMethods(); len(methods) != 1 {
+		t.Fatalf("unexpected requests %v", methods)
+	}
+	fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventmediators/events"][SPEC] = map[string]interface{}{"tls": map[string]interface{}{"mode": tlsModeNone}}
+	reconcileEventMediators(client, "kabanero", "image")
+	methods := fake.takeMethods()
+	if len(methods) != 4 || methods[2] != "DELETE /apis/route.openshift.io/v1/namespaces/kabanero/routes/events" {
+		t.Fatalf("unexpected requests %v", methods)
+	}
+	if clusterIP, _, _ := unstructured.NestedString(fake.objects["/api/v1/namespaces/kabanero/services/events"], SPEC, "clusterIP"); clusterIP != "10.0.0.1" {
+		t.Fatalf("cluster IP %q not kept", clusterIP)
+	}
+
+	/* resources not owned by the EventMediator are not replaced */
+	fake.objects["/apis/apps/v1/namespaces/kabanero/deployments/events"]["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{}
+	fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventmediators/events"][SPEC] = map[string]interface{}{"replicas": 3}
+	if failed, _ := reconcileEventMediators(client, "kabanero", "image"); failed != 1 {
+		t.Fatalf("%v failed", failed)
+	}
+	conditions, _, _ = unstructured.NestedSlice(fake.objects["/apis/kabanero.io/v1alpha1/namespaces/kabanero/eventmediators/events"], "status", "conditions")
+	if condition := conditions[0].(map[string]interface{}); condition["status"] != "False" || !strings.Contains(condition["message"].(string), "not owned") {
+		t.Fatalf("unexpected condition %v", condition)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Streaming events. GET /admin/events/stream streams the audit records of the messages as they are processed, as
+server-sent events, optionally only those of an eventSource or collection. A comment is sent every
+eventStreamHeartbeat so that proxies keep the connection open. Audit records are not queued for a slow client: those
+that do not fit its buffer are dropped and counted.
+*/
+
+var (
+	eventStreamBuffer    = 100              // audit records buffered for each client of the stream
+	eventStreamHeartbeat = 15 * time.Second // interval of the comments sent to keep the stream open
+
+	auditSubscribersMutex sync.Mutex
+	auditSubscribers      = make(map[chan *auditRecord]bool)
+)
+
+/* Subscribe to the audit records that are recorded. The channel must be unsubscribed */
+func subscribeAudit() chan *auditRecord {
+	auditSubscribersMutex.Lock()
+	defer auditSubscribersMutex.Unlock()
+	records := make(chan *auditRecord, eventStreamBuffer)
+	auditSubscribers[records] = true
+	return records
+}
+
+func unsubscribeAudit(records chan *auditRecord) {
+	auditSubscribersMutex.Lock()
+	defer auditSubscribersMutex.Unlock()
+	delete(auditSubscribers, records)
+}
+
+/* Publish an audit record to the subscribers, without waiting for those whose buffer is full */
+func publishAudit(record *auditRecord) {
+	auditSubscribersMutex.Lock()
+	defer auditSubscribersMutex.Unlock()
+	for records := range auditSubscribers {
+		select {
+		case records <- record:
+		default:
+			incrementMetric("audit.stream.dropped")
+		}
+	}
+}
+
+/* GET /admin/events/stream streams the audit records as server-sent events */
+func adminEventStreamHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, req, codeInternalError, "streaming is not supported")
+		return
+	}
+	eventSource, collection := req.URL.Query().Get("eventSource"), req.URL.Query().Get("collection")
+
+	records := subscribeAudit()
+	defer unsubscribeAudit(records)
+	incrementMetric("audit.stream.clients")
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case record := <-records:
+			if (eventSource != "" && record.EventSource != eventSource) || (collection != "" && record.Collection != collection) {
+				continue
+			}
+			data, err := json.Marshal(record)
+			if err != nil {
+				klog.Errorf("Unable to stream the audit record of event %v: %v", record.EventID, err)
+				continue
+			}
+			if _, err = fmt.Fprintf(writer, "event: audit\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamHandler(t *testing.T) {
+	savedStore := auditStore
+	defer func() { auditStore = savedStore }()
+	auditStore = newMemoryStore()
+
+	server := httptest.NewServer(http.HandlerFunc(adminEventStreamHandler))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?collection=active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected response %v %v", resp.Status, resp.Header)
+	}
+
+	/* the records are published once the client is subscribed */
+	for {
+		auditSubscribersMutex.Lock()
+		subscribers := len(auditSubscribers)
+		auditSubscribersMutex.Unlock()
+		if subscribers > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	message := map[string]interface{}{EVENTID: "canary-event"}
+	recordAudit(message, "github", "canary", nil, nil)
+	message[EVENTID] = "active-event"
+	recordAudit(message, "github", "active", &evalResult{actions: []string{"build"}}, nil)
+
+	buffer := make([]byte, 4096)
+	read := ""
+	for !strings.HasSuffix(read, "\n\n") {
+		count, err := resp.Body.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += string(buffer[:count])
+	}
+	if !strings.HasPrefix(read, "event: audit\ndata: {") || !strings.Contains(read, `"eventID":"active-event"`) || strings.Contains(read, "canary-event") {
+		t.Fatalf("unexpected stream %q", read)
+	}
+}
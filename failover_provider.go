@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog"
+)
+
+// The failover provider sends and receives messages through a list of backends, other messageProviders in order of
+// preference, so that an outage of the primary broker degrades to a secondary broker rather than halting the
+// pipeline. Messages are sent to the first healthy backend. A backend that fails is unhealthy for the retry interval,
+// after which it is preferred again. Messages are received from all backends, as senders may have failed over, and
+// the subscriptions of a failed backend are retried until it recovers.
+
+const defaultFailoverRetryInterval = 30 * time.Second
+
+type failoverProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	retryInterval             time.Duration
+
+	mutex    sync.Mutex
+	active   string                 // backend the last message was sent to
+	failedAt map[string]time.Time   // time of the last failure of each unhealthy backend
+	received map[string]chan []byte // messages received from all backends, by eventSource
+
+	stop      chan struct{}  // closed by Close, to stop the receivers and listeners of the backends
+	receivers sync.WaitGroup // receivers of the backends
+}
+
+func (provider *failoverProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	if len(mpd.Backends) == 0 {
+		return fmt.Errorf("failover provider '%s' has no backends", mpd.Name)
+	}
+	for _, backend := range mpd.Backends {
+		if backend == mpd.Name {
+			return fmt.Errorf("failover provider '%s' can not be its own backend", mpd.Name)
+		}
+	}
+	provider.retryInterval = mpd.RetryInterval
+	if provider.retryInterval <= 0 {
+		provider.retryInterval = defaultFailoverRetryInterval
+	}
+	provider.failedAt = make(map[string]time.Time)
+	provider.received = make(map[string]chan []byte)
+	provider.stop = make(chan struct{})
+	return nil
+}
+
+// Return the provider of a backend. The providers are looked up on each use, as they are replaced when the
+// configuration changes.
+func (provider *failoverProvider) backend(name string) (MessageProvider, error) {
+	backend := lookupMessageProvider(name)
+	if backend == nil {
+		return nil, fmt.Errorf("backend '%s' of failover provider '%s' is not defined", name, provider.messageProviderDefinition.Name)
+	}
+	return backend, nil
+}
+
+// Return the backends in the order they should be tried: the healthy ones in order of preference, then the unhealthy ones.
+func (provider *failoverProvider) candidates(now time.Time) []string {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	healthy := make([]string, 0, len(provider.messageProviderDefinition.Backends))
+	unhealthy := make([]string, 0)
+	for _, name := range provider.messageProviderDefinition.Backends {
+		if failedAt, failed := provider.failedAt[name]; failed && now.Sub(failedAt) < provider.retryInterval {
+			unhealthy = append(unhealthy, name)
+			continue
+		}
+		healthy = append(healthy, name)
+	}
+	return append(healthy, unhealthy...)
+}
+
+// Record a failure of a backend.
+func (provider *failoverProvider) markFailed(name string, err error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.failedAt[name] = time.Now()
+	incrementMetric("failover." + provider.messageProviderDefinition.Name + ".errors")
+	klog.Warningf("failoverProvider: backend '%s' of '%s' failed: %v", name, provider.messageProviderDefinition.Name, err)
+}
+
+// Record a successful send to a backend.
+func (provider *failoverProvider) markSent(name string) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	delete(provider.failedAt, name)
+	if provider.active != name {
+		if provider.active != "" {
+			incrementMetric("failover." + provider.messageProviderDefinition.Name + ".switches")
+			klog.Warningf("failoverProvider: '%s' switched from backend '%s' to '%s'", provider.messageProviderDefinition.Name, provider.active, name)
+		}
+		provider.active = name
+	}
+}
+
+// Send a message to the first backend that accepts it.
+func (provider *failoverProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	errors := make([]string, 0)
+	for _, name := range provider.candidates(time.Now()) {
+		backend, err := provider.backend(name)
+		if err == nil {
+			err = backend.Send(node, payload, header)
+		}
+		if err != nil {
+			provider.markFailed(name, err)
+			errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		provider.markSent(name)
+		return nil
+	}
+	return fmt.Errorf("failoverProvider: unable to send to any backend of '%s': %s", provider.messageProviderDefinition.Name, strings.Join(errors, "; "))
+}
+
+// Subscribe to an eventSource on all backends. Backends that can not subscribe are retried until they recover.
+func (provider *failoverProvider) Subscribe(node *EventNode) error {
+	provider.mutex.Lock()
+	if provider.stopped() {
+		provider.mutex.Unlock()
+		return fmt.Errorf("failover provider '%s' is closed", provider.messageProviderDefinition.Name)
+	}
+	if _, subscribed := provider.received[node.Name]; subscribed {
+		provider.mutex.Unlock()
+		return nil
+	}
+	received := make(chan []byte)
+	provider.received[node.Name] = received
+	provider.receivers.Add(len(provider.messageProviderDefinition.Backends))
+	provider.mutex.Unlock()
+
+	subscribed := 0
+	for _, name := range provider.messageProviderDefinition.Backends {
+		backend, err := provider.backend(name)
+		if err == nil {
+			err = backend.Subscribe(node)
+		}
+		if err != nil {
+			provider.markFailed(name, err)
+		} else {
+			subscribed++
+		}
+		go provider.receiveFrom(name, node, received, err == nil)
+	}
+	if subscribed == 0 {
+		return fmt.Errorf("failoverProvider: unable to subscribe to '%s' on any backend of '%s'", node.Topic, provider.messageProviderDefinition.Name)
+	}
+	return nil
+}
+
+// Return whether the provider is closed.
+func (provider *failoverProvider) stopped() bool {
+	select {
+	case <-provider.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for the retry interval. Returns false if the provider was closed meanwhile.
+func (provider *failoverProvider) sleep() bool {
+	select {
+	case <-provider.stop:
+		return false
+	case <-time.After(provider.retryInterval):
+		return true
+	}
+}
+
+// Receive the messages of an eventSource from a backend, resubscribing after failures, until the provider is closed.
+func (provider *failoverProvider) receiveFrom(name string, node *EventNode, received chan<- []byte, subscribed bool) {
+	defer provider.receivers.Done()
+	for !provider.stopped() {
+		if !subscribed {
+			if !provider.sleep() {
+				return
+			}
+			backend, err := provider.backend(name)
+			if err == nil {
+				err = backend.Subscribe(node)
+			}
+			if err != nil {
+				provider.markFailed(name, err)
+				continue
+			}
+			if klog.V(2) {
+				klog.Infof("failoverProvider: resubscribed to '%s' on backend '%s'", node.Topic, name)
+			}
+			subscribed = true
+		}
+		backend, err := provider.backend(name)
+		if err != nil {
+			subscribed = false
+			continue
+		}
+		data, err := backend.Receive(node)
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			provider.markFailed(name, err)
+			subscribed = false
+			continue
+		}
+		select {
+		case received <- data:
+		case <-provider.stop:
+			return
+		}
+	}
+}
+
+// Receive a message of an eventSource from any backend.
+func (provider *failoverProvider) Receive(node *EventNode) ([]byte, error) {
+	provider.mutex.Lock()
+	received, ok := provider.received[node.Name]
+	provider.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no subscription for eventSource '%s'. It should be defined and Subscribed to", node.Name)
+	}
+	var timeout <-chan time.Time
+	if provider.messageProviderDefinition.Timeout > 0 {
+		timeout = time.After(provider.messageProviderDefinition.Timeout)
+	}
+	select {
+	case data := <-received:
+		return data, nil
+	case <-timeout:
+		return nil, nats.ErrTimeout
+	case <-provider.stop:
+		return nil, fmt.Errorf("failover provider '%s' is closed", provider.messageProviderDefinition.Name)
+	}
+}
+
+// ListenAndServe listens on all backends, restarting the listener of a backend whenever it stops, until the provider
+// is closed.
+func (provider *failoverProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	var wg sync.WaitGroup
+	for _, name := range provider.messageProviderDefinition.Backends {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			for !provider.stopped() {
+				backend, err := provider.backend(name)
+				if err != nil {
+					klog.Error(err)
+					return
+				}
+				backend.ListenAndServe(node, receiver)
+				if provider.stopped() {
+					return
+				}
+				klog.Warningf("failoverProvider: listener of backend '%s' stopped. Restarting in %v", name, provider.retryInterval)
+				if !provider.sleep() {
+					return
+				}
+			}
+		}(name)
+	}
+	wg.Wait()
+}
+
+// Close stops the receivers of the backends, and waits for them to return. The backends are not closed, as they
+// are messageProviders of their own.
+func (provider *failoverProvider) Close() error {
+	provider.mutex.Lock()
+	if !provider.stopped() {
+		close(provider.stop)
+	}
+	provider.mutex.Unlock()
+	provider.receivers.Wait()
+	return nil
+}
+
+func init() {
+	RegisterMessageProvider("failover", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newFailoverProvider(mpd)
+	})
+}
+
+func newFailoverProvider(mpd *MessageProviderDefinition) (*failoverProvider, error) {
+	provider := new(failoverProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/* A message provider that can be taken down, delivering the messages it is sent to its subscribers */
+type brokerProvider struct {
+	mutex      sync.Mutex
+	down       bool
+	sent       int
+	subscribed int
+	messages   chan []byte
+	timeout    bool // Receive times out, as providers with a timeout do, rather than waiting for a message
+}
+
+func newBrokerProvider() *brokerProvider {
+	return &brokerProvider{messages: make(chan []byte, 10)}
+}
+
+func (provider *brokerProvider) setDown(down bool) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.down = down
+}
+
+func (provider *brokerProvider) isDown() bool {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	return provider.down
+}
+
+func (provider *brokerProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.down {
+		return fmt.Errorf("broker is down")
+	}
+	provider.sent++
+	provider.messages <- payload
+	return nil
+}
+
+func (provider *brokerProvider) Subscribe(node *EventNode) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.down {
+		return fmt.Errorf("broker is down")
+	}
+	provider.subscribed++
+	return nil
+}
+
+func (provider *brokerProvider) Receive(node *EventNode) ([]byte, error) {
+	if provider.isDown() {
+		return nil, fmt.Errorf("broker is down")
+	}
+	select {
+	case data := <-provider.messages:
+		return data, nil
+	case <-time.After(5 * time.Millisecond):
+		if provider.isDown() {
+			return nil, fmt.Errorf("connection lost")
+		}
+		if provider.timeout {
+			return nil, nats.ErrTimeout
+		}
+		return provider.Receive(node)
+	}
+}
+
+func (provider *brokerProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {}
+
+func setupFailover(t *testing.T, primary MessageProvider, secondary MessageProvider) *failoverProvider {
+	mpd := &MessageProviderDefinition{Name: "brokers", ProviderType: "failover", Backends: []string{"primary", "secondary"}, RetryInterval: 20 * time.Millisecond, Timeout: time.Second}
+	provider, err := newFailoverProvider(mpd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []MessageProvider{primary, secondary} {
+		if broker, ok := backend.(*brokerProvider); ok {
+			broker.timeout = true
+		}
+	}
+	messageProviders = map[string]MessageProvider{"primary": primary, "secondary": secondary, "brokers": provider}
+	return provider
+}
+
+func TestFailoverSend(t *testing.T) {
+	savedProviders := messageProviders
+	defer func() { messageProviders = savedProviders }()
+	primary, secondary := newBrokerProvider(), newBrokerProvider()
+	provider := setupFailover(t, primary, secondary)
+	node := &EventNode{Name: "github", Topic: "github", ProviderRef: "brokers"}
+
+	if err := provider.Send(node, []byte("1"), nil); err != nil || primary.sent != 1 {
+		t.Fatalf("message not sent to the primary: %v", err)
+	}
+	primary.setDown(true)
+	if err := provider.Send(node, []byte("2"), nil); err != nil || secondary.sent != 1 {
+		t.Fatalf("message not sent to the secondary: %v", err)
+	}
+	/* the primary is not tried again until the retry interval has elapsed */
+	primary.setDown(false)
+	if err := provider.Send(node, []byte("3"), nil); err != nil || secondary.sent != 2 || primary.sent != 1 {
+		t.Fatalf("message not sent to the secondary: %v", err)
+	}
+	time.Sleep(provider.retryInterval)
+	if err := provider.Send(node, []byte("4"), nil); err != nil || primary.sent != 2 {
+		t.Fatalf("message not sent to the recovered primary: %v", err)
+	}
+
+	secondary.setDown(true)
+	primary.setDown(true)
+	if err := provider.Send(node, []byte("5"), nil); err == nil {
+		t.Fatal("expected error sending with all backends down")
+	}
+
+	if _, err := newFailoverProvider(&MessageProviderDefinition{Name: "brokers", Backends: []string{"brokers"}}); err == nil {
+		t.Fatal("expected error creating a failover provider backed by itself")
+	}
+}
+
+func TestFailoverReceive(t *testing.T) {
+	savedProviders := messageProviders
+	defer func() { messageProviders = savedProviders }()
+	primary, secondary := newBrokerProvider(), newBrokerProvider()
+	provider := setupFailover(t, primary, secondary)
+	defer provider.Close()
+	node := &EventNode{Name: "github", Topic: "github", ProviderRef: "brokers"}
+
+	/* the secondary is down when subscribing, and is resubscribed once it recovers */
+	secondary.setDown(true)
+	if err := provider.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Send(node, []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := provider.Receive(node); err != nil || string(data) != "1" {
+		t.Fatalf("unexpected message %s: %v", data, err)
+	}
+
+	secondary.setDown(false)
+	primary.setDown(true)
+	if err := provider.Send(node, []byte("2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := provider.Receive(node); err != nil || string(data) != "2" {
+		t.Fatalf("unexpected message %s: %v", data, err)
+	}
+	secondary.mutex.Lock()
+	subscribed := secondary.subscribed
+	secondary.mutex.Unlock()
+	if subscribed != 1 {
+		t.Fatalf("secondary subscribed %v times", subscribed)
+	}
+
+	/* closing the provider stops its receivers */
+	if err := provider.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Receive(node); err == nil || err == nats.ErrTimeout {
+		t.Fatalf("unexpected error receiving from a closed provider: %v", err)
+	}
+	if err := provider.Subscribe(&EventNode{Name: "gitlab", Topic: "gitlab", ProviderRef: "brokers"}); err == nil {
+		t.Fatal("expected error subscribing on a closed provider")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"k8s.io/klog"
+)
+
+/*
+Filters of eventDestinations. The filter of an eventDestination is a CEL expression of the message, and of the kabanero
+variable of transforms, that selects the messages sent to the destination, such as the push events of the main branch,
+while its receiveFilter selects the messages received from it as an event source before the triggers are evaluated,
+such as those published by other producers. Messages that do not match are dropped, reducing the traffic of the message
+brokers and the evaluation of triggers. A filter that cannot be evaluated, for example because it reads a field that
+the message does not have, does not match.
+*/
+
+var (
+	filtersMutex    sync.Mutex
+	compiledFilters = make(map[string]cel.Program) // by expression
+)
+
+/* Return the program of a filter, compiling it the first time */
+func getCompiledFilter(expression string) (cel.Program, error) {
+	filtersMutex.Lock()
+	defer filtersMutex.Unlock()
+	if program, ok := compiledFilters[expression]; ok {
+		return program, nil
+	}
+	program, err := compileMessageExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+	compiledFilters[expression] = program
+	return program, nil
+}
+
+/* Compile the filters of the eventDestinations */
+func initializeFilters(ed *EventDefinition) error {
+	for _, node := range ed.EventDestinations {
+		for _, expression := range []string{node.Filter, node.ReceiveFilter} {
+			if expression == "" {
+				continue
+			}
+			if _, err := getCompiledFilter(expression); err != nil {
+				return fmt.Errorf("invalid filter of eventDestination %s: %v", node.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+/* Return whether a message matches a filter of an eventDestination */
+func matchesFilter(node *EventNode, expression string, message map[string]interface{}) bool {
+	program, err := getCompiledFilter(expression)
+	if err != nil {
+		incrementMetric("filter.errors")
+		klog.Errorf("Invalid filter of eventDestination %s: %v", node.Name, err)
+		return false
+	}
+	out, _, err := program.Eval(messageVariables(node, message))
+	if err != nil {
+		incrementMetric("filter.errors")
+		if klog.V(4) {
+			klog.Infof("Filter of eventDestination %s does not match message %v: %v", node.Name, messageEventID(message), err)
+		}
+		return false
+	}
+	return out == types.True
+}
+
+/* Return whether a message is sent to an eventDestination by its filter */
+func filterSentMessage(node *EventNode, bytes []byte) bool {
+	if node.Filter == "" {
+		return true
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(bytes, &message); err != nil || !matchesFilter(node, node.Filter, message) {
+		incrementMetric("filter." + node.Name + ".dropped")
+		return false
+	}
+	return true
+}
+
+/* Return whether a message received from an event source is processed by its receiveFilter */
+func filterReceivedMessage(node *EventNode, message map[string]interface{}) bool {
+	if node.ReceiveFilter == "" || matchesFilter(node, node.ReceiveFilter, message) {
+		return true
+	}
+	incrementMetric("filter." + node.Name + ".skipped")
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFilterSentMessages(t *testing.T) {
+	provider := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": provider}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{
+		{Name: "main-pushes", ProviderRef: "capture", Filter: `message.header["X-Github-Event"][0] == "push" && message.body.ref == "refs/heads/main"`},
+	}}
+	if err := initializeFilters(eventProviders); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []string{
+		`{"header":{"X-Github-Event":["push"]},"body":{"ref":"refs/heads/main"}}`,
+		`{"header":{"X-Github-Event":["push"]},"body":{"ref":"refs/heads/feature"}}`,
+		`{"header":{"X-Github-Event":["pull_request"]},"body":{"action":"opened"}}`,
+		`not JSON`,
+	} {
+		if err := sendToDestinationNow("main-pushes", []byte(message), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	/* the filter of the pull request reads a missing field, and does not match */
+	if len(provider.messages) != 1 || string(provider.messages[0]) != `{"header":{"X-Github-Event":["push"]},"body":{"ref":"refs/heads/main"}}` {
+		t.Fatalf("unexpected messages %q", provider.messages)
+	}
+
+	eventProviders.EventDestinations[0].ReceiveFilter = "message.body.ref =="
+	if err := initializeFilters(eventProviders); err == nil {
+		t.Fatal("invalid filter was compiled")
+	}
+}
+
+func TestFilterReceivedMessages(t *testing.T) {
+	node := &EventNode{Name: "labeled", ReceiveFilter: `message.body.action == "labeled" && message.body.label.name == kabanero.destination`}
+	for message, expected := range map[string]bool{
+		`{"body":{"action":"labeled","label":{"name":"labeled"}}}`:   true,
+		`{"body":{"action":"labeled","label":{"name":"wontfix"}}}`:   false,
+		`{"body":{"action":"unlabeled","label":{"name":"labeled"}}}`: false,
+		`{"body":{"action":"labeled"}}`:                              false,
+	} {
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(message), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if filterReceivedMessage(node, parsed) != expected {
+			t.Errorf("message %s was not filtered as expected", message)
+		}
+	}
+	if !filterReceivedMessage(&EventNode{Name: "all"}, map[string]interface{}{}) {
+		t.Error("message of an event source without filter was filtered")
+	}
+}
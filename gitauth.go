@@ -0,0 +1,658 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Credentials of outbound git calls. The credentials used to read the files of a repository are resolved by a chain of
+auth providers, configured per host in the gitAuth section of eventDefinitions.yaml: the secrets annotated with git
+URLs, a GitHub App, HashiCorp Vault, the ambient workload identity of the pod, or the GH_USER and GH_TOKEN environment
+variables. The providers of the host of the repository are tried in order, and the first that has credentials for the
+repository is used; a provider failing is logged, and the next one tried. Without a gitAuth section, the annotated
+secrets are used for all hosts.
+*/
+
+const (
+	gitAuthSecrets          = "secrets"
+	gitAuthGitHubApp        = "githubApp"
+	gitAuthVault            = "vault"
+	gitAuthWorkloadIdentity = "workloadIdentity"
+	gitAuthEnv              = "env"
+
+	gitAuthAnyHost            = "*"
+	gitAuthTimeout            = 10 * time.Second
+	gitAuthTokenRefreshMargin = 5 * time.Minute // tokens are renewed this long before they expire
+	githubAppUsername         = "x-access-token"
+	defaultServiceAccountJWT  = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+/* The credentials of a repository */
+type gitCredentials struct {
+	username string
+	token    string
+	source   string // the provider, and for secrets the name of the secret
+}
+
+/* A provider of credentials. Returns nil credentials, and no error, if it has none for the repository */
+type gitAuthProvider interface {
+	credentials(repoURL string) (*gitCredentials, error)
+}
+
+/* The chains of auth providers, by host */
+type gitAuthChains struct {
+	providers map[string]gitAuthProvider // by name
+	hosts     map[string][]string        // names of the providers, by host
+}
+
+var gitAuth = defaultGitAuthChains()
+
+/* The annotated secrets, for all hosts */
+func defaultGitAuthChains() *gitAuthChains {
+	return &gitAuthChains{
+		providers: map[string]gitAuthProvider{gitAuthSecrets: &secretsAuthProvider{}},
+		hosts:     map[string][]string{gitAuthAnyHost: {gitAuthSecrets}},
+	}
+}
+
+/* Create the auth providers and chains of the gitAuth section of the event definition */
+func initializeGitAuth(ed *EventDefinition) error {
+	if ed.GitAuth == nil {
+		gitAuth = defaultGitAuthChains()
+		return nil
+	}
+	chains, err := newGitAuthChains(ed.GitAuth)
+	if err != nil {
+		return err
+	}
+	gitAuth = chains
+	return nil
+}
+
+func newGitAuthChains(definition *GitAuthDefinition) (*gitAuthChains, error) {
+	chains := &gitAuthChains{providers: make(map[string]gitAuthProvider), hosts: make(map[string][]string)}
+	for _, pd := range definition.Providers {
+		if pd.Name == "" {
+			return nil, fmt.Errorf("gitAuth provider of type '%s' has no name", pd.Type)
+		}
+		if _, ok := chains.providers[pd.Name]; ok {
+			return nil, fmt.Errorf("gitAuth provider '%s' is defined more than once", pd.Name)
+		}
+		provider, err := newGitAuthProvider(pd)
+		if err != nil {
+			return nil, fmt.Errorf("gitAuth provider '%s': %v", pd.Name, err)
+		}
+		chains.providers[pd.Name] = provider
+	}
+	for _, host := range definition.Hosts {
+		if host.Host == "" {
+			return nil, fmt.Errorf("gitAuth host has no name. Use %s for the other hosts", gitAuthAnyHost)
+		}
+		if _, ok := chains.hosts[strings.ToLower(host.Host)]; ok {
+			return nil, fmt.Errorf("gitAuth host '%s' is listed more than once", host.Host)
+		}
+		for _, name := range host.Providers {
+			if _, ok := chains.providers[name]; !ok {
+				return nil, fmt.Errorf("gitAuth provider '%s' of host '%s' is not defined", name, host.Host)
+			}
+		}
+		chains.hosts[strings.ToLower(host.Host)] = host.Providers
+	}
+	if len(definition.Hosts) == 0 {
+		/* the providers in the order in which they are defined, for all hosts */
+		names := make([]string, 0, len(definition.Providers))
+		for _, pd := range definition.Providers {
+			names = append(names, pd.Name)
+		}
+		chains.hosts[gitAuthAnyHost] = names
+	}
+	return chains, nil
+}
+
+func newGitAuthProvider(pd *GitAuthProviderDefinition) (gitAuthProvider, error) {
+	switch pd.Type {
+	case gitAuthSecrets:
+		return &secretsAuthProvider{}, nil
+	case gitAuthEnv:
+		return &envAuthProvider{}, nil
+	case gitAuthGitHubApp:
+		return newGitHubAppAuthProvider(pd)
+	case gitAuthVault:
+		return newVaultAuthProvider(pd)
+	case gitAuthWorkloadIdentity:
+		return newWorkloadIdentityAuthProvider(pd)
+	}
+	return nil, fmt.Errorf("unknown type '%s'. Use %s, %s, %s, %s or %s", pd.Type, gitAuthSecrets, gitAuthGitHubApp, gitAuthVault, gitAuthWorkloadIdentity, gitAuthEnv)
+}
+
+/* Return the names of the providers of the host of a repository */
+func (chains *gitAuthChains) chain(repoURL string) []string {
+	host := ""
+	if parsed, err := url.Parse(repoURL); err == nil {
+		host = strings.ToLower(parsed.Hostname())
+	}
+	if names, ok := chains.hosts[host]; ok {
+		return names
+	}
+	return chains.hosts[gitAuthAnyHost]
+}
+
+/* Resolve the credentials of a repository with the providers of its host */
+func (chains *gitAuthChains) resolve(repoURL string) (*gitCredentials, error) {
+	names := chains.chain(repoURL)
+	failures := make([]string, 0)
+	for _, name := range names {
+		credentials, err := chains.providers[name].credentials(repoURL)
+		if err != nil {
+			incrementMetric("gitauth." + name + ".errors")
+			klog.Warningf("gitAuth provider '%s' failed for %v: %v", name, repoURL, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if credentials != nil {
+			incrementMetric("gitauth." + name + ".resolved")
+			if klog.V(5) {
+				klog.Infof("Resolved credentials of %v with %v", repoURL, credentials.source)
+			}
+			return credentials, nil
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no gitAuth providers are configured for the host of %s", repoURL)
+	}
+	if len(failures) > 0 {
+		return nil, fmt.Errorf("unable to find credentials for %s with gitAuth providers %s: %s", repoURL, strings.Join(names, ","), strings.Join(failures, "; "))
+	}
+	return nil, fmt.Errorf("unable to find credentials for %s with gitAuth providers %s", repoURL, strings.Join(names, ","))
+}
+
+/* Return the username and token of a repository, and where they were found */
+func resolveGitCredentials(repoURL string) (string, string, string, error) {
+	credentials, err := gitAuth.resolve(repoURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	return credentials.username, credentials.token, credentials.source, nil
+}
+
+/* Split the URL of a repository, such as https://github.com/owner/repo.git, into its owner and name */
+func repositoryOwnerAndName(repoURL string) (string, string) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return "", ""
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], strings.TrimSuffix(parts[1], ".git")
+}
+
+/* Return an HTTP client of an auth provider, trusting the certificates of caFile in addition to those of the system */
+func newGitAuthClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Transport: withUserAgent(nil), Timeout: gitAuthTimeout}
+	if caFile == "" {
+		return client, nil
+	}
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	client.Transport = withUserAgent(&http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}})
+	return client, nil
+}
+
+/* Send a JSON request, decoding the JSON response in result. Returns the status code of the response */
+func doGitAuthRequest(client *http.Client, method string, url string, header http.Header, body interface{}, result interface{}) (int, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s %s returned %s", method, url, resp.Status)
+	}
+	if result != nil {
+		if err = json.Unmarshal(data, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("unable to decode the response of %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+/* A token cached until shortly before it expires */
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+func (cached *cachedToken) valid(now time.Time) bool {
+	return cached != nil && cached.token != "" && now.Add(gitAuthTokenRefreshMargin).Before(cached.expires)
+}
+
+/* The secrets annotated with git URLs */
+type secretsAuthProvider struct{}
+
+func (provider *secretsAuthProvider) credentials(repoURL string) (*gitCredentials, error) {
+	username, token, secret, err := getURLAPIToken(dynamicClient, repositoryNamespace(repoURL), repoURL)
+	if err != nil {
+		if _, ok := err.(*noAPITokenError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &gitCredentials{username: username, token: token, source: gitAuthSecrets + "/" + secret}, nil
+}
+
+/* The GH_USER and GH_TOKEN environment variables */
+type envAuthProvider struct{}
+
+func (provider *envAuthProvider) credentials(repoURL string) (*gitCredentials, error) {
+	token := strings.TrimSpace(os.Getenv("GH_TOKEN"))
+	if token == "" {
+		return nil, nil
+	}
+	username := strings.TrimSpace(os.Getenv("GH_USER"))
+	if username == "" {
+		username = githubAppUsername
+	}
+	return &gitCredentials{username: username, token: token, source: gitAuthEnv}, nil
+}
+
+/*
+The installation tokens of a GitHub App. The installation of the App on the owner of the repository is looked up,
+unless it is configured, and its tokens are cached until shortly before they expire.
+*/
+type githubAppAuthProvider struct {
+	appID          int64
+	installationID int64
+	apiURL         string // the API of the host of the repository if empty
+	key            *rsa.PrivateKey
+	client         *http.Client
+	mutex          sync.Mutex
+	installations  map[string]int64       // by API URL and owner
+	tokens         map[int64]*cachedToken // by installation
+}
+
+func newGitHubAppAuthProvider(pd *GitAuthProviderDefinition) (*githubAppAuthProvider, error) {
+	if pd.AppID == 0 || pd.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("a GitHub App requires appID and privateKeyFile")
+	}
+	data, err := ioutil.ReadFile(pd.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseRSAPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the private key of %s: %v", pd.PrivateKeyFile, err)
+	}
+	client, err := newGitAuthClient(pd.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	apiURL := pd.APIURL
+	if apiURL != "" && !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+	return &githubAppAuthProvider{appID: pd.AppID, installationID: pd.InstallationID, apiURL: apiURL, key: key, client: client,
+		installations: make(map[string]int64), tokens: make(map[int64]*cachedToken)}, nil
+}
+
+/* Parse a PEM encoded PKCS#1 or PKCS#8 RSA private key */
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the private key is not an RSA key")
+	}
+	return key, nil
+}
+
+/* Return a JSON Web Token of claims, signed with RS256 */
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(encoded)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+/* Return the JSON Web Token authenticating the App, valid for 10 minutes */
+func (provider *githubAppAuthProvider) jwt(now time.Time) (string, error) {
+	return signJWT(provider.key, map[string]interface{}{
+		/* issued in the past, in case the clock of GitHub is behind */
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(provider.appID, 10),
+	})
+}
+
+func (provider *githubAppAuthProvider) credentials(repoURL string) (*gitCredentials, error) {
+	apiURL := provider.apiURL
+	if apiURL == "" {
+		if apiURL, _ = gitHubAPIURL(repoURL); apiURL == "" {
+			return nil, nil
+		}
+	}
+	owner, name := repositoryOwnerAndName(repoURL)
+	if owner == "" || name == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	jwt, err := provider.jwt(now)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Authorization": {"Bearer " + jwt}, "Accept": {"application/vnd.github+json"}}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	installationID := provider.installationID
+	if installationID == 0 {
+		installationID = provider.installations[apiURL+owner]
+	}
+	if installationID == 0 {
+		var installation struct {
+			ID int64 `json:"id"`
+		}
+		status, err := doGitAuthRequest(provider.client, http.MethodGet, apiURL+"repos/"+owner+"/"+name+"/installation", header, nil, &installation)
+		if status == http.StatusNotFound {
+			/* the App is not installed on the repository */
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		installationID = installation.ID
+		provider.installations[apiURL+owner] = installationID
+	}
+	if cached := provider.tokens[installationID]; cached.valid(now) {
+		return &gitCredentials{username: githubAppUsername, token: cached.token, source: gitAuthGitHubApp}, nil
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	status, err := doGitAuthRequest(provider.client, http.MethodPost, fmt.Sprintf("%sapp/installations/%d/access_tokens", apiURL, installationID), header, nil, &token)
+	if status == http.StatusNotFound && provider.installationID == 0 {
+		/* the App was uninstalled: look the installation up again next time */
+		delete(provider.installations, apiURL+owner)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider.tokens[installationID] = &cachedToken{token: token.Token, expires: token.ExpiresAt}
+	return &gitCredentials{username: githubAppUsername, token: token.Token, source: gitAuthGitHubApp}, nil
+}
+
+/*
+The tokens stored in HashiCorp Vault, at a path templated by the host, owner and name of the repository, such as
+secret/data/git/{{host}}/{{owner}}. The token of Vault is read from a file, or obtained with the Kubernetes auth method
+with the token of the service account of the pod.
+*/
+type vaultAuthProvider struct {
+	address   string
+	path      string
+	role      string
+	authPath  string
+	tokenFile string // token of Vault, if not using the Kubernetes auth method
+	jwtFile   string // token of the service account, for the Kubernetes auth method
+	client    *http.Client
+	mutex     sync.Mutex
+	token     *cachedToken
+}
+
+func newVaultAuthProvider(pd *GitAuthProviderDefinition) (*vaultAuthProvider, error) {
+	if pd.Address == "" || pd.Path == "" {
+		return nil, fmt.Errorf("Vault requires address and path")
+	}
+	if pd.Role == "" && pd.TokenFile == "" {
+		return nil, fmt.Errorf("Vault requires a role for the Kubernetes auth method, or a tokenFile")
+	}
+	client, err := newGitAuthClient(pd.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	provider := &vaultAuthProvider{address: strings.TrimSuffix(pd.Address, "/"), path: strings.Trim(pd.Path, "/"), role: pd.Role,
+		authPath: strings.Trim(pd.AuthPath, "/"), tokenFile: pd.TokenFile, jwtFile: pd.JWTFile, client: client}
+	if provider.authPath == "" {
+		provider.authPath = "auth/kubernetes"
+	}
+	if provider.jwtFile == "" {
+		provider.jwtFile = defaultServiceAccountJWT
+	}
+	return provider, nil
+}
+
+/* Return the token of Vault, logging in with the Kubernetes auth method when the cached token expires */
+func (provider *vaultAuthProvider) vaultToken(now time.Time) (string, error) {
+	if provider.tokenFile != "" {
+		data, err := ioutil.ReadFile(provider.tokenFile)
+		return strings.TrimSpace(string(data)), err
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.token.valid(now) {
+		return provider.token.token, nil
+	}
+	jwt, err := ioutil.ReadFile(provider.jwtFile)
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role": provider.role, "jwt": strings.TrimSpace(string(jwt))}
+	if _, err = doGitAuthRequest(provider.client, http.MethodPost, provider.address+"/v1/"+provider.authPath+"/login", nil, body, &login); err != nil {
+		return "", err
+	}
+	provider.token = &cachedToken{token: login.Auth.ClientToken, expires: now.Add(time.Duration(login.Auth.LeaseDuration) * time.Second)}
+	return login.Auth.ClientToken, nil
+}
+
+func (provider *vaultAuthProvider) credentials(repoURL string) (*gitCredentials, error) {
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, nil
+	}
+	owner, name := repositoryOwnerAndName(repoURL)
+	path := strings.NewReplacer("{{host}}", parsed.Hostname(), "{{owner}}", owner, "{{repository}}", name).Replace(provider.path)
+	token, err := provider.vaultToken(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("unable to authenticate with Vault: %v", err)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	status, err := doGitAuthRequest(provider.client, http.MethodGet, provider.address+"/v1/"+path, http.Header{"X-Vault-Token": {token}}, nil, &secret)
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	if status == http.StatusForbidden && provider.tokenFile == "" {
+		/* the token may have been revoked: log in again next time */
+		provider.mutex.Lock()
+		provider.token = nil
+		provider.mutex.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	/* the secrets of the version 2 of the key/value engine are in data.data */
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	gitToken, _ := data[TOKEN].(string)
+	if gitToken == "" {
+		return nil, fmt.Errorf("the Vault secret %s has no token", path)
+	}
+	username, _ := data[USERNAME].(string)
+	if username == "" {
+		username = githubAppUsername
+	}
+	return &gitCredentials{username: username, token: gitToken, source: gitAuthVault + "/" + path}, nil
+}
+
+/*
+The ambient workload identity of the pod: a projected service account token, or a token maintained by the platform in
+tokenFile. With tokenURL, the token is exchanged for a git token with OAuth 2.0 token exchange, as by the
+identity federation of git hosting services, and the result is cached until shortly before it expires.
+*/
+type workloadIdentityAuthProvider struct {
+	tokenFile string
+	tokenURL  string
+	audience  string
+	username  string
+	client    *http.Client
+	mutex     sync.Mutex
+	token     *cachedToken
+}
+
+func newWorkloadIdentityAuthProvider(pd *GitAuthProviderDefinition) (*workloadIdentityAuthProvider, error) {
+	if pd.TokenFile == "" {
+		return nil, fmt.Errorf("a workload identity requires tokenFile")
+	}
+	client, err := newGitAuthClient(pd.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	username := pd.Username
+	if username == "" {
+		username = githubAppUsername
+	}
+	return &workloadIdentityAuthProvider{tokenFile: pd.TokenFile, tokenURL: pd.TokenURL, audience: pd.Audience, username: username, client: client}, nil
+}
+
+func (provider *workloadIdentityAuthProvider) credentials(repoURL string) (*gitCredentials, error) {
+	/* the file is read for each call, since the platform rotates it */
+	data, err := ioutil.ReadFile(provider.tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	identity := strings.TrimSpace(string(data))
+	if provider.tokenURL == "" {
+		return &gitCredentials{username: provider.username, token: identity, source: gitAuthWorkloadIdentity}, nil
+	}
+
+	now := time.Now()
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.token.valid(now) {
+		return &gitCredentials{username: provider.username, token: provider.token.token, source: gitAuthWorkloadIdentity}, nil
+	}
+	form := url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":      {identity},
+		"subject_token_type": {"urn:ietf:params:oauth:token-type:jwt"},
+	}
+	if provider.audience != "" {
+		form.Set("audience", provider.audience)
+	}
+	resp, err := provider.client.PostForm(provider.tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token exchange with %s returned %s", provider.tokenURL, resp.Status)
+	}
+	var exchanged struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&exchanged); err != nil {
+		return nil, fmt.Errorf("unable to decode the token exchanged with %s: %v", provider.tokenURL, err)
+	}
+	if exchanged.AccessToken == "" {
+		return nil, fmt.Errorf("token exchange with %s returned no access token", provider.tokenURL)
+	}
+	provider.token = &cachedToken{token: exchanged.AccessToken, expires: now.Add(time.Duration(exchanged.ExpiresIn) * time.Second)}
+	return &gitCredentials{username: provider.username, token: exchanged.AccessToken, source: gitAuthWorkloadIdentity}, nil
+}
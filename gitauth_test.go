@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAuthProvider struct {
+	creds *gitCredentials
+	err   error
+	calls int
+}
+
+func (provider *testAuthProvider) credentials(repoURL string) (*gitCredentials, error) {
+	provider.calls++
+	return provider.creds, provider.err
+}
+
+func TestGitAuthChains(t *testing.T) {
+	failing := &testAuthProvider{err: errors.New("unavailable")}
+	none := &testAuthProvider{}
+	found := &testAuthProvider{creds: &gitCredentials{username: "user", token: "token", source: "found"}}
+	chains := &gitAuthChains{
+		providers: map[string]gitAuthProvider{"failing": failing, "none": none, "found": found},
+		hosts:     map[string][]string{"github.com": {"failing", "none", "found"}, gitAuthAnyHost: {"none"}},
+	}
+
+	/* a failing provider is skipped */
+	creds, err := chains.resolve("https://GitHub.com/owner/repo")
+	if err != nil || creds.source != "found" || failing.calls != 1 || none.calls != 1 {
+		t.Fatalf("unexpected credentials %v: %v", creds, err)
+	}
+	/* the other hosts use the chain of * */
+	if _, err = chains.resolve("https://github.example.com/owner/repo"); err == nil || found.calls != 1 {
+		t.Fatalf("expected error resolving credentials of another host, got %v", err)
+	}
+	delete(chains.hosts, gitAuthAnyHost)
+	if _, err = chains.resolve("https://github.example.com/owner/repo"); err == nil || !strings.Contains(err.Error(), "no gitAuth providers") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestNewGitAuthChains(t *testing.T) {
+	chains, err := newGitAuthChains(&GitAuthDefinition{Providers: []*GitAuthProviderDefinition{
+		{Name: "env", Type: gitAuthEnv}, {Name: "secrets", Type: gitAuthSecrets}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := chains.chain("https://github.com/a/b"); strings.Join(names, ",") != "env,secrets" {
+		t.Fatalf("unexpected default chain %v", names)
+	}
+
+	for _, definition := range []*GitAuthDefinition{
+		{Providers: []*GitAuthProviderDefinition{{Name: "x", Type: "ldap"}}},
+		{Providers: []*GitAuthProviderDefinition{{Type: gitAuthEnv}}},
+		{Providers: []*GitAuthProviderDefinition{{Name: "x", Type: gitAuthEnv}, {Name: "x", Type: gitAuthSecrets}}},
+		{Providers: []*GitAuthProviderDefinition{{Name: "x", Type: gitAuthEnv}}, Hosts: []*GitAuthHost{{Host: "github.com", Providers: []string{"y"}}}},
+		{Providers: []*GitAuthProviderDefinition{{Name: "x", Type: gitAuthGitHubApp}}},
+		{Providers: []*GitAuthProviderDefinition{{Name: "x", Type: gitAuthVault, Address: "https://vault:8200"}}},
+	} {
+		if _, err := newGitAuthChains(definition); err == nil {
+			t.Errorf("expected error with definition %v", definition)
+		}
+	}
+}
+
+func TestRepositoryOwnerAndName(t *testing.T) {
+	if owner, name := repositoryOwnerAndName("https://github.com/owner/repo.git"); owner != "owner" || name != "repo" {
+		t.Fatalf("unexpected owner %v and name %v", owner, name)
+	}
+	if owner, name := repositoryOwnerAndName("https://github.com/owner"); owner != "owner" || name != "" {
+		t.Fatalf("unexpected owner %v and name %v", owner, name)
+	}
+}
+
+func TestGitHubAppAuthProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gitauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	tokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") || strings.Count(req.Header.Get("Authorization"), ".") != 2 {
+			http.Error(writer, "no JWT", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.Method == http.MethodGet && req.URL.Path == "/repos/owner/repo/installation":
+			writer.Write([]byte(`{"id": 42}`))
+		case req.Method == http.MethodPost && req.URL.Path == "/app/installations/42/access_tokens":
+			tokens++
+			json.NewEncoder(writer).Encode(map[string]interface{}{"token": "installation-token", "expires_at": time.Now().Add(time.Hour)})
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer server.Close()
+
+	provider, err := newGitHubAppAuthProvider(&GitAuthProviderDefinition{AppID: 7, PrivateKeyFile: keyFile, APIURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		creds, err := provider.credentials("https://github.com/owner/repo")
+		if err != nil || creds.username != githubAppUsername || creds.token != "installation-token" {
+			t.Fatalf("unexpected credentials %v: %v", creds, err)
+		}
+	}
+	if tokens != 1 {
+		t.Fatalf("the installation token was not cached: %v requests", tokens)
+	}
+	/* the App is not installed on the other repository */
+	if creds, err := provider.credentials("https://github.com/other/repo"); creds != nil || err != nil {
+		t.Fatalf("unexpected credentials %v: %v", creds, err)
+	}
+}
+
+func TestVaultAuthProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jwtFile := filepath.Join(dir, "jwt")
+	ioutil.WriteFile(jwtFile, []byte("service-account-jwt\n"), 0600)
+
+	logins := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			body := make(map[string]string)
+			json.NewDecoder(req.Body).Decode(&body)
+			if body["role"] != "events" || body["jwt"] != "service-account-jwt" {
+				http.Error(writer, "denied", http.StatusForbidden)
+				return
+			}
+			logins++
+			writer.Write([]byte(`{"auth": {"client_token": "vault-token", "lease_duration": 3600}}`))
+		case "/v1/secret/data/git/github.com/owner":
+			if req.Header.Get("X-Vault-Token") != "vault-token" {
+				http.Error(writer, "denied", http.StatusForbidden)
+				return
+			}
+			writer.Write([]byte(`{"data": {"data": {"username": "user", "token": "git-token"}}}`))
+		default:
+			http.NotFound(writer, req)
+		}
+	}))
+	defer server.Close()
+
+	provider, err := newVaultAuthProvider(&GitAuthProviderDefinition{Address: server.URL, Path: "secret/data/git/{{host}}/{{owner}}", Role: "events", JWTFile: jwtFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		creds, err := provider.credentials("https://github.com/owner/repo")
+		if err != nil || creds.username != "user" || creds.token != "git-token" || creds.source != "vault/secret/data/git/github.com/owner" {
+			t.Fatalf("unexpected credentials %v: %v", creds, err)
+		}
+	}
+	if logins != 1 {
+		t.Fatalf("the Vault token was not cached: %v logins", logins)
+	}
+	if creds, err := provider.credentials("https://github.com/other/repo"); creds != nil || err != nil {
+		t.Fatalf("unexpected credentials %v: %v", creds, err)
+	}
+}
+
+func TestWorkloadIdentityAuthProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("identity-token\n"), 0600)
+
+	provider, err := newWorkloadIdentityAuthProvider(&GitAuthProviderDefinition{TokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := provider.credentials("https://github.com/owner/repo"); err != nil || creds.token != "identity-token" {
+		t.Fatalf("unexpected credentials %v: %v", creds, err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("subject_token") != "identity-token" || req.Form.Get("audience") != "git" {
+			http.Error(writer, "denied", http.StatusBadRequest)
+			return
+		}
+		writer.Write([]byte(`{"access_token": "exchanged-token", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+	provider, err = newWorkloadIdentityAuthProvider(&GitAuthProviderDefinition{TokenFile: tokenFile, TokenURL: server.URL, Audience: "git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds, err := provider.credentials("https://github.com/owner/repo"); err != nil || creds.token != "exchanged-token" {
+		t.Fatalf("unexpected credentials %v: %v", creds, err)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"k8s.io/klog"
+)
+
+/*
+Trigger collections from Git. Instead of the URL of a Kabanero index, a collection may be given as a directory of a
+branch or tag of a GitHub or GitHub Enterprise repository, with a URL such as
+git+https://github.com/<owner>/<repo>?ref=<branch or tag>&path=<directory>. The archive of the ref is fetched through
+the GitHub API with the credentials of the repository, found as for the other repositories, by the gitAuth providers,
+or else anonymously, and the files of the directory are extracted as the collection. It is not verified against a
+checksum, since it is not packaged: the ref is trusted instead.
+*/
+
+const gitCollectionPrefix = "git+" // prefix of the URLs of trigger collections in Git
+
+/* A directory of a ref of a repository holding a trigger collection */
+type gitCollectionSource struct {
+	repoURL string // URL of the repository, such as https://github.com/owner/repo
+	apiURL  string // URL of the GitHub API of the host of the repository
+	owner   string
+	name    string
+	ref     string // branch or tag. The default branch if empty
+	path    string // directory of the collection in the repository. The root if empty
+}
+
+/* Return whether a collection URL is a directory of a Git repository rather than a Kabanero index */
+func isGitCollectionURL(collectionURL string) bool {
+	return strings.HasPrefix(collectionURL, gitCollectionPrefix)
+}
+
+/* Parse a git+https URL of a collection */
+func parseGitCollectionURL(collectionURL string) (*gitCollectionSource, error) {
+	parsed, err := url.Parse(strings.TrimPrefix(collectionURL, gitCollectionPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s of a trigger collection in Git: %v", redactURL(collectionURL), err)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("URL %s of a trigger collection in Git has no host", redactURL(collectionURL))
+	}
+	query := parsed.Query()
+	parsed.RawQuery, parsed.Fragment = "", ""
+	parsed.Path = strings.TrimSuffix(strings.TrimSuffix(parsed.Path, "/"), ".git")
+	source := &gitCollectionSource{repoURL: parsed.String(), ref: query.Get("ref"), path: strings.Trim(path.Clean("/"+query.Get("path")), "/")}
+	source.owner, source.name = repositoryOwnerAndName(source.repoURL)
+	if source.owner == "" || source.name == "" {
+		return nil, fmt.Errorf("URL %s of a trigger collection in Git has no owner and repository", redactURL(collectionURL))
+	}
+	source.apiURL, _ = gitHubAPIURL(parsed.Scheme + "://" + parsed.Host)
+	return source, nil
+}
+
+/* Return the description of a source, for logs and errors */
+func (source *gitCollectionSource) String() string {
+	description := source.repoURL
+	if source.ref != "" {
+		description += "@" + source.ref
+	}
+	if source.path != "" {
+		description += "/" + source.path
+	}
+	return description
+}
+
+/* Download a trigger collection from Git into a directory */
+func downloadGitCollection(collectionURL string, dir string) error {
+	source, err := parseGitCollectionURL(collectionURL)
+	if err != nil {
+		return err
+	}
+	if klog.V(5) {
+		klog.Infof("Entering downloadGitCollection %s, directory to store trigger: %s", source, dir)
+		defer klog.Infof("Leaving downloadGitCollection %s", source)
+	}
+
+	var transport http.RoundTripper = withUserAgent(nil)
+	username, token, credentialsSource, err := resolveGitCredentials(source.repoURL)
+	if err == nil {
+		klog.Infof("Fetching trigger collection %s with the credentials of %s", source, credentialsSource)
+		transport = &github.BasicAuthTransport{Username: username, Password: token, Transport: transport}
+	} else {
+		/* public repositories do not need credentials */
+		klog.Infof("Fetching trigger collection %s anonymously: %v", source, err)
+	}
+	client, err := github.NewEnterpriseClient(source.apiURL, source.apiURL, &http.Client{Transport: transport, Timeout: indexTimeout})
+	if err != nil {
+		return err
+	}
+	client.UserAgent = userAgent()
+
+	archiveURL, resp, err := client.Repositories.GetArchiveLink(context.Background(), source.owner, source.name, github.Tarball, &github.RepositoryContentGetOptions{Ref: source.ref})
+	if err != nil {
+		return gitHubCallError(resp, err, fmt.Sprintf("unable to get the archive of %s", source))
+	}
+	/* the archive link is signed, and does not need the credentials */
+	archiveClient := http.Client{Transport: withUserAgent(nil), Timeout: indexTimeout}
+	archive, err := archiveClient.Get(archiveURL.String())
+	if err != nil {
+		return fmt.Errorf("unable to download the archive of %s: %v", source, err)
+	}
+	defer archive.Body.Close()
+	if archive.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to download the archive of %s, http status: %s", source, archive.Status)
+	}
+	files, err := extractGitArchive(archive.Body, source.path, dir)
+	if err != nil {
+		return fmt.Errorf("unable to extract the archive of %s: %v", source, err)
+	}
+	if files == 0 {
+		return fmt.Errorf("trigger collection %s has no files", source)
+	}
+	klog.Infof("Fetched %v files of trigger collection %s", files, source)
+	return nil
+}
+
+/*
+Extract the files of a directory of the gzipped tar archive of a repository into a directory, returning their number.
+The entries of the archive are under a top directory named after the commit.
+*/
+func extractGitArchive(reader io.Reader, directory string, dir string) (int, error) {
+	gzReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return 0, err
+	}
+	tarReader := tar.NewReader(gzReader)
+	prefix := ""
+	if directory != "" {
+		prefix = directory + "/"
+	}
+	files := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		/* strip the top directory */
+		parts := strings.SplitN(header.Name, "/", 2)
+		if len(parts) < 2 || !strings.HasPrefix(parts[1], prefix) {
+			continue
+		}
+		relative := strings.TrimPrefix(parts[1], prefix)
+		if relative == "" {
+			continue
+		}
+		dest, err := mergePathWithErrorCheck(dir, relative)
+		if err != nil {
+			return files, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(dest, 0755); err != nil {
+				return files, fmt.Errorf("unable to make directory %s, error: %s", dest, err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return files, fmt.Errorf("unable to make directory %s, error: %s", filepath.Dir(dest), err)
+			}
+			file, err := os.OpenFile(dest, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+			if err != nil {
+				return files, fmt.Errorf("unable to create file %s, error: %s", dest, err)
+			}
+			_, err = io.Copy(file, tarReader)
+			closeErr := file.Close()
+			if err != nil {
+				return files, fmt.Errorf("unable to read file %s, error: %s", dest, err)
+			}
+			if closeErr != nil {
+				return files, fmt.Errorf("unable to close file %s, error: %s", dest, closeErr)
+			}
+			files++
+		default:
+			/* links and other entries are not part of a trigger collection */
+			if klog.V(5) {
+				klog.Infof("Skipping entry %s of type %v of the archive", header.Name, header.Typeflag)
+			}
+		}
+	}
+}
+
+/* Download the trigger collection of a Kabanero index, or of a directory of a Git repository, into a directory */
+func downloadCollection(collectionURL string, dir string) error {
+	if err := checkSignatureSupported(collectionURL); err != nil {
+		return err
+	}
+	if isGitCollectionURL(collectionURL) {
+		return downloadGitCollection(collectionURL, dir)
+	}
+	return downloadTrigger(collectionURL, dir)
+}
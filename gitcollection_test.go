@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* Return a gzipped tar archive of a repository, as served by GitHub */
+func testGitArchive(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	gzWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzWriter)
+	headers := []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "0123456789abcdef"}},
+		{Name: "owner-triggers-0123456/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "owner-triggers-0123456/collection/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "owner-triggers-0123456/collection/link.yaml", Typeflag: tar.TypeSymlink, Linkname: "../README.md"},
+	}
+	for _, header := range headers {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := tarWriter.WriteHeader(&tar.Header{Name: "owner-triggers-0123456/" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(content))
+	}
+	tarWriter.Close()
+	gzWriter.Close()
+	return buffer.Bytes()
+}
+
+func TestDownloadGitCollection(t *testing.T) {
+	savedAuth := gitAuth
+	defer func() { gitAuth = savedAuth }()
+	provider := &testAuthProvider{creds: &gitCredentials{username: "user", token: "token", source: "test"}}
+	gitAuth = &gitAuthChains{providers: map[string]gitAuthProvider{"test": provider}, hosts: map[string][]string{gitAuthAnyHost: {"test"}}}
+
+	archive := testGitArchive(t, map[string]string{
+		"README.md":                        "not part of the collection",
+		"collection/trigger.yaml":          "eventTriggers: []\n",
+		"collection/resources/config.yaml": "kind: ConfigMap\n",
+	})
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v3/repos/owner/triggers/tarball/main":
+			if username, token, ok := req.BasicAuth(); !ok || username != "user" || token != "token" {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.Redirect(writer, req, server.URL+"/archive/main.tar.gz?token=signed", http.StatusFound)
+		case "/archive/main.tar.gz":
+			writer.Write(archive)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gitcollection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	collectionURL := "git+" + server.URL + "/owner/triggers.git?ref=main&path=/collection/"
+	if !isGitCollectionURL(collectionURL) || isGitCollectionURL(server.URL+"/kabanero-index.yaml") {
+		t.Fatal("unexpected detection of collections in Git")
+	}
+	if err = downloadCollection(collectionURL, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{"trigger.yaml": true, "resources/config.yaml": true, "README.md": false, "link.yaml": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != expected {
+			t.Errorf("unexpected extraction of %v: %v", name, err)
+		}
+	}
+
+	/* a missing directory, or a ref that can not be read, are errors */
+	if err = downloadCollection("git+"+server.URL+"/owner/triggers?ref=main&path=missing", dir); err == nil {
+		t.Fatal("expected an error fetching a missing directory")
+	}
+	provider.creds = nil
+	if err = downloadCollection(collectionURL, dir); err == nil || retryHintOf(err) == nil {
+		t.Fatalf("unexpected error fetching without credentials: %v", err)
+	}
+	if _, err = parseGitCollectionURL("git+https://github.com/owner"); err == nil {
+		t.Fatal("expected an error parsing a URL without a repository")
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+
+	"k8s.io/klog"
+)
+
+/*
+Gitea and Gogs webhooks. Push and pull request events of the Gitea or Gogs webhooks received on /gitea are normalized
+into the message envelope of GitHub webhooks, which their payloads are already close to: the X-Github-Event header is
+set from X-Gitea-Event, or X-Gogs-Event, the login of the users is set from their username when missing, and
+head_commit and the GitHub pull_request actions are added to the body, so that existing triggers fire on the events of
+self-hosted Gitea and Gogs servers. The original fields are kept.
+*/
+
+const (
+	GITEASECRET = "GITEA_SECRET" // environment variable containing the secret used to sign Gitea and Gogs webhook requests
+
+	defaultGiteaMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,giteaAuth"
+)
+
+var giteaMiddleware string // comma separated middleware chain of the Gitea webhook endpoint
+
+/* GitHub event equivalent to each Gitea event */
+var giteaEventTypes = map[string]string{
+	"push":         "push",
+	"pull_request": "pull_request",
+}
+
+/* Headers of Gitea requests that are not passed on to triggers */
+var giteaSignatureHeaders = []string{"X-Gitea-Signature", "X-Gogs-Signature", "X-Hub-Signature", "X-Hub-Signature-256"}
+
+/*
+Middleware verifying the HMAC SHA256 signature of Gitea webhook requests in X-Gitea-Signature, or X-Gogs-Signature,
+with the secret in the environment variable GITEA_SECRET. Requests are not verified if the variable is not set.
+*/
+func giteaAuthMiddleware(next http.Handler) http.Handler {
+	return hmacVerifier{secretEnv: GITEASECRET, headers: []string{"X-Gitea-Signature", "X-Gogs-Signature"}, hash: sha256.New}.middleware(next)
+}
+
+/* HTTP listener of Gitea and Gogs webhooks */
+func giteaListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, err := normalizeGiteaEvent(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process Gitea webhook: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	if !allowRepositoryEvent(writer, req, bodyMap) {
+		return
+	}
+	logReceivedEvent(assignEventID(header), "Gitea listener received event", req.URL.Path, header, bodyMap)
+	respondWebhookMessage(writer, req, WEBHOOKDESTINATION, "", header, bodyMap)
+}
+
+/* Normalize the body of a Gitea or Gogs event in place into a GitHub event, and return its header */
+func normalizeGiteaEvent(giteaHeader http.Header, body map[string]interface{}) (http.Header, error) {
+	giteaEvent, delivery := giteaHeader.Get("X-Gitea-Event"), giteaHeader.Get("X-Gitea-Delivery")
+	if giteaEvent == "" {
+		giteaEvent, delivery = giteaHeader.Get("X-Gogs-Event"), giteaHeader.Get("X-Gogs-Delivery")
+	}
+	eventType, ok := giteaEventTypes[giteaEvent]
+	if !ok {
+		return nil, fmt.Errorf("unsupported Gitea event '%v'", giteaEvent)
+	}
+
+	header := make(http.Header)
+	for key, values := range giteaHeader {
+		header[key] = values
+	}
+	for _, key := range giteaSignatureHeaders {
+		header.Del(key)
+	}
+	header.Set("X-Github-Event", eventType)
+	if delivery != "" {
+		header.Set("X-Github-Delivery", delivery)
+	}
+
+	repository, _ := body["repository"].(map[string]interface{})
+	if repository == nil {
+		return nil, fmt.Errorf("Gitea %v event does not contain repository", giteaEvent)
+	}
+	setGiteaLogin(repository["owner"])
+	setGiteaLogin(body["sender"])
+
+	if eventType == "pull_request" {
+		normalizeGiteaPullRequest(body)
+	} else {
+		setGiteaLogin(body["pusher"])
+		if _, ok := body["head_commit"].(map[string]interface{}); !ok {
+			body["head_commit"] = giteaHeadCommit(body)
+		}
+	}
+	return header, nil
+}
+
+/* Set the login of a Gitea user from its username, as Gogs users may not have one */
+func setGiteaLogin(user interface{}) {
+	userMap, ok := user.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if login, _ := userMap["login"].(string); login == "" {
+		if username, ok := userMap["username"].(string); ok {
+			userMap["login"] = username
+		}
+	}
+}
+
+/* Return the head commit of a Gitea push: the commit pushed at its after commit, else only the ID of that commit */
+func giteaHeadCommit(body map[string]interface{}) map[string]interface{} {
+	after, _ := body["after"].(string)
+	commits, _ := body["commits"].([]interface{})
+	for _, commit := range commits {
+		if commitMap, ok := commit.(map[string]interface{}); ok && commitMap["id"] == after {
+			return commitMap
+		}
+	}
+	return map[string]interface{}{"id": after}
+}
+
+/* Add the fields of a GitHub pull_request event to a Gitea pull_request event */
+func normalizeGiteaPullRequest(body map[string]interface{}) {
+	if body["action"] == "synchronized" {
+		body["action"] = "synchronize"
+	}
+	pullRequest, _ := body["pull_request"].(map[string]interface{})
+	if pullRequest == nil {
+		return
+	}
+	setGiteaLogin(pullRequest["user"])
+	if _, ok := body["number"]; !ok {
+		body["number"] = pullRequest["number"]
+	}
+	for _, side := range []string{"head", "base"} {
+		branch, ok := pullRequest[side].(map[string]interface{})
+		if !ok {
+			/* Gogs pull requests have <side>_branch and <side>_repo, and no commit, for which the branch is used */
+			name, _ := pullRequest[side+"_branch"].(string)
+			branch = map[string]interface{}{"ref": name, "sha": name, "repo": pullRequest[side+"_repo"]}
+			pullRequest[side] = branch
+		}
+		if repo, ok := branch["repo"].(map[string]interface{}); ok {
+			setGiteaLogin(repo["owner"])
+		}
+	}
+	if merged, ok := pullRequest["has_merged"]; ok {
+		if _, exists := pullRequest["merged"]; !exists {
+			pullRequest["merged"] = merged
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeGiteaPush(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/gitea0/push.json")
+	header, err := normalizeGiteaEvent(http.Header{
+		"X-Gitea-Event":     {"push"},
+		"X-Gitea-Delivery":  {"d7a4b1c2-5e6f-4a8b-9c0d-1e2f3a4b5c6d"},
+		"X-Gitea-Signature": {"0123"},
+	}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "push" || header.Get("X-Github-Delivery") != "d7a4b1c2-5e6f-4a8b-9c0d-1e2f3a4b5c6d" || header.Get("X-Gitea-Signature") != "" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+
+	owner, name, htmlURL, ref, err := getRepositoryInfo(body, "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "kabanero-team" || name != "appsody-hello" || htmlURL != "https://gitea.example.com/kabanero-team/appsody-hello" || ref != "9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c" {
+		t.Fatalf("unexpected repository info: %v %v %v %v", owner, name, htmlURL, ref)
+	}
+	headCommit := body["head_commit"].(map[string]interface{})
+	if headCommit["id"] != ref || headCommit["message"] != "Update the stack version\n" {
+		t.Fatalf("unexpected head_commit: %v", headCommit)
+	}
+	if _, ok := body["compare_url"]; !ok {
+		t.Fatal("Gitea fields were not kept")
+	}
+}
+
+func TestNormalizeGogsPullRequest(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/gitea0/gogs_pull_request.json")
+	header, err := normalizeGiteaEvent(http.Header{"X-Gogs-Event": {"pull_request"}, "X-Gogs-Delivery": {"f1e2d3c4"}}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "pull_request" || header.Get("X-Github-Delivery") != "f1e2d3c4" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+
+	owner, name, htmlURL, ref, err := getRepositoryInfo(body, "pull_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "kabanero-team" || name != "appsody-hello" || htmlURL != "https://gogs.example.com/kabanero-team/appsody-hello" || ref != "stack-update" {
+		t.Fatalf("unexpected repository info: %v %v %v %v", owner, name, htmlURL, ref)
+	}
+	pullRequest := body["pull_request"].(map[string]interface{})
+	base := pullRequest["base"].(map[string]interface{})
+	if body["action"] != "synchronize" || body["sender"].(map[string]interface{})["login"] != "jdoe" || base["ref"] != "master" || pullRequest["merged"] != false {
+		t.Fatalf("unexpected pull_request: %v", body)
+	}
+
+	if _, err = normalizeGiteaEvent(http.Header{"X-Gitea-Event": {"issues"}}, map[string]interface{}{}); err == nil {
+		t.Fatal("expected error normalizing an unsupported event")
+	}
+	if _, err = normalizeGiteaEvent(http.Header{"X-Gitea-Event": {"push"}}, map[string]interface{}{}); err == nil {
+		t.Fatal("expected error normalizing an event without repository")
+	}
+}
+
+func TestGiteaAuthMiddleware(t *testing.T) {
+	os.Setenv(GITEASECRET, "secret")
+	defer os.Unsetenv(GITEASECRET)
+	handler := giteaAuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+
+	body := `{"ref":"refs/heads/master"}`
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(body))
+	valid := hex.EncodeToString(mac.Sum(nil))
+	for _, test := range []struct {
+		header, signature string
+		expected          int
+	}{
+		{"X-Gitea-Signature", valid, http.StatusOK},
+		{"X-Gogs-Signature", valid, http.StatusOK},
+		{"X-Gitea-Signature", "sha256=" + valid, http.StatusUnauthorized},
+		{"X-Gitea-Signature", "0123", http.StatusUnauthorized},
+		{"X-Hub-Signature-256", "sha256=" + valid, http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", "/gitea", strings.NewReader(body))
+		req.Header.Set(test.header, test.signature)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("%v '%v': status %v, expected %v", test.header, test.signature, recorder.Code, test.expected)
+		}
+	}
+}
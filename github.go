@@ -81,7 +81,7 @@ func NewGitHubEventListener(dynamicClient dynamic.Interface) (*GitHubListener, e
 	token := strings.TrimSpace(os.Getenv("GH_TOKEN"))
 
 	var err error
-	username, token, _, err = getURLAPIToken(dynamicClient, webhookNamespace, githubURL)
+	username, token, _, err = resolveGitCredentials(githubURL)
 
 	if err != nil {
 		return nil, err
@@ -110,6 +110,7 @@ func NewGitHubEventListener(dynamicClient dynamic.Interface) (*GitHubListener, e
 	if err != nil {
 		return nil, err
 	}
+	client.UserAgent = userAgent()
 
 	listener := new(GitHubListener)
 	listener.DynamicClient = dynamicClient
@@ -164,6 +165,10 @@ func (listener *GitHubListener) GetFile(ghURL, owner, repo, path string) (string
 	} else {
 		client, err = github.NewEnterpriseClient("https://api."+ghURL, ghURL, tp.Client())
 	}
+	if err != nil {
+		return "", err
+	}
+	client.UserAgent = userAgent()
 
 	rc, err := client.Repositories.DownloadContents(context.Background(), owner, repo, path, nil)
 	if err != nil {
@@ -0,0 +1,196 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+GitLab webhooks. Push, tag push, and merge request events received on /gitlab are normalized into the message
+envelope of GitHub webhooks, so that existing triggers fire on GitLab events: the X-Github-Event header is set to the
+equivalent GitHub event, and the GitHub fields used by triggers, such as repository.full_name, are added to the
+body. The original GitLab fields, such as object_kind and checkout_sha, are kept.
+*/
+
+/* GitHub event equivalent to each GitLab object_kind */
+var gitlabEventTypes = map[string]string{
+	"push":          "push",
+	"tag_push":      "push",
+	"merge_request": "pull_request",
+}
+
+/* GitHub pull_request action equivalent to each GitLab merge request action */
+var gitlabMergeRequestActions = map[string]string{
+	"open":   "opened",
+	"reopen": "reopened",
+	"update": "synchronize",
+	"close":  "closed",
+	"merge":  "closed",
+}
+
+/* Middleware authenticating GitLab webhook requests with the secret token in X-Gitlab-Token */
+func gitlabAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		token := os.Getenv(GITLABTOKEN)
+		if token == "" {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("X-Gitlab-Token")), []byte(token)) != 1 {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeInvalidToken, "invalid token")
+			return
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* HTTP listener of GitLab webhooks */
+func gitlabListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, err := normalizeGitLabEvent(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process GitLab webhook: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	if !allowRepositoryEvent(writer, req, bodyMap) {
+		return
+	}
+	logReceivedEvent(assignEventID(header), "GitLab listener received event", req.URL.Path, header, bodyMap)
+	respondWebhookMessage(writer, req, WEBHOOKDESTINATION, "", header, bodyMap)
+}
+
+/* Normalize the body of a GitLab event in place into a GitHub event, and return its header */
+func normalizeGitLabEvent(gitlabHeader http.Header, body map[string]interface{}) (http.Header, error) {
+	objectKind, _ := body["object_kind"].(string)
+	eventType, ok := gitlabEventTypes[objectKind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported GitLab object_kind '%v'", objectKind)
+	}
+
+	header := make(http.Header)
+	for key, values := range gitlabHeader {
+		if http.CanonicalHeaderKey(key) == "X-Gitlab-Token" {
+			/* secrets are not passed on to triggers */
+			continue
+		}
+		header[key] = values
+	}
+	header.Set("X-Github-Event", eventType)
+	if uuid := gitlabHeader.Get("X-Gitlab-Event-Uuid"); uuid != "" && header.Get("X-Github-Delivery") == "" {
+		header.Set("X-Github-Delivery", uuid)
+	}
+
+	project, _ := body["project"].(map[string]interface{})
+	if project == nil {
+		return nil, fmt.Errorf("GitLab %v event does not contain project", objectKind)
+	}
+	body["repository"] = gitlabRepository(project, body["repository"])
+
+	if objectKind == "merge_request" {
+		normalizeGitLabMergeRequest(body)
+	} else {
+		if username, ok := body["user_username"].(string); ok {
+			body["sender"] = map[string]interface{}{"login": username}
+		}
+		if sha, ok := body["checkout_sha"].(string); ok {
+			body["head_commit"] = map[string]interface{}{"id": sha}
+		}
+	}
+	return header, nil
+}
+
+/* Return the repository of a GitLab project, with the fields of a GitHub repository added */
+func gitlabRepository(project map[string]interface{}, existing interface{}) map[string]interface{} {
+	repository, _ := existing.(map[string]interface{})
+	if repository == nil {
+		repository = make(map[string]interface{})
+	}
+	fullName, _ := project["path_with_namespace"].(string)
+	repository["full_name"] = fullName
+	/* the owner of projects in subgroups, such as group/subgroup/project, is the full path of the subgroup */
+	if slash := strings.LastIndex(fullName, "/"); slash > 0 {
+		repository["name"] = fullName[slash+1:]
+		repository["owner"] = map[string]interface{}{"login": fullName[:slash]}
+	}
+	if webURL, ok := project["web_url"].(string); ok {
+		repository["html_url"] = webURL
+	}
+	if cloneURL, ok := project["git_http_url"].(string); ok {
+		repository["clone_url"] = cloneURL
+	}
+	if sshURL, ok := project["git_ssh_url"].(string); ok {
+		repository["ssh_url"] = sshURL
+	}
+	if branch, ok := project["default_branch"].(string); ok {
+		repository["default_branch"] = branch
+	}
+	return repository
+}
+
+/* Add the fields of a GitHub pull_request event to a GitLab merge request event */
+func normalizeGitLabMergeRequest(body map[string]interface{}) {
+	attributes, _ := body["object_attributes"].(map[string]interface{})
+	if attributes == nil {
+		attributes = make(map[string]interface{})
+	}
+	gitlabAction, _ := attributes["action"].(string)
+	body["action"] = gitlabMergeRequestActions[gitlabAction]
+	if user, ok := body["user"].(map[string]interface{}); ok {
+		body["sender"] = map[string]interface{}{"login": user["username"]}
+	}
+
+	state, _ := attributes["state"].(string)
+	switch state {
+	case "opened":
+		state = "open"
+	case "merged":
+		state = "closed"
+	}
+	head := map[string]interface{}{"ref": attributes["source_branch"]}
+	if lastCommit, ok := attributes["last_commit"].(map[string]interface{}); ok {
+		head["sha"] = lastCommit["id"]
+	}
+	if source, ok := attributes["source"].(map[string]interface{}); ok {
+		head["repo"] = gitlabRepository(source, nil)
+	}
+	base := map[string]interface{}{"ref": attributes["target_branch"]}
+	if target, ok := attributes["target"].(map[string]interface{}); ok {
+		base["repo"] = gitlabRepository(target, nil)
+	}
+	body["number"] = attributes["iid"]
+	body["pull_request"] = map[string]interface{}{
+		"number":   attributes["iid"],
+		"title":    attributes["title"],
+		"state":    state,
+		"html_url": attributes["url"],
+		"merged":   attributes["state"] == "merged",
+		"head":     head,
+		"base":     base,
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func readGitLabEvent(t *testing.T, fileName string) map[string]interface{} {
+	bytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make(map[string]interface{})
+	if err = json.Unmarshal(bytes, &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestNormalizeGitLabPush(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/gitlab0/push.json")
+	gitlabHeader := http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Token": {"secret"}, "X-Gitlab-Event-Uuid": {"4f3c2a"}}
+	header, err := normalizeGitLabEvent(gitlabHeader, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "push" || header.Get("X-Gitlab-Event") != "Push Hook" || header.Get("X-Github-Delivery") != "4f3c2a" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	if header.Get("X-Gitlab-Token") != "" {
+		t.Fatal("the GitLab token was passed on")
+	}
+
+	owner, name, htmlURL, ref, err := getRepositoryInfo(body, "push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "mike" || name != "diaspora" || htmlURL != "http://example.com/mike/diaspora" || ref != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" {
+		t.Fatalf("unexpected repository info: %v %v %v %v", owner, name, htmlURL, ref)
+	}
+	message := map[string]interface{}{BODY: body}
+	if messageRepositoryName(message) != "mike/diaspora" {
+		t.Fatalf("unexpected repository name %v", messageRepositoryName(message))
+	}
+	if body["object_kind"] != "push" || body["repository"].(map[string]interface{})["homepage"] != "http://example.com/mike/diaspora" {
+		t.Fatal("GitLab fields were not kept")
+	}
+}
+
+func TestNormalizeGitLabMergeRequest(t *testing.T) {
+	body := readGitLabEvent(t, "test_data/gitlab0/merge_request.json")
+	header, err := normalizeGitLabEvent(http.Header{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != "pull_request" || body["action"] != "opened" {
+		t.Fatalf("unexpected event %v, action %v", header.Get("X-Github-Event"), body["action"])
+	}
+	_, name, _, ref, err := getRepositoryInfo(body, "pull_request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "gitlab-test" || ref != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" {
+		t.Fatalf("unexpected repository info: %v %v", name, ref)
+	}
+	pr := body["pull_request"].(map[string]interface{})
+	if pr["state"] != "open" || pr["head"].(map[string]interface{})["ref"] != "ms-viewport" || pr["base"].(map[string]interface{})["ref"] != "master" {
+		t.Fatalf("unexpected pull_request: %v", pr)
+	}
+
+	if _, err = normalizeGitLabEvent(http.Header{}, map[string]interface{}{"object_kind": "note"}); err == nil {
+		t.Fatal("expected error normalizing an unsupported event")
+	}
+}
+
+func TestGitLabAuthMiddleware(t *testing.T) {
+	os.Setenv(GITLABTOKEN, "secret")
+	defer os.Unsetenv(GITLABTOKEN)
+	handler := gitlabAuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+
+	for token, expected := range map[string]int{"secret": http.StatusOK, "wrong": http.StatusUnauthorized, "": http.StatusUnauthorized} {
+		req := httptest.NewRequest("POST", "/gitlab", nil)
+		if token != "" {
+			req.Header.Set("X-Gitlab-Token", token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != expected {
+			t.Errorf("token '%v': status %v, expected %v", token, recorder.Code, expected)
+		}
+	}
+}
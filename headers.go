@@ -0,0 +1,127 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+/* headers for correlating requests */
+const (
+	REQUESTIDHEADER = "X-Request-Id"
+)
+
+const maxRequestIDLength = 128
+
+/* Headers added to every response. None of the endpoints serve content meant for a browser. */
+var securityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	"Referrer-Policy":         "no-referrer",
+	"Cache-Control":           "no-store",
+}
+
+/* Headers that identify the server, removed from every response */
+var serverIdentificationHeaders = []string{"Server", "X-Powered-By"}
+
+/* A response writer that removes the server identification headers before the headers are written */
+type headerStripper struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (stripper *headerStripper) Unwrap() http.ResponseWriter {
+	return stripper.ResponseWriter
+}
+
+func (stripper *headerStripper) WriteHeader(status int) {
+	if !stripper.wroteHeader {
+		stripper.wroteHeader = true
+		for _, name := range serverIdentificationHeaders {
+			stripper.ResponseWriter.Header().Del(name)
+		}
+	}
+	stripper.ResponseWriter.WriteHeader(status)
+}
+
+func (stripper *headerStripper) Write(buf []byte) (int, error) {
+	if !stripper.wroteHeader {
+		stripper.WriteHeader(http.StatusOK)
+	}
+	return stripper.ResponseWriter.Write(buf)
+}
+
+func (stripper *headerStripper) Flush() {
+	if flusher, ok := stripper.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/* Add the security headers to responses, and remove headers identifying the server */
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		header := writer.Header()
+		for name, value := range securityHeaders {
+			header.Set(name, value)
+		}
+		if req.TLS != nil {
+			header.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		next.ServeHTTP(&headerStripper{ResponseWriter: writer}, req)
+	})
+}
+
+/* Return whether a request ID received from a client is safe to log and echo */
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+/* Generate a random request ID */
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+/*
+Propagate the X-Request-Id of the request, or generate one if it has none, and echo it in the response. The ID is kept in
+the request header, so that it is logged and is part of the webhook message sent to the message provider.
+*/
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(REQUESTIDHEADER)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		req.Header.Set(REQUESTIDHEADER, id)
+		writer.Header().Set(REQUESTIDHEADER, id)
+		next.ServeHTTP(writer, req)
+	})
+}
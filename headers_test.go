@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	var received string
+	handler, err := chainMiddleware("requestID,securityHeaders", http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		received = req.Header.Get(REQUESTIDHEADER)
+		writer.Header().Set("Server", "kabanero-events")
+		writer.Write([]byte("ok"))
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* a valid request ID is propagated */
+	req := httptest.NewRequest("POST", "/webhook", nil)
+	req.Header.Set(REQUESTIDHEADER, "abc-123")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if received != "abc-123" || recorder.Header().Get(REQUESTIDHEADER) != "abc-123" {
+		t.Fatalf("request ID not propagated: received %v, echoed %v", received, recorder.Header().Get(REQUESTIDHEADER))
+	}
+	if recorder.Header().Get("X-Content-Type-Options") != "nosniff" || recorder.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("security headers missing: %v", recorder.Header())
+	}
+	if recorder.Header().Get("Server") != "" {
+		t.Fatalf("server identification not removed: %v", recorder.Header().Get("Server"))
+	}
+
+	/* an invalid request ID is replaced */
+	req = httptest.NewRequest("POST", "/webhook", nil)
+	req.Header.Set(REQUESTIDHEADER, "bad id\n"+strings.Repeat("x", 200))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	echoed := recorder.Header().Get(REQUESTIDHEADER)
+	if len(echoed) != 32 || echoed != received {
+		t.Fatalf("invalid request ID not replaced: received %v, echoed %v", received, echoed)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Health and readiness probes, served without authentication on the webhook listener. GET /healthz, for the liveness
+probe, checks that the active trigger collection is loaded and that the connections of the message providers are up.
+GET /readyz, for the readiness probe, also checks that the listeners of the event destinations are started, that the
+Kubernetes API server is reachable, with -validateTokens, that the git API tokens are valid, and, with
+-heartbeatInterval, that the heartbeats complete. Both return 503 with the failed checks when degraded.
+*/
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+var (
+	healthTimeout    time.Duration // maximum time to reach the Kubernetes API server
+	listenersStarted bool          // whether the listeners of the event destinations are started
+
+	/* check that the Kubernetes API server is reachable. Replaced in tests */
+	kubeAPIHealth = func(ctx context.Context) error {
+		if discClient == nil {
+			return fmt.Errorf("no Kubernetes client")
+		}
+		return discClient.RESTClient().Get().AbsPath("/version").Context(ctx).Do().Error()
+	}
+)
+
+/* A message provider that knows whether its connection is up */
+type healthReporter interface {
+	health() error
+}
+
+/* The response of a probe */
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+/* Return the health of a message provider. Providers that do not report their health are assumed healthy */
+func providerHealth(provider MessageProvider) error {
+	if reporter, ok := provider.(healthReporter); ok {
+		return reporter.health()
+	}
+	return nil
+}
+
+func (provider *natsProvider) health() error {
+	if provider.connection == nil {
+		return fmt.Errorf("not connected")
+	}
+	switch provider.connection.Status() {
+	case nats.CONNECTED:
+		return nil
+	case nats.RECONNECTING:
+		return fmt.Errorf("reconnecting to %v", provider.messageProviderDefinition.URL)
+	case nats.CLOSED:
+		return fmt.Errorf("connection closed")
+	default:
+		return fmt.Errorf("disconnected")
+	}
+}
+
+/* A failover provider is healthy as long as one of its backends is */
+func (provider *failoverProvider) health() error {
+	now := time.Now()
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	for _, name := range provider.messageProviderDefinition.Backends {
+		if failedAt, failed := provider.failedAt[name]; !failed || now.Sub(failedAt) >= provider.retryInterval {
+			return nil
+		}
+	}
+	return fmt.Errorf("all backends failed")
+}
+
+/* Providers wrapping others report the health of the provider they wrap */
+func (sp *signingProvider) health() error {
+	return providerHealth(sp.MessageProvider)
+}
+
+func (cp *cloudEventsProvider) health() error {
+	return providerHealth(cp.MessageProvider)
+}
+
+/* Check that the Kubernetes API server is reachable within -healthTimeout. The request is cancelled at the deadline */
+func checkKubeAPI(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := kubeAPIHealth(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("no response within %v", timeout)
+	}
+	return err
+}
+
+/* Run the checks of a probe. The readiness probe also checks the listeners and the Kubernetes API */
+func checkHealth(readiness bool) *healthReport {
+	report := &healthReport{Status: healthOK, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		report.Checks[name] = healthOK
+		if err != nil {
+			report.Checks[name] = err.Error()
+			report.Status = healthDegraded
+		}
+	}
+
+	triggerProc, _, _ := currentCollections()
+	if triggerProc == nil || triggerProc.triggerDef == nil {
+		check("triggers", fmt.Errorf("trigger collection is not loaded"))
+	} else {
+		check("triggers", nil)
+	}
+	messageProvidersMutex.RLock()
+	providers := make(map[string]MessageProvider, len(messageProviders))
+	names := make([]string, 0, len(messageProviders))
+	for name, provider := range messageProviders {
+		providers[name] = provider
+		names = append(names, name)
+	}
+	messageProvidersMutex.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		check("provider/"+name, providerHealth(providers[name]))
+	}
+	if readiness {
+		if !listenersStarted {
+			check("listeners", fmt.Errorf("listeners are not started"))
+		} else {
+			check("listeners", nil)
+		}
+		check("kubernetes", checkKubeAPI(healthTimeout))
+		if validateTokens {
+			check("tokens", tokensHealth())
+		}
+		if heartbeatInterval > 0 {
+			check("heartbeat", heartbeatHealth())
+		}
+	}
+	return report
+}
+
+/* Write the report of a probe, with 503 if degraded */
+func writeHealthReport(writer http.ResponseWriter, req *http.Request, readiness bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	report := checkHealth(readiness)
+	if report.Status != healthOK {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(writer, report)
+}
+
+/* GET /healthz is the liveness probe */
+func healthzHandler(writer http.ResponseWriter, req *http.Request) {
+	writeHealthReport(writer, req, false)
+}
+
+/* GET /readyz is the readiness probe */
+func readyzHandler(writer http.ResponseWriter, req *http.Request) {
+	writeHealthReport(writer, req, true)
+}
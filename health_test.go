@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, handler http.HandlerFunc, path string) (int, *healthReport) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	report := &healthReport{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), report); err != nil {
+		t.Fatalf("%v returned %s: %v", path, recorder.Body.String(), err)
+	}
+	return recorder.Code, report
+}
+
+func TestHealthProbes(t *testing.T) {
+	savedProviders, savedProc, savedStarted, savedKube, savedTimeout := messageProviders, triggerProc, listenersStarted, kubeAPIHealth, healthTimeout
+	defer func() {
+		messageProviders, triggerProc, listenersStarted, kubeAPIHealth, healthTimeout = savedProviders, savedProc, savedStarted, savedKube, savedTimeout
+	}()
+	failover := &failoverProvider{}
+	if err := failover.initialize(&MessageProviderDefinition{Name: "brokers", Backends: []string{"primary", "secondary"}, RetryInterval: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	messageProviders = map[string]MessageProvider{"brokers": failover, "capture": &capturingProvider{}}
+	triggerProc = &triggerProcessor{triggerDef: &eventTriggerDefinition{}}
+	listenersStarted = false
+	kubeAPIHealth = func(ctx context.Context) error { return nil }
+	healthTimeout = 50 * time.Millisecond
+
+	if code, report := probe(t, healthzHandler, "/healthz"); code != http.StatusOK || report.Status != healthOK || report.Checks["provider/brokers"] != healthOK {
+		t.Fatalf("healthz returned %v: %+v", code, report)
+	}
+	/* not ready until the listeners are started */
+	if code, report := probe(t, readyzHandler, "/readyz"); code != http.StatusServiceUnavailable || report.Checks["listeners"] == healthOK {
+		t.Fatalf("readyz returned %v before the listeners started: %+v", code, report)
+	}
+	listenersStarted = true
+	if code, report := probe(t, readyzHandler, "/readyz"); code != http.StatusOK {
+		t.Fatalf("readyz returned %v: %+v", code, report)
+	}
+
+	/* an unreachable Kubernetes API de-routes the pod, without failing the liveness probe */
+	/* the request is cancelled at the deadline, rather than left running */
+	kubeAPIHealth = func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+	if code, report := probe(t, readyzHandler, "/readyz"); code != http.StatusServiceUnavailable || report.Checks["kubernetes"] == healthOK {
+		t.Fatalf("readyz returned %v with an unreachable Kubernetes API: %+v", code, report)
+	}
+	if code, _ := probe(t, healthzHandler, "/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz returned %v with an unreachable Kubernetes API", code)
+	}
+
+	/* a provider whose backends are all down fails both probes */
+	failover.markFailed("primary", fmt.Errorf("down"))
+	failover.markFailed("secondary", fmt.Errorf("down"))
+	if code, report := probe(t, healthzHandler, "/healthz"); code != http.StatusServiceUnavailable || report.Checks["provider/brokers"] == healthOK || report.Checks["provider/capture"] != healthOK {
+		t.Fatalf("healthz returned %v with a failed provider: %+v", code, report)
+	}
+	triggerProc = nil
+	if _, report := probe(t, healthzHandler, "/healthz"); report.Checks["triggers"] == healthOK {
+		t.Fatalf("healthz reported unloaded triggers as ok: %+v", report)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Heartbeats. With -heartbeatInterval, a synthetic event is posted periodically to a webhook path of the listener, through
+its middleware and handler, is sent to the eventDestination of the path, and is expected to come back from the broker
+through the listener of the destination, where it is evaluated against the no-op trigger of the self-test. A pipeline
+that is wedged, such as a listener that stopped receiving without its connection dropping, is detected even though the
+health probes pass: after -heartbeatFailures consecutive heartbeats do not complete within -heartbeatTimeout, the
+heartbeat.stalled gauge is set to 1 and the heartbeat check of the readiness probe fails.
+*/
+
+var (
+	heartbeatInterval time.Duration // interval of the heartbeats. Disabled if 0
+	heartbeatTimeout  time.Duration // maximum time for a heartbeat to complete
+	heartbeatFailures int           // consecutive failed heartbeats after which the pipeline is stalled
+	heartbeatPath     string        // webhook path the heartbeats are posted to. The first path if empty
+
+	heartbeatMutex  sync.Mutex
+	heartbeatMux    http.Handler   // the handlers of the listener, once it is started
+	heartbeatTarget *ListenerPath  // the path the heartbeats are posted to
+	heartbeatStatus heartbeatState // the outcome of the last heartbeats
+)
+
+/* The outcome of the last heartbeats */
+type heartbeatState struct {
+	lastCompleted time.Time
+	failures      int // consecutive failed heartbeats
+	lastError     error
+}
+
+/* Record the handlers and paths of the listener, so that heartbeats may be posted to them */
+func setHeartbeatListener(mux http.Handler, paths []*ListenerPath) {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	heartbeatMux = mux
+	heartbeatTarget = nil
+	for _, path := range paths {
+		if path.Path == heartbeatPath || (heartbeatPath == "" && heartbeatTarget == nil) {
+			heartbeatTarget = path
+		}
+	}
+}
+
+/* A response writer remembering the status of the response to a heartbeat */
+type heartbeatResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (response *heartbeatResponse) Header() http.Header { return response.header }
+
+func (response *heartbeatResponse) Write(data []byte) (int, error) {
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	return response.body.Write(data)
+}
+
+func (response *heartbeatResponse) WriteHeader(status int) {
+	if response.status == 0 {
+		response.status = status
+	}
+}
+
+/* Post a heartbeat to the listener, and wait for it to come back through the destination of its path */
+func sendHeartbeat(timeout time.Duration) (time.Duration, error) {
+	heartbeatMutex.Lock()
+	mux, target := heartbeatMux, heartbeatTarget
+	heartbeatMutex.Unlock()
+	if mux == nil {
+		return 0, fmt.Errorf("the listener is not started")
+	}
+	if target == nil {
+		return 0, fmt.Errorf("the listener has no webhook path %v", heartbeatPath)
+	}
+	if !isSelfTestListening(target.Destination) {
+		return 0, fmt.Errorf("no listener is running for eventDestination '%s' of path %s", target.Destination, target.Path)
+	}
+
+	id := newRequestID()
+	body, err := json.Marshal(map[string]interface{}{
+		"selftest": map[string]interface{}{"id": id, "destination": target.Destination, "heartbeat": true},
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, target.Path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Github-Event", "heartbeat")
+	req.Header.Set(REQUESTIDHEADER, id)
+	req.Header.Set(selfTestHeader, id)
+	/* the heartbeat is authenticated like the webhooks of the path */
+	if secret := os.Getenv(WEBHOOKSECRET); secret != "" {
+		mac := hmac.New(sha1.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature", "sha1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	probe, remove := addSelfTestProbe(id)
+	defer remove()
+	start := time.Now()
+	response := &heartbeatResponse{header: make(http.Header)}
+	mux.ServeHTTP(response, req)
+	if response.status >= http.StatusBadRequest {
+		return 0, fmt.Errorf("the listener rejected the heartbeat with %v: %s", response.status, bytes.TrimSpace(response.body.Bytes()))
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case arrival := <-probe:
+		return arrival.received.Sub(start) + arrival.trigger, arrival.err
+	case <-timer.C:
+		return 0, fmt.Errorf("heartbeat did not complete within %v", timeout)
+	}
+}
+
+/* Record the outcome of a heartbeat in the state and the metrics */
+func recordHeartbeat(latency time.Duration, err error, now time.Time) {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	incrementMetric("heartbeat.sent")
+	if err != nil {
+		incrementMetric("heartbeat.failures")
+		heartbeatStatus.failures++
+		heartbeatStatus.lastError = err
+		if heartbeatStatus.failures == heartbeatFailures {
+			klog.Errorf("Event pipeline stalled: the last %v heartbeats did not complete: %v", heartbeatStatus.failures, err)
+		} else {
+			klog.Warningf("Heartbeat failed: %v", err)
+		}
+	} else {
+		incrementMetric("heartbeat.completed")
+		if heartbeatStatus.failures >= heartbeatFailures {
+			klog.Infof("Event pipeline recovered after %v failed heartbeats", heartbeatStatus.failures)
+		}
+		heartbeatStatus = heartbeatState{lastCompleted: now}
+		setMetric("heartbeat.latencyMillis", latency.Nanoseconds()/int64(time.Millisecond))
+		setMetric("heartbeat.lastCompleted", now.Unix())
+		if klog.V(4) {
+			klog.Infof("Heartbeat completed in %v", latency)
+		}
+	}
+	stalled := int64(0)
+	if heartbeatStatus.failures >= heartbeatFailures {
+		stalled = 1
+	}
+	setMetric("heartbeat.stalled", stalled)
+}
+
+/* The heartbeat check of the readiness probe */
+func heartbeatHealth() error {
+	heartbeatMutex.Lock()
+	defer heartbeatMutex.Unlock()
+	if heartbeatStatus.failures < heartbeatFailures {
+		return nil
+	}
+	return fmt.Errorf("the last %v heartbeats did not complete: %v", heartbeatStatus.failures, heartbeatStatus.lastError)
+}
+
+/* Send the heartbeats every -heartbeatInterval */
+func runHeartbeats() {
+	if heartbeatInterval <= 0 {
+		return
+	}
+	if heartbeatFailures < 1 {
+		heartbeatFailures = 1
+	}
+	klog.Infof("Sending heartbeats every %v", heartbeatInterval)
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		latency, err := sendHeartbeat(heartbeatTimeout)
+		recordHeartbeat(latency, err, time.Now())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	broker := newBrokerProvider()
+	savedProviders, savedDefinitions, savedMux, savedTarget, savedPath := messageProviders, eventProviders, heartbeatMux, heartbeatTarget, heartbeatPath
+	defer func() {
+		messageProviders, eventProviders, heartbeatMux, heartbeatTarget, heartbeatPath = savedProviders, savedDefinitions, savedMux, savedTarget, savedPath
+	}()
+	messageProviders = map[string]MessageProvider{"broker": broker}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: "github", ProviderRef: "broker"}}}
+
+	if _, err := sendHeartbeat(time.Second); err == nil {
+		t.Fatal("heartbeat completed before the listener was started")
+	}
+
+	heartbeatPath = ""
+	paths := []*ListenerPath{{Path: "/webhook", Destination: "github"}, {Path: "/other", Destination: "other"}}
+	mux := http.NewServeMux()
+	for _, path := range paths {
+		if err := handleWithMiddleware(mux, path.Path, "recovery,requestID", webhookHandler(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setHeartbeatListener(mux, paths)
+	if heartbeatTarget.Path != "/webhook" {
+		t.Fatalf("unexpected heartbeat path %v", heartbeatTarget.Path)
+	}
+
+	go messageListener(broker, eventProviders.EventDestinations[0], nil)
+	defer broker.setDown(true)
+	waitFor(t, func() bool { return isSelfTestListening("github") })
+
+	latency, err := sendHeartbeat(time.Second)
+	if err != nil || latency <= 0 {
+		t.Fatalf("heartbeat returned %v: %v", latency, err)
+	}
+
+	/* the heartbeats of a path without a running listener do not complete */
+	heartbeatPath = "/other"
+	setHeartbeatListener(mux, paths)
+	if _, err = sendHeartbeat(100 * time.Millisecond); err == nil {
+		t.Fatal("heartbeat completed without a listener of the destination")
+	}
+}
+
+func TestRecordHeartbeat(t *testing.T) {
+	savedStatus, savedFailures := heartbeatStatus, heartbeatFailures
+	defer func() { heartbeatStatus, heartbeatFailures = savedStatus, savedFailures }()
+	heartbeatStatus, heartbeatFailures = heartbeatState{}, 2
+
+	now := time.Now()
+	recordHeartbeat(0, errors.New("timed out"), now)
+	if err := heartbeatHealth(); err != nil || metrics.Get("heartbeat.stalled").String() != "0" {
+		t.Fatalf("pipeline stalled after one failure: %v", err)
+	}
+	recordHeartbeat(0, errors.New("timed out"), now)
+	if err := heartbeatHealth(); err == nil || metrics.Get("heartbeat.stalled").String() != "1" {
+		t.Fatal("pipeline did not stall after two failures")
+	}
+	recordHeartbeat(time.Millisecond, nil, now)
+	if err := heartbeatHealth(); err != nil || metrics.Get("heartbeat.stalled").String() != "0" || !heartbeatStatus.lastCompleted.Equal(now) {
+		t.Fatalf("pipeline did not recover: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+/*
+Pipeline hooks. Distributions of kabanero-events may inspect, change, or veto the events at the stages of the
+pipeline without changing it:
+  - OnReceive: a webhook message, as received by a listener, before it is sent to its eventDestination.
+  - PreRoute: a webhook message about to be sent. Hooks may change its eventDestination.
+  - PreTriggerEval: a message received from an event source, before its triggers are evaluated.
+  - PreApply: a resource rendered by a trigger, before it is checked by the resource policies and created.
+  - PostDeliver: a message sent to an eventDestination. Hooks of this stage can not veto.
+Hooks change the message or resource of the event in place. A hook returning an error vetoes the event: a webhook
+message is rejected with the vetoed code, a message of an event source is dropped, and the applyResources of a
+resource fails. Hooks are compiled in, registered with registerPipelineHook from an init function, or are executables
+of -pipelineHooks that read the event as JSON on stdin, and may write the changed event as JSON on stdout. A non-zero
+exit status vetoes the event, with the first line of stderr as the reason.
+*/
+
+const (
+	stageOnReceive      = "OnReceive"      // webhook message received by a listener
+	stagePreRoute       = "PreRoute"       // webhook message about to be sent to its eventDestination
+	stagePreTriggerEval = "PreTriggerEval" // message of an event source, before its triggers are evaluated
+	stagePreApply       = "PreApply"       // resource rendered by a trigger, before it is checked and created
+	stagePostDeliver    = "PostDeliver"    // message sent to an eventDestination
+)
+
+var pipelineStages = []string{stageOnReceive, stagePreRoute, stagePreTriggerEval, stagePreApply, stagePostDeliver}
+
+var (
+	pipelineHooksFlag   string        // comma separated stage=executable hooks
+	pipelineHookTimeout time.Duration // maximum duration of a call of an executable hook
+)
+
+/* An event at a stage of the pipeline */
+type pipelineEvent struct {
+	stage       string
+	eventID     string
+	source      string                     // listener path of OnReceive, event source of PreTriggerEval
+	destination string                     // eventDestination of PreRoute and PostDeliver. May be changed by PreRoute hooks
+	message     map[string]interface{}     // message with header and body. nil for PreApply
+	resource    *unstructured.Unstructured // resource of PreApply
+	trigger     string                     // trigger and collection of the resource of PreApply
+	collection  string
+}
+
+/* A hook of a stage. Returning an error vetoes the event */
+type pipelineHook func(event *pipelineEvent) error
+
+type namedPipelineHook struct {
+	name string
+	hook pipelineHook
+}
+
+var (
+	pipelineHooksMutex sync.RWMutex
+	pipelineHooks      = make(map[string][]namedPipelineHook) // hooks of each stage, in the order they are registered
+)
+
+/* The veto of an event by a hook */
+type hookVeto struct {
+	stage string
+	hook  string
+	err   error
+}
+
+func (veto *hookVeto) Error() string {
+	return fmt.Sprintf("vetoed by %s hook %s: %v", veto.stage, veto.hook, veto.err)
+}
+
+/* Register a hook of a stage, to be called after the hooks already registered for the stage */
+func registerPipelineHook(stage string, name string, hook pipelineHook) error {
+	if !isPipelineStage(stage) {
+		return fmt.Errorf("unknown pipeline stage %s. The stages are %v", stage, strings.Join(pipelineStages, ", "))
+	}
+	pipelineHooksMutex.Lock()
+	defer pipelineHooksMutex.Unlock()
+	for _, registered := range pipelineHooks[stage] {
+		if registered.name == name {
+			return fmt.Errorf("%s hook %s is already registered", stage, name)
+		}
+	}
+	pipelineHooks[stage] = append(pipelineHooks[stage], namedPipelineHook{name: name, hook: hook})
+	return nil
+}
+
+func isPipelineStage(stage string) bool {
+	for _, known := range pipelineStages {
+		if stage == known {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return whether a stage has hooks, to skip preparing events for stages without hooks */
+func hasPipelineHooks(stage string) bool {
+	pipelineHooksMutex.RLock()
+	defer pipelineHooksMutex.RUnlock()
+	return len(pipelineHooks[stage]) > 0
+}
+
+/* Register the executable hooks of -pipelineHooks */
+func initializePipelineHooks() error {
+	if pipelineHooksFlag == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(pipelineHooksFlag, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equal := strings.Index(entry, "=")
+		if equal <= 0 || equal == len(entry)-1 {
+			return fmt.Errorf("invalid pipeline hook %s: expecting stage=executable", entry)
+		}
+		stage, path := entry[:equal], entry[equal+1:]
+		if _, err := exec.LookPath(path); err != nil {
+			return fmt.Errorf("invalid %s hook %s: %v", stage, path, err)
+		}
+		if err := registerPipelineHook(stage, path, execPipelineHook(path)); err != nil {
+			return err
+		}
+		klog.Infof("Registered %s hook %s", stage, path)
+	}
+	return nil
+}
+
+/*
+Call the hooks of the stage of an event, in order. Returns a *hookVeto if a hook vetoes the event, in which case the
+hooks after it are not called. The errors of PostDeliver hooks are logged instead.
+*/
+func runPipelineHooks(event *pipelineEvent) error {
+	pipelineHooksMutex.RLock()
+	hooks := pipelineHooks[event.stage]
+	pipelineHooksMutex.RUnlock()
+	for _, hook := range hooks {
+		err := callPipelineHook(hook.hook, event)
+		if err == nil {
+			continue
+		}
+		if event.stage == stagePostDeliver {
+			incrementMetric("hooks." + event.stage + ".errors")
+			eventWarning(event.eventID, "Pipeline hook failed", logFields{"stage": event.stage, "hook": hook.name, "error": err})
+			continue
+		}
+		incrementMetric("hooks." + event.stage + ".vetoed")
+		return &hookVeto{stage: event.stage, hook: hook.name, err: err}
+	}
+	return nil
+}
+
+/* Call a hook, turning a panic into an error, so that a faulty hook vetoes the event rather than crashing */
+func callPipelineHook(hook pipelineHook, event *pipelineEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("hook panicked: %v", r)
+		}
+	}()
+	return hook(event)
+}
+
+/* Run the PreApply hooks of a resource. A resource filter, run before those checking the resources */
+func hookResource(action *resourceAction, resource *unstructured.Unstructured) error {
+	if !hasPipelineHooks(stagePreApply) {
+		return nil
+	}
+	return runPipelineHooks(&pipelineEvent{stage: stagePreApply, eventID: action.eventID, resource: resource,
+		trigger: action.trigger, collection: action.collection})
+}
+
+/* Run the PostDeliver hooks of a message sent to an eventDestination */
+func hookDelivered(destination string, bytes []byte) {
+	if !hasPipelineHooks(stagePostDeliver) {
+		return
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(bytes, &message); err != nil {
+		/* messages of triggers may be any JSON value */
+		message = map[string]interface{}{BODY: json.RawMessage(bytes)}
+	}
+	runPipelineHooks(&pipelineEvent{stage: stagePostDeliver, eventID: messageEventID(message), destination: destination, message: message})
+}
+
+/* The JSON of an event, read and written by executable hooks */
+type externalPipelineEvent struct {
+	Stage       string                 `json:"stage"`
+	EventID     string                 `json:"eventId,omitempty"`
+	Source      string                 `json:"source,omitempty"`
+	Destination string                 `json:"destination,omitempty"`
+	Message     map[string]interface{} `json:"message,omitempty"`
+	Resource    map[string]interface{} `json:"resource,omitempty"`
+	Trigger     string                 `json:"trigger,omitempty"`
+	Collection  string                 `json:"collection,omitempty"`
+}
+
+/* Return a hook calling an executable with the event on stdin */
+func execPipelineHook(path string) pipelineHook {
+	return func(event *pipelineEvent) error {
+		external := &externalPipelineEvent{Stage: event.stage, EventID: event.eventID, Source: event.source, Destination: event.destination,
+			Message: event.message, Trigger: event.trigger, Collection: event.collection}
+		if event.resource != nil {
+			external.Resource = event.resource.Object
+		}
+		input, err := json.Marshal(external)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		if pipelineHookTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, pipelineHookTimeout)
+			defer cancel()
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, path)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err = cmd.Run(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("timed out after %v", pipelineHookTimeout)
+			}
+			if reason := strings.TrimSpace(strings.SplitN(stderr.String(), "\n", 2)[0]); reason != "" {
+				return fmt.Errorf("%s", reason)
+			}
+			return err
+		}
+		if len(bytes.TrimSpace(stdout.Bytes())) == 0 || event.stage == stagePostDeliver {
+			return nil
+		}
+		changed := &externalPipelineEvent{}
+		if err = json.Unmarshal(stdout.Bytes(), changed); err != nil {
+			return fmt.Errorf("invalid event written by the hook: %v", err)
+		}
+		if changed.Message != nil && event.message != nil {
+			/* the message is changed in place, since the callers hold it */
+			for key := range event.message {
+				delete(event.message, key)
+			}
+			for key, value := range changed.Message {
+				event.message[key] = value
+			}
+		}
+		if changed.Resource != nil && event.resource != nil {
+			event.resource.Object = changed.Resource
+		}
+		if changed.Destination != "" && event.stage == stagePreRoute {
+			event.destination = changed.Destination
+		}
+		return nil
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+/* Replace the registered hooks, restoring them when done */
+func setupPipelineHooks() func() {
+	pipelineHooksMutex.Lock()
+	saved := pipelineHooks
+	pipelineHooks = make(map[string][]namedPipelineHook)
+	pipelineHooksMutex.Unlock()
+	return func() {
+		pipelineHooksMutex.Lock()
+		pipelineHooks = saved
+		pipelineHooksMutex.Unlock()
+	}
+}
+
+func TestWebhookPipelineHooks(t *testing.T) {
+	defer setupPipelineHooks()()
+	webhook, other := &failingProvider{}, &failingProvider{}
+	defer setupDeadLetters(t, webhook, other)()
+	eventProviders.EventDestinations = append(eventProviders.EventDestinations, &EventNode{Name: "other", ProviderRef: "dlq"})
+
+	registerPipelineHook(stageOnReceive, "veto", func(event *pipelineEvent) error {
+		if body, _ := event.message[BODY].(map[string]interface{}); body["ref"] == "refs/heads/vetoed" {
+			return fmt.Errorf("vetoed branch")
+		}
+		event.message[BODY].(map[string]interface{})["hooked"] = true
+		return nil
+	})
+	registerPipelineHook(stagePreRoute, "route", func(event *pipelineEvent) error {
+		if body, _ := event.message[BODY].(map[string]interface{}); body["ref"] == "refs/heads/other" {
+			event.destination = "other"
+		}
+		return nil
+	})
+	delivered := make(chan string, 10)
+	registerPipelineHook(stagePostDeliver, "delivered", func(event *pipelineEvent) error {
+		delivered <- event.destination
+		return fmt.Errorf("errors of PostDeliver hooks are ignored")
+	})
+	if err := registerPipelineHook(stageOnReceive, "veto", func(*pipelineEvent) error { return nil }); err == nil {
+		t.Fatal("expected an error registering a hook twice")
+	}
+	if err := registerPipelineHook("OnCreate", "unknown", func(*pipelineEvent) error { return nil }); err == nil {
+		t.Fatal("expected an error registering a hook of an unknown stage")
+	}
+
+	for _, ref := range []string{"refs/heads/master", "refs/heads/other"} {
+		if recorder := postWebhook(`{"ref":"` + ref + `"}`); recorder.Code != http.StatusOK {
+			t.Fatalf("webhook of %v returned %v: %s", ref, recorder.Code, recorder.Body.String())
+		}
+	}
+	for _, destination := range []string{WEBHOOKDESTINATION, "other"} {
+		select {
+		case got := <-delivered:
+			if got != destination {
+				t.Fatalf("delivered to %v, expected %v", got, destination)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("PostDeliver hook not called")
+		}
+	}
+	messages, _ := webhook.sent()
+	otherMessages, _ := other.sent()
+	if len(messages) != 1 || len(otherMessages) != 1 || !strings.Contains(string(messages[0]), `"hooked":true`) {
+		t.Fatalf("unexpected messages %s and %s", messages, otherMessages)
+	}
+
+	recorder := postWebhook(`{"ref":"refs/heads/vetoed"}`)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), `"code":"vetoed"`) {
+		t.Fatalf("vetoed webhook returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+	if messages, _ = webhook.sent(); len(messages) != 1 {
+		t.Fatalf("vetoed message was sent: %s", messages)
+	}
+}
+
+func TestPreApplyHooks(t *testing.T) {
+	defer setupPipelineHooks()()
+	registerPipelineHook(stagePreApply, "label", func(event *pipelineEvent) error {
+		if event.trigger == "vetoed" {
+			return fmt.Errorf("trigger %s may not create resources", event.trigger)
+		}
+		event.resource.SetLabels(map[string]string{"hooked": event.collection})
+		return nil
+	})
+	registerPipelineHook(stagePreApply, "panic", func(event *pipelineEvent) error {
+		if event.trigger == "panic" {
+			panic("faulty hook")
+		}
+		return nil
+	})
+
+	variables := map[string]interface{}{"attr1": "string1"}
+	action := &resourceAction{collection: "active", trigger: "t", dryrun: true}
+	if err := applyResourcesHelper("test_data/trigger11", nil, "resources", variables, action); err != nil {
+		t.Fatal(err)
+	}
+	labels, _ := action.rendered[0].Resource["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels["hooked"] != "active" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	for _, trigger := range []string{"vetoed", "panic"} {
+		err := applyResourcesHelper("test_data/trigger11", nil, "resources", variables, &resourceAction{collection: "active", trigger: trigger, dryrun: true})
+		if _, vetoed := err.(*hookVeto); !vetoed {
+			t.Fatalf("expected trigger %v to be vetoed, got %v", trigger, err)
+		}
+	}
+}
+
+func TestExecPipelineHooks(t *testing.T) {
+	defer setupPipelineHooks()()
+	savedFlag, savedTimeout := pipelineHooksFlag, pipelineHookTimeout
+	defer func() { pipelineHooksFlag, pipelineHookTimeout = savedFlag, savedTimeout }()
+
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	scripts := map[string]string{
+		"mutate": "#!/bin/sh\ncat > " + filepath.Join(dir, "input.json") + "\necho '{\"resource\": {\"apiVersion\": \"v1\", \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"changed\"}}}'\n",
+		"veto":   "#!/bin/sh\necho 'not allowed today' >&2\nexit 1\n",
+		"slow":   "#!/bin/sh\nexec sleep 5\n",
+	}
+	for name, script := range scripts {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pipelineHooksFlag = stagePreApply + "=" + filepath.Join(dir, "mutate")
+	pipelineHookTimeout = 100 * time.Millisecond
+	if err = initializePipelineHooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	resource := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "original"}}}
+	event := &pipelineEvent{stage: stagePreApply, eventID: "0123", resource: resource, trigger: "t", collection: "active"}
+	if err = runPipelineHooks(event); err != nil {
+		t.Fatal(err)
+	}
+	if resource.GetName() != "changed" {
+		t.Fatalf("unexpected resource %v", resource.Object)
+	}
+	input, err := ioutil.ReadFile(filepath.Join(dir, "input.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var external externalPipelineEvent
+	if err = json.Unmarshal(input, &external); err != nil || external.Stage != stagePreApply || external.Trigger != "t" || external.EventID != "0123" {
+		t.Fatalf("unexpected input %s of the hook: %v", input, err)
+	}
+
+	for name, reason := range map[string]string{"veto": "not allowed today", "slow": "timed out"} {
+		err = execPipelineHook(filepath.Join(dir, name))(event)
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("unexpected error of hook %v: %v", name, err)
+		}
+	}
+
+	pipelineHooksFlag = "OnReceive=" + filepath.Join(dir, "missing")
+	if err = initializePipelineHooks(); err == nil {
+		t.Fatal("expected an error registering a missing executable")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// The HTTP provider POSTs messages to the URL of the messageProvider, so that events can be fanned out to services
+// that do not speak NATS. Requests carry the configured headers, and bearer or basic credentials read from a Secret
+// in the namespace of kabanero-events. Failed requests, that is connection errors, 429 and 5xx responses, are retried
+// with an exponential backoff. Unlike the REST provider, any 2xx response is a success.
+
+const (
+	httpAuthBearer = "bearer"
+	httpAuthBasic  = "basic"
+	httpToken      = "token"
+
+	defaultHTTPTimeout       = 5 * time.Second
+	defaultHTTPRetryInterval = time.Second
+	httpSecretRefresh        = 5 * time.Minute
+)
+
+// Read the data of a Secret in the namespace of kabanero-events. Replaced in tests.
+var readProviderSecret = func(name string) (map[string][]byte, error) {
+	if dynamicClient == nil {
+		return nil, fmt.Errorf("unable to read secret %s: no Kubernetes client", name)
+	}
+	obj, err := secretsInterface(dynamicClient, webhookNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte)
+	dataMap, _ := obj.Object[DATA].(map[string]interface{})
+	for key, value := range dataMap {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key %s of secret %s: %v", key, name, err)
+		}
+		data[key] = decoded
+	}
+	return data, nil
+}
+
+type httpProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	client                    *http.Client
+	retryInterval             time.Duration
+
+	mutex    sync.Mutex
+	secret   map[string][]byte // data of the secret holding the credentials
+	readTime time.Time         // time the secret was read
+}
+
+func (provider *httpProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	if mpd.URL == "" {
+		return fmt.Errorf("HTTP provider '%s' has no url", mpd.Name)
+	}
+	switch mpd.Auth {
+	case "", httpAuthBearer, httpAuthBasic:
+	default:
+		return fmt.Errorf("auth '%s' of HTTP provider '%s' is not bearer or basic", mpd.Auth, mpd.Name)
+	}
+	if mpd.Auth != "" && mpd.SecretRef == "" {
+		return fmt.Errorf("HTTP provider '%s' with %s auth has no secretRef", mpd.Name, mpd.Auth)
+	}
+	if mpd.MaxRetries < 0 {
+		return fmt.Errorf("maxRetries of HTTP provider '%s' is negative", mpd.Name)
+	}
+	provider.retryInterval = mpd.RetryInterval
+	if provider.retryInterval <= 0 {
+		provider.retryInterval = defaultHTTPRetryInterval
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: mpd.SkipTLSVerify}
+	if mpd.CAFile != "" {
+		caCert, err := ioutil.ReadFile(mpd.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the CA certificate of HTTP provider '%s': %v", mpd.Name, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in %s for HTTP provider '%s'", mpd.CAFile, mpd.Name)
+		}
+	}
+	if mpd.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(mpd.CertFile, mpd.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the client certificate of HTTP provider '%s': %v", mpd.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	timeout := mpd.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	provider.client = &http.Client{Transport: withUserAgent(&http.Transport{TLSClientConfig: tlsConfig}), Timeout: timeout}
+	return nil
+}
+
+// Return the data of the secret holding the credentials, reading it again once it is stale.
+func (provider *httpProvider) credentials(refresh bool) (map[string][]byte, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.secret == nil || refresh || time.Since(provider.readTime) > httpSecretRefresh {
+		secret, err := readProviderSecret(provider.messageProviderDefinition.SecretRef)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the secret of HTTP provider '%s': %v", provider.messageProviderDefinition.Name, err)
+		}
+		provider.secret, provider.readTime = secret, time.Now()
+	}
+	return provider.secret, nil
+}
+
+// Set the headers, and the credentials, of a request.
+func (provider *httpProvider) authorize(req *http.Request, header interface{}, refresh bool) error {
+	mpd := provider.messageProviderDefinition
+	if header != nil {
+		headerMap, ok := header.(map[string][]string)
+		if !ok {
+			return fmt.Errorf("httpProvider.Send: header not map[string][]string")
+		}
+		for key, values := range headerMap {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	for key, value := range mpd.Headers {
+		req.Header.Set(key, value)
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if mpd.Auth == "" {
+		return nil
+	}
+	secret, err := provider.credentials(refresh)
+	if err != nil {
+		return err
+	}
+	switch mpd.Auth {
+	case httpAuthBearer:
+		token, ok := secret[httpToken]
+		if !ok {
+			return fmt.Errorf("secret %s of HTTP provider '%s' has no %s", mpd.SecretRef, mpd.Name, httpToken)
+		}
+		req.Header.Set("Authorization", "Bearer "+string(bytes.TrimSpace(token)))
+	case httpAuthBasic:
+		username, usernameOK := secret[USERNAME]
+		password, passwordOK := secret[PASSWORD]
+		if !usernameOK || !passwordOK {
+			return fmt.Errorf("secret %s of HTTP provider '%s' has no %s or %s", mpd.SecretRef, mpd.Name, USERNAME, PASSWORD)
+		}
+		req.SetBasicAuth(string(bytes.TrimSpace(username)), string(bytes.TrimSpace(password)))
+	}
+	return nil
+}
+
+// Send a message once. Returns whether a failed request may be retried.
+func (provider *httpProvider) sendOnce(payload []byte, header interface{}, refresh bool) (bool, int, error) {
+	url := provider.messageProviderDefinition.URL
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return false, 0, err
+	}
+	if err = provider.authorize(req, header, refresh); err != nil {
+		return false, 0, err
+	}
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, resp.StatusCode, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, resp.StatusCode, fmt.Errorf("http_provider Send to %v failed with http status %v", url, resp.Status)
+}
+
+// Send a message to an eventDestination, retrying failed requests.
+func (provider *httpProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	if klog.V(6) {
+		klog.Infof("httpProvider: Sending %s", string(payload))
+	}
+	interval := provider.retryInterval
+	refresh := false
+	for attempt := 0; ; attempt++ {
+		retry, status, err := provider.sendOnce(payload, header, refresh)
+		if err == nil {
+			return nil
+		}
+		if status == http.StatusUnauthorized && !refresh && provider.messageProviderDefinition.Auth != "" {
+			/* the credentials may have been rotated: read them again once */
+			refresh, retry = true, true
+		} else {
+			refresh = false
+		}
+		if !retry || attempt >= provider.messageProviderDefinition.MaxRetries {
+			return err
+		}
+		if klog.V(4) {
+			klog.Infof("httpProvider: retrying in %v after error: %v", interval, err)
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// Subscribe is not implemented for HTTP providers.
+func (provider *httpProvider) Subscribe(node *EventNode) error {
+	return fmt.Errorf("subscribing on HTTP provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+// Receive is not implemented for HTTP providers.
+func (provider *httpProvider) Receive(node *EventNode) ([]byte, error) {
+	return nil, fmt.Errorf("receiving on HTTP provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+// ListenAndServe is not implemented for HTTP providers.
+func (provider *httpProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	klog.Errorf("listening on HTTP provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+func init() {
+	RegisterMessageProvider("http", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newHTTPProvider(mpd)
+	})
+}
+
+func newHTTPProvider(mpd *MessageProviderDefinition) (*httpProvider, error) {
+	provider := new(httpProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
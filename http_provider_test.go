@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPProviderSend(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if req.Header.Get("Authorization") != "Bearer s3cret" || req.Header.Get("X-Source") != "kabanero-events" || req.Header.Get("X-Github-Event") != "push" {
+			t.Errorf("unexpected headers %v", req.Header)
+		}
+		/* fail the first attempt */
+		if requests == 1 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	savedRead := readProviderSecret
+	defer func() { readProviderSecret = savedRead }()
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		if name != "service-token" {
+			t.Errorf("unexpected secret %v", name)
+		}
+		return map[string][]byte{httpToken: []byte("s3cret\n")}, nil
+	}
+
+	provider, err := newHTTPProvider(&MessageProviderDefinition{Name: "service", ProviderType: "http", URL: server.URL,
+		Headers: map[string]string{"X-Source": "kabanero-events"}, Auth: httpAuthBearer, SecretRef: "service-token",
+		MaxRetries: 2, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = provider.Send(&EventNode{Name: "service"}, []byte(`{}`), map[string][]string{"X-Github-Event": {"push"}}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatalf("%v requests sent, expected 2", requests)
+	}
+}
+
+func TestHTTPProviderErrors(t *testing.T) {
+	status := http.StatusBadRequest
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		requests++
+		if username, password, ok := req.BasicAuth(); !ok || username != "kabanero" || password != "passw0rd" {
+			t.Errorf("unexpected credentials %v %v", username, password)
+		}
+		writer.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	savedRead := readProviderSecret
+	defer func() { readProviderSecret = savedRead }()
+	reads := 0
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		reads++
+		return map[string][]byte{USERNAME: []byte("kabanero"), PASSWORD: []byte("passw0rd")}, nil
+	}
+
+	provider, err := newHTTPProvider(&MessageProviderDefinition{Name: "service", URL: server.URL, Auth: httpAuthBasic,
+		SecretRef: "service-credentials", MaxRetries: 3, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* client errors are not retried */
+	if err = provider.Send(&EventNode{}, []byte(`{}`), nil); err == nil || requests != 1 {
+		t.Fatalf("%v requests sent for a bad request: %v", requests, err)
+	}
+
+	/* server errors are retried up to maxRetries */
+	status, requests = http.StatusInternalServerError, 0
+	if err = provider.Send(&EventNode{}, []byte(`{}`), nil); err == nil || requests != 4 {
+		t.Fatalf("%v requests sent for a server error: %v", requests, err)
+	}
+
+	/* the secret is read again after a 401 */
+	status, requests, reads = http.StatusUnauthorized, 0, 0
+	if err = provider.Send(&EventNode{}, []byte(`{}`), nil); err == nil || requests != 2 || reads != 1 {
+		t.Fatalf("%v requests sent and %v reads of the secret after a 401: %v", requests, reads, err)
+	}
+
+	for _, mpd := range []*MessageProviderDefinition{
+		{Name: "nourl"},
+		{Name: "auth", URL: server.URL, Auth: "digest", SecretRef: "secret"},
+		{Name: "nosecret", URL: server.URL, Auth: httpAuthBearer},
+		{Name: "retries", URL: server.URL, MaxRetries: -1},
+	} {
+		if _, err := newHTTPProvider(mpd); err == nil {
+			t.Errorf("HTTP provider %v was created", mpd.Name)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Mirrors of the Kabanero index. The index URL of a trigger collection may be a comma separated list of URLs, the primary
+first, such as the public host followed by an internal mirror, and -indexMirrors adds mirrors of the index of the
+active collection. The trigger collection is downloaded from the first URL whose index and collection can be
+downloaded and verified, so that an outage of one host does not prevent kabanero-events from starting. The health of
+each URL is tracked: a URL that failed is tried after the healthy ones until -indexRetryAfter has passed since its last
+failure, so that loading a collection does not wait for the timeout of a host known to be down. The health is reported
+by GET /admin/diagnostics.
+*/
+
+var (
+	indexMirrors    string        // comma separated mirrors of the Kabanero index of the active collection
+	indexRetryAfter time.Duration // how long a failed index URL is tried after the healthy ones
+	indexTimeout    time.Duration // maximum time to download a Kabanero index or trigger collection. Unlimited if 0
+)
+
+/* The health of a Kabanero index URL */
+type indexSourceHealth struct {
+	URL                 string    `json:"url"`
+	Successes           int64     `json:"successes"`
+	Failures            int64     `json:"failures"`
+	ConsecutiveFailures int64     `json:"consecutiveFailures"`
+	LastSuccess         time.Time `json:"lastSuccess,omitempty"`
+	LastFailure         time.Time `json:"lastFailure,omitempty"`
+	LastError           string    `json:"lastError,omitempty"`
+}
+
+var (
+	indexSourcesMutex sync.Mutex
+	indexSources      = make(map[string]*indexSourceHealth) // by URL
+)
+
+/* Split a comma separated list of index URLs, removing duplicates */
+func splitIndexURLs(values ...string) []string {
+	urls := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, indexURL := range strings.Split(value, ",") {
+			if indexURL = strings.TrimSpace(indexURL); indexURL != "" && !seen[indexURL] {
+				seen[indexURL] = true
+				urls = append(urls, indexURL)
+			}
+		}
+	}
+	return urls
+}
+
+/* Redact each URL of a comma separated list */
+func redactURLs(value string) string {
+	urls := splitIndexURLs(value)
+	for index, indexURL := range urls {
+		urls[index] = redactURL(indexURL)
+	}
+	return strings.Join(urls, ",")
+}
+
+/* Return the health of an index URL, recording it if new. Must be called with the mutex held */
+func indexSourceOf(indexURL string) *indexSourceHealth {
+	source, ok := indexSources[indexURL]
+	if !ok {
+		source = &indexSourceHealth{URL: indexURL}
+		indexSources[indexURL] = source
+	}
+	return source
+}
+
+/* Record the outcome of a download from an index URL */
+func recordIndexSource(indexURL string, err error, now time.Time) {
+	indexSourcesMutex.Lock()
+	defer indexSourcesMutex.Unlock()
+	source := indexSourceOf(indexURL)
+	if err != nil {
+		source.Failures++
+		source.ConsecutiveFailures++
+		source.LastFailure = now
+		source.LastError = err.Error()
+		incrementMetric("index.failures")
+		return
+	}
+	source.Successes++
+	source.ConsecutiveFailures = 0
+	source.LastSuccess = now
+	source.LastError = ""
+	incrementMetric("index.successes")
+}
+
+/* Order index URLs to be tried: the healthy URLs first, then those that failed recently, each in the configured order */
+func orderIndexURLs(urls []string, now time.Time) []string {
+	indexSourcesMutex.Lock()
+	defer indexSourcesMutex.Unlock()
+	failing := func(indexURL string) bool {
+		source, ok := indexSources[indexURL]
+		return ok && source.ConsecutiveFailures > 0 && now.Sub(source.LastFailure) < indexRetryAfter
+	}
+	ordered := append([]string{}, urls...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return !failing(ordered[i]) && failing(ordered[j])
+	})
+	return ordered
+}
+
+/* Return the health of index URLs, with redacted URLs */
+func indexSourcesHealth(urls []string) []indexSourceHealth {
+	indexSourcesMutex.Lock()
+	defer indexSourcesMutex.Unlock()
+	health := make([]indexSourceHealth, 0, len(urls))
+	for _, indexURL := range urls {
+		source := *indexSourceOf(indexURL)
+		source.URL = redactURL(source.URL)
+		health = append(health, source)
+	}
+	return health
+}
+
+/*
+Download the trigger collection of the first index URL that can be downloaded into a new temporary directory.
+Return the directory and the URL it was downloaded from.
+*/
+func downloadTriggerFromSources(urls []string) (string, string, error) {
+	if len(urls) == 0 {
+		return "", "", fmt.Errorf("no Kabanero index URL")
+	}
+	errs := make([]string, 0, len(urls))
+	for _, indexURL := range orderIndexURLs(urls, time.Now()) {
+		dir, err := ioutil.TempDir("", "webhook")
+		if err != nil {
+			return "", "", fmt.Errorf("unable to create temporary directory. Error: %s", err)
+		}
+		err = downloadCollection(indexURL, dir)
+		recordIndexSource(indexURL, err, time.Now())
+		if err == nil {
+			return dir, indexURL, nil
+		}
+		os.RemoveAll(dir)
+		klog.Warningf("Unable to download the trigger collection of the Kabanero index %s: %v", redactURL(indexURL), err)
+		errs = append(errs, fmt.Sprintf("%s: %v", redactURL(indexURL), err))
+	}
+	return "", "", fmt.Errorf("unable to download the trigger collection from any Kabanero index: %s", strings.Join(errs, "; "))
+}
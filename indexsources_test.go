@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadTriggerFromMirror(t *testing.T) {
+	savedSources, savedRetryAfter := indexSources, indexRetryAfter
+	defer func() { indexSources, indexRetryAfter = savedSources, savedRetryAfter }()
+	indexSources, indexRetryAfter = make(map[string]*indexSourceHealth), time.Hour
+
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chkSum, err := sha256sum(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var primaryRequests int32
+	primary := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&primaryRequests, 1)
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	var mirror *httptest.Server
+	mirror = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/kabanero-index.yaml":
+			fmt.Fprintf(writer, "triggers:\n - url: %s/triggers.tar.gz\n   sha256: %s\n", mirror.URL, chkSum)
+		case "/triggers.tar.gz":
+			writer.Write(archive)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mirror.Close()
+
+	primaryURL, mirrorURL := primary.URL+"/kabanero-index.yaml", mirror.URL+"/kabanero-index.yaml"
+	dir, indexURL, err := downloadTriggerFromSources(splitIndexURLs(primaryURL + ", " + mirrorURL + "," + primaryURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if indexURL != mirrorURL || atomic.LoadInt32(&primaryRequests) != 1 {
+		t.Fatalf("unexpected index URL %v after %v requests to the primary", indexURL, primaryRequests)
+	}
+	health := indexSourcesHealth([]string{primaryURL, mirrorURL})
+	if health[0].ConsecutiveFailures != 1 || health[0].LastError == "" || health[1].Successes != 1 || health[1].ConsecutiveFailures != 0 {
+		t.Fatalf("unexpected health %+v", health)
+	}
+
+	/* the primary that failed is tried after the mirror until -indexRetryAfter has passed */
+	if ordered := orderIndexURLs([]string{primaryURL, mirrorURL}, time.Now()); !reflect.DeepEqual(ordered, []string{mirrorURL, primaryURL}) {
+		t.Fatalf("unexpected order %v", ordered)
+	}
+	if ordered := orderIndexURLs([]string{primaryURL, mirrorURL}, time.Now().Add(2*time.Hour)); !reflect.DeepEqual(ordered, []string{primaryURL, mirrorURL}) {
+		t.Fatalf("unexpected order %v after -indexRetryAfter", ordered)
+	}
+	dir, indexURL, err = downloadTriggerFromSources([]string{primaryURL, mirrorURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	if indexURL != mirrorURL || atomic.LoadInt32(&primaryRequests) != 1 {
+		t.Fatalf("the failed primary was tried first: %v requests", primaryRequests)
+	}
+
+	/* all sources failing is an error */
+	if _, _, err = downloadTriggerFromSources([]string{primaryURL}); err == nil {
+		t.Fatal("expected an error when no index can be downloaded")
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Runtime inspection. The admin API reports the loaded message providers and event destinations, with the health of
+their connections, the messages sent and received through them, and their last error, as well as, for each trigger,
+how many events it matched, missed, or failed on, and the triggers matched and missed by the most recent events, so
+that operators can debug the processing of events without grepping the logs.
+*/
+
+var recentEventsSize = 50 // number of recent events kept for inspection
+
+/* The messages sent and received through a provider or destination */
+type activityStatus struct {
+	Sent          int64      `json:"sent"`
+	Received      int64      `json:"received"`
+	Errors        int64      `json:"errors"`
+	LastSent      *time.Time `json:"lastSent,omitempty"`
+	LastReceived  *time.Time `json:"lastReceived,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+/* The events matched, missed, and failed on by a trigger */
+type triggerActivity struct {
+	Matches       int64      `json:"matches"`
+	Misses        int64      `json:"misses"`
+	Errors        int64      `json:"errors"`
+	LastMatched   *time.Time `json:"lastMatched,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+/* The triggers matched and missed by a recent event */
+type recentEvent struct {
+	Time        time.Time         `json:"time"`
+	EventID     string            `json:"eventID,omitempty"`
+	EventSource string            `json:"eventSource"`
+	Collection  string            `json:"collection"`
+	Repository  string            `json:"repository,omitempty"`
+	Matched     []string          `json:"matched"`
+	Missed      []string          `json:"missed"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+/* A provider as reported by the admin API */
+type providerStatus struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	URLs       []string `json:"urls,omitempty"`
+	Registered bool     `json:"registered"`
+	Health     string   `json:"health"`
+	activityStatus
+}
+
+/* A destination as reported by the admin API */
+type destinationStatus struct {
+	Name        string   `json:"name"`
+	Topic       string   `json:"topic"`
+	ProviderRef string   `json:"providerRef"`
+	Anonymize   bool     `json:"anonymize,omitempty"`
+	Accepts     []string `json:"accepts,omitempty"`
+	Listening   bool     `json:"listening"`
+	activityStatus
+}
+
+var (
+	inspectMutex        sync.Mutex
+	providerActivity    = make(map[string]*activityStatus)  // by provider
+	destinationActivity = make(map[string]*activityStatus)  // by destination
+	triggerActivities   = make(map[string]*triggerActivity) // by collection and trigger
+	recentEvents        = make([]*recentEvent, 0)           // oldest first
+)
+
+/* Record the outcome of sending or receiving a message in an activity */
+func (activity *activityStatus) record(sent bool, err error, now time.Time) {
+	if err != nil {
+		activity.Errors++
+		activity.LastError = err.Error()
+		activity.LastErrorTime = &now
+	} else if sent {
+		activity.Sent++
+		activity.LastSent = &now
+	} else {
+		activity.Received++
+		activity.LastReceived = &now
+	}
+}
+
+/* Record a message sent to, or received from, a destination, and its provider */
+func recordMessageActivity(node *EventNode, sent bool, err error) {
+	if node == nil {
+		return
+	}
+	now := time.Now().UTC()
+	inspectMutex.Lock()
+	defer inspectMutex.Unlock()
+	for name, activities := range map[string]map[string]*activityStatus{node.Name: destinationActivity, node.ProviderRef: providerActivity} {
+		activity, ok := activities[name]
+		if !ok {
+			activity = &activityStatus{}
+			activities[name] = activity
+		}
+		activity.record(sent, err, now)
+	}
+}
+
+/* Return a copy of the activity of a provider or destination */
+func activityOf(activities map[string]*activityStatus, name string) activityStatus {
+	inspectMutex.Lock()
+	defer inspectMutex.Unlock()
+	if activity, ok := activities[name]; ok {
+		return *activity
+	}
+	return activityStatus{}
+}
+
+/* Record the outcomes of the triggers evaluated against a message */
+func recordTriggerActivity(message map[string]interface{}, eventSource string, collection string, outcomes []*triggerOutcome) {
+	now := time.Now().UTC()
+	event := &recentEvent{Time: now, EventSource: eventSource, Collection: collection, Repository: messageRepositoryName(message),
+		Matched: make([]string, 0), Missed: make([]string, 0)}
+	event.EventID, _ = message[EVENTID].(string)
+
+	inspectMutex.Lock()
+	defer inspectMutex.Unlock()
+	for _, outcome := range outcomes {
+		if outcome == nil {
+			continue
+		}
+		key := collection + "/" + outcome.trigger
+		activity, ok := triggerActivities[key]
+		if !ok {
+			activity = &triggerActivity{}
+			triggerActivities[key] = activity
+		}
+		switch {
+		case outcome.err != nil:
+			activity.Errors++
+			activity.LastError = outcome.err.Error()
+			activity.LastErrorTime = &now
+			if event.Errors == nil {
+				event.Errors = make(map[string]string)
+			}
+			event.Errors[outcome.trigger] = outcome.err.Error()
+		case len(outcome.actions) > 0:
+			activity.Matches++
+			activity.LastMatched = &now
+			event.Matched = append(event.Matched, outcome.trigger)
+		default:
+			activity.Misses++
+			event.Missed = append(event.Missed, outcome.trigger)
+		}
+	}
+	recentEvents = append(recentEvents, event)
+	if len(recentEvents) > recentEventsSize {
+		recentEvents = recentEvents[len(recentEvents)-recentEventsSize:]
+	}
+}
+
+/* Return a copy of the activity of a trigger of a collection */
+func triggerActivityOf(collection string, trigger string) triggerActivity {
+	inspectMutex.Lock()
+	defer inspectMutex.Unlock()
+	if activity, ok := triggerActivities[collection+"/"+trigger]; ok {
+		return *activity
+	}
+	return triggerActivity{}
+}
+
+/* GET /admin/providers lists the message providers, the health of their connections, and their activity */
+func adminProvidersHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	statuses := make([]providerStatus, 0)
+	if ed := currentEventProviders(); ed != nil {
+		for _, mpd := range ed.MessageProviders {
+			status := providerStatus{Name: mpd.Name, Type: mpd.ProviderType, Health: healthOK, activityStatus: activityOf(providerActivity, mpd.Name)}
+			redacted := redactMessageProvider(mpd)
+			for _, value := range append([]string{redacted.URL}, redacted.URLs...) {
+				if value != "" {
+					status.URLs = append(status.URLs, value)
+				}
+			}
+			if provider := lookupMessageProvider(mpd.Name); provider == nil {
+				status.Health = "not registered"
+			} else if err := providerHealth(provider); err != nil {
+				status.Registered = true
+				status.Health = err.Error()
+			} else {
+				status.Registered = true
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	writeJSON(writer, statuses)
+}
+
+/* GET /admin/destinations lists the event destinations, whether they are listened to, and their activity */
+func adminDestinationsHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	statuses := make([]destinationStatus, 0)
+	if ed := currentEventProviders(); ed != nil {
+		for _, node := range ed.EventDestinations {
+			statuses = append(statuses, destinationStatus{Name: node.Name, Topic: node.Topic, ProviderRef: node.ProviderRef, Anonymize: node.Anonymize, Accepts: node.Accepts,
+				Listening: isSelfTestListening(node.Name), activityStatus: activityOf(destinationActivity, node.Name)})
+		}
+	}
+	writeJSON(writer, statuses)
+}
+
+/* GET /admin/recent-events lists the triggers matched and missed by the most recent events, newest first */
+func adminRecentEventsHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := recentEventsSize
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			writeError(writer, req, codeInvalidParameter, "invalid limit "+value)
+			return
+		}
+	}
+	inspectMutex.Lock()
+	events := make([]*recentEvent, 0, len(recentEvents))
+	for index := len(recentEvents) - 1; index >= 0 && len(events) < limit; index-- {
+		events = append(events, recentEvents[index])
+	}
+	inspectMutex.Unlock()
+	writeJSON(writer, events)
+}
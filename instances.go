@@ -0,0 +1,266 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Multiple Kabanero instances. The first Kabanero CR of the namespace of kabanero-events is the default instance, whose
+collection is the active trigger collection. The other Kabanero CRs of that namespace, and the Kabanero CRs of the
+namespaces of -kabaneroNamespaces, are additional instances, each with the trigger collection of its Kabanero CR, and
+the git secrets of its namespace. A message is processed by the collection of the instance whose
+kabanero.io/events-paths annotation lists the listener path the message was received on, or else by the instance whose
+kabanero.io/events-repositories annotation has the best match for the repository of the message, using the URL patterns
+of the git secrets. Other messages are processed by the default instance. The Kabanero CRs are watched, and the
+collection of an instance is loaded again when its URL changes.
+*/
+
+const (
+	KABANERONAMESPACES = "KABANERO_NAMESPACES" // comma separated namespaces of other Kabanero instances
+
+	eventsRepositoriesAnnotation = "kabanero.io/events-repositories"
+	eventsPathsAnnotation        = "kabanero.io/events-paths"
+)
+
+var (
+	kabaneroNamespaces string // comma separated namespaces of other Kabanero instances
+
+	instancesMutex    sync.RWMutex
+	kabaneroInstances []*kabaneroInstance // instances other than the default
+
+	kabanerosGVR = schema.GroupVersionResource{Group: KABANEROIO, Version: V1ALPHA1, Resource: KABANEROS}
+)
+
+/* A Kabanero instance other than the default one */
+type kabaneroInstance struct {
+	namespace    string
+	name         string
+	indexURL     string
+	repositories []*gitURLPattern // URL patterns of the repositories routed to the instance
+	paths        map[string]bool  // listener paths routed to the instance
+	proc         *triggerProcessor
+}
+
+/* Return the namespace of the Kabanero instance of a collection */
+func (tp *triggerProcessor) kabaneroNamespace() string {
+	if tp == nil || tp.namespace == "" {
+		return webhookNamespace
+	}
+	return tp.namespace
+}
+
+/* Return the namespaces whose Kabanero CRs are instances: that of kabanero-events first */
+func instanceNamespaces() []string {
+	namespaces := []string{webhookNamespace}
+	seen := map[string]bool{webhookNamespace: true}
+	for _, namespace := range strings.Split(kabaneroNamespaces, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if namespace != "" && !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+/* Create the instance of a Kabanero CR, without its collection. Returns nil if the CR has no active collection */
+func newKabaneroInstance(obj unstructured.Unstructured) (*kabaneroInstance, error) {
+	indexURL := kabaneroCollectionURL(obj)
+	if indexURL == "" {
+		return nil, nil
+	}
+	instance := &kabaneroInstance{namespace: obj.GetNamespace(), name: obj.GetName(), indexURL: indexURL, paths: make(map[string]bool)}
+	annotations := obj.GetAnnotations()
+	for _, text := range splitURLPatterns(annotations[eventsRepositoriesAnnotation]) {
+		pattern, err := compileURLPattern(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation of Kabanero %s/%s: %v", eventsRepositoriesAnnotation, instance.namespace, instance.name, err)
+		}
+		instance.repositories = append(instance.repositories, pattern)
+	}
+	for _, path := range strings.FieldsFunc(annotations[eventsPathsAnnotation], func(r rune) bool { return r == ',' || r == ' ' }) {
+		instance.paths["/"+strings.TrimPrefix(path, "/")] = true
+	}
+	return instance, nil
+}
+
+/* Return the instance of a Kabanero CR */
+func findKabaneroInstance(instances []*kabaneroInstance, namespace string, name string) *kabaneroInstance {
+	for _, instance := range instances {
+		if instance.namespace == namespace && instance.name == name {
+			return instance
+		}
+	}
+	return nil
+}
+
+/*
+List the Kabanero CRs of the instance namespaces, and replace the instances. The collections of the new instances, and
+of the instances whose URL changed, are loaded. An instance whose collection cannot be loaded keeps its collection
+*/
+func refreshKabaneroInstances(dynInterf dynamic.Interface) error {
+	instancesMutex.RLock()
+	previous := kabaneroInstances
+	instancesMutex.RUnlock()
+
+	var firstErr error
+	instances := make([]*kabaneroInstance, 0)
+	for _, namespace := range instanceNamespaces() {
+		list, err := dynInterf.Resource(kabanerosGVR).Namespace(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("unable to list the Kabanero CRs of namespace %s: %v", namespace, err)
+			}
+			/* the instances of the namespace are kept until the CRs can be listed */
+			for _, instance := range previous {
+				if instance.namespace == namespace {
+					instances = append(instances, instance)
+				}
+			}
+			continue
+		}
+		isDefault := namespace == webhookNamespace
+		for _, obj := range list.Items {
+			instance, err := newKabaneroInstance(obj)
+			if err == nil && instance != nil && isDefault {
+				/* the first Kabanero CR with a collection is the default instance */
+				isDefault = false
+				continue
+			}
+			if err != nil || instance == nil {
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if len(instance.repositories) == 0 && len(instance.paths) == 0 {
+				klog.Warningf("Kabanero %s/%s has neither %s nor %s annotation: no message is routed to it", instance.namespace, instance.name, eventsRepositoriesAnnotation, eventsPathsAnnotation)
+			}
+			if existing := findKabaneroInstance(previous, instance.namespace, instance.name); existing != nil && existing.indexURL == instance.indexURL {
+				instance.proc = existing.proc
+			} else if proc, err := loadTriggerProcessor(instance.namespace+"/"+instance.name, instance.indexURL); err != nil {
+				incrementMetric("instances.errors")
+				if firstErr == nil {
+					firstErr = fmt.Errorf("unable to load the collection of Kabanero %s/%s: %v", instance.namespace, instance.name, err)
+				}
+				if existing == nil {
+					continue
+				}
+				instance.proc = existing.proc
+			} else {
+				proc.namespace = instance.namespace
+				instance.proc = proc
+				klog.Infof("Loaded the trigger collection of Kabanero %s/%s from %s", instance.namespace, instance.name, redactURLs(instance.indexURL))
+			}
+			instances = append(instances, instance)
+		}
+	}
+
+	instancesMutex.Lock()
+	kabaneroInstances = instances
+	instancesMutex.Unlock()
+	for _, instance := range previous {
+		if current := findKabaneroInstance(instances, instance.namespace, instance.name); current == nil || current.proc != instance.proc {
+			/* messages being evaluated by the replaced collection may still read its directory */
+			retireDir := instance.proc.triggerDir
+			time.AfterFunc(retireCollectionDelay, func() { os.RemoveAll(retireDir) })
+		}
+	}
+	return firstErr
+}
+
+/*
+Select the instance of a message: the instance listing the path the message was received on, or else the instance with
+the best match for the repository of the message. Returns nil for the default instance
+*/
+func selectKabaneroInstance(message map[string]interface{}) *kabaneroInstance {
+	instancesMutex.RLock()
+	defer instancesMutex.RUnlock()
+	if len(kabaneroInstances) == 0 {
+		return nil
+	}
+	if sourcePath, _ := message[SOURCEPATH].(string); sourcePath != "" {
+		for _, instance := range kabaneroInstances {
+			if instance.paths[sourcePath] {
+				return instance
+			}
+		}
+	}
+	return repositoryInstance(messageRepositoryURL(message))
+}
+
+/* Return the instance with the best match for a repository, or nil if none. instancesMutex must be locked */
+func repositoryInstance(repoURL string) *kabaneroInstance {
+	if repoURL == "" {
+		return nil
+	}
+	var best *kabaneroInstance
+	bestPrecedence, bestLength := 0, 0
+	for _, instance := range kabaneroInstances {
+		for _, pattern := range instance.repositories {
+			matched, precedence := pattern.match(repoURL)
+			if matched && (best == nil || precedence < bestPrecedence || (precedence == bestPrecedence && pattern.length > bestLength)) {
+				best, bestPrecedence, bestLength = instance, precedence, pattern.length
+			}
+		}
+	}
+	return best
+}
+
+/* Return the namespace of the instance of a repository, whose secrets are used to access it */
+func repositoryNamespace(repoURL string) string {
+	instancesMutex.RLock()
+	defer instancesMutex.RUnlock()
+	if instance := repositoryInstance(repoURL); instance != nil {
+		return instance.namespace
+	}
+	return webhookNamespace
+}
+
+/* Load the instances, and watch the git secrets of their namespaces */
+func initializeKabaneroInstances(dynInterf dynamic.Interface) error {
+	for _, namespace := range instanceNamespaces()[1:] {
+		go watchGitSecrets(dynInterf, namespace)
+	}
+	return refreshKabaneroInstances(dynInterf)
+}
+
+/* Watch the Kabanero CRs of the instance namespaces, and refresh the instances when they change. Does not return */
+func watchKabaneroInstances(dynInterf dynamic.Interface) {
+	changes := make(chan struct{}, 1)
+	for _, namespace := range instanceNamespaces() {
+		go watchCRDConfigResource(dynInterf, kabanerosGVR, namespace, changes)
+	}
+	for range changes {
+		time.Sleep(crdConfigSettleDelay)
+		if err := refreshKabaneroInstances(dynInterf); err != nil {
+			klog.Errorf("Unable to refresh the Kabanero instances: %v", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+func newKabaneroCR(namespace string, name string, indexURL string, annotations map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": KABANEROIO + "/" + V1ALPHA1,
+		"kind":       "Kabanero",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace, ANNOTATIONS: annotations},
+		SPEC: map[string]interface{}{COLLECTIONS: map[string]interface{}{REPOSITORIES: []interface{}{
+			map[string]interface{}{ACTIVATEDEFAULTCOLLECTIONS: true, URL: indexURL},
+		}}},
+	}
+}
+
+func TestKabaneroInstances(t *testing.T) {
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chkSum, err := sha256sum(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index *httptest.Server
+	index = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/triggers.tar.gz":
+			writer.Write(archive)
+		default:
+			fmt.Fprintf(writer, "triggers:\n - url: %s/triggers.tar.gz\n   sha256: %s\n", index.URL, chkSum)
+		}
+	}))
+	defer index.Close()
+
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/kabaneros/a-default": newKabaneroCR("kabanero", "a-default", index.URL+"/default.yaml", nil),
+		"/apis/kabanero.io/v1alpha1/namespaces/kabanero/kabaneros/b-team-a": newKabaneroCR("kabanero", "b-team-a", index.URL+"/team-a.yaml", map[string]interface{}{
+			eventsPathsAnnotation: "team-a",
+		}),
+		"/apis/kabanero.io/v1alpha1/namespaces/team-b/kabaneros/kabanero": newKabaneroCR("team-b", "kabanero", index.URL+"/team-b.yaml", map[string]interface{}{
+			eventsRepositoriesAnnotation: "https://github.com/team-b/*, https://github.com/shared/team-b",
+		}),
+		"/apis/kabanero.io/v1alpha1/namespaces/team-b/kabaneros/empty": {
+			"apiVersion": KABANEROIO + "/" + V1ALPHA1, "kind": "Kabanero",
+			"metadata": map[string]interface{}{"name": "empty", "namespace": "team-b"},
+		},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	savedNamespace, savedNamespaces, savedInstances, savedDelay := webhookNamespace, kabaneroNamespaces, kabaneroInstances, retireCollectionDelay
+	defer func() {
+		for _, instance := range kabaneroInstances {
+			os.RemoveAll(instance.proc.triggerDir)
+		}
+		webhookNamespace, kabaneroNamespaces, kabaneroInstances, retireCollectionDelay = savedNamespace, savedNamespaces, savedInstances, savedDelay
+	}()
+	webhookNamespace, kabaneroNamespaces, kabaneroInstances, retireCollectionDelay = "kabanero", "team-b, kabanero", nil, 50*time.Millisecond
+
+	if err = refreshKabaneroInstances(client); err != nil {
+		t.Fatal(err)
+	}
+	if len(kabaneroInstances) != 2 || kabaneroInstances[0].name != "b-team-a" || kabaneroInstances[1].namespace != "team-b" {
+		t.Fatalf("unexpected instances %v", kabaneroInstances)
+	}
+	teamA, teamB := kabaneroInstances[0], kabaneroInstances[1]
+	if teamB.proc.name != "team-b/kabanero" || teamB.proc.kabaneroNamespace() != "team-b" || teamA.proc.kabaneroNamespace() != "kabanero" {
+		t.Fatalf("unexpected collections %v and %v", teamA.proc.name, teamB.proc.name)
+	}
+	config := (&triggerEval{tp: teamB.proc}).kabaneroConfigCEL().Value().(map[string]interface{})
+	if config[NAMESPACE] != "team-b" {
+		t.Fatalf("unexpected kabaneroConfig %v", config)
+	}
+
+	/* messages are routed by listener path, then by repository */
+	message := canaryTestMessage("https://github.com/team-b/service")
+	if instance := selectKabaneroInstance(message); instance != teamB {
+		t.Fatalf("repository routed to %v", instance)
+	}
+	message[SOURCEPATH] = "/team-a"
+	if instance := selectKabaneroInstance(message); instance != teamA {
+		t.Fatalf("listener path routed to %v", instance)
+	}
+	if instance := selectKabaneroInstance(canaryTestMessage("https://github.com/shared/other")); instance != nil {
+		t.Fatalf("unrouted repository routed to %v", instance)
+	}
+	if namespace := repositoryNamespace("https://github.com/shared/team-b.git"); namespace != "team-b" {
+		t.Fatalf("secrets of repository looked up in namespace %v", namespace)
+	}
+
+	/* unchanged collections are kept, and those of deleted instances removed */
+	delete(fake.objects, "/apis/kabanero.io/v1alpha1/namespaces/kabanero/kabaneros/b-team-a")
+	if err = refreshKabaneroInstances(client); err != nil {
+		t.Fatal(err)
+	}
+	if len(kabaneroInstances) != 1 || kabaneroInstances[0].proc != teamB.proc {
+		t.Fatalf("unexpected instances %v", kabaneroInstances)
+	}
+	if _, err = os.Stat(teamA.proc.triggerDir); err != nil {
+		t.Fatalf("the directory of a deleted instance was removed while it may be in use: %v", err)
+	}
+	waitFor(t, func() bool { _, err = os.Stat(teamA.proc.triggerDir); return os.IsNotExist(err) })
+}
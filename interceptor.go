@@ -0,0 +1,209 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Tekton interceptor mode. With -interceptor, /interceptor accepts the requests that Tekton Triggers EventListeners send
+to ClusterInterceptors, so that Tekton users can reuse kabanero trigger collections. The body and headers of the event
+are evaluated as a message by the triggers of the event source named by the eventSource interceptor parameter, github
+by default, in dry-run: no action is executed, since the EventListener creates the resources. The EventListener
+continues if a trigger would have executed an action, and the variables set by the triggers are returned in the
+kabanero extension, for example as $(extensions.kabanero.variables.branch) in TriggerBindings. The variables whose
+value may come from the Kubernetes functions are not returned, since they may hold the values of Secrets, and the
+requests must carry the bearer token in the environment variable INTERCEPTOR_TOKEN.
+*/
+
+const (
+	INTERCEPTORTOKEN = "INTERCEPTOR_TOKEN" // environment variable containing the bearer token required by the interceptor
+
+	interceptorPath              = "/interceptor"
+	interceptorExtension         = "kabanero"
+	interceptorEventSource       = "eventSource"
+	defaultInterceptorMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,interceptorAuth"
+
+	/* the gRPC status codes of interceptor responses */
+	interceptorCodeOK                 = 0
+	interceptorCodeInvalidArgument    = 3
+	interceptorCodeFailedPrecondition = 9
+	interceptorCodeInternal           = 13
+)
+
+var (
+	interceptorMode       bool   // serve the Tekton interceptor endpoint
+	interceptorMiddleware string // comma separated middleware chain of the Tekton interceptor endpoint
+)
+
+/* The request sent by Tekton EventListeners to interceptors */
+type interceptorRequest struct {
+	Body              string                 `json:"body"`
+	Header            map[string][]string    `json:"header"`
+	Extensions        map[string]interface{} `json:"extensions"`
+	InterceptorParams map[string]interface{} `json:"interceptor_params"`
+	Context           *struct {
+		EventURL  string `json:"event_url"`
+		EventID   string `json:"event_id"`
+		TriggerID string `json:"trigger_id"`
+	} `json:"context"`
+}
+
+type interceptorStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+/* The response of interceptors to Tekton EventListeners */
+type interceptorResponse struct {
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+	Continue   bool                   `json:"continue"`
+	Status     interceptorStatus      `json:"status"`
+}
+
+/*
+Middleware verifying the bearer token of interceptor requests against the token in the environment variable
+INTERCEPTOR_TOKEN. Unlike the webhook endpoints, requests are rejected if the variable is not set, since the responses
+contain the variables of the triggers.
+*/
+func interceptorAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		token := os.Getenv(INTERCEPTORTOKEN)
+		auth := req.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeInvalidToken, "invalid token")
+			return
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* Evaluate an interceptor request with the triggers of the active collection */
+func intercept(request *interceptorRequest) *interceptorResponse {
+	eventSource := WEBHOOKDESTINATION
+	if value, ok := request.InterceptorParams[interceptorEventSource]; ok {
+		name, ok := value.(string)
+		if !ok || name == "" {
+			return &interceptorResponse{Status: interceptorStatus{Code: interceptorCodeInvalidArgument, Message: "the eventSource parameter is not a name"}}
+		}
+		eventSource = name
+	}
+	var body interface{}
+	if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+		return &interceptorResponse{Status: interceptorStatus{Code: interceptorCodeInvalidArgument, Message: fmt.Sprintf("the body of the event is not JSON: %v", err)}}
+	}
+	header := request.Header
+	if header == nil {
+		header = make(map[string][]string)
+	}
+	message := map[string]interface{}{
+		HEADER: header,
+		BODY:   body,
+	}
+	if request.Context != nil && request.Context.EventID != "" {
+		message[EVENTID] = request.Context.EventID
+	} else {
+		message[EVENTID] = newEventID(http.Header(header))
+	}
+	if request.Extensions != nil {
+		message["extensions"] = request.Extensions
+	}
+
+	triggerProc, _, _ := currentCollections()
+	if triggerProc == nil || triggerProc.triggerDef == nil {
+		return &interceptorResponse{Status: interceptorStatus{Code: interceptorCodeInternal, Message: "no trigger collection is loaded"}}
+	}
+	result, err := triggerProc.evaluateMessage(message, eventSource, evalOptions{dryrun: true})
+	if err != nil {
+		return &interceptorResponse{Status: interceptorStatus{Code: interceptorCodeInternal, Message: err.Error()}}
+	}
+
+	/* the variables of all triggers, except those holding the message itself, or values read from Kubernetes */
+	variables := make(map[string]interface{})
+	for _, triggerVariables := range result.variables {
+		for name, value := range triggerVariables {
+			if result.kubeVariables[name] {
+				continue
+			}
+			if valueMap, ok := value.(map[string]interface{}); ok && reflect.ValueOf(valueMap).Pointer() == reflect.ValueOf(message).Pointer() {
+				continue
+			}
+			variables[name] = value
+		}
+	}
+	response := &interceptorResponse{
+		Extensions: map[string]interface{}{
+			interceptorExtension: map[string]interface{}{
+				"triggers":  result.triggers,
+				"actions":   result.actions,
+				"variables": variables,
+			},
+		},
+		Continue: len(result.actions) > 0,
+		Status:   interceptorStatus{Code: interceptorCodeOK},
+	}
+	if !response.Continue {
+		response.Status = interceptorStatus{Code: interceptorCodeFailedPrecondition, Message: "no kabanero trigger matched the event"}
+	}
+	return response
+}
+
+/* POST /interceptor evaluates a Tekton interceptor request */
+func interceptorHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	incrementMetric("interceptor.requests")
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	request := &interceptorRequest{}
+	if err = json.Unmarshal(data, request); err != nil {
+		writeError(writer, req, codeBadRequest, fmt.Sprintf("the request is not an interceptor request: %v", err))
+		return
+	}
+	response := intercept(request)
+	if response.Status.Code == interceptorCodeInternal {
+		incrementMetric("interceptor.errors")
+		klog.Errorf("Unable to evaluate the interceptor request of trigger %v: %v", requestTriggerID(request), response.Status.Message)
+	} else if klog.V(4) {
+		klog.Infof("Interceptor request of trigger %v: continue %v", requestTriggerID(request), response.Continue)
+	}
+	writeJSON(writer, response)
+}
+
+/* Return the Tekton trigger of an interceptor request */
+func requestTriggerID(request *interceptorRequest) string {
+	if request.Context == nil {
+		return ""
+	}
+	return request.Context.TriggerID
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+func TestInterceptorHandler(t *testing.T) {
+	savedProc := triggerProc
+	defer func() { triggerProc = savedProc }()
+	triggerProc = newTriggerProcessor()
+	if err := triggerProc.initialize("test_data/trigger15"); err != nil {
+		t.Fatal(err)
+	}
+
+	for ref, expected := range map[string]bool{"refs/heads/master": true, "refs/heads/feature": false} {
+		request := `{"body": "{\"ref\": \"` + ref + `\"}", "header": {"X-Github-Event": ["push"]}, "context": {"event_id": "abc", "trigger_id": "namespaces/default/triggers/kabanero"}}`
+		req := httptest.NewRequest(http.MethodPost, interceptorPath, strings.NewReader(request))
+		recorder := httptest.NewRecorder()
+		interceptorHandler(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("interceptor returned %v: %s", recorder.Code, recorder.Body.String())
+		}
+		response := &interceptorResponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Continue != expected {
+			t.Fatalf("continue is %v for %v: %+v", response.Continue, ref, response)
+		}
+		extension := response.Extensions[interceptorExtension].(map[string]interface{})
+		variables := extension["variables"].(map[string]interface{})
+		if variables["branch"] != strings.TrimPrefix(ref, "refs/heads/") || variables[MESSAGE] != nil {
+			t.Fatalf("unexpected variables %v", variables)
+		}
+		if expected && response.Status.Code != interceptorCodeOK || !expected && response.Status.Code != interceptorCodeFailedPrecondition {
+			t.Fatalf("unexpected status %+v for %v", response.Status, ref)
+		}
+	}
+}
+
+func TestInterceptInvalidRequests(t *testing.T) {
+	for _, request := range []*interceptorRequest{
+		{Body: "not json"},
+		{Body: "{}", InterceptorParams: map[string]interface{}{interceptorEventSource: 1}},
+	} {
+		if response := intercept(request); response.Continue || response.Status.Code != interceptorCodeInvalidArgument {
+			t.Errorf("unexpected response %+v to %+v", response, request)
+		}
+	}
+}
+
+func TestInterceptorAuthMiddleware(t *testing.T) {
+	savedToken, hadToken := os.LookupEnv(INTERCEPTORTOKEN)
+	defer func() {
+		if hadToken {
+			os.Setenv(INTERCEPTORTOKEN, savedToken)
+		} else {
+			os.Unsetenv(INTERCEPTORTOKEN)
+		}
+	}()
+	handler := interceptorAuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+	for _, test := range []struct {
+		token         string
+		authorization string
+		code          int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer other", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	} {
+		os.Setenv(INTERCEPTORTOKEN, test.token)
+		req := httptest.NewRequest(http.MethodPost, interceptorPath, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.code {
+			t.Errorf("token %q and authorization %q returned %v, expected %v", test.token, test.authorization, recorder.Code, test.code)
+		}
+	}
+}
+
+func TestInterceptKubeVariables(t *testing.T) {
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		"/api/v1/namespaces/kabanero/secrets/registry": {
+			"apiVersion": V1, "kind": "Secret",
+			"metadata": map[string]interface{}{"name": "registry", "namespace": "kabanero"},
+			"data":     map[string]interface{}{"password": "c2VjcmV0"},
+		},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	savedClient, savedSecrets, savedProc := dynamicClient, kubeSecrets, triggerProc
+	defer func() {
+		dynamicClient, kubeSecrets, triggerProc = savedClient, savedSecrets, savedProc
+		kubeCache = make(map[string]*kubeCachedObject)
+	}()
+	dynamicClient = dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+	kubeSecrets = "kabanero/registry"
+	kubeCache = make(map[string]*kubeCachedObject)
+
+	dir, err := ioutil.TempDir("", "interceptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	collection := `eventTriggers:
+  - eventSource: github
+    input: message
+    body:
+      - branch: 'split(message.body.ref, "/")[2]'
+      - password: 'kube.getSecretKey("kabanero", "registry", "password")'
+      - credentials: '"admin:" + password'
+`
+	if err = ioutil.WriteFile(filepath.Join(dir, "triggers.yaml"), []byte(collection), 0600); err != nil {
+		t.Fatal(err)
+	}
+	triggerProc = newTriggerProcessor()
+	if err = triggerProc.initialize(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	/* the values read from Kubernetes, and those computed from them, are not returned */
+	response := intercept(&interceptorRequest{Body: `{"ref": "refs/heads/master"}`})
+	extension := response.Extensions[interceptorExtension].(map[string]interface{})
+	variables := extension["variables"].(map[string]interface{})
+	if variables["branch"] != "master" || variables["password"] != nil || variables["credentials"] != nil {
+		t.Fatalf("unexpected variables %v", variables)
+	}
+}
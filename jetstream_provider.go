@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"k8s.io/klog"
+)
+
+// The JetStream provider sends and receives messages through a stream of a NATS server with JetStream, so that events
+// survive restarts of kabanero-events, and can be replayed. The topics of event destinations are subjects of the
+// stream, and messages are only sent once the stream acknowledged them. Event sources are received through durable
+// pull consumers, one per event source, and messages are acknowledged once they are processed, so that messages that
+// were not processed are delivered again, up to maxDeliver times. The JetStream API is used through NATS requests on
+// its $JS.API subjects.
+
+const (
+	jetStreamAPIPrefix = "$JS.API."
+	jetStreamAckPrefix = "$JS.ACK."
+	jetStreamAck       = "+ACK"
+
+	defaultJetStreamTimeout = 5 * time.Second
+	defaultJetStreamDurable = "kabanero-events"
+	jetStreamNotFound       = 404
+)
+
+type jetstreamProvider struct {
+	natsProvider
+	mutex     sync.Mutex
+	consumers map[string]string // durable consumers, by eventSource
+}
+
+// An error returned by the JetStream API.
+type jetStreamError struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+}
+
+func (err *jetStreamError) Error() string {
+	return fmt.Sprintf("%s (%d)", err.Description, err.Code)
+}
+
+// The configuration of a stream, as expected by the JetStream API.
+type jetStreamConfig struct {
+	Name      string   `json:"name"`
+	Subjects  []string `json:"subjects,omitempty"`
+	Retention string   `json:"retention"`
+	Storage   string   `json:"storage"`
+	MaxAge    int64    `json:"max_age,omitempty"`
+	MaxMsgs   int64    `json:"max_msgs,omitempty"`
+	MaxBytes  int64    `json:"max_bytes,omitempty"`
+	Replicas  int      `json:"num_replicas,omitempty"`
+}
+
+// The configuration of a durable consumer, as expected by the JetStream API.
+type jetStreamConsumerConfig struct {
+	Durable       string `json:"durable_name"`
+	DeliverPolicy string `json:"deliver_policy"`
+	AckPolicy     string `json:"ack_policy"`
+	AckWait       int64  `json:"ack_wait,omitempty"`
+	MaxDeliver    int    `json:"max_deliver,omitempty"`
+	FilterSubject string `json:"filter_subject,omitempty"`
+}
+
+func (provider *jetstreamProvider) initialize(mpd *MessageProviderDefinition) error {
+	js := mpd.JetStream
+	if js == nil || js.Stream == "" {
+		return fmt.Errorf("JetStream provider '%s' has no jetStream stream", mpd.Name)
+	}
+	if !oneOf(js.Retention, "", "limits", "interest", "workqueue") {
+		return fmt.Errorf("retention '%s' of JetStream provider '%s' is not limits, interest or workqueue", js.Retention, mpd.Name)
+	}
+	if !oneOf(js.Storage, "", "file", "memory") {
+		return fmt.Errorf("storage '%s' of JetStream provider '%s' is not file or memory", js.Storage, mpd.Name)
+	}
+	if !oneOf(js.DeliverPolicy, "", "all", "new", "last") {
+		return fmt.Errorf("deliverPolicy '%s' of JetStream provider '%s' is not all, new or last", js.DeliverPolicy, mpd.Name)
+	}
+	if err := provider.natsProvider.initialize(mpd); err != nil {
+		return err
+	}
+	provider.consumers = make(map[string]string)
+	if err := provider.ensureStream(); err != nil {
+		provider.connection.Close()
+		return err
+	}
+	return nil
+}
+
+func oneOf(value string, values ...string) bool {
+	for _, v := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (provider *jetstreamProvider) timeout() time.Duration {
+	if provider.messageProviderDefinition.Timeout > 0 {
+		return provider.messageProviderDefinition.Timeout
+	}
+	return defaultJetStreamTimeout
+}
+
+// Send a request to the JetStream API, and decode its response.
+func (provider *jetstreamProvider) apiRequest(subject string, request interface{}, response interface{}) error {
+	var data []byte
+	if request != nil {
+		var err error
+		if data, err = json.Marshal(request); err != nil {
+			return err
+		}
+	}
+	msg, err := provider.connection.Request(jetStreamAPIPrefix+subject, data, provider.timeout())
+	if err != nil {
+		return fmt.Errorf("JetStream API %s of provider '%s' failed: %v", subject, provider.messageProviderDefinition.Name, err)
+	}
+	return decodeJetStreamResponse(msg.Data, response)
+}
+
+// Decode a response of JetStream, returning the error it holds, if any.
+func decodeJetStreamResponse(data []byte, response interface{}) error {
+	result := struct {
+		Error *jetStreamError `json:"error,omitempty"`
+	}{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("unable to decode JetStream response %s: %v", data, err)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(data, response)
+}
+
+// Return the configuration of the stream of a provider.
+func newJetStreamConfig(js *JetStreamDefinition) *jetStreamConfig {
+	config := &jetStreamConfig{
+		Name:      js.Stream,
+		Subjects:  js.Subjects,
+		Retention: js.Retention,
+		Storage:   js.Storage,
+		MaxAge:    int64(js.MaxAge),
+		MaxMsgs:   js.MaxMsgs,
+		MaxBytes:  js.MaxBytes,
+		Replicas:  js.Replicas,
+	}
+	if config.Retention == "" {
+		config.Retention = "limits"
+	}
+	if config.Storage == "" {
+		config.Storage = "file"
+	}
+	return config
+}
+
+// Create or update the stream of the provider. Without subjects, the stream is managed outside of kabanero-events.
+func (provider *jetstreamProvider) ensureStream() error {
+	js := provider.messageProviderDefinition.JetStream
+	err := provider.apiRequest("STREAM.INFO."+js.Stream, nil, nil)
+	if len(js.Subjects) == 0 {
+		if err != nil {
+			return fmt.Errorf("stream %s of JetStream provider '%s' is not available: %v", js.Stream, provider.messageProviderDefinition.Name, err)
+		}
+		return nil
+	}
+	operation := "UPDATE"
+	if apiErr, ok := err.(*jetStreamError); ok && apiErr.Code == jetStreamNotFound {
+		operation = "CREATE"
+	} else if err != nil {
+		return err
+	}
+	if err = provider.apiRequest("STREAM."+operation+"."+js.Stream, newJetStreamConfig(js), nil); err != nil {
+		return fmt.Errorf("unable to %s stream %s of JetStream provider '%s': %v", strings.ToLower(operation), js.Stream, provider.messageProviderDefinition.Name, err)
+	}
+	if klog.V(4) {
+		klog.Infof("JetStream provider '%s': %sd stream %s for subjects %v", provider.messageProviderDefinition.Name, strings.ToLower(operation), js.Stream, js.Subjects)
+	}
+	return nil
+}
+
+// Return the name of the durable consumer of an eventSource. Durable names may not contain dots, wildcards or spaces.
+func jetStreamDurableName(prefix string, eventSource string) string {
+	if prefix == "" {
+		prefix = defaultJetStreamDurable
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t':
+			return '-'
+		}
+		return r
+	}, prefix+"-"+eventSource)
+}
+
+// Subscribe to an eventSource by creating its durable consumer, which is kept when kabanero-events restarts.
+func (provider *jetstreamProvider) Subscribe(node *EventNode) error {
+	js := provider.messageProviderDefinition.JetStream
+	durable := jetStreamDurableName(js.Durable, node.Name)
+	deliverPolicy := js.DeliverPolicy
+	if deliverPolicy == "" {
+		deliverPolicy = "all"
+	}
+	request := map[string]interface{}{
+		"stream_name": js.Stream,
+		"config": &jetStreamConsumerConfig{
+			Durable:       durable,
+			DeliverPolicy: deliverPolicy,
+			AckPolicy:     "explicit",
+			AckWait:       int64(js.AckWait),
+			MaxDeliver:    js.MaxDeliver,
+			FilterSubject: node.Topic,
+		},
+	}
+	if err := provider.apiRequest("CONSUMER.DURABLE.CREATE."+js.Stream+"."+durable, request, nil); err != nil {
+		return fmt.Errorf("unable to create consumer %s of JetStream provider '%s': %v", durable, provider.messageProviderDefinition.Name, err)
+	}
+	if klog.V(6) {
+		klog.Infof("Subscribed to JetStream stream %s subject %s with durable consumer %s", js.Stream, node.Topic, durable)
+	}
+	provider.mutex.Lock()
+	provider.consumers[node.Name] = durable
+	provider.mutex.Unlock()
+	return nil
+}
+
+// Send a message to an eventDestination, returning once the stream acknowledged it.
+func (provider *jetstreamProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	if klog.V(6) {
+		klog.Infof("jetstreamProvider: Sending %s", string(payload))
+	}
+	msg, err := provider.connection.Request(node.Topic, payload, provider.timeout())
+	if err != nil {
+		return fmt.Errorf("jetstreamProvider Send to %v failed: %v", node.Topic, err)
+	}
+	ack := struct {
+		Stream string `json:"stream"`
+		Seq    uint64 `json:"seq"`
+	}{}
+	if err = decodeJetStreamResponse(msg.Data, &ack); err != nil {
+		return fmt.Errorf("jetstreamProvider Send to %v failed: %v", node.Topic, err)
+	}
+	if klog.V(8) {
+		klog.Infof("jetstreamProvider: message stored in stream %s as %d", ack.Stream, ack.Seq)
+	}
+	return nil
+}
+
+// Fetch the next message of the consumer of an eventSource. Returns nats.ErrTimeout if there is none.
+func (provider *jetstreamProvider) next(node *EventNode) (*nats.Msg, error) {
+	provider.mutex.Lock()
+	durable, ok := provider.consumers[node.Name]
+	provider.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no subscription for eventSource '%s'. It should be defined and Subscribed to", node.Name)
+	}
+	js := provider.messageProviderDefinition.JetStream
+	timeout := provider.timeout()
+	request, _ := json.Marshal(map[string]interface{}{"batch": 1, "expires": int64(timeout)})
+	msg, err := provider.connection.Request(jetStreamAPIPrefix+"CONSUMER.MSG.NEXT."+js.Stream+"."+durable, request, timeout+time.Second)
+	if err != nil {
+		return nil, err
+	}
+	/* the status sent when the request expires without a message has no acknowledgement subject */
+	if !strings.HasPrefix(msg.Reply, jetStreamAckPrefix) {
+		return nil, nats.ErrTimeout
+	}
+	return msg, nil
+}
+
+// Receive a message from an eventSource, acknowledging it at once.
+func (provider *jetstreamProvider) Receive(node *EventNode) ([]byte, error) {
+	msg, err := provider.next(node)
+	if err != nil {
+		return nil, err
+	}
+	if err = provider.connection.Publish(msg.Reply, []byte(jetStreamAck)); err != nil {
+		klog.Errorf("Unable to acknowledge JetStream message of eventSource '%s': %v", node.Name, err)
+	}
+	return msg.Data, nil
+}
+
+// ListenAndServe listens for new events on some eventSource and calls the ReceiverFunc on the message payload.
+// Messages are acknowledged once the ReceiverFunc returns.
+func (provider *jetstreamProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	js := provider.messageProviderDefinition.JetStream
+	if klog.V(5) {
+		klog.Infof("jetstreamProvider: Starting to listen for events of stream %s subject %s", js.Stream, node.Topic)
+	}
+	for {
+		provider.mutex.Lock()
+		_, subscribed := provider.consumers[node.Name]
+		provider.mutex.Unlock()
+		if !subscribed {
+			if err := provider.Subscribe(node); err != nil {
+				klog.Error(err)
+				time.Sleep(provider.timeout())
+				continue
+			}
+		}
+		msg, err := provider.next(node)
+		if err == nats.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			klog.Errorf("Unable to receive JetStream messages of eventSource '%s': %v", node.Name, err)
+			if err == nats.ErrConnectionClosed {
+				return
+			}
+			time.Sleep(provider.timeout())
+			continue
+		}
+		if klog.V(8) {
+			klog.Infof("Received message on stream %s subject %s: %s", js.Stream, msg.Subject, msg.Data)
+		}
+		receiver(msg.Data)
+		if err = provider.connection.Publish(msg.Reply, []byte(jetStreamAck)); err != nil {
+			klog.Errorf("Unable to acknowledge JetStream message of eventSource '%s': %v", node.Name, err)
+		}
+	}
+}
+
+func init() {
+	RegisterMessageProvider("jetstream", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newJetStreamProvider(mpd)
+	})
+}
+
+func newJetStreamProvider(mpd *MessageProviderDefinition) (*jetstreamProvider, error) {
+	provider := new(jetstreamProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
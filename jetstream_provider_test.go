@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJetStreamProviderValidation(t *testing.T) {
+	for _, js := range []*JetStreamDefinition{
+		nil,
+		{},
+		{Stream: "events", Retention: "forever"},
+		{Stream: "events", Storage: "disk"},
+		{Stream: "events", DeliverPolicy: "latest"},
+	} {
+		if _, err := newJetStreamProvider(&MessageProviderDefinition{Name: "js", ProviderType: "jetstream", URL: "nats://127.0.0.1:1", JetStream: js}); err == nil {
+			t.Errorf("jetStream %+v was accepted", js)
+		}
+	}
+}
+
+func TestDecodeJetStreamResponse(t *testing.T) {
+	ack := struct {
+		Stream string `json:"stream"`
+		Seq    uint64 `json:"seq"`
+	}{}
+	if err := decodeJetStreamResponse([]byte(`{"stream": "events", "seq": 42}`), &ack); err != nil || ack.Stream != "events" || ack.Seq != 42 {
+		t.Fatalf("unexpected acknowledgement %+v: %v", ack, err)
+	}
+	err := decodeJetStreamResponse([]byte(`{"error": {"code": 404, "description": "stream not found"}}`), nil)
+	if apiErr, ok := err.(*jetStreamError); !ok || apiErr.Code != jetStreamNotFound {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = decodeJetStreamResponse([]byte("+OK"), nil); err == nil {
+		t.Fatal("an invalid response was decoded")
+	}
+}
+
+func TestJetStreamConfig(t *testing.T) {
+	config := newJetStreamConfig(&JetStreamDefinition{Stream: "events", Subjects: []string{"github"}, MaxAge: 24 * time.Hour})
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"name":"events","subjects":["github"],"retention":"limits","storage":"file","max_age":86400000000000}` {
+		t.Fatalf("unexpected stream configuration %s", data)
+	}
+	if name := jetStreamDurableName("", "github.push *"); name != "kabanero-events-github-push--" {
+		t.Fatalf("unexpected durable name %v", name)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Bounded decoding of JSON request bodies. The body is decoded token by token as it is read, instead of being read
+completely first, so that a body that is too deeply nested is rejected as soon as the limit is reached, and decoding
+stops when the context of the request is done. The time to read the body is limited with a read deadline on the
+connection, as closing the body of a request does not interrupt a read blocked on a client sending it slowly.
+*/
+
+var (
+	maxJSONDepth    int           // maximum nesting of objects and arrays in a JSON request body
+	bodyReadTimeout time.Duration // time allowed to read and decode a request body
+
+	errJSONTooDeep = errors.New("JSON nested too deeply")
+)
+
+/* Key of the context value holding the body read deadline of the requests whose deadline is set */
+type bodyDeadlineKey struct{}
+
+/* A request body clearing the read deadline of its connection once it has been read */
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	once       sync.Once
+}
+
+/*
+Read the body. Once it is read completely, the deadline is cleared, so that it does not interrupt the processing of the
+request. It is kept after other errors, as the connection is not reused.
+*/
+func (body *deadlineBody) Read(buf []byte) (int, error) {
+	n, err := body.ReadCloser.Read(buf)
+	if err == io.EOF {
+		body.once.Do(func() { body.controller.SetReadDeadline(time.Time{}) })
+	}
+	return n, err
+}
+
+/*
+Limit the time to read the body of a request to -bodyReadTimeout, with a read deadline on its connection: reads of a
+body that is not sent in time fail with os.ErrDeadlineExceeded. The deadline is set once per request, by the sizeLimit
+middleware or when the body is decoded, and cleared once the body is read. Returns the request unchanged if the
+writer does not support deadlines.
+*/
+func limitBodyReadTime(writer http.ResponseWriter, req *http.Request) *http.Request {
+	if bodyReadTimeout <= 0 || req.Body == nil || req.Body == http.NoBody || req.Context().Value(bodyDeadlineKey{}) != nil {
+		return req
+	}
+	controller := http.NewResponseController(writer)
+	deadline := time.Now().Add(bodyReadTimeout)
+	if err := controller.SetReadDeadline(deadline); err != nil {
+		return req
+	}
+	req = req.WithContext(context.WithValue(req.Context(), bodyDeadlineKey{}, deadline))
+	req.Body = &deadlineBody{ReadCloser: req.Body, controller: controller}
+	return req
+}
+
+/* Return the read deadline of the body of a request, and whether it is set */
+func bodyReadDeadline(req *http.Request) (time.Time, bool) {
+	deadline, ok := req.Context().Value(bodyDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+/*
+Return whether reading the body of a request failed because it was not read in time. Once the read deadline of the
+connection is reached, the server may cancel the context of the request before the read fails, so a canceled
+context after the deadline counts as a timeout too.
+*/
+func bodyReadTimedOut(req *http.Request, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	deadline, ok := bodyReadDeadline(req)
+	return ok && errors.Is(err, context.Canceled) && !time.Now().Before(deadline)
+}
+
+/* A JSON decoder that checks the depth of nesting and the context of the request */
+type boundedDecoder struct {
+	ctx      context.Context
+	decoder  *json.Decoder
+	maxDepth int
+}
+
+/*
+Decode a JSON object from a reader. The reader is closed if the context is done before decoding completes, which
+interrupts readers such as pipes; the bodies of requests are interrupted by their read deadline instead.
+*/
+func decodeJSONObject(ctx context.Context, body io.ReadCloser, maxDepth int) (map[string]interface{}, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			body.Close()
+		case <-done:
+		}
+	}()
+
+	bd := &boundedDecoder{ctx: ctx, decoder: json.NewDecoder(body), maxDepth: maxDepth}
+	value, err := bd.decodeValue(0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("JSON body is not an object, but %T", value)
+	}
+	if bd.decoder.More() {
+		return nil, fmt.Errorf("unexpected data after JSON object")
+	}
+	return object, nil
+}
+
+/* Decode the next value. Numbers are decoded as float64, like json.Unmarshal does. */
+func (bd *boundedDecoder) decodeValue(depth int) (interface{}, error) {
+	if err := bd.ctx.Err(); err != nil {
+		return nil, err
+	}
+	token, err := bd.decoder.Token()
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		return token, nil
+	}
+	if depth+1 > bd.maxDepth && bd.maxDepth > 0 {
+		return nil, errJSONTooDeep
+	}
+	switch delim {
+	case '{':
+		object := make(map[string]interface{})
+		for bd.decoder.More() {
+			keyToken, err := bd.decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := keyToken.(string)
+			if !ok {
+				return nil, fmt.Errorf("JSON object key %v is not a string", keyToken)
+			}
+			value, err := bd.decodeValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = value
+		}
+		if _, err := bd.decoder.Token(); err != nil {
+			return nil, err
+		}
+		return object, nil
+	case '[':
+		array := make([]interface{}, 0)
+		for bd.decoder.More() {
+			value, err := bd.decodeValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		if _, err := bd.decoder.Token(); err != nil {
+			return nil, err
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("unexpected JSON delimiter %v", delim)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeJSONObject(t *testing.T) {
+	ctx := context.Background()
+	object, err := decodeJSONObject(ctx, ioutil.NopCloser(strings.NewReader(`{"a": [1, {"b": "c"}], "d": null, "e": true}`)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	array := object["a"].([]interface{})
+	if array[0] != float64(1) || array[1].(map[string]interface{})["b"] != "c" || object["d"] != nil || object["e"] != true {
+		t.Fatalf("unexpected decoded object: %v", object)
+	}
+
+	tests := []string{
+		`{"a": [1, {"b": "c"}]}extra`,
+		`[1, 2]`,
+		`{"a": `,
+		`{"a": [[[[1]]]]}`,
+	}
+	for _, test := range tests {
+		if _, err = decodeJSONObject(ctx, ioutil.NopCloser(strings.NewReader(test)), 3); err == nil {
+			t.Errorf("expected error decoding %v", test)
+		}
+	}
+	if _, err = decodeJSONObject(ctx, ioutil.NopCloser(strings.NewReader(`{"a": [[[[1]]]]}`)), 3); err != errJSONTooDeep {
+		t.Errorf("expected error for depth, got %v", err)
+	}
+}
+
+func TestDecodeJSONObjectTimeout(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	go writer.Write([]byte(`{"a": `))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := decodeJSONObject(ctx, reader, 10)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected timeout decoding slow body, got %v", err)
+	}
+}
+
+func TestReadWebhookBodyStalled(t *testing.T) {
+	savedTimeout := bodyReadTimeout
+	defer func() { bodyReadTimeout = savedTimeout }()
+	bodyReadTimeout = 100 * time.Millisecond
+
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if _, ok := readWebhookBody(writer, req); ok {
+			writer.WriteHeader(http.StatusOK)
+		}
+	})
+	/* the deadline is set through the writers of the middlewares */
+	for name, h := range map[string]http.Handler{"handler": handler, "middleware": metricsMiddleware(sizeLimitMiddleware(handler))} {
+		server := httptest.NewServer(h)
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		/* the body is never completed */
+		fmt.Fprintf(conn, "POST /webhook HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"a\": ")
+		start := time.Now()
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if response.StatusCode != http.StatusRequestTimeout || time.Since(start) > 2*time.Second {
+			t.Errorf("%v: stalled body returned %v after %v", name, response.StatusCode, time.Since(start))
+		}
+		conn.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// The kafka-rest provider talks to Kafka through the v2 API of a Kafka REST Proxy, whose URL is the URL of the
+// messageProvider. It does not connect to the brokers: the brokers, and the SASL settings used to reach them, are
+// those configured in the proxy.
+
+const (
+	kafkaV2ContentType     = "application/vnd.kafka.v2+json"
+	kafkaBinaryContentType = "application/vnd.kafka.binary.v2+json"
+	kafkaPollInterval      = time.Second
+)
+
+// A record produced to, or consumed from, Kafka. Values are base64 encoded by the proxy.
+type kafkaRecord struct {
+	Value []byte `json:"value"`
+}
+
+// A consumer instance created in the proxy for an eventSource.
+type kafkaConsumer struct {
+	baseURI string
+	mutex   sync.Mutex // held by Receive while it reads and refills pending
+	pending [][]byte   // records received but not yet returned by Receive
+}
+
+type kafkaProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	client                    *http.Client
+	password                  string
+	mutex                     sync.Mutex
+	consumers                 map[string]*kafkaConsumer
+}
+
+func (provider *kafkaProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	provider.consumers = make(map[string]*kafkaConsumer)
+	if mpd.PasswordEnv != "" {
+		provider.password = os.Getenv(mpd.PasswordEnv)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: mpd.SkipTLSVerify}
+	if mpd.CAFile != "" {
+		caCert, err := ioutil.ReadFile(mpd.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the CA certificate of Kafka provider '%s': %v", mpd.Name, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in %s for Kafka provider '%s'", mpd.CAFile, mpd.Name)
+		}
+	}
+	if mpd.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(mpd.CertFile, mpd.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load the client certificate of Kafka provider '%s': %v", mpd.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	provider.client = &http.Client{Transport: withUserAgent(&http.Transport{TLSClientConfig: tlsConfig})}
+	return nil
+}
+
+// Send a request to the proxy with a JSON body if not nil, decoding the JSON response into result if not nil.
+func (provider *kafkaProvider) request(method string, url string, contentType string, body interface{}, result interface{}, timeout time.Duration) error {
+	payload := []byte{}
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", kafkaV2ContentType)
+	} else {
+		/* the format of the records returned by polls is given by the accepted content type */
+		req.Header.Set("Accept", contentType)
+	}
+	if provider.messageProviderDefinition.Username != "" {
+		req.SetBasicAuth(provider.messageProviderDefinition.Username, provider.password)
+	}
+
+	client := *provider.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("kafkaProvider %s %s failed with http status %v: %s", method, url, resp.Status, string(responseBody))
+	}
+	if result != nil && len(responseBody) > 0 {
+		return json.Unmarshal(responseBody, result)
+	}
+	return nil
+}
+
+// Timeout of requests other than polls.
+func (provider *kafkaProvider) requestTimeout() time.Duration {
+	timeout := provider.messageProviderDefinition.Timeout
+	if timeout <= 0 || timeout > 30*time.Second {
+		timeout = 30 * time.Second
+	}
+	return timeout
+}
+
+// Subscribe to a topic, with a new consumer instance in the consumer group of the provider.
+func (provider *kafkaProvider) Subscribe(node *EventNode) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if _, ok := provider.consumers[node.Name]; ok {
+		return nil
+	}
+	mpd := provider.messageProviderDefinition
+	group := mpd.ConsumerGroup
+	if group == "" {
+		group = "kabanero-events"
+	}
+	if klog.V(6) {
+		klog.Infof("Subscribing to Kafka provider on %s:%s with consumer group %s", mpd.URL, node.Topic, group)
+	}
+
+	url := strings.TrimSuffix(mpd.URL, "/")
+	request := map[string]string{"name": node.Name + "-" + newRequestID(), "format": "binary", "auto.offset.reset": "latest"}
+	var instance struct {
+		InstanceID string `json:"instance_id"`
+		BaseURI    string `json:"base_uri"`
+	}
+	err := provider.request("POST", url+"/consumers/"+group, kafkaV2ContentType, request, &instance, provider.requestTimeout())
+	if err != nil {
+		return err
+	}
+	if instance.BaseURI == "" {
+		return fmt.Errorf("kafkaProvider: proxy did not return the base URI of consumer %s", instance.InstanceID)
+	}
+	subscription := map[string][]string{"topics": {node.Topic}}
+	err = provider.request("POST", instance.BaseURI+"/subscription", kafkaV2ContentType, subscription, nil, provider.requestTimeout())
+	if err != nil {
+		return err
+	}
+	provider.consumers[node.Name] = &kafkaConsumer{baseURI: instance.BaseURI}
+	return nil
+}
+
+// Poll the records available for a consumer, waiting for up to timeout.
+func (provider *kafkaProvider) poll(consumer *kafkaConsumer, timeout time.Duration) ([][]byte, error) {
+	url := fmt.Sprintf("%s/records?timeout=%d", consumer.baseURI, timeout.Nanoseconds()/int64(time.Millisecond))
+	records := make([]kafkaRecord, 0)
+	err := provider.request("GET", url, kafkaBinaryContentType, nil, &records, timeout+provider.requestTimeout())
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, 0, len(records))
+	for _, record := range records {
+		values = append(values, record.Value)
+	}
+	return values, nil
+}
+
+// Send a message to the topic of an eventDestination.
+func (provider *kafkaProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	if klog.V(6) {
+		klog.Infof("kafkaProvider: Sending %s", string(payload))
+	}
+	url := strings.TrimSuffix(provider.messageProviderDefinition.URL, "/") + "/topics/" + node.Topic
+	records := map[string][]kafkaRecord{"records": {{Value: payload}}}
+	var response struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	err := provider.request("POST", url, kafkaBinaryContentType, records, &response, provider.requestTimeout())
+	if err != nil {
+		return err
+	}
+	for _, offset := range response.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("kafkaProvider: unable to send to topic %s: %s", node.Topic, offset.Error)
+		}
+	}
+	return nil
+}
+
+// Receive a message from an eventSource. The timeout can be configured by setting the timeout on the messageProvider.
+func (provider *kafkaProvider) Receive(node *EventNode) ([]byte, error) {
+	provider.mutex.Lock()
+	consumer, ok := provider.consumers[node.Name]
+	provider.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no subscription for eventSource '%s'. It should be defined and Subscribed to", node.Name)
+	}
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	if len(consumer.pending) == 0 {
+		values, err := provider.poll(consumer, provider.messageProviderDefinition.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		consumer.pending = values
+	}
+	if len(consumer.pending) == 0 {
+		return nil, fmt.Errorf("kafkaProvider: timed out receiving from topic %s", node.Topic)
+	}
+	value := consumer.pending[0]
+	consumer.pending = consumer.pending[1:]
+	return value, nil
+}
+
+// ListenAndServe listens for new events on some eventSource and calls the ReceiverFunc on the message payload.
+func (provider *kafkaProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	urlAndTopic := fmt.Sprintf("%s:%s", provider.messageProviderDefinition.URL, node.Topic)
+	if klog.V(5) {
+		klog.Infof("kafkaProvider: Starting to listen for Kafka events from %s", urlAndTopic)
+	}
+	for {
+		if err := provider.Subscribe(node); err != nil {
+			klog.Errorf("unable to set up listener for Kafka events for %s: %v", urlAndTopic, err)
+			time.Sleep(kafkaPollInterval)
+			continue
+		}
+		provider.mutex.Lock()
+		consumer := provider.consumers[node.Name]
+		provider.mutex.Unlock()
+
+		values, err := provider.poll(consumer, kafkaPollInterval)
+		if err != nil {
+			klog.Errorf("unable to receive Kafka events from %s: %v", urlAndTopic, err)
+			/* the proxy drops idle consumer instances. Subscribe again with a new one. */
+			provider.mutex.Lock()
+			delete(provider.consumers, node.Name)
+			provider.mutex.Unlock()
+			time.Sleep(kafkaPollInterval)
+			continue
+		}
+		for _, value := range values {
+			if klog.V(8) {
+				klog.Infof("Received message on %s: %s", urlAndTopic, value)
+			}
+			receiver(value)
+		}
+	}
+}
+
+func init() {
+	RegisterMessageProvider("kafka-rest", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newKafkaProvider(mpd)
+	})
+}
+
+func newKafkaProvider(mpd *MessageProviderDefinition) (*kafkaProvider, error) {
+	provider := new(kafkaProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
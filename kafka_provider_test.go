@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* A minimal Kafka REST Proxy that keeps the records of each topic in memory */
+type fakeKafkaProxy struct {
+	mutex  sync.Mutex
+	topics map[string][][]byte
+	topic  string // topic subscribed to by the consumer
+	read   int    // records of the topic already returned to the consumer
+	server *httptest.Server
+}
+
+func (proxy *fakeKafkaProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if user, password, ok := req.BasicAuth(); !ok || user != "kabanero" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/topics/"):
+		var records map[string][]kafkaRecord
+		json.NewDecoder(req.Body).Decode(&records)
+		topic := strings.TrimPrefix(req.URL.Path, "/topics/")
+		for _, record := range records["records"] {
+			proxy.topics[topic] = append(proxy.topics[topic], record.Value)
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":0}]}`))
+	case req.Method == "POST" && req.URL.Path == "/consumers/ci":
+		w.Write([]byte(`{"instance_id":"c1","base_uri":"` + proxy.server.URL + `/consumers/ci/instances/c1"}`))
+	case req.Method == "POST" && req.URL.Path == "/consumers/ci/instances/c1/subscription":
+		var subscription map[string][]string
+		json.NewDecoder(req.Body).Decode(&subscription)
+		proxy.topic = subscription["topics"][0]
+		w.WriteHeader(http.StatusNoContent)
+	case req.Method == "GET" && req.URL.Path == "/consumers/ci/instances/c1/records":
+		if req.Header.Get("Accept") != kafkaBinaryContentType {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		records := make([]kafkaRecord, 0)
+		for _, value := range proxy.topics[proxy.topic][proxy.read:] {
+			records = append(records, kafkaRecord{Value: value})
+		}
+		proxy.read = len(proxy.topics[proxy.topic])
+		json.NewEncoder(w).Encode(records)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestKafkaProvider(t *testing.T) {
+	proxy := &fakeKafkaProxy{topics: make(map[string][][]byte)}
+	proxy.server = httptest.NewServer(proxy)
+	defer proxy.server.Close()
+
+	const passwordEnv = "KAFKA_PROVIDER_TEST_PASSWORD"
+	os.Setenv(passwordEnv, "secret")
+	defer os.Unsetenv(passwordEnv)
+	mpd := &MessageProviderDefinition{Name: "kafka", ProviderType: "kafka-rest", URL: proxy.server.URL, Timeout: time.Second,
+		ConsumerGroup: "ci", Username: "kabanero", PasswordEnv: passwordEnv}
+	provider, err := newKafkaProvider(mpd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &EventNode{Name: "kafka-dest", Topic: "github", ProviderRef: "kafka"}
+
+	if _, err = provider.Receive(node); err == nil {
+		t.Fatal("expected error receiving without a subscription")
+	}
+	if err = provider.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{`{"a":1}`, `{"b":2}`} {
+		if err = provider.Send(node, []byte(payload), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []string{`{"a":1}`, `{"b":2}`} {
+		received, err := provider.Receive(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(received) != expected {
+			t.Fatalf("received %s, expected %s", received, expected)
+		}
+	}
+	if _, err = provider.Receive(node); err == nil {
+		t.Fatal("expected error receiving from an empty topic")
+	}
+
+	/* the proxy rejects requests with wrong credentials */
+	mpd.Username = "other"
+	if err = provider.Send(node, []byte(`{}`), nil); err == nil {
+		t.Fatal("expected error sending with wrong credentials")
+	}
+}
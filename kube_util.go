@@ -18,7 +18,6 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"strings"
 
@@ -43,6 +42,7 @@ const (
 	PASSWORD                   = "password"
 	TOKEN                      = "token"
 	SECRETS                    = "secrets"
+	CONFIGMAPS                 = "configmaps"
 	SPEC                       = "spec"
 	COLLECTIONS                = "collections"
 	REPOSITORIES               = "repositories"
@@ -69,9 +69,10 @@ data:
   username:  <base64 encoded user name>
   token: <base64 encoded token>
 
- If the url in the secret is a prefix of repoURL, and username and token are defined, then return the user and token.
+ If a URL pattern of the annotations of the secret matches repoURL, and username and token are defined, then return
+ the user and token. The URL patterns and their precedence are described in secrets.go.
  Return user, token, error.
- TODO: Change to controller pattern and cache the secrets.
+ The secrets are looked up in the cache of the secrets once it is loaded.
 
 Return: username, token, secret name, error
 */
@@ -79,143 +80,18 @@ func getURLAPIToken(dynInterf dynamic.Interface, namespace string, repoURL strin
 	if klog.V(5) {
 		klog.Infof("getURLAPIToken namespace: %s, repoURL: %s", namespace, repoURL)
 	}
-	gvr := schema.GroupVersionResource{
-		Group:    "",
-		Version:  V1,
-		Resource: SECRETS,
+	if cache := secretsCacheFor(namespace); cache.isSyncedFor(namespace) {
+		return cache.lookup(repoURL)
 	}
-	var intfNoNS = dynInterf.Resource(gvr)
-	var intf dynamic.ResourceInterface
-	intf = intfNoNS.Namespace(namespace)
 
-	// fetch the current resource
-	var unstructuredList *unstructured.UnstructuredList
-	var err error
-	unstructuredList, err = intf.List(metav1.ListOptions{})
+	/* the cache is not loaded yet: fetch the current secrets */
+	unstructuredList, err := secretsInterface(dynInterf, namespace).List(metav1.ListOptions{})
 	if err != nil {
 		return "", "", "", err
 	}
-
-	for _, unstructuredObj := range unstructuredList.Items {
-		var objMap = unstructuredObj.Object
-
-		metadataObj, ok := objMap[METADATA]
-		if !ok {
-			continue
-		}
-
-		metadata, ok := metadataObj.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		annotationsObj, ok := metadata[ANNOTATIONS]
-		if !ok {
-			continue
-		}
-
-		annotations, ok := annotationsObj.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		tektonList := make([]string,0)
-		kabaneroList := make([]string, 0)
-		for key, val := range annotations {
-			if strings.HasPrefix(key, "kabanero.io/git-") {
-				url, ok := val.(string)
-				if ok {
-					kabaneroList = append(kabaneroList, url)
-				}
-			} else if strings.HasPrefix(key, "tekton.dev/git-") {
-				url, ok := val.(string)
-				if ok {
-					tektonList = append(tektonList, url)
-				}
-			}
-		}
-
-		/* find that annotation that is a match */
-		urlMatched, matchedURL := matchPrefix(repoURL, kabaneroList) 
-		if !urlMatched {
-			urlMatched, matchedURL = matchPrefix(repoURL, tektonList) 
-		}
-		if !urlMatched {
-			/* no match */
-			continue
-		}
-		if klog.V(5) {
-			klog.Infof("getURLAPIToken found match %v", matchedURL)
-		}
-		
-
-        nameObj, ok := metadata["name"]
-        if !ok {
-            continue
-        }
-        name, ok := nameObj.(string)
-        if !ok {
-            continue
-        } 
-
-		dataMapObj, ok := objMap[DATA]
-		if !ok {
-			continue
-		}
-
-		dataMap, ok := dataMapObj.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		usernameObj, ok := dataMap[USERNAME]
-		if !ok {
-			continue
-		}
-		username, ok := usernameObj.(string)
-		if !ok {
-			continue
-		}
-
-		tokenObj, ok := dataMap[PASSWORD]
-		if !ok {
-			continue
-		}
-		token, ok := tokenObj.(string)
-		if !ok {
-			continue
-		}
-
-		decodedUserName, err := base64.StdEncoding.DecodeString(username)
-		if err != nil {
-			return "", "", "", err
-		}
-
-		decodedToken, err := base64.StdEncoding.DecodeString(token)
-		if err != nil {
-			return "", "", "", err
-		}
-		return string(decodedUserName), string(decodedToken), name,  nil
-	}
-	return "", "", "", fmt.Errorf("Unable to find API token for url: %s", repoURL)
-}
-
-
-/* 
- Input:
-	str: input string
-	arrStr: input array of string
- Return: 
-	true if any element of arrStr is a prefix of str
-	the first element of arrStr that is a prefix of str
- */
-func matchPrefix(str string, arrStr [] string) (bool, string) {
-	for _, val := range arrStr  {
-		if strings.HasPrefix(str, val) {
-			return true, val
-		}
-	}
-	return false, ""
+	listed := newSecretsCache()
+	listed.replace(namespace, unstructuredList.Items)
+	return listed.lookup(repoURL)
 }
 
 
@@ -246,97 +122,105 @@ func getKabaneroIndexURL(dynInterf dynamic.Interface, namespace string) (string,
 	}
 
 	for _, unstructuredObj := range unstructuredList.Items {
+		if url := kabaneroCollectionURL(unstructuredObj); url != "" {
+			return url, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find collection url in kabanero custom resource for namespace %s", namespace)
+}
+
+/* Return the URL of the active default collection of a kabanero CRD instance, or empty string if none */
+func kabaneroCollectionURL(unstructuredObj unstructured.Unstructured) string {
+	if klog.V(5) {
+		klog.Infof("Processing kabanero CRD instance: %v", unstructuredObj)
+	}
+	var objMap = unstructuredObj.Object
+	specMapObj, ok := objMap[SPEC]
+	if !ok {
 		if klog.V(5) {
-			klog.Infof("Processing kabanero CRD instance: %v", unstructuredObj)
+			klog.Infof("    kabanero CRD instance: has no spec section. Skipping")
 		}
-		var objMap = unstructuredObj.Object
-		specMapObj, ok := objMap[SPEC]
-		if !ok {
-			if klog.V(5) {
-				klog.Infof("    kabanero CRD instance: has no spec section. Skipping")
-			}
-			continue
+		return ""
+	}
+
+	specMap, ok := specMapObj.(map[string]interface{})
+	if !ok {
+		if klog.V(5) {
+			klog.Infof("    kabanero CRD instance: spec section is type %T. Skipping", specMapObj)
 		}
+		return ""
+	}
 
-		specMap, ok := specMapObj.(map[string]interface{})
-		if !ok {
-			if klog.V(5) {
-				klog.Infof("    kabanero CRD instance: spec section is type %T. Skipping", specMapObj)
-			}
-			continue
+	collectionsMapObj, ok := specMap[COLLECTIONS]
+	if !ok {
+		if klog.V(5) {
+			klog.Infof("    kabanero CRD instance: spec section has no collections section. Skipping")
+		}
+		return ""
+	}
+	collectionMap, ok := collectionsMapObj.(map[string]interface{})
+	if !ok {
+		if klog.V(5) {
+			klog.Infof("    kabanero CRD instance: collections type is %T. Skipping", collectionsMapObj)
 		}
+		return ""
+	}
 
-		collectionsMapObj, ok := specMap[COLLECTIONS]
-		if !ok {
-			if klog.V(5) {
-				klog.Infof("    kabanero CRD instance: spec section has no collections section. Skipping")
-			}
-			continue
+	repositoriesInterface, ok := collectionMap[REPOSITORIES]
+	if !ok {
+		if klog.V(5) {
+			klog.Infof("    kabanero CRD instance: collections section has no repositories section. Skipping")
 		}
-		collectionMap, ok := collectionsMapObj.(map[string]interface{})
+		return ""
+	}
+	repositoriesArray, ok := repositoriesInterface.([]interface{})
+	if !ok {
+		if klog.V(5) {
+			klog.Infof("    kabanero CRD instance: repositories  type is %T. Skipping", repositoriesInterface)
+		}
+		return ""
+	}
+	for index, elementObj := range repositoriesArray {
+		elementMap, ok := elementObj.(map[string]interface{})
 		if !ok {
 			if klog.V(5) {
-				klog.Infof("    kabanero CRD instance: collections type is %T. Skipping", collectionsMapObj)
+				klog.Infof("    kabanero CRD instance repositories index %d, types is %T. Skipping", index, elementObj)
 			}
 			continue
 		}
-
-		repositoriesInterface, ok := collectionMap[REPOSITORIES]
+		activeDefaultCollectionsObj, ok := elementMap[ACTIVATEDEFAULTCOLLECTIONS]
 		if !ok {
 			if klog.V(5) {
-				klog.Infof("    kabanero CRD instance: collections section has no repositories section. Skipping")
+				klog.Infof("    kabanero CRD instance: index %d, activeDefaultCollection not set. Skipping", index)
 			}
 			continue
 		}
-		repositoriesArray, ok := repositoriesInterface.([]interface{})
+		active, ok := activeDefaultCollectionsObj.(bool)
 		if !ok {
 			if klog.V(5) {
-				klog.Infof("    kabanero CRD instance: repositories  type is %T. Skipping", repositoriesInterface)
+				klog.Infof("    kabanero CRD instance index %d, activeDefaultCollection, types is %T. Skipping", index, activeDefaultCollectionsObj)
 			}
 			continue
 		}
-		for index, elementObj := range repositoriesArray {
-			elementMap, ok := elementObj.(map[string]interface{})
-			if !ok {
-				if klog.V(5) {
-					klog.Infof("    kabanero CRD instance repositories index %d, types is %T. Skipping", index, elementObj)
-				}
-				continue
-			}
-			activeDefaultCollectionsObj, ok := elementMap[ACTIVATEDEFAULTCOLLECTIONS]
+		if active {
+			urlObj, ok := elementMap[URL]
 			if !ok {
 				if klog.V(5) {
-					klog.Infof("    kabanero CRD instance: index %d, activeDefaultCollection not set. Skipping", index)
+					klog.Infof("    kabanero CRD instance: index %d, url set. Skipping", index)
 				}
 				continue
 			}
-			active, ok := activeDefaultCollectionsObj.(bool)
+			url, ok := urlObj.(string)
 			if !ok {
 				if klog.V(5) {
-					klog.Infof("    kabanero CRD instance index %d, activeDefaultCollection, types is %T. Skipping", index, activeDefaultCollectionsObj)
+					klog.Infof("    kabanero CRD instance index %d, url type is %T. Skipping", index, url)
 				}
 				continue
 			}
-			if active {
-				urlObj, ok := elementMap[URL]
-				if !ok {
-					if klog.V(5) {
-						klog.Infof("    kabanero CRD instance: index %d, url set. Skipping", index)
-					}
-					continue
-				}
-				url, ok := urlObj.(string)
-				if !ok {
-					if klog.V(5) {
-						klog.Infof("    kabanero CRD instance index %d, url type is %T. Skipping", index, url)
-					}
-					continue
-				}
-				return url, nil
-			}
+			return url
 		}
 	}
-	return "", fmt.Errorf("Unable to find collection url in kabanero custom resource for namespace %s", namespace)
+	return ""
 }
 
 /* @Return true if character is valid for a domain name */
@@ -0,0 +1,261 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/parser"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+/*
+Kubernetes functions of triggers. kube.getConfigMap returns the data of a ConfigMap, and kube.getSecretKey a key of a
+Secret, so that triggers render resources with the configuration of the cluster, such as the target environment or the
+defaults of pipelines, rather than with values copied into the collection. The functions are sandboxed: only the
+ConfigMaps matching -kubeConfigMaps and the Secrets matching -kubeSecrets may be read, so that a collection can not
+read the credentials of the cluster. The objects read are cached for kubeFunctionsCacheTTL, so that a burst of events
+does not read them for each event. Since the names may come from the messages, at most maxKubeCacheEntries objects are
+cached.
+*/
+
+const (
+	KUBE                  = "kube"
+	kubeFunctionsCacheTTL = 30 * time.Second
+	maxKubeCacheEntries   = 1000 // objects cached, the expired and then those expiring first are forgotten beyond
+)
+
+var (
+	kubeConfigMaps string // comma separated namespace/name patterns of the ConfigMaps triggers may read
+	kubeSecrets    string // comma separated namespace/name or namespace/name/key patterns of the Secrets triggers may read
+)
+
+/* A cached ConfigMap or Secret */
+type kubeCachedObject struct {
+	data    map[string]interface{}
+	err     error
+	expires time.Time
+}
+
+var (
+	kubeCacheMutex sync.Mutex
+	kubeCache      = make(map[string]*kubeCachedObject) // by resource/namespace/name
+)
+
+/*
+Parser macros mapping the calls of kube.getConfigMap and kube.getSecretKey to the namespaced functions. Other calls of
+getConfigMap and getSecretKey are kept as they are, and fail to check as undeclared.
+*/
+var triggerMacros = cel.Macros(
+	parser.NewReceiverMacro("getConfigMap", 2, kubeFunctionMacro("getConfigMap")),
+	parser.NewReceiverMacro("getSecretKey", 3, kubeFunctionMacro("getSecretKey")))
+
+func kubeFunctionMacro(function string) parser.MacroExpander {
+	return func(eh parser.ExprHelper, target *exprpb.Expr, args []*exprpb.Expr) (*exprpb.Expr, *common.Error) {
+		if target.GetIdentExpr().GetName() == KUBE {
+			return eh.GlobalCall(KUBE+"."+function, args...), nil
+		}
+		return eh.ReceiverCall(function, target, args...), nil
+	}
+}
+
+/* Return whether namespace/name, or one of the longer paths, matches a pattern of a comma separated allowlist */
+func kubeAllowed(allowlist string, paths ...string) bool {
+	for _, pattern := range strings.Split(allowlist, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		for _, p := range paths {
+			if matched, _ := path.Match(pattern, p); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Return the data of a ConfigMap or Secret, reading it if it is not cached. The cache is not locked while reading, so that
+the evaluations do not wait for each other's reads.
+*/
+func readKubeData(resource string, namespace string, name string) (map[string]interface{}, error) {
+	key := resource + "/" + namespace + "/" + name
+	kubeCacheMutex.Lock()
+	cached, ok := kubeCache[key]
+	kubeCacheMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.data, cached.err
+	}
+	if dynamicClient == nil {
+		return nil, fmt.Errorf("the Kubernetes API is not available")
+	}
+	gvr := schema.GroupVersionResource{Group: "", Version: V1, Resource: resource}
+	cached = &kubeCachedObject{}
+	obj, err := dynamicClient.Resource(gvr).Namespace(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		incrementMetric("kubeFunctions.errors")
+		cached.err = err
+	} else {
+		cached.data, _ = obj.Object[DATA].(map[string]interface{})
+	}
+
+	now := time.Now()
+	cached.expires = now.Add(kubeFunctionsCacheTTL)
+	kubeCacheMutex.Lock()
+	defer kubeCacheMutex.Unlock()
+	if _, ok := kubeCache[key]; !ok && len(kubeCache) >= maxKubeCacheEntries {
+		sweepKubeCache(now)
+	}
+	kubeCache[key] = cached
+	return cached.data, cached.err
+}
+
+/* Forget the expired objects, and the one expiring first if there are still too many. Called with kubeCacheMutex held */
+func sweepKubeCache(now time.Time) {
+	var firstKey string
+	var first time.Time
+	for key, cached := range kubeCache {
+		if !now.Before(cached.expires) {
+			delete(kubeCache, key)
+		} else if firstKey == "" || cached.expires.Before(first) {
+			firstKey, first = key, cached.expires
+		}
+	}
+	if len(kubeCache) >= maxKubeCacheEntries {
+		delete(kubeCache, firstKey)
+	}
+}
+
+/* kube.getConfigMap for CEL, counting the reads of the evaluation */
+func (ev *triggerEval) kubeGetConfigMapCEL(namespaceVal ref.Val, nameVal ref.Val) ref.Val {
+	ev.kubeReads++
+	return kubeGetConfigMapCEL(namespaceVal, nameVal)
+}
+
+/* kube.getSecretKey for CEL, counting the reads of the evaluation */
+func (ev *triggerEval) kubeGetSecretKeyCEL(values ...ref.Val) ref.Val {
+	ev.kubeReads++
+	return kubeGetSecretKeyCEL(values...)
+}
+
+/* Remember that the value of a variable, and of the variable holding it if it is nested, may come from Kubernetes */
+func (ev *triggerEval) markKubeVariable(name string) {
+	if ev.kubeVariables == nil {
+		ev.kubeVariables = make(map[string]bool)
+	}
+	ev.kubeVariables[strings.Split(name, ".")[0]] = true
+}
+
+/* Return whether a checked expression refers to a variable whose value may come from Kubernetes */
+func (ev *triggerEval) usesKubeVariables(checked cel.Ast) bool {
+	if len(ev.kubeVariables) == 0 {
+		return false
+	}
+	checkedExpr, err := cel.AstToCheckedExpr(checked)
+	if err != nil {
+		return true
+	}
+	for _, reference := range checkedExpr.GetReferenceMap() {
+		if ev.kubeVariables[strings.Split(reference.GetName(), ".")[0]] {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return the namespace and name parameters of a Kubernetes function */
+func kubeObjectParams(function string, namespaceVal ref.Val, nameVal ref.Val) (string, string, ref.Val) {
+	namespace, ok := namespaceVal.(types.String)
+	if !ok {
+		return "", "", types.ValOrErr(namespaceVal, "unexpected type '%v' passed as first parameter to function %s", namespaceVal.Type(), function)
+	}
+	name, ok := nameVal.(types.String)
+	if !ok {
+		return "", "", types.ValOrErr(nameVal, "unexpected type '%v' passed as second parameter to function %s", nameVal.Type(), function)
+	}
+	return string(namespace), string(name), nil
+}
+
+/* implementation of kube.getConfigMap for CEL */
+func kubeGetConfigMapCEL(namespaceVal ref.Val, nameVal ref.Val) ref.Val {
+	namespace, name, errVal := kubeObjectParams("kube.getConfigMap", namespaceVal, nameVal)
+	if errVal != nil {
+		return errVal
+	}
+	if !kubeAllowed(kubeConfigMaps, namespace+"/"+name) {
+		incrementMetric("kubeFunctions.denied")
+		klog.Warningf("Trigger denied reading ConfigMap %s/%s, which is not allowed by -kubeConfigMaps", namespace, name)
+		return types.NewErr("kube.getConfigMap: ConfigMap %s/%s is not allowed by -kubeConfigMaps", namespace, name)
+	}
+	data, err := readKubeData(CONFIGMAPS, namespace, name)
+	if err != nil {
+		return types.NewErr("kube.getConfigMap: %v", err)
+	}
+	ret := make(map[string]string)
+	for key, value := range data {
+		if str, ok := value.(string); ok {
+			ret[key] = str
+		}
+	}
+	return types.NewStringStringMap(types.DefaultTypeAdapter, ret)
+}
+
+/* implementation of kube.getSecretKey for CEL */
+func kubeGetSecretKeyCEL(values ...ref.Val) ref.Val {
+	if len(values) != 3 {
+		return types.NewErr("unexpected number of parameters %v passed to function kube.getSecretKey", len(values))
+	}
+	namespace, name, errVal := kubeObjectParams("kube.getSecretKey", values[0], values[1])
+	if errVal != nil {
+		return errVal
+	}
+	key, ok := values[2].(types.String)
+	if !ok {
+		return types.ValOrErr(values[2], "unexpected type '%v' passed as third parameter to function kube.getSecretKey", values[2].Type())
+	}
+	if !kubeAllowed(kubeSecrets, namespace+"/"+name, namespace+"/"+name+"/"+string(key)) {
+		incrementMetric("kubeFunctions.denied")
+		klog.Warningf("Trigger denied reading key %s of Secret %s/%s, which is not allowed by -kubeSecrets", key, namespace, name)
+		return types.NewErr("kube.getSecretKey: key %s of Secret %s/%s is not allowed by -kubeSecrets", key, namespace, name)
+	}
+	data, err := readKubeData(SECRETS, namespace, name)
+	if err != nil {
+		return types.NewErr("kube.getSecretKey: %v", err)
+	}
+	encoded, ok := data[string(key)].(string)
+	if !ok {
+		return types.NewErr("kube.getSecretKey: Secret %s/%s has no key %s", namespace, name, key)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return types.NewErr("kube.getSecretKey: key %s of Secret %s/%s is not base64: %v", key, namespace, name, err)
+	}
+	return types.String(decoded)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+func TestKubeFunctionsCEL(t *testing.T) {
+	fake := &fakeObjectServer{objects: map[string]map[string]interface{}{
+		"/api/v1/namespaces/kabanero/configmaps/pipeline-defaults": {
+			"apiVersion": V1, "kind": "ConfigMap",
+			"metadata": map[string]interface{}{"name": "pipeline-defaults", "namespace": "kabanero"},
+			"data":     map[string]interface{}{"environment": "staging", "timeout": "1h"},
+		},
+		"/api/v1/namespaces/kabanero/configmaps/other": {
+			"apiVersion": V1, "kind": "ConfigMap",
+			"metadata": map[string]interface{}{"name": "other", "namespace": "kabanero"},
+			"data":     map[string]interface{}{"environment": "production"},
+		},
+		"/api/v1/namespaces/kabanero/secrets/registry": {
+			"apiVersion": V1, "kind": "Secret",
+			"metadata": map[string]interface{}{"name": "registry", "namespace": "kabanero"},
+			"data":     map[string]interface{}{"host": "cmVnaXN0cnkuZXhhbXBsZS5jb20=", "password": "c2VjcmV0"},
+		},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	savedClient, savedConfigMaps, savedSecrets := dynamicClient, kubeConfigMaps, kubeSecrets
+	defer func() {
+		dynamicClient, kubeConfigMaps, kubeSecrets = savedClient, savedConfigMaps, savedSecrets
+		kubeCache = make(map[string]*kubeCachedObject)
+	}()
+	dynamicClient = dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+	kubeConfigMaps, kubeSecrets = "kabanero/pipeline-*, team-a/*", "kabanero/registry/host"
+	kubeCache = make(map[string]*kubeCachedObject)
+
+	variables, err := evaluateFunctionsTrigger([]interface{}{
+		map[interface{}]interface{}{"environment": `kube.getConfigMap("kabanero", "pipeline-defaults").environment`},
+		map[interface{}]interface{}{"registry": `kube.getSecretKey("kabanero", "registry", "host")`},
+	}, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variables["environment"] != "staging" || variables["registry"] != "registry.example.com" {
+		t.Fatalf("unexpected variables %v", variables)
+	}
+
+	/* objects and keys that are not allowed are errors, and are not read */
+	for _, expression := range []string{
+		`kube.getConfigMap("kabanero", "other")`,
+		`kube.getSecretKey("kabanero", "registry", "password")`,
+		`kube.getConfigMap("team-a", "missing")`,
+		`kube.getSecretKey("kabanero", "registry", "")`,
+	} {
+		_, err = evaluateFunctionsTrigger([]interface{}{map[interface{}]interface{}{"result": expression}}, map[string]interface{}{})
+		if err == nil {
+			t.Errorf("expression %s was evaluated", expression)
+		} else if strings.Contains(err.Error(), "c2VjcmV0") {
+			t.Errorf("error of expression %s contains the value of the secret: %v", expression, err)
+		}
+	}
+
+	/* other receivers of the function names are not Kubernetes functions */
+	if _, err = evaluateFunctionsTrigger([]interface{}{map[interface{}]interface{}{"result": `message.getConfigMap("kabanero", "pipeline-defaults")`}}, map[string]interface{}{}); err == nil {
+		t.Error("getConfigMap of a message was evaluated")
+	}
+
+	/* the objects are cached */
+	fake.mutex.Lock()
+	delete(fake.objects, "/api/v1/namespaces/kabanero/configmaps/pipeline-defaults")
+	fake.mutex.Unlock()
+	if variables, err = evaluateFunctionsTrigger([]interface{}{
+		map[interface{}]interface{}{"timeout": `kube.getConfigMap("kabanero", "pipeline-defaults").timeout`},
+	}, map[string]interface{}{}); err != nil || variables["timeout"] != "1h" {
+		t.Fatalf("unexpected variables %v: %v", variables, err)
+	}
+}
+
+func TestKubeAllowed(t *testing.T) {
+	for _, test := range []struct {
+		allowlist string
+		paths     []string
+		allowed   bool
+	}{
+		{"", []string{"kabanero/config"}, false},
+		{"kabanero/config", []string{"kabanero/config"}, true},
+		{"kabanero/*", []string{"kabanero/config"}, true},
+		{"kabanero/*", []string{"kabanero-dev/config"}, false},
+		{"kabanero/registry", []string{"kabanero/registry", "kabanero/registry/password"}, true},
+		{"kabanero/registry/host", []string{"kabanero/registry", "kabanero/registry/password"}, false},
+		{"team-*/config, kabanero/registry/*", []string{"kabanero/registry", "kabanero/registry/password"}, true},
+	} {
+		if kubeAllowed(test.allowlist, test.paths...) != test.allowed {
+			t.Errorf("paths %v allowed by %q is not %v", test.paths, test.allowlist, test.allowed)
+		}
+	}
+}
+
+func TestKubeCacheBound(t *testing.T) {
+	server := httptest.NewServer(&fakeObjectServer{objects: map[string]map[string]interface{}{}})
+	defer server.Close()
+	savedClient := dynamicClient
+	defer func() {
+		dynamicClient = savedClient
+		kubeCache = make(map[string]*kubeCachedObject)
+	}()
+	dynamicClient = dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+
+	/* expired objects are forgotten when the cache is full */
+	kubeCache = make(map[string]*kubeCachedObject)
+	for i := 0; i < maxKubeCacheEntries; i++ {
+		kubeCache[fmt.Sprintf("configmaps/kabanero/expired%d", i)] = &kubeCachedObject{expires: time.Now().Add(-time.Second)}
+	}
+	readKubeData("configmaps", "kabanero", "missing")
+	if _, ok := kubeCache["configmaps/kabanero/missing"]; !ok || len(kubeCache) != 1 {
+		t.Fatalf("expired objects were kept: %v objects", len(kubeCache))
+	}
+
+	/* otherwise, the object expiring first is forgotten */
+	kubeCache = make(map[string]*kubeCachedObject)
+	for i := 0; i < maxKubeCacheEntries; i++ {
+		kubeCache[fmt.Sprintf("configmaps/kabanero/cached%d", i)] = &kubeCachedObject{expires: time.Now().Add(time.Duration(i+1) * time.Second)}
+	}
+	readKubeData("configmaps", "kabanero", "missing")
+	if _, ok := kubeCache["configmaps/kabanero/cached0"]; ok || len(kubeCache) != maxKubeCacheEntries {
+		t.Fatalf("cache not bounded: %v objects", len(kubeCache))
+	}
+	if _, ok := kubeCache["configmaps/kabanero/missing"]; !ok {
+		t.Fatal("object read was not cached")
+	}
+}
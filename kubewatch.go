@@ -0,0 +1,236 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Kubernetes watchers. A watcher watches the core/v1 Events, or the resources of any kind, of the kubeWatchers of
+eventDefinitions.yaml, filtered by namespace and by label and field selectors, and sends a message to its
+eventDestination for each change, so that triggers may react to things such as failed PipelineRuns or pods in crash
+loops as they react to webhooks. The resources that exist when a watcher starts are only listed, so that no messages
+are sent for them. A watch that ends is resumed from the last resource version seen, and the resources are listed
+again without sending messages if that version has expired.
+*/
+
+const (
+	kubeWatchRetryDelay = 30 * time.Second
+	kindEvent           = "Event"
+)
+
+/* A watcher of Kubernetes resources */
+type kubeWatcher struct {
+	definition      *KubeWatcherDefinition
+	client          dynamic.Interface
+	gvr             schema.GroupVersionResource
+	kind            string
+	eventTypes      map[watch.EventType]bool // types of the changes sent
+	resourceVersion string                   // resource version to resume the watch from, empty to list the resources
+}
+
+func newKubeWatcher(definition *KubeWatcherDefinition, ed *EventDefinition, client dynamic.Interface) (*kubeWatcher, error) {
+	if definition.Name == "" {
+		return nil, fmt.Errorf("a kubeWatcher has no name")
+	}
+	destination := false
+	for _, node := range ed.EventDestinations {
+		destination = destination || node.Name == definition.Destination
+	}
+	if !destination {
+		return nil, fmt.Errorf("eventDestination '%s' of kubeWatcher '%s' is not defined", definition.Destination, definition.Name)
+	}
+	apiVersion, kind := definition.APIVersion, definition.Kind
+	if apiVersion == "" {
+		apiVersion = V1
+	}
+	if kind == "" {
+		kind = kindEvent
+	}
+	gv, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apiVersion of kubeWatcher '%s': %v", definition.Name, err)
+	}
+	mapping, err := resolveResource(gv.WithKind(kind))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve the resource of kind %s of kubeWatcher '%s': %v", kind, definition.Name, err)
+	}
+	if !mapping.namespaced && definition.Namespace != "" {
+		return nil, fmt.Errorf("kind %s of kubeWatcher '%s' is not namespaced, and has no namespace", kind, definition.Name)
+	}
+
+	w := &kubeWatcher{definition: definition, client: client, gvr: mapping.gvr, kind: kind, eventTypes: make(map[watch.EventType]bool)}
+	eventTypes := definition.EventTypes
+	if len(eventTypes) == 0 {
+		eventTypes = []string{string(watch.Added), string(watch.Modified), string(watch.Deleted)}
+		if kind == kindEvent && gv.Group == "" {
+			/* Events are deleted when they expire */
+			eventTypes = eventTypes[:2]
+		}
+	}
+	for _, eventType := range eventTypes {
+		switch watch.EventType(strings.ToUpper(eventType)) {
+		case watch.Added, watch.Modified, watch.Deleted:
+			w.eventTypes[watch.EventType(strings.ToUpper(eventType))] = true
+		default:
+			return nil, fmt.Errorf("unknown event type '%s' of kubeWatcher '%s', expected ADDED, MODIFIED, or DELETED", eventType, definition.Name)
+		}
+	}
+	return w, nil
+}
+
+/* Return the interface of the watched resources */
+func (w *kubeWatcher) resources() dynamic.ResourceInterface {
+	if w.definition.Namespace == "" {
+		return w.client.Resource(w.gvr)
+	}
+	return w.client.Resource(w.gvr).Namespace(w.definition.Namespace)
+}
+
+/* Return the message of a change of a resource */
+func (w *kubeWatcher) message(eventType watch.EventType, obj *unstructured.Unstructured) map[string]interface{} {
+	body := map[string]interface{}{
+		"watcher":    w.definition.Name,
+		"type":       string(eventType),
+		"apiVersion": obj.GetAPIVersion(),
+		"kind":       obj.GetKind(),
+		"name":       obj.GetName(),
+		"namespace":  obj.GetNamespace(),
+		"object":     obj.Object,
+	}
+	if w.kind == kindEvent && w.gvr.Group == "" {
+		/* the fields triggers usually filter Events by */
+		for _, field := range []string{"reason", "message", "involvedObject", "count"} {
+			if value, ok := obj.Object[field]; ok {
+				body[field] = value
+			}
+		}
+		body["eventType"] = obj.Object["type"]
+	}
+	return map[string]interface{}{
+		HEADER: map[string][]string{},
+		BODY:   body,
+		/* a change is identified by its resource version, so that it is not processed twice */
+		EVENTID: fmt.Sprintf("%s-%s", obj.GetUID(), obj.GetResourceVersion()),
+	}
+}
+
+/* Send the message of a change of a resource to the eventDestination of the watcher */
+func (w *kubeWatcher) send(eventType watch.EventType, obj *unstructured.Unstructured) {
+	incrementMetric("kubeWatcher.events")
+	bytes, err := json.Marshal(w.message(eventType, obj))
+	if err != nil {
+		klog.Errorf("Unable to marshal the message of kubeWatcher '%s': %v", w.definition.Name, err)
+		return
+	}
+	if klog.V(4) {
+		klog.Infof("kubeWatcher '%s': %s %s %s/%s", w.definition.Name, eventType, obj.GetKind(), obj.GetNamespace(), obj.GetName())
+	}
+	if err = sendWithRetry(w.definition.Destination, bytes); err != nil {
+		klog.Errorf("Unable to send the message of kubeWatcher '%s': %v", w.definition.Name, err)
+	}
+}
+
+/* List the resources if needed, then watch them until the watch ends, sending the changes */
+func (w *kubeWatcher) watchOnce() error {
+	if w.resourceVersion == "" {
+		list, err := w.resources().List(metav1.ListOptions{LabelSelector: w.definition.LabelSelector, FieldSelector: w.definition.FieldSelector})
+		if err != nil {
+			return fmt.Errorf("unable to list %s: %v", w.gvr.Resource, err)
+		}
+		incrementMetric("kubeWatcher.relists")
+		w.resourceVersion = list.GetResourceVersion()
+	}
+	watcher, err := w.resources().Watch(metav1.ListOptions{
+		LabelSelector:   w.definition.LabelSelector,
+		FieldSelector:   w.definition.FieldSelector,
+		ResourceVersion: w.resourceVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to watch %s: %v", w.gvr.Resource, err)
+	}
+	defer watcher.Stop()
+	for event := range watcher.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified, watch.Deleted:
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			w.resourceVersion = obj.GetResourceVersion()
+			if w.eventTypes[event.Type] {
+				w.send(event.Type, obj)
+			}
+		case watch.Error:
+			status, _ := event.Object.(*metav1.Status)
+			if status != nil && status.Code != http.StatusGone {
+				return fmt.Errorf("watch of %s failed: %v", w.gvr.Resource, status.Message)
+			}
+			/* the resource version expired: the changes since then are lost */
+			w.resourceVersion = ""
+			return nil
+		}
+	}
+	return nil
+}
+
+/* Watch the resources of the watcher, forever */
+func (w *kubeWatcher) run() {
+	for {
+		if err := w.watchOnce(); err != nil {
+			incrementMetric("kubeWatcher.errors")
+			klog.Errorf("kubeWatcher '%s': %v", w.definition.Name, err)
+			time.Sleep(kubeWatchRetryDelay)
+		}
+	}
+}
+
+/* Start the kubeWatchers of an eventDefinitions.yaml */
+func startKubeWatchers(ed *EventDefinition, client dynamic.Interface) error {
+	names := make(map[string]bool)
+	watchers := make([]*kubeWatcher, 0, len(ed.KubeWatchers))
+	for _, definition := range ed.KubeWatchers {
+		if names[definition.Name] {
+			return fmt.Errorf("kubeWatcher '%s' is defined more than once", definition.Name)
+		}
+		names[definition.Name] = true
+		w, err := newKubeWatcher(definition, ed, client)
+		if err != nil {
+			return err
+		}
+		watchers = append(watchers, w)
+	}
+	for _, w := range watchers {
+		if klog.V(2) {
+			klog.Infof("Starting kubeWatcher '%s' of %s in namespace '%s'", w.definition.Name, w.gvr.Resource, w.definition.Namespace)
+		}
+		go w.run()
+	}
+	return nil
+}
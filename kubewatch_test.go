@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+/* An API server listing no Events, then returning the watch events of a resource version */
+type fakeWatchServer struct {
+	mutex   sync.Mutex
+	lists   int
+	watches []string                 // resource version of each watch
+	events  map[string][]interface{} // watch events by resource version
+}
+
+func (server *fakeWatchServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if req.URL.Path != "/api/v1/namespaces/kabanero/events" || req.URL.Query().Get("fieldSelector") != "reason=Failed" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.URL.Query().Get("watch") == "" {
+		server.lists++
+		fmt.Fprintf(w, `{"apiVersion":"v1","kind":"EventList","metadata":{"resourceVersion":"%d"},"items":[]}`, 10*server.lists)
+		return
+	}
+	resourceVersion := req.URL.Query().Get("resourceVersion")
+	server.watches = append(server.watches, resourceVersion)
+	for _, event := range server.events[resourceVersion] {
+		json.NewEncoder(w).Encode(event)
+	}
+}
+
+func newWatchedEvent(eventType string, name string, resourceVersion string) interface{} {
+	return map[string]interface{}{"type": eventType, "object": map[string]interface{}{
+		"apiVersion":     "v1",
+		"kind":           kindEvent,
+		"metadata":       map[string]interface{}{"name": name, "namespace": "kabanero", "uid": name, "resourceVersion": resourceVersion},
+		"reason":         "Failed",
+		"type":           "Warning",
+		"involvedObject": map[string]interface{}{"kind": "PipelineRun", "name": "build-1"},
+	}}
+}
+
+func TestKubeWatcher(t *testing.T) {
+	fake := &fakeWatchServer{events: map[string][]interface{}{
+		"10": {newWatchedEvent("ADDED", "first", "11"), newWatchedEvent("DELETED", "first", "12")},
+		"12": {map[string]interface{}{"type": "ERROR", "object": map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Expired", "code": 410}}},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	captured := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"captured": captured}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: "kube", ProviderRef: "captured"}}}
+
+	client := dynamic.NewForConfigOrDie(&rest.Config{Host: server.URL})
+	w, err := newKubeWatcher(&KubeWatcherDefinition{Name: "failures", Destination: "kube", Namespace: "kabanero", FieldSelector: "reason=Failed"}, eventProviders, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the deletions of Events are not sent by default */
+	if err = w.watchOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if len(captured.messages) != 1 || w.resourceVersion != "12" {
+		t.Fatalf("%v messages, resource version %v", len(captured.messages), w.resourceVersion)
+	}
+	message := make(map[string]interface{})
+	if err = json.Unmarshal(captured.messages[0], &message); err != nil {
+		t.Fatal(err)
+	}
+	body := message[BODY].(map[string]interface{})
+	if message[EVENTID] != "first-11" || body["watcher"] != "failures" || body["type"] != "ADDED" || body["reason"] != "Failed" || body["eventType"] != "Warning" {
+		t.Fatalf("unexpected message %v", message)
+	}
+	if body["involvedObject"].(map[string]interface{})["kind"] != "PipelineRun" {
+		t.Fatalf("unexpected involvedObject %v", body["involvedObject"])
+	}
+
+	/* an expired resource version lists the Events again */
+	if err = w.watchOnce(); err != nil || w.resourceVersion != "" {
+		t.Fatalf("resource version %q after expiry: %v", w.resourceVersion, err)
+	}
+	w.watchOnce()
+	if fake.lists != 2 || len(fake.watches) != 3 || fake.watches[2] != "20" {
+		t.Fatalf("%v lists, watches %v", fake.lists, fake.watches)
+	}
+
+	for _, invalid := range []*KubeWatcherDefinition{
+		{Name: "nodes", Destination: "kube", Kind: "Node", EventTypes: []string{"BOOKMARK"}},
+		{Name: "missing", Destination: "missing"},
+		{Name: "version", Destination: "kube", APIVersion: "a/b/c"},
+	} {
+		if _, err = newKubeWatcher(invalid, eventProviders, client); err == nil {
+			t.Errorf("kubeWatcher %v was accepted", invalid.Name)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+/*
+Standard labels of the resources created by triggers, so that they can be selected, cleaned up, and joined with
+metrics regardless of the collection that created them. Labels set by the templates are overwritten.
+*/
+
+/* labels added to the resources created by triggers */
+const (
+	LABELEVENTID          = "kabanero.io/event-id"
+	LABELREPOSITORY       = "kabanero.io/repository"
+	LABELTRIGGER          = "kabanero.io/trigger"
+	LABELCOLLECTION       = "kabanero.io/collection"
+	LABELCOLLECTIONDIGEST = "kabanero.io/collection-digest"
+)
+
+const digestLabelLength = 16 // number of hex digits of the collection digest used in the label
+
+/* Return the ID of the event of a message: the one assigned by the listener, or the GitHub delivery ID */
+func messageEventID(message map[string]interface{}) string {
+	if id, ok := message[EVENTID].(string); ok && id != "" {
+		return id
+	}
+	headerMap, err := convertToHeaderMap(message[HEADER])
+	if err != nil {
+		return ""
+	}
+	for key, values := range headerMap {
+		if strings.EqualFold(key, "X-Github-Delivery") && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+/* Return the full name of the repository of a message, such as myorg/project1 */
+func messageRepositoryName(message map[string]interface{}) string {
+	body, ok := message[BODY].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	repository, ok := body["repository"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	fullName, _ := repository["full_name"].(string)
+	return fullName
+}
+
+/* Return the login of the user who caused the event of a GitHub, GitLab, or Bitbucket message */
+func messageSenderName(message map[string]interface{}) string {
+	body, ok := message[BODY].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if sender, ok := body["sender"].(map[string]interface{}); ok {
+		login, _ := sender["login"].(string)
+		return login
+	}
+	if username, ok := body["user_username"].(string); ok {
+		return username
+	}
+	if actor, ok := body["actor"].(map[string]interface{}); ok {
+		nickname, _ := actor["nickname"].(string)
+		return nickname
+	}
+	return ""
+}
+
+/* Compute the sha256 digest of the files of a collection, in lexical order of their paths */
+func collectionDigest(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		io.WriteString(hash, relative+"\x00")
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/* Resource filter adding the standard labels to a resource */
+func labelResource(action *resourceAction, resource *unstructured.Unstructured) error {
+	labels := resource.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	digest := action.digest
+	if len(digest) > digestLabelLength {
+		digest = digest[:digestLabelLength]
+	}
+	values := map[string]string{
+		LABELEVENTID:          action.eventID,
+		LABELREPOSITORY:       action.repository,
+		LABELTRIGGER:          action.trigger,
+		LABELCOLLECTION:       action.collection,
+		LABELCOLLECTIONDIGEST: digest,
+	}
+	for key, value := range values {
+		/* characters not allowed in label values, such as the / of repository names, are replaced by toLabelName */
+		if label := toLabelName(value); label != "" {
+			labels[key] = label
+		}
+	}
+	resource.SetLabels(labels)
+	return nil
+}
+
+/* Assign an ID to an event received by the webhook: the GitHub delivery ID, the request ID, or a new ID */
+func newEventID(header http.Header) string {
+	if id := header.Get("X-Github-Delivery"); validRequestID(id) {
+		return id
+	}
+	if id := header.Get(REQUESTIDHEADER); validRequestID(id) {
+		return id
+	}
+	return newRequestID()
+}
+
+/*
+Assign the ID of an event received by a listener. A new ID is kept as the request ID of the header, so that the
+message and the log entries of the event have the same ID.
+*/
+func assignEventID(header http.Header) string {
+	id := newEventID(header)
+	if !validRequestID(header.Get("X-Github-Delivery")) && !validRequestID(header.Get(REQUESTIDHEADER)) {
+		header.Set(REQUESTIDHEADER, id)
+	}
+	return id
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestLabelResource(t *testing.T) {
+	digest, err := collectionDigest("test_data/trigger11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := collectionDigest("test_data/trigger12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digest) != 64 || digest == otherDigest {
+		t.Fatalf("unexpected collection digests %v and %v", digest, otherDigest)
+	}
+
+	message := map[string]interface{}{
+		HEADER: map[string]interface{}{"X-Github-Delivery": []interface{}{"8f3c5e40-0b9a-11ea-8a6e-1c1e6e9e3b1d"}},
+		BODY:   map[string]interface{}{"repository": map[string]interface{}{"full_name": "myorg/project1"}},
+	}
+	action := &resourceAction{collection: "active", digest: digest, trigger: "github-0", eventID: messageEventID(message), repository: messageRepositoryName(message)}
+
+	resource := &unstructured.Unstructured{Object: map[string]interface{}{"kind": "PipelineRun"}}
+	resource.SetLabels(map[string]string{"app": "project1", LABELTRIGGER: "spoofed"})
+	if err = labelResource(action, resource); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"app":                 "project1",
+		LABELEVENTID:          "8f3c5e40-0b9a-11ea-8a6e-1c1e6e9e3b1d",
+		LABELREPOSITORY:       "myorg.project1",
+		LABELTRIGGER:          "github-0",
+		LABELCOLLECTION:       "active",
+		LABELCOLLECTIONDIGEST: digest[:digestLabelLength],
+	}
+	labels := resource.GetLabels()
+	for key, value := range expected {
+		if labels[key] != value {
+			t.Errorf("expected label %v=%v, got %v", key, value, labels[key])
+		}
+	}
+
+	/* the ID assigned by the listener takes precedence */
+	message[EVENTID] = "assigned"
+	if id := messageEventID(message); id != "assigned" {
+		t.Fatalf("unexpected event ID %v", id)
+	}
+}
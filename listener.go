@@ -17,10 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"net/http"
 	"io"
-	"io/ioutil"
 	"k8s.io/klog"
 	"github.com/google/go-github/github"
 	"os"
@@ -28,6 +28,8 @@ import (
 	// "golang.org/x/oauth2"
 	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 )
 
@@ -36,70 +38,331 @@ const (
 	tlsKeyPath = "/etc/tls/tls.key"
 )
 
+/* environment variables setting the defaults of the listener flags */
+const (
+	LISTENPORT    = "LISTEN_PORT"
+	LISTENTLSPORT = "LISTEN_TLS_PORT"
+	WEBHOOKPATH   = "WEBHOOK_PATH"
+	BINDADDRESS   = "BIND_ADDRESS"
+)
+
+var (
+	listenPort    int    // port of the listener when TLS is disabled
+	listenTLSPort int    // port of the TLS listener
+	webhookPath   string // path of the webhook, unless the paths are listed in the listener block of eventDefinitions.yaml
+	bindAddress   string // address the listener binds to. All addresses if empty
+)
+
+/* Return the value of an environment variable, or a default if it is not set */
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+/* Return the value of an environment variable holding a port, or a default if it is not set or invalid */
+func envPortOrDefault(name string, defaultValue int) int {
+	port, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || port <= 0 {
+		return defaultValue
+	}
+	return port
+}
+
+/*
+Return the webhook paths served by the listener, and the eventDestination of each: those of the listener block of
+eventDefinitions.yaml if any, or -webhookPath sending to the webhook destination.
+*/
+func webhookPaths() ([]*ListenerPath, error) {
+	ed := currentEventProviders()
+	if ed == nil || ed.Listener == nil || len(ed.Listener.Paths) == 0 {
+		return []*ListenerPath{{Path: webhookPath, Destination: WEBHOOKDESTINATION}}, nil
+	}
+	seen := make(map[string]bool)
+	for _, path := range ed.Listener.Paths {
+		if !strings.HasPrefix(path.Path, "/") {
+			return nil, fmt.Errorf("listener path '%s' does not start with /", path.Path)
+		}
+		if seen[path.Path] {
+			return nil, fmt.Errorf("listener path '%s' is listed more than once", path.Path)
+		}
+		seen[path.Path] = true
+		if path.Destination == "" {
+			path.Destination = WEBHOOKDESTINATION
+		}
+		if ed.GetEventDestination(path.Destination) == nil {
+			return nil, fmt.Errorf("eventDestination '%s' of listener path '%s' is not defined", path.Destination, path.Path)
+		}
+	}
+	return ed.Listener.Paths, nil
+}
 
 /* HTTP listsnert */
 func listenerHandler(writer http.ResponseWriter, req *http.Request) {
+	webhookHandler(&ListenerPath{Path: webhookPath, Destination: WEBHOOKDESTINATION})(writer, req)
+}
 
-    header := req.Header
-	klog.Infof("Recevied request. Header: %v", header)
+/* Return the handler of a webhook path, sending its messages, tagged with the path, to the eventDestination of the path */
+func webhookHandler(path *ListenerPath) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		header := req.Header
+		eventID := assignEventID(header)
 
-	var body io.ReadCloser = req.Body
+		bodyMap, ok := readWebhookBody(writer, req)
+		if !ok || !allowRepositoryEvent(writer, req, bodyMap) {
+			return
+		}
+		logReceivedEvent(eventID, "Webhook listener received event", path.Path, header, bodyMap)
+
+		respondWebhookMessage(writer, req, path.Destination, path.Path, header, bodyMap)
+	}
+}
+
+/* Log an event received by a listener. Its header, without credentials, and body are logged with -v 5 */
+func logReceivedEvent(eventID string, msg string, path string, header http.Header, body map[string]interface{}) {
+	fields := logFields{"path": path, "event": header.Get("X-Github-Event")}
+	if repository := messageRepositoryURL(map[string]interface{}{BODY: body}); repository != "" {
+		fields["repository"] = repository
+	}
+	if klog.V(5) {
+		fields["header"] = redactHeader(header)
+		fields["body"] = body
+	}
+	logEvent(1, "info", eventID, msg, fields)
+}
 
+/* Decode the JSON body of a webhook request. Returns false, after writing the error response, if it can not be decoded. */
+func readWebhookBody(writer http.ResponseWriter, req *http.Request) (map[string]interface{}, bool) {
+	req = limitBodyReadTime(writer, req)
+	var body io.ReadCloser = req.Body
+	if maxBodySize > 0 {
+		body = http.MaxBytesReader(writer, body, maxBodySize)
+	}
 	defer body.Close()
-	bytes, err := ioutil.ReadAll(body)
-	if err != nil {
-		klog.Errorf("Webhook listener can not read body. Error: %v", err);
-	} else {
-	 	klog.Infof("Webhook listener received body: %v", string(bytes))
-    }
 
-	var bodyMap map[string]interface{}
-	err = json.Unmarshal(bytes, &bodyMap)
+	/* the read deadline of the connection limits the time to read the body, or else the context if it is not set */
+	ctx := req.Context()
+	if _, ok := bodyReadDeadline(req); !ok && bodyReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bodyReadTimeout)
+		defer cancel()
+	}
+	bodyMap, err := decodeJSONObject(ctx, body, maxJSONDepth)
 	if err != nil {
-		klog.Errorf("Unable to unarmshal json body: %v", err)
-		return
+		klog.Errorf("Unable to decode json body: %v", err)
+		switch {
+		case bodyReadTimedOut(req, err):
+			writeError(writer, req, codeRequestTimeout, "timed out reading request body")
+		case strings.Contains(err.Error(), "request body too large"):
+			writeError(writer, req, codePayloadTooLarge, "request body too large")
+		default:
+			writeError(writer, req, codeInvalidJSON, "invalid JSON body")
+		}
+		return nil, false
 	}
+	return bodyMap, true
+}
+
+/* Send the message of a webhook request to the webhook destination */
+func sendWebhookMessage(header http.Header, bodyMap map[string]interface{}) error {
+	return sendWebhookMessageTo(WEBHOOKDESTINATION, "", header, bodyMap)
+}
+
+/*
+Send the message of a webhook request to an eventDestination, or write it to the outbox of the destination if there is
+one. The message is tagged with the path it was received on, if not empty. Returns an error if the message could not be
+written to the outbox. Failed sends are retried in the background.
+*/
+func sendWebhookMessageTo(destination string, sourcePath string, header http.Header, bodyMap map[string]interface{}) error {
+	_, err := deliverWebhookMessage(destination, sourcePath, header, bodyMap)
+	return err
+}
+
+/*
+Send the message of an event requested by a user, such as a backfilled event, to the webhook destination. The message
+is marked as interactive, so that the resources of its triggers are created before those of events.
+*/
+func sendInteractiveWebhookMessage(header http.Header, bodyMap map[string]interface{}) error {
+	message := newWebhookMessage("", header, bodyMap)
+	message[INTERACTIVE] = true
+	_, err := deliverMessage(WEBHOOKDESTINATION, "", header, message)
+	return err
+}
 
+/* Send the message of a webhook request as sendWebhookMessageTo, returning the summary of its delivery */
+func deliverWebhookMessage(destination string, sourcePath string, header http.Header, bodyMap map[string]interface{}) (*webhookSummary, error) {
+	return deliverMessage(destination, sourcePath, header, newWebhookMessage(sourcePath, header, bodyMap))
+}
 
+/* Return the message of a webhook request, tagged with the path it was received on if not empty */
+func newWebhookMessage(sourcePath string, header http.Header, bodyMap map[string]interface{}) map[string]interface{} {
 	message := make(map[string]interface{})
 	message[HEADER] = map[string][]string(header)
 	message[BODY] = bodyMap
+	message[EVENTID] = newEventID(header)
+	if sourcePath != "" {
+		message[SOURCEPATH] = sourcePath
+	}
+	return message
+}
 
-	bytes, err = json.Marshal(message)
-	if err != nil {
-		klog.Errorf("Unable to marshall as JSON: %v, type %T", message, message)
-		return
+/* Run the OnReceive hooks of a webhook message, and send it to the destinations accepting its kind of event */
+func deliverMessage(destination string, sourcePath string, header http.Header, message map[string]interface{}) (*webhookSummary, error) {
+	summary := &webhookSummary{EventID: messageEventID(message), Destinations: make([]*destinationSummary, 0), message: message}
+	if hasPipelineHooks(stageOnReceive) {
+		event := &pipelineEvent{stage: stageOnReceive, eventID: messageEventID(message), source: sourcePath, destination: destination, message: message}
+		if err := runPipelineHooks(event); err != nil {
+			eventInfo(event.eventID, "Webhook message vetoed", logFields{"destination": destination, "error": err})
+			return summary, err
+		}
+		destination = event.destination
 	}
 
-	destNode := eventProviders.GetEventDestination(WEBHOOKDESTINATION)
-	if destNode == nil {
-		klog.Errorf("Unable to find an eventDestination with the name '%s'. Verify that it has been defined.", WEBHOOKDESTINATION)
-		return
+	/* messages are sent to the destinations accepting their kind of event, if destinations declare the kinds they accept */
+	body, _ := message[BODY].(map[string]interface{})
+	kind := eventKind(header, body)
+	summary.Kind = kind
+	destinations := routeEventKind(destination, kind)
+	if len(destinations) == 0 {
+		eventInfo(messageEventID(message), "No eventDestination accepts webhook message", logFields{"kind": kind, "destination": destination})
+		incrementMetric("routing.unrouted")
+		return summary, nil
 	}
-	provider := eventProviders.GetMessageProvider(destNode.ProviderRef)
-	if provider == nil {
-		klog.Errorf("Unable to find a messageProvider with the name '%s'. Verify that is has been defined.", destNode.ProviderRef)
-		return
+	var firstErr error
+	for _, routed := range destinations {
+		sent, err := sendRoutedWebhookMessage(routed, sourcePath, header, message)
+		if sent != nil {
+			summary.Destinations = append(summary.Destinations, sent)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return summary, firstErr
+}
+
+/* Send a webhook message to one of its destinations, after the PreRoute hooks, returning the summary of the send */
+func sendRoutedWebhookMessage(destination string, sourcePath string, header http.Header, message map[string]interface{}) (*destinationSummary, error) {
+	if hasPipelineHooks(stagePreRoute) {
+		event := &pipelineEvent{stage: stagePreRoute, eventID: messageEventID(message), source: sourcePath, destination: destination, message: message}
+		if err := runPipelineHooks(event); err != nil {
+			eventInfo(event.eventID, "Webhook message vetoed", logFields{"destination": destination, "error": err})
+			return nil, err
+		}
+		destination = event.destination
 	}
+	sent := &destinationSummary{Destination: destination, Status: sendStatusSent}
+	s := startSpan("send "+destination, spanKindProducer, parseTraceparent(header.Get(TRACEPARENT)))
+	s.setAttribute("messaging.destination.name", destination)
+	s.setAttribute("kabanero.event_id", message[EVENTID])
+	message[TRACEPARENT] = s.context.traceparent()
 
-	err = provider.Send(destNode, bytes, nil)
+	bytes, err := json.Marshal(message)
 	if err != nil {
-		klog.Errorf("Unable to send webhook message. Error: %v", err)
-		return
+		klog.Errorf("Unable to marshall as JSON: %v, type %T", message, message)
+		s.finish(err)
+		sent.Status, sent.Error = sendStatusFailed, err.Error()
+		return sent, err
 	}
+
+	observeTraffic(messageRepositoryURL(message), len(bytes))
+
+	eventID, _ := message[EVENTID].(string)
+	if ob := outboxes[destination]; ob != nil {
+		if err = ob.write(bytes); err != nil {
+			eventError(eventID, "Rejecting webhook message", logFields{"destination": destination, "error": err})
+		}
+		s.setAttribute("kabanero.outbox", true)
+		s.finish(err)
+		if err != nil {
+			return nil, err
+		}
+		sent.Status = sendStatusOutbox
+		return sent, nil
+	}
+
+	/* failed sends are retried, then dead-lettered */
+	err = sendWithRetry(destination, bytes)
+	s.finish(err)
 	if err != nil {
-		klog.Errorf("Error processing webhook message: %v", err)
+		eventError(eventID, "Unable to send webhook message", logFields{"destination": destination, "error": err})
+		sent.Status, sent.Error = sendStatusRetrying, err.Error()
+	} else if klog.V(4) {
+		eventInfo(eventID, "Sent webhook message", logFields{"destination": destination})
 	}
+	return sent, nil
 }
 
+/* Return the server of the listener. Clients sending their headers slowly are disconnected after -bodyReadTimeout */
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{Handler: handler, ReadHeaderTimeout: bodyReadTimeout}
+}
 
 func newListener() error{
-	http.HandleFunc("/webhook", listenerHandler)
+	/* Use a dedicated mux so that handlers registered on the default mux, such as expvar's, are not exposed */
+	mux := http.NewServeMux()
+	paths, err := webhookPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		klog.Infof("Serving webhook path %s for eventDestination %s", path.Path, path.Destination)
+		if err := handleWithMiddleware(mux, path.Path, path.MiddlewareChain(), webhookHandler(path)); err != nil {
+			return err
+		}
+	}
+	if err := handleWithMiddleware(mux, "/gitlab", gitlabMiddleware, gitlabListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/bitbucket", bitbucketMiddleware, bitbucketListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/gitea", giteaMiddleware, giteaListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/azuredevops", azureDevOpsMiddleware, azureDevOpsListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/registry", registryMiddleware, registryListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/slack", slackMiddleware, slackListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/alertmanager", alertmanagerMiddleware, alertmanagerListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/cloudevents", cloudEventsMiddleware, cloudEventsListenerHandler); err != nil {
+		return err
+	}
+	if err := handleWithMiddleware(mux, "/peer", peerMiddleware, peerListenerHandler); err != nil {
+		return err
+	}
+	if interceptorMode {
+		if err := handleWithMiddleware(mux, interceptorPath, interceptorMiddleware, interceptorHandler); err != nil {
+			return err
+		}
+	}
+	/* the probes of the kubelet are not authenticated */
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	setHeartbeatListener(mux, paths)
+
+	if webhookSocket != "" {
+		go func() {
+			klog.Fatal(serveUnixSocket(webhookSocket, mux))
+		}()
+	}
 
 	if disableTLS {
-		klog.Infof("Starting listener on port 9080");
-		err := http.ListenAndServe(":9080", nil)
-		return err
+		addr := net.JoinHostPort(bindAddress, strconv.Itoa(listenPort))
+		klog.Infof("Starting listener on %v", addr)
+		listener, err := listenTCP(addr)
+		if err != nil {
+			return err
+		}
+		return newHTTPServer(mux).Serve(listener)
 	}
 
 	// Setup TLS listener
@@ -113,9 +376,22 @@ func newListener() error{
 		return err
 	}
 
-	klog.Infof("Starting listener on port 9443");
-	err := http.ListenAndServeTLS(":9443", tlsCertPath, tlsKeyPath, nil)
-	return err
+	addr := net.JoinHostPort(bindAddress, strconv.Itoa(listenTLSPort))
+	klog.Infof("Starting listener on %v", addr)
+	listener, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	server := newHTTPServer(mux)
+	/* peers forwarding messages authenticate with client certificates */
+	peerCAs, err := loadPeerCAs()
+	if err != nil {
+		return err
+	}
+	if peerCAs != nil {
+		server.TLSConfig = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: peerCAs}
+	}
+	return server.ServeTLS(listener, tlsCertPath, tlsKeyPath)
 }
 
 /* Get the repository's information from from github message body: name, owner, html_url, and ref */
@@ -295,6 +571,7 @@ func downloadFileFromGithub(owner, repository,fileName, ref, githubURL, user, to
 	} else {
 		client = github.NewClient(tp.Client())
 	}
+	client.UserAgent = userAgent()
 
 	var options *github.RepositoryContentGetOptions = nil
 	if ref != "" {
@@ -311,6 +588,10 @@ func downloadFileFromGithub(owner, repository,fileName, ref, githubURL, user, to
 	buf, err := ioutil.ReadAll(rc)
 */
 	fileContent, _, resp, err := client.Repositories.GetContents(context, owner, repository, fileName, options)
+	if resp == nil || resp.Response == nil {
+		/* no response was received */
+		return nil, false, gitHubCallError(resp, err, fmt.Sprintf("unable to download %v/%v/%v", owner, repository, fileName))
+	}
 	if resp.Response.StatusCode == 200 {
 		if fileContent != nil {
 			if fileContent.Content == nil {
@@ -332,7 +613,7 @@ func downloadFileFromGithub(owner, repository,fileName, ref, githubURL, user, to
 		return nil, false, nil
 	} else {
 		/* some other errors */
-		return nil, false, fmt.Errorf("unable to download %v/%v/%v, http error %v", owner, repository, fileName, resp.Response.Status)
+		return nil, false, gitHubCallError(resp, err, fmt.Sprintf("unable to download %v/%v/%v, http error %v", owner, repository, fileName, resp.Response.Status))
 	}
 
 }
@@ -343,34 +624,19 @@ func downloadFileFromGithub(owner, repository,fileName, ref, githubURL, user, to
 	bodyMap: HTTP  message body from webhook 
 */
 func downloadYAML(header map[string][]string, bodyMap map[string]interface{}, fileName string ) (map[string]interface{}, bool, error) {
-
-	hostHeader, isEnterprise := header[http.CanonicalHeaderKey("x-github-enterprise-host")]
-    var host string
-	if !isEnterprise {
-        host = "github.com"
-	} else {
-		host = hostHeader[0]
-	}
-
-	repositoryEvent := header["X-Github-Event"][0]
-
-	owner, name, htmlURL, ref, err := getRepositoryInfo(bodyMap, repositoryEvent)
-	if err != nil {
-		return nil, false, fmt.Errorf("Unable to get repository owner, name, or html_url from webhook message: %v", err);
-	}
-
-    user, token , _, err := getURLAPIToken(dynamicClient, webhookNamespace, htmlURL )
-	if err != nil {
-		return nil, false, fmt.Errorf("Unable to get user/token secrets for URL %v", htmlURL);
-	}
-
-	githubURL := "https://" + host
-
-
-	bytes, found, err := downloadFileFromGithub(owner, name, fileName, ref, githubURL, user, token, isEnterprise)
-	if err != nil {
+	bytes, found, err := downloadRepositoryFile(header, bodyMap, fileName)
+	if err != nil || !found {
 		return nil, found, err
 	}
 	retMap, err := yamlToMap(bytes);
 	return retMap, found, err
 }
+
+/* Download a file of the repository of a webhook message, at the commit of the event, with the resolver of its host */
+func downloadRepositoryFile(header map[string][]string, bodyMap map[string]interface{}, fileName string ) ([]byte, bool, error) {
+	repo, err := messageRepositoryRef(header, bodyMap)
+	if err != nil {
+		return nil, false, err
+	}
+	return resolverFor(repo, header).ResolveFile(repo, fileName)
+}
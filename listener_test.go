@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookPaths(t *testing.T) {
+	savedDefinitions, savedPath := eventProviders, webhookPath
+	defer func() { eventProviders, webhookPath = savedDefinitions, savedPath }()
+	webhookPath = "/hooks/github"
+	destinations := []*EventNode{{Name: WEBHOOKDESTINATION}, {Name: "team-a"}}
+
+	eventProviders = &EventDefinition{EventDestinations: destinations}
+	paths, err := webhookPaths()
+	if err != nil || len(paths) != 1 || paths[0].Path != "/hooks/github" || paths[0].Destination != WEBHOOKDESTINATION {
+		t.Fatalf("unexpected default paths %+v: %v", paths, err)
+	}
+
+	eventProviders.Listener = &ListenerDefinition{Paths: []*ListenerPath{{Path: "/webhook"}, {Path: "/team-a", Destination: "team-a"}}}
+	paths, err = webhookPaths()
+	if err != nil || len(paths) != 2 || paths[0].Destination != WEBHOOKDESTINATION || paths[1].Destination != "team-a" {
+		t.Fatalf("unexpected paths %+v: %v", paths, err)
+	}
+
+	for _, invalid := range [][]*ListenerPath{
+		{{Path: "webhook"}},
+		{{Path: "/webhook"}, {Path: "/webhook", Destination: "team-a"}},
+		{{Path: "/team-b", Destination: "team-b"}},
+	} {
+		eventProviders.Listener.Paths = invalid
+		if _, err = webhookPaths(); err == nil {
+			t.Errorf("paths %+v were accepted", invalid)
+		}
+	}
+}
+
+func TestWebhookHandlerDestination(t *testing.T) {
+	github, teamA := &capturingProvider{}, &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"github": github, "team-a": teamA}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "github"}, {Name: "team-a", ProviderRef: "team-a"}}}
+
+	req := httptest.NewRequest(http.MethodPost, "/team-a", strings.NewReader(`{"ref":"refs/heads/master"}`))
+	recorder := httptest.NewRecorder()
+	webhookHandler(&ListenerPath{Path: "/team-a", Destination: "team-a"})(recorder, req)
+	if recorder.Code != http.StatusOK || len(teamA.messages) != 1 || len(github.messages) != 0 {
+		t.Fatalf("webhook returned %v, and sent %v messages to team-a and %v to github", recorder.Code, len(teamA.messages), len(github.messages))
+	}
+
+	/* messages are tagged with the path they were received on */
+	message := make(map[string]interface{})
+	if err := json.Unmarshal(teamA.messages[0], &message); err != nil || message[SOURCEPATH] != "/team-a" {
+		t.Fatalf("unexpected message %s: %v", teamA.messages[0], err)
+	}
+}
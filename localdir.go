@@ -0,0 +1,144 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Local trigger directories, for the development of trigger collections. With -triggerDir, the active collection is
+loaded from a local directory instead of the Kabanero index, so that trigger authors can try their changes without
+publishing a collection. The directory is copied before it is loaded, so that the triggers evaluated by a message do
+not change while it is being edited. Unless -triggerDirPoll is 0, the directory is polled for changes, and the
+collection is reloaded when the digest of its files changes, keeping the previous collection if the new one is invalid.
+The directory is polled, since no file system notification library is vendored: each poll reads every file.
+*/
+
+var (
+	triggerDir     string        // local directory of the active trigger collection. Downloaded from the Kabanero index if empty
+	triggerDirPoll time.Duration // interval of the polls of -triggerDir for changes. Not polled if 0
+)
+
+/* Load a trigger collection from a copy of a local directory */
+func loadLocalTriggerProcessor(name string, sourceDir string) (*triggerProcessor, error) {
+	if err := checkTriggerDirSupported(sourceDir); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary directory. Error: %s", err)
+	}
+	if err = copyTriggerDir(sourceDir, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to copy trigger directory %s: %v", sourceDir, err)
+	}
+
+	tp := newTriggerProcessor()
+	tp.name = name
+	tp.indexURL = sourceDir
+	tp.localDir = sourceDir
+	if err = tp.initialize(dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to initialize trigger definition of %s: %s", sourceDir, err)
+	}
+	if name == "active" {
+		tp.precompile()
+	} else {
+		go tp.precompile()
+	}
+	return tp, nil
+}
+
+/* Copy the regular files of a directory, recursively */
+func copyTriggerDir(sourceDir string, dir string) error {
+	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, relative)
+		if info.IsDir() {
+			return os.MkdirAll(dest, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		source, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		file, err := os.OpenFile(dest, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, source)
+		closeErr := file.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	})
+}
+
+/* Poll the local trigger directory, and reload the collections loaded from it when it changes. Does not return */
+func watchTriggerDir(interval time.Duration) {
+	klog.Infof("Watching trigger directory %s for changes every %v", triggerDir, interval)
+	failedDigest := ""
+	for {
+		time.Sleep(interval)
+		failedDigest = reloadChangedTriggerDir(failedDigest)
+	}
+}
+
+/*
+Reload the collections loaded from the local trigger directory if its files changed, unless they are those that failed
+to load the previous time. Return the digest of the files if they failed to load.
+*/
+func reloadChangedTriggerDir(failedDigest string) string {
+	digest, err := collectionDigest(triggerDir)
+	if err != nil {
+		klog.Errorf("Unable to read trigger directory %s: %v", triggerDir, err)
+		return failedDigest
+	}
+	changed := make([]string, 0)
+	for _, tp := range loadedTriggerProcessors() {
+		if tp != nil && tp.localDir == triggerDir && tp.digest != digest {
+			changed = append(changed, tp.name)
+		}
+	}
+	if len(changed) == 0 || digest == failedDigest {
+		return failedDigest
+	}
+	klog.Infof("Trigger directory %s changed, reloading the %v collection(s)", triggerDir, changed)
+	if _, err = reloadCollections(changed...); err != nil {
+		klog.Errorf("Unable to reload trigger directory %s, keeping the previous collection: %v", triggerDir, err)
+		return digest
+	}
+	return ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadChangedTriggerDir(t *testing.T) {
+	savedProc, savedCanary, savedShadow, savedProviders, savedDir := triggerProc, canaryProc, shadowProc, eventProviders, triggerDir
+	defer func() {
+		triggerProc, canaryProc, shadowProc, eventProviders, triggerDir = savedProc, savedCanary, savedShadow, savedProviders, savedDir
+	}()
+	canaryProc, shadowProc, eventProviders = nil, nil, nil
+
+	source, err := ioutil.TempDir("", "triggerdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(source)
+	if err = copyTriggerDir("test_data/trigger16", source); err != nil {
+		t.Fatal(err)
+	}
+	triggerDir = source
+	triggerProc, err = loadLocalTriggerProcessor("active", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := triggerProc
+	defer os.RemoveAll(loaded.triggerDir)
+	if loaded.triggerDir == source || loaded.triggerCount() != 2 {
+		t.Fatalf("unexpected collection loaded from %v: %v triggers", loaded.triggerDir, loaded.triggerCount())
+	}
+
+	/* an unchanged directory is not reloaded */
+	if failed := reloadChangedTriggerDir(""); failed != "" || triggerProc != loaded {
+		t.Fatal("the unchanged trigger directory was reloaded")
+	}
+
+	/* a changed directory is reloaded */
+	triggerFile := filepath.Join(source, "trigger16.yaml")
+	data, err := ioutil.ReadFile(triggerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := "  - eventSource: default\n    name: extra\n    input: event\n    body:\n      - result: 'true'\n"
+	if err = ioutil.WriteFile(triggerFile, append(data, extra...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if failed := reloadChangedTriggerDir(""); failed != "" || triggerProc == loaded || triggerProc.triggerCount() != 3 {
+		t.Fatalf("the changed trigger directory was not reloaded: %v triggers", triggerProc.triggerCount())
+	}
+	defer os.RemoveAll(triggerProc.triggerDir)
+
+	/* an invalid directory keeps the previous collection, and is not reloaded again until it changes */
+	reloaded := triggerProc
+	if err = ioutil.WriteFile(triggerFile, []byte("eventTriggers: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failed := reloadChangedTriggerDir("")
+	if failed == "" || triggerProc != reloaded {
+		t.Fatal("the invalid trigger directory was loaded")
+	}
+	if reloadChangedTriggerDir(failed) != failed {
+		t.Fatal("unexpected result reloading a trigger directory that failed to load")
+	}
+}
+
+func TestTriggerDirRequiresSignature(t *testing.T) {
+	saved := signatureKeysConfigMap
+	defer func() { signatureKeysConfigMap = saved }()
+
+	/* a local directory is not signed */
+	signatureKeysConfigMap = "trigger-keys"
+	if tp, err := loadLocalTriggerProcessor("active", "test_data/trigger16"); err == nil {
+		os.RemoveAll(tp.triggerDir)
+		t.Fatal("unsigned trigger directory was loaded while signatures are required")
+	}
+
+	signatureKeysConfigMap = ""
+	tp, err := loadLocalTriggerProcessor("active", "test_data/trigger16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(tp.triggerDir)
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Structured logging. The events received by the listeners, and their processing by the triggers, are logged as entries
+with fields, among which the eventID of the message, so that a webhook is traced from the listener through the message
+provider to the resources created by the triggers. The eventID is the GitHub delivery ID of the event, its request ID,
+or a new ID, which is kept in the message. With -logFormat json, every log line, including those of klog, is written
+to stderr as a JSON object, for log collectors; otherwise the fields follow the message of the line as key=value.
+Headers holding credentials are redacted.
+*/
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logFormat string // text or json
+
+/* The fields of a structured log entry */
+type logFields map[string]interface{}
+
+/* Writes log entries as JSON lines */
+type jsonLogWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+var jsonLog *jsonLogWriter // set with -logFormat json
+
+var klogSeverities = map[byte]string{'I': "info", 'W': "warning", 'E': "error", 'F': "fatal"}
+
+/* Write an entry, with the time, level, caller and message fields */
+func (writer *jsonLogWriter) write(entry logFields) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(logFields{"time": entry["time"], "level": entry["level"], "msg": fmt.Sprintf("%v", entry["msg"])})
+	}
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.out.Write(append(data, '\n'))
+}
+
+/* Convert a line written by klog, such as "I1014 12:00:00.000000    1 listener.go:109] msg", to a JSON entry */
+func (writer *jsonLogWriter) Write(line []byte) (int, error) {
+	entry := logFields{"time": time.Now().UTC().Format(time.RFC3339Nano), "level": "info"}
+	msg := line
+	if end := bytes.Index(line, []byte("] ")); end > 0 && len(line) > 0 {
+		if level, ok := klogSeverities[line[0]]; ok {
+			entry["level"] = level
+			header := strings.Fields(string(line[:end]))
+			if len(header) > 0 {
+				entry["caller"] = header[len(header)-1]
+			}
+			msg = line[end+2:]
+		}
+	}
+	entry["msg"] = strings.TrimRight(string(msg), "\n")
+	writer.write(entry)
+	return len(line), nil
+}
+
+/* Configure the output of klog for -logFormat */
+func setupLogging() error {
+	switch logFormat {
+	case "", logFormatText:
+		return nil
+	case logFormatJSON:
+	default:
+		return fmt.Errorf("unknown -logFormat %s. Use %s or %s", logFormat, logFormatText, logFormatJSON)
+	}
+	jsonLog = &jsonLogWriter{out: os.Stderr}
+	/* each line is written once, to the info output, whatever its severity */
+	for name, value := range map[string]string{"logtostderr": "false", "alsologtostderr": "false", "stderrthreshold": "4"} {
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	klog.SetOutputBySeverity("INFO", jsonLog)
+	for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+		klog.SetOutputBySeverity(severity, ioutil.Discard)
+	}
+	return nil
+}
+
+/* Headers whose values are not logged */
+func isSensitiveHeader(name string) bool {
+	lower := strings.ToLower(name)
+	if lower == "authorization" || lower == "cookie" || lower == "proxy-authorization" {
+		return true
+	}
+	for _, word := range []string{"token", "secret", "signature", "password", "key"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return a copy of a header without the values of credentials */
+func redactHeader(header http.Header) map[string][]string {
+	copied := make(map[string][]string, len(header))
+	for name, values := range header {
+		if isSensitiveHeader(name) {
+			copied[name] = []string{redacted}
+		} else {
+			copied[name] = values
+		}
+	}
+	return copied
+}
+
+/* Format a field value of a text log line */
+func formatLogValue(value interface{}) string {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case error:
+		str = v.Error()
+	case fmt.Stringer:
+		str = v.String()
+	default:
+		if data, err := json.Marshal(v); err == nil && (strings.HasPrefix(string(data), "{") || strings.HasPrefix(string(data), "[")) {
+			return string(data)
+		}
+		str = fmt.Sprintf("%v", v)
+	}
+	if str == "" || strings.ContainsAny(str, " \t\n\"=") {
+		return strconv.Quote(str)
+	}
+	return str
+}
+
+/* Log an entry of a severity for an event. The depth is that of the caller of logEvent. */
+func logEvent(depth int, severity string, eventID string, msg string, fields logFields) {
+	if jsonLog != nil {
+		entry := logFields{}
+		for key, value := range fields {
+			if err, ok := value.(error); ok {
+				value = err.Error()
+			}
+			entry[key] = value
+		}
+		entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+		entry["level"] = severity
+		entry["msg"] = msg
+		if eventID != "" {
+			entry[EVENTID] = eventID
+		}
+		if _, file, line, ok := runtime.Caller(depth + 1); ok {
+			entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+		jsonLog.write(entry)
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var line strings.Builder
+	line.WriteString(msg)
+	if eventID != "" {
+		line.WriteString(" " + EVENTID + "=" + formatLogValue(eventID))
+	}
+	for _, key := range keys {
+		line.WriteString(" " + key + "=" + formatLogValue(fields[key]))
+	}
+	switch severity {
+	case "error":
+		klog.ErrorDepth(depth+1, line.String())
+	case "warning":
+		klog.WarningDepth(depth+1, line.String())
+	default:
+		klog.InfoDepth(depth+1, line.String())
+	}
+}
+
+/* Log information about an event */
+func eventInfo(eventID string, msg string, fields logFields) {
+	logEvent(1, "info", eventID, msg, fields)
+}
+
+/* Log a warning about an event */
+func eventWarning(eventID string, msg string, fields logFields) {
+	logEvent(1, "warning", eventID, msg, fields)
+}
+
+/* Log an error processing an event */
+func eventError(eventID string, msg string, fields logFields) {
+	logEvent(1, "error", eventID, msg, fields)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &jsonLogWriter{out: &buf}
+	writer.Write([]byte("E1014 12:00:00.000000    1 listener.go:109] Unable to send webhook message\n"))
+	writer.Write([]byte("not a klog line"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output %q", buf.String())
+	}
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "error" || entry["caller"] != "listener.go:109" || entry["msg"] != "Unable to send webhook message" || entry["time"] == nil {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry["msg"] != "not a klog line" || entry["level"] != "info" {
+		t.Fatalf("unexpected entry %v: %v", entry, err)
+	}
+}
+
+func TestLogEventJSON(t *testing.T) {
+	saved := jsonLog
+	defer func() { jsonLog = saved }()
+	var buf bytes.Buffer
+	jsonLog = &jsonLogWriter{out: &buf}
+
+	eventError("delivery-1", "Error evaluating trigger", logFields{"trigger": "build", "error": errors.New("failed")})
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry[EVENTID] != "delivery-1" || entry["level"] != "error" || entry["trigger"] != "build" || entry["error"] != "failed" {
+		t.Fatalf("unexpected entry %v", entry)
+	}
+	if !strings.HasPrefix(entry["caller"].(string), "logging_test.go:") {
+		t.Fatalf("unexpected caller %v", entry["caller"])
+	}
+}
+
+func TestFormatLogValue(t *testing.T) {
+	tests := map[interface{}]string{
+		"push":          "push",
+		"two words":     `"two words"`,
+		"":              `""`,
+		200:             "200",
+		errors.New("x"): "x",
+	}
+	for value, expected := range tests {
+		if str := formatLogValue(value); str != expected {
+			t.Errorf("formatLogValue(%v) returned %v, expected %v", value, str, expected)
+		}
+	}
+	if str := formatLogValue([]string{"a", "b"}); str != `["a","b"]` {
+		t.Errorf("unexpected list %v", str)
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "token abc")
+	header.Set("X-Hub-Signature", "sha1=abc")
+	header.Set("X-Gitlab-Token", "abc")
+	header.Set("X-Github-Event", "push")
+	redactedHeader := redactHeader(header)
+	for _, name := range []string{"Authorization", "X-Hub-Signature", "X-Gitlab-Token"} {
+		if redactedHeader[name][0] != redacted {
+			t.Errorf("header %v was not redacted: %v", name, redactedHeader[name])
+		}
+	}
+	if redactedHeader["X-Github-Event"][0] != "push" || header.Get("Authorization") != "token abc" {
+		t.Fatalf("unexpected headers %v, %v", redactedHeader, header)
+	}
+}
+
+func TestAssignEventID(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Github-Delivery", "delivery-1")
+	if id := assignEventID(header); id != "delivery-1" || header.Get(REQUESTIDHEADER) != "" {
+		t.Fatalf("unexpected ID %v, request ID %v", id, header.Get(REQUESTIDHEADER))
+	}
+
+	/* a new ID is kept, so that the message has the ID that is logged */
+	header = http.Header{}
+	id := assignEventID(header)
+	if id == "" || header.Get(REQUESTIDHEADER) != id || newEventID(header) != id {
+		t.Fatalf("unexpected ID %v, request ID %v", id, header.Get(REQUESTIDHEADER))
+	}
+}
+
+func TestSetupLoggingFormat(t *testing.T) {
+	saved := logFormat
+	defer func() { logFormat = saved }()
+	logFormat = "xml"
+	if err := setupLogging(); err == nil {
+		t.Fatal("expected error with an unknown log format")
+	}
+	logFormat = logFormatText
+	if err := setupLogging(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"flag"
 	"fmt"
 	// ghw "gopkg.in/go-playground/webhooks.v3/github"
-	"io/ioutil"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/watch"
@@ -39,6 +38,7 @@ import (
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 )
 
 /* useful constants */
@@ -79,33 +79,94 @@ func init() {
 	}()
 }
 
+/* Subcommands that may follow the flags on the command line. Each returns the exit code of the process. */
+var subcommands = map[string]func([]string) int{
+	"tail":       tailCommand,
+	"schema":     schemaCommand,
+	"events":     eventsCommand,
+	"validate":   validateCommand,
+	"backfill":   backfillCommand,
+	"simulate":   simulateCommand,
+	"controller": controllerCommand,
+	"crds":       crdsCommand,
+}
+
 func main() {
 
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		command, ok := subcommands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command '%s'\n", flag.Arg(0))
+			os.Exit(2)
+		}
+		os.Exit(command(flag.Args()[1:]))
+	}
+
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := loadErrorMessages(); err != nil {
+		klog.Fatal(err)
+	}
+
+	exporter, err := startTracing()
+	if err != nil {
+		klog.Fatal(err)
+	}
+	tracer = exporter
+
 	klog.Infof("disableTLS: %v", disableTLS)
 	klog.Infof("skipChecksumVerify: %v", skipChkSumVerify)
+	klog.Infof("dryRun: %v, serverDryRun: %v", dryRun, serverDryRun)
 
-	var err error
-	var cfg *rest.Config
-	if strings.Compare(masterURL, "") != 0 {
-		// running outside of Kube cluster
-		klog.Infof("starting Kabanero webhook outside cluster\n")
-		klog.Infof("masterURL: %s\n", masterURL)
-		klog.Infof("kubeconfig: %s\n", kubeconfig)
-		cfg, err = clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
-		if err != nil {
-			klog.Fatal(err)
-		}
-	} else {
-		// running inside the Kube cluster
-		klog.Infof("starting Kabanero webhook status controller inside cluster\n")
-		cfg, err = rest.InClusterConfig()
+	if err := initializeTrustedProxies(); err != nil {
+		klog.Fatal(err)
+	}
+
+	initializeCreateLimiter()
+
+	if err := validateSecretScanMode(); err != nil {
+		klog.Fatal(err)
+	}
+
+	if err := checkCollectionAuth(); err != nil {
+		klog.Fatal(err)
+	}
+
+	if err := initializeRepositoryResolvers(); err != nil {
+		klog.Fatal(err)
+	}
+	if err := initializePipelineHooks(); err != nil {
+		klog.Fatal(err)
+	}
+
+	if policyFile != "" {
+		policy, err := loadResourcePolicy(policyFile)
 		if err != nil {
 			klog.Fatal(err)
 		}
+		resourcePolicy = policy
 	}
 
+	if err := loadProviderPlugins(providerPlugins); err != nil {
+		klog.Fatal(err)
+	}
+
+	cfg, err := newKubeConfig()
+	if err != nil {
+		klog.Fatal(err)
+	}
+
+	if clusterID == "" {
+		clusterID = discoverClusterID(cfg)
+	}
+	cfg.UserAgent = userAgent()
+	klog.Infof("User-Agent: %v", cfg.UserAgent)
+
 	kubeClient, err = kubernetes.NewForConfig(cfg)
 	if err != nil {
 		klog.Fatal(err)
@@ -117,40 +178,102 @@ func main() {
 		klog.Fatal(err)
 	}
 	klog.Infof("Received discClient %T, dynamicClient  %T\n", discClient, dynamicClient)
+	initializeRESTMapper(discClient)
+	go watchCRDs(dynamicClient, restMapper)
+	err = initializeRemoteClusters()
+	if err != nil {
+		klog.Fatal(err)
+	}
 
 	/* Get namespace of where we are installed */
 	webhookNamespace = os.Getenv(KUBENAMESPACE)
 	if webhookNamespace == "" {
 		webhookNamespace = DEFAULTNAMESPACE
 	}
+	go watchGitSecrets(dynamicClient, webhookNamespace)
+	if freezeConfigMap != "" {
+		go watchFreezeCalendars(dynamicClient, webhookNamespace)
+	}
+
+	err = startCleanupController(dynamicClient)
+	if err != nil {
+		klog.Fatal(err)
+	}
 
-	kabaneroIndexURL := os.Getenv(KABANEROINDEXURL)
-	if kabaneroIndexURL == "" {
-		// not overriden, use the one in the kabanero CRD
-		kabaneroIndexURL, err = getKabaneroIndexURL(dynamicClient, webhookNamespace)
+	if crdConfig {
+		if err = initializeCRDConfig(dynamicClient, webhookNamespace); err != nil {
+			klog.Fatal(err)
+		}
+	}
+
+	if triggerDir != "" {
+		/* Load the trigger from a local directory, for development */
+		klog.Infof("Loading trigger collection from local directory: %s", triggerDir)
+		triggerProc, err = loadLocalTriggerProcessor("active", triggerDir)
 		if err != nil {
-			klog.Fatal(fmt.Errorf("unable to get kabanero index URL from kabanero CRD. Error: %s", err))
+			klog.Fatal(err)
+		}
+		if triggerDirPoll > 0 {
+			go watchTriggerDir(triggerDirPoll)
 		}
 	} else {
-		klog.Infof("Using value of KABANERO_INDEX_URL environment variable to fetch kabanero index from: %s", kabaneroIndexURL)
-	}
+		kabaneroIndexURL := os.Getenv(KABANEROINDEXURL)
+		if kabaneroIndexURL == "" {
+			// not overriden, use the one in the kabanero CRD
+			kabaneroIndexURL, err = getKabaneroIndexURL(dynamicClient, webhookNamespace)
+			if err != nil {
+				klog.Fatal(fmt.Errorf("unable to get kabanero index URL from kabanero CRD. Error: %s", err))
+			}
+		} else {
+			klog.Infof("Using value of KABANERO_INDEX_URL environment variable to fetch kabanero index from: %s", kabaneroIndexURL)
+		}
 
-	/* Download the trigger into temp directory */
-	dir, err := ioutil.TempDir("", "webhook")
-	if err != nil {
-		klog.Fatal(fmt.Errorf("unable to create temproary directory. Error: %s", err))
+		if indexMirrors != "" {
+			klog.Infof("Using mirrors of the kabanero index: %s", redactURLs(indexMirrors))
+			kabaneroIndexURL += "," + indexMirrors
+		}
+
+		/* Download the trigger into temp directory */
+		triggerProc, err = loadTriggerProcessor("active", kabaneroIndexURL)
+		if err != nil {
+			klog.Fatal(err)
+		}
+
+		/* the other Kabanero CRs have their own collections */
+		if err = initializeKabaneroInstances(dynamicClient); err != nil {
+			klog.Errorf("Unable to initialize the Kabanero instances: %v", err)
+		}
+		go watchKabaneroInstances(dynamicClient)
 	}
-	defer os.RemoveAll(dir)
+	defer os.RemoveAll(triggerProc.triggerDir)
+	dir := triggerProc.triggerDir
 
-	err = downloadTrigger(kabaneroIndexURL, dir)
-	if err != nil {
-		klog.Fatal(fmt.Errorf("unable to download trigger pointed by kabanero_index_url at: %s, error: %s", kabaneroIndexURL, err))
+	if canaryIndexURL == "" {
+		canaryIndexURL = os.Getenv(CANARYKABANEROINDEXURL)
+	}
+	if canaryIndexURL != "" {
+		klog.Infof("Loading canary trigger collection from Kabanero index: %s", canaryIndexURL)
+		canaryProc, err = loadTriggerProcessor("canary", canaryIndexURL)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		defer os.RemoveAll(canaryProc.triggerDir)
+		err = initializeCanaryRouting()
+		if err != nil {
+			klog.Fatal(err)
+		}
 	}
 
-	triggerProc = &triggerProcessor{}
-	err = triggerProc.initialize(dir)
-	if err != nil {
-		klog.Fatal(fmt.Errorf("unable to initialize trigger definition: %s", err))
+	if shadowIndexURL == "" {
+		shadowIndexURL = os.Getenv(SHADOWKABANEROINDEXURL)
+	}
+	if shadowIndexURL != "" {
+		klog.Infof("Loading shadow trigger collection from Kabanero index: %s", shadowIndexURL)
+		shadowProc, err = loadTriggerProcessor("shadow", shadowIndexURL)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		defer os.RemoveAll(shadowProc.triggerDir)
 	}
 
 	if providerCfg == "" {
@@ -168,11 +291,45 @@ func main() {
 		klog.Fatal(fmt.Errorf("unable to initialize event providers: %s", err))
 	}
 
+	if err = checkStrictMode(); err != nil {
+		klog.Fatal(err)
+	}
+	go updateDeprecationCondition(dynamicClient, webhookNamespace)
+
+	if err = initializeRetention(); err != nil {
+		klog.Fatal(fmt.Errorf("unable to initialize the retention store: %s", err))
+	}
+
+	if err = initializeSpools(); err != nil {
+		klog.Fatal(fmt.Errorf("unable to open the spools of event destinations: %s", err))
+	}
+
+	if err = initializeOutbox(); err != nil {
+		klog.Fatal(err)
+	}
+
 	/* Start listeners to listen on events */
-	err = triggerProc.startListeners(eventProviders)
+	err = startListeners(eventProviders, triggerProc, canaryProc)
 	if err != nil {
 		klog.Fatal(fmt.Errorf("unable to start listeners for event triggers: %s", err))
 	}
+	listenersStarted = true
+	if err = startPollers(eventProviders); err != nil {
+		klog.Fatal(fmt.Errorf("unable to start pollers: %s", err))
+	}
+	if err = startKubeWatchers(eventProviders, dynamicClient); err != nil {
+		klog.Fatal(fmt.Errorf("unable to start kubeWatchers: %s", err))
+	}
+	if crdConfig {
+		go watchCRDConfig(dynamicClient, webhookNamespace)
+	}
+	if statusInterval > 0 {
+		go reportInstanceStatusPeriodically(dynamicClient, webhookNamespace)
+	}
+	logDiagnostics()
+	if selfTestMode {
+		os.Exit(runSelfTestCommand())
+	}
 
 	// gvr := schema.GroupVersionResource { Group: "app.k8s.io", Version: "v1beta1", Resource: "applications" }
 	// deleteOrphanedAutoCreatedApplications(dynamicClient, gvr )
@@ -184,6 +341,14 @@ func main() {
 	//	klog.Fatal(err)
 	//}
 
+	if adminAddr != "" || adminSocket != "" {
+		go func() {
+			klog.Fatal(newAdminListener())
+		}()
+	}
+
+	go runHeartbeats()
+
 	// Handle GitHub events
     err = newListener()
 	if err != nil {
@@ -295,10 +460,146 @@ func init() {
 	}
 	flag.StringVar(&masterURL, "master", "", "The address of the Kubernetes API server. Overrides any value in kubeconfig. Only required if out-of-cluster.")
 	flag.StringVar(&providerCfg, "providercfg", "", "path to the provider config")
+	flag.StringVar(&providerPlugins, "providerPlugins", "", "comma separated paths of the Go plugins registering the providerTypes of additional message providers")
 	flag.BoolVar(&disableTLS, "disableTLS", false, "set to use non-TLS listener")
+	flag.StringVar(&adminAddr, "adminAddr", "", "address of the admin API listener, such as :9091. The admin API is disabled if not set")
+	flag.StringVar(&canaryIndexURL, "canaryIndexURL", "", "URL of the Kabanero index of a canary trigger collection. Overrides the CANARY_KABANERO_INDEX_URL environment variable")
+	flag.IntVar(&canaryPercent, "canaryPercent", 0, "percentage of repositories whose events are processed by the canary trigger collection")
+	flag.StringVar(&canaryRepos, "canaryRepos", "", "comma separated list of repository URLs whose events are processed by the canary trigger collection")
+	flag.StringVar(&shadowIndexURL, "shadowIndexURL", "", "URL of the Kabanero index of a trigger collection to evaluate in dry-run against live events. Overrides the SHADOW_KABANERO_INDEX_URL environment variable")
+	flag.StringVar(&webhookSocket, "webhookSocket", "", "path of a Unix socket on which to also serve the webhook, without TLS, for example for a sidecar proxy")
+	flag.StringVar(&adminSocket, "adminSocket", "", "path of a Unix socket on which to serve the admin API, in addition to -adminAddr if set")
+	flag.StringVar(&trustedProxies, "trustedProxies", "", "comma separated IP addresses or CIDRs of proxies trusted to report the client address in X-Forwarded-For or the PROXY protocol")
+	flag.BoolVar(&proxyProtocol, "proxyProtocol", false, "accept the PROXY protocol header on connections from trusted proxies")
+	flag.IntVar(&maxJSONDepth, "maxJSONDepth", 64, "maximum nesting of objects and arrays in a webhook request body. Unlimited if 0")
+	flag.DurationVar(&bodyReadTimeout, "bodyReadTimeout", 30*time.Second, "time allowed to read the headers and the body of a webhook request. Unlimited if 0")
+	flag.StringVar(&anomalyDestination, "anomalyDestination", "", "eventDestination to send warning events to when the rate or size of events of a repository is anomalous. Anomaly detection is disabled if not set")
+	flag.Float64Var(&anomalyFactor, "anomalyFactor", 10, "how many times its baseline the rate or size of events must be to be reported as anomalous")
+	flag.IntVar(&anomalyMinEvents, "anomalyMinEvents", 20, "number of events of a repository before anomalies are reported")
+	flag.StringVar(&envelopeKeyFile, "envelopeKeyFile", "", "file containing the key used to sign messages sent through message brokers, such as a mounted Secret. Overrides the ENVELOPE_SIGNING_KEY environment variable")
+	flag.StringVar(&policyFile, "policyFile", "", "file containing the policy restricting the resources that triggers may create. All resources are allowed if not set")
+	flag.StringVar(&opaURL, "opaURL", "", "URL of an Open Policy Agent rule deciding whether triggers may create a resource, such as http://localhost:8181/v1/data/kabanero/events/allow")
+	flag.DurationVar(&opaTimeout, "opaTimeout", 5*time.Second, "timeout of requests to Open Policy Agent")
+	flag.BoolVar(&opaFailOpen, "opaFailOpen", false, "create resources when Open Policy Agent can not be reached, instead of rejecting them")
+	flag.StringVar(&secretScanMode, "secretScan", secretScanRedact, "what to do with resources rendered by triggers that contain credentials: redact, block, or off")
+	flag.StringVar(&cleanupRetention, "cleanupRetention", "", "comma separated <apiVersion>/<kind>=<duration> of the resources created by triggers to delete once older than the duration, such as tekton.dev/v1alpha1/PipelineRun=72h")
+	flag.DurationVar(&cleanupInterval, "cleanupInterval", 10*time.Minute, "time between cleanups of the resources created by triggers")
+	flag.StringVar(&cleanupNamespaces, "cleanupNamespaces", "", "comma separated namespaces in which to clean up the resources created by triggers. All namespaces if not set")
+	flag.DurationVar(&eventDeadline, "eventDeadline", 5*time.Minute, "deadline of the processing of an event. Unbounded if 0")
+	flag.StringVar(&failureDestination, "failureDestination", "", "eventDestination to report events whose processing failed or timed out to")
+	flag.Float64Var(&createRate, "createRate", 10, "maximum resources created by triggers per second. Unlimited if 0")
+	flag.IntVar(&createBurst, "createBurst", 20, "maximum resources created by triggers at once when -createRate is set")
+	flag.IntVar(&triggerParallelism, "triggerParallelism", 1, "maximum triggers of an event source evaluated concurrently for an event. Sequential if 1")
+	flag.BoolVar(&dryRun, "dryRun", false, "set to render the resources of all triggers without creating them, whatever the dryrun settings of the collections and triggers")
+	flag.BoolVar(&serverDryRun, "serverDryRun", false, "set to submit the resources rendered in dry-run with a Kubernetes server-side dry-run")
+	flag.StringVar(&remoteClustersDir, "remoteClusters", "", "directory of kubeconfig files of remote clusters where triggers may create resources, named after the clusters")
+	flag.IntVar(&sendRetries, "sendRetries", 5, "retries of a failed send of a webhook message before it is dead-lettered")
+	flag.DurationVar(&sendRetryBackoff, "sendRetryBackoff", time.Second, "delay before the first retry of a failed send, doubled for each retry")
+	flag.IntVar(&requeueAttempts, "requeueAttempts", 3, "maximum requeues of an event whose GitHub calls failed with a retryable error. Disabled if 0")
+	flag.DurationVar(&requeueBackoff, "requeueBackoff", 30*time.Second, "delay before the first requeue of an event without a retry hint, doubled for each requeue")
+	flag.DurationVar(&requeueMaxDelay, "requeueMaxDelay", time.Hour, "maximum delay before requeuing an event, whatever its retry hint")
+	flag.StringVar(&deadLetterDestination, "deadLetterDestination", "", "eventDestination receiving webhook messages that could not be sent")
+	flag.StringVar(&deadLetterDir, "deadLetterDir", "", "directory where webhook messages that could not be sent are spooled for replay")
+	flag.StringVar(&cloudEventsMode, "cloudEvents", "", "wrap the messages sent through message providers in CloudEvents: structured, binary, or none")
+	flag.StringVar(&cloudEventsMiddleware, "cloudEventsMiddleware", defaultCloudEventsMiddleware, "comma separated middleware chain of the CloudEvents endpoint")
+	flag.StringVar(&spoolDir, "spoolDir", "", "directory where messages to unhealthy event destinations are spooled until they recover")
+	flag.Int64Var(&spoolMaxBytes, "spoolMaxBytes", 100<<20, "maximum size in bytes of the spool of an event destination. The oldest messages are evicted when it is full")
+	flag.DurationVar(&spoolDrainInterval, "spoolDrainInterval", 5*time.Second, "interval between attempts to drain the spool of an unhealthy event destination")
+	flag.StringVar(&outboxDir, "outboxDir", "", "directory where webhook messages are durably written before they are acknowledged, and dispatched from")
+	flag.Int64Var(&outboxMaxBytes, "outboxMaxBytes", 100<<20, "maximum size in bytes of the outbox. Webhook requests are rejected when it is full")
+	flag.DurationVar(&outboxRetryInterval, "outboxRetryInterval", 5*time.Second, "interval between attempts to dispatch the outbox while the webhook destination fails")
+	flag.IntVar(&auditSize, "auditRecords", auditSize, "number of audit records of processed messages kept in the retention store")
+	flag.StringVar(&retentionStore, "retentionStore", retentionMemory, "store of the audit records: memory, or file to also keep them in -retentionFile")
+	flag.StringVar(&retentionPath, "retentionFile", "", "JSON lines file of the audit records of the file retention store")
+	flag.DurationVar(&retentionMaxAge, "retentionMaxAge", 0, "maximum age of the audit records kept in the retention store. Unlimited if 0")
+	flag.DurationVar(&secretsResync, "secretsResync", 10*time.Minute, "interval between resyncs of the cache of the secrets holding git API tokens. No periodic resync if 0")
+	flag.BoolVar(&selfTestMode, "selftest", false, "publish a synthetic event through every event destination, report whether it comes back to its listener, and exit")
+	flag.DurationVar(&selfTestTimeout, "selftestTimeout", 30*time.Second, "maximum time for the synthetic event of a self-test to come back")
+	flag.StringVar(&anonymizePublicHosts, "anonymizePublicHosts", "github.com,gitlab.com,bitbucket.org", "comma separated hosts whose URLs are kept in messages sent to anonymized event destinations, unless the repository is private")
+	flag.DurationVar(&healthTimeout, "healthTimeout", 2*time.Second, "maximum time for the readiness probe to reach the Kubernetes API server")
+	flag.IntVar(&listenPort, "listenPort", envPortOrDefault(LISTENPORT, 9080), "port of the listener when TLS is disabled. Defaults to $"+LISTENPORT+" if set")
+	flag.IntVar(&listenTLSPort, "listenTLSPort", envPortOrDefault(LISTENTLSPORT, 9443), "port of the TLS listener. Defaults to $"+LISTENTLSPORT+" if set")
+	flag.StringVar(&webhookPath, "webhookPath", envOrDefault(WEBHOOKPATH, "/webhook"), "path of the webhook, unless the paths are listed in the listener block of eventDefinitions.yaml. Defaults to $"+WEBHOOKPATH+" if set")
+	flag.BoolVar(&webhookSummaryEnabled, "webhookSummary", false, "respond to webhook requests with a JSON summary of their processing, unless disabled by the summary=false query parameter")
+	flag.StringVar(&bindAddress, "bindAddress", os.Getenv(BINDADDRESS), "address the listener binds to, all addresses if empty. Defaults to $"+BINDADDRESS+" if set")
+	flag.BoolVar(&strictMode, "strict", false, "refuse to start if deprecated settings are in use")
+	flag.BoolVar(&interceptorMode, "interceptor", false, "serve /interceptor, evaluating the requests of Tekton EventListeners with the triggers")
+	flag.StringVar(&interceptorMiddleware, "interceptorMiddleware", defaultInterceptorMiddleware, "comma separated middleware chain of the Tekton interceptor endpoint")
+	flag.StringVar(&freezeConfigMap, "freezeConfigMap", "", "name of the ConfigMap holding the freeze calendars checked by inFreeze")
+	flag.StringVar(&kubeConfigMaps, "kubeConfigMaps", "", "comma separated namespace/name patterns of the ConfigMaps that triggers may read with kube.getConfigMap, such as kabanero/pipeline-*")
+	flag.StringVar(&kubeSecrets, "kubeSecrets", "", "comma separated namespace/name or namespace/name/key patterns of the Secrets that triggers may read with kube.getSecretKey")
+	flag.BoolVar(&repoConfigEnabled, "repoConfig", false, "read the "+repoConfigFile+" file of the repositories of events, to configure how triggers handle them")
+	flag.DurationVar(&repoConfigTTL, "repoConfigTTL", 5*time.Minute, "how long the "+repoConfigFile+" file of a repository is cached")
+	flag.StringVar(&logFormat, "logFormat", logFormatText, "format of the log: text, or json to write each entry as a JSON object")
+	flag.BoolVar(&validateTokens, "validateTokens", false, "validate the git API tokens of the secrets when they are listed or rotated, failing the readiness probe if they are invalid")
+	flag.StringVar(&requiredTokenScopes, "requiredTokenScopes", "repo", "comma separated OAuth scopes required of the git API tokens with -validateTokens")
+	flag.StringVar(&otlpEndpoint, "otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), "URL of the OTLP/HTTP traces endpoint of an OpenTelemetry collector, such as http://collector:4318/v1/traces. Spans are not exported if empty")
+	flag.StringVar(&otlpHeaders, "otlpHeaders", "", "comma separated name=value headers sent to the OpenTelemetry collector")
+	flag.StringVar(&traceServiceName, "traceServiceName", "kabanero-events", "service name of the exported spans")
+	flag.Float64Var(&traceSampleRatio, "traceSampleRatio", 1, "ratio of the new traces that are sampled, between 0 and 1. Traces started by callers follow their sampling decision")
+	flag.StringVar(&errorDocsURL, "errorDocsURL", "https://github.com/kabanero-io/kabanero-events/blob/master/README.md", "URL of the documentation of the codes of error responses, referenced with the code as fragment. Not referenced if empty")
+	flag.StringVar(&errorMessagesFile, "errorMessagesFile", "", "YAML file of the messages of the codes of error responses, by language of the Accept-Language header")
+	flag.StringVar(&clusterID, "clusterID", os.Getenv("CLUSTER_ID"), "identity of the cluster in the User-Agent of outbound requests. The UID of the kube-system namespace if empty")
+	flag.StringVar(&userAgentFlag, "userAgent", "", "User-Agent of outbound requests, replacing kabanero-events/<version> (cluster <clusterID>)")
+	flag.DurationVar(&heartbeatInterval, "heartbeatInterval", 0, "interval of the heartbeats sent through the listener, the broker and a no-op trigger. Disabled if 0")
+	flag.DurationVar(&heartbeatTimeout, "heartbeatTimeout", 30*time.Second, "maximum time for a heartbeat to complete")
+	flag.IntVar(&heartbeatFailures, "heartbeatFailures", 3, "consecutive failed heartbeats after which the event pipeline is reported stalled")
+	flag.StringVar(&heartbeatPath, "heartbeatPath", "", "webhook path the heartbeats are posted to. The first webhook path if empty")
+	flag.StringVar(&webhookMiddleware, "webhookMiddleware", defaultWebhookMiddleware, "comma separated middleware chain of the webhook endpoint")
+	flag.StringVar(&gitlabMiddleware, "gitlabMiddleware", defaultGitLabMiddleware, "comma separated middleware chain of the GitLab webhook endpoint")
+	flag.StringVar(&bitbucketMiddleware, "bitbucketMiddleware", defaultBitbucketMiddleware, "comma separated middleware chain of the Bitbucket webhook endpoint")
+	flag.StringVar(&giteaMiddleware, "giteaMiddleware", defaultGiteaMiddleware, "comma separated middleware chain of the Gitea webhook endpoint")
+	flag.StringVar(&azureDevOpsMiddleware, "azureDevOpsMiddleware", defaultAzureDevOpsMiddleware, "comma separated middleware chain of the Azure DevOps webhook endpoint")
+	flag.StringVar(&registryMiddleware, "registryMiddleware", defaultRegistryMiddleware, "comma separated middleware chain of the container registry webhook endpoint")
+	flag.StringVar(&slackMiddleware, "slackMiddleware", defaultSlackMiddleware, "comma separated middleware chain of the Slack endpoint")
+	flag.StringVar(&alertmanagerMiddleware, "alertmanagerMiddleware", defaultAlertmanagerMiddleware, "comma separated middleware chain of the Alertmanager webhook endpoint")
+	flag.StringVar(&peerMiddleware, "peerMiddleware", defaultPeerMiddleware, "comma separated middleware chain of the peer endpoint")
+	flag.StringVar(&peerCAFile, "peerCAFile", "", "file of the CA certificates trusted to sign the client certificates of peer kabanero-events instances")
+	flag.StringVar(&adminMiddleware, "adminMiddleware", defaultAdminMiddleware, "comma separated middleware chain of the admin endpoints")
+	flag.Int64Var(&maxBodySize, "maxBodySize", 10*1024*1024, "maximum size in bytes of a webhook request body. Unlimited if 0")
+	flag.StringVar(&allowedContentTypes, "allowedContentTypes", "application/json,application/*+json", "comma separated media types of the webhook request bodies accepted by the contentType middleware")
+	flag.Float64Var(&webhookRate, "webhookRate", 0, "maximum webhook requests per second. Unlimited if 0")
+	flag.IntVar(&webhookBurst, "webhookBurst", 10, "maximum burst of webhook requests when -webhookRate is set")
+	flag.Float64Var(&webhookSourceRate, "webhookSourceRate", 0, "maximum webhook requests per second from each client address. Unlimited if 0")
+	flag.IntVar(&webhookSourceBurst, "webhookSourceBurst", 20, "maximum burst of webhook requests from each client address when -webhookSourceRate is set")
+	flag.Float64Var(&webhookRepositoryRate, "webhookRepositoryRate", 0, "maximum webhook events per second of each repository. Unlimited if 0")
+	flag.IntVar(&webhookRepositoryBurst, "webhookRepositoryBurst", 10, "maximum burst of webhook events of each repository when -webhookRepositoryRate is set")
+	flag.StringVar(&triggerDir, "triggerDir", "", "local directory of the active trigger collection, loaded instead of the Kabanero index for development")
+	flag.DurationVar(&triggerDirPoll, "triggerDirPoll", 10*time.Second, "interval of the polls of -triggerDir for changes, reloading the collection when its files change. Each poll reads every file of the directory. Not polled if 0")
+	flag.BoolVar(&crdConfig, "crdConfig", false, "also read the messageProviders, eventDestinations and active trigger collection from the EventProvider, EventDestination and EventTrigger CRs of the namespace, applying their changes without restarting")
+	flag.DurationVar(&statusInterval, "statusInterval", time.Minute, "interval of the reports of the status of this instance in the Kabanero CRs of the namespace. Not reported if 0")
+	flag.StringVar(&webhookURL, "webhookURL", os.Getenv("WEBHOOK_URL"), "external URL of the webhook listener, reported in the status of the Kabanero CRs. Defaults to $WEBHOOK_URL if set")
+	flag.StringVar(&kabaneroNamespaces, "kabaneroNamespaces", os.Getenv(KABANERONAMESPACES), "comma separated namespaces whose Kabanero CRs are also instances, with their own trigger collections and git secrets. Defaults to $KABANERO_NAMESPACES if set")
 	flag.BoolVar(&skipChkSumVerify, "skipChecksumVerify", false, "set to skip the verification of trigger collection checksum")
+	flag.StringVar(&indexMirrors, "indexMirrors", "", "comma separated mirrors of the Kabanero index of the active trigger collection, tried in order when the index can not be downloaded")
+	flag.DurationVar(&indexRetryAfter, "indexRetryAfter", 5*time.Minute, "how long a Kabanero index URL that failed is tried after the healthy ones")
+	flag.DurationVar(&indexTimeout, "indexTimeout", time.Minute, "maximum time to download a Kabanero index or trigger collection. Unlimited if 0")
+	flag.StringVar(&collectionAuth, "collectionAuth", "", "authentication of the downloads of the trigger collections: bearer, basic or github. Anonymous if empty")
+	flag.StringVar(&collectionSecret, "collectionSecret", "", "Secret holding the token, or username and password, of the downloads of the trigger collections")
+	flag.StringVar(&collectionAuthHosts, "collectionAuthHosts", "", "comma separated hosts, besides that of the Kabanero index, the credentials of the trigger collections are sent to")
+	flag.StringVar(&repositoryResolvers, "repositoryResolvers", "", "comma separated host=resolver[:argument] readers of repository files: github, graphql, gitlab, raw:<URL template>, or local:<directory>. * for the other hosts")
+	flag.StringVar(&pipelineHooksFlag, "pipelineHooks", "", "comma separated stage=executable hooks of the pipeline. The stages are OnReceive, PreRoute, PreTriggerEval, PreApply, and PostDeliver")
+	flag.StringVar(&backfillRepositories, "backfillRepositories", "", "comma separated URLs of the GitHub repositories backfilled by POST /admin/backfill when the request names none")
+	flag.DurationVar(&backfillSince, "backfillSince", 30*24*time.Hour, "default age of the oldest branch commit or pull request update backfilled")
+	flag.DurationVar(&pipelineHookTimeout, "pipelineHookTimeout", 5*time.Second, "maximum duration of a call of an executable pipeline hook, after which the event is vetoed")
+	flag.StringVar(&signatureKeysSecret, "signatureKeysSecret", "", "Secret holding the cosign or OpenPGP public keys the trigger collections must be signed with")
+	flag.StringVar(&signatureKeysConfigMap, "signatureKeysConfigMap", "", "ConfigMap holding the cosign or OpenPGP public keys the trigger collections must be signed with")
 
 	// init falgs for klog
 	klog.InitFlags(nil)
 
 }
+
+/* Return the configuration of the Kubernetes client, from -master and -kubeconfig outside of the cluster */
+func newKubeConfig() (*rest.Config, error) {
+	if strings.Compare(masterURL, "") != 0 {
+		// running outside of Kube cluster
+		klog.Infof("starting Kabanero webhook outside cluster\n")
+		klog.Infof("masterURL: %s\n", masterURL)
+		klog.Infof("kubeconfig: %s\n", kubeconfig)
+		return clientcmd.BuildConfigFromFlags(masterURL, kubeconfig)
+	}
+	// running inside the Kube cluster
+	klog.Infof("starting Kabanero webhook status controller inside cluster\n")
+	return rest.InClusterConfig()
+}
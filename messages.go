@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"k8s.io/klog"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -28,6 +31,92 @@ type MessageProvider interface {
 type EventDefinition struct {
 	MessageProviders      []*MessageProviderDefinition     `yaml:"messageProviders,omitempty"`
 	EventDestinations     []*EventNode                     `yaml:"eventDestinations,omitempty"`
+	Listener              *ListenerDefinition              `yaml:"listener,omitempty"`
+	Pollers               []*PollerDefinition              `yaml:"pollers,omitempty"`
+	KubeWatchers          []*KubeWatcherDefinition         `yaml:"kubeWatchers,omitempty"`
+	GitAuth               *GitAuthDefinition               `yaml:"gitAuth,omitempty"`
+}
+
+// PollerDefinition describes an URL that is polled, and the eventDestination notified when its response changes.
+type PollerDefinition struct {
+	Name                  string                           `yaml:"name"`
+	URL                   string                           `yaml:"url"`
+	Destination           string                           `yaml:"destination"`
+	Interval              time.Duration                    `yaml:"interval,omitempty"`
+	JSONPath              string                           `yaml:"jsonPath,omitempty"`
+	Headers               map[string]string                `yaml:"headers,omitempty"`
+	Auth                  string                           `yaml:"auth,omitempty"`
+	SecretRef             string                           `yaml:"secretRef,omitempty"`
+	Timeout               time.Duration                    `yaml:"timeout,omitempty"`
+	SkipTLSVerify         bool                             `yaml:"skipTLSVerify,omitempty"`
+	CAFile                string                           `yaml:"caFile,omitempty"`
+}
+
+// KubeWatcherDefinition describes the Kubernetes resources that are watched, core/v1 Events by default, and the
+// eventDestination notified of their changes.
+type KubeWatcherDefinition struct {
+	Name                  string                           `yaml:"name"`
+	Destination           string                           `yaml:"destination"`
+	APIVersion            string                           `yaml:"apiVersion,omitempty"`
+	Kind                  string                           `yaml:"kind,omitempty"`
+	Namespace             string                           `yaml:"namespace,omitempty"`
+	LabelSelector         string                           `yaml:"labelSelector,omitempty"`
+	FieldSelector         string                           `yaml:"fieldSelector,omitempty"`
+	EventTypes            []string                         `yaml:"eventTypes,omitempty"`
+}
+
+// GitAuthDefinition configures the auth providers that resolve the credentials of outbound git calls, and the order
+// in which the providers are tried for each host.
+type GitAuthDefinition struct {
+	Providers             []*GitAuthProviderDefinition     `yaml:"providers,omitempty"`
+	Hosts                 []*GitAuthHost                   `yaml:"hosts,omitempty"`
+}
+
+// GitAuthProviderDefinition describes an auth provider of type secrets, githubApp, vault, workloadIdentity or env.
+type GitAuthProviderDefinition struct {
+	Name                  string                           `yaml:"name"`
+	Type                  string                           `yaml:"type"`
+	AppID                 int64                            `yaml:"appID,omitempty"`
+	InstallationID        int64                            `yaml:"installationID,omitempty"`
+	PrivateKeyFile        string                           `yaml:"privateKeyFile,omitempty"`
+	APIURL                string                           `yaml:"apiURL,omitempty"`
+	Address               string                           `yaml:"address,omitempty"`
+	Path                  string                           `yaml:"path,omitempty"`
+	Role                  string                           `yaml:"role,omitempty"`
+	AuthPath              string                           `yaml:"authPath,omitempty"`
+	JWTFile               string                           `yaml:"jwtFile,omitempty"`
+	TokenFile             string                           `yaml:"tokenFile,omitempty"`
+	TokenURL              string                           `yaml:"tokenURL,omitempty"`
+	Audience              string                           `yaml:"audience,omitempty"`
+	Username              string                           `yaml:"username,omitempty"`
+	CAFile                string                           `yaml:"caFile,omitempty"`
+}
+
+// GitAuthHost lists the auth providers of a host, in the order in which they are tried. The host * matches the
+// hosts that are not listed.
+type GitAuthHost struct {
+	Host                  string                           `yaml:"host"`
+	Providers             []string                         `yaml:"providers"`
+}
+
+// ListenerDefinition configures the webhook listener.
+type ListenerDefinition struct {
+	Paths                 []*ListenerPath                  `yaml:"paths,omitempty"`
+}
+
+// ListenerPath maps a webhook path of the listener to the eventDestination its messages are sent to.
+type ListenerPath struct {
+	Path                  string                           `yaml:"path"`
+	Destination           string                           `yaml:"destination,omitempty"`
+	Middleware            string                           `yaml:"middleware,omitempty"`
+}
+
+// MiddlewareChain returns the middleware chain of the path: its own, or that of the webhook.
+func (path *ListenerPath) MiddlewareChain() string {
+	if path.Middleware != "" {
+		return path.Middleware
+	}
+	return webhookMiddleware
 }
 
 // MessageProviderDefinition describes a message provider and its URLs.
@@ -35,8 +124,81 @@ type MessageProviderDefinition struct {
 	Name                  string                           `yaml:"name"`
 	ProviderType          string                           `yaml:"providerType"`
 	URL                   string                           `yaml:"url"`
+	URLs                  []string                         `yaml:"urls,omitempty"`
 	Timeout               time.Duration                    `yaml:"timeout"`
 	SkipTLSVerify         bool                             `yaml:"skipTLSVerify,omitempty"`
+	ConsumerGroup         string                           `yaml:"consumerGroup,omitempty"`
+	Username              string                           `yaml:"username,omitempty"`
+	PasswordEnv           string                           `yaml:"passwordEnv,omitempty"`
+	CAFile                string                           `yaml:"caFile,omitempty"`
+	CertFile              string                           `yaml:"certFile,omitempty"`
+	KeyFile               string                           `yaml:"keyFile,omitempty"`
+	Backends              []string                         `yaml:"backends,omitempty"`
+	RetryInterval         time.Duration                    `yaml:"retryInterval,omitempty"`
+	CloudEvents           string                           `yaml:"cloudEvents,omitempty"`
+	Headers               map[string]string                `yaml:"headers,omitempty"`
+	Auth                  string                           `yaml:"auth,omitempty"`
+	SecretRef             string                           `yaml:"secretRef,omitempty"`
+	MaxRetries            int                              `yaml:"maxRetries,omitempty"`
+	JetStream             *JetStreamDefinition             `yaml:"jetStream,omitempty"`
+	Redis                 *RedisDefinition                 `yaml:"redis,omitempty"`
+	AWS                   *AWSDefinition                   `yaml:"aws,omitempty"`
+	PubSub                *PubSubDefinition                `yaml:"pubsub,omitempty"`
+	Notification          *NotificationDefinition          `yaml:"notification,omitempty"`
+	MaxReconnects         int                              `yaml:"maxReconnects,omitempty"`
+	ReconnectWait         time.Duration                    `yaml:"reconnectWait,omitempty"`
+	ReconnectBufSize      int                              `yaml:"reconnectBufSize,omitempty"`
+	Config                map[string]interface{}           `yaml:"config,omitempty"`
+}
+
+// JetStreamDefinition describes the stream and durable consumers of a JetStream provider.
+type JetStreamDefinition struct {
+	Stream                string                           `yaml:"stream"`
+	Subjects              []string                         `yaml:"subjects,omitempty"`
+	Retention             string                           `yaml:"retention,omitempty"`
+	Storage               string                           `yaml:"storage,omitempty"`
+	MaxAge                time.Duration                    `yaml:"maxAge,omitempty"`
+	MaxMsgs               int64                            `yaml:"maxMsgs,omitempty"`
+	MaxBytes              int64                            `yaml:"maxBytes,omitempty"`
+	Replicas              int                              `yaml:"replicas,omitempty"`
+	Durable               string                           `yaml:"durable,omitempty"`
+	DeliverPolicy         string                           `yaml:"deliverPolicy,omitempty"`
+	AckWait               time.Duration                    `yaml:"ackWait,omitempty"`
+	MaxDeliver            int                              `yaml:"maxDeliver,omitempty"`
+}
+
+// RedisDefinition describes the streams and consumer of a Redis provider.
+type RedisDefinition struct {
+	MaxLen                int64                            `yaml:"maxLen,omitempty"`
+	Consumer              string                           `yaml:"consumer,omitempty"`
+}
+
+// AWSDefinition describes the region, account, and SQS queues of an AWS provider.
+type AWSDefinition struct {
+	Region                string                           `yaml:"region"`
+	AccountID             string                           `yaml:"accountID,omitempty"`
+	RoleARN               string                           `yaml:"roleARN,omitempty"`
+	Queues                map[string]string                `yaml:"queues,omitempty"`
+	VisibilityTimeout     time.Duration                    `yaml:"visibilityTimeout,omitempty"`
+	WaitTime              time.Duration                    `yaml:"waitTime,omitempty"`
+	MaxMessages           int                              `yaml:"maxMessages,omitempty"`
+}
+
+// PubSubDefinition describes the project, subscriptions, and delivery of a Google Cloud Pub/Sub provider.
+type PubSubDefinition struct {
+	Project               string                           `yaml:"project"`
+	Subscriptions         map[string]string                `yaml:"subscriptions,omitempty"`
+	AckDeadline           time.Duration                    `yaml:"ackDeadline,omitempty"`
+	Ordered               bool                             `yaml:"ordered,omitempty"`
+	MaxMessages           int                              `yaml:"maxMessages,omitempty"`
+}
+
+// NotificationDefinition describes the messages posted by a notification provider to a Slack or Teams webhook.
+type NotificationDefinition struct {
+	Format                string                           `yaml:"format"`
+	Title                 string                           `yaml:"title,omitempty"`
+	Text                  string                           `yaml:"text"`
+	Colors                map[string]string                `yaml:"colors,omitempty"`
 }
 
 // EventNode represents either an event source or destination and consists of a provider reference and the topic to
@@ -45,59 +207,127 @@ type EventNode struct {
 	Name                  string                           `yaml:"name"`
 	Topic                 string                           `yaml:"topic"`
 	ProviderRef           string                           `yaml:"providerRef"`
+	Anonymize             bool                             `yaml:"anonymize,omitempty"`
+	Accepts               []string                         `yaml:"accepts,omitempty"`
+	Transform             *TransformDefinition             `yaml:"transform,omitempty"`
+	Filter                string                           `yaml:"filter,omitempty"`
+	ReceiveFilter         string                           `yaml:"receiveFilter,omitempty"`
+	Retry                 *RetryDefinition                 `yaml:"retry,omitempty"`
+}
+
+// TransformDefinition describes the transformation of the messages sent to an eventDestination.
+type TransformDefinition struct {
+	Remove                []string                         `yaml:"remove,omitempty"`
+	Expression            string                           `yaml:"expression,omitempty"`
+	Template              string                           `yaml:"template,omitempty"`
+}
+
+// RetryDefinition describes the retries of the failed sends to an eventDestination.
+type RetryDefinition struct {
+	MaxAttempts           int                              `yaml:"maxAttempts,omitempty"`
+	Backoff               string                           `yaml:"backoff,omitempty"`
+	InitialInterval       time.Duration                    `yaml:"initialInterval,omitempty"`
+	MaxInterval           time.Duration                    `yaml:"maxInterval,omitempty"`
+	MaxElapsedTime        time.Duration                    `yaml:"maxElapsedTime,omitempty"`
 }
 
 
 var (
 	messageProviders map[string]MessageProvider
+	/* guards messageProviders and eventProviders, which are replaced when the configuration changes */
+	messageProvidersMutex sync.RWMutex
 )
 
+// currentEventProviders returns the current eventDefinitions, or nil.
+func currentEventProviders() *EventDefinition {
+	messageProvidersMutex.RLock()
+	defer messageProvidersMutex.RUnlock()
+	return eventProviders
+}
+
+// replaceEventProviders replaces the eventDefinitions and the messageProviders at once, returning the previous
+// messageProviders.
+func replaceEventProviders(ed *EventDefinition, providers map[string]MessageProvider) map[string]MessageProvider {
+	messageProvidersMutex.Lock()
+	defer messageProvidersMutex.Unlock()
+	previous := messageProviders
+	eventProviders, messageProviders = ed, providers
+	return previous
+}
+
+// lookupMessageProvider returns the MessageProvider specified by name, or nil.
+func lookupMessageProvider(name string) MessageProvider {
+	messageProvidersMutex.RLock()
+	defer messageProvidersMutex.RUnlock()
+	return messageProviders[name]
+}
+
 func initializeEventProviders(fileName string) (*EventDefinition, error) {
 	if klog.V(5) {
 		klog.Info("Initializing event providers...")
 	}
+	messageProvidersMutex.Lock()
 	messageProviders = make(map[string]MessageProvider)
+	messageProvidersMutex.Unlock()
 	ed, err := readEventDefinition(fileName)
+	if err != nil && crdConfig && os.IsNotExist(err) {
+		/* the configuration may be entirely in CRs */
+		ed, err = &EventDefinition{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	if crdConfig && currentCRDConfig != nil {
+		fileEventDefinition = ed
+		ed = mergeCRDConfiguration(ed, currentCRDConfig)
+	}
 
 	// Create the messaging providers
 	for _, provider := range ed.MessageProviders {
-		switch provider.ProviderType {
-		case "nats":
-			if klog.V(6) {
-				klog.Infof("Creating NATS provider '%s'", provider.Name)
-			}
-			natsProvider, err := newNATSProvider(provider)
-			if err != nil {
-				klog.Warning(err)
-			}
-			err = RegisterProvider(provider.Name, natsProvider)
-			if err != nil {
-                klog.Warning(err)
-			}
-		case "rest":
-			if klog.V(6) {
-				klog.Infof("Creating REST provider '%s'", provider.Name)
-			}
-			restProvider, err := newRESTProvider(provider)
-			if err != nil {
-                klog.Warning(err)
-			}
-			err = RegisterProvider(provider.Name, restProvider)
-			if err != nil {
-				klog.Warning(err)
-			}
-		case "kafka":
-			klog.Warning("Kafka provider is not yet implemented.")
-		default:
-			klog.Warningf("Provider '%s' is not recognized.", provider.ProviderType)
+		mp, err := createMessageProvider(provider)
+		if err != nil {
+			klog.Warning(err)
+			/* a failed provider is not registered, so that it is reported as undefined rather than used */
+			continue
+		}
+		err = RegisterProvider(provider.Name, mp)
+		if err != nil {
+			klog.Warning(err)
 		}
 	}
+	messageProvidersMutex.Lock()
+	err = initializeProviders(ed, messageProviders)
+	messageProvidersMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err = initializeGitAuth(ed); err != nil {
+		return nil, err
+	}
 	return ed, nil
 }
 
+/*
+Wrap the created providers of a definition in CloudEvents and signed envelopes, and validate its eventDestinations.
+Providers missing from the map, such as those kept from a previous definition, are not wrapped again.
+*/
+func initializeProviders(ed *EventDefinition, providers map[string]MessageProvider) error {
+	/* messages are signed before they are wrapped in CloudEvents */
+	if err := initializeCloudEvents(ed, providers); err != nil {
+		return err
+	}
+	if err := initializeEnvelopeSigning(ed, providers); err != nil {
+		return err
+	}
+	if err := initializeTransforms(ed); err != nil {
+		return err
+	}
+	if err := initializeFilters(ed); err != nil {
+		return err
+	}
+	return initializeRetries(ed)
+}
+
 func readEventDefinition(fileName string) (*EventDefinition, error) {
 	if klog.V(5) {
 		klog.Infof("Reading event providers from '%s'", fileName)
@@ -110,17 +340,36 @@ func readEventDefinition(fileName string) (*EventDefinition, error) {
 
 	var ed EventDefinition
 	err = yaml.Unmarshal(bytes, &ed)
+	if err == nil {
+		checkEventDefinitionDeprecations(fileName, bytes, &ed)
+	}
 	return &ed, err
 }
 
 // GetMessageProvider returns the MessageProvider implementation specified by name.
 func (ed *EventDefinition) GetMessageProvider(name string) MessageProvider {
-	return messageProviders[name]
+	return lookupMessageProvider(name)
+}
+
+// GetMessageProviderDefinition returns the definition of the messageProvider specified by name.
+func (ed *EventDefinition) GetMessageProviderDefinition(name string) *MessageProviderDefinition {
+	if ed == nil {
+		return nil
+	}
+	for _, mpd := range ed.MessageProviders {
+		if mpd.Name == name {
+			return mpd
+		}
+	}
+	return nil
 }
 
 // GetEventDestination returns the eventDestination specified by name.
 func (ed *EventDefinition) GetEventDestination(name string) *EventNode {
-	for _, node := range eventProviders.EventDestinations {
+	if ed == nil {
+		return nil
+	}
+	for _, node := range ed.EventDestinations {
 		if node.Name == name {
 			return node
 		}
@@ -130,6 +379,43 @@ func (ed *EventDefinition) GetEventDestination(name string) *EventNode {
 
 // RegisterProvider should be called to register a new provider.
 func RegisterProvider(name string, mp MessageProvider) error {
+	messageProvidersMutex.Lock()
+	defer messageProvidersMutex.Unlock()
 	messageProviders[name] = mp
 	return nil
 }
+
+// sendToDestinationNow sends a message to the eventDestination specified by name, without spooling it.
+func sendToDestinationNow(name string, bytes []byte, header interface{}) error {
+	destNode := currentEventProviders().GetEventDestination(name)
+	if destNode == nil {
+		return fmt.Errorf("unable to find an eventDestination with the name '%s'. Verify that it has been defined", name)
+	}
+	provider := lookupMessageProvider(destNode.ProviderRef)
+	if provider == nil {
+		return fmt.Errorf("unable to find a messageProvider with the name '%s'. Verify that is has been defined", destNode.ProviderRef)
+	}
+	if !filterSentMessage(destNode, bytes) {
+		return nil
+	}
+	if destNode.Transform != nil {
+		transformed, err := transformMessage(destNode, bytes)
+		if err != nil {
+			return fmt.Errorf("unable to transform message for eventDestination %s: %v", name, err)
+		}
+		bytes = transformed
+	}
+	if destNode.Anonymize {
+		anonymized, err := anonymizeMessage(bytes)
+		if err != nil {
+			return fmt.Errorf("unable to anonymize message for eventDestination %s: %v", name, err)
+		}
+		bytes = anonymized
+	}
+	err := sendWithRetryPolicy(destNode, provider, bytes, header)
+	recordMessageActivity(destNode, true, err)
+	if err == nil {
+		hookDelivered(name, bytes)
+	}
+	return err
+}
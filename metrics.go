@@ -0,0 +1,39 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"expvar"
+)
+
+/*
+Counters exported through the admin API at /admin/metrics.
+Names are dot separated, most general component first, such as triggerProcessor.canary.messages.
+*/
+var metrics = expvar.NewMap("kabaneroEvents")
+
+/* Add one to the named counter */
+func incrementMetric(name string) {
+	metrics.Add(name, 1)
+}
+
+/* Set the named gauge */
+func setMetric(name string, value int64) {
+	gauge := new(expvar.Int)
+	gauge.Set(value)
+	metrics.Set(name, gauge)
+}
@@ -0,0 +1,415 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+)
+
+/*
+HTTP middleware. Each endpoint is served through a chain of middleware, given by name on the command line, so that a
+deployment can compose the protections it needs for each endpoint. The first middleware of a chain is the outermost.
+Additional middleware may be added with registerMiddleware before the listeners are started.
+*/
+
+/* environment variables for the middleware */
+const (
+	WEBHOOKSECRET   = "WEBHOOK_SECRET"   // environment variable containing the secret used to sign webhook requests
+	GITLABTOKEN     = "GITLAB_TOKEN"     // environment variable containing the secret token of GitLab webhook requests
+	BITBUCKETSECRET = "BITBUCKET_SECRET" // environment variable containing the secret used to sign Bitbucket webhook requests
+)
+
+/* Default middleware chains of the endpoints */
+const (
+	defaultWebhookMiddleware   = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,auth"
+	defaultGitLabMiddleware    = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,gitlabAuth"
+	defaultBitbucketMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,bitbucketAuth"
+	defaultAdminMiddleware     = "recovery,requestID,securityHeaders,clientIP,logging"
+)
+
+const otherRoute = "other" // metric key of the requests that were not routed by a mux
+
+type middleware func(http.Handler) http.Handler
+
+var (
+	webhookMiddleware   string  // comma separated middleware chain of the webhook endpoint
+	gitlabMiddleware    string  // comma separated middleware chain of the GitLab webhook endpoint
+	bitbucketMiddleware string  // comma separated middleware chain of the Bitbucket webhook endpoint
+	adminMiddleware     string  // comma separated middleware chain of the admin endpoints
+	maxBodySize         int64   // maximum size, in bytes, of a request body accepted by the sizeLimit middleware
+	allowedContentTypes string  // comma separated media types of the request bodies accepted by the contentType middleware
+	webhookRate         float64 // requests per second accepted by the rateLimit middleware. Unlimited if 0
+	webhookBurst        int     // burst size of the rateLimit middleware
+
+	middlewareMutex sync.RWMutex
+	middlewares     = map[string]middleware{
+		"recovery":         recoveryMiddleware,
+		"requestID":        requestIDMiddleware,
+		"securityHeaders":  securityHeadersMiddleware,
+		"clientIP":         clientIPMiddleware,
+		"logging":          loggingMiddleware,
+		"metrics":          metricsMiddleware,
+		"tracing":          tracingMiddleware,
+		"sizeLimit":        sizeLimitMiddleware,
+		"contentType":      contentTypeMiddleware,
+		"rateLimit":        rateLimitMiddleware,
+		"auth":             authMiddleware,
+		"gitlabAuth":       gitlabAuthMiddleware,
+		"bitbucketAuth":    bitbucketAuthMiddleware,
+		"giteaAuth":        giteaAuthMiddleware,
+		"azureDevOpsAuth":  azureDevOpsAuthMiddleware,
+		"registryAuth":     registryAuthMiddleware,
+		"slackAuth":        slackAuthMiddleware,
+		"alertmanagerAuth": alertmanagerAuthMiddleware,
+		"cloudEventsAuth":  cloudEventsAuthMiddleware,
+		"interceptorAuth":  interceptorAuthMiddleware,
+	}
+)
+
+/* Register a middleware under a name, so that it may be used in a middleware chain */
+func registerMiddleware(name string, m middleware) error {
+	middlewareMutex.Lock()
+	defer middlewareMutex.Unlock()
+	if _, exists := middlewares[name]; exists {
+		return fmt.Errorf("middleware %v is already registered", name)
+	}
+	middlewares[name] = m
+	return nil
+}
+
+/* Wrap a handler in the comma separated chain of middleware */
+func chainMiddleware(chain string, handler http.Handler) (http.Handler, error) {
+	middlewareMutex.RLock()
+	defer middlewareMutex.RUnlock()
+
+	names := make([]string, 0)
+	for _, name := range strings.Split(chain, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	/* wrap from the innermost so that the first middleware sees the request first */
+	for i := len(names) - 1; i >= 0; i-- {
+		m, ok := middlewares[names[i]]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %v", names[i])
+		}
+		handler = m(handler)
+	}
+	return handler, nil
+}
+
+/* The key of the pattern of the route of a request in its context */
+type routeKey struct{}
+
+/*
+Register a handler on a mux, wrapped in a middleware chain. The pattern is kept in the context of the requests for
+metricRoute, since http.Request.Pattern is not set in GOPATH builds, which default to the mux of Go 1.21.
+*/
+func handleWithMiddleware(mux *http.ServeMux, pattern string, chain string, handler http.HandlerFunc) error {
+	wrapped, err := chainMiddleware(chain, handler)
+	if err != nil {
+		return fmt.Errorf("unable to set up middleware of %v: %v", pattern, err)
+	}
+	mux.Handle(pattern, http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		wrapped.ServeHTTP(writer, req.WithContext(context.WithValue(req.Context(), routeKey{}, pattern)))
+	}))
+	return nil
+}
+
+/* A response writer that remembers the status code */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+/* Return the wrapped writer, so that http.ResponseController reaches the connection */
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+/* Flush the response, so that streamed responses are sent as they are written */
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/* Return the writer as a statusRecorder, wrapping it if it is not one yet */
+func recordStatus(writer http.ResponseWriter) *statusRecorder {
+	if recorder, ok := writer.(*statusRecorder); ok {
+		return recorder
+	}
+	return &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+}
+
+/* Recover from a panic in a handler, and respond with an internal server error */
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				klog.Errorf("Panic serving %v %v: %v", req.Method, req.URL.Path, r)
+				incrementMetric("http.panics")
+				writeError(writer, req, codeInternalError, "internal server error")
+			}
+		}()
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* Log each request with its status and duration */
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := recordStatus(writer)
+		next.ServeHTTP(recorder, req)
+		/* the ID of the event of a webhook request, or the ID of the request */
+		eventID := req.Header.Get("X-Github-Delivery")
+		if eventID == "" {
+			eventID = req.Header.Get(REQUESTIDHEADER)
+		}
+		logEvent(0, "info", eventID, fmt.Sprintf("%v %v", req.Method, req.URL.Path), logFields{"remote": req.RemoteAddr, "status": recorder.status, "duration": time.Since(start), "requestID": req.Header.Get(REQUESTIDHEADER)})
+	})
+}
+
+/*
+Return the key of the metrics of a request: the pattern of its route, such as /admin/deadletters/, or other if it was
+not routed by handleWithMiddleware. Paths are not used as keys, since any client could then grow the metrics without
+bound.
+*/
+func metricRoute(req *http.Request) string {
+	if pattern, ok := req.Context().Value(routeKey{}).(string); ok && pattern != "" {
+		return pattern
+	}
+	return otherRoute
+}
+
+/* Count requests and responses by status in the metrics */
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := recordStatus(writer)
+		next.ServeHTTP(recorder, req)
+		incrementMetric("http." + metricRoute(req) + ".requests")
+		incrementMetric(fmt.Sprintf("http.%v.status.%d", metricRoute(req), recorder.status))
+		metrics.Add("http."+metricRoute(req)+".durationMillis", time.Since(start).Nanoseconds()/int64(time.Millisecond))
+	})
+}
+
+/*
+Record the request as a span of the trace of its W3C traceparent header, or of a new trace if the request does not have
+one. The header is replaced by the context of the span, and is part of the webhook message, so that the trace can be
+followed through the message provider.
+*/
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		s := startSpan(req.Method+" "+req.URL.Path, spanKindServer, parseTraceparent(req.Header.Get(TRACEPARENT)))
+		req.Header.Set(TRACEPARENT, s.context.traceparent())
+		recorder := recordStatus(writer)
+		next.ServeHTTP(recorder, req)
+		s.setAttribute("http.request.method", req.Method)
+		s.setAttribute("url.path", req.URL.Path)
+		s.setAttribute("http.response.status_code", recorder.status)
+		if id := req.Header.Get("X-Github-Delivery"); id != "" {
+			s.setAttribute("kabanero.event_id", id)
+		}
+		var err error
+		if recorder.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%s", http.StatusText(recorder.status))
+		}
+		s.finish(err)
+	})
+}
+
+/* Reject request bodies larger than maxBodySize, or not read within bodyReadTimeout */
+func sizeLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		req = limitBodyReadTime(writer, req)
+		if maxBodySize > 0 {
+			if req.ContentLength > maxBodySize {
+				writeError(writer, req, codePayloadTooLarge, "request body too large")
+				return
+			}
+			req.Body = http.MaxBytesReader(writer, req.Body, maxBodySize)
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/*
+Reject request bodies whose Content-Type is not one of the allowedContentTypes, such as the form encoded bodies of
+webhooks that are not configured to send JSON, before they are read. A type with a * subtype, such as
+application/*+json, matches the subtypes with the same suffix. Only UTF-8 bodies are accepted.
+*/
+func contentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.ContentLength == 0 || req.Method == http.MethodGet || req.Method == http.MethodHead {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		contentType := req.Header.Get("Content-Type")
+		if err := checkContentType(contentType); err != nil {
+			incrementMetric("http." + metricRoute(req) + ".unsupportedMediaType")
+			if klog.V(2) {
+				klog.Infof("Rejected %v %v with Content-Type %q: %v", req.Method, req.URL.Path, contentType, err)
+			}
+			writeError(writer, req, codeUnsupportedMediaType, err.Error())
+			return
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* Return an error if a Content-Type is not one of the allowedContentTypes */
+func checkContentType(contentType string) error {
+	if contentType == "" {
+		return fmt.Errorf("the Content-Type of the request body is required")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type %s", contentType)
+	}
+	if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+		return fmt.Errorf("unsupported charset %s, the request body must be UTF-8", charset)
+	}
+	for _, allowed := range strings.Split(allowedContentTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == mediaType {
+			return nil
+		}
+		/* application/*+json */
+		if index := strings.Index(allowed, "/*"); index >= 0 && strings.HasPrefix(mediaType, allowed[:index+1]) && strings.HasSuffix(mediaType, allowed[index+2:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported Content-Type %s, expected %s", mediaType, allowedContentTypes)
+}
+
+/* Limit the rate of requests to webhookRate per second, and to webhookSourceRate per second from each client */
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	var limiter *rate.Limiter
+	var sourceLimiters *keyedLimiters
+	var once sync.Once
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		/* the limiters are created on first use, after the flags are parsed */
+		once.Do(func() {
+			if webhookRate > 0 {
+				limiter = rate.NewLimiter(rate.Limit(webhookRate), webhookBurst)
+			}
+			if webhookSourceRate > 0 {
+				sourceLimiters = newKeyedLimiters(webhookSourceRate, webhookSourceBurst)
+			}
+		})
+		now := time.Now()
+		if sourceLimiters != nil {
+			if allowed, retryAfter := sourceLimiters.allow(clientIP(req), now); !allowed {
+				incrementMetric("http." + metricRoute(req) + ".sourceRateLimited")
+				rejectRateLimited(writer, req, retryAfter, "too many requests from "+clientIP(req))
+				return
+			}
+		}
+		if limiter != nil {
+			if allowed, retryAfter := allowAt(limiter, now); !allowed {
+				incrementMetric("http." + metricRoute(req) + ".rateLimited")
+				rejectRateLimited(writer, req, retryAfter, "too many requests")
+				return
+			}
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/*
+Verify the X-Hub-Signature header of the request: the HMAC SHA1 of the body, keyed with the secret in the environment
+variable WEBHOOK_SECRET. Requests are not verified if the variable is not set.
+*/
+func authMiddleware(next http.Handler) http.Handler {
+	return hmacVerifier{secretEnv: WEBHOOKSECRET, headers: []string{"X-Hub-Signature"}, prefix: "sha1=", hash: sha1.New}.middleware(next)
+}
+
+/* The verification of the HMAC signature of the body of webhook requests */
+type hmacVerifier struct {
+	secretEnv string           // environment variable containing the secret. Requests are not verified if not set
+	headers   []string         // headers of the signature. The first one set is verified
+	prefix    string           // prefix of the hex encoded signature, such as sha256=
+	hash      func() hash.Hash // hash function of the HMAC
+	/* return the signed content of a request, or an error if it is invalid. The body if nil */
+	content func(req *http.Request, body []byte) ([]byte, error)
+}
+
+/* Return a middleware verifying the signature of requests, and restoring their body for the next handler */
+func (verifier hmacVerifier) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		secret := os.Getenv(verifier.secretEnv)
+		if secret == "" {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			writeError(writer, req, codeBadRequest, "unable to read request body")
+			return
+		}
+		content := body
+		if verifier.content != nil {
+			if content, err = verifier.content(req, body); err != nil {
+				incrementMetric("http." + metricRoute(req) + ".unauthorized")
+				writeError(writer, req, codeInvalidSignature, err.Error())
+				return
+			}
+		}
+		signature := ""
+		for _, header := range verifier.headers {
+			if signature = req.Header.Get(header); signature != "" {
+				break
+			}
+		}
+		mac := hmac.New(verifier.hash, []byte(secret))
+		mac.Write(content)
+		expected := verifier.prefix + hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(signature), []byte(expected)) {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeInvalidSignature, "invalid signature")
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(writer, req)
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestChainMiddleware(t *testing.T) {
+	order := make([]string, 0)
+	tagging := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(writer, req)
+			})
+		}
+	}
+	if err := registerMiddleware("testFirst", tagging("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerMiddleware("testSecond", tagging("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerMiddleware("testFirst", tagging("first")); err == nil {
+		t.Fatal("expected error registering a middleware twice")
+	}
+
+	handler, err := chainMiddleware("testFirst, testSecond", http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		order = append(order, "handler")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/webhook", nil))
+	if strings.Join(order, ",") != "first,second,handler" {
+		t.Fatalf("unexpected middleware order: %v", order)
+	}
+
+	if _, err = chainMiddleware("recovery,unknown", handler); err == nil {
+		t.Fatal("expected error for unknown middleware")
+	}
+}
+
+func TestAuthAndSizeLimitMiddleware(t *testing.T) {
+	os.Setenv(WEBHOOKSECRET, "secret")
+	defer os.Unsetenv(WEBHOOKSECRET)
+	savedMaxBodySize := maxBodySize
+	maxBodySize = 16
+	defer func() { maxBodySize = savedMaxBodySize }()
+
+	handler, err := chainMiddleware("recovery,sizeLimit,auth", http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		writer.Write(body)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(body string) string {
+		mac := hmac.New(sha1.New, []byte("secret"))
+		mac.Write([]byte(body))
+		return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	tests := []struct {
+		body      string
+		signature string
+		status    int
+	}{
+		{`{"a":1}`, sign(`{"a":1}`), http.StatusOK},
+		{`{"a":1}`, sign(`{"a":2}`), http.StatusUnauthorized},
+		{`{"a":1}`, "", http.StatusUnauthorized},
+		{`{"a":"0123456789abcdef"}`, sign(`{"a":"0123456789abcdef"}`), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/webhook", strings.NewReader(test.body))
+		if test.signature != "" {
+			req.Header.Set("X-Hub-Signature", test.signature)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.status {
+			t.Errorf("body %v signature %v: expected status %v, got %v", test.body, test.signature, test.status, recorder.Code)
+		}
+		if test.status == http.StatusOK && recorder.Body.String() != test.body {
+			t.Errorf("body not passed to handler after verification: %v", recorder.Body.String())
+		}
+	}
+}
+
+func TestContentTypeMiddleware(t *testing.T) {
+	saved := allowedContentTypes
+	defer func() { allowedContentTypes = saved }()
+	allowedContentTypes = "application/json,application/*+json"
+
+	handler := contentTypeMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+	tests := map[string]int{
+		"application/json":                     http.StatusOK,
+		"application/json; charset=UTF-8":      http.StatusOK,
+		"application/cloudevents+json":         http.StatusOK,
+		"application/x-www-form-urlencoded":    http.StatusUnsupportedMediaType,
+		"text/json+xml":                        http.StatusUnsupportedMediaType,
+		"application/json; charset=iso-8859-1": http.StatusUnsupportedMediaType,
+		"":                                     http.StatusUnsupportedMediaType,
+		"application/json; charset":            http.StatusUnsupportedMediaType,
+	}
+	for contentType, status := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("{}"))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != status {
+			t.Errorf("Content-Type %q returned %v, expected %v", contentType, recorder.Code, status)
+		}
+	}
+
+	/* requests without a body are not checked */
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/webhook", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("request without body returned %v", recorder.Code)
+	}
+}
+
+func TestMetricsMiddlewareRoutes(t *testing.T) {
+	metricValue := func(key string) string {
+		if value := metrics.Get(key); value != nil {
+			return value.String()
+		}
+		return "0"
+	}
+	mux := http.NewServeMux()
+	handler := func(writer http.ResponseWriter, req *http.Request) { writer.WriteHeader(http.StatusAccepted) }
+	if err := handleWithMiddleware(mux, "/routes/", "metrics", handler); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/routes/a", "/routes/b"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, path, nil))
+	}
+	if value := metricValue("http./routes/.requests"); value != "2" {
+		t.Errorf("%v requests counted for the route, expected 2", value)
+	}
+	if value := metricValue("http./routes/.status.202"); value != "2" {
+		t.Errorf("%v responses counted for the route, expected 2", value)
+	}
+	if metrics.Get("http./routes/a.requests") != nil {
+		t.Error("requests counted by path")
+	}
+
+	/* requests that were not routed by a mux are counted as other */
+	before := metricValue("http.other.requests")
+	metricsMiddleware(http.HandlerFunc(handler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/unrouted", nil))
+	if metricValue("http.other.requests") == before || metrics.Get("http./unrouted.requests") != nil {
+		t.Error("unrouted request not counted as other")
+	}
+}
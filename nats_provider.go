@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"github.com/nats-io/nats.go"
 	"k8s.io/klog"
-	// "time"
+	"strings"
+	"time"
 )
 
+// By default, NATS providers reconnect forever, so that delivery resumes once a broker restarts.
+const defaultNATSReconnectWait = 2 * time.Second
+
 type natsProvider struct {
 	messageProviderDefinition *MessageProviderDefinition
     connection *nats.Conn
@@ -15,16 +19,73 @@ type natsProvider struct {
 
 func (provider *natsProvider) initialize(mpd *MessageProviderDefinition) error {
 	provider.messageProviderDefinition = mpd
-	nc, err := nats.Connect(mpd.URL)
+	// The servers of a NATS cluster are listed in urls. The client fails over between them, and resubscribes.
+	servers := mpd.URLs
+	if mpd.URL != "" {
+		servers = append([]string{mpd.URL}, servers...)
+	}
+	nc, err := nats.Connect(strings.Join(servers, ","), provider.options()...)
 	if err != nil {
 		return err
 	}
+	setMetric(provider.connectedMetric(), 1)
 
 	provider.connection = nc
 	provider.subscription = make(map[string]*nats.Subscription)
 	return nil
 }
 
+// Return the reconnect options of the connection, and the handlers reporting its state.
+func (provider *natsProvider) options() []nats.Option {
+	mpd := provider.messageProviderDefinition
+	maxReconnects := mpd.MaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = -1
+	}
+	reconnectWait := mpd.ReconnectWait
+	if reconnectWait <= 0 {
+		reconnectWait = defaultNATSReconnectWait
+	}
+	// Without a reconnect buffer, sends fail during outages, and are retried or spooled.
+	reconnectBufSize := mpd.ReconnectBufSize
+	if reconnectBufSize <= 0 {
+		reconnectBufSize = -1
+	}
+	return []nats.Option{
+		// The client name identifies the connection in the monitoring of the server.
+		nats.Name(userAgent()),
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(reconnectWait),
+		nats.ReconnectBufSize(reconnectBufSize),
+		nats.DisconnectErrHandler(provider.disconnected),
+		nats.ReconnectHandler(provider.reconnected),
+		nats.ClosedHandler(provider.closed),
+	}
+}
+
+// Name of the gauge that is 1 while the provider is connected, and 0 otherwise.
+func (provider *natsProvider) connectedMetric() string {
+	return "nats." + provider.messageProviderDefinition.Name + ".connected"
+}
+
+func (provider *natsProvider) disconnected(nc *nats.Conn, err error) {
+	setMetric(provider.connectedMetric(), 0)
+	incrementMetric("nats.disconnects")
+	klog.Warningf("NATS provider '%s' disconnected, reconnecting: %v", provider.messageProviderDefinition.Name, err)
+}
+
+func (provider *natsProvider) reconnected(nc *nats.Conn) {
+	setMetric(provider.connectedMetric(), 1)
+	incrementMetric("nats.reconnects")
+	klog.Infof("NATS provider '%s' reconnected to %v", provider.messageProviderDefinition.Name, nc.ConnectedUrl())
+}
+
+func (provider *natsProvider) closed(nc *nats.Conn) {
+	setMetric(provider.connectedMetric(), 0)
+	incrementMetric("nats.closed")
+	klog.Errorf("Connection of NATS provider '%s' closed: %v", provider.messageProviderDefinition.Name, nc.LastError())
+}
+
 func (provider *natsProvider) Subscribe(node *EventNode) error {
 	if klog.V(6) {
 		urlAndTopic := fmt.Sprintf("%s:%s", provider.messageProviderDefinition.URL, node.Topic)
@@ -47,6 +108,12 @@ func (provider *natsProvider) Send(node *EventNode, payload []byte, header inter
 		return err
 	}
 
+	// During an outage, the message is in the reconnect buffer, and sent once reconnected.
+	if conn.IsReconnecting() && provider.messageProviderDefinition.ReconnectBufSize > 0 {
+		incrementMetric("nats.buffered")
+		return nil
+	}
+
 	// Perform a round trip to the server and return when it receives the internal reply.
 	if err := conn.Flush(); err != nil {
 		return err
@@ -104,6 +171,12 @@ func (provider *natsProvider) ListenAndServe(node *EventNode, receiver ReceiverF
 	sub.Drain()
 }
 
+func init() {
+	RegisterMessageProvider("nats", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newNATSProvider(mpd)
+	})
+}
+
 func newNATSProvider(mpd *MessageProviderDefinition) (*natsProvider, error) {
 	provider := new(natsProvider)
 	if err := provider.initialize(mpd); err != nil {
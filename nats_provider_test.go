@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATSProviderOptions(t *testing.T) {
+	provider := &natsProvider{messageProviderDefinition: &MessageProviderDefinition{Name: "broker"}}
+	options := &nats.Options{}
+	for _, option := range provider.options() {
+		if err := option(options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if options.MaxReconnect != -1 || options.ReconnectWait != defaultNATSReconnectWait || options.ReconnectBufSize != -1 {
+		t.Fatalf("unexpected default options %+v", options)
+	}
+
+	provider.messageProviderDefinition = &MessageProviderDefinition{Name: "broker", MaxReconnects: 10, ReconnectWait: time.Second, ReconnectBufSize: 1024}
+	for _, option := range provider.options() {
+		option(options)
+	}
+	if options.MaxReconnect != 10 || options.ReconnectWait != time.Second || options.ReconnectBufSize != 1024 {
+		t.Fatalf("unexpected options %+v", options)
+	}
+}
+
+func TestNATSProviderConnectionMetrics(t *testing.T) {
+	provider := &natsProvider{messageProviderDefinition: &MessageProviderDefinition{Name: "metrics-broker"}}
+	connected := func() string {
+		return metrics.Get(provider.connectedMetric()).String()
+	}
+	provider.reconnected(nil)
+	if connected() != "1" {
+		t.Fatalf("gauge is %v after reconnecting", connected())
+	}
+	provider.disconnected(nil, fmt.Errorf("connection reset"))
+	if connected() != "0" || metrics.Get("nats.disconnects") == nil {
+		t.Fatalf("gauge is %v after disconnecting", connected())
+	}
+	provider.reconnected(nil)
+	provider.closed(nil)
+	if connected() != "0" {
+		t.Fatalf("gauge is %v after the connection closed", connected())
+	}
+}
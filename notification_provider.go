@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	"k8s.io/klog"
+)
+
+// The notification provider posts the messages sent to its eventDestinations to a Slack incoming webhook or to a
+// Microsoft Teams connector, so that people are told of events, and of the outcomes and errors of triggers. The title
+// and text of the notification are Go templates of the message, with the variables and functions of the templates of
+// transforms, and the color of the notification is that of the kind of the event. The webhook URL is the url of the
+// messageProvider, or the url key of its secretRef, as webhook URLs are secrets. Requests are sent, and retried, as by
+// the HTTP provider, without the headers of the webhook message.
+
+const (
+	notificationSlack = "slack"
+	notificationTeams = "teams"
+
+	notificationURLKey       = "url"     // key of the secretRef holding the webhook URL
+	notificationKindError    = "error"   // kind of the messages with an error field
+	notificationKindDefault  = "default" // color key of the kinds without a color
+	notificationDefaultColor = "#808080"
+)
+
+// Colors of the notifications of each kind, unless set in the colors of the provider.
+var defaultNotificationColors = map[string]string{
+	eventKindPush:           "#2EB67D",
+	eventKindTag:            "#2EB67D",
+	eventKindPullRequest:    "#1D9BD1",
+	eventKindImagePush:      "#1D9BD1",
+	eventKindAlert:          "#ECB22E",
+	notificationKindError:   "#E01E5A",
+	notificationKindDefault: notificationDefaultColor,
+}
+
+type notificationProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	title                     *template.Template
+	text                      *template.Template
+
+	mutex  sync.Mutex
+	sender *httpProvider // created on the first send, once the webhook URL is known
+}
+
+func newNotificationProvider(mpd *MessageProviderDefinition) (*notificationProvider, error) {
+	def := mpd.Notification
+	if def == nil {
+		return nil, fmt.Errorf("notification provider '%s' has no notification", mpd.Name)
+	}
+	switch def.Format {
+	case notificationSlack, notificationTeams:
+	default:
+		return nil, fmt.Errorf("format '%s' of notification provider '%s' is not %s or %s", def.Format, mpd.Name, notificationSlack, notificationTeams)
+	}
+	if def.Text == "" {
+		return nil, fmt.Errorf("notification provider '%s' has no text", mpd.Name)
+	}
+	if mpd.URL == "" && mpd.SecretRef == "" {
+		return nil, fmt.Errorf("notification provider '%s' has no url or secretRef", mpd.Name)
+	}
+	if mpd.URL == "" && mpd.Auth != "" {
+		return nil, fmt.Errorf("notification provider '%s' with %s auth has no url", mpd.Name, mpd.Auth)
+	}
+	provider := &notificationProvider{messageProviderDefinition: mpd}
+	var err error
+	if provider.text, err = template.New("text").Funcs(transformFuncs).Option("missingkey=zero").Parse(def.Text); err != nil {
+		return nil, fmt.Errorf("unable to parse the text of notification provider '%s': %v", mpd.Name, err)
+	}
+	if def.Title != "" {
+		if provider.title, err = template.New("title").Funcs(transformFuncs).Option("missingkey=zero").Parse(def.Title); err != nil {
+			return nil, fmt.Errorf("unable to parse the title of notification provider '%s': %v", mpd.Name, err)
+		}
+	}
+	return provider, nil
+}
+
+// Return the HTTP provider posting the notifications, reading the webhook URL from the secretRef the first time.
+func (provider *notificationProvider) httpSender() (*httpProvider, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.sender != nil {
+		return provider.sender, nil
+	}
+	mpd := *provider.messageProviderDefinition
+	if mpd.URL == "" {
+		secret, err := readProviderSecret(mpd.SecretRef)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the webhook URL of notification provider '%s': %v", mpd.Name, err)
+		}
+		webhookURL, ok := secret[notificationURLKey]
+		if !ok {
+			return nil, fmt.Errorf("secret %s of notification provider '%s' has no %s", mpd.SecretRef, mpd.Name, notificationURLKey)
+		}
+		mpd.URL, mpd.SecretRef = string(bytes.TrimSpace(webhookURL)), ""
+	}
+	sender, err := newHTTPProvider(&mpd)
+	if err != nil {
+		return nil, err
+	}
+	provider.sender = sender
+	return sender, nil
+}
+
+// Return the kind of a message, which selects the color of its notification: error for messages with an error,
+// the kind of webhook messages, or the kind field of other messages, such as those sent by triggers.
+func notificationKind(message interface{}) string {
+	messageMap, ok := message.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if messageError, ok := messageMap["error"]; ok && messageError != nil && messageError != "" {
+		return notificationKindError
+	}
+	if headerMap, ok := messageMap[HEADER].(map[string]interface{}); ok {
+		header := make(map[string][]string, len(headerMap))
+		for key, values := range headerMap {
+			if list, ok := values.([]interface{}); ok {
+				for _, value := range list {
+					header[key] = append(header[key], fmt.Sprint(value))
+				}
+			}
+		}
+		body, _ := messageMap[BODY].(map[string]interface{})
+		return eventKind(header, body)
+	}
+	kind, _ := messageMap["kind"].(string)
+	return kind
+}
+
+// Return the color of the notifications of a kind.
+func (provider *notificationProvider) color(kind string) string {
+	colors := provider.messageProviderDefinition.Notification.Colors
+	for _, key := range []string{kind, notificationKindDefault} {
+		if color, ok := colors[key]; ok {
+			return color
+		}
+		if color, ok := defaultNotificationColors[key]; ok {
+			return color
+		}
+	}
+	return notificationDefaultColor
+}
+
+// Return the notification of a message, in the format of the provider.
+func (provider *notificationProvider) notification(node *EventNode, payload []byte) ([]byte, error) {
+	var message interface{}
+	if err := json.Unmarshal(payload, &message); err != nil {
+		/* messages transformed by a template may not be JSON */
+		message = string(payload)
+	}
+	kind := notificationKind(message)
+	variables := messageVariables(node, nil)
+	variables["message"] = message
+	variables["kind"] = kind
+
+	var text, title bytes.Buffer
+	if err := provider.text.Execute(&text, variables); err != nil {
+		return nil, fmt.Errorf("unable to execute the text of notification provider '%s': %v", provider.messageProviderDefinition.Name, err)
+	}
+	if provider.title != nil {
+		if err := provider.title.Execute(&title, variables); err != nil {
+			return nil, fmt.Errorf("unable to execute the title of notification provider '%s': %v", provider.messageProviderDefinition.Name, err)
+		}
+	}
+	color := provider.color(kind)
+
+	if provider.messageProviderDefinition.Notification.Format == notificationTeams {
+		card := map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"themeColor": strings.TrimPrefix(color, "#"),
+			"summary":    text.String(),
+			"text":       text.String(),
+		}
+		if title.Len() > 0 {
+			card["title"], card["summary"] = title.String(), title.String()
+		}
+		return json.Marshal(card)
+	}
+	attachment := map[string]interface{}{"color": color, "text": text.String(), "fallback": text.String()}
+	if title.Len() > 0 {
+		attachment["title"] = title.String()
+	}
+	return json.Marshal(map[string]interface{}{"attachments": []interface{}{attachment}})
+}
+
+// Send the notification of a message to the webhook. The header of the message is not sent.
+func (provider *notificationProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	notification, err := provider.notification(node, payload)
+	if err != nil {
+		return err
+	}
+	sender, err := provider.httpSender()
+	if err != nil {
+		return err
+	}
+	if klog.V(6) {
+		klog.Infof("notificationProvider: Sending %s", string(notification))
+	}
+	return sender.Send(node, notification, nil)
+}
+
+// Subscribe is not implemented for notification providers.
+func (provider *notificationProvider) Subscribe(node *EventNode) error {
+	return fmt.Errorf("subscribing on notification provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+// Receive is not implemented for notification providers.
+func (provider *notificationProvider) Receive(node *EventNode) ([]byte, error) {
+	return nil, fmt.Errorf("receiving on notification provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+// ListenAndServe is not implemented for notification providers.
+func (provider *notificationProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	klog.Errorf("listening on notification provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+func init() {
+	RegisterMessageProvider("notification", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newNotificationProvider(mpd)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestNotificationProviderSend(t *testing.T) {
+	var mutex sync.Mutex
+	var received []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if req.Header.Get("X-Github-Event") != "" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected headers %v", req.Header)
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		notification := make(map[string]interface{})
+		if err := json.Unmarshal(data, &notification); err != nil {
+			t.Errorf("unable to decode notification %s: %v", data, err)
+		}
+		received = append(received, notification)
+	}))
+	defer server.Close()
+
+	savedRead := readProviderSecret
+	defer func() { readProviderSecret = savedRead }()
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		if name != "teams-webhook" {
+			t.Errorf("unexpected secret %v", name)
+		}
+		return map[string][]byte{notificationURLKey: []byte(server.URL + "\n")}, nil
+	}
+
+	slack, err := newNotificationProvider(&MessageProviderDefinition{Name: "slack", ProviderType: "notification", URL: server.URL,
+		Notification: &NotificationDefinition{Format: notificationSlack, Title: "{{ .kind }} of {{ .message.body.repository.full_name }}",
+			Text: "{{ .message.body.ref }} sent to {{ .kabanero.destination }}", Colors: map[string]string{eventKindPush: "good"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := `{"header": {"X-Github-Event": ["push"]}, "body": {"ref": "refs/heads/master", "repository": {"full_name": "kabanero-io/appsody-hello"}}}`
+	if err = slack.Send(&EventNode{Name: "chatops"}, []byte(push), map[string][]string{"X-Github-Event": {"push"}}); err != nil {
+		t.Fatal(err)
+	}
+	teams, err := newNotificationProvider(&MessageProviderDefinition{Name: "teams", ProviderType: "notification", SecretRef: "teams-webhook",
+		Notification: &NotificationDefinition{Format: notificationTeams, Text: "Trigger failed: {{ .message.error }}"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = teams.Send(&EventNode{Name: "chatops"}, []byte(`{"error": "unable to create PipelineRun"}`), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("%v notifications received, expected 2", len(received))
+	}
+	attachment := received[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	if attachment["color"] != "good" || attachment["title"] != "push of kabanero-io/appsody-hello" || attachment["text"] != "refs/heads/master sent to chatops" {
+		t.Fatalf("unexpected Slack notification %v", received[0])
+	}
+	card := received[1]
+	if card["@type"] != "MessageCard" || card["themeColor"] != "E01E5A" || card["text"] != "Trigger failed: unable to create PipelineRun" || card["summary"] != card["text"] {
+		t.Fatalf("unexpected Teams notification %v", card)
+	}
+}
+
+func TestNotificationProviderDefinitions(t *testing.T) {
+	for _, invalid := range []*MessageProviderDefinition{
+		{Name: "none", URL: "https://hooks.slack.com/services/T0001"},
+		{Name: "format", URL: "https://hooks.slack.com/services/T0001", Notification: &NotificationDefinition{Format: "email", Text: "event"}},
+		{Name: "text", URL: "https://hooks.slack.com/services/T0001", Notification: &NotificationDefinition{Format: notificationSlack}},
+		{Name: "url", Notification: &NotificationDefinition{Format: notificationSlack, Text: "event"}},
+		{Name: "template", URL: "https://hooks.slack.com/services/T0001", Notification: &NotificationDefinition{Format: notificationSlack, Text: "{{ .message"}},
+	} {
+		if _, err := newNotificationProvider(invalid); err == nil {
+			t.Errorf("invalid notification provider %v was created", invalid.Name)
+		}
+	}
+
+	/* the colors of kinds without color are the default ones */
+	provider, err := newNotificationProvider(&MessageProviderDefinition{Name: "colors", URL: "https://hooks.slack.com/services/T0001",
+		Notification: &NotificationDefinition{Format: notificationSlack, Text: "event", Colors: map[string]string{notificationKindDefault: "#000000"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, expected := range map[string]string{eventKindAlert: "#ECB22E", "": "#000000", "issues": "#000000"} {
+		if color := provider.color(kind); color != expected {
+			t.Errorf("color of kind %q is %v, expected %v", kind, color, expected)
+		}
+	}
+	if kind := notificationKind(map[string]interface{}{"kind": "deployment"}); kind != "deployment" {
+		t.Errorf("unexpected kind %v", kind)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+/*
+Open Policy Agent hook. When an OPA URL is configured, every rendered resource is sent to OPA through its data API
+before it is created, and the resource is not created if the policy denies it. The URL is that of a rule, such as
+http://localhost:8181/v1/data/kabanero/events/allow, which either evaluates to a boolean, or to an object with a
+boolean "allow" and optional "reasons".
+*/
+
+var (
+	opaURL      string        // URL of the OPA rule deciding whether a resource may be created. The hook is disabled if empty
+	opaTimeout  time.Duration // timeout of requests to OPA
+	opaFailOpen bool          // allow resources when OPA can not be reached, instead of denying them
+)
+
+/* Input document sent to OPA */
+type opaInput struct {
+	Collection string                 `json:"collection"`
+	Trigger    string                 `json:"trigger"`
+	Cluster    string                 `json:"cluster"`
+	DryRun     bool                   `json:"dryrun"`
+	Resource   map[string]interface{} `json:"resource"`
+}
+
+/* Decision of a rule returning an object */
+type opaDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+}
+
+/* Ask OPA whether a resource may be created. Returns whether it is allowed, and the reasons given if not. */
+func queryOPA(url string, input *opaInput) (bool, []string, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, nil, err
+	}
+	client := &http.Client{Transport: withUserAgent(nil), Timeout: opaTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(requestBody))
+	if err != nil {
+		return false, nil, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, nil, fmt.Errorf("OPA returned %v: %v", resp.Status, string(responseBody))
+	}
+
+	var response struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err = json.Unmarshal(responseBody, &response); err != nil {
+		return false, nil, fmt.Errorf("unable to parse OPA response: %v", err)
+	}
+	if len(response.Result) == 0 {
+		/* the rule is not defined, which OPA reports without a result */
+		return false, []string{"policy rule is undefined"}, nil
+	}
+	var allowed bool
+	if err = json.Unmarshal(response.Result, &allowed); err == nil {
+		return allowed, nil, nil
+	}
+	var decision opaDecision
+	if err = json.Unmarshal(response.Result, &decision); err != nil {
+		return false, nil, fmt.Errorf("OPA result is neither a boolean nor an object with allow: %v", string(response.Result))
+	}
+	return decision.Allow, decision.Reasons, nil
+}
+
+/* Resource filter rejecting the resources denied by OPA */
+func checkOPAPolicy(action *resourceAction, resource *unstructured.Unstructured) error {
+	if opaURL == "" {
+		return nil
+	}
+	input := &opaInput{Collection: action.collection, Trigger: action.trigger, Cluster: clusterName(action.cluster), DryRun: action.dryrun, Resource: resource.Object}
+	allowed, reasons, err := queryOPA(opaURL, input)
+	if err != nil {
+		incrementMetric("opa.errors")
+		if opaFailOpen {
+			klog.Warningf("Unable to query OPA, allowing %v %v: %v", resource.GetKind(), resource.GetName(), err)
+			return nil
+		}
+		return fmt.Errorf("unable to query OPA for %v %v: %v", resource.GetKind(), resource.GetName(), err)
+	}
+	if !allowed {
+		incrementMetric("opa.denied")
+		return fmt.Errorf("OPA denied trigger %v of collection %v creating %v %v in namespace %v: %v",
+			action.trigger, action.collection, resource.GetKind(), resource.GetName(), resource.GetNamespace(), strings.Join(reasons, "; "))
+	}
+	return nil
+}
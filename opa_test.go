@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestOPAPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Input opaInput `json:"input"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		switch req.URL.Path {
+		case "/v1/data/bool":
+			writer.Write([]byte(`{"result": ` + map[bool]string{true: "true", false: "false"}[body.Input.Resource["kind"] == "PipelineRun"] + `}`))
+		case "/v1/data/object":
+			writer.Write([]byte(`{"result": {"allow": false, "reasons": ["privileged pod"]}}`))
+		case "/v1/data/undefined":
+			writer.Write([]byte(`{}`))
+		default:
+			http.Error(writer, "error", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	savedURL, savedTimeout, savedFailOpen := opaURL, opaTimeout, opaFailOpen
+	defer func() { opaURL, opaTimeout, opaFailOpen = savedURL, savedTimeout, savedFailOpen }()
+	opaTimeout = 5 * time.Second
+
+	action := &resourceAction{collection: "active", trigger: "default-0"}
+	pipelineRun := &unstructured.Unstructured{Object: map[string]interface{}{"kind": "PipelineRun", "metadata": map[string]interface{}{"name": "run1"}}}
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{"kind": "Pod", "metadata": map[string]interface{}{"name": "pod1"}}}
+
+	tests := []struct {
+		path     string
+		resource *unstructured.Unstructured
+		failOpen bool
+		allowed  bool
+	}{
+		{"/v1/data/bool", pipelineRun, false, true},
+		{"/v1/data/bool", pod, false, false},
+		{"/v1/data/object", pipelineRun, false, false},
+		{"/v1/data/undefined", pipelineRun, false, false},
+		{"/v1/data/error", pipelineRun, false, false},
+		{"/v1/data/error", pipelineRun, true, true},
+	}
+	for _, test := range tests {
+		opaURL = server.URL + test.path
+		opaFailOpen = test.failOpen
+		err := checkOPAPolicy(action, test.resource)
+		if (err == nil) != test.allowed {
+			t.Errorf("%v with %v, failOpen %v: expected allowed %v, got error %v", test.path, test.resource.GetKind(), test.failOpen, test.allowed, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Outbox. With an outbox directory, every webhook message is durably written to the outbox, which is a spool synced to
+disk, before the webhook request is acknowledged with 202 Accepted. A dispatcher sends the messages of the outbox to
+the webhook destination, in order, and removes each message once it is sent, so that webhook messages are delivered
+at least once even if kabanero-events crashes between receiving and sending them. Messages left in the outbox are
+dispatched when kabanero-events starts again. Webhook paths sending to other eventDestinations have their own outbox,
+in a subdirectory named after the destination.
+*/
+
+var (
+	outboxDir           string        // directory of the outbox. Webhook messages are sent directly if empty
+	outboxMaxBytes      int64         // maximum size of the outbox. Webhook requests are rejected once it is full
+	outboxRetryInterval time.Duration // interval between attempts to dispatch the outbox while the destination fails
+
+	outbox   *webhookOutbox            // outbox of the webhook destination
+	outboxes map[string]*webhookOutbox // outboxes by eventDestination
+)
+
+/* The outbox of the webhook messages */
+type webhookOutbox struct {
+	spool *destinationSpool
+	wake  chan struct{} // signaled when a message is written
+}
+
+/* Open the outboxes of the webhook paths, and start dispatching the messages they contain */
+func initializeOutbox() error {
+	if outboxDir == "" {
+		return nil
+	}
+	paths, err := webhookPaths()
+	if err != nil {
+		return err
+	}
+	outboxes = make(map[string]*webhookOutbox)
+	for _, path := range paths {
+		if outboxes[path.Destination] != nil {
+			continue
+		}
+		dir, name := outboxDir, "outbox"
+		if path.Destination != WEBHOOKDESTINATION {
+			dir, name = filepath.Join(outboxDir, path.Destination), "outbox."+path.Destination
+		}
+		spool, err := openSpool(path.Destination, dir)
+		if err != nil {
+			return fmt.Errorf("unable to open the outbox %v: %v", dir, err)
+		}
+		spool.name = name
+		spool.maxBytes = outboxMaxBytes
+		spool.reject = true
+		spool.durable = true
+		ob := &webhookOutbox{spool: spool, wake: make(chan struct{}, 1)}
+		outboxes[path.Destination] = ob
+		go ob.dispatch(outboxRetryInterval)
+	}
+	outbox = outboxes[WEBHOOKDESTINATION]
+	return nil
+}
+
+/* Durably write a message to the outbox */
+func (ob *webhookOutbox) write(message []byte) error {
+	ob.spool.mutex.Lock()
+	err := ob.spool.append(message, nil)
+	ob.spool.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to write webhook message to the outbox: %v", err)
+	}
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+/* Send the messages of the outbox as they are written, retrying while the destination fails */
+func (ob *webhookOutbox) dispatch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for ob.spool.drainOne() {
+		}
+		select {
+		case <-ob.wake:
+		case <-ticker.C:
+			if ob.spool.length() > 0 && klog.V(2) {
+				klog.Infof("Outbox contains %v webhook messages that could not be sent yet", ob.spool.length())
+			}
+		}
+	}
+}
+
+/*
+Respond to a webhook request once its messages are sent, or written to the outbox. Messages written to the outbox
+are acknowledged with 202 Accepted, and requests whose messages could not be written are rejected with 503, so that
+they are redelivered.
+*/
+func respondWebhook(writer http.ResponseWriter, req *http.Request, err error) {
+	if _, vetoed := err.(*hookVeto); vetoed {
+		writeError(writer, req, codeVetoed, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(writer, req, codeUnavailable, err.Error())
+		return
+	}
+	if len(outboxes) > 0 {
+		writer.WriteHeader(http.StatusAccepted)
+	}
+}
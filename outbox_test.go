@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupOutbox(t *testing.T, broker MessageProvider) func() {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	savedDir, savedMax, savedInterval := outboxDir, outboxMaxBytes, outboxRetryInterval
+	messageProviders = map[string]MessageProvider{"broker": broker}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "broker"}}}
+	outboxDir, outboxMaxBytes, outboxRetryInterval = dir, 4096, 10*time.Millisecond
+	return func() {
+		messageProviders, eventProviders = savedProviders, savedDefinitions
+		outboxDir, outboxMaxBytes, outboxRetryInterval = savedDir, savedMax, savedInterval
+		outbox, outboxes = nil, nil
+		os.RemoveAll(dir)
+	}
+}
+
+func postWebhook(body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	req.Header.Set("X-Github-Event", "push")
+	recorder := httptest.NewRecorder()
+	listenerHandler(recorder, req)
+	return recorder
+}
+
+func TestOutbox(t *testing.T) {
+	broker := newBrokerProvider()
+	defer setupOutbox(t, broker)()
+	broker.setDown(true)
+	if err := initializeOutbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* messages are acknowledged once written, and wait in the outbox while the destination fails */
+	for i := 0; i < 2; i++ {
+		if recorder := postWebhook(`{"ref":"refs/heads/master"}`); recorder.Code != http.StatusAccepted {
+			t.Fatalf("webhook returned %v: %s", recorder.Code, recorder.Body.String())
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if outbox.spool.length() != 2 {
+		t.Fatalf("outbox contains %v messages, expected 2", outbox.spool.length())
+	}
+
+	/* the outbox survives a restart */
+	reopened, err := openSpool(WEBHOOKDESTINATION, outboxDir)
+	if err != nil || reopened.length() != 2 {
+		t.Fatalf("reopened outbox contains %v messages, expected 2: %v", reopened.length(), err)
+	}
+	broker.setDown(false)
+	waitFor(t, func() bool { return outbox.spool.length() == 0 })
+	for i := 0; i < 2; i++ {
+		if data := <-broker.messages; !strings.Contains(string(data), "refs/heads/master") {
+			t.Fatalf("unexpected message %s", data)
+		}
+	}
+
+	/* messages are dispatched as soon as they are written */
+	if recorder := postWebhook(`{"ref":"refs/heads/release"}`); recorder.Code != http.StatusAccepted {
+		t.Fatalf("webhook returned %v", recorder.Code)
+	}
+	select {
+	case data := <-broker.messages:
+		if !strings.Contains(string(data), "refs/heads/release") {
+			t.Fatalf("unexpected message %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not dispatched")
+	}
+}
+
+func TestOutboxFull(t *testing.T) {
+	broker := newBrokerProvider()
+	defer setupOutbox(t, broker)()
+	broker.setDown(true)
+	if err := initializeOutbox(); err != nil {
+		t.Fatal(err)
+	}
+
+	/* requests are rejected, rather than messages evicted, once the outbox is full */
+	body := `{"data":"` + strings.Repeat("x", 1024) + `"}`
+	code := http.StatusAccepted
+	for i := 0; i < 5 && code == http.StatusAccepted; i++ {
+		code = postWebhook(body).Code
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("webhook to a full outbox returned %v", code)
+	}
+	broker.setDown(false)
+	waitFor(t, func() bool { return outbox.spool.length() == 0 })
+	if recorder := postWebhook(body); recorder.Code != http.StatusAccepted {
+		t.Fatalf("webhook returned %v once the outbox was dispatched", recorder.Code)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// The peer provider forwards webhook messages to peer kabanero-events instances in other clusters, so that
+// multi-cluster installations can share a single inbound webhook URL. Messages are sent over HTTPS with mTLS to the
+// /peer endpoint of each peer, which sends them to its own webhook destination as if received on its webhook. When
+// some peers fail, the provider remembers them, so that a retry of the send of the same message only goes to them.
+
+const (
+	// FORWARDEDHEADER is the header of messages forwarded by a peer, containing the name of the forwarding instance.
+	FORWARDEDHEADER = "X-Kabanero-Forwarded-By"
+
+	defaultPeerMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,sizeLimit"
+	peerSendTimeout       = 10 * time.Second
+
+	maxPeerFailures   = 1000      // messages whose failed peers are remembered, the oldest are forgotten beyond
+	peerFailureExpiry = time.Hour // failed peers of a message are forgotten after this long, sending a retry to all peers
+)
+
+var (
+	peerMiddleware string // comma separated middleware chain of the peer endpoint
+	peerCAFile     string // CA certificates trusted to sign the client certificates of peers. The peer endpoint rejects all requests if empty
+)
+
+type peerProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	client                    *http.Client
+	instance                  string
+	mutex                     sync.Mutex
+	failures                  map[string]*peerFailure // by digest of the message
+}
+
+// The peers a message could not be sent to.
+type peerFailure struct {
+	peers []string
+	time  time.Time
+}
+
+func (provider *peerProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	if len(provider.peerURLs()) == 0 {
+		return fmt.Errorf("peer provider '%s' has no url or urls", mpd.Name)
+	}
+	if mpd.CertFile == "" {
+		return fmt.Errorf("peer provider '%s' requires a certFile and keyFile to authenticate to its peers", mpd.Name)
+	}
+	cert, err := tls.LoadX509KeyPair(mpd.CertFile, mpd.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load the client certificate of peer provider '%s': %v", mpd.Name, err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: mpd.SkipTLSVerify}
+	if mpd.CAFile != "" {
+		caCert, err := ioutil.ReadFile(mpd.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the CA certificate of peer provider '%s': %v", mpd.Name, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificates found in %s for peer provider '%s'", mpd.CAFile, mpd.Name)
+		}
+	}
+	timeout := mpd.Timeout
+	if timeout <= 0 {
+		timeout = peerSendTimeout
+	}
+	provider.client = &http.Client{Transport: withUserAgent(&http.Transport{TLSClientConfig: tlsConfig}), Timeout: timeout}
+	provider.instance, _ = os.Hostname()
+	provider.failures = make(map[string]*peerFailure)
+	return nil
+}
+
+// The URLs of the peers: url, followed by urls.
+func (provider *peerProvider) peerURLs() []string {
+	urls := make([]string, 0)
+	if provider.messageProviderDefinition.URL != "" {
+		urls = append(urls, provider.messageProviderDefinition.URL)
+	}
+	return append(urls, provider.messageProviderDefinition.URLs...)
+}
+
+// Subscribe is not implemented for peer providers.
+func (provider *peerProvider) Subscribe(node *EventNode) error {
+	return fmt.Errorf("subscribing on a peer provider is not supported")
+}
+
+// Receive is not implemented for peer providers. Messages from peers are received on the /peer endpoint.
+func (provider *peerProvider) Receive(node *EventNode) ([]byte, error) {
+	return nil, fmt.Errorf("receiving from a peer provider is not supported")
+}
+
+// ListenAndServe is not implemented for peer providers. Messages from peers are received on the /peer endpoint.
+func (provider *peerProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	klog.Errorf("listening on peer provider '%s' is not supported", provider.messageProviderDefinition.Name)
+}
+
+// Send a message to all the peers, or only to the peers that failed if it is a retry. Messages that were forwarded by
+// a peer are not forwarded again.
+func (provider *peerProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	message := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return fmt.Errorf("peerProvider: message is not a JSON object: %v", err)
+	}
+	messageHeader, err := convertToHeaderMap(message[HEADER])
+	if err != nil {
+		return err
+	}
+	if forwardedBy := http.Header(messageHeader).Get(FORWARDEDHEADER); forwardedBy != "" {
+		if klog.V(5) {
+			klog.Infof("peerProvider: not forwarding message already forwarded by %s", forwardedBy)
+		}
+		return nil
+	}
+	http.Header(messageHeader).Set(FORWARDEDHEADER, provider.instance)
+	message[HEADER] = messageHeader
+	forwarded, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(payload)
+	key := hex.EncodeToString(digest[:])
+	failed := make([]string, 0)
+	for _, url := range provider.pendingPeers(key) {
+		if err := provider.sendToPeer(url, forwarded); err != nil {
+			klog.Errorf("Unable to forward message to peer %s: %v", url, err)
+			incrementMetric("peer.errors")
+			failed = append(failed, url)
+			continue
+		}
+		incrementMetric("peer.forwarded")
+	}
+	provider.recordFailures(key, failed, time.Now())
+	if len(failed) > 0 {
+		return fmt.Errorf("peerProvider: unable to forward message to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Return the peers to send a message to: those that failed the previous time it was sent, or else all of them.
+func (provider *peerProvider) pendingPeers(key string) []string {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if failure, ok := provider.failures[key]; ok && time.Since(failure.time) < peerFailureExpiry {
+		return failure.peers
+	}
+	return provider.peerURLs()
+}
+
+// Remember the peers a message could not be sent to, or forget them if it was sent to all.
+func (provider *peerProvider) recordFailures(key string, failed []string, now time.Time) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if len(failed) == 0 {
+		delete(provider.failures, key)
+		return
+	}
+	if _, ok := provider.failures[key]; !ok && len(provider.failures) >= maxPeerFailures {
+		var oldestKey string
+		var oldest time.Time
+		for failedKey, failure := range provider.failures {
+			if now.Sub(failure.time) >= peerFailureExpiry {
+				delete(provider.failures, failedKey)
+			} else if oldestKey == "" || failure.time.Before(oldest) {
+				oldestKey, oldest = failedKey, failure.time
+			}
+		}
+		if len(provider.failures) >= maxPeerFailures {
+			delete(provider.failures, oldestKey)
+		}
+	}
+	provider.failures[key] = &peerFailure{peers: failed, time: now}
+}
+
+// Send a message to a peer.
+func (provider *peerProvider) sendToPeer(url string, message []byte) error {
+	resp, err := provider.client.Post(url, "application/json", bytes.NewReader(message))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("peer returned http status %v: %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+func init() {
+	RegisterMessageProvider("peer", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newPeerProvider(mpd)
+	})
+}
+
+func newPeerProvider(mpd *MessageProviderDefinition) (*peerProvider, error) {
+	provider := new(peerProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+
+	return provider, nil
+}
+
+// Load the CA certificates trusted to sign the client certificates of peers. Nil if no CA file is configured.
+func loadPeerCAs() (*x509.CertPool, error) {
+	if peerCAFile == "" {
+		return nil, nil
+	}
+	caCert, err := ioutil.ReadFile(peerCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in %s", peerCAFile)
+	}
+	return pool, nil
+}
+
+// HTTP listener of messages forwarded by peers. Peers must present a client certificate signed by a peer CA.
+func peerListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		incrementMetric("http." + metricRoute(req) + ".unauthorized")
+		writeError(writer, req, codeUnauthorized, "a client certificate signed by a peer CA is required")
+		return
+	}
+	message, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, err := convertToHeaderMap(message[HEADER])
+	if err != nil || http.Header(header).Get(FORWARDEDHEADER) == "" {
+		writeError(writer, req, codeBadRequest, "message is not forwarded by a peer")
+		return
+	}
+	if _, ok := message[BODY].(map[string]interface{}); !ok {
+		writeError(writer, req, codeBadRequest, "message does not contain a body")
+		return
+	}
+	if klog.V(5) {
+		klog.Infof("Received message forwarded by peer %s (%s)", http.Header(header).Get(FORWARDEDHEADER), req.TLS.VerifiedChains[0][0].Subject)
+	}
+
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		writeError(writer, req, codeInternalError, "unable to marshal message")
+		return
+	}
+	if err = sendToDestination(WEBHOOKDESTINATION, bytes, nil); err != nil {
+		klog.Errorf("Unable to send message forwarded by a peer. Error: %v", err)
+		writeError(writer, req, codeUnavailable, "unable to send message")
+		return
+	}
+}
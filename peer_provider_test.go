@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* A message provider keeping the messages sent */
+type capturingProvider struct {
+	mutex    sync.Mutex
+	messages [][]byte
+}
+
+func (provider *capturingProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	provider.messages = append(provider.messages, payload)
+	return nil
+}
+func (provider *capturingProvider) Subscribe(node *EventNode) error                       { return nil }
+func (provider *capturingProvider) Receive(node *EventNode) ([]byte, error)               { return nil, nil }
+func (provider *capturingProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {}
+
+/* Write a certificate and its key as PEM files, returning the certificate */
+func writeCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestPeerProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	/* a CA signing the client certificate of the forwarding instance */
+	notAfter := time.Now().Add(time.Hour)
+	caFile := filepath.Join(dir, "ca.crt")
+	ca, caKey := writeCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "peer-ca"}, NotAfter: notAfter,
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil, nil, caFile, filepath.Join(dir, "ca.key"))
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "hub"}, NotAfter: notAfter,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, KeyUsage: x509.KeyUsageDigitalSignature}, ca, caKey, certFile, keyFile)
+
+	/* the peer receiving the forwarded messages */
+	captured := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": captured}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "capture"}}}
+
+	peerCAFile = caFile
+	defer func() { peerCAFile = "" }()
+	peerCAs, err := loadPeerCAs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := httptest.NewUnstartedServer(http.HandlerFunc(peerListenerHandler))
+	peer.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: peerCAs}
+	peer.StartTLS()
+	defer peer.Close()
+
+	mpd := &MessageProviderDefinition{Name: "peers", ProviderType: "peer", URLs: []string{peer.URL + "/peer"},
+		CertFile: certFile, KeyFile: keyFile, SkipTLSVerify: true}
+	provider, err := newPeerProvider(mpd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte(`{"header": {"X-Github-Event": ["push"]}, "body": {"ref": "refs/heads/master"}, "eventID": "e1"}`)
+	if err = provider.Send(&EventNode{Name: "peers"}, message, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(captured.messages) != 1 {
+		t.Fatalf("expected 1 forwarded message, got %v", len(captured.messages))
+	}
+	forwarded := make(map[string]interface{})
+	if err = json.Unmarshal(captured.messages[0], &forwarded); err != nil {
+		t.Fatal(err)
+	}
+	header, _ := convertToHeaderMap(forwarded[HEADER])
+	if http.Header(header).Get(FORWARDEDHEADER) == "" || http.Header(header).Get("X-Github-Event") != "push" || forwarded[EVENTID] != "e1" {
+		t.Fatalf("unexpected forwarded message: %v", forwarded)
+	}
+
+	/* messages forwarded by a peer are not forwarded again */
+	if err = provider.Send(&EventNode{Name: "peers"}, captured.messages[0], nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(captured.messages) != 1 {
+		t.Fatal("a forwarded message was forwarded again")
+	}
+
+	/* a retry only goes to the peers that failed */
+	var flakyMutex sync.Mutex
+	flakyCalls := 0
+	flaky := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		flakyMutex.Lock()
+		defer flakyMutex.Unlock()
+		flakyCalls++
+		if flakyCalls == 1 {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer flaky.Close()
+	mpd.URLs = []string{peer.URL + "/peer", flaky.URL}
+	message = []byte(`{"header": {"X-Github-Event": ["push"]}, "body": {"ref": "refs/heads/master"}, "eventID": "e2"}`)
+	if err = provider.Send(&EventNode{Name: "peers"}, message, nil); err == nil {
+		t.Fatal("the failure of a peer was not reported")
+	}
+	if err = provider.Send(&EventNode{Name: "peers"}, message, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(captured.messages) != 2 || flakyCalls != 2 {
+		t.Fatalf("expected the retry to go to the failed peer only, got %v messages and %v calls", len(captured.messages), flakyCalls)
+	}
+
+	/* peers without a client certificate are rejected */
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Post(peer.URL+"/peer", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized without a client certificate, got %v", resp.Status)
+	}
+}
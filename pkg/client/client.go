@@ -0,0 +1,341 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package client is a typed client of the admin API of kabanero-events. It lists and switches triggers, replays
+dead-lettered messages, simulates events, reloads the trigger collections, and tails the audit records of the
+processed messages from the event stream.
+
+	c := client.New("http://kabanero-events:9091", os.Getenv("ADMIN_TOKEN"))
+	triggers, err := c.ListTriggers(ctx)
+
+The base URL may also be unix:///path/to/socket, for an admin API served on a unix socket.
+*/
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const unixScheme = "unix://"
+
+/* Client is a client of the admin API */
+type Client struct {
+	BaseURL    string       // URL of the admin API, such as http://localhost:9091
+	Token      string       // bearer token of the admin API. None if empty
+	UserAgent  string       // User-Agent header of the requests. The default of net/http if empty
+	HTTPClient *http.Client // client of the requests. Must not time out streams for TailEvents
+}
+
+/* New returns a client of the admin API of a base URL, authenticating with a token if not empty */
+func New(baseURL string, token string) *Client {
+	client := &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token, HTTPClient: &http.Client{}}
+	if strings.HasPrefix(baseURL, unixScheme) {
+		socket := strings.TrimPrefix(baseURL, unixScheme)
+		client.BaseURL = "http://unix"
+		client.HTTPClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}
+	}
+	return client
+}
+
+/* Error is an error response of the admin API */
+type Error struct {
+	Status        int    `json:"-"`
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	Detail        string `json:"detail,omitempty"`
+	CorrelationID string `json:"correlationId"`
+	DocsRef       string `json:"docsRef,omitempty"`
+}
+
+func (err *Error) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("admin API returned status %d: %s", err.Status, err.Message)
+	}
+	return fmt.Sprintf("admin API returned status %d: %s: %s (correlation ID %s)", err.Status, err.Code, err.Message, err.CorrelationID)
+}
+
+/* Trigger is a trigger of a loaded collection, and the events it matched */
+type Trigger struct {
+	Name          string     `json:"name"`
+	Collection    string     `json:"collection"`
+	EventSource   string     `json:"eventSource"`
+	Enabled       bool       `json:"enabled"`
+	Matches       int64      `json:"matches"`
+	Misses        int64      `json:"misses"`
+	Errors        int64      `json:"errors"`
+	LastMatched   *time.Time `json:"lastMatched,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+/* RetryHint tells whether and when retrying an event may succeed */
+type RetryHint struct {
+	Reason     string `json:"reason"`
+	Retryable  bool   `json:"retryable"`
+	RetryAfter int64  `json:"retryAfterSeconds,omitempty"`
+	Status     int    `json:"status,omitempty"`
+}
+
+/* DryRunResource is a resource rendered by a trigger in dry-run */
+type DryRunResource struct {
+	Trigger      string                 `json:"trigger"`
+	Cluster      string                 `json:"cluster,omitempty"`
+	Kind         string                 `json:"kind"`
+	Name         string                 `json:"name"`
+	Namespace    string                 `json:"namespace,omitempty"`
+	Resource     map[string]interface{} `json:"resource"`
+	ServerDryRun bool                   `json:"serverDryRun,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+/* SimulateRequest is an event to evaluate in dry-run. The collection that would process the event is used if Collection is empty */
+type SimulateRequest struct {
+	EventSource string              `json:"eventSource"`
+	Collection  string              `json:"collection,omitempty"`
+	Header      map[string][]string `json:"header,omitempty"`
+	Body        interface{}         `json:"body"`
+}
+
+/* SimulateResult holds the triggers matched by a simulated event, and the actions and resources they would have executed */
+type SimulateResult struct {
+	Collection  string            `json:"collection"`
+	EventSource string            `json:"eventSource"`
+	EventID     string            `json:"eventID"`
+	Triggers    []string          `json:"triggers"`
+	Actions     []string          `json:"actions"`
+	Resources   []*DryRunResource `json:"dryRunResources,omitempty"`
+	Retry       *RetryHint        `json:"retry,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+/* Collection is a reloaded trigger collection */
+type Collection struct {
+	Name           string `json:"name"`
+	IndexURL       string `json:"indexURL"`
+	Digest         string `json:"digest"`
+	PreviousDigest string `json:"previousDigest"`
+	Changed        bool   `json:"changed"`
+	Triggers       int    `json:"triggers"`
+}
+
+/* AuditRecord is the processing of a message by a trigger collection */
+type AuditRecord struct {
+	Time        time.Time         `json:"time"`
+	EventID     string            `json:"eventID,omitempty"`
+	EventSource string            `json:"eventSource"`
+	Collection  string            `json:"collection"`
+	Repository  string            `json:"repository,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Triggers    []string          `json:"triggers"`
+	Actions     []string          `json:"actions"`
+	Outcome     string            `json:"outcome"`
+	Error       string            `json:"error,omitempty"`
+	Retry       *RetryHint        `json:"retry,omitempty"`
+	Resources   []*DryRunResource `json:"dryRunResources,omitempty"`
+}
+
+/* TailOptions selects the audit records streamed by TailEvents. All are streamed if empty */
+type TailOptions struct {
+	EventSource string
+	Collection  string
+}
+
+/* Send a request, and decode the JSON response into result if not nil */
+func (client *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	resp, err := client.send(ctx, method, path, body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("unable to decode the response of %s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+/* Send a request, returning the response if successful, or else an *Error */
+func (client *Client) send(ctx context.Context, method string, path string, body interface{}, accept string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, client.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.Token)
+	}
+	if client.UserAgent != "" {
+		req.Header.Set("User-Agent", client.UserAgent)
+	}
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	apiErr := &Error{Status: resp.StatusCode}
+	if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+		apiErr.Code, apiErr.Message = "", strings.TrimSpace(string(data))
+	}
+	return nil, apiErr
+}
+
+/* ListTriggers lists the triggers of the loaded collections */
+func (client *Client) ListTriggers(ctx context.Context) ([]Trigger, error) {
+	triggers := make([]Trigger, 0)
+	err := client.do(ctx, http.MethodGet, "/admin/triggers", nil, &triggers)
+	return triggers, err
+}
+
+/* EnableTrigger enables a trigger in the collections that have it */
+func (client *Client) EnableTrigger(ctx context.Context, name string) ([]Trigger, error) {
+	return client.switchTrigger(ctx, name, "enable")
+}
+
+/* DisableTrigger disables a trigger in the collections that have it */
+func (client *Client) DisableTrigger(ctx context.Context, name string) ([]Trigger, error) {
+	return client.switchTrigger(ctx, name, "disable")
+}
+
+func (client *Client) switchTrigger(ctx context.Context, name string, action string) ([]Trigger, error) {
+	triggers := make([]Trigger, 0)
+	err := client.do(ctx, http.MethodPost, "/admin/triggers/"+url.PathEscape(name)+"/"+action, nil, &triggers)
+	return triggers, err
+}
+
+/*
+Replay replays a dead-lettered message, or all of them if id is empty. Return the outcome of each replayed message by ID:
+"replayed", or the error of the replay.
+*/
+func (client *Client) Replay(ctx context.Context, id string) (map[string]string, error) {
+	path := "/admin/deadletters/replay"
+	if id != "" {
+		path = "/admin/deadletters/" + url.PathEscape(id) + "/replay"
+	}
+	results := make(map[string]string)
+	err := client.do(ctx, http.MethodPost, path, nil, &results)
+	return results, err
+}
+
+/* Simulate evaluates an event with the triggers of a collection in dry-run */
+func (client *Client) Simulate(ctx context.Context, request *SimulateRequest) (*SimulateResult, error) {
+	result := &SimulateResult{}
+	if err := client.do(ctx, http.MethodPost, "/admin/simulate", request, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+/* Reload reloads the trigger collections from their Kabanero indexes */
+func (client *Client) Reload(ctx context.Context) ([]Collection, error) {
+	collections := make([]Collection, 0)
+	err := client.do(ctx, http.MethodPost, "/admin/reload", nil, &collections)
+	return collections, err
+}
+
+/*
+TailEvents streams the audit records of the messages as they are processed, calling handler for each, until the context is
+done, the stream ends, or handler returns an error, which is returned. The context being done is not an error.
+*/
+func (client *Client) TailEvents(ctx context.Context, options TailOptions, handler func(*AuditRecord) error) error {
+	query := url.Values{}
+	if options.EventSource != "" {
+		query.Set("eventSource", options.EventSource)
+	}
+	if options.Collection != "" {
+		query.Set("collection", options.Collection)
+	}
+	path := "/admin/events/stream"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	resp, err := client.send(ctx, http.MethodGet, path, nil, "text/event-stream")
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	/* server-sent events: fields until an empty line, comments start with a colon */
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	event, data := "", make([]string, 0)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "audit" && len(data) > 0 {
+				record := &AuditRecord{}
+				if err = json.Unmarshal([]byte(strings.Join(data, "\n")), record); err != nil {
+					return fmt.Errorf("unable to decode an audit record of the event stream: %v", err)
+				}
+				if err = handler(record); err != nil {
+					return err
+				}
+			}
+			event, data = "", data[:0]
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
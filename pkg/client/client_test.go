@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* A fake admin API */
+func fakeAdmin(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/triggers", func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(writer, `[{"name":"build","collection":"active","eventSource":"github","enabled":true,"matches":3}]`)
+	})
+	mux.HandleFunc("/admin/triggers/build/disable", func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(writer, `[{"name":"build","collection":"active","eventSource":"github","enabled":false}]`)
+	})
+	mux.HandleFunc("/admin/deadletters/replay", func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(writer, `{"a":"replayed","b":"unable to send"}`)
+	})
+	mux.HandleFunc("/admin/deadletters/a/replay", func(writer http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(writer, `{"a":"replayed"}`)
+	})
+	mux.HandleFunc("/admin/simulate", func(writer http.ResponseWriter, req *http.Request) {
+		request := &SimulateRequest{}
+		if err := json.NewDecoder(req.Body).Decode(request); err != nil || request.EventSource != "github" {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(writer, `{"code":"invalid_json","message":"the simulation request is not JSON","correlationId":"abc"}`)
+			return
+		}
+		fmt.Fprint(writer, `{"collection":"active","eventSource":"github","eventID":"abc","triggers":["build"],"actions":["applyResources"],
+			"dryRunResources":[{"trigger":"build","kind":"ConfigMap","name":"config","resource":{"kind":"ConfigMap"}}]}`)
+	})
+	mux.HandleFunc("/admin/reload", func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(writer, `{"code":"bad_gateway","message":"unable to reload the active collection","correlationId":"def"}`)
+	})
+	mux.HandleFunc("/admin/events/stream", func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("collection") != "active" {
+			t.Errorf("unexpected query %v", req.URL.RawQuery)
+		}
+		writer.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(writer, ": heartbeat\n\nevent: audit\ndata: {\"eventID\":\"one\",\"collection\":\"active\",\"outcome\":\"none\"}\n\n")
+		fmt.Fprint(writer, "event: audit\ndata: {\"eventID\":\"two\",\"collection\":\"active\",\"outcome\":\"actions\"}\n\n")
+	})
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			writer.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(writer, `{"code":"unauthorized","message":"unauthorized","correlationId":"ghi"}`)
+			return
+		}
+		mux.ServeHTTP(writer, req)
+	})
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(fakeAdmin(t))
+	defer server.Close()
+	client, ctx := New(server.URL+"/", "secret"), context.Background()
+
+	triggers, err := client.ListTriggers(ctx)
+	if err != nil || len(triggers) != 1 || triggers[0].Name != "build" || !triggers[0].Enabled || triggers[0].Matches != 3 {
+		t.Fatalf("unexpected triggers %+v: %v", triggers, err)
+	}
+	if triggers, err = client.DisableTrigger(ctx, "build"); err != nil || triggers[0].Enabled {
+		t.Fatalf("unexpected disabled triggers %+v: %v", triggers, err)
+	}
+	if results, err := client.Replay(ctx, ""); err != nil || len(results) != 2 || results["b"] != "unable to send" {
+		t.Fatalf("unexpected replay %v: %v", results, err)
+	}
+	if results, err := client.Replay(ctx, "a"); err != nil || len(results) != 1 || results["a"] != "replayed" {
+		t.Fatalf("unexpected replay %v: %v", results, err)
+	}
+
+	result, err := client.Simulate(ctx, &SimulateRequest{EventSource: "github", Body: map[string]interface{}{"ref": "refs/heads/master"}})
+	if err != nil || result.Collection != "active" || len(result.Resources) != 1 || result.Resources[0].Kind != "ConfigMap" {
+		t.Fatalf("unexpected simulation %+v: %v", result, err)
+	}
+	_, err = client.Simulate(ctx, &SimulateRequest{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadRequest || apiErr.Code != "invalid_json" || apiErr.CorrelationID != "abc" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err = client.Reload(ctx); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadGateway {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	records := make([]string, 0)
+	err = client.TailEvents(ctx, TailOptions{Collection: "active"}, func(record *AuditRecord) error {
+		records = append(records, record.EventID)
+		return nil
+	})
+	if err != nil || len(records) != 2 || records[0] != "one" || records[1] != "two" {
+		t.Fatalf("unexpected streamed records %v: %v", records, err)
+	}
+	stop := errors.New("stop")
+	if err = client.TailEvents(ctx, TailOptions{Collection: "active"}, func(*AuditRecord) error { return stop }); err != stop {
+		t.Fatalf("unexpected error %v stopping the stream", err)
+	}
+
+	if _, err = New(server.URL, "").ListTriggers(ctx); !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Fatalf("unexpected error %v without a token", err)
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: fakeAdmin(t)}
+	go server.Serve(listener)
+	defer server.Close()
+
+	triggers, err := New("unix://"+socket, "secret").ListTriggers(context.Background())
+	if err != nil || len(triggers) != 1 {
+		t.Fatalf("unexpected triggers %+v: %v", triggers, err)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package provider is the interface of the message providers of kabanero-events that are loaded as Go plugins. A plugin
+is built with go build -buildmode=plugin, and exports a Providers variable holding the factories of its provider types:
+
+	package main
+
+	import "github.com/kabanero-io/kabanero-events/pkg/provider"
+
+	var Providers = map[string]provider.Factory{
+		"mqtt": newMQTTProvider,
+	}
+
+The messageProviders of eventDefinitions.yaml whose providerType is one of these are then created by the factory, with
+the definition of the messageProvider, whose config section holds the settings specific to the provider. Plugins must
+be built with the same version of Go, and of this package, as kabanero-events.
+*/
+package provider
+
+import (
+	"time"
+)
+
+// Definition is the definition of a messageProvider in eventDefinitions.yaml.
+type Definition struct {
+	Name          string
+	ProviderType  string
+	URL           string
+	Timeout       time.Duration
+	SkipTLSVerify bool
+	Username      string
+	PasswordEnv   string
+	Config        map[string]interface{} // the config section, specific to the provider type
+}
+
+// Destination is an eventDestination, or an event source, of the provider.
+type Destination struct {
+	Name  string
+	Topic string
+}
+
+// Provider sends and receives the messages of the eventDestinations of a messageProvider.
+type Provider interface {
+	// Send a message to an eventDestination, with the headers of the webhook request, if any.
+	Send(destination Destination, payload []byte, header map[string][]string) error
+
+	// Subscribe to the messages of an event source.
+	Subscribe(destination Destination) error
+
+	// Receive the next message of an event source, blocking until there is one.
+	Receive(destination Destination) ([]byte, error)
+}
+
+// Factory creates the Provider of a messageProvider definition.
+type Factory func(definition Definition) (Provider, error)
@@ -0,0 +1,149 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+/*
+Policy for the resources created by triggers. When a policy file is configured, a resource may be created only if a
+rule matching the collection and trigger allows its kind and namespace. Resources that are not allowed are rejected
+before any resource of the applyResources call is created, so that a compromised or buggy collection can not create
+arbitrary resources in the cluster. Cluster scoped resources, such as ClusterTasks or Namespaces, may only be created
+when explicitly allowed by a rule with clusterScoped set, and never without a policy file.
+*/
+
+var (
+	policyFile     string             // file containing the resource policy. All resources are allowed if empty
+	resourcePolicy *resourcePolicyDef // parsed policyFile
+)
+
+/* The resource policy file */
+type resourcePolicyDef struct {
+	Rules []*resourcePolicyRule `yaml:"rules"`
+}
+
+/*
+A rule of the resource policy. The fields are lists of patterns, as in path.Match, and an empty list matches
+everything. For example, kinds: ["PipelineRun", "PipelineResource"]
+*/
+type resourcePolicyRule struct {
+	Collections []string `yaml:"collections,omitempty"` // names of the trigger collections: active, canary, or shadow
+	Triggers    []string `yaml:"triggers,omitempty"`
+	Kinds       []string `yaml:"kinds,omitempty"`
+	Namespaces  []string `yaml:"namespaces,omitempty"`
+	Clusters    []string `yaml:"clusters,omitempty"` // names of the remote clusters, or local for the local cluster
+
+	/* the rule allows cluster scoped resources, whose namespace is then ignored, instead of namespaced resources */
+	ClusterScoped bool `yaml:"clusterScoped,omitempty"`
+}
+
+/* Read the resource policy file */
+func loadResourcePolicy(fileName string) (*resourcePolicyDef, error) {
+	bytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	policy := &resourcePolicyDef{}
+	err = yaml.UnmarshalStrict(bytes, policy)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse resource policy %v: %v", fileName, err)
+	}
+	for _, rule := range policy.Rules {
+		for _, patterns := range [][]string{rule.Collections, rule.Triggers, rule.Kinds, rule.Namespaces, rule.Clusters} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid pattern %v in resource policy %v: %v", pattern, fileName, err)
+				}
+			}
+		}
+	}
+	if klog.V(2) {
+		klog.Infof("Loaded resource policy %v with %v rules", fileName, len(policy.Rules))
+	}
+	return policy, nil
+}
+
+/* Return whether a value matches any of the patterns. An empty list of patterns matches everything. */
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return whether the policy allows a trigger to create a resource of a kind in a namespace, or a cluster scoped resource */
+func (policy *resourcePolicyDef) allows(action *resourceAction, kind string, namespace string, clusterScoped bool) bool {
+	for _, rule := range policy.Rules {
+		if rule.ClusterScoped != clusterScoped {
+			continue
+		}
+		if matchesAny(rule.Collections, action.collection) && matchesAny(rule.Triggers, action.trigger) &&
+			matchesAny(rule.Kinds, kind) && (clusterScoped || matchesAny(rule.Namespaces, namespace)) &&
+			matchesAny(rule.Clusters, clusterName(action.cluster)) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Resource filter rejecting the resources not allowed by the resource policy */
+func checkResourcePolicy(action *resourceAction, resource *unstructured.Unstructured) error {
+	target, err := targetCluster(action.cluster)
+	if err != nil {
+		return err
+	}
+	mapping, err := target.mapper.resolve(resource.GroupVersionKind())
+	if err != nil {
+		return fmt.Errorf("unable to resolve the resource of %v %v rendered by trigger %v: %v", resource.GetKind(), resource.GetName(), action.trigger, err)
+	}
+	clusterScoped := !mapping.namespaced
+	if resourcePolicy == nil {
+		if clusterScoped {
+			incrementMetric("policy.denied")
+			return fmt.Errorf("trigger %v of collection %v may not create cluster scoped %v %v without a resource policy allowing it",
+				action.trigger, action.collection, resource.GetKind(), resource.GetName())
+		}
+		return nil
+	}
+	if clusterScoped {
+		if !resourcePolicy.allows(action, resource.GetKind(), "", true) {
+			incrementMetric("policy.denied")
+			return fmt.Errorf("resource policy does not allow trigger %v of collection %v to create cluster scoped %v %v",
+				action.trigger, action.collection, resource.GetKind(), resource.GetName())
+		}
+		return nil
+	}
+	if !resourcePolicy.allows(action, resource.GetKind(), resource.GetNamespace(), false) {
+		incrementMetric("policy.denied")
+		return fmt.Errorf("resource policy does not allow trigger %v of collection %v to create %v %v in namespace %v",
+			action.trigger, action.collection, resource.GetKind(), resource.GetName(), resource.GetNamespace())
+	}
+	return nil
+}
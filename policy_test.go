@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+)
+
+func TestResourcePolicy(t *testing.T) {
+	policy, err := loadResourcePolicy("test_data/policy0/policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		collection    string
+		trigger       string
+		kind          string
+		namespace     string
+		clusterScoped bool
+		allowed       bool
+	}{
+		{"active", "default-0", "PipelineRun", "kabanero", false, true},
+		{"active", "default-0", "PipelineRun", "kube-system", false, false},
+		{"active", "default-0", "ClusterRoleBinding", "kabanero", false, false},
+		{"canary", "config-maps", "ConfigMap", "default", false, true},
+		{"active", "config-maps", "ConfigMap", "default", false, false},
+		{"canary", "other", "ConfigMap", "default", false, false},
+		{"active", "tasks-0", "ClusterTask", "", true, true},
+		{"active", "tasks-0", "ClusterTask", "kabanero", true, true},
+		{"active", "default-0", "ClusterTask", "", true, false},
+		{"active", "tasks-0", "Namespace", "", true, false},
+		{"active", "tasks-0", "ClusterTask", "kabanero", false, false},
+	}
+	for _, test := range tests {
+		action := &resourceAction{collection: test.collection, trigger: test.trigger}
+		if allowed := policy.allows(action, test.kind, test.namespace, test.clusterScoped); allowed != test.allowed {
+			t.Errorf("%v/%v creating %v in %v: expected allowed %v, got %v", test.collection, test.trigger, test.kind, test.namespace, test.allowed, allowed)
+		}
+	}
+
+	/* resources not allowed are rejected even in dry-run */
+	resourcePolicy = policy
+	defer func() { resourcePolicy = nil }()
+	variables := map[string]interface{}{"attr1": "string1"}
+	err = applyResourcesHelper("test_data/trigger11", nil, "resources", variables, &resourceAction{collection: "active", trigger: "default-0", dryrun: true})
+	if err == nil {
+		t.Fatal("expected ConfigMap to be rejected by the resource policy")
+	}
+	err = applyResourcesHelper("test_data/trigger11", nil, "resources", variables, &resourceAction{collection: "canary", trigger: "config-0", dryrun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterScopedResourcePolicy(t *testing.T) {
+	server := httptest.NewServer(&fakeDiscoveryServer{})
+	defer server.Close()
+	initializeRESTMapper(discovery.NewDiscoveryClientForConfigOrDie(&rest.Config{Host: server.URL}))
+	defer func() { restMapper = nil }()
+
+	namespace := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   map[string]interface{}{"name": "build-1"},
+	}}
+	configMap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "config", "namespace": "kabanero"},
+	}}
+	action := &resourceAction{collection: "active", trigger: "namespaces-0"}
+
+	/* without a policy, only namespaced resources are allowed */
+	resourcePolicy = nil
+	if err := checkResourcePolicy(action, namespace); err == nil {
+		t.Fatal("expected cluster scoped resource to be rejected without a resource policy")
+	}
+	if err := checkResourcePolicy(action, configMap); err != nil {
+		t.Fatal(err)
+	}
+
+	resourcePolicy = &resourcePolicyDef{Rules: []*resourcePolicyRule{
+		{Triggers: []string{"namespaces-*"}, Kinds: []string{"Namespace"}, ClusterScoped: true},
+	}}
+	defer func() { resourcePolicy = nil }()
+	if err := checkResourcePolicy(action, namespace); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkResourcePolicy(action, configMap); err == nil {
+		t.Fatal("expected namespaced resource to be rejected by a policy allowing only cluster scoped resources")
+	}
+	if err := checkResourcePolicy(&resourceAction{collection: "active", trigger: "other"}, namespace); err == nil {
+		t.Fatal("expected cluster scoped resource to be rejected for a trigger not allowed by the policy")
+	}
+}
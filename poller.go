@@ -0,0 +1,264 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/jsonpath"
+	"k8s.io/klog"
+)
+
+/*
+HTTP pollers. A poller periodically GETs the URL of one of the pollers of eventDefinitions.yaml, with the headers and
+credentials of HTTP message providers, and sends a message to its eventDestination when the response changed since it
+was last polled, to watch resources that do not send webhooks, such as the index of a stack hub or the version of an
+external service. If a jsonPath is configured, only the values it selects from the JSON response are compared, so
+that unrelated changes, such as timestamps, do not cause messages. The first poll records the current response
+without sending a message.
+*/
+
+const (
+	defaultPollInterval = time.Minute
+	maxPollResponseSize = 10 * 1024 * 1024
+)
+
+/* A poller of an URL */
+type poller struct {
+	definition *PollerDefinition
+	client     *httpProvider      // sends the requests, with the headers and credentials of the poller
+	jsonPath   *jsonpath.JSONPath // selects the compared values, if set
+
+	mutex    sync.Mutex
+	polled   bool        // whether the URL was polled successfully
+	etag     string      // ETag of the last response
+	digest   string      // digest of the last value
+	previous interface{} // last value
+}
+
+/* The running pollers, by name */
+var (
+	pollersMutex sync.Mutex
+	pollers      = make(map[string]*poller)
+)
+
+func newPoller(definition *PollerDefinition, ed *EventDefinition) (*poller, error) {
+	if definition.Name == "" {
+		return nil, fmt.Errorf("a poller has no name")
+	}
+	destination := false
+	for _, node := range ed.EventDestinations {
+		destination = destination || node.Name == definition.Destination
+	}
+	if !destination {
+		return nil, fmt.Errorf("eventDestination '%s' of poller '%s' is not defined", definition.Destination, definition.Name)
+	}
+	if definition.Interval < 0 {
+		return nil, fmt.Errorf("interval of poller '%s' is negative", definition.Name)
+	}
+	client, err := newHTTPProvider(&MessageProviderDefinition{
+		Name:          definition.Name,
+		URL:           definition.URL,
+		Headers:       definition.Headers,
+		Auth:          definition.Auth,
+		SecretRef:     definition.SecretRef,
+		Timeout:       definition.Timeout,
+		SkipTLSVerify: definition.SkipTLSVerify,
+		CAFile:        definition.CAFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("poller '%s': %v", definition.Name, err)
+	}
+	p := &poller{definition: definition, client: client}
+	if definition.JSONPath != "" {
+		expression := definition.JSONPath
+		if !strings.HasPrefix(expression, "{") {
+			expression = "{" + expression + "}"
+		}
+		p.jsonPath = jsonpath.New(definition.Name)
+		if err = p.jsonPath.Parse(expression); err != nil {
+			return nil, fmt.Errorf("invalid jsonPath of poller '%s': %v", definition.Name, err)
+		}
+	}
+	return p, nil
+}
+
+/* Return the value of a response to be compared: the values selected by the jsonPath, or the whole response */
+func (p *poller) value(body []byte) (interface{}, error) {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		if p.jsonPath != nil {
+			return nil, fmt.Errorf("response is not JSON: %v", err)
+		}
+		return string(body), nil
+	}
+	if p.jsonPath == nil {
+		return data, nil
+	}
+	results, err := p.jsonPath.FindResults(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0)
+	for _, result := range results {
+		for _, value := range result {
+			values = append(values, value.Interface())
+		}
+	}
+	if len(values) == 1 {
+		return values[0], nil
+	}
+	return values, nil
+}
+
+/* Poll the URL once. Returns the message to send if the response changed */
+func (p *poller) poll(refresh bool) (map[string]interface{}, int, error) {
+	definition := p.definition
+	req, err := http.NewRequest(http.MethodGet, definition.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = p.client.authorize(req, nil, refresh); err != nil {
+		return nil, 0, err
+	}
+	req.Header.Del("Content-Type")
+	p.mutex.Lock()
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	p.mutex.Unlock()
+	resp, err := p.client.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, resp.StatusCode, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, resp.StatusCode, fmt.Errorf("GET %v failed with http status %v", redactURL(definition.URL), resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPollResponseSize))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	value, err := p.value(body)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.etag = resp.Header.Get("ETag")
+	polled, previous, changed := p.polled, p.previous, digest != p.digest
+	p.polled, p.digest, p.previous = true, digest, value
+	if !polled || !changed {
+		return nil, resp.StatusCode, nil
+	}
+	message := map[string]interface{}{
+		HEADER: map[string][]string{},
+		BODY: map[string]interface{}{
+			"poller":   definition.Name,
+			"url":      redactURL(definition.URL),
+			"value":    value,
+			"previous": previous,
+			"digest":   digest,
+		},
+		EVENTID: newRequestID(),
+	}
+	return message, resp.StatusCode, nil
+}
+
+/* Poll the URL, and send a message to the eventDestination of the poller if the response changed */
+func (p *poller) pollAndSend() {
+	incrementMetric("poller.polls")
+	message, status, err := p.poll(false)
+	if status == http.StatusUnauthorized && p.definition.Auth != "" {
+		/* the credentials may have been rotated: read them again once */
+		message, _, err = p.poll(true)
+	}
+	if err != nil {
+		incrementMetric("poller.errors")
+		klog.Errorf("Unable to poll %v for poller '%s': %v", redactURL(p.definition.URL), p.definition.Name, err)
+		return
+	}
+	if message == nil {
+		return
+	}
+	incrementMetric("poller.changes")
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		klog.Errorf("Unable to marshal the message of poller '%s': %v", p.definition.Name, err)
+		return
+	}
+	if klog.V(4) {
+		klog.Infof("Response of %v changed for poller '%s'", redactURL(p.definition.URL), p.definition.Name)
+	}
+	if err = sendWithRetry(p.definition.Destination, bytes); err != nil {
+		klog.Errorf("Unable to send the message of poller '%s': %v", p.definition.Name, err)
+	}
+}
+
+/* Poll the URL at the interval of the poller, forever */
+func (p *poller) run() {
+	interval := p.definition.Interval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	for {
+		p.pollAndSend()
+		time.Sleep(interval)
+	}
+}
+
+/* Start the pollers of an eventDefinitions.yaml */
+func startPollers(ed *EventDefinition) error {
+	pollersMutex.Lock()
+	defer pollersMutex.Unlock()
+	for _, definition := range ed.Pollers {
+		if _, ok := pollers[definition.Name]; ok {
+			return fmt.Errorf("poller '%s' is defined more than once", definition.Name)
+		}
+		p, err := newPoller(definition, ed)
+		if err != nil {
+			return err
+		}
+		pollers[definition.Name] = p
+	}
+	for _, p := range pollers {
+		if klog.V(2) {
+			klog.Infof("Starting poller '%s' of %v", p.definition.Name, redactURL(p.definition.URL))
+		}
+		go p.run()
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestPollerChangeDetection(t *testing.T) {
+	var mutex sync.Mutex
+	version, generated := "0.2.0", 1
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		fmt.Fprintf(writer, `{"generated": %d, "stacks": [{"id": "nodejs", "version": "%s"}]}`, generated, version)
+	}))
+	defer server.Close()
+
+	captured := &capturingProvider{}
+	savedProviders, savedDefinitions, savedRead := messageProviders, eventProviders, readProviderSecret
+	defer func() {
+		messageProviders, eventProviders, readProviderSecret = savedProviders, savedDefinitions, savedRead
+	}()
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{httpToken: []byte("s3cret")}, nil
+	}
+	messageProviders = map[string]MessageProvider{"captured": captured}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: "stacks", ProviderRef: "captured"}}}
+
+	p, err := newPoller(&PollerDefinition{Name: "hub", URL: server.URL, Destination: "stacks", JSONPath: ".stacks[*].version", Auth: httpAuthBearer, SecretRef: "hub-token"}, eventProviders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the first poll records the response, and unrelated changes are ignored */
+	p.pollAndSend()
+	mutex.Lock()
+	generated = 2
+	mutex.Unlock()
+	p.pollAndSend()
+	if len(captured.messages) != 0 {
+		t.Fatalf("unexpected messages %q", captured.messages)
+	}
+
+	mutex.Lock()
+	version = "0.3.0"
+	mutex.Unlock()
+	p.pollAndSend()
+	if len(captured.messages) != 1 {
+		t.Fatalf("sent %v messages after a change", len(captured.messages))
+	}
+	message := make(map[string]interface{})
+	if err = json.Unmarshal(captured.messages[0], &message); err != nil {
+		t.Fatal(err)
+	}
+	body := message[BODY].(map[string]interface{})
+	if body["poller"] != "hub" || body["value"] != "0.3.0" || body["previous"] != "0.2.0" {
+		t.Fatalf("unexpected message %s", captured.messages[0])
+	}
+}
+
+func TestNewPollerValidation(t *testing.T) {
+	ed := &EventDefinition{EventDestinations: []*EventNode{{Name: "stacks"}}}
+	for _, definition := range []*PollerDefinition{
+		{URL: "https://hub.example.com/index.json", Destination: "stacks"},
+		{Name: "hub", Destination: "stacks"},
+		{Name: "hub", URL: "https://hub.example.com/index.json", Destination: "undefined"},
+		{Name: "hub", URL: "https://hub.example.com/index.json", Destination: "stacks", JSONPath: ".stacks[*"},
+		{Name: "hub", URL: "https://hub.example.com/index.json", Destination: "stacks", Auth: httpAuthBasic},
+	} {
+		if _, err := newPoller(definition, ed); err == nil {
+			t.Errorf("poller %+v was accepted", definition)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kabanero-io/kabanero-events/pkg/provider"
+	"k8s.io/klog"
+)
+
+// MessageProviderFactory creates the MessageProvider of a messageProvider definition.
+type MessageProviderFactory func(*MessageProviderDefinition) (MessageProvider, error)
+
+var (
+	providerFactoriesMutex sync.RWMutex
+	providerFactories      = make(map[string]MessageProviderFactory) // by providerType
+
+	providerPlugins string // comma separated paths of the Go plugins of message providers
+
+	pluginReceiveRetry = time.Second // delay before receiving again from a plugin provider whose receive failed
+)
+
+// RegisterMessageProvider registers the factory of the providers of a providerType. The providers compiled in
+// register themselves from an init function. Panics if the providerType is already registered.
+func RegisterMessageProvider(providerType string, factory MessageProviderFactory) {
+	providerFactoriesMutex.Lock()
+	defer providerFactoriesMutex.Unlock()
+	if _, ok := providerFactories[providerType]; ok {
+		panic(fmt.Sprintf("providerType %s is registered more than once", providerType))
+	}
+	providerFactories[providerType] = factory
+}
+
+// messageProviderTypes returns the registered provider types, sorted.
+func messageProviderTypes() []string {
+	providerFactoriesMutex.RLock()
+	defer providerFactoriesMutex.RUnlock()
+	types := make([]string, 0, len(providerFactories))
+	for providerType := range providerFactories {
+		types = append(types, providerType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// createMessageProvider creates the MessageProvider of a messageProvider definition, with the factory of its type.
+func createMessageProvider(provider *MessageProviderDefinition) (MessageProvider, error) {
+	providerFactoriesMutex.RLock()
+	factory, ok := providerFactories[provider.ProviderType]
+	providerFactoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Provider '%s' is not recognized.", provider.ProviderType)
+	}
+	if klog.V(6) {
+		klog.Infof("Creating %s provider '%s'", provider.ProviderType, provider.Name)
+	}
+	return factory(provider)
+}
+
+// providerCloser is implemented by the MessageProviders holding goroutines or connections, which are released by
+// Close once the provider is no longer used.
+type providerCloser interface {
+	Close() error
+}
+
+// closeMessageProvider closes a MessageProvider, if it holds goroutines or connections.
+func closeMessageProvider(mp MessageProvider) error {
+	if closer, ok := mp.(providerCloser); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// loadProviderPlugins opens the Go plugins of -providerPlugins, and registers the provider types of their Providers
+// variable.
+func loadProviderPlugins(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		plug, err := plugin.Open(path)
+		if err != nil {
+			return fmt.Errorf("unable to open the provider plugin %s: %v", path, err)
+		}
+		symbol, err := plug.Lookup("Providers")
+		if err != nil {
+			return fmt.Errorf("provider plugin %s has no Providers variable: %v", path, err)
+		}
+		factories, ok := symbol.(*map[string]provider.Factory)
+		if !ok {
+			return fmt.Errorf("the Providers variable of provider plugin %s is a %T, not a map[string]provider.Factory", path, symbol)
+		}
+		if err = registerPluginProviders(*factories); err != nil {
+			return fmt.Errorf("provider plugin %s: %v", path, err)
+		}
+		klog.Infof("Loaded provider plugin %s", path)
+	}
+	return nil
+}
+
+// registerPluginProviders registers the factories of the provider types of a plugin.
+func registerPluginProviders(factories map[string]provider.Factory) error {
+	types := make([]string, 0, len(factories))
+	for providerType := range factories {
+		types = append(types, providerType)
+	}
+	sort.Strings(types)
+	for _, providerType := range types {
+		providerFactoriesMutex.RLock()
+		_, registered := providerFactories[providerType]
+		providerFactoriesMutex.RUnlock()
+		if registered {
+			return fmt.Errorf("providerType %s is already registered", providerType)
+		}
+		factory := factories[providerType]
+		RegisterMessageProvider(providerType, func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+			p, err := factory(provider.Definition{
+				Name:          mpd.Name,
+				ProviderType:  mpd.ProviderType,
+				URL:           mpd.URL,
+				Timeout:       mpd.Timeout,
+				SkipTLSVerify: mpd.SkipTLSVerify,
+				Username:      mpd.Username,
+				PasswordEnv:   mpd.PasswordEnv,
+				Config:        mpd.Config,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &pluginProvider{provider: p}, nil
+		})
+	}
+	return nil
+}
+
+// pluginProvider is the MessageProvider of a provider of a plugin.
+type pluginProvider struct {
+	provider provider.Provider
+}
+
+func pluginDestination(node *EventNode) provider.Destination {
+	return provider.Destination{Name: node.Name, Topic: node.Topic}
+}
+
+// Send a message to the eventDestination. The context is the header of the webhook request, if any.
+func (pp *pluginProvider) Send(node *EventNode, payload []byte, ctx interface{}) error {
+	var header map[string][]string
+	switch typed := ctx.(type) {
+	case http.Header:
+		header = typed
+	case map[string][]string:
+		header = typed
+	}
+	return pp.provider.Send(pluginDestination(node), payload, header)
+}
+
+// Subscribe to the messages of an event source.
+func (pp *pluginProvider) Subscribe(node *EventNode) error {
+	return pp.provider.Subscribe(pluginDestination(node))
+}
+
+// Receive the next message of an event source.
+func (pp *pluginProvider) Receive(node *EventNode) ([]byte, error) {
+	return pp.provider.Receive(pluginDestination(node))
+}
+
+// ListenAndServe receives the messages of an event source, and calls the ReceiverFunc on each of them. Failed
+// receives, such as those of a lost connection to the broker, are retried.
+func (pp *pluginProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	for {
+		payload, err := pp.provider.Receive(pluginDestination(node))
+		if err != nil {
+			klog.Errorf("Unable to receive a message from %s: %v", node.Name, err)
+			time.Sleep(pluginReceiveRetry)
+			continue
+		}
+		receiver(payload)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kabanero-io/kabanero-events/pkg/provider"
+)
+
+/* A provider of a plugin, recording the messages sent */
+type recordingPluginProvider struct {
+	definition provider.Definition
+	sent       []provider.Destination
+	header     map[string][]string
+}
+
+func (rp *recordingPluginProvider) Send(destination provider.Destination, payload []byte, header map[string][]string) error {
+	rp.sent = append(rp.sent, destination)
+	rp.header = header
+	return nil
+}
+
+func (rp *recordingPluginProvider) Subscribe(destination provider.Destination) error {
+	return nil
+}
+
+func (rp *recordingPluginProvider) Receive(destination provider.Destination) ([]byte, error) {
+	return []byte(destination.Topic), nil
+}
+
+/* A provider of a plugin whose first receives fail, and which blocks once it received a message */
+type failingPluginProvider struct {
+	recordingPluginProvider
+	failures int
+	received bool
+}
+
+func (fp *failingPluginProvider) Receive(destination provider.Destination) ([]byte, error) {
+	if fp.failures > 0 {
+		fp.failures--
+		return nil, fmt.Errorf("connection lost")
+	}
+	if fp.received {
+		select {}
+	}
+	fp.received = true
+	return []byte(destination.Topic), nil
+}
+
+func TestMessageProviderRegistry(t *testing.T) {
+	types := messageProviderTypes()
+	if !sort.StringsAreSorted(types) {
+		t.Fatalf("provider types %v are not sorted", types)
+	}
+	for _, providerType := range []string{"nats", "rest", "http", "kafka-rest", "aws", "peer", "failover", "notification"} {
+		index := sort.SearchStrings(types, providerType)
+		if index == len(types) || types[index] != providerType {
+			t.Errorf("provider type %v is not registered: %v", providerType, types)
+		}
+	}
+	if _, err := createMessageProvider(&MessageProviderDefinition{Name: "unknown", ProviderType: "mqtt"}); err == nil {
+		t.Fatal("provider of an unregistered type was created")
+	}
+
+	var created *recordingPluginProvider
+	defer func() {
+		providerFactoriesMutex.Lock()
+		delete(providerFactories, "mqtt")
+		providerFactoriesMutex.Unlock()
+	}()
+	err := registerPluginProviders(map[string]provider.Factory{"mqtt": func(definition provider.Definition) (provider.Provider, error) {
+		created = &recordingPluginProvider{definition: definition}
+		return created, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = registerPluginProviders(map[string]provider.Factory{"nats": nil}); err == nil {
+		t.Fatal("plugin replaced a registered provider type")
+	}
+
+	mp, err := createMessageProvider(&MessageProviderDefinition{Name: "broker", ProviderType: "mqtt", URL: "tcp://broker:1883", Config: map[string]interface{}{"qos": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.definition.Name != "broker" || created.definition.URL != "tcp://broker:1883" || created.definition.Config["qos"] != 1 {
+		t.Fatalf("unexpected definition %+v", created.definition)
+	}
+	node := &EventNode{Name: "github", Topic: "github-events"}
+	if err = mp.Send(node, []byte("{}"), http.Header{"X-Github-Event": {"push"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.sent) != 1 || created.sent[0].Topic != "github-events" || created.header["X-Github-Event"][0] != "push" {
+		t.Fatalf("unexpected sends %v with header %v", created.sent, created.header)
+	}
+	if payload, err := mp.Receive(node); err != nil || string(payload) != "github-events" {
+		t.Fatalf("unexpected message %q: %v", payload, err)
+	}
+	if err = loadProviderPlugins("test_data/missing.so"); err == nil {
+		t.Fatal("missing plugin was loaded")
+	}
+}
+
+func TestPluginProviderListenRetries(t *testing.T) {
+	savedRetry := pluginReceiveRetry
+	defer func() { pluginReceiveRetry = savedRetry }()
+	pluginReceiveRetry = time.Millisecond
+
+	pp := &pluginProvider{provider: &failingPluginProvider{failures: 2}}
+	received := make(chan []byte, 1)
+	go pp.ListenAndServe(&EventNode{Name: "github", Topic: "github-events"}, func(payload []byte) { received <- payload })
+	select {
+	case payload := <-received:
+		if string(payload) != "github-events" {
+			t.Fatalf("unexpected message %q", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("listener stopped after a failed receive")
+	}
+}
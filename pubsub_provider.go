@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// The Pub/Sub provider publishes messages to Google Cloud Pub/Sub topics, and receives event sources from their
+// subscriptions, so that GKE-based installations need not run a broker. The topic of a node is the name of a topic
+// of the project of the provider, or its full name, projects/<project>/topics/<topic>. The subscription of an event
+// source is created on its topic if it does not exist. Received messages are acknowledged once processed, and their
+// ack deadline is extended while they are, so that messages that were not processed are delivered again. With
+// ordered delivery, messages are published with the name of their repository as ordering key, so that the events of a
+// repository are received in the order they were published. The REST API of Pub/Sub is called with the access tokens
+// of a service account key, from a Secret or the file of GOOGLE_APPLICATION_CREDENTIALS, or of the workload identity of
+// the pod, from the metadata server.
+
+const (
+	pubsubKeyFile         = "key.json" // key of the service account key in the secretRef
+	pubsubScope           = "https://www.googleapis.com/auth/pubsub"
+	pubsubAuthNone        = "none" // for the Pub/Sub emulator
+	defaultPubSubURL      = "https://pubsub.googleapis.com/v1/"
+	defaultPubSubTimeout  = 30 * time.Second
+	defaultPubSubDeadline = 60 * time.Second
+	minPubSubDeadline     = 10 * time.Second
+	maxPubSubDeadline     = 600 * time.Second
+	defaultPubSubMessages = 10
+	defaultMetadataHost   = "metadata.google.internal"
+	pubsubGoogleTokenURI  = "https://oauth2.googleapis.com/token"
+)
+
+// The fields of a service account key used to get access tokens.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// A message of Pub/Sub.
+type pubsubMessage struct {
+	Data        []byte            `json:"data"` // base64 encoded in JSON
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	MessageID   string            `json:"messageId,omitempty"`
+}
+
+// A message received from a subscription.
+type pubsubReceivedMessage struct {
+	AckID   string        `json:"ackId"`
+	Message pubsubMessage `json:"message"`
+}
+
+// An error returned by the REST API of Pub/Sub.
+type pubsubError struct {
+	Details struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+	status int
+}
+
+func (err *pubsubError) Error() string {
+	if err.Details.Status == "" {
+		return fmt.Sprintf("http status %d", err.status)
+	}
+	return fmt.Sprintf("%s: %s (http status %d)", err.Details.Status, err.Details.Message, err.status)
+}
+
+type pubsubProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	pubsub                    *PubSubDefinition
+	baseURL                   string
+	client                    *http.Client
+	mutex                     sync.Mutex
+	token                     *cachedToken
+	tokenSource               string
+	subscribed                map[string]bool // subscriptions known to exist
+}
+
+func (provider *pubsubProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	provider.pubsub = mpd.PubSub
+	if provider.pubsub == nil || provider.pubsub.Project == "" {
+		return fmt.Errorf("Pub/Sub provider '%s' has no pubsub project", mpd.Name)
+	}
+	if deadline := provider.pubsub.AckDeadline; deadline != 0 && (deadline < minPubSubDeadline || deadline > maxPubSubDeadline) {
+		return fmt.Errorf("pubsub ackDeadline of Pub/Sub provider '%s' is not between %v and %v", mpd.Name, minPubSubDeadline, maxPubSubDeadline)
+	}
+	if provider.pubsub.MaxMessages < 0 || provider.pubsub.MaxMessages > 1000 {
+		return fmt.Errorf("pubsub maxMessages of Pub/Sub provider '%s' is not between 1 and 1000", mpd.Name)
+	}
+	if mpd.Auth != "" && mpd.Auth != pubsubAuthNone {
+		return fmt.Errorf("auth '%s' of Pub/Sub provider '%s' is not %s", mpd.Auth, mpd.Name, pubsubAuthNone)
+	}
+	provider.baseURL = defaultPubSubURL
+	if mpd.URL != "" {
+		parsed, err := url.Parse(mpd.URL)
+		if err != nil || parsed.Host == "" {
+			return fmt.Errorf("url '%s' of Pub/Sub provider '%s' is not a URL", redactURL(mpd.URL), mpd.Name)
+		}
+		provider.baseURL = strings.TrimSuffix(mpd.URL, "/") + "/"
+	}
+	provider.subscribed = make(map[string]bool)
+	provider.client = &http.Client{Transport: withUserAgent(nil), Timeout: provider.timeout()}
+	return nil
+}
+
+func (provider *pubsubProvider) timeout() time.Duration {
+	if provider.messageProviderDefinition.Timeout > 0 {
+		return provider.messageProviderDefinition.Timeout
+	}
+	return defaultPubSubTimeout
+}
+
+func (provider *pubsubProvider) ackDeadline() time.Duration {
+	if provider.pubsub.AckDeadline > 0 {
+		return provider.pubsub.AckDeadline
+	}
+	return defaultPubSubDeadline
+}
+
+// Return the full name of the topic of a node.
+func (provider *pubsubProvider) topicName(node *EventNode) string {
+	if strings.HasPrefix(node.Topic, "projects/") {
+		return node.Topic
+	}
+	return "projects/" + provider.pubsub.Project + "/topics/" + node.Topic
+}
+
+// Return the full name of the subscription of an eventSource: that of pubsub.subscriptions, or the topic followed by
+// the consumer group.
+func (provider *pubsubProvider) subscriptionName(node *EventNode) string {
+	subscription, ok := provider.pubsub.Subscriptions[node.Name]
+	if !ok {
+		group := provider.messageProviderDefinition.ConsumerGroup
+		if group == "" {
+			group = "kabanero-events"
+		}
+		topic := node.Topic
+		topic = topic[strings.LastIndex(topic, "/")+1:]
+		subscription = topic + "-" + group
+	}
+	if strings.HasPrefix(subscription, "projects/") {
+		return subscription
+	}
+	return "projects/" + provider.pubsub.Project + "/subscriptions/" + subscription
+}
+
+// Return an access token, renewing it before it expires.
+func (provider *pubsubProvider) accessToken() (string, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	now := time.Now()
+	if provider.token.valid(now) {
+		return provider.token.token, nil
+	}
+	token, source, err := provider.newAccessToken(now)
+	if err != nil {
+		return "", fmt.Errorf("unable to get an access token for Pub/Sub provider '%s': %v", provider.messageProviderDefinition.Name, err)
+	}
+	if klog.V(5) && source != provider.tokenSource {
+		klog.Infof("Pub/Sub provider '%s' uses the access tokens of %s", provider.messageProviderDefinition.Name, source)
+	}
+	provider.token, provider.tokenSource = token, source
+	return token.token, nil
+}
+
+// Get an access token from the service account key of the secretRef or of GOOGLE_APPLICATION_CREDENTIALS, or else
+// from the metadata server.
+func (provider *pubsubProvider) newAccessToken(now time.Time) (*cachedToken, string, error) {
+	mpd := provider.messageProviderDefinition
+	if mpd.SecretRef != "" {
+		secret, err := readProviderSecret(mpd.SecretRef)
+		if err != nil {
+			return nil, "", err
+		}
+		data, ok := secret[pubsubKeyFile]
+		if !ok {
+			return nil, "", fmt.Errorf("secret %s has no %s", mpd.SecretRef, pubsubKeyFile)
+		}
+		token, err := provider.serviceAccountToken(data, now)
+		return token, "the key of secret " + mpd.SecretRef, err
+	}
+	if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, "", err
+		}
+		token, err := provider.serviceAccountToken(data, now)
+		return token, "the key " + file, err
+	}
+	token, err := provider.metadataToken(now)
+	return token, "the workload identity of the pod", err
+}
+
+// Exchange a JSON Web Token signed with a service account key for an access token.
+func (provider *pubsubProvider) serviceAccountToken(data []byte, now time.Time) (*cachedToken, error) {
+	key := &serviceAccountKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("unable to decode the service account key: %v", err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return nil, fmt.Errorf("the service account key has no client_email or private_key")
+	}
+	privateKey, err := parseRSAPrivateKey([]byte(key.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the private key of %s: %v", key.ClientEmail, err)
+	}
+	tokenURI := key.TokenURI
+	if tokenURI == "" {
+		tokenURI = pubsubGoogleTokenURI
+	}
+	assertion, err := signServiceAccountJWT(privateKey, key, tokenURI, now)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	resp, err := provider.client.PostForm(tokenURI, form)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAccessToken(resp, now)
+}
+
+func signServiceAccountJWT(privateKey *rsa.PrivateKey, key *serviceAccountKey, tokenURI string, now time.Time) (string, error) {
+	return signJWT(privateKey, map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": pubsubScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+}
+
+// Get the access token of the service account of the pod from the metadata server, such as that of GKE Workload
+// Identity.
+func (provider *pubsubProvider) metadataToken(now time.Time) (*cachedToken, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultMetadataHost
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAccessToken(resp, now)
+}
+
+// Decode the access token of a response of a token endpoint.
+func decodeAccessToken(resp *http.Response, now time.Time) (*cachedToken, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token endpoint returned http status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("unable to decode the access token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+	return &cachedToken{token: token.AccessToken, expires: now.Add(time.Duration(token.ExpiresIn) * time.Second)}, nil
+}
+
+// Call a method of the REST API of Pub/Sub on a resource, and decode its JSON response into result if not nil.
+// Returns the http status of the response.
+func (provider *pubsubProvider) call(method string, resource string, request interface{}, result interface{}) (int, error) {
+	var body []byte
+	if request != nil {
+		var err error
+		if body, err = json.Marshal(request); err != nil {
+			return 0, err
+		}
+	}
+	req, err := http.NewRequest(method, provider.baseURL+resource, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if provider.messageProviderDefinition.Auth != pubsubAuthNone {
+		token, err := provider.accessToken()
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			/* the token may have been revoked: get a new one for the next call */
+			provider.mutex.Lock()
+			provider.token = nil
+			provider.mutex.Unlock()
+		}
+		apiErr := &pubsubError{status: resp.StatusCode}
+		json.Unmarshal(responseBody, apiErr)
+		return resp.StatusCode, apiErr
+	}
+	if result != nil {
+		return resp.StatusCode, json.Unmarshal(responseBody, result)
+	}
+	return resp.StatusCode, nil
+}
+
+// Subscribe creates the subscription of an eventSource on its topic if it does not exist.
+func (provider *pubsubProvider) Subscribe(node *EventNode) error {
+	subscription := provider.subscriptionName(node)
+	status, err := provider.call(http.MethodGet, subscription, nil, nil)
+	if status == http.StatusNotFound {
+		request := map[string]interface{}{
+			"topic":                 provider.topicName(node),
+			"ackDeadlineSeconds":    int(provider.ackDeadline() / time.Second),
+			"enableMessageOrdering": provider.pubsub.Ordered,
+		}
+		status, err = provider.call(http.MethodPut, subscription, request, nil)
+		if status == http.StatusConflict {
+			/* created by another instance */
+			err = nil
+		} else if err == nil && klog.V(5) {
+			klog.Infof("Created Pub/Sub subscription %s", subscription)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to %s of Pub/Sub provider '%s': %v", subscription, provider.messageProviderDefinition.Name, err)
+	}
+	provider.mutex.Lock()
+	provider.subscribed[subscription] = true
+	provider.mutex.Unlock()
+	return nil
+}
+
+// Return the ordering key of a message: the full name of the repository of the event, if any.
+func pubsubOrderingKey(payload []byte) string {
+	message := make(map[string]interface{})
+	if json.Unmarshal(payload, &message) != nil {
+		return ""
+	}
+	return messageRepositoryName(message)
+}
+
+// Publish a message to the topic of an eventDestination.
+func (provider *pubsubProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	if klog.V(6) {
+		klog.Infof("pubsubProvider: Sending %s", string(payload))
+	}
+	message := pubsubMessage{Data: payload}
+	if provider.pubsub.Ordered {
+		message.OrderingKey = pubsubOrderingKey(payload)
+	}
+	var result struct {
+		MessageIDs []string `json:"messageIds"`
+	}
+	topic := provider.topicName(node)
+	if _, err := provider.call(http.MethodPost, topic+":publish", map[string]interface{}{"messages": []pubsubMessage{message}}, &result); err != nil {
+		return fmt.Errorf("pubsubProvider Send to %v failed: %v", topic, err)
+	}
+	if klog.V(8) {
+		klog.Infof("pubsubProvider: message published to %s as %v", topic, result.MessageIDs)
+	}
+	return nil
+}
+
+// Pull up to maxMessages messages of the subscription of an eventSource.
+func (provider *pubsubProvider) pull(node *EventNode, maxMessages int) ([]*pubsubReceivedMessage, error) {
+	subscription := provider.subscriptionName(node)
+	provider.mutex.Lock()
+	subscribed := provider.subscribed[subscription]
+	provider.mutex.Unlock()
+	if !subscribed {
+		return nil, fmt.Errorf("eventSource %s is not subscribed", node.Name)
+	}
+	var result struct {
+		ReceivedMessages []*pubsubReceivedMessage `json:"receivedMessages"`
+	}
+	if _, err := provider.call(http.MethodPost, subscription+":pull", map[string]interface{}{"maxMessages": maxMessages}, &result); err != nil {
+		return nil, err
+	}
+	return result.ReceivedMessages, nil
+}
+
+// Acknowledge messages once processed, so that they are not delivered again.
+func (provider *pubsubProvider) acknowledge(node *EventNode, ackIDs []string) {
+	subscription := provider.subscriptionName(node)
+	if _, err := provider.call(http.MethodPost, subscription+":acknowledge", map[string]interface{}{"ackIds": ackIDs}, nil); err != nil {
+		klog.Errorf("Unable to acknowledge Pub/Sub messages of eventSource '%s': %v", node.Name, err)
+	}
+}
+
+// Extend the ack deadline of messages being processed, so that they are not delivered again meanwhile.
+func (provider *pubsubProvider) extendDeadline(node *EventNode, ackIDs []string) {
+	subscription := provider.subscriptionName(node)
+	request := map[string]interface{}{"ackIds": ackIDs, "ackDeadlineSeconds": int(provider.ackDeadline() / time.Second)}
+	if _, err := provider.call(http.MethodPost, subscription+":modifyAckDeadline", request, nil); err != nil {
+		klog.Errorf("Unable to extend the ack deadline of Pub/Sub messages of eventSource '%s': %v", node.Name, err)
+	}
+}
+
+// Receive a message from an eventSource, acknowledging it at once.
+func (provider *pubsubProvider) Receive(node *EventNode) ([]byte, error) {
+	messages, err := provider.pull(node, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("pubsubProvider: no message received from eventSource %s", node.Name)
+	}
+	provider.acknowledge(node, []string{messages[0].AckID})
+	return messages[0].Message.Data, nil
+}
+
+// ListenAndServe listens for new events on some eventSource and calls the ReceiverFunc on the message payload.
+// The messages of a batch are processed in order. Their ack deadline is extended until they are processed, and each
+// is acknowledged once the ReceiverFunc returns.
+func (provider *pubsubProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	if klog.V(5) {
+		klog.Infof("pubsubProvider: Starting to listen for events of eventSource %s", node.Name)
+	}
+	maxMessages := provider.pubsub.MaxMessages
+	if maxMessages == 0 {
+		maxMessages = defaultPubSubMessages
+	}
+	for {
+		messages, err := provider.pull(node, maxMessages)
+		if err != nil {
+			klog.Errorf("Unable to pull Pub/Sub messages of eventSource '%s': %v", node.Name, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		pending := make(map[string]bool, len(messages))
+		for _, message := range messages {
+			pending[message.AckID] = true
+		}
+		var mutex sync.Mutex
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(provider.ackDeadline() * 2 / 3)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					mutex.Lock()
+					ackIDs := make([]string, 0, len(pending))
+					for ackID := range pending {
+						ackIDs = append(ackIDs, ackID)
+					}
+					mutex.Unlock()
+					if len(ackIDs) > 0 {
+						provider.extendDeadline(node, ackIDs)
+					}
+				}
+			}
+		}()
+		for _, message := range messages {
+			if klog.V(8) {
+				klog.Infof("Received message %s of eventSource %s: %s", message.Message.MessageID, node.Name, message.Message.Data)
+			}
+			receiver(message.Message.Data)
+			provider.acknowledge(node, []string{message.AckID})
+			mutex.Lock()
+			delete(pending, message.AckID)
+			mutex.Unlock()
+		}
+		close(done)
+	}
+}
+
+func init() {
+	RegisterMessageProvider("pubsub", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newPubSubProvider(mpd)
+	})
+}
+
+func newPubSubProvider(mpd *MessageProviderDefinition) (*pubsubProvider, error) {
+	provider := new(pubsubProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
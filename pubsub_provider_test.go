@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* A Pub/Sub API with one topic and its subscriptions, and the token endpoint of a service account */
+type fakePubSub struct {
+	server        *httptest.Server
+	publicKey     *rsa.PublicKey
+	mutex         sync.Mutex
+	messages      []pubsubMessage          // messages not yet pulled
+	unacked       map[string]pubsubMessage // messages pulled but not acknowledged, by ack ID
+	ackIDs        int
+	subscriptions map[string]map[string]interface{}
+	extended      int
+	tokens        int
+	requests      []string
+}
+
+func newFakePubSub(t *testing.T, publicKey *rsa.PublicKey) *fakePubSub {
+	fake := &fakePubSub{publicKey: publicKey, unacked: make(map[string]pubsubMessage), subscriptions: make(map[string]map[string]interface{})}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (fake *fakePubSub) serve(writer http.ResponseWriter, req *http.Request) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.requests = append(fake.requests, req.Method+" "+req.URL.Path)
+	if req.URL.Path == "/token" {
+		req.ParseForm()
+		parts := strings.Split(req.Form.Get("assertion"), ".")
+		claims := make(map[string]interface{})
+		verified := false
+		if len(parts) == 3 {
+			decoded, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			json.Unmarshal(decoded, &claims)
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			verified = rsa.VerifyPKCS1v15(fake.publicKey, crypto.SHA256, digest[:], signature) == nil
+		}
+		if !verified || req.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || claims["iss"] != "events@project.iam.gserviceaccount.com" ||
+			claims["scope"] != pubsubScope || claims["aud"] != fake.server.URL+"/token" {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(writer, `{"error":"invalid_grant"}`)
+			return
+		}
+		fake.tokens++
+		fmt.Fprint(writer, `{"access_token":"access","expires_in":3600,"token_type":"Bearer"}`)
+		return
+	}
+	if req.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+		if req.Header.Get("Metadata-Flavor") != "Google" {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(writer, `{"access_token":"access","expires_in":3600,"token_type":"Bearer"}`)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer access" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(writer, `{"error":{"code":401,"message":"invalid credentials","status":"UNAUTHENTICATED"}}`)
+		return
+	}
+	request := make(map[string]interface{})
+	json.NewDecoder(req.Body).Decode(&request)
+	resource := strings.TrimPrefix(req.URL.Path, "/v1/")
+	switch {
+	case strings.HasSuffix(resource, ":publish"):
+		var publish struct {
+			Messages []pubsubMessage `json:"messages"`
+		}
+		encoded, _ := json.Marshal(request)
+		json.Unmarshal(encoded, &publish)
+		fake.messages = append(fake.messages, publish.Messages...)
+		fmt.Fprint(writer, `{"messageIds":["1"]}`)
+	case strings.HasSuffix(resource, ":pull"):
+		received := make([]*pubsubReceivedMessage, 0)
+		for len(fake.messages) > 0 && len(received) < int(request["maxMessages"].(float64)) {
+			fake.ackIDs++
+			ackID := fmt.Sprintf("ack-%d", fake.ackIDs)
+			fake.unacked[ackID] = fake.messages[0]
+			received = append(received, &pubsubReceivedMessage{AckID: ackID, Message: fake.messages[0]})
+			fake.messages = fake.messages[1:]
+		}
+		json.NewEncoder(writer).Encode(map[string]interface{}{"receivedMessages": received})
+	case strings.HasSuffix(resource, ":acknowledge"):
+		for _, ackID := range request["ackIds"].([]interface{}) {
+			delete(fake.unacked, ackID.(string))
+		}
+		fmt.Fprint(writer, `{}`)
+	case strings.HasSuffix(resource, ":modifyAckDeadline"):
+		fake.extended++
+		fmt.Fprint(writer, `{}`)
+	case req.Method == http.MethodGet:
+		if _, ok := fake.subscriptions[resource]; !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(writer, `{"error":{"code":404,"message":"Resource not found","status":"NOT_FOUND"}}`)
+			return
+		}
+		fmt.Fprint(writer, `{}`)
+	case req.Method == http.MethodPut:
+		fake.subscriptions[resource] = request
+		fmt.Fprint(writer, `{}`)
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+/* Return a service account key using the token endpoint of a fake */
+func serviceAccountKeyJSON(t *testing.T, key *rsa.PrivateKey, tokenURI string) []byte {
+	data, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "events@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPubSubProviderValidation(t *testing.T) {
+	for _, mpd := range []*MessageProviderDefinition{
+		{Name: "pubsub"},
+		{Name: "pubsub", PubSub: &PubSubDefinition{Project: "project", AckDeadline: time.Second}},
+		{Name: "pubsub", PubSub: &PubSubDefinition{Project: "project", MaxMessages: 1001}},
+		{Name: "pubsub", Auth: "basic", PubSub: &PubSubDefinition{Project: "project"}},
+		{Name: "pubsub", URL: "emulator", PubSub: &PubSubDefinition{Project: "project"}},
+	} {
+		if _, err := newPubSubProvider(mpd); err == nil {
+			t.Errorf("provider %+v was accepted", mpd)
+		}
+	}
+	provider, err := newPubSubProvider(&MessageProviderDefinition{Name: "pubsub", ConsumerGroup: "staging",
+		PubSub: &PubSubDefinition{Project: "project", Subscriptions: map[string]string{"quay": "images"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[*EventNode]string{
+		{Name: "github", Topic: "github"}:                       "projects/project/subscriptions/github-staging",
+		{Name: "quay", Topic: "quay"}:                           "projects/project/subscriptions/images",
+		{Name: "docker", Topic: "projects/other/topics/docker"}: "projects/project/subscriptions/docker-staging",
+	}
+	for node, expected := range tests {
+		if subscription := provider.subscriptionName(node); subscription != expected {
+			t.Errorf("subscription of %s is %s, expected %s", node.Name, subscription, expected)
+		}
+	}
+	if topic := provider.topicName(&EventNode{Topic: "github"}); topic != "projects/project/topics/github" {
+		t.Fatalf("unexpected topic %s", topic)
+	}
+}
+
+func TestPubSubProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakePubSub(t, &key.PublicKey)
+	defer fake.server.Close()
+	savedReader := readProviderSecret
+	defer func() { readProviderSecret = savedReader }()
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{pubsubKeyFile: serviceAccountKeyJSON(t, key, fake.server.URL+"/token")}, nil
+	}
+
+	provider, err := newPubSubProvider(&MessageProviderDefinition{Name: "pubsub", URL: fake.server.URL + "/v1", SecretRef: "pubsub-key", Timeout: time.Second,
+		PubSub: &PubSubDefinition{Project: "project", Ordered: true, AckDeadline: 10 * time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &EventNode{Name: "github", Topic: "github"}
+	if _, err = provider.Receive(node); err == nil {
+		t.Fatal("expected an error receiving without a subscription")
+	}
+	if err = provider.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+	subscription := fake.subscriptions["projects/project/subscriptions/github-kabanero-events"]
+	if subscription == nil || subscription["topic"] != "projects/project/topics/github" || subscription["ackDeadlineSeconds"] != float64(10) || subscription["enableMessageOrdering"] != true {
+		t.Fatalf("unexpected subscriptions %v", fake.subscriptions)
+	}
+	/* the subscription exists when another instance subscribes */
+	other, _ := newPubSubProvider(provider.messageProviderDefinition)
+	if err = other.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int{1, 2, 3} {
+		message := fmt.Sprintf(`{"header":{},"body":{"id":%d,"repository":{"full_name":"kabanero-io/events"}}}`, id)
+		if err = provider.Send(node, []byte(message), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.messages[0].OrderingKey != "kabanero-io/events" {
+		t.Fatalf("unexpected ordering key %q", fake.messages[0].OrderingKey)
+	}
+	/* one access token of each provider */
+	if fake.tokens != 2 {
+		t.Fatalf("%d access tokens requested", fake.tokens)
+	}
+	data, err := provider.Receive(node)
+	if err != nil || !strings.Contains(string(data), `"id":1`) {
+		t.Fatalf("unexpected message %s: %v", data, err)
+	}
+
+	/* the deadline of the messages of a batch is extended while they are processed */
+	provider.pubsub.AckDeadline = 30 * time.Millisecond
+	received := make(chan string, 10)
+	go provider.ListenAndServe(node, func(data []byte) {
+		time.Sleep(50 * time.Millisecond)
+		received <- string(data)
+	})
+	for _, id := range []string{`"id":2`, `"id":3`} {
+		select {
+		case got := <-received:
+			if !strings.Contains(got, id) {
+				t.Fatalf("unexpected message %s, expected %s", got, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+	waitFor(t, func() bool {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		return len(fake.unacked) == 0
+	})
+	fake.mutex.Lock()
+	extended := fake.extended
+	fake.mutex.Unlock()
+	if extended == 0 {
+		t.Fatal("ack deadline not extended")
+	}
+
+	readProviderSecret = func(name string) (map[string][]byte, error) { return map[string][]byte{}, nil }
+	missing, _ := newPubSubProvider(&MessageProviderDefinition{Name: "pubsub", URL: fake.server.URL + "/v1", SecretRef: "pubsub-key", PubSub: &PubSubDefinition{Project: "project"}})
+	if err = missing.Send(node, []byte("{}"), nil); err == nil || !strings.Contains(err.Error(), "has no key.json") {
+		t.Fatalf("unexpected error sending without a key: %v", err)
+	}
+}
+
+func TestPubSubWorkloadIdentity(t *testing.T) {
+	fake := newFakePubSub(t, nil)
+	defer fake.server.Close()
+	saved, set := os.LookupEnv("GCE_METADATA_HOST")
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(fake.server.URL, "http://"))
+	defer func() {
+		if set {
+			os.Setenv("GCE_METADATA_HOST", saved)
+		} else {
+			os.Unsetenv("GCE_METADATA_HOST")
+		}
+	}()
+	provider, err := newPubSubProvider(&MessageProviderDefinition{Name: "pubsub", URL: fake.server.URL + "/v1", PubSub: &PubSubDefinition{Project: "project"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = provider.Send(&EventNode{Name: "github", Topic: "github"}, []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if provider.tokenSource != "the workload identity of the pod" || fake.messages[0].OrderingKey != "" {
+		t.Fatalf("unexpected token source %s, or ordering key %q", provider.tokenSource, fake.messages[0].OrderingKey)
+	}
+
+	/* the emulator is not authenticated */
+	emulator, _ := newPubSubProvider(&MessageProviderDefinition{Name: "pubsub", URL: fake.server.URL + "/v1", Auth: pubsubAuthNone,
+		PubSub: &PubSubDefinition{Project: "project"}})
+	if err = emulator.Send(&EventNode{Name: "github", Topic: "github"}, []byte("{}"), nil); err == nil || !strings.Contains(err.Error(), "UNAUTHENTICATED") {
+		t.Fatalf("unexpected error sending to the emulator: %v", err)
+	}
+}
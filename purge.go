@@ -0,0 +1,134 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Deletion of stored data. DELETE /admin/events purges the audit records of the retention store, and the messages of the
+dead-letter spool, that match a repository, a user, and/or a time range, to honor requests to delete the personal
+data of developers found in the payloads of their commits. A dead letter matches a user if the user is the login,
+username, or email of any person in its message.
+*/
+
+/* The number of records and messages purged */
+type purgeResult struct {
+	AuditRecords int `json:"auditRecords"`
+	DeadLetters  int `json:"deadLetters"`
+}
+
+/* Return true if a value of a message names a user */
+func mentionsUser(value interface{}, user string, person bool) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			if str, ok := element.(string); ok && (personValueKeys[key] || (person && key == NAME)) && strings.EqualFold(str, user) {
+				return true
+			}
+			if mentionsUser(element, user, personKeys[key]) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, element := range v {
+			if mentionsUser(element, user, person) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Return true if a dead letter matches a purge query */
+func deadLetterMatches(query auditQuery, letter *deadLetter) bool {
+	/* dead letters are not processed by trigger collections */
+	if query.EventSource != "" || query.Collection != "" || query.Trigger != "" || query.Outcome != "" {
+		return false
+	}
+	if !query.Since.IsZero() && letter.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !letter.Time.Before(query.Until) {
+		return false
+	}
+	message := make(map[string]interface{})
+	if (query.Repository != "" || query.User != "") && json.Unmarshal(letter.Message, &message) != nil {
+		return false
+	}
+	if query.Repository != "" && messageRepositoryName(message) != query.Repository {
+		return false
+	}
+	return query.User == "" || mentionsUser(message[BODY], query.User, false)
+}
+
+/* Remove the dead letters matching a query */
+func purgeDeadLetters(query auditQuery) (int, error) {
+	letters, err := listDeadLetters()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, letter := range letters {
+		if !deadLetterMatches(query, letter) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(deadLetterDir, letter.ID+deadLetterSuffix)); err != nil && !os.IsNotExist(err) {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+/* Purge the audit records and dead letters matching a query */
+func purgeEvents(query auditQuery) (*purgeResult, error) {
+	result := &purgeResult{}
+	var err error
+	if result.AuditRecords, err = auditStore.purge(query); err != nil {
+		return result, err
+	}
+	if result.DeadLetters, err = purgeDeadLetters(query); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+/* DELETE /admin/events purges the records and messages matching the query, which must select something */
+func adminPurgeHandler(writer http.ResponseWriter, req *http.Request, query auditQuery) {
+	query.Limit = 0
+	if query == (auditQuery{}) {
+		writeError(writer, req, codeBadRequest, "the events to purge must be selected, for example by repository, user, since, or until")
+		return
+	}
+	result, err := purgeEvents(query)
+	if err != nil {
+		incrementMetric("purge.errors")
+		writeError(writer, req, codeInternalError, err.Error())
+		return
+	}
+	incrementMetric("purge.requests")
+	klog.Infof("Purged %v audit records and %v dead letters", result.AuditRecords, result.DeadLetters)
+	writeJSON(writer, result)
+}
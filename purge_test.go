@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPurgeEvents(t *testing.T) {
+	defer setupDeadLetters(t, &failingProvider{}, &failingProvider{})()
+	savedStore := auditStore
+	defer func() { auditStore = savedStore }()
+	auditStore = newMemoryStore()
+	now := time.Now().UTC()
+	for _, record := range []*auditRecord{
+		{Time: now.Add(-2 * time.Hour), Repository: "kabanero-io/appsody", User: "jdoe"},
+		{Time: now.Add(-time.Hour), Repository: "kabanero-io/appsody", User: "bob"},
+		{Time: now, Repository: "kabanero-io/collections", User: "jdoe"},
+	} {
+		auditStore.add(record)
+	}
+	for _, letter := range []*deadLetter{
+		{ID: "01", Time: now, Message: json.RawMessage(`{"body":{"repository":{"full_name":"kabanero-io/appsody"},"sender":{"login":"bob"}}}`)},
+		{ID: "02", Time: now, Message: json.RawMessage(`{"body":{"repository":{"full_name":"kabanero-io/appsody"},"head_commit":{"author":{"email":"JDoe@example.com"}}}}`)},
+	} {
+		data, _ := json.Marshal(letter)
+		if err := writeDeadLetter(letter.ID, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purge := func(query string) (int, *purgeResult) {
+		recorder := httptest.NewRecorder()
+		adminEventsHandler(recorder, httptest.NewRequest(http.MethodDelete, "/admin/events?"+query, nil))
+		result := &purgeResult{}
+		json.Unmarshal(recorder.Body.Bytes(), result)
+		return recorder.Code, result
+	}
+
+	/* a purge must select the events */
+	if code, _ := purge(""); code != http.StatusBadRequest {
+		t.Fatalf("purge of everything returned %v", code)
+	}
+
+	if code, result := purge("user=jdoe@example.com"); code != http.StatusOK || result.AuditRecords != 0 || result.DeadLetters != 1 {
+		t.Fatalf("purge by email returned %v: %+v", code, result)
+	}
+	if code, result := purge("user=jdoe&until=30m"); code != http.StatusOK || result.AuditRecords != 1 || result.DeadLetters != 0 {
+		t.Fatalf("purge by user and time returned %v: %+v", code, result)
+	}
+	if code, result := purge("repository=kabanero-io/appsody"); code != http.StatusOK || result.AuditRecords != 1 || result.DeadLetters != 1 {
+		t.Fatalf("purge by repository returned %v: %+v", code, result)
+	}
+	records, _ := auditStore.query(auditQuery{})
+	letters, _ := listDeadLetters()
+	if len(records) != 1 || records[0].Repository != "kabanero-io/collections" || len(letters) != 0 {
+		t.Fatalf("unexpected records %v and dead letters %v left", records, letters)
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+)
+
+/*
+Rate limiting of the creation of resources. A burst of events, such as a push to many repositories at once, could
+otherwise create hundreds of PipelineRuns at once and get the API server to throttle all of its clients. Resources are
+created at most at the configured rate, smoothing out bursts. When resources are waiting to be created, those of
+interactive evaluations, such as dead letters replayed or events backfilled through the admin API, are created before
+those of events.
+*/
+
+/* priorities of resource creation */
+const (
+	priorityBulk        = 0
+	priorityInteractive = 1
+	numPriorities       = 2
+)
+
+var (
+	createRate    float64          // resources created per second. Unlimited if 0
+	createBurst   int              // number of resources that may be created at once
+	createLimiter *priorityLimiter // nil if unlimited
+)
+
+/* A token bucket whose tokens go to the waiters of the highest priority first */
+type priorityLimiter struct {
+	limiter *rate.Limiter
+	mutex   sync.Mutex
+	queues  [numPriorities][]chan struct{} // waiters by priority, in order of arrival. A channel is closed when granted a token
+	wake    chan struct{}
+}
+
+func newPriorityLimiter(limit float64, burst int) *priorityLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	pl := &priorityLimiter{limiter: rate.NewLimiter(rate.Limit(limit), burst), wake: make(chan struct{}, 1)}
+	go pl.dispatch()
+	return pl
+}
+
+/* Wait until a token is granted, or the context is done */
+func (pl *priorityLimiter) wait(ctx context.Context, priority int) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	granted := make(chan struct{})
+	pl.mutex.Lock()
+	pl.queues[priority] = append(pl.queues[priority], granted)
+	pl.mutex.Unlock()
+	select {
+	case pl.wake <- struct{}{}:
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case <-granted:
+		metrics.Add("createLimiter.waitMillis", time.Since(start).Nanoseconds()/int64(time.Millisecond))
+		return nil
+	case <-ctx.Done():
+		pl.mutex.Lock()
+		defer pl.mutex.Unlock()
+		queue := pl.queues[priority]
+		for index, waiter := range queue {
+			if waiter == granted {
+				pl.queues[priority] = append(queue[:index], queue[index+1:]...)
+				break
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+/* Remove the first waiter of the highest priority, or return nil if there are none */
+func (pl *priorityLimiter) next() chan struct{} {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	for priority := numPriorities - 1; priority >= 0; priority-- {
+		if len(pl.queues[priority]) > 0 {
+			waiter := pl.queues[priority][0]
+			pl.queues[priority] = pl.queues[priority][1:]
+			return waiter
+		}
+	}
+	return nil
+}
+
+/* Return whether there are waiters */
+func (pl *priorityLimiter) waiting() bool {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	for _, queue := range pl.queues {
+		if len(queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/* Grant tokens as they become available. The waiter is chosen once a token is available, so that late waiters of a higher priority go first. */
+func (pl *priorityLimiter) dispatch() {
+	for {
+		if !pl.waiting() {
+			<-pl.wake
+			continue
+		}
+		pl.limiter.Wait(context.Background())
+		if waiter := pl.next(); waiter != nil {
+			close(waiter)
+		}
+	}
+}
+
+/* Return whether a message was requested by a user, such as a replayed or backfilled event */
+func messageInteractive(message map[string]interface{}) bool {
+	interactive, _ := message[INTERACTIVE].(bool)
+	return interactive
+}
+
+/* Wait for permission to create a resource */
+func waitToCreate(action *resourceAction) error {
+	if createLimiter == nil {
+		return nil
+	}
+	return createLimiter.wait(action.ctx, action.priority)
+}
+
+/* Create the limiter of resource creation from the flags */
+func initializeCreateLimiter() {
+	if createRate > 0 {
+		createLimiter = newPriorityLimiter(createRate, createBurst)
+	}
+}
+
+/*
+Throttling of webhook requests. Besides the global -webhookRate, requests are limited per client address with
+-webhookSourceRate by the rateLimit middleware, and events per repository with -webhookRepositoryRate once their body
+is decoded, so that a runaway sender, such as a CI bot pushing to a repository in a loop, is throttled without
+rejecting the events of the other repositories. Rejected requests get 429 Too Many Requests with a Retry-After header.
+The buckets of idle keys are forgotten, since they would be full again.
+*/
+
+const (
+	maxKeyedLimiters   = 10000            // buckets kept per limiter, the least recently used are forgotten beyond
+	keyedLimiterIdle   = 10 * time.Minute // buckets unused for this long are forgotten
+	keyedLimiterSweeps = time.Minute      // interval of the sweeps of idle buckets
+)
+
+var (
+	webhookSourceRate      float64 // webhook requests per second per client address. Unlimited if 0
+	webhookSourceBurst     int     // burst of webhook requests per client address
+	webhookRepositoryRate  float64 // webhook events per second per repository. Unlimited if 0
+	webhookRepositoryBurst int     // burst of webhook events per repository
+
+	repositoryLimiters     *keyedLimiters
+	repositoryLimitersOnce sync.Once
+)
+
+/* The token buckets of keys, such as client addresses */
+type keyedLimiters struct {
+	limit     rate.Limit
+	burst     int
+	mutex     sync.Mutex
+	buckets   map[string]*keyedBucket
+	lastSweep time.Time
+}
+
+type keyedBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+func newKeyedLimiters(limit float64, burst int) *keyedLimiters {
+	if burst < 1 {
+		burst = 1
+	}
+	return &keyedLimiters{limit: rate.Limit(limit), burst: burst, buckets: make(map[string]*keyedBucket)}
+}
+
+/* Take a token of the bucket of a key. Returns false, and when to retry, if the bucket is empty */
+func (kl *keyedLimiters) allow(key string, now time.Time) (bool, time.Duration) {
+	kl.mutex.Lock()
+	defer kl.mutex.Unlock()
+	bucket, ok := kl.buckets[key]
+	if !ok {
+		if now.Sub(kl.lastSweep) > keyedLimiterSweeps || len(kl.buckets) >= maxKeyedLimiters {
+			kl.sweep(now)
+		}
+		bucket = &keyedBucket{limiter: rate.NewLimiter(kl.limit, kl.burst)}
+		kl.buckets[key] = bucket
+	}
+	bucket.lastUsed = now
+	return allowAt(bucket.limiter, now)
+}
+
+/* Forget idle buckets, and the least recently used if there are still too many */
+func (kl *keyedLimiters) sweep(now time.Time) {
+	kl.lastSweep = now
+	var oldestKey string
+	var oldest time.Time
+	for key, bucket := range kl.buckets {
+		if now.Sub(bucket.lastUsed) > keyedLimiterIdle {
+			delete(kl.buckets, key)
+		} else if oldestKey == "" || bucket.lastUsed.Before(oldest) {
+			oldestKey, oldest = key, bucket.lastUsed
+		}
+	}
+	if len(kl.buckets) >= maxKeyedLimiters {
+		delete(kl.buckets, oldestKey)
+	}
+}
+
+/* Take a token of a bucket. Returns false, and when to retry, if it is empty */
+func allowAt(limiter *rate.Limiter, now time.Time) (bool, time.Duration) {
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return true, 0
+	}
+	/* the token is not taken from the bucket of a rejected request */
+	reservation.CancelAt(now)
+	return false, delay
+}
+
+/* Reject a request with 429 Too Many Requests, telling the sender when to retry */
+func rejectRateLimited(writer http.ResponseWriter, req *http.Request, retryAfter time.Duration, message string) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeError(writer, req, codeTooManyRequests, message)
+}
+
+/*
+Throttle the events of the repository of a decoded webhook body. Returns false, after writing the 429 response, if the
+repository exceeds -webhookRepositoryRate.
+*/
+func allowRepositoryEvent(writer http.ResponseWriter, req *http.Request, body map[string]interface{}) bool {
+	repositoryLimitersOnce.Do(func() {
+		if webhookRepositoryRate > 0 {
+			repositoryLimiters = newKeyedLimiters(webhookRepositoryRate, webhookRepositoryBurst)
+		}
+	})
+	if repositoryLimiters == nil {
+		return true
+	}
+	repository := messageRepositoryURL(map[string]interface{}{BODY: body})
+	if repository == "" {
+		return true
+	}
+	allowed, retryAfter := repositoryLimiters.allow(repository, time.Now())
+	if !allowed {
+		incrementMetric("http." + metricRoute(req) + ".repositoryRateLimited")
+		if klog.V(2) {
+			klog.Infof("Throttled event of repository %v from %v", repository, clientIP(req))
+		}
+		rejectRateLimited(writer, req, retryAfter, "too many events for repository "+repository)
+	}
+	return allowed
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityLimiter(t *testing.T) {
+	pl := newPriorityLimiter(20, 1)
+
+	/* use the initial token so that the waiters below queue up */
+	if err := pl.wait(context.Background(), priorityBulk); err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	order := make([]int, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pl.wait(context.Background(), priorityBulk)
+			mutex.Lock()
+			order = append(order, priorityBulk)
+			mutex.Unlock()
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pl.wait(context.Background(), priorityInteractive)
+		mutex.Lock()
+		order = append(order, priorityInteractive)
+		mutex.Unlock()
+	}()
+	wg.Wait()
+
+	/* the interactive waiter arrived last, but at most one bulk waiter was granted a token before it */
+	position := -1
+	for index, priority := range order {
+		if priority == priorityInteractive {
+			position = index
+		}
+	}
+	if position < 0 || position > 1 {
+		t.Fatalf("interactive waiter not given priority: %v", order)
+	}
+
+	/* a waiter gives up when its context is done */
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	pl.wait(context.Background(), priorityBulk)
+	if err := pl.wait(ctx, priorityBulk); err == nil {
+		t.Fatal("expected error waiting with an expired context")
+	}
+}
+
+func TestKeyedLimiters(t *testing.T) {
+	kl := newKeyedLimiters(1, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if allowed, _ := kl.allow("10.0.0.1", now); !allowed {
+			t.Fatalf("request %v of the burst was rejected", i)
+		}
+	}
+	allowed, retryAfter := kl.allow("10.0.0.1", now)
+	if allowed || retryAfter <= 0 || retryAfter > time.Second {
+		t.Fatalf("request beyond the burst returned %v, retry after %v", allowed, retryAfter)
+	}
+	/* the other keys have their own bucket */
+	if allowed, _ := kl.allow("10.0.0.2", now); !allowed {
+		t.Fatal("request of another key was rejected")
+	}
+	/* a rejected request does not take a token */
+	if allowed, _ := kl.allow("10.0.0.1", now.Add(time.Second)); !allowed {
+		t.Fatal("request after the refill was rejected")
+	}
+
+	kl.allow("10.0.0.3", now.Add(keyedLimiterIdle+2*time.Minute))
+	if _, ok := kl.buckets["10.0.0.2"]; ok || len(kl.buckets) != 1 {
+		t.Fatalf("idle buckets were not forgotten: %v", kl.buckets)
+	}
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	savedRate, savedBurst := webhookSourceRate, webhookSourceBurst
+	defer func() { webhookSourceRate, webhookSourceBurst = savedRate, savedBurst }()
+	webhookSourceRate, webhookSourceBurst = 0.001, 1
+
+	handler := rateLimitMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+	send := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+		req.RemoteAddr = addr
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+	if recorder := send("10.0.0.1:1234"); recorder.Code != http.StatusOK {
+		t.Fatalf("first request returned %v", recorder.Code)
+	}
+	recorder := send("10.0.0.1:5678")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("request beyond the burst returned %v, Retry-After %v", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if recorder := send("10.0.0.2:1234"); recorder.Code != http.StatusOK {
+		t.Fatalf("request of another client returned %v", recorder.Code)
+	}
+}
+
+func TestAllowRepositoryEvent(t *testing.T) {
+	savedRate, savedBurst, savedLimiters := webhookRepositoryRate, webhookRepositoryBurst, repositoryLimiters
+	defer func() {
+		webhookRepositoryRate, webhookRepositoryBurst, repositoryLimiters = savedRate, savedBurst, savedLimiters
+		repositoryLimitersOnce = sync.Once{}
+	}()
+	webhookRepositoryRate, webhookRepositoryBurst = 0.001, 1
+	repositoryLimitersOnce = sync.Once{}
+
+	body := func(url string) map[string]interface{} {
+		return map[string]interface{}{"repository": map[string]interface{}{"html_url": url}}
+	}
+	allow := func(body map[string]interface{}) (*httptest.ResponseRecorder, bool) {
+		recorder := httptest.NewRecorder()
+		return recorder, allowRepositoryEvent(recorder, httptest.NewRequest(http.MethodPost, "/webhook", nil), body)
+	}
+	if _, ok := allow(body("https://github.com/org/busy")); !ok {
+		t.Fatal("first event was throttled")
+	}
+	recorder, ok := allow(body("https://github.com/org/busy"))
+	if ok || recorder.Code != http.StatusTooManyRequests || !strings.Contains(recorder.Body.String(), "org/busy") {
+		t.Fatalf("event beyond the burst returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+	if _, ok := allow(body("https://github.com/org/quiet")); !ok {
+		t.Fatal("event of another repository was throttled")
+	}
+	/* events without a repository are not throttled */
+	if _, ok := allow(map[string]interface{}{}); !ok {
+		t.Fatal("event without a repository was throttled")
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// The Redis provider sends and receives messages through Redis Streams. Messages are added to the stream named after
+// the topic of an event destination with XADD, trimmed to about redis.maxLen entries if set. Event sources are
+// received by the consumer group of the provider with XREADGROUP, so that instances of kabanero-events in the same
+// group share the messages of a stream. Messages are acknowledged with XACK once they are processed, and the messages
+// a consumer received but did not acknowledge, such as before a restart, are delivered again when it starts listening.
+// The Redis protocol is spoken directly, over TCP, or TLS for rediss:// URLs.
+
+const (
+	defaultRedisTimeout  = 5 * time.Second
+	defaultRedisGroup    = "kabanero-events"
+	redisMessageField    = "data"
+	redisBusyGroupPrefix = "BUSYGROUP"
+)
+
+// An error returned by Redis.
+type redisError string
+
+func (err redisError) Error() string {
+	return string(err)
+}
+
+// A connection to Redis.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// An entry of a stream.
+type redisStreamEntry struct {
+	id   string
+	data []byte
+}
+
+type redisProvider struct {
+	messageProviderDefinition *MessageProviderDefinition
+	address                   string
+	tlsConfig                 *tls.Config // nil without TLS
+	username                  string
+	password                  string
+	db                        int
+	consumer                  string
+	mutex                     sync.Mutex
+	conn                      *redisConn      // connection of the commands that do not block
+	groups                    map[string]bool // streams whose consumer group exists, by eventSource
+}
+
+func (provider *redisProvider) initialize(mpd *MessageProviderDefinition) error {
+	provider.messageProviderDefinition = mpd
+	provider.groups = make(map[string]bool)
+	parsed, err := url.Parse(mpd.URL)
+	if err != nil || (parsed.Scheme != "redis" && parsed.Scheme != "rediss") || parsed.Host == "" {
+		return fmt.Errorf("url '%s' of Redis provider '%s' is not a redis:// or rediss:// URL", redactURL(mpd.URL), mpd.Name)
+	}
+	provider.address = parsed.Host
+	if parsed.Port() == "" {
+		provider.address = net.JoinHostPort(parsed.Hostname(), "6379")
+	}
+	if db := strings.Trim(parsed.Path, "/"); db != "" {
+		if provider.db, err = strconv.Atoi(db); err != nil {
+			return fmt.Errorf("database '%s' of Redis provider '%s' is not a number", db, mpd.Name)
+		}
+	}
+	if parsed.User != nil {
+		provider.username = parsed.User.Username()
+		provider.password, _ = parsed.User.Password()
+		if provider.password == "" {
+			/* redis://:password@host has the password in place of the user */
+			provider.password, provider.username = provider.username, ""
+		}
+	}
+	if mpd.Username != "" {
+		provider.username = mpd.Username
+	}
+	if mpd.PasswordEnv != "" {
+		provider.password = os.Getenv(mpd.PasswordEnv)
+	}
+	if mpd.Redis != nil && mpd.Redis.MaxLen < 0 {
+		return fmt.Errorf("redis maxLen of Redis provider '%s' is negative", mpd.Name)
+	}
+
+	if parsed.Scheme == "rediss" {
+		provider.tlsConfig = &tls.Config{InsecureSkipVerify: mpd.SkipTLSVerify, ServerName: parsed.Hostname()}
+		if mpd.CAFile != "" {
+			caCert, err := ioutil.ReadFile(mpd.CAFile)
+			if err != nil {
+				return fmt.Errorf("unable to read the CA certificate of Redis provider '%s': %v", mpd.Name, err)
+			}
+			provider.tlsConfig.RootCAs = x509.NewCertPool()
+			if !provider.tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+				return fmt.Errorf("no certificates found in %s for Redis provider '%s'", mpd.CAFile, mpd.Name)
+			}
+		}
+		if mpd.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(mpd.CertFile, mpd.KeyFile)
+			if err != nil {
+				return fmt.Errorf("unable to load the client certificate of Redis provider '%s': %v", mpd.Name, err)
+			}
+			provider.tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if mpd.Redis != nil {
+		provider.consumer = mpd.Redis.Consumer
+	}
+	if provider.consumer == "" {
+		provider.consumer, _ = os.Hostname()
+	}
+	if provider.consumer == "" {
+		provider.consumer = newRequestID()
+	}
+	return nil
+}
+
+func (provider *redisProvider) timeout() time.Duration {
+	if provider.messageProviderDefinition.Timeout > 0 {
+		return provider.messageProviderDefinition.Timeout
+	}
+	return defaultRedisTimeout
+}
+
+func (provider *redisProvider) group() string {
+	if provider.messageProviderDefinition.ConsumerGroup != "" {
+		return provider.messageProviderDefinition.ConsumerGroup
+	}
+	return defaultRedisGroup
+}
+
+// Open a connection, authenticated and on the database of the provider.
+func (provider *redisProvider) dial() (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: provider.timeout()}
+	var conn net.Conn
+	var err error
+	if provider.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", provider.address, provider.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", provider.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to Redis provider '%s': %v", provider.messageProviderDefinition.Name, err)
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if provider.password != "" {
+		args := []string{"AUTH", provider.password}
+		if provider.username != "" {
+			args = []string{"AUTH", provider.username, provider.password}
+		}
+		if _, err = rc.do(provider.timeout(), args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to authenticate to Redis provider '%s': %v", provider.messageProviderDefinition.Name, err)
+		}
+	}
+	if provider.db != 0 {
+		if _, err = rc.do(provider.timeout(), "SELECT", strconv.Itoa(provider.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to select database %d of Redis provider '%s': %v", provider.db, provider.messageProviderDefinition.Name, err)
+		}
+	}
+	return rc, nil
+}
+
+// Send a command on the shared connection, opening it again if it was lost.
+func (provider *redisProvider) do(args ...string) (interface{}, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.conn == nil {
+		conn, err := provider.dial()
+		if err != nil {
+			return nil, err
+		}
+		provider.conn = conn
+	}
+	reply, err := provider.conn.do(provider.timeout(), args...)
+	if _, isRedisError := err.(redisError); err != nil && !isRedisError {
+		/* the connection is in an unknown state after an I/O error */
+		provider.conn.conn.Close()
+		provider.conn = nil
+	}
+	return reply, err
+}
+
+// Send a command, and read its reply within a timeout.
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rc.reader)
+}
+
+// Read a reply of the Redis protocol: a string, an error, an integer, bulk bytes, or an array of replies. Nil bulk
+// strings and arrays are nil.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid Redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(value)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		array := make([]interface{}, count)
+		for index := range array {
+			if array[index], err = readRedisReply(reader); err != nil {
+				if _, isRedisError := err.(redisError); !isRedisError {
+					return nil, err
+				}
+				array[index] = err
+			}
+		}
+		return array, nil
+	}
+	return nil, fmt.Errorf("invalid Redis reply %q", line)
+}
+
+// Return the entries of the reply of XREADGROUP. Entries deleted from the stream while pending have no fields.
+func redisStreamEntries(reply interface{}) ([]redisStreamEntry, error) {
+	entries := make([]redisStreamEntry, 0)
+	streams, ok := reply.([]interface{})
+	if reply == nil {
+		return entries, nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %v of XREADGROUP", reply)
+	}
+	for _, streamObj := range streams {
+		stream, ok := streamObj.([]interface{})
+		if !ok || len(stream) != 2 {
+			return nil, fmt.Errorf("unexpected stream %v of XREADGROUP", streamObj)
+		}
+		messages, _ := stream[1].([]interface{})
+		for _, messageObj := range messages {
+			message, ok := messageObj.([]interface{})
+			if !ok || len(message) != 2 {
+				return nil, fmt.Errorf("unexpected entry %v of XREADGROUP", messageObj)
+			}
+			id, _ := message[0].([]byte)
+			entry := redisStreamEntry{id: string(id)}
+			fields, _ := message[1].([]interface{})
+			for index := 0; index+1 < len(fields); index += 2 {
+				if name, _ := fields[index].([]byte); string(name) == redisMessageField {
+					entry.data, _ = fields[index+1].([]byte)
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// Subscribe to an eventSource by creating the consumer group of the provider on its stream, if it does not exist yet.
+func (provider *redisProvider) Subscribe(node *EventNode) error {
+	provider.mutex.Lock()
+	subscribed := provider.groups[node.Name]
+	provider.mutex.Unlock()
+	if subscribed {
+		return nil
+	}
+	/* a new group receives the messages added from now on */
+	_, err := provider.do("XGROUP", "CREATE", node.Topic, provider.group(), "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), redisBusyGroupPrefix) {
+		return fmt.Errorf("unable to create consumer group %s of stream %s of Redis provider '%s': %v", provider.group(), node.Topic,
+			provider.messageProviderDefinition.Name, err)
+	}
+	if klog.V(6) {
+		klog.Infof("Subscribed to Redis stream %s with consumer group %s as %s", node.Topic, provider.group(), provider.consumer)
+	}
+	provider.mutex.Lock()
+	provider.groups[node.Name] = true
+	provider.mutex.Unlock()
+	return nil
+}
+
+// Send a message to the stream of an eventDestination.
+func (provider *redisProvider) Send(node *EventNode, payload []byte, header interface{}) error {
+	if klog.V(6) {
+		klog.Infof("redisProvider: Sending %s", string(payload))
+	}
+	args := []string{"XADD", node.Topic}
+	if redis := provider.messageProviderDefinition.Redis; redis != nil && redis.MaxLen > 0 {
+		/* trimming to about maxLen entries is much cheaper than to exactly maxLen */
+		args = append(args, "MAXLEN", "~", strconv.FormatInt(redis.MaxLen, 10))
+	}
+	args = append(args, "*", redisMessageField, string(payload))
+	reply, err := provider.do(args...)
+	if err != nil {
+		return fmt.Errorf("redisProvider Send to %v failed: %v", node.Topic, err)
+	}
+	if klog.V(8) {
+		klog.Infof("redisProvider: message added to stream %s as %s", node.Topic, reply)
+	}
+	return nil
+}
+
+// Read the next entries of the consumer of the provider on a connection: the pending ones from id 0, or new ones
+// from id >, waiting for up to block for new ones.
+func (provider *redisProvider) read(rc *redisConn, node *EventNode, id string, block time.Duration) ([]redisStreamEntry, error) {
+	reply, err := rc.do(block+provider.timeout(), "XREADGROUP", "GROUP", provider.group(), provider.consumer, "COUNT", "1",
+		"BLOCK", strconv.FormatInt(int64(block/time.Millisecond), 10), "STREAMS", node.Topic, id)
+	if err != nil {
+		return nil, err
+	}
+	return redisStreamEntries(reply)
+}
+
+// Acknowledge an entry of the stream of an eventSource.
+func (provider *redisProvider) ack(rc *redisConn, node *EventNode, id string) {
+	if _, err := rc.do(provider.timeout(), "XACK", node.Topic, provider.group(), id); err != nil {
+		klog.Errorf("Unable to acknowledge Redis message %s of eventSource '%s': %v", id, node.Name, err)
+	}
+}
+
+// Receive a message from an eventSource, acknowledging it at once.
+func (provider *redisProvider) Receive(node *EventNode) ([]byte, error) {
+	provider.mutex.Lock()
+	subscribed := provider.groups[node.Name]
+	provider.mutex.Unlock()
+	if !subscribed {
+		return nil, fmt.Errorf("no subscription for eventSource '%s'. It should be defined and Subscribed to", node.Name)
+	}
+	/* a blocking read would hold the shared connection */
+	rc, err := provider.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.conn.Close()
+	entries, err := provider.read(rc, node, ">", provider.timeout())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("redisProvider: timed out receiving from stream %s", node.Topic)
+	}
+	provider.ack(rc, node, entries[0].id)
+	return entries[0].data, nil
+}
+
+// ListenAndServe listens for new events on some eventSource and calls the ReceiverFunc on the message payload.
+// Messages are acknowledged once the ReceiverFunc returns. The messages received but not acknowledged before are
+// delivered first.
+func (provider *redisProvider) ListenAndServe(node *EventNode, receiver ReceiverFunc) {
+	if klog.V(5) {
+		klog.Infof("redisProvider: Starting to listen for events of stream %s", node.Topic)
+	}
+	var rc *redisConn
+	pending := true
+	for {
+		if rc == nil {
+			err := provider.Subscribe(node)
+			if err == nil {
+				rc, err = provider.dial()
+			}
+			if err != nil {
+				klog.Error(err)
+				time.Sleep(provider.timeout())
+				continue
+			}
+		}
+		id := ">"
+		if pending {
+			id = "0"
+		}
+		entries, err := provider.read(rc, node, id, provider.timeout())
+		if err != nil {
+			klog.Errorf("Unable to receive Redis messages of eventSource '%s': %v", node.Name, err)
+			rc.conn.Close()
+			rc = nil
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				/* the stream or its group was deleted */
+				provider.mutex.Lock()
+				delete(provider.groups, node.Name)
+				provider.mutex.Unlock()
+			}
+			time.Sleep(provider.timeout())
+			continue
+		}
+		if pending && len(entries) == 0 {
+			pending = false
+			continue
+		}
+		for _, entry := range entries {
+			if entry.data != nil {
+				if klog.V(8) {
+					klog.Infof("Received message on stream %s: %s", node.Topic, entry.data)
+				}
+				receiver(entry.data)
+			}
+			provider.ack(rc, node, entry.id)
+		}
+	}
+}
+
+func init() {
+	RegisterMessageProvider("redis", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newRedisProvider(mpd)
+	})
+}
+
+func newRedisProvider(mpd *MessageProviderDefinition) (*redisProvider, error) {
+	provider := new(redisProvider)
+	if err := provider.initialize(mpd); err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* An in-memory Redis server supporting the commands of the Redis provider, for one stream and consumer group */
+type fakeRedis struct {
+	listener  net.Listener
+	password  string
+	mutex     sync.Mutex
+	entries   [][2]string     // id and data of the entries of the stream
+	delivered int             // entries delivered to the group
+	pending   map[string]bool // ids of the entries delivered but not acknowledged
+	group     bool
+	commands  []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{listener: listener, password: password, pending: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := server.password == ""
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		args := make([]string, 0)
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		if args[0] == "AUTH" {
+			authenticated = args[len(args)-1] == server.password
+			if !authenticated {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+			continue
+		}
+		if !authenticated {
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		fmt.Fprint(conn, server.execute(args))
+	}
+}
+
+/* Return the reply of an array of entries of the stream, as returned by XREADGROUP */
+func redisEntriesReply(stream string, entries [][2]string) string {
+	reply := fmt.Sprintf("*1\r\n*2\r\n$%d\r\n%s\r\n*%d\r\n", len(stream), stream, len(entries))
+	for _, entry := range entries {
+		reply += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n*2\r\n$4\r\ndata\r\n$%d\r\n%s\r\n", len(entry[0]), entry[0], len(entry[1]), entry[1])
+	}
+	return reply
+}
+
+func (server *fakeRedis) execute(args []string) string {
+	server.mutex.Lock()
+	server.commands = append(server.commands, strings.Join(args, " "))
+	switch args[0] {
+	case "SELECT":
+		server.mutex.Unlock()
+		return "+OK\r\n"
+	case "XGROUP":
+		defer server.mutex.Unlock()
+		if server.group {
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+		}
+		server.group = true
+		server.delivered = len(server.entries)
+		return "+OK\r\n"
+	case "XADD":
+		defer server.mutex.Unlock()
+		id := fmt.Sprintf("%d-0", len(server.entries)+1)
+		server.entries = append(server.entries, [2]string{id, args[len(args)-1]})
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(id), id)
+	case "XACK":
+		defer server.mutex.Unlock()
+		delete(server.pending, args[3])
+		return ":1\r\n"
+	case "XREADGROUP":
+		stream, id := args[len(args)-2], args[len(args)-1]
+		if id == "0" {
+			defer server.mutex.Unlock()
+			for _, entry := range server.entries {
+				if server.pending[entry[0]] {
+					return redisEntriesReply(stream, [][2]string{entry})
+				}
+			}
+			return redisEntriesReply(stream, nil)
+		}
+		for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+			if server.delivered < len(server.entries) {
+				entry := server.entries[server.delivered]
+				server.delivered++
+				server.pending[entry[0]] = true
+				server.mutex.Unlock()
+				return redisEntriesReply(stream, [][2]string{entry})
+			}
+			server.mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			server.mutex.Lock()
+		}
+		server.mutex.Unlock()
+		return "*-1\r\n"
+	}
+	server.mutex.Unlock()
+	return "-ERR unknown command\r\n"
+}
+
+func TestReadRedisReply(t *testing.T) {
+	reply, err := readRedisReply(bufio.NewReader(strings.NewReader("*4\r\n+OK\r\n:42\r\n$5\r\nhello\r\n$-1\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	array := reply.([]interface{})
+	if array[0] != "OK" || array[1] != int64(42) || string(array[2].([]byte)) != "hello" || array[3] != nil {
+		t.Fatalf("unexpected reply %v", reply)
+	}
+	if _, err = readRedisReply(bufio.NewReader(strings.NewReader("-ERR wrong\r\n"))); err == nil || err.Error() != "ERR wrong" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if reply, err = readRedisReply(bufio.NewReader(strings.NewReader("*-1\r\n"))); reply != nil || err != nil {
+		t.Fatalf("unexpected nil array %v: %v", reply, err)
+	}
+	if _, err = readRedisReply(bufio.NewReader(strings.NewReader("?\r\n"))); err == nil {
+		t.Fatal("expected an error reading an invalid reply")
+	}
+}
+
+func TestRedisProviderValidation(t *testing.T) {
+	for _, mpd := range []*MessageProviderDefinition{
+		{Name: "redis", URL: "nats://127.0.0.1:4222"},
+		{Name: "redis", URL: "redis://127.0.0.1:6379/first"},
+		{Name: "redis", URL: "redis://127.0.0.1", Redis: &RedisDefinition{MaxLen: -1}},
+		{Name: "redis", URL: "rediss://127.0.0.1", CAFile: "test_data/missing.crt"},
+	} {
+		if _, err := newRedisProvider(mpd); err == nil {
+			t.Errorf("provider %+v was accepted", mpd)
+		}
+	}
+	provider, err := newRedisProvider(&MessageProviderDefinition{Name: "redis", URL: "redis://:secret@redis/2"})
+	if err != nil || provider.address != "redis:6379" || provider.password != "secret" || provider.username != "" || provider.db != 2 {
+		t.Fatalf("unexpected provider %+v: %v", provider, err)
+	}
+}
+
+func TestRedisProvider(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.listener.Close()
+	provider, err := newRedisProvider(&MessageProviderDefinition{Name: "redis", URL: "redis://:secret@" + server.listener.Addr().String() + "/1",
+		Timeout: 100 * time.Millisecond, Redis: &RedisDefinition{MaxLen: 1000, Consumer: "instance-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &EventNode{Name: "github", Topic: "github"}
+	if _, err = provider.Receive(node); err == nil {
+		t.Fatal("expected an error receiving without a subscription")
+	}
+	if err = provider.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+	/* the group already exists when another instance subscribes */
+	other, _ := newRedisProvider(provider.messageProviderDefinition)
+	if err = other.Subscribe(node); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []string{`{"id":1}`, `{"id":2}`} {
+		if err = provider.Send(node, []byte(message), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if commands := strings.Join(server.commands, "\n"); !strings.Contains(commands, "SELECT 1") || !strings.Contains(commands, "XADD github MAXLEN ~ 1000 * data") {
+		t.Fatalf("unexpected commands %s", commands)
+	}
+	data, err := provider.Receive(node)
+	if err != nil || string(data) != `{"id":1}` {
+		t.Fatalf("unexpected message %s: %v", data, err)
+	}
+
+	/* a message received by a listener is delivered again after a restart if it was not acknowledged */
+	server.mutex.Lock()
+	server.pending["2-0"], server.delivered = true, 2
+	server.mutex.Unlock()
+	received := make(chan string, 10)
+	go provider.ListenAndServe(node, func(data []byte) { received <- string(data) })
+	if got := <-received; got != `{"id":2}` {
+		t.Fatalf("unexpected pending message %s", got)
+	}
+	provider.Send(node, []byte(`{"id":3}`), nil)
+	select {
+	case got := <-received:
+		if got != `{"id":3}` {
+			t.Fatalf("unexpected message %s", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	waitFor(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.pending) == 0
+	})
+
+	wrong, _ := newRedisProvider(&MessageProviderDefinition{Name: "redis", URL: "redis://:wrong@" + server.listener.Addr().String(), Timeout: 100 * time.Millisecond})
+	if err = wrong.Send(node, []byte("{}"), nil); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("unexpected error sending with a wrong password: %v", err)
+	}
+}
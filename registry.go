@@ -0,0 +1,255 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/*
+Container registry webhooks. The image push notifications of Docker Hub, Quay, and Harbor received on /registry are
+normalized into one event per pushed tag, with the pushed image in the image field of the body, whatever the
+registry: its registry, repository, tag, digest, and the full reference of the image, so that triggers may start
+pipelines on new images, such as the updates of base images, with the same expressions for every registry. The
+registry is recognized from the payload, whose fields are kept, and the events are of the image-push kind.
+*/
+
+const (
+	REGISTRYTOKEN = "REGISTRY_TOKEN" // environment variable containing the token of container registry webhook requests
+
+	defaultRegistryMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,contentType,rateLimit,registryAuth"
+
+	registryDockerHub = "dockerhub"
+	registryQuay      = "quay"
+	registryHarbor    = "harbor"
+
+	dockerHubRegistry = "docker.io"
+	quayRegistry      = "quay.io"
+)
+
+var registryMiddleware string // comma separated middleware chain of the container registry webhook endpoint
+
+/*
+Middleware verifying the token of container registry webhook requests against the token in the environment variable
+REGISTRY_TOKEN: the Authorization header, set with the auth header of Harbor webhooks, or the token query parameter,
+for Docker Hub and Quay, whose webhooks do not have headers. Requests are not verified if the variable is not set.
+*/
+func registryAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		token := os.Getenv(REGISTRYTOKEN)
+		if token == "" {
+			next.ServeHTTP(writer, req)
+			return
+		}
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if queryToken := req.URL.Query().Get("token"); queryToken != "" {
+			given = queryToken
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			incrementMetric("http." + metricRoute(req) + ".unauthorized")
+			writeError(writer, req, codeInvalidToken, "invalid token")
+			return
+		}
+		next.ServeHTTP(writer, req)
+	})
+}
+
+/* HTTP listener of container registry webhooks */
+func registryListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	bodyMap, ok := readWebhookBody(writer, req)
+	if !ok {
+		return
+	}
+	header, bodies, err := normalizeRegistryEvent(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process container registry webhook: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	for _, body := range bodies {
+		/* each event of a notification of several tags has its own ID */
+		eventHeader := make(http.Header)
+		for key, values := range header {
+			eventHeader[key] = values
+		}
+		logReceivedEvent(assignEventID(eventHeader), "Registry listener received event", req.URL.Path, eventHeader, body)
+		if err = sendWebhookMessage(eventHeader, body); err != nil {
+			break
+		}
+	}
+	respondWebhook(writer, req, err)
+}
+
+/* Return the registry that sent an image push notification, empty if it is not one */
+func registrySource(body map[string]interface{}) string {
+	if _, ok := body["push_data"]; ok {
+		return registryDockerHub
+	}
+	if _, ok := body["updated_tags"]; ok {
+		return registryQuay
+	}
+	if harborType, _ := body["type"].(string); harborType == "PUSH_ARTIFACT" || harborType == "pushImage" {
+		return registryHarbor
+	}
+	return ""
+}
+
+/* Normalize an image push notification into one event per pushed tag, returning their header and bodies */
+func normalizeRegistryEvent(registryHeader http.Header, body map[string]interface{}) (http.Header, []map[string]interface{}, error) {
+	source := registrySource(body)
+	var images []map[string]interface{}
+	switch source {
+	case registryDockerHub:
+		images = dockerHubImages(body)
+	case registryQuay:
+		images = quayImages(body)
+	case registryHarbor:
+		images = harborImages(body)
+	default:
+		return nil, nil, fmt.Errorf("unsupported container registry notification")
+	}
+	if len(images) == 0 {
+		return nil, nil, fmt.Errorf("%v notification does not contain pushed images", source)
+	}
+
+	header := make(http.Header)
+	for key, values := range registryHeader {
+		if http.CanonicalHeaderKey(key) == "Authorization" {
+			/* secrets are not passed on to triggers */
+			continue
+		}
+		header[key] = values
+	}
+
+	bodies := make([]map[string]interface{}, 0, len(images))
+	for _, image := range images {
+		image["source"] = source
+		image["reference"] = imageReference(image)
+		imageBody := make(map[string]interface{}, len(body)+1)
+		for key, value := range body {
+			imageBody[key] = value
+		}
+		imageBody["image"] = image
+		bodies = append(bodies, imageBody)
+	}
+	return header, bodies, nil
+}
+
+/* Return the full reference of a pushed image: <registry>/<repository>:<tag>, or @<digest> without tag */
+func imageReference(image map[string]interface{}) string {
+	reference := fmt.Sprintf("%v/%v", image["registry"], image["repository"])
+	if tag, _ := image["tag"].(string); tag != "" {
+		return reference + ":" + tag
+	}
+	if digest, _ := image["digest"].(string); digest != "" {
+		return reference + "@" + digest
+	}
+	return reference
+}
+
+/* Return the image pushed to Docker Hub. Docker Hub notifications do not have digests */
+func dockerHubImages(body map[string]interface{}) []map[string]interface{} {
+	pushData, _ := body["push_data"].(map[string]interface{})
+	repository, _ := body["repository"].(map[string]interface{})
+	name, _ := repository["repo_name"].(string)
+	if name == "" || pushData == nil {
+		return nil
+	}
+	if !strings.Contains(name, "/") {
+		/* official images */
+		name = "library/" + name
+	}
+	return []map[string]interface{}{{
+		"registry":   dockerHubRegistry,
+		"repository": name,
+		"tag":        pushData["tag"],
+		"digest":     "",
+		"pusher":     pushData["pusher"],
+	}}
+}
+
+/* Return the images of the tags pushed to Quay. Quay notifications do not have digests */
+func quayImages(body map[string]interface{}) []map[string]interface{} {
+	name, _ := body["repository"].(string)
+	if name == "" {
+		return nil
+	}
+	registry := quayRegistry
+	/* the registry of Quay Enterprise is the host of docker_url */
+	if dockerURL, ok := body["docker_url"].(string); ok {
+		if slash := strings.Index(dockerURL, "/"); slash > 0 {
+			registry = dockerURL[:slash]
+		}
+	}
+	tags, _ := body["updated_tags"].([]interface{})
+	images := make([]map[string]interface{}, 0, len(tags))
+	for _, tag := range tags {
+		images = append(images, map[string]interface{}{
+			"registry":   registry,
+			"repository": name,
+			"tag":        tag,
+			"digest":     "",
+			"pusher":     "",
+		})
+	}
+	return images
+}
+
+/* Return the images of the artifacts pushed to Harbor */
+func harborImages(body map[string]interface{}) []map[string]interface{} {
+	eventData, _ := body["event_data"].(map[string]interface{})
+	repository, _ := eventData["repository"].(map[string]interface{})
+	name, _ := repository["repo_full_name"].(string)
+	resources, _ := eventData["resources"].([]interface{})
+	if name == "" {
+		return nil
+	}
+	images := make([]map[string]interface{}, 0, len(resources))
+	for _, resourceObj := range resources {
+		resource, ok := resourceObj.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		/* the resource URL is <registry>/<repository>:<tag> or <registry>/<repository>@<digest> */
+		registry := ""
+		if resourceURL, ok := resource["resource_url"].(string); ok {
+			if slash := strings.Index(resourceURL, "/"); slash > 0 {
+				registry = resourceURL[:slash]
+			}
+		}
+		tag, _ := resource["tag"].(string)
+		digest, _ := resource["digest"].(string)
+		if tag == digest {
+			/* artifacts pushed by digest have their digest as tag */
+			tag = ""
+		}
+		images = append(images, map[string]interface{}{
+			"registry":   registry,
+			"repository": name,
+			"tag":        tag,
+			"digest":     digest,
+			"pusher":     body["operator"],
+		})
+	}
+	return images
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeRegistryEvent(t *testing.T) {
+	for _, test := range []struct {
+		fileName string
+		images   []map[string]interface{}
+	}{
+		{"test_data/registry0/dockerhub.json", []map[string]interface{}{
+			{"source": registryDockerHub, "registry": "docker.io", "repository": "kabanero/nodejs", "tag": "0.3.1", "digest": "", "pusher": "kabanero-bot", "reference": "docker.io/kabanero/nodejs:0.3.1"},
+		}},
+		{"test_data/registry0/quay.json", []map[string]interface{}{
+			{"source": registryQuay, "registry": "quay.example.com", "repository": "kabanero/nodejs", "tag": "0.3.1", "reference": "quay.example.com/kabanero/nodejs:0.3.1"},
+			{"source": registryQuay, "registry": "quay.example.com", "repository": "kabanero/nodejs", "tag": "latest", "reference": "quay.example.com/kabanero/nodejs:latest"},
+		}},
+		{"test_data/registry0/harbor.json", []map[string]interface{}{
+			{"source": registryHarbor, "registry": "harbor.example.com", "tag": "0.3.1", "digest": "sha256:954b378c375d852eb3c63ab88978f640b4348b01c1b3456a024a81536dafbbf4", "pusher": "robot$kabanero", "reference": "harbor.example.com/kabanero/nodejs:0.3.1"},
+			{"source": registryHarbor, "registry": "harbor.example.com", "tag": "", "reference": "harbor.example.com/kabanero/nodejs@sha256:2a5c1b7e1f1b3e6d9c8a7f6e5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c"},
+		}},
+	} {
+		body := readGitLabEvent(t, test.fileName)
+		header, bodies, err := normalizeRegistryEvent(http.Header{"Authorization": {"Bearer secret"}}, body)
+		if err != nil {
+			t.Fatalf("%v: %v", test.fileName, err)
+		}
+		if header.Get("Authorization") != "" || len(bodies) != len(test.images) {
+			t.Fatalf("%v: unexpected header %v of %v events", test.fileName, header, len(bodies))
+		}
+		for index, expected := range test.images {
+			image := bodies[index]["image"].(map[string]interface{})
+			for key, value := range expected {
+				if image[key] != value {
+					t.Errorf("%v: %v of image %v is %v, expected %v", test.fileName, key, index, image[key], value)
+				}
+			}
+			if eventKind(header, bodies[index]) != eventKindImagePush {
+				t.Errorf("%v: event %v is not an image push", test.fileName, index)
+			}
+		}
+	}
+
+	if _, _, err := normalizeRegistryEvent(http.Header{}, map[string]interface{}{"ref": "refs/heads/master"}); err == nil {
+		t.Fatal("expected error normalizing a notification of an unknown registry")
+	}
+	if _, _, err := normalizeRegistryEvent(http.Header{}, map[string]interface{}{"updated_tags": []interface{}{"latest"}}); err == nil {
+		t.Fatal("expected error normalizing a notification without repository")
+	}
+}
+
+func TestRegistryAuthMiddleware(t *testing.T) {
+	os.Setenv(REGISTRYTOKEN, "secret")
+	defer os.Unsetenv(REGISTRYTOKEN)
+	handler := registryAuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+
+	for _, test := range []struct {
+		target, authorization string
+		expected              int
+	}{
+		{"/registry?token=secret", "", http.StatusOK},
+		{"/registry", "Bearer secret", http.StatusOK},
+		{"/registry", "secret", http.StatusOK},
+		{"/registry?token=wrong", "Bearer secret", http.StatusUnauthorized},
+		{"/registry", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", test.target, strings.NewReader(`{"updated_tags":["latest"]}`))
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("%v with authorization '%v': status %v, expected %v", test.target, test.authorization, recorder.Code, test.expected)
+		}
+	}
+}
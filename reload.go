@@ -0,0 +1,177 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Reloading trigger collections. POST /admin/reload downloads the loaded collections again from their Kabanero indexes,
+or copies them again from their local -triggerDir, and switches to them once all are downloaded and initialized, so
+that a new version of a collection is picked up without restarting kabanero-events. If any collection fails to load,
+none is switched. The triggers disabled through the admin API stay disabled. Listeners are started for the event
+sources that only the reloaded collections have. The directories of the previous collections are removed after a
+delay, once the messages evaluating their triggers are done.
+*/
+
+var (
+	collectionsMutex sync.RWMutex // protects triggerProc, canaryProc and shadowProc once the listeners are started
+	reloadMutex      sync.Mutex   // one reload at a time
+
+	retireCollectionDelay = 10 * time.Minute // delay before removing the directory of a replaced collection
+)
+
+/* A reloaded collection, as reported by the admin API */
+type reloadedCollection struct {
+	Name     string `json:"name"`
+	IndexURL string `json:"indexURL"`
+	Digest   string `json:"digest"`
+	Previous string `json:"previousDigest"`
+	Changed  bool   `json:"changed"`
+	Triggers int    `json:"triggers"`
+}
+
+/* Return the active, canary and shadow collections. The canary and shadow collections are nil if not loaded */
+func currentCollections() (*triggerProcessor, *triggerProcessor, *triggerProcessor) {
+	collectionsMutex.RLock()
+	defer collectionsMutex.RUnlock()
+	return triggerProc, canaryProc, shadowProc
+}
+
+/* Replace a loaded collection, by name */
+func replaceCollection(tp *triggerProcessor) {
+	collectionsMutex.Lock()
+	defer collectionsMutex.Unlock()
+	switch tp.name {
+	case "canary":
+		canaryProc = tp
+	case "shadow":
+		shadowProc = tp
+	default:
+		triggerProc = tp
+	}
+}
+
+/* Keep the triggers disabled in a previous version of a collection disabled, if they still exist */
+func (tp *triggerProcessor) copyDisabledTriggers(previous *triggerProcessor) {
+	previous.disabledMutex.RLock()
+	defer previous.disabledMutex.RUnlock()
+	for name := range previous.disabled {
+		if tp.triggerDef.findTrigger(name) != nil {
+			tp.setTriggerEnabled(name, false)
+		}
+	}
+}
+
+/* Return the number of triggers of a collection */
+func (tp *triggerProcessor) triggerCount() int {
+	count := 0
+	for _, triggers := range tp.triggerDef.eventTriggers {
+		count += len(triggers)
+	}
+	return count
+}
+
+/*
+Reload the loaded collections of the given names, or all of them if none, from their Kabanero indexes or local
+directories, and switch to them if all are loaded
+*/
+func reloadCollections(names ...string) ([]reloadedCollection, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	current := loadedTriggerProcessors()
+	reloaded, previous := make([]*triggerProcessor, 0, len(current)), make([]*triggerProcessor, 0, len(current))
+	for _, tp := range current {
+		if tp == nil || !isCollectionNamed(tp.name, names) {
+			continue
+		}
+		var next *triggerProcessor
+		var err error
+		switch {
+		case tp.localDir != "":
+			next, err = loadLocalTriggerProcessor(tp.name, tp.localDir)
+		case len(tp.indexURLs) > 0:
+			next, err = loadTriggerProcessor(tp.name, strings.Join(tp.indexURLs, ","))
+		default:
+			/* not loaded from a Kabanero index */
+			continue
+		}
+		if err != nil {
+			for _, loaded := range reloaded {
+				os.RemoveAll(loaded.triggerDir)
+			}
+			incrementMetric("collections.reload.failures")
+			return nil, fmt.Errorf("unable to reload the %v collection: %v", tp.name, err)
+		}
+		next.copyDisabledTriggers(tp)
+		reloaded, previous = append(reloaded, next), append(previous, tp)
+	}
+
+	collections := make([]reloadedCollection, 0, len(reloaded))
+	for index, tp := range reloaded {
+		replaced := previous[index]
+		replaceCollection(tp)
+		collections = append(collections, reloadedCollection{Name: tp.name, IndexURL: redactURL(tp.indexURL), Digest: tp.digest,
+			Previous: replaced.digest, Changed: tp.digest != replaced.digest, Triggers: tp.triggerCount()})
+		klog.Infof("Reloaded the %v collection from %v, digest %v, previously %v", tp.name, redactURL(tp.indexURL), tp.digest, replaced.digest)
+		retireDir := replaced.triggerDir
+		time.AfterFunc(retireCollectionDelay, func() { os.RemoveAll(retireDir) })
+	}
+	incrementMetric("collections.reloads")
+
+	/* the shadow collection is evaluated against the events of the others, and needs no listener */
+	if ed := currentEventProviders(); ed != nil {
+		active, canary, _ := currentCollections()
+		if err := startListeners(ed, active, canary); err != nil {
+			return collections, fmt.Errorf("reloaded the collections, but unable to start their listeners: %v", err)
+		}
+	}
+	return collections, nil
+}
+
+/* Return whether a collection is one of the names, or names is empty */
+func isCollectionNamed(name string, names []string) bool {
+	for _, candidate := range names {
+		if candidate == name {
+			return true
+		}
+	}
+	return len(names) == 0
+}
+
+/* POST /admin/reload reloads the trigger collections from their Kabanero indexes or local directories */
+func adminReloadHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	collections, err := reloadCollections()
+	if err != nil {
+		writeError(writer, req, codeBadGateway, err.Error())
+		return
+	}
+	writeJSON(writer, collections)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadCollections(t *testing.T) {
+	savedProc, savedCanary, savedShadow, savedProviders := triggerProc, canaryProc, shadowProc, eventProviders
+	savedSources, savedDelay := indexSources, retireCollectionDelay
+	defer func() {
+		triggerProc, canaryProc, shadowProc, eventProviders = savedProc, savedCanary, savedShadow, savedProviders
+		indexSources, retireCollectionDelay = savedSources, savedDelay
+	}()
+	canaryProc, shadowProc, eventProviders = nil, nil, nil
+	indexSources, retireCollectionDelay = make(map[string]*indexSourceHealth), time.Millisecond
+
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chkSum, err := sha256sum(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failing int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch req.URL.Path {
+		case "/kabanero-index.yaml":
+			fmt.Fprintf(writer, "triggers:\n - url: %s/triggers.tar.gz\n   sha256: %s\n", server.URL, chkSum)
+		case "/triggers.tar.gz":
+			writer.Write(archive)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	triggerProc, err = loadTriggerProcessor("active", server.URL+"/kabanero-index.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := triggerProc
+
+	/* the reloaded collection replaces the previous one, whose directory is removed */
+	collections, err := reloadCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(triggerProc.triggerDir)
+	if len(collections) != 1 || collections[0].Name != "active" || collections[0].Changed || collections[0].Digest != previous.digest {
+		t.Fatalf("unexpected reloaded collections %+v", collections)
+	}
+	if triggerProc == previous {
+		t.Fatal("the reloaded collection did not replace the previous one")
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		if _, err := os.Stat(previous.triggerDir); os.IsNotExist(err) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the directory of the previous collection was not removed")
+		}
+	}
+
+	/* a collection that can not be reloaded is kept */
+	atomic.StoreInt32(&failing, 1)
+	current := triggerProc
+	if _, err = reloadCollections(); err == nil || triggerProc != current {
+		t.Fatalf("unexpected reload of an unavailable collection: %v", err)
+	}
+}
+
+func TestCopyDisabledTriggers(t *testing.T) {
+	previous, next := newTriggerProcessor(), newTriggerProcessor()
+	for _, tp := range []*triggerProcessor{previous, next} {
+		if err := tp.initialize("test_data/trigger16"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := previous.setTriggerEnabled("render", false); err != nil {
+		t.Fatal(err)
+	}
+	next.copyDisabledTriggers(previous)
+	if next.isTriggerEnabled("render") || !next.isTriggerEnabled("live") || next.triggerCount() != 2 {
+		t.Fatalf("unexpected triggers after copying the disabled triggers: %v", next.disabled)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+/*
+Repository configuration. With -repoConfig, the .kabanero/events.yaml file of the repository of a GitHub event is read
+when the event is processed, so that application teams configure how the triggers handle their repository in the
+repository itself: the triggers they opt in to or out of, parameters, and the pipeline to run. The file is cached
+for -repoConfigTTL per repository. Triggers excluded by the file are not evaluated, and the other triggers read the
+file as the repoConfig variable. A repository without the file, or whose file can not be read, has an empty
+configuration, so that its events are handled as without -repoConfig.
+*/
+
+const (
+	repoConfigFile     = ".kabanero/events.yaml"
+	repoConfigVariable = "repoConfig"
+)
+
+var (
+	repoConfigEnabled bool          // read the configuration file of the repositories of events
+	repoConfigTTL     time.Duration // how long the configuration of a repository is cached
+)
+
+/* The configuration file of a repository */
+type repositoryConfig struct {
+	Triggers struct {
+		Include []string `json:"include,omitempty"` // the only triggers evaluated, if set
+		Exclude []string `json:"exclude,omitempty"` // triggers not evaluated
+	} `json:"triggers,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	Pipeline   string                 `json:"pipeline,omitempty"`
+	exists     bool
+}
+
+/* Return whether the configuration of a repository lets a trigger be evaluated */
+func (config *repositoryConfig) allows(trigger string) bool {
+	if config == nil {
+		return true
+	}
+	for _, name := range config.Triggers.Exclude {
+		if name == trigger {
+			return false
+		}
+	}
+	if len(config.Triggers.Include) == 0 {
+		return true
+	}
+	for _, name := range config.Triggers.Include {
+		if name == trigger {
+			return true
+		}
+	}
+	return false
+}
+
+/* Return the repoConfig variable of triggers */
+func (config *repositoryConfig) variable() map[string]interface{} {
+	parameters := config.Parameters
+	if parameters == nil {
+		parameters = make(map[string]interface{})
+	}
+	include, exclude := config.Triggers.Include, config.Triggers.Exclude
+	if include == nil {
+		include = []string{}
+	}
+	if exclude == nil {
+		exclude = []string{}
+	}
+	return map[string]interface{}{
+		"exists":     config.exists,
+		"parameters": parameters,
+		"pipeline":   config.Pipeline,
+		"triggers":   map[string]interface{}{"include": include, "exclude": exclude},
+	}
+}
+
+/* Download the configuration file of the repository of a message. Replaced in tests */
+var fetchRepoConfig = func(message map[string]interface{}) ([]byte, bool, error) {
+	header, err := convertToHeaderMap(message[HEADER])
+	if err != nil {
+		return nil, false, err
+	}
+	body, _ := message[BODY].(map[string]interface{})
+	return downloadRepositoryFile(header, body, repoConfigFile)
+}
+
+type repoConfigEntry struct {
+	config *repositoryConfig
+	read   time.Time
+}
+
+var (
+	repoConfigMutex sync.Mutex
+	repoConfigCache = make(map[string]repoConfigEntry) // by repository URL
+)
+
+/* Return the configuration of the repository of a message, or nil if repository configurations are not enabled */
+func loadRepoConfig(message map[string]interface{}) *repositoryConfig {
+	if !repoConfigEnabled {
+		return nil
+	}
+	repository := messageRepositoryURL(message)
+	if repository == "" {
+		return &repositoryConfig{}
+	}
+	repoConfigMutex.Lock()
+	entry, ok := repoConfigCache[repository]
+	repoConfigMutex.Unlock()
+	if ok && time.Since(entry.read) < repoConfigTTL {
+		return entry.config
+	}
+
+	config := &repositoryConfig{}
+	incrementMetric("repoconfig.reads")
+	data, found, err := fetchRepoConfig(message)
+	if err != nil {
+		incrementMetric("repoconfig.errors")
+		klog.Warningf("Unable to read %v of repository %v: %v", repoConfigFile, repository, err)
+		/* keep the previous configuration rather than dropping the choices of the team, and read it again later */
+		if !ok {
+			return config
+		}
+		config = entry.config
+	} else if found {
+		if err = yaml.Unmarshal(data, config); err != nil {
+			incrementMetric("repoconfig.errors")
+			klog.Warningf("Unable to parse %v of repository %v: %v", repoConfigFile, repository, err)
+			config = &repositoryConfig{}
+		} else {
+			config.exists = true
+		}
+	}
+	repoConfigMutex.Lock()
+	repoConfigCache[repository] = repoConfigEntry{config: config, read: time.Now()}
+	repoConfigMutex.Unlock()
+	return config
+}
+
+/* Declare the repoConfig variable of a trigger, if repository configurations are enabled */
+func addRepoConfigVariable(env cel.Env, variables map[string]interface{}, config *repositoryConfig) (cel.Env, error) {
+	if config == nil {
+		return env, nil
+	}
+	env, err := env.Extend(cel.Declarations(decls.NewIdent(repoConfigVariable, decls.NewMapType(decls.String, decls.Dyn), nil)))
+	if err != nil {
+		return env, err
+	}
+	variables[repoConfigVariable] = config.variable()
+	return env, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRepoConfig(t *testing.T) {
+	savedEnabled, savedTTL, savedFetch, savedCache := repoConfigEnabled, repoConfigTTL, fetchRepoConfig, repoConfigCache
+	defer func() {
+		repoConfigEnabled, repoConfigTTL, fetchRepoConfig, repoConfigCache = savedEnabled, savedTTL, savedFetch, savedCache
+	}()
+	repoConfigEnabled, repoConfigTTL, repoConfigCache = true, time.Hour, make(map[string]repoConfigEntry)
+	fetches := 0
+	file := "triggers:\n  exclude: [deploy]\nparameters:\n  namespace: team-a\n  replicas: 2\npipeline: build-push\n"
+	fetchRepoConfig = func(message map[string]interface{}) ([]byte, bool, error) {
+		fetches++
+		switch messageRepositoryURL(message) {
+		case "https://github.com/org/configured":
+			return []byte(file), true, nil
+		case "https://github.com/org/unreadable":
+			return nil, false, fmt.Errorf("rate limited")
+		}
+		return nil, false, nil
+	}
+	message := func(repository string) map[string]interface{} {
+		return map[string]interface{}{BODY: map[string]interface{}{"repository": map[string]interface{}{"html_url": repository}}}
+	}
+
+	config := loadRepoConfig(message("https://github.com/org/configured"))
+	if !config.exists || config.allows("deploy") || !config.allows("build") || config.Pipeline != "build-push" {
+		t.Fatalf("unexpected configuration %+v", config)
+	}
+	variable := config.variable()
+	if variable["parameters"].(map[string]interface{})["namespace"] != "team-a" {
+		t.Fatalf("unexpected variable %v", variable)
+	}
+	loadRepoConfig(message("https://github.com/org/configured"))
+	if fetches != 1 {
+		t.Fatalf("the configuration was fetched %v times", fetches)
+	}
+
+	/* repositories without the file, or whose file can not be read, are not restricted */
+	for _, repository := range []string{"https://github.com/org/plain", "https://github.com/org/unreadable"} {
+		if config = loadRepoConfig(message(repository)); config.exists || !config.allows("deploy") {
+			t.Fatalf("unexpected configuration %+v of %v", config, repository)
+		}
+	}
+
+	config = &repositoryConfig{}
+	config.Triggers.Include = []string{"build"}
+	if !config.allows("build") || config.allows("deploy") {
+		t.Fatalf("unexpected included triggers of %+v", config)
+	}
+	repoConfigEnabled = false
+	if loadRepoConfig(message("https://github.com/org/configured")) != nil {
+		t.Fatal("the configuration was read without -repoConfig")
+	}
+}
+
+func TestRepoConfigTriggers(t *testing.T) {
+	savedEnabled, savedFetch, savedCache := repoConfigEnabled, fetchRepoConfig, repoConfigCache
+	defer func() { repoConfigEnabled, fetchRepoConfig, repoConfigCache = savedEnabled, savedFetch, savedCache }()
+	repoConfigEnabled, repoConfigCache = true, make(map[string]repoConfigEntry)
+	fetchRepoConfig = func(message map[string]interface{}) ([]byte, bool, error) {
+		return []byte("triggers:\n  exclude: [skipped]\npipeline: custom\n"), true, nil
+	}
+
+	triggers := make([]map[interface{}]interface{}, 0)
+	for _, name := range []string{"skipped", "evaluated"} {
+		triggers = append(triggers, map[interface{}]interface{}{
+			NAME:        name,
+			EVENTSOURCE: "github",
+			INPUT:       MESSAGE,
+			BODY:        []interface{}{map[interface{}]interface{}{"pipeline": "repoConfig.pipeline"}},
+		})
+	}
+	tp := &triggerProcessor{name: "repoconfig"}
+	tp.triggerDef = &eventTriggerDefinition{
+		setting:       []map[interface{}]interface{}{{"dryrun": true}},
+		eventTriggers: map[string][]map[interface{}]interface{}{"github": triggers},
+		functions:     make(map[string]map[interface{}]interface{}),
+		macros:        make(map[string]*celMacro),
+	}
+	message := map[string]interface{}{BODY: map[string]interface{}{"repository": map[string]interface{}{"html_url": "https://github.com/org/repo"}}}
+	result, err := tp.evaluateMessage(message, "github", evalOptions{dryrun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.variables) != 1 || result.variables[0]["pipeline"] != "custom" {
+		t.Fatalf("unexpected variables %v", result.variables)
+	}
+}
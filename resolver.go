@@ -0,0 +1,439 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"k8s.io/klog"
+)
+
+/*
+Repository file resolvers. The files of the repository of an event, such as those read by the downloadYAML function
+and the repository configuration, are read by the resolver of the host of the repository:
+  - github: the GitHub REST contents API, the default.
+  - graphql: the GitHub GraphQL API, reading a file in a single call that is cheaper on the rate limit.
+  - gitlab: the GitLab repository files API, the default for GitLab events.
+  - gitea: the raw file API of Gitea and Gogs, the default for Gitea and Gogs events.
+  - raw: plain HTTP GET of a URL template with the {owner}, {repo}, {ref} and {path} placeholders, such as
+    https://git.example.com/{owner}/{repo}/raw/{ref}/{path}, for Git servers without a supported API.
+  - local: the files of a local directory, <directory>/<owner>/<repo>/<path>, whatever the ref, for development.
+-repositoryResolvers maps hosts to resolvers, such as github.com=graphql,git.example.com=raw:<template>, with * for
+the other hosts. Credentials are those found for the repository by the gitAuth providers. Additional resolvers may be
+registered with registerRepositoryResolver before the flags are parsed.
+*/
+
+/* The repository of an event, at the commit of the event */
+type repositoryRef struct {
+	host       string // host of the repository, such as github.com
+	owner      string // owner of the repository. The full path of the group of GitLab projects in subgroups
+	name       string
+	htmlURL    string // URL of the repository
+	ref        string // commit of the event. The default branch if empty
+	enterprise bool   // whether the host is a GitHub Enterprise server
+}
+
+/* A RepositoryResolver reads the files of repositories */
+type RepositoryResolver interface {
+	/* Return the content of a file of a repository, and whether it exists */
+	ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error)
+}
+
+/* Create a resolver from the argument after the colon in -repositoryResolvers, empty if none */
+type repositoryResolverFactory func(arg string) (RepositoryResolver, error)
+
+const repositoryResolverAnyHost = "*"
+
+var (
+	repositoryResolvers string // comma separated host=resolver[:argument] resolvers of repository files
+	resolverTimeout     = 30 * time.Second
+
+	repositoryResolverMutex     sync.RWMutex
+	repositoryResolverFactories = map[string]repositoryResolverFactory{
+		"github":  func(string) (RepositoryResolver, error) { return &gitHubRESTResolver{}, nil },
+		"graphql": func(string) (RepositoryResolver, error) { return &gitHubGraphQLResolver{}, nil },
+		"gitlab": func(baseURL string) (RepositoryResolver, error) {
+			return &gitLabResolver{baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+		},
+		"gitea": func(baseURL string) (RepositoryResolver, error) {
+			return &giteaResolver{baseURL: strings.TrimSuffix(baseURL, "/")}, nil
+		},
+		"raw":   newRawHTTPResolver,
+		"local": newLocalDirResolver,
+	}
+	repositoryResolversByHost = make(map[string]RepositoryResolver) // configured by -repositoryResolvers
+)
+
+/* Register a resolver under a name, so that it may be selected by -repositoryResolvers */
+func registerRepositoryResolver(name string, factory repositoryResolverFactory) error {
+	repositoryResolverMutex.Lock()
+	defer repositoryResolverMutex.Unlock()
+	if _, exists := repositoryResolverFactories[name]; exists {
+		return fmt.Errorf("repository resolver %v is already registered", name)
+	}
+	repositoryResolverFactories[name] = factory
+	return nil
+}
+
+/* Parse -repositoryResolvers into the resolvers by host */
+func parseRepositoryResolvers(value string) (map[string]RepositoryResolver, error) {
+	repositoryResolverMutex.RLock()
+	defer repositoryResolverMutex.RUnlock()
+	resolvers := make(map[string]RepositoryResolver)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equal := strings.Index(entry, "=")
+		if equal <= 0 {
+			return nil, fmt.Errorf("repository resolver %s is not of the form host=resolver", entry)
+		}
+		host, kind := strings.ToLower(strings.TrimSpace(entry[:equal])), strings.TrimSpace(entry[equal+1:])
+		arg := ""
+		if colon := strings.Index(kind, ":"); colon >= 0 {
+			kind, arg = kind[:colon], kind[colon+1:]
+		}
+		factory, ok := repositoryResolverFactories[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown repository resolver %s of host %s", kind, host)
+		}
+		resolver, err := factory(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repository resolver of host %s: %v", host, err)
+		}
+		resolvers[host] = resolver
+	}
+	return resolvers, nil
+}
+
+/* Initialize the resolvers of -repositoryResolvers */
+func initializeRepositoryResolvers() error {
+	resolvers, err := parseRepositoryResolvers(repositoryResolvers)
+	if err != nil {
+		return err
+	}
+	repositoryResolverMutex.Lock()
+	defer repositoryResolverMutex.Unlock()
+	repositoryResolversByHost = resolvers
+	return nil
+}
+
+/* Return the resolver of a repository: that of its host, else that of any host, else the default of its events */
+func resolverFor(repo *repositoryRef, header map[string][]string) RepositoryResolver {
+	repositoryResolverMutex.RLock()
+	defer repositoryResolverMutex.RUnlock()
+	if resolver, ok := repositoryResolversByHost[strings.ToLower(repo.host)]; ok {
+		return resolver
+	}
+	if resolver, ok := repositoryResolversByHost[repositoryResolverAnyHost]; ok {
+		return resolver
+	}
+	if _, ok := header[http.CanonicalHeaderKey("X-Gitlab-Event")]; ok {
+		return &gitLabResolver{}
+	}
+	if _, ok := header[http.CanonicalHeaderKey("X-Gitea-Event")]; ok {
+		return &giteaResolver{}
+	}
+	if _, ok := header[http.CanonicalHeaderKey("X-Gogs-Event")]; ok {
+		return &giteaResolver{}
+	}
+	return &gitHubRESTResolver{}
+}
+
+/* Return the repository of a webhook message, at the commit of the event */
+func messageRepositoryRef(header map[string][]string, bodyMap map[string]interface{}) (*repositoryRef, error) {
+	repositoryEvent := ""
+	if values := header["X-Github-Event"]; len(values) > 0 {
+		repositoryEvent = values[0]
+	}
+	owner, name, htmlURL, ref, err := getRepositoryInfo(bodyMap, repositoryEvent)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get repository owner, name, or html_url from webhook message: %v", err)
+	}
+	repo := &repositoryRef{owner: owner, name: name, htmlURL: htmlURL, ref: ref, host: "github.com"}
+	if hostHeader, ok := header[http.CanonicalHeaderKey("x-github-enterprise-host")]; ok && len(hostHeader) > 0 {
+		repo.host, repo.enterprise = hostHeader[0], true
+	} else if parsed, err := url.Parse(htmlURL); err == nil && parsed.Host != "" {
+		repo.host = parsed.Host
+	}
+	return repo, nil
+}
+
+/* Return the credentials of a repository, empty if none is found */
+func repositoryCredentials(repo *repositoryRef) (string, string) {
+	username, token, _, err := resolveGitCredentials(repo.htmlURL)
+	if err != nil {
+		if klog.V(5) {
+			klog.Infof("No credentials for repository %v: %v", repo.htmlURL, err)
+		}
+		return "", ""
+	}
+	return username, token
+}
+
+/* Return the error of an HTTP call of a resolver, with a retry hint */
+func resolverCallError(resp *http.Response, err error, description string) error {
+	if err == nil && resp != nil {
+		err = fmt.Errorf("http status %v", resp.Status)
+	}
+	var response *github.Response
+	if resp != nil {
+		response = &github.Response{Response: resp}
+	}
+	return gitHubCallError(response, err, description)
+}
+
+/* Resolver of the GitHub REST contents API */
+type gitHubRESTResolver struct{}
+
+func (resolver *gitHubRESTResolver) ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error) {
+	user, token, _, err := resolveGitCredentials(repo.htmlURL)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to get user/token secrets for URL %v: %v", repo.htmlURL, err)
+	}
+	return downloadFileFromGithub(repo.owner, repo.name, path, repo.ref, "https://"+repo.host, user, token, repo.enterprise)
+}
+
+/* Resolver of the GitHub GraphQL API */
+type gitHubGraphQLResolver struct {
+	endpoint string // URL of the GraphQL API. That of the host of the repository if empty
+}
+
+const gitHubFileQuery = `query($owner: String!, $name: String!, $expression: String!) {
+  repository(owner: $owner, name: $name) { object(expression: $expression) { ... on Blob { text isBinary } } }
+}`
+
+func (resolver *gitHubGraphQLResolver) ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error) {
+	_, token := repositoryCredentials(repo)
+	if token == "" {
+		return nil, false, fmt.Errorf("the GitHub GraphQL API requires a token for repository %v", repo.htmlURL)
+	}
+	endpoint := resolver.endpoint
+	if endpoint == "" {
+		endpoint = "https://api.github.com/graphql"
+		if repo.enterprise || repo.host != "github.com" {
+			endpoint = "https://" + repo.host + "/api/graphql"
+		}
+	}
+	ref := repo.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	query, err := json.Marshal(map[string]interface{}{
+		"query":     gitHubFileQuery,
+		"variables": map[string]string{"owner": repo.owner, "name": repo.name, "expression": ref + ":" + path},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	description := fmt.Sprintf("unable to download %v/%v/%v", repo.owner, repo.name, path)
+	client := &http.Client{Transport: withUserAgent(nil), Timeout: resolverTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, resolverCallError(nil, err, description)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, resolverCallError(resp, nil, description)
+	}
+	var result struct {
+		Data struct {
+			Repository *struct {
+				Object *struct {
+					Text     *string `json:"text"`
+					IsBinary bool    `json:"isBinary"`
+				} `json:"object"`
+			} `json:"repository"`
+		} `json:"data"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false, fmt.Errorf("%s: invalid GraphQL response: %v", description, err)
+	}
+	if len(result.Errors) > 0 {
+		if result.Errors[0].Type == "NOT_FOUND" {
+			resp.StatusCode, resp.Status = http.StatusNotFound, "404 Not Found"
+			return nil, false, resolverCallError(resp, fmt.Errorf("%s", result.Errors[0].Message), description)
+		}
+		return nil, false, fmt.Errorf("%s: %s", description, result.Errors[0].Message)
+	}
+	if result.Data.Repository == nil || result.Data.Repository.Object == nil {
+		/* does not exist */
+		return nil, false, nil
+	}
+	object := result.Data.Repository.Object
+	if object.Text == nil || object.IsBinary {
+		return nil, true, fmt.Errorf("%s: not a text file", description)
+	}
+	return []byte(*object.Text), true, nil
+}
+
+/* Resolver of the GitLab repository files API */
+type gitLabResolver struct {
+	baseURL string // URL of the GitLab server. https://<host of the repository> if empty
+}
+
+func (resolver *gitLabResolver) ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error) {
+	baseURL := resolver.baseURL
+	if baseURL == "" {
+		baseURL = "https://" + repo.host
+	}
+	fileURL := fmt.Sprintf("%s/api/v4/projects/%s/repository/files/%s/raw", strings.TrimSuffix(baseURL, "/"),
+		url.PathEscape(repo.owner+"/"+repo.name), url.PathEscape(strings.TrimPrefix(path, "/")))
+	if repo.ref != "" {
+		fileURL += "?ref=" + url.QueryEscape(repo.ref)
+	}
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, token := repositoryCredentials(repo); token != "" {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}
+	return resolveHTTPFile(req, fmt.Sprintf("unable to download %v/%v/%v", repo.owner, repo.name, path))
+}
+
+/* Resolver of the raw file API of Gitea and Gogs */
+type giteaResolver struct {
+	baseURL string // URL of the Gitea or Gogs server. https://<host of the repository> if empty
+}
+
+func (resolver *giteaResolver) ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error) {
+	baseURL := resolver.baseURL
+	if baseURL == "" {
+		baseURL = "https://" + repo.host
+	}
+	ref := repo.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	/* the ref as the first segment of the path is understood by both Gitea and Gogs */
+	fileURL := fmt.Sprintf("%s/api/v1/repos/%s/%s/raw/%s/%s", baseURL, url.PathEscape(repo.owner), url.PathEscape(repo.name),
+		url.PathEscape(ref), strings.TrimPrefix(path, "/"))
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if _, token := repositoryCredentials(repo); token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	return resolveHTTPFile(req, fmt.Sprintf("unable to download %v/%v/%v", repo.owner, repo.name, path))
+}
+
+/* Resolver of plain HTTP URLs */
+type rawHTTPResolver struct {
+	template string // URL with the {owner}, {repo}, {ref} and {path} placeholders
+}
+
+func newRawHTTPResolver(template string) (RepositoryResolver, error) {
+	if !strings.Contains(template, "{path}") {
+		return nil, fmt.Errorf("the URL template %s of the raw resolver does not contain {path}", template)
+	}
+	return &rawHTTPResolver{template: template}, nil
+}
+
+func (resolver *rawHTTPResolver) ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error) {
+	ref := repo.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	fileURL := strings.NewReplacer("{owner}", repo.owner, "{repo}", repo.name, "{ref}", url.PathEscape(ref),
+		"{path}", strings.TrimPrefix(path, "/")).Replace(resolver.template)
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if username, token := repositoryCredentials(repo); token != "" {
+		req.SetBasicAuth(username, token)
+	}
+	return resolveHTTPFile(req, fmt.Sprintf("unable to download %v/%v/%v", repo.owner, repo.name, path))
+}
+
+/* Send the request of a file. A 404 response is a file that does not exist */
+func resolveHTTPFile(req *http.Request, description string) ([]byte, bool, error) {
+	client := &http.Client{Transport: withUserAgent(nil), Timeout: resolverTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, resolverCallError(nil, err, description)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, true, fmt.Errorf("%s: %v", description, err)
+		}
+		return content, true, nil
+	case http.StatusNotFound:
+		/* does not exist */
+		return nil, false, nil
+	default:
+		return nil, false, resolverCallError(resp, nil, description)
+	}
+}
+
+/* Resolver of the files of a local directory */
+type localDirResolver struct {
+	dir string // directory of the repositories, as <owner>/<repo>
+}
+
+func newLocalDirResolver(dir string) (RepositoryResolver, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("the local resolver requires a directory")
+	}
+	return &localDirResolver{dir: dir}, nil
+}
+
+func (resolver *localDirResolver) ResolveFile(repo *repositoryRef, path string) ([]byte, bool, error) {
+	repoDir, err := mergePathWithErrorCheck(resolver.dir, filepath.Join(repo.owner, repo.name))
+	if err != nil {
+		return nil, false, err
+	}
+	fileName, err := mergePathWithErrorCheck(repoDir, path)
+	if err != nil {
+		return nil, false, err
+	}
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return content, true, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositoryResolvers(t *testing.T) {
+	savedResolvers := repositoryResolversByHost
+	defer func() { repositoryResolversByHost = savedResolvers }()
+
+	resolvers, err := parseRepositoryResolvers("github.com=graphql,gitlab.example.com=gitlab:https://gitlab.example.com/, GIT.example.com=raw:https://git.example.com/{owner}/{repo}/raw/{ref}/{path},*=local:/repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositoryResolversByHost = resolvers
+	if _, ok := resolverFor(&repositoryRef{host: "github.com"}, nil).(*gitHubGraphQLResolver); !ok {
+		t.Error("unexpected resolver of github.com")
+	}
+	if gitLab, ok := resolverFor(&repositoryRef{host: "gitlab.example.com"}, nil).(*gitLabResolver); !ok || gitLab.baseURL != "https://gitlab.example.com" {
+		t.Error("unexpected resolver of gitlab.example.com")
+	}
+	if raw, ok := resolverFor(&repositoryRef{host: "git.example.com"}, nil).(*rawHTTPResolver); !ok || raw.template != "https://git.example.com/{owner}/{repo}/raw/{ref}/{path}" {
+		t.Error("unexpected resolver of git.example.com")
+	}
+	if local, ok := resolverFor(&repositoryRef{host: "other.example.com"}, nil).(*localDirResolver); !ok || local.dir != "/repos" {
+		t.Error("unexpected resolver of the other hosts")
+	}
+
+	/* GitHub REST by default, except for GitLab, Gitea, and Gogs events */
+	repositoryResolversByHost = make(map[string]RepositoryResolver)
+	if _, ok := resolverFor(&repositoryRef{host: "github.com"}, nil).(*gitHubRESTResolver); !ok {
+		t.Error("unexpected default resolver")
+	}
+	if _, ok := resolverFor(&repositoryRef{host: "gitlab.com"}, map[string][]string{"X-Gitlab-Event": {"Push Hook"}}).(*gitLabResolver); !ok {
+		t.Error("unexpected default resolver of GitLab events")
+	}
+	for _, event := range []string{"X-Gitea-Event", "X-Gogs-Event"} {
+		if _, ok := resolverFor(&repositoryRef{host: "git.example.com"}, map[string][]string{event: {"push"}}).(*giteaResolver); !ok {
+			t.Errorf("unexpected default resolver of events with %v", event)
+		}
+	}
+
+	for _, invalid := range []string{"github.com", "github.com=unknown", "git.example.com=raw:https://git.example.com", "*=local"} {
+		if _, err := parseRepositoryResolvers(invalid); err == nil {
+			t.Errorf("expected an error parsing %v", invalid)
+		}
+	}
+}
+
+func TestMessageRepositoryRef(t *testing.T) {
+	body := map[string]interface{}{
+		"after":      "0123456",
+		"repository": map[string]interface{}{"name": "repo", "owner": map[string]interface{}{"login": "owner"}, "html_url": "https://gitlab.example.com/owner/repo"},
+	}
+	repo, err := messageRepositoryRef(map[string][]string{"X-Github-Event": {"push"}}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *repo != (repositoryRef{host: "gitlab.example.com", owner: "owner", name: "repo", htmlURL: "https://gitlab.example.com/owner/repo", ref: "0123456"}) {
+		t.Fatalf("unexpected repository %+v", repo)
+	}
+	repo, err = messageRepositoryRef(map[string][]string{"X-Github-Event": {"push"}, "X-Github-Enterprise-Host": {"github.example.com"}}, body)
+	if err != nil || repo.host != "github.example.com" || !repo.enterprise {
+		t.Fatalf("unexpected repository %+v: %v", repo, err)
+	}
+}
+
+func TestHTTPRepositoryResolvers(t *testing.T) {
+	savedAuth := gitAuth
+	defer func() { gitAuth = savedAuth }()
+	gitAuth = &gitAuthChains{providers: map[string]gitAuthProvider{"test": &testAuthProvider{creds: &gitCredentials{username: "user", token: "token", source: "test"}}},
+		hosts: map[string][]string{gitAuthAnyHost: {"test"}}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.EscapedPath() {
+		case "/api/v4/projects/group%2Fsubgroup%2Frepo/repository/files/dir%2Ffile.yaml/raw":
+			if req.Header.Get("PRIVATE-TOKEN") != "token" || req.URL.Query().Get("ref") != "0123456" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(writer, "from: gitlab\n")
+		case "/raw/owner/repo/0123456/dir/file.yaml":
+			if username, token, ok := req.BasicAuth(); !ok || username != "user" || token != "token" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(writer, "from: raw\n")
+		case "/api/v1/repos/owner/repo/raw/0123456/dir/file.yaml":
+			if req.Header.Get("Authorization") != "token token" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(writer, "from: gitea\n")
+		case "/raw/owner/unavailable/0123456/dir/file.yaml":
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		case "/graphql":
+			var query struct {
+				Variables map[string]string `json:"variables"`
+			}
+			json.NewDecoder(req.Body).Decode(&query)
+			if req.Header.Get("Authorization") != "bearer token" || query.Variables["expression"] != "0123456:dir/file.yaml" {
+				fmt.Fprint(writer, `{"data": {"repository": {"object": null}}}`)
+				return
+			}
+			fmt.Fprint(writer, `{"data": {"repository": {"object": {"text": "from: graphql\n", "isBinary": false}}}}`)
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		resolver RepositoryResolver
+		repo     repositoryRef
+		expected string
+	}{
+		{&gitLabResolver{baseURL: server.URL}, repositoryRef{owner: "group/subgroup", name: "repo", ref: "0123456"}, "from: gitlab\n"},
+		{&rawHTTPResolver{template: server.URL + "/raw/{owner}/{repo}/{ref}/{path}"}, repositoryRef{owner: "owner", name: "repo", ref: "0123456"}, "from: raw\n"},
+		{&giteaResolver{baseURL: server.URL}, repositoryRef{owner: "owner", name: "repo", ref: "0123456"}, "from: gitea\n"},
+		{&gitHubGraphQLResolver{endpoint: server.URL + "/graphql"}, repositoryRef{owner: "owner", name: "repo", ref: "0123456"}, "from: graphql\n"},
+	} {
+		test.repo.htmlURL = server.URL + "/" + test.repo.owner + "/" + test.repo.name
+		content, exists, err := test.resolver.ResolveFile(&test.repo, "dir/file.yaml")
+		if err != nil || !exists || string(content) != test.expected {
+			t.Errorf("unexpected content %q of %T: %v, %v", content, test.resolver, exists, err)
+		}
+		/* files that do not exist */
+		if _, exists, err = test.resolver.ResolveFile(&test.repo, "missing.yaml"); exists || err != nil {
+			t.Errorf("unexpected result reading a missing file with %T: %v, %v", test.resolver, exists, err)
+		}
+	}
+
+	unavailable := &repositoryRef{owner: "owner", name: "unavailable", ref: "0123456", htmlURL: server.URL + "/owner/unavailable"}
+	_, _, err := (&rawHTTPResolver{template: server.URL + "/raw/{owner}/{repo}/{ref}/{path}"}).ResolveFile(unavailable, "dir/file.yaml")
+	if hint := retryHintOf(err); hint == nil || hint.Reason != retryReasonServerError || !hint.Retryable {
+		t.Fatalf("unexpected hint %+v of error %v", hint, err)
+	}
+}
+
+func TestLocalDirResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(filepath.Join(dir, "owner", "repo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "owner", "repo", "file.yaml"), []byte("from: local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := newLocalDirResolver(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &repositoryRef{owner: "owner", name: "repo"}
+	if content, exists, err := resolver.ResolveFile(repo, "file.yaml"); err != nil || !exists || string(content) != "from: local\n" {
+		t.Fatalf("unexpected content %q: %v, %v", content, exists, err)
+	}
+	if _, exists, err := resolver.ResolveFile(repo, "missing.yaml"); exists || err != nil {
+		t.Fatalf("unexpected result reading a missing file: %v, %v", exists, err)
+	}
+	if _, _, err := resolver.ResolveFile(repo, "../../../etc/passwd"); err == nil {
+		t.Fatal("expected an error reading a file outside of the directory")
+	}
+}
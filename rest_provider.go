@@ -51,7 +51,9 @@ func (provider *restProvider) Send(node *EventNode, payload []byte, header inter
 			}
 		}
 	}
-	req.Header.Add("Content-Type", "application/json")
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Add("Content-Type", "application/json")
+	}
 
 	tr := &http.Transport{ }
 	if provider.messageProviderDefinition.SkipTLSVerify {
@@ -61,7 +63,7 @@ func (provider *restProvider) Send(node *EventNode, payload []byte, header inter
 	// TODO: honor timeout
 	timeout := time.Duration(5*time.Second) // TODO: make it configurable
 	client := &http.Client {
-		Transport: tr,
+		Transport: withUserAgent(tr),
 		Timeout: timeout,
 	}
 
@@ -84,6 +86,12 @@ func (provider *restProvider) Receive(node *EventNode) ([]byte, error) {
 	return nil, nil
 }
 
+func init() {
+	RegisterMessageProvider("rest", func(mpd *MessageProviderDefinition) (MessageProvider, error) {
+		return newRESTProvider(mpd)
+	})
+}
+
 func newRESTProvider(mpd *MessageProviderDefinition) (*restProvider, error) {
 	provider := new(restProvider)
 	if err := provider.initialize(mpd); err != nil {
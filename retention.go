@@ -0,0 +1,493 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Retention store of the audit records. Records are kept in a pluggable store, selected with -retentionStore: memory,
+the default, keeps them in a bounded in-memory ring, and file also appends them to a JSON lines file, so that they
+survive restarts. Records are queried by repository, event source, collection, trigger, outcome, and time range,
+through GET /admin/events, or the events command, and purged through DELETE /admin/events. No database store, such as
+bbolt or Postgres, is provided: one would be added as another implementation of eventStore.
+*/
+
+const (
+	retentionMemory = "memory"
+	retentionFile   = "file"
+
+	defaultEventsLimit = 100     // number of records returned by a query, unless limited otherwise
+	maxRecordLineSize  = 1 << 20 // maximum size of a line of the retention file
+)
+
+var (
+	retentionStore  = retentionMemory // kind of the retention store
+	retentionPath   string            // file of the file retention store
+	retentionMaxAge time.Duration     // maximum age of the records kept. Unlimited if 0
+
+	auditStore eventStore = newMemoryStore()
+)
+
+/* A store of audit records */
+type eventStore interface {
+	/* add a record */
+	add(record *auditRecord) error
+	/* return the most recent records matching a query, oldest first */
+	query(query auditQuery) ([]*auditRecord, error)
+	/* remove all the records matching a query, returning how many were removed */
+	purge(query auditQuery) (int, error)
+}
+
+/* A query of the audit records. Empty fields match all records */
+type auditQuery struct {
+	Repository  string
+	User        string
+	EventSource string
+	Collection  string
+	Trigger     string
+	Outcome     string
+	Since       time.Time
+	Until       time.Time
+	Limit       int // maximum number of records returned, the most recent ones. Unlimited if 0
+}
+
+/* Return true if a record matches the query */
+func (query auditQuery) matches(record *auditRecord) bool {
+	if query.Repository != "" && record.Repository != query.Repository {
+		return false
+	}
+	if query.User != "" && record.User != query.User {
+		return false
+	}
+	if query.EventSource != "" && record.EventSource != query.EventSource {
+		return false
+	}
+	if query.Collection != "" && record.Collection != query.Collection {
+		return false
+	}
+	if query.Outcome != "" && record.Outcome != query.Outcome {
+		return false
+	}
+	if !query.Since.IsZero() && record.Time.Before(query.Since) {
+		return false
+	}
+	if !query.Until.IsZero() && !record.Time.Before(query.Until) {
+		return false
+	}
+	if query.Trigger != "" {
+		for _, trigger := range record.Triggers {
+			if trigger == query.Trigger {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+/* Create the retention store selected by the flags */
+func initializeRetention() error {
+	switch retentionStore {
+	case retentionMemory:
+		auditStore = newMemoryStore()
+	case retentionFile:
+		if retentionPath == "" {
+			return fmt.Errorf("-retentionFile must be set for the %s retention store", retentionFile)
+		}
+		store, err := openFileStore(retentionPath)
+		if err != nil {
+			return err
+		}
+		auditStore = store
+	default:
+		return fmt.Errorf("retention store '%s' is not %s or %s", retentionStore, retentionMemory, retentionFile)
+	}
+	return nil
+}
+
+/*
+A store keeping the most recent -auditRecords records, younger than -retentionMaxAge, in memory. The records are kept
+in a ring: once it is full, a new record replaces the oldest one.
+*/
+type memoryStore struct {
+	mutex   sync.RWMutex
+	records []*auditRecord // ring of -auditRecords records
+	head    int            // index of the oldest record
+	length  int            // number of records in the ring
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{records: make([]*auditRecord, 0)}
+}
+
+func (store *memoryStore) add(record *auditRecord) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.insert(record, time.Now())
+	return nil
+}
+
+/* Return the record at an index, from the oldest. Called with the lock held */
+func (store *memoryStore) at(index int) *auditRecord {
+	return store.records[(store.head+index)%len(store.records)]
+}
+
+/* Return the records, oldest first. Called with the lock held */
+func (store *memoryStore) list() []*auditRecord {
+	records := make([]*auditRecord, 0, store.length)
+	for index := 0; index < store.length; index++ {
+		records = append(records, store.at(index))
+	}
+	return records
+}
+
+/* Replace the records of the ring with the most recent of records, oldest first. Called with the lock held */
+func (store *memoryStore) reset(records []*auditRecord) {
+	size := auditSize
+	if size < 0 {
+		size = 0
+	}
+	if len(records) > size {
+		records = records[len(records)-size:]
+	}
+	store.records = make([]*auditRecord, size)
+	store.head = 0
+	store.length = copy(store.records, records)
+}
+
+/* Add a record to the ring, and discard the records older than -retentionMaxAge. Called with the lock held */
+func (store *memoryStore) insert(record *auditRecord, now time.Time) {
+	if len(store.records) != auditSize {
+		store.reset(store.list())
+	}
+	if auditSize <= 0 {
+		return
+	}
+	if store.length == len(store.records) {
+		store.records[store.head] = record
+		store.head = (store.head + 1) % len(store.records)
+	} else {
+		store.records[(store.head+store.length)%len(store.records)] = record
+		store.length++
+	}
+	if retentionMaxAge > 0 {
+		oldest := now.Add(-retentionMaxAge)
+		for store.length > 0 && store.at(0).Time.Before(oldest) {
+			store.records[store.head] = nil
+			store.head = (store.head + 1) % len(store.records)
+			store.length--
+		}
+	}
+}
+
+func (store *memoryStore) query(query auditQuery) ([]*auditRecord, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	matched := make([]*auditRecord, 0)
+	/* newest first, until the limit is reached */
+	for index := store.length - 1; index >= 0; index-- {
+		if query.Limit > 0 && len(matched) >= query.Limit {
+			break
+		}
+		if record := store.at(index); query.matches(record) {
+			matched = append(matched, record)
+		}
+	}
+	for left, right := 0, len(matched)-1; left < right; left, right = left+1, right-1 {
+		matched[left], matched[right] = matched[right], matched[left]
+	}
+	return matched, nil
+}
+
+func (store *memoryStore) purge(query auditQuery) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.remove(query), nil
+}
+
+/* Remove the records matching a query. Called with the lock held */
+func (store *memoryStore) remove(query auditQuery) int {
+	kept := make([]*auditRecord, 0, store.length)
+	for _, record := range store.list() {
+		if !query.matches(record) {
+			kept = append(kept, record)
+		}
+	}
+	removed := store.length - len(kept)
+	if removed > 0 {
+		store.reset(kept)
+	}
+	return removed
+}
+
+/*
+A store keeping its records in memory, and appending them to a JSON lines file, which is loaded on startup. The file
+is compacted to the records kept in memory once it contains twice as many.
+*/
+type fileStore struct {
+	*memoryStore
+	path  string
+	file  *os.File
+	lines int // records in the file
+}
+
+/* Open a file store, loading the records of the file */
+func openFileStore(path string) (*fileStore, error) {
+	store := &fileStore{memoryStore: newMemoryStore(), path: path}
+	file, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), maxRecordLineSize)
+		for scanner.Scan() {
+			record := &auditRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+				klog.Warningf("Skipping unreadable audit record in %v: %v", path, err)
+				continue
+			}
+			store.memoryStore.add(record)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read retention file %v: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	klog.Infof("Loaded %v audit records from %v", store.length, path)
+	return store, nil
+}
+
+/* Rewrite the file with the records in memory. Called with the lock held */
+func (store *fileStore) compact() error {
+	temp, err := ioutil.TempFile(filepath.Dir(store.path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(temp)
+	encoder := json.NewEncoder(writer)
+	for _, record := range store.list() {
+		if err = encoder.Encode(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), store.path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("unable to compact retention file %v: %v", store.path, err)
+	}
+	if store.file != nil {
+		store.file.Close()
+	}
+	store.file, err = os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		store.file = nil
+		return err
+	}
+	store.lines = store.length
+	return nil
+}
+
+func (store *fileStore) add(record *auditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.insert(record, time.Now())
+	if store.lines >= 2*auditSize || store.file == nil {
+		return store.compact()
+	}
+	if _, err = store.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	store.lines++
+	return nil
+}
+
+/* Remove the records matching a query, and rewrite the file so that they are no longer on disk */
+func (store *fileStore) purge(query auditQuery) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	removed := store.remove(query)
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, store.compact()
+}
+
+/* Parse a time of a query: either a RFC 3339 time, or a duration before now */
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+/* Parse the query of GET /admin/events */
+func parseAuditQuery(values url.Values, now time.Time) (auditQuery, error) {
+	query := auditQuery{
+		Repository:  values.Get("repository"),
+		User:        values.Get("user"),
+		EventSource: values.Get("eventSource"),
+		Collection:  values.Get("collection"),
+		Trigger:     values.Get("trigger"),
+		Outcome:     values.Get("outcome"),
+		Limit:       defaultEventsLimit,
+	}
+	var err error
+	if query.Since, err = parseQueryTime(values.Get("since"), now); err != nil {
+		return query, fmt.Errorf("invalid since %v: %v", values.Get("since"), err)
+	}
+	if query.Until, err = parseQueryTime(values.Get("until"), now); err != nil {
+		return query, fmt.Errorf("invalid until %v: %v", values.Get("until"), err)
+	}
+	switch query.Outcome {
+	case "", auditOutcomeActions, auditOutcomeNone, auditOutcomeError:
+	default:
+		return query, fmt.Errorf("outcome %v is not %v, %v, or %v", query.Outcome, auditOutcomeActions, auditOutcomeNone, auditOutcomeError)
+	}
+	if value := values.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 0 {
+			return query, fmt.Errorf("invalid limit %v", value)
+		}
+	}
+	return query, nil
+}
+
+/* GET /admin/events queries the audit records, and DELETE /admin/events purges them */
+func adminEventsHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodDelete {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	query, err := parseAuditQuery(req.URL.Query(), time.Now())
+	if err != nil {
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	if req.Method == http.MethodDelete {
+		adminPurgeHandler(writer, req, query)
+		return
+	}
+	records, err := auditStore.query(query)
+	if err != nil {
+		writeError(writer, req, codeInternalError, err.Error())
+		return
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		writeError(writer, req, codeInternalError, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(data)
+}
+
+/*
+eventsCommand implements "kabanero-events events [-admin <url>] [-repository <name>] [-since <time>] ...".
+It queries the audit records of a running instance through its admin API, authenticating with ADMIN_TOKEN if set.
+*/
+func eventsCommand(args []string) int {
+	flags := flag.NewFlagSet("events", flag.ExitOnError)
+	admin := flags.String("admin", "http://localhost:9091", "URL of the admin API")
+	raw := flags.Bool("raw", false, "print the complete JSON of the records")
+	values := make(map[string]*string)
+	for _, name := range []string{"repository", "user", "eventSource", "collection", "trigger", "outcome", "since", "until", "limit"} {
+		values[name] = flags.String(name, "", "only the records of the given "+name)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kabanero-events events [-admin <url>] [-repository <name>] [-since <time|duration>] ...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	query := url.Values{}
+	for name, value := range values {
+		if *value != "" {
+			query.Set(name, *value)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*admin, "/")+"/admin/events?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "events: %v\n", err)
+		return 2
+	}
+	if token := os.Getenv(ADMINTOKEN); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", userAgent())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "events: %v\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "events: query failed with status %v: %s %v\n", resp.Status, strings.TrimSpace(string(body)), err)
+		return 1
+	}
+	records := make([]*auditRecord, 0)
+	if err = json.Unmarshal(body, &records); err != nil {
+		fmt.Fprintf(os.Stderr, "events: %v\n", err)
+		return 1
+	}
+	for _, record := range records {
+		if *raw {
+			data, _ := json.Marshal(record)
+			fmt.Printf("%s\n", data)
+			continue
+		}
+		fmt.Printf("%s %-8s %-12s %-8s %s %s\n", record.Time.Format(time.RFC3339), record.Outcome, record.EventSource, record.Collection,
+			record.Repository, strings.Join(record.Triggers, ","))
+	}
+	return 0
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func addTestRecords(t *testing.T, store eventStore, now time.Time) {
+	records := []*auditRecord{
+		{Time: now.Add(-3 * time.Hour), EventSource: "github", Repository: "kabanero-io/appsody", Triggers: []string{"build"}, Outcome: auditOutcomeActions},
+		{Time: now.Add(-2 * time.Hour), EventSource: "github", Repository: "kabanero-io/collections", Outcome: auditOutcomeNone},
+		{Time: now.Add(-time.Hour), EventSource: "github", Repository: "kabanero-io/appsody", Triggers: []string{"tag"}, Outcome: auditOutcomeError},
+		{Time: now, EventSource: "notifications", Repository: "kabanero-io/appsody", Triggers: []string{"build", "notify"}, Outcome: auditOutcomeActions},
+	}
+	for _, record := range records {
+		if err := store.add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	now := time.Now()
+	store := newMemoryStore()
+	addTestRecords(t, store, now)
+
+	for _, test := range []struct {
+		query    auditQuery
+		expected []string // outcomes, oldest first
+	}{
+		{auditQuery{}, []string{auditOutcomeActions, auditOutcomeNone, auditOutcomeError, auditOutcomeActions}},
+		{auditQuery{Repository: "kabanero-io/appsody", EventSource: "github"}, []string{auditOutcomeActions, auditOutcomeError}},
+		{auditQuery{Trigger: "build"}, []string{auditOutcomeActions, auditOutcomeActions}},
+		{auditQuery{Outcome: auditOutcomeError}, []string{auditOutcomeError}},
+		{auditQuery{Since: now.Add(-150 * time.Minute), Until: now}, []string{auditOutcomeNone, auditOutcomeError}},
+		{auditQuery{Limit: 2}, []string{auditOutcomeError, auditOutcomeActions}},
+	} {
+		records, err := store.query(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcomes := make([]string, 0)
+		for _, record := range records {
+			outcomes = append(outcomes, record.Outcome)
+		}
+		if strings.Join(outcomes, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("query %+v returned %v, expected %v", test.query, outcomes, test.expected)
+		}
+	}
+
+	/* records older than -retentionMaxAge are discarded */
+	savedMaxAge := retentionMaxAge
+	defer func() { retentionMaxAge = savedMaxAge }()
+	retentionMaxAge = 90 * time.Minute
+	store.add(&auditRecord{Time: now, Outcome: auditOutcomeNone})
+	if records, _ := store.query(auditQuery{}); len(records) != 3 {
+		t.Fatalf("%v records kept, expected 3", len(records))
+	}
+}
+
+func TestMemoryStoreRing(t *testing.T) {
+	savedSize := auditSize
+	defer func() { auditSize = savedSize }()
+	auditSize = 3
+	store := newMemoryStore()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		store.add(&auditRecord{Time: now, EventID: strconv.Itoa(i)})
+	}
+	eventIDs := func() string {
+		records, _ := store.query(auditQuery{})
+		ids := make([]string, 0)
+		for _, record := range records {
+			ids = append(ids, record.EventID)
+		}
+		return strings.Join(ids, ",")
+	}
+	if ids := eventIDs(); ids != "2,3,4" {
+		t.Fatalf("ring kept %v, expected 2,3,4", ids)
+	}
+	if purged, _ := store.purge(auditQuery{Since: now, Until: now.Add(time.Second)}); purged != 3 {
+		t.Fatalf("%v records purged", purged)
+	}
+	store.add(&auditRecord{Time: now, EventID: "5"})
+	if ids := eventIDs(); ids != "5" {
+		t.Fatalf("ring kept %v after a purge, expected 5", ids)
+	}
+
+	/* the ring is resized when -auditRecords changes, keeping the most recent records */
+	store.add(&auditRecord{Time: now, EventID: "6"})
+	auditSize = 1
+	store.add(&auditRecord{Time: now, EventID: "7"})
+	if ids := eventIDs(); ids != "7" {
+		t.Fatalf("resized ring kept %v, expected 7", ids)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedSize := auditSize
+	defer func() { auditSize = savedSize }()
+	auditSize = 3
+
+	path := filepath.Join(dir, "audit.jsonl")
+	store, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	addTestRecords(t, store, now)
+	store.file.Close()
+
+	/* the records are loaded again after a restart */
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.file.Close()
+	records, _ := reopened.query(auditQuery{})
+	if len(records) != 3 || records[0].Outcome != auditOutcomeNone || !records[2].Time.Equal(now) || records[2].Triggers[1] != "notify" {
+		t.Fatalf("unexpected reloaded records %v", records)
+	}
+
+	/* the file is compacted once it contains twice as many records as kept */
+	for i := 0; i < 4; i++ {
+		reopened.add(&auditRecord{Time: now, Outcome: auditOutcomeNone})
+	}
+	data, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines > 2*auditSize {
+		t.Fatalf("file of %v records was not compacted", lines)
+	}
+
+	/* purged records are removed from the file */
+	reopened.add(&auditRecord{Time: now, Repository: "kabanero-io/purged", Outcome: auditOutcomeNone})
+	if purged, err := reopened.purge(auditQuery{Repository: "kabanero-io/purged"}); purged != 1 || err != nil {
+		t.Fatalf("%v records purged: %v", purged, err)
+	}
+	if data, _ = ioutil.ReadFile(path); strings.Contains(string(data), "kabanero-io/purged") {
+		t.Fatal("purged record is still in the file")
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	savedStore := auditStore
+	defer func() { auditStore = savedStore }()
+	auditStore = newMemoryStore()
+	addTestRecords(t, auditStore, time.Now())
+
+	recorder := httptest.NewRecorder()
+	adminEventsHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/events?repository=kabanero-io/appsody&since=90m", nil))
+	records := make([]*auditRecord, 0)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &records); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("query returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(records) != 2 || records[0].Outcome != auditOutcomeError {
+		t.Fatalf("unexpected records %v", records)
+	}
+
+	for _, query := range []string{"since=yesterday", "outcome=success", "limit=-1"} {
+		recorder = httptest.NewRecorder()
+		adminEventsHandler(recorder, httptest.NewRequest(http.MethodGet, "/admin/events?"+query, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("query %v returned %v", query, recorder.Code)
+		}
+	}
+}
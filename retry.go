@@ -0,0 +1,138 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Retry policies of eventDestinations. An eventDestination may declare a retry policy, so that a send failing with a
+transient error of its provider, such as a broker restarting, is retried before it fails: at most maxAttempts attempts
+are made, within maxElapsedTime of the first one if it is set, separated by delays growing from initialInterval up to
+maxInterval with the backoff strategy: exponential, doubling each delay, linear, or constant. Each delay is jittered by
+up to half of it, so that the senders of a destination that failed together do not retry together. The retries are
+made within the send, before the retries of the webhook messages with -sendRetries, or their spooling.
+*/
+
+const (
+	backoffExponential = "exponential"
+	backoffLinear      = "linear"
+	backoffConstant    = "constant"
+
+	defaultRetryMaxAttempts     = 3
+	defaultRetryInitialInterval = 500 * time.Millisecond
+	defaultRetryMaxInterval     = 30 * time.Second
+)
+
+/* Return a random number in [0, 1) to jitter the delays of retries. Replaced in tests */
+var retryJitter = rand.Float64
+
+/* Validate a retry policy */
+func validateRetry(def *RetryDefinition) error {
+	switch def.Backoff {
+	case "", backoffExponential, backoffLinear, backoffConstant:
+	default:
+		return fmt.Errorf("backoff %q is not %s, %s, or %s", def.Backoff, backoffExponential, backoffLinear, backoffConstant)
+	}
+	if def.MaxAttempts < 0 || def.InitialInterval < 0 || def.MaxInterval < 0 || def.MaxElapsedTime < 0 {
+		return fmt.Errorf("maxAttempts, initialInterval, maxInterval, and maxElapsedTime can not be negative")
+	}
+	return nil
+}
+
+/* Validate the retry policies of the eventDestinations */
+func initializeRetries(ed *EventDefinition) error {
+	for _, node := range ed.EventDestinations {
+		if node.Retry == nil {
+			continue
+		}
+		if err := validateRetry(node.Retry); err != nil {
+			return fmt.Errorf("invalid retry of eventDestination %s: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+/* Return the number of attempts of a retry policy */
+func (def *RetryDefinition) attempts() int {
+	if def.MaxAttempts == 0 {
+		return defaultRetryMaxAttempts
+	}
+	return def.MaxAttempts
+}
+
+/* Return the delay before a retry, the first being 1, before it is jittered */
+func (def *RetryDefinition) delay(retry int) time.Duration {
+	initial, max := def.InitialInterval, def.MaxInterval
+	if initial == 0 {
+		initial = defaultRetryInitialInterval
+	}
+	if max == 0 {
+		max = defaultRetryMaxInterval
+	}
+	delay := initial
+	switch def.Backoff {
+	case backoffLinear:
+		delay = initial * time.Duration(retry)
+	case backoffConstant:
+	default:
+		for i := 1; i < retry && delay < max; i++ {
+			delay *= 2
+		}
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+/* Jitter a delay by up to half of it, either way */
+func jitterDelay(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(retryJitter()*float64(delay))
+}
+
+/* Send a message with a provider, retrying the failed sends with the retry policy of the eventDestination */
+func sendWithRetryPolicy(node *EventNode, provider MessageProvider, bytes []byte, header interface{}) error {
+	err := provider.Send(node, bytes, header)
+	if err == nil || node.Retry == nil {
+		return err
+	}
+	start := time.Now()
+	attempts := node.Retry.attempts()
+	for attempt := 2; attempt <= attempts; attempt++ {
+		delay := jitterDelay(node.Retry.delay(attempt - 1))
+		if node.Retry.MaxElapsedTime > 0 && time.Since(start)+delay > node.Retry.MaxElapsedTime {
+			break
+		}
+		if klog.V(3) {
+			klog.Infof("Retrying send to eventDestination %s in %v after attempt %v failed: %v", node.Name, delay, attempt-1, err)
+		}
+		time.Sleep(delay)
+		incrementMetric("retry." + node.Name + ".attempts")
+		if err = provider.Send(node, bytes, header); err == nil {
+			incrementMetric("retry." + node.Name + ".recovered")
+			return nil
+		}
+	}
+	incrementMetric("retry." + node.Name + ".exhausted")
+	return fmt.Errorf("send to eventDestination %s failed after retries: %v", node.Name, err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRetryDelays(t *testing.T) {
+	for _, test := range []struct {
+		def    RetryDefinition
+		delays []time.Duration
+	}{
+		{RetryDefinition{}, []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}},
+		{RetryDefinition{InitialInterval: time.Second, MaxInterval: 5 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{RetryDefinition{Backoff: backoffLinear, InitialInterval: time.Second, MaxInterval: 3 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}},
+		{RetryDefinition{Backoff: backoffConstant, InitialInterval: time.Second}, []time.Duration{time.Second, time.Second}},
+	} {
+		for index, expected := range test.delays {
+			if delay := test.def.delay(index + 1); delay != expected {
+				t.Errorf("delay of retry %v of %+v is %v, expected %v", index+1, test.def, delay, expected)
+			}
+		}
+	}
+
+	savedJitter := retryJitter
+	defer func() { retryJitter = savedJitter }()
+	for jitter, expected := range map[float64]time.Duration{0: 5 * time.Second, 0.5: 10 * time.Second, 0.99: 14900 * time.Millisecond} {
+		retryJitter = func() float64 { return jitter }
+		if delay := jitterDelay(10 * time.Second); delay != expected {
+			t.Errorf("jittered delay is %v, expected %v", delay, expected)
+		}
+	}
+
+	for _, invalid := range []RetryDefinition{{Backoff: "fibonacci"}, {MaxAttempts: -1}, {MaxElapsedTime: -time.Second}} {
+		if err := validateRetry(&invalid); err == nil {
+			t.Errorf("invalid retry %+v was accepted", invalid)
+		}
+	}
+}
+
+func TestSendWithRetryPolicy(t *testing.T) {
+	var ed EventDefinition
+	err := yaml.Unmarshal([]byte(`
+eventDestinations:
+- name: flaky
+  topic: flaky
+  providerRef: failing
+  retry:
+    maxAttempts: 4
+    backoff: constant
+    initialInterval: 1ms
+- name: bounded
+  topic: bounded
+  providerRef: failing
+  retry:
+    maxAttempts: 10
+    initialInterval: 20ms
+    maxElapsedTime: 50ms
+- name: once
+  topic: once
+  providerRef: failing
+`), &ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = initializeRetries(&ed); err != nil {
+		t.Fatal(err)
+	}
+	if ed.EventDestinations[0].Retry.InitialInterval != time.Millisecond {
+		t.Fatalf("unexpected retry %+v", ed.EventDestinations[0].Retry)
+	}
+
+	/* transient failures are retried */
+	provider := &failingProvider{failures: 3}
+	if err = sendWithRetryPolicy(ed.EventDestinations[0], provider, []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if messages, sends := provider.sent(); len(messages) != 1 || sends != 4 {
+		t.Fatalf("unexpected %v messages after %v sends", len(messages), sends)
+	}
+	provider = &failingProvider{failures: 4}
+	if err = sendWithRetryPolicy(ed.EventDestinations[0], provider, []byte("{}"), nil); err == nil {
+		t.Fatal("send succeeded after the attempts of the policy")
+	}
+
+	/* without jitter, the second retry would be 60ms after the first attempt, after the maximum elapsed time */
+	savedJitter := retryJitter
+	defer func() { retryJitter = savedJitter }()
+	retryJitter = func() float64 { return 0.5 }
+	provider = &failingProvider{failures: 10}
+	if err = sendWithRetryPolicy(ed.EventDestinations[1], provider, []byte("{}"), nil); err == nil {
+		t.Fatal("send of a failing provider succeeded")
+	}
+	if _, sends := provider.sent(); sends != 2 {
+		t.Fatalf("unexpected %v sends within the maximum elapsed time", sends)
+	}
+
+	/* destinations without a policy are sent to once */
+	provider = &failingProvider{failures: 1}
+	if err = sendWithRetryPolicy(ed.EventDestinations[2], provider, []byte("{}"), nil); err == nil {
+		t.Fatal("send of a destination without retry policy was retried")
+	}
+	if _, sends := provider.sent(); sends != 1 {
+		t.Fatalf("unexpected %v sends", sends)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"k8s.io/klog"
+)
+
+/*
+Retry hints of GitHub errors. A failed GitHub API call is classified by its cause: the primary rate limit, the
+secondary (abuse) rate limit, a missing file or repository, missing permissions, a server error, or a network error,
+and whether retrying later may succeed, and when. The hint is returned to the trigger by downloadYAML, and attached to
+the outcome of the event in its audit record. An event whose processing hit a retryable error without executing any
+action is requeued to its event source, after the delay of the hint, or else with exponential backoff, at most
+-requeueAttempts times. Events failing for other reasons are not requeued, since retrying them can not succeed.
+*/
+
+const (
+	retryReasonRateLimit          = "rate_limit"
+	retryReasonSecondaryRateLimit = "secondary_rate_limit"
+	retryReasonNotFound           = "not_found"
+	retryReasonForbidden          = "forbidden"
+	retryReasonUnauthorized       = "unauthorized"
+	retryReasonServerError        = "server_error"
+	retryReasonNetwork            = "network"
+
+	REQUEUEATTEMPT = "requeueAttempt" // number of times a message was requeued
+
+	defaultSecondaryRetryAfter = time.Minute // GitHub recommends waiting at least a minute without a Retry-After
+)
+
+var (
+	requeueAttempts int           // maximum requeues of an event that hit a retryable error
+	requeueBackoff  time.Duration // delay before the first requeue without a hint, doubled for each requeue
+	requeueMaxDelay time.Duration // maximum delay before a requeue
+)
+
+/* Whether, and when, a failed call may be retried */
+type retryHint struct {
+	Reason     string `json:"reason"`
+	Retryable  bool   `json:"retryable"`
+	RetryAfter int64  `json:"retryAfterSeconds,omitempty"`
+	Status     int    `json:"status,omitempty"`
+}
+
+/* The delay of a hint */
+func (hint *retryHint) delay() time.Duration {
+	return time.Duration(hint.RetryAfter) * time.Second
+}
+
+/* An error of a GitHub API call, with its retry hint */
+type gitHubError struct {
+	err  error
+	hint *retryHint
+}
+
+func (e *gitHubError) Error() string {
+	return fmt.Sprintf("%v (%v)", e.err, e.hint.Reason)
+}
+
+/* Return the retry hint of an error, nil if it has none */
+func retryHintOf(err error) *retryHint {
+	if e, ok := err.(*gitHubError); ok {
+		return e.hint
+	}
+	return nil
+}
+
+/* Return the seconds until a time, at least one */
+func secondsUntil(t time.Time, now time.Time) int64 {
+	return int64(math.Max(1, math.Ceil(t.Sub(now).Seconds())))
+}
+
+/* Return the seconds of the Retry-After header of a response, 0 if none */
+func retryAfterHeader(header http.Header) int64 {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(header.Get("Retry-After")), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+/* Classify the error of a GitHub API call and its response, which is nil if no response was received */
+func classifyGitHubError(resp *http.Response, err error, now time.Time) *retryHint {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return &retryHint{Reason: retryReasonRateLimit, Retryable: true, RetryAfter: secondsUntil(e.Rate.Reset.Time, now), Status: http.StatusForbidden}
+	case *github.AbuseRateLimitError:
+		hint := &retryHint{Reason: retryReasonSecondaryRateLimit, Retryable: true, RetryAfter: int64(defaultSecondaryRetryAfter / time.Second), Status: http.StatusForbidden}
+		if e.RetryAfter != nil {
+			hint.RetryAfter = int64(math.Max(1, e.RetryAfter.Seconds()))
+		}
+		return hint
+	case *github.ErrorResponse:
+		if resp == nil {
+			resp = e.Response
+		}
+	}
+	if resp == nil {
+		return &retryHint{Reason: retryReasonNetwork, Retryable: true}
+	}
+
+	hint := &retryHint{Status: resp.StatusCode, RetryAfter: retryAfterHeader(resp.Header)}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.Header.Get("X-RateLimit-Remaining") == "0":
+		hint.Reason, hint.Retryable = retryReasonRateLimit, true
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil && hint.RetryAfter == 0 {
+			hint.RetryAfter = secondsUntil(time.Unix(reset, 0), now)
+		}
+	case resp.StatusCode == http.StatusForbidden && (hint.RetryAfter > 0 || (err != nil && strings.Contains(strings.ToLower(err.Error()), "secondary rate limit"))):
+		hint.Reason, hint.Retryable = retryReasonSecondaryRateLimit, true
+		if hint.RetryAfter == 0 {
+			hint.RetryAfter = int64(defaultSecondaryRetryAfter / time.Second)
+		}
+	case resp.StatusCode == http.StatusNotFound:
+		/* a private repository the token can not read is also not found */
+		hint.Reason = retryReasonNotFound
+	case resp.StatusCode == http.StatusForbidden:
+		hint.Reason = retryReasonForbidden
+	case resp.StatusCode == http.StatusUnauthorized:
+		hint.Reason = retryReasonUnauthorized
+	case resp.StatusCode >= http.StatusInternalServerError:
+		hint.Reason, hint.Retryable = retryReasonServerError, true
+	default:
+		return nil
+	}
+	return hint
+}
+
+/* Describe the error of a GitHub API call, and wrap it with its retry hint */
+func gitHubCallError(resp *github.Response, err error, description string) error {
+	var response *http.Response
+	if resp != nil {
+		response = resp.Response
+	}
+	described := fmt.Errorf("%s: %v", description, err)
+	hint := classifyGitHubError(response, err, time.Now())
+	if hint == nil {
+		return described
+	}
+	incrementMetric("github.errors." + hint.Reason)
+	return &gitHubError{err: described, hint: hint}
+}
+
+/* Combine the hints of the triggers of an event: retrying is worth it if any hint is retryable, after the last delay */
+func mergeRetryHints(hint *retryHint, other *retryHint) *retryHint {
+	if other == nil {
+		return hint
+	}
+	if hint == nil || (other.Retryable && !hint.Retryable) || (other.Retryable == hint.Retryable && other.RetryAfter > hint.RetryAfter) {
+		return other
+	}
+	return hint
+}
+
+/* Return the delay before requeuing a message for the given attempt, starting at 0 */
+func requeueDelay(hint *retryHint, attempt int) time.Duration {
+	delay := requeueBackoff << uint(attempt)
+	if hint.delay() > delay {
+		delay = hint.delay()
+	}
+	if requeueMaxDelay > 0 && delay > requeueMaxDelay {
+		delay = requeueMaxDelay
+	}
+	return delay
+}
+
+/* Return the number of times a message was requeued */
+func messageRequeueAttempt(message map[string]interface{}) int {
+	switch attempt := message[REQUEUEATTEMPT].(type) {
+	case float64:
+		return int(attempt)
+	case int:
+		return attempt
+	}
+	return 0
+}
+
+/*
+Requeue a message to its event source if its processing hit a retryable error, without executing any action, which
+would be executed again. Return the delay of the requeue, 0 if the message is not requeued.
+*/
+func requeueMessage(message map[string]interface{}, eventSource string, result *evalResult) time.Duration {
+	if result == nil || result.retry == nil || !result.retry.Retryable || len(result.actions) > 0 {
+		return 0
+	}
+	eventID := messageEventID(message)
+	attempt := messageRequeueAttempt(message)
+	if attempt >= requeueAttempts {
+		if requeueAttempts > 0 {
+			incrementMetric("requeue.exhausted")
+			eventWarning(eventID, "Not requeuing message again", logFields{"eventSource": eventSource, "attempts": attempt, "reason": result.retry.Reason})
+		}
+		return 0
+	}
+	delay := requeueDelay(result.retry, attempt)
+	requeued := make(map[string]interface{}, len(message)+1)
+	for key, value := range message {
+		requeued[key] = value
+	}
+	requeued[REQUEUEATTEMPT] = attempt + 1
+	bytes, err := json.Marshal(requeued)
+	if err != nil {
+		klog.Errorf("Unable to marshal message %v to requeue: %v", eventID, err)
+		return 0
+	}
+	incrementMetric("requeue.scheduled")
+	eventInfo(eventID, "Requeuing message", logFields{"eventSource": eventSource, "attempt": attempt + 1, "delay": delay.String(), "reason": result.retry.Reason})
+	time.AfterFunc(delay, func() {
+		if err := sendToDestinationNow(eventSource, bytes, nil); err != nil {
+			incrementMetric("requeue.failed")
+			eventError(eventID, "Unable to requeue message", logFields{"eventSource": eventSource, "error": err})
+		}
+	})
+	return delay
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClassifyGitHubErrors(t *testing.T) {
+	reset := time.Now().Add(90 * time.Second).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/api/v3/repos/owner/limited/contents/file.yaml":
+			writer.Header().Set("X-RateLimit-Limit", "5000")
+			writer.Header().Set("X-RateLimit-Remaining", "0")
+			writer.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+			writer.WriteHeader(http.StatusForbidden)
+			writer.Write([]byte(`{"message": "API rate limit exceeded for user ID 1."}`))
+		case "/api/v3/repos/owner/abused/contents/file.yaml":
+			writer.Header().Set("Retry-After", "120")
+			writer.WriteHeader(http.StatusForbidden)
+			writer.Write([]byte(`{"message": "You have exceeded a secondary rate limit.", "documentation_url": "https://developer.github.com/v3/#abuse-rate-limits"}`))
+		case "/api/v3/repos/owner/secondary/contents/file.yaml":
+			writer.WriteHeader(http.StatusForbidden)
+			writer.Write([]byte(`{"message": "You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`))
+		case "/api/v3/repos/owner/private/contents/file.yaml":
+			writer.WriteHeader(http.StatusForbidden)
+			writer.Write([]byte(`{"message": "Resource not accessible by integration"}`))
+		case "/api/v3/repos/owner/unavailable/contents/file.yaml":
+			writer.WriteHeader(http.StatusBadGateway)
+			writer.Write([]byte(`{"message": "Server Error"}`))
+		default:
+			writer.WriteHeader(http.StatusNotFound)
+			writer.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	defer server.Close()
+
+	for repository, expected := range map[string]retryHint{
+		"limited":     {Reason: retryReasonRateLimit, Retryable: true, Status: http.StatusForbidden},
+		"abused":      {Reason: retryReasonSecondaryRateLimit, Retryable: true, RetryAfter: 120, Status: http.StatusForbidden},
+		"secondary":   {Reason: retryReasonSecondaryRateLimit, Retryable: true, RetryAfter: 60, Status: http.StatusForbidden},
+		"private":     {Reason: retryReasonForbidden, Status: http.StatusForbidden},
+		"missing":     {Reason: retryReasonNotFound, Status: http.StatusNotFound},
+		"unavailable": {Reason: retryReasonServerError, Retryable: true, Status: http.StatusBadGateway},
+	} {
+		_, exists, err := downloadFileFromGithub("owner", repository, "file.yaml", "", server.URL, "user", "token", true)
+		hint := retryHintOf(err)
+		if exists || hint == nil {
+			t.Errorf("expected a retry hint downloading from %v, got %v", repository, err)
+			continue
+		}
+		if repository == "limited" {
+			/* the delay is until the reset of the rate limit */
+			if hint.RetryAfter < 80 || hint.RetryAfter > 91 {
+				t.Errorf("unexpected delay %v until the reset of the rate limit", hint.RetryAfter)
+			}
+			hint.RetryAfter = 0
+		}
+		if *hint != expected {
+			t.Errorf("unexpected hint %+v downloading from %v", hint, repository)
+		}
+	}
+
+	server.Close()
+	_, _, err := downloadFileFromGithub("owner", "repo", "file.yaml", "", server.URL, "user", "token", true)
+	if hint := retryHintOf(err); hint == nil || hint.Reason != retryReasonNetwork || !hint.Retryable {
+		t.Errorf("unexpected hint %+v of a network error %v", hint, err)
+	}
+}
+
+func TestMergeRetryHints(t *testing.T) {
+	notFound := &retryHint{Reason: retryReasonNotFound}
+	limited := &retryHint{Reason: retryReasonRateLimit, Retryable: true, RetryAfter: 30}
+	abused := &retryHint{Reason: retryReasonSecondaryRateLimit, Retryable: true, RetryAfter: 60}
+	if hint := mergeRetryHints(mergeRetryHints(nil, notFound), limited); hint != limited {
+		t.Errorf("unexpected hint %+v", hint)
+	}
+	if hint := mergeRetryHints(mergeRetryHints(abused, limited), notFound); hint != abused {
+		t.Errorf("unexpected hint %+v", hint)
+	}
+}
+
+func TestRequeueMessage(t *testing.T) {
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	savedAttempts, savedBackoff, savedMax := requeueAttempts, requeueBackoff, requeueMaxDelay
+	defer func() {
+		messageProviders, eventProviders = savedProviders, savedDefinitions
+		requeueAttempts, requeueBackoff, requeueMaxDelay = savedAttempts, savedBackoff, savedMax
+	}()
+	provider := &capturingProvider{}
+	messageProviders = map[string]MessageProvider{"sink": provider}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: "source", ProviderRef: "sink"}}}
+	requeueAttempts, requeueBackoff, requeueMaxDelay = 2, time.Millisecond, 10*time.Millisecond
+
+	result := &evalResult{retry: &retryHint{Reason: retryReasonSecondaryRateLimit, Retryable: true, RetryAfter: 60}}
+	message := map[string]interface{}{EVENTID: "event-1", "body": map[string]interface{}{}}
+	/* the delay of the hint is bounded by -requeueMaxDelay */
+	if delay := requeueMessage(message, "source", result); delay != 10*time.Millisecond {
+		t.Fatalf("unexpected delay %v", delay)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		provider.mutex.Lock()
+		sent := len(provider.messages)
+		provider.mutex.Unlock()
+		if sent == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the message was not requeued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	requeued := make(map[string]interface{})
+	json.Unmarshal(provider.messages[0], &requeued)
+	if messageRequeueAttempt(requeued) != 1 || requeued[EVENTID] != "event-1" {
+		t.Fatalf("unexpected requeued message %v", requeued)
+	}
+
+	/* the attempts are bounded */
+	requeued[REQUEUEATTEMPT] = float64(2)
+	if delay := requeueMessage(requeued, "source", result); delay != 0 {
+		t.Fatalf("requeued a message after %v attempts", requeued[REQUEUEATTEMPT])
+	}
+	/* events that executed actions, or failed for other reasons, are not requeued */
+	if delay := requeueMessage(message, "source", &evalResult{retry: result.retry, actions: []string{"sendEvent dest"}}); delay != 0 {
+		t.Fatal("requeued a message that executed actions")
+	}
+	if delay := requeueMessage(message, "source", &evalResult{retry: &retryHint{Reason: retryReasonNotFound}}); delay != 0 {
+		t.Fatal("requeued a message that can not succeed")
+	}
+	if delay := requeueMessage(message, "source", &evalResult{}); delay != 0 {
+		t.Fatal("requeued a message without a retry hint")
+	}
+}
+
+func TestRequeueDelay(t *testing.T) {
+	savedBackoff, savedMax := requeueBackoff, requeueMaxDelay
+	defer func() { requeueBackoff, requeueMaxDelay = savedBackoff, savedMax }()
+	requeueBackoff, requeueMaxDelay = 30*time.Second, time.Hour
+	hint := &retryHint{Reason: retryReasonServerError, Retryable: true}
+	if delay := requeueDelay(hint, 2); delay != 2*time.Minute {
+		t.Errorf("unexpected delay %v", delay)
+	}
+	hint.RetryAfter = 600
+	if delay := requeueDelay(hint, 0); delay != 10*time.Minute {
+		t.Errorf("unexpected delay %v", delay)
+	}
+}
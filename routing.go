@@ -0,0 +1,113 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+Routing webhook messages by event kind. An eventDestination may declare the kinds of events it accepts, such as push,
+pull_request, tag, and image-push, with "accepts". The messages received by the listeners are then sent to every
+eventDestination accepting their kind, rather than all to the destination of the path they were received on. A
+message of a kind that no destination accepts is sent to the destination of its path, unless that destination declares
+the kinds it accepts. Destinations declaring nothing accept nothing by kind, so that without any "accepts" the messages
+go to the destination of their path, as they always did.
+*/
+
+/* Normalized event kinds */
+const (
+	eventKindPush        = "push"
+	eventKindPullRequest = "pull_request"
+	eventKindTag         = "tag"
+	eventKindImagePush   = "image-push"
+	eventKindAlert       = "alert" // an alert of Alertmanager
+	eventKindSlack       = "slack" // a slash command, interaction, or event of Slack
+	eventKindAny         = "*"     // accepted by a destination accepting every kind
+)
+
+/*
+Return the normalized kind of a webhook message: tag for the pushes and creations of tags, image-push for the
+notifications of pushed images of GitHub packages, Docker Hub, Quay, and Harbor, and otherwise its GitHub event type.
+Empty if it has none.
+*/
+func eventKind(header http.Header, body map[string]interface{}) string {
+	eventType := header.Get("X-Github-Event")
+	switch eventType {
+	case "push":
+		if ref, _ := body["ref"].(string); strings.HasPrefix(ref, "refs/tags/") {
+			return eventKindTag
+		}
+		return eventKindPush
+	case "create":
+		if refType, _ := body["ref_type"].(string); refType == "tag" {
+			return eventKindTag
+		}
+	case "package", "registry_package":
+		return eventKindImagePush
+	case "":
+		/* registries do not send a GitHub event type */
+		if registrySource(body) != "" {
+			return eventKindImagePush
+		}
+	}
+	return eventType
+}
+
+/* Return whether a destination accepts an event kind */
+func (node *EventNode) acceptsKind(kind string) bool {
+	for _, accepted := range node.Accepts {
+		if accepted == eventKindAny || (kind != "" && accepted == kind) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Return the destinations of a webhook message of a kind received for a destination: those accepting its kind, in the
+order of eventDefinitions.yaml, or the destination it was received for
+*/
+func routeEventKind(destination string, kind string) []string {
+	ed := currentEventProviders()
+	if ed == nil {
+		return []string{destination}
+	}
+	routed := make([]string, 0)
+	declared := false
+	for _, node := range ed.EventDestinations {
+		if len(node.Accepts) == 0 {
+			continue
+		}
+		declared = true
+		if node.acceptsKind(kind) {
+			routed = append(routed, node.Name)
+		}
+	}
+	if !declared {
+		return []string{destination}
+	}
+	if len(routed) > 0 {
+		return routed
+	}
+	if node := ed.GetEventDestination(destination); node != nil && len(node.Accepts) > 0 {
+		/* the destination of the path only accepts other kinds */
+		return routed
+	}
+	return []string{destination}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEventKind(t *testing.T) {
+	tests := []struct {
+		eventType string
+		body      map[string]interface{}
+		kind      string
+	}{
+		{"push", map[string]interface{}{"ref": "refs/heads/master"}, eventKindPush},
+		{"push", map[string]interface{}{"ref": "refs/tags/v1.0"}, eventKindTag},
+		{"create", map[string]interface{}{"ref_type": "tag"}, eventKindTag},
+		{"create", map[string]interface{}{"ref_type": "branch"}, "create"},
+		{"pull_request", map[string]interface{}{"action": "opened"}, eventKindPullRequest},
+		{"registry_package", map[string]interface{}{}, eventKindImagePush},
+		{"", map[string]interface{}{"push_data": map[string]interface{}{"tag": "latest"}}, eventKindImagePush},
+		{"", map[string]interface{}{"updated_tags": []interface{}{"latest"}}, eventKindImagePush},
+		{"", map[string]interface{}{"type": "PUSH_ARTIFACT"}, eventKindImagePush},
+		{"", map[string]interface{}{}, ""},
+	}
+	for _, test := range tests {
+		header := make(http.Header)
+		if test.eventType != "" {
+			header.Set("X-Github-Event", test.eventType)
+		}
+		if kind := eventKind(header, test.body); kind != test.kind {
+			t.Errorf("kind of %v event %v is %q, expected %q", test.eventType, test.body, kind, test.kind)
+		}
+	}
+}
+
+func TestRouteEventKind(t *testing.T) {
+	webhook, other := &failingProvider{}, &failingProvider{}
+	defer setupDeadLetters(t, webhook, other)()
+
+	/* without any accepts, messages go to the destination of their path */
+	if routed := routeEventKind("dlq", eventKindPush); len(routed) != 1 || routed[0] != "dlq" {
+		t.Fatalf("unexpected destinations %v", routed)
+	}
+
+	eventProviders.EventDestinations[0].Accepts = []string{eventKindPush, eventKindPullRequest}
+	eventProviders.EventDestinations = append(eventProviders.EventDestinations,
+		&EventNode{Name: "releases", ProviderRef: "dlq", Accepts: []string{eventKindTag, eventKindImagePush}},
+		&EventNode{Name: "audit", ProviderRef: "dlq", Accepts: []string{eventKindAny}})
+	tests := map[string][]string{
+		eventKindPush:      {WEBHOOKDESTINATION, "audit"},
+		eventKindTag:       {"releases", "audit"},
+		eventKindImagePush: {"releases", "audit"},
+		"issues":           {"audit"},
+	}
+	for kind, expected := range tests {
+		routed := routeEventKind(WEBHOOKDESTINATION, kind)
+		if strings.Join(routed, ",") != strings.Join(expected, ",") {
+			t.Errorf("%v events routed to %v, expected %v", kind, routed, expected)
+		}
+	}
+
+	/* without a catch-all, a kind nobody accepts goes to the path's destination only if it declares nothing */
+	eventProviders.EventDestinations = eventProviders.EventDestinations[:3]
+	if routed := routeEventKind("dlq", "issues"); len(routed) != 1 || routed[0] != "dlq" {
+		t.Fatalf("issues of a path without accepts routed to %v", routed)
+	}
+	if routed := routeEventKind(WEBHOOKDESTINATION, "issues"); len(routed) != 0 {
+		t.Fatalf("issues of a path accepting other kinds routed to %v", routed)
+	}
+
+	/* tags are sent to releases, and unrouted messages are accepted and dropped */
+	header := http.Header{"X-Github-Event": {"push"}}
+	if err := sendWebhookMessage(header, map[string]interface{}{"ref": "refs/tags/v1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendWebhookMessage(http.Header{"X-Github-Event": {"issues"}}, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendWebhookMessage(header, map[string]interface{}{"ref": "refs/heads/master"}); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := webhook.sent()
+	releases, _ := other.sent()
+	if len(messages) != 1 || len(releases) != 1 {
+		t.Fatalf("unexpected messages %s sent to github and %s to releases", messages, releases)
+	}
+
+	/* a message that can not be marshalled is not reported as sent */
+	if err := sendWebhookMessage(header, map[string]interface{}{"ref": "refs/heads/master", "size": math.Inf(1)}); err == nil {
+		t.Fatal("message that can not be marshalled was reported as sent")
+	}
+	if messages, _ = webhook.sent(); len(messages) != 1 {
+		t.Fatalf("unexpected messages %s sent to github", messages)
+	}
+}
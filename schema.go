@@ -0,0 +1,178 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+/*
+JSON Schema of the typed trigger context, generated from the structs in typed_event.go so that it can not get out of
+date. The schema of an event type describes the context variable of a trigger receiving that event type.
+*/
+
+/* Generate the JSON Schema of a Go type */
+func jsonSchemaOf(typ reflect.Type) map[string]interface{} {
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return jsonSchemaOf(typ.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaOf(typ.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaOf(typ.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name := jsonFieldName(field)
+			if name == "" {
+				continue
+			}
+			properties[name] = jsonFieldSchema(field)
+			required = append(required, name)
+		}
+		sort.Strings(required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+/* Generate the schema of a struct field, with its description and whether it is an enrichment */
+func jsonFieldSchema(field reflect.StructField) map[string]interface{} {
+	schema := jsonSchemaOf(field.Type)
+	if description := field.Tag.Get("description"); description != "" {
+		schema["description"] = description
+	}
+	if field.Tag.Get("enrichment") == "true" {
+		schema["x-enrichment"] = true
+	}
+	return schema
+}
+
+/* Return the JSON name of a struct field, or an empty string if it is not serialized */
+func jsonFieldName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name
+}
+
+/* Generate the JSON Schema of the trigger context for an event type */
+func triggerContextSchema(eventType string) (map[string]interface{}, error) {
+	payloadField, ok := typedEventTypes[eventType]
+	if !ok {
+		return nil, fmt.Errorf("event type %v does not have a typed context", eventType)
+	}
+	schema := jsonSchemaOf(reflect.TypeOf(TriggerContext{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "Trigger context of " + eventType + " events"
+
+	/* the payloads of other event types are present, but always empty */
+	properties := schema["properties"].(map[string]interface{})
+	for _, otherField := range typedEventTypes {
+		if otherField != payloadField {
+			delete(properties, otherField)
+		}
+	}
+	required := make([]string, 0)
+	for name := range properties {
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	schema["required"] = required
+	return schema, nil
+}
+
+/* Generate the schemas of all event types with a typed context */
+func triggerContextSchemas() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	for eventType := range typedEventTypes {
+		schema, _ := triggerContextSchema(eventType)
+		schemas[eventType] = schema
+	}
+	return schemas
+}
+
+/* GET /admin/schema returns the schemas of all event types. GET /admin/schema?eventType=<type> returns one schema. */
+func adminSchemaHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	eventType := req.URL.Query().Get("eventType")
+	if eventType == "" {
+		writeJSON(writer, triggerContextSchemas())
+		return
+	}
+	schema, err := triggerContextSchema(eventType)
+	if err != nil {
+		writeError(writer, req, codeNotFound, err.Error())
+		return
+	}
+	writeJSON(writer, schema)
+}
+
+/*
+schemaCommand implements "kabanero-events schema [eventType]".
+It prints the JSON Schema of the trigger context of the event type, or of all event types if none is given.
+*/
+func schemaCommand(args []string) int {
+	var value interface{}
+	switch len(args) {
+	case 0:
+		value = triggerContextSchemas()
+	case 1:
+		schema, err := triggerContextSchema(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "schema: %v\n", err)
+			return 1
+		}
+		value = schema
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: kabanero-events schema [eventType]\n")
+		return 2
+	}
+	bytes, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "schema: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s\n", bytes)
+	return 0
+}
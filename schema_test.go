@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTriggerContextSchema(t *testing.T) {
+	schema, err := triggerContextSchema("push")
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := schema["properties"].(map[string]interface{})
+	if _, ok := properties["pull_request"]; ok {
+		t.Fatalf("push schema contains pull_request payload")
+	}
+	push, ok := properties["push"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("push schema does not contain push payload: %v", properties)
+	}
+	branch := push["properties"].(map[string]interface{})["branch"].(map[string]interface{})
+	if branch["type"] != "string" || branch["x-enrichment"] != true {
+		t.Fatalf("unexpected schema of enrichment branch: %v", branch)
+	}
+	commits := push["properties"].(map[string]interface{})["commits"].(map[string]interface{})
+	if commits["type"] != "array" {
+		t.Fatalf("unexpected schema of commits: %v", commits)
+	}
+
+	if _, err = triggerContextSchema("unknown"); err == nil {
+		t.Fatal("expected error for event type without typed context")
+	}
+}
@@ -0,0 +1,441 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Cache of the secrets holding the API tokens of git repositories. The secrets of the namespace annotated with
+kabanero.io/git-* or tekton.dev/git-* URLs are listed and watched, and indexed by URL, so that the token of a
+repository is found without listing the secrets for each event. The secrets are listed again at each resync.
+
+An annotation holds one or more URL patterns separated by commas or spaces. A pattern is a prefix of the URLs of the
+repositories, such as https://github.com/myorg, or contains * wildcards, which match within a path segment, such as
+https://github.com/myorg/* for the repositories of an organization. An annotation whose value starts with regex: holds a
+single regular expression matching the whole URL instead. When several secrets match a repository, a pattern equal to
+the URL of the repository is preferred, then the prefix or wildcard pattern with the most characters other than *, and
+then regular expressions. Secrets that match equally are taken in the order of their names.
+*/
+
+const (
+	kabaneroGitAnnotationPrefix = "kabanero.io/git-"
+	tektonGitAnnotationPrefix   = "tekton.dev/git-"
+	regexURLPatternPrefix       = "regex:"
+)
+
+/* The precedence of the kinds of URL patterns, the lowest first */
+const (
+	urlMatchExact = iota
+	urlMatchPrefix
+	urlMatchRegex
+)
+
+var (
+	secretsResync time.Duration // interval between resyncs of the cache of the secrets. No periodic resync if 0
+
+	gitSecrets = newSecretsCache()
+
+	namespaceSecretsMutex sync.Mutex
+	namespaceSecrets      = make(map[string]*secretsCache) // caches of the namespaces of other Kabanero instances
+)
+
+/* A secret annotated with git URLs */
+type gitSecret struct {
+	name     string
+	kabanero []string // URL patterns of the kabanero.io/git- annotations
+	tekton   []string // URL patterns of the tekton.dev/git- annotations
+	username string   // base64 encoded
+	token    string   // base64 encoded
+	hasToken bool
+}
+
+/* Secrets annotated with git URLs, indexed by URL */
+type secretsCache struct {
+	mutex     sync.RWMutex
+	synced    bool
+	namespace string
+	secrets   map[string]*gitSecret     // by name
+	index     map[string][]string       // names of the secrets, by annotated URL pattern
+	patterns  map[string]*gitURLPattern // compiled URL patterns of the index
+}
+
+func newSecretsCache() *secretsCache {
+	return &secretsCache{secrets: make(map[string]*gitSecret), index: make(map[string][]string), patterns: make(map[string]*gitURLPattern)}
+}
+
+/* A compiled URL pattern of an annotation */
+type gitURLPattern struct {
+	text   string
+	prefix string         // the pattern, if it has no wildcard
+	regex  *regexp.Regexp // the regular expression, or the wildcard pattern
+	isRE   bool           // whether the pattern is a regex: pattern
+	length int            // number of characters of the pattern other than wildcards
+}
+
+/* Compile an annotated URL pattern */
+func compileURLPattern(text string) (*gitURLPattern, error) {
+	if strings.HasPrefix(text, regexURLPatternPrefix) {
+		regex, err := regexp.Compile("^(?:" + strings.TrimPrefix(text, regexURLPatternPrefix) + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &gitURLPattern{text: text, regex: regex, isRE: true}, nil
+	}
+	if !strings.Contains(text, "*") {
+		return &gitURLPattern{text: text, prefix: text, length: len(text)}, nil
+	}
+	/* a wildcard matches within a segment, and the URL may continue after the pattern, as for prefixes */
+	parts := strings.Split(text, "*")
+	quoted := make([]string, len(parts))
+	for index, part := range parts {
+		quoted[index] = regexp.QuoteMeta(part)
+	}
+	regex, err := regexp.Compile("^" + strings.Join(quoted, "[^/]*") + "(?:[/.].*)?$")
+	if err != nil {
+		return nil, err
+	}
+	return &gitURLPattern{text: text, regex: regex, length: len(text) - len(parts) + 1}, nil
+}
+
+/* Remove the trailing / or .git of a URL */
+func normalizeRepoURL(url string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+}
+
+/* Return whether a URL matches the pattern, and the precedence of the match */
+func (pattern *gitURLPattern) match(repoURL string) (bool, int) {
+	if !pattern.isRE && normalizeRepoURL(pattern.text) == normalizeRepoURL(repoURL) {
+		return true, urlMatchExact
+	}
+	switch {
+	case pattern.isRE:
+		return pattern.regex.MatchString(repoURL), urlMatchRegex
+	case pattern.regex != nil:
+		return pattern.regex.MatchString(repoURL), urlMatchPrefix
+	}
+	return strings.HasPrefix(repoURL, pattern.prefix), urlMatchPrefix
+}
+
+/* Return the URL patterns of an annotation */
+func splitURLPatterns(value string) []string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, regexURLPatternPrefix) {
+		return []string{value}
+	}
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+/* Return the secret of an object, or nil if it is not annotated with git URLs */
+func newGitSecret(obj *unstructured.Unstructured) *gitSecret {
+	secret := &gitSecret{name: obj.GetName()}
+	for key, value := range obj.GetAnnotations() {
+		if strings.HasPrefix(key, kabaneroGitAnnotationPrefix) {
+			secret.kabanero = append(secret.kabanero, splitURLPatterns(value)...)
+		} else if strings.HasPrefix(key, tektonGitAnnotationPrefix) {
+			secret.tekton = append(secret.tekton, splitURLPatterns(value)...)
+		}
+	}
+	if secret.name == "" || len(secret.kabanero)+len(secret.tekton) == 0 {
+		return nil
+	}
+	dataMap, ok := obj.Object[DATA].(map[string]interface{})
+	if ok {
+		username, usernameOK := dataMap[USERNAME].(string)
+		token, tokenOK := dataMap[PASSWORD].(string)
+		if usernameOK && tokenOK {
+			secret.username, secret.token, secret.hasToken = username, token, true
+		}
+	}
+	return secret
+}
+
+/* Add or replace a secret. Called with the lock held */
+func (cache *secretsCache) add(secret *gitSecret) {
+	cache.remove(secret.name)
+	cache.secrets[secret.name] = secret
+	for _, urls := range [][]string{secret.kabanero, secret.tekton} {
+		for _, url := range urls {
+			if _, ok := cache.patterns[url]; !ok {
+				pattern, err := compileURLPattern(url)
+				if err != nil {
+					klog.Warningf("Ignoring URL pattern %v of secret %v: %v", url, secret.name, err)
+					continue
+				}
+				cache.patterns[url] = pattern
+			}
+			cache.index[url] = append(cache.index[url], secret.name)
+		}
+	}
+}
+
+/* Remove a secret. Called with the lock held */
+func (cache *secretsCache) remove(name string) {
+	secret, ok := cache.secrets[name]
+	if !ok {
+		return
+	}
+	delete(cache.secrets, name)
+	for _, urls := range [][]string{secret.kabanero, secret.tekton} {
+		for _, url := range urls {
+			names := make([]string, 0, len(cache.index[url]))
+			for _, indexed := range cache.index[url] {
+				if indexed != name {
+					names = append(names, indexed)
+				}
+			}
+			if len(names) == 0 {
+				delete(cache.index, url)
+				delete(cache.patterns, url)
+			} else {
+				cache.index[url] = names
+			}
+		}
+	}
+}
+
+/* Update the cache with a secret that was added or modified */
+func (cache *secretsCache) update(obj *unstructured.Unstructured) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if secret := newGitSecret(obj); secret != nil {
+		cache.add(secret)
+	} else {
+		/* the annotations may have been removed */
+		cache.remove(obj.GetName())
+	}
+}
+
+/* Remove a deleted secret from the cache */
+func (cache *secretsCache) delete(obj *unstructured.Unstructured) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.remove(obj.GetName())
+}
+
+/* Replace the content of the cache with the listed secrets */
+func (cache *secretsCache) replace(namespace string, objs []unstructured.Unstructured) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.namespace = namespace
+	cache.secrets = make(map[string]*gitSecret)
+	cache.index = make(map[string][]string)
+	cache.patterns = make(map[string]*gitURLPattern)
+	for index := range objs {
+		if secret := newGitSecret(&objs[index]); secret != nil {
+			cache.add(secret)
+		}
+	}
+	cache.synced = true
+}
+
+/* Return the cached secrets */
+func (cache *secretsCache) list() []*gitSecret {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	secrets := make([]*gitSecret, 0, len(cache.secrets))
+	for _, secret := range cache.secrets {
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
+/* Return whether the cache was loaded with the secrets of a namespace */
+func (cache *secretsCache) isSyncedFor(namespace string) bool {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	return cache.synced && cache.namespace == namespace
+}
+
+/*
+Find the user and token of a repository: among the secrets with a token whose kabanero.io/git- or tekton.dev/git- URL
+patterns match repoURL, the one with the best match, as described above. Return: username, token, secret name, error
+*/
+func (cache *secretsCache) lookup(repoURL string) (string, string, string, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+
+	/* the best match of each secret */
+	type secretMatch struct {
+		name       string
+		url        string
+		precedence int
+		length     int
+	}
+	best := make(map[string]*secretMatch)
+	for url, indexed := range cache.index {
+		pattern := cache.patterns[url]
+		matched, precedence := pattern.match(repoURL)
+		if !matched {
+			continue
+		}
+		for _, name := range indexed {
+			current, ok := best[name]
+			if !ok || precedence < current.precedence || (precedence == current.precedence && pattern.length > current.length) {
+				best[name] = &secretMatch{name: name, url: url, precedence: precedence, length: pattern.length}
+			}
+		}
+	}
+	matches := make([]*secretMatch, 0, len(best))
+	for _, match := range best {
+		if cache.secrets[match.name].hasToken {
+			matches = append(matches, match)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].precedence != matches[j].precedence {
+			return matches[i].precedence < matches[j].precedence
+		}
+		if matches[i].length != matches[j].length {
+			return matches[i].length > matches[j].length
+		}
+		return matches[i].name < matches[j].name
+	})
+	if len(matches) == 0 {
+		return "", "", "", &noAPITokenError{repoURL}
+	}
+
+	match := matches[0]
+	secret := cache.secrets[match.name]
+	if klog.V(5) {
+		klog.Infof("getURLAPIToken found match %v in secret %v", match.url, match.name)
+	}
+	decodedUserName, err := base64.StdEncoding.DecodeString(secret.username)
+	if err != nil {
+		return "", "", "", err
+	}
+	decodedToken, err := base64.StdEncoding.DecodeString(secret.token)
+	if err != nil {
+		return "", "", "", err
+	}
+	return string(decodedUserName), string(decodedToken), match.name, nil
+}
+
+/* No secret has an API token for a URL */
+type noAPITokenError struct {
+	url string
+}
+
+func (err *noAPITokenError) Error() string {
+	return fmt.Sprintf("Unable to find API token for url: %s", err.url)
+}
+
+/* Return the cache of the secrets of a namespace: gitSecrets for the namespace of kabanero-events */
+func secretsCacheFor(namespace string) *secretsCache {
+	if namespace == webhookNamespace {
+		return gitSecrets
+	}
+	namespaceSecretsMutex.Lock()
+	defer namespaceSecretsMutex.Unlock()
+	cache, ok := namespaceSecrets[namespace]
+	if !ok {
+		cache = newSecretsCache()
+		namespaceSecrets[namespace] = cache
+	}
+	return cache
+}
+
+/* Return the interface of the secrets of a namespace */
+func secretsInterface(dynInterf dynamic.Interface, namespace string) dynamic.ResourceInterface {
+	gvr := schema.GroupVersionResource{
+		Group:    "",
+		Version:  V1,
+		Resource: SECRETS,
+	}
+	return dynInterf.Resource(gvr).Namespace(namespace)
+}
+
+/* List and watch the secrets of a namespace, keeping the cache up to date. Does not return */
+func watchGitSecrets(dynInterf dynamic.Interface, namespace string) {
+	intf := secretsInterface(dynInterf, namespace)
+	cache := secretsCacheFor(namespace)
+	for {
+		list, err := intf.List(metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("Unable to list secrets in namespace %v: %v", namespace, err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		cache.replace(namespace, list.Items)
+		incrementMetric("secrets.resyncs")
+		if cache == gitSecrets {
+			go validateGitTokens(dynInterf, namespace)
+		}
+		if klog.V(4) {
+			klog.Infof("Cached the git secrets of namespace %v", namespace)
+		}
+
+		/* the watch times out at the next resync */
+		options := metav1.ListOptions{ResourceVersion: list.GetResourceVersion()}
+		if secretsResync > 0 {
+			timeout := int64(secretsResync / time.Second)
+			options.TimeoutSeconds = &timeout
+		}
+		watcher, err := intf.Watch(options)
+		if err != nil {
+			klog.Errorf("Unable to watch secrets in namespace %v: %v", namespace, err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		for event := range watcher.ResultChan() {
+			if !cache.applyEvent(event) {
+				break
+			}
+			/* validate added secrets and rotated tokens */
+			if cache == gitSecrets {
+				go validateGitTokens(dynInterf, namespace)
+			}
+		}
+		watcher.Stop()
+	}
+}
+
+/* Apply a watch event to the cache. Returns false if the secrets must be listed again */
+func (cache *secretsCache) applyEvent(event watch.Event) bool {
+	obj, ok := event.Object.(*unstructured.Unstructured)
+	if !ok {
+		if klog.V(4) {
+			klog.Infof("Watch of secrets returned %v event: %v", event.Type, event.Object)
+		}
+		return false
+	}
+	switch event.Type {
+	case watch.Added, watch.Modified:
+		cache.update(obj)
+	case watch.Deleted:
+		cache.delete(obj)
+	default:
+		return false
+	}
+	return true
+}
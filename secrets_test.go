@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func newTestSecret(name string, annotations map[string]string, username string, token string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": V1,
+		"kind":       "Secret",
+		DATA: map[string]interface{}{
+			USERNAME: base64.StdEncoding.EncodeToString([]byte(username)),
+			PASSWORD: base64.StdEncoding.EncodeToString([]byte(token)),
+		},
+	}}
+	obj.SetName(name)
+	obj.SetAnnotations(annotations)
+	return obj
+}
+
+func TestSecretsCacheLookup(t *testing.T) {
+	cache := newSecretsCache()
+	cache.replace("kabanero", []unstructured.Unstructured{
+		*newTestSecret("b-org", map[string]string{"tekton.dev/git-0": "https://github.com/kabanero-io"}, "tekton", "t1"),
+		*newTestSecret("c-org", map[string]string{"kabanero.io/git-0": "https://github.com/kabanero-io"}, "kabanero", "t2"),
+		*newTestSecret("a-other", map[string]string{"kabanero.io/git-0": "https://github.com/other"}, "other", "t3"),
+		*newTestSecret("unannotated", map[string]string{"url": "https://github.com/kabanero-io"}, "none", "t4"),
+	})
+	if !cache.isSyncedFor("kabanero") || cache.isSyncedFor("default") {
+		t.Fatal("cache is not synced for namespace kabanero only")
+	}
+	if len(cache.secrets) != 3 {
+		t.Fatalf("cache contains %v secrets, expected 3", len(cache.secrets))
+	}
+
+	/* secrets are looked up in the order in which they are listed */
+	username, token, name, err := cache.lookup("https://github.com/kabanero-io/appsody")
+	if err != nil || username != "tekton" || token != "t1" || name != "b-org" {
+		t.Fatalf("unexpected lookup %v %v %v: %v", username, token, name, err)
+	}
+	if _, _, _, err = cache.lookup("https://gitlab.com/kabanero-io/appsody"); err == nil {
+		t.Fatal("expected error looking up a repository without secret")
+	}
+
+	/* watch events update the cache */
+	if !cache.applyEvent(watch.Event{Type: watch.Deleted, Object: newTestSecret("b-org", nil, "", "")}) {
+		t.Fatal("deleted event was not applied")
+	}
+	if _, _, name, _ = cache.lookup("https://github.com/kabanero-io/appsody"); name != "c-org" {
+		t.Fatalf("secret %v found after deletion of b-org", name)
+	}
+	cache.applyEvent(watch.Event{Type: watch.Modified, Object: newTestSecret("c-org", map[string]string{"kabanero.io/git-0": "https://github.com/kabanero-io/kabanero"}, "kabanero", "t5")})
+	if _, _, _, err = cache.lookup("https://github.com/kabanero-io/appsody"); err == nil {
+		t.Fatal("expected error looking up a repository whose secret was modified")
+	}
+	cache.applyEvent(watch.Event{Type: watch.Added, Object: newTestSecret("d-org", map[string]string{"tekton.dev/git-1": "https://github.com/kabanero-io"}, "added", "t6")})
+	if username, _, _, _ = cache.lookup("https://github.com/kabanero-io/appsody"); username != "added" {
+		t.Fatalf("added secret was not found: %v", username)
+	}
+	if len(cache.index) != 3 {
+		t.Fatalf("unexpected index %v", cache.index)
+	}
+	if cache.applyEvent(watch.Event{Type: watch.Error, Object: &unstructured.Unstructured{Object: map[string]interface{}{"kind": "Status"}}}) {
+		t.Fatal("error event did not stop the watch")
+	}
+}
+
+func TestSecretsCacheURLPatterns(t *testing.T) {
+	cache := newSecretsCache()
+	cache.replace("kabanero", []unstructured.Unstructured{
+		*newTestSecret("a-host", map[string]string{"kabanero.io/git-0": "https://github.com"}, "host", "t1"),
+		*newTestSecret("b-org", map[string]string{"kabanero.io/git-0": "https://github.com/myorg/*, https://gitlab.com/myorg"}, "org", "t2"),
+		*newTestSecret("c-repo", map[string]string{"tekton.dev/git-0": "https://github.com/myorg/app.git", "tekton.dev/git-1": "https://github.com/*/config"}, "repo", "t3"),
+		*newTestSecret("d-regex", map[string]string{"kabanero.io/git-0": "regex:https://ghe\\.[a-z]+\\.com/(team1|team2)/.*"}, "regex", "t4"),
+		*newTestSecret("e-invalid", map[string]string{"kabanero.io/git-0": "regex:https://ghe.example.com/(", "kabanero.io/git-1": "https://ghe.example.com/team3"}, "invalid", "t5"),
+		*newTestSecret("f-regex", map[string]string{"kabanero.io/git-0": "regex:https://github\\.com/myorg/.*"}, "regex2", "t6"),
+	})
+
+	tests := []struct {
+		url    string
+		secret string
+	}{
+		/* an exact match is preferred to more specific wildcards */
+		{"https://github.com/myorg/app", "c-repo"},
+		{"https://github.com/myorg/app/", "c-repo"},
+		/* a wildcard is preferred to a shorter prefix and to a regular expression */
+		{"https://github.com/myorg/other", "b-org"},
+		{"https://github.com/myorg/other.git", "b-org"},
+		/* wildcards match within a segment */
+		{"https://github.com/myorg2/other", "a-host"},
+		{"https://github.com/someorg/config", "c-repo"},
+		{"https://github.com/someorg/configuration", "a-host"},
+		/* several URLs in an annotation */
+		{"https://gitlab.com/myorg/app", "b-org"},
+		{"https://ghe.example.com/team2/app", "d-regex"},
+		{"https://ghe.example.com/team3/app", "e-invalid"},
+		{"https://ghe.example.com/team4/app", ""},
+	}
+	for _, test := range tests {
+		_, _, name, err := cache.lookup(test.url)
+		if test.secret == "" {
+			if err == nil {
+				t.Errorf("expected error looking up %v, found secret %v", test.url, name)
+			}
+		} else if err != nil || name != test.secret {
+			t.Errorf("looking up %v returned secret %v, expected %v: %v", test.url, name, test.secret, err)
+		}
+	}
+
+	/* the invalid regular expression is ignored, and patterns are removed with their secrets */
+	if _, ok := cache.patterns["regex:https://ghe.example.com/("]; ok {
+		t.Fatal("invalid regular expression was compiled")
+	}
+	cache.delete(newTestSecret("b-org", nil, "", ""))
+	if _, ok := cache.patterns["https://gitlab.com/myorg"]; ok {
+		t.Fatal("pattern of deleted secret was kept")
+	}
+	if _, _, name, _ := cache.lookup("https://github.com/myorg/other"); name != "a-host" {
+		t.Fatalf("looking up after deletion returned secret %v", name)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+/*
+Secrets scanning of rendered resources. The string values of every resource are scanned for credentials, so that a
+template does not accidentally bake a token from the event or the environment into, for example, a PipelineRun spec.
+The credentials are redacted by default, or, if blocking is opted in to, resources containing them are rejected. Secrets
+are not scanned, since holding credentials is their purpose.
+*/
+
+/* modes of secrets scanning */
+const (
+	secretScanBlock  = "block"
+	secretScanRedact = "redact"
+	secretScanOff    = "off"
+
+	redacted = "[REDACTED]"
+)
+
+var secretScanMode = secretScanRedact // redact, block, or off
+
+/* Patterns of credentials, by name */
+var secretPatterns = map[string]*regexp.Regexp{
+	"GitHub token":        regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`),
+	"AWS access key":      regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	"Slack token":         regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`),
+	"private key":         regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`),
+	"bearer token":        regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]{20,}=*`),
+	"basic auth in a URL": regexp.MustCompile(`\b[a-z][a-z0-9+.-]*://[^\s:/@]+:[^\s/@]+@`),
+}
+
+/* Return the names of the credentials found in a string */
+func scanForSecrets(str string) []string {
+	found := make([]string, 0)
+	for name, pattern := range secretPatterns {
+		if pattern.MatchString(str) {
+			found = append(found, name)
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+/* Replace the credentials found in a string */
+func redactSecrets(str string) string {
+	for _, pattern := range secretPatterns {
+		str = pattern.ReplaceAllString(str, redacted)
+	}
+	return str
+}
+
+/* Scan the string values of an object, redacting them if redact is set. Returns the names of the credentials found, with their path. */
+func scanObjectForSecrets(value interface{}, path string, redact bool) (interface{}, []string) {
+	found := make([]string, 0)
+	switch v := value.(type) {
+	case string:
+		for _, name := range scanForSecrets(v) {
+			found = append(found, name+" in "+path)
+		}
+		if redact && len(found) > 0 {
+			return redactSecrets(v), found
+		}
+	case map[string]interface{}:
+		for key, element := range v {
+			newElement, elementFound := scanObjectForSecrets(element, path+"."+key, redact)
+			v[key] = newElement
+			found = append(found, elementFound...)
+		}
+	case []interface{}:
+		for index, element := range v {
+			newElement, elementFound := scanObjectForSecrets(element, fmt.Sprintf("%v[%v]", path, index), redact)
+			v[index] = newElement
+			found = append(found, elementFound...)
+		}
+	}
+	return value, found
+}
+
+/* Resource filter rejecting, or redacting, resources that contain credentials */
+func scanResourceSecrets(action *resourceAction, resource *unstructured.Unstructured) error {
+	if secretScanMode == secretScanOff || resource.GetKind() == "Secret" {
+		return nil
+	}
+	redact := secretScanMode == secretScanRedact
+	_, found := scanObjectForSecrets(resource.Object, resource.GetKind(), redact)
+	if len(found) == 0 {
+		return nil
+	}
+	sort.Strings(found)
+	incrementMetric("secretScan.found")
+	if redact {
+		klog.Warningf("Redacted credentials from %v %v created by trigger %v: %v", resource.GetKind(), resource.GetName(), action.trigger, strings.Join(found, ", "))
+		return nil
+	}
+	return fmt.Errorf("%v %v rendered by trigger %v contains credentials: %v", resource.GetKind(), resource.GetName(), action.trigger, strings.Join(found, ", "))
+}
+
+/* Check the secret scan mode flag */
+func validateSecretScanMode() error {
+	switch secretScanMode {
+	case secretScanBlock, secretScanRedact, secretScanOff:
+		return nil
+	}
+	return fmt.Errorf("secretScan must be one of %v, %v, or %v, not %v", secretScanBlock, secretScanRedact, secretScanOff, secretScanMode)
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Self-test. A synthetic event is published through every eventDestination, and is expected to come back through the
+listener of the destination, where it is evaluated against a no-op trigger instead of the trigger collection. The
+latency of each hop is reported: publishing the event, receiving it back, and evaluating the trigger. The self-test
+is run on demand through the admin API, or with -selftest, once at startup, after which kabanero-events exits.
+*/
+
+const (
+	selfTestHeader = "X-Kabanero-Selftest" // header of synthetic events, whose value is the ID of the probe
+
+	selfTestPassed  = "passed"
+	selfTestFailed  = "failed"
+	selfTestSkipped = "skipped"
+)
+
+var (
+	selfTestMode    bool          // run the self-test at startup, and exit
+	selfTestTimeout time.Duration // maximum time for a synthetic event to come back
+
+	selfTestMutex     sync.Mutex
+	selfTestListeners = map[string]int{}                  // number of running listeners, by destination
+	selfTestProbes    = map[string]chan selfTestArrival{} // pending probes, by ID
+)
+
+/* A synthetic event received by a listener */
+type selfTestArrival struct {
+	received time.Time
+	trigger  time.Duration // time to evaluate the no-op trigger
+	err      error
+}
+
+/* Result of the self-test of an eventDestination. Latencies are in milliseconds */
+type selfTestResult struct {
+	Destination    string  `json:"destination"`
+	Status         string  `json:"status"`
+	Error          string  `json:"error,omitempty"`
+	PublishMillis  float64 `json:"publishMillis"`
+	DeliveryMillis float64 `json:"deliveryMillis"`
+	TriggerMillis  float64 `json:"triggerMillis"`
+	TotalMillis    float64 `json:"totalMillis"`
+}
+
+/* Result of a self-test */
+type selfTestReport struct {
+	Passed  bool             `json:"passed"`
+	Time    time.Time        `json:"time"`
+	Results []selfTestResult `json:"results"`
+}
+
+func durationMillis(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+/* Record that a listener of a destination is running, or has exited */
+func setSelfTestListener(destination string, running bool) {
+	selfTestMutex.Lock()
+	defer selfTestMutex.Unlock()
+	if running {
+		selfTestListeners[destination]++
+	} else if selfTestListeners[destination]--; selfTestListeners[destination] <= 0 {
+		delete(selfTestListeners, destination)
+	}
+}
+
+func isSelfTestListening(destination string) bool {
+	selfTestMutex.Lock()
+	defer selfTestMutex.Unlock()
+	return selfTestListeners[destination] > 0
+}
+
+/* Return a trigger processor whose only trigger matches the synthetic events of a destination, without any action */
+func newSelfTestProcessor(destination string) *triggerProcessor {
+	trigger := map[interface{}]interface{}{
+		NAME:        "selftest",
+		EVENTSOURCE: destination,
+		INPUT:       MESSAGE,
+		BODY: []interface{}{
+			map[interface{}]interface{}{
+				IF:        fmt.Sprintf("message.body.selftest.destination == %q", destination),
+				"matched": "true",
+			},
+		},
+	}
+	tp := &triggerProcessor{name: "selftest"}
+	tp.triggerDef = &eventTriggerDefinition{
+		setting:       []map[interface{}]interface{}{{"dryrun": true}},
+		eventTriggers: map[string][]map[interface{}]interface{}{destination: {trigger}},
+		functions:     make(map[string]map[interface{}]interface{}),
+		macros:        make(map[string]*celMacro),
+	}
+	return tp
+}
+
+/*
+Complete the probe of a synthetic event received by a listener. Returns false if the message is not a synthetic
+event. Synthetic events are never processed by the trigger collection, even if their probe is not pending
+*/
+func completeSelfTest(message map[string]interface{}, source string) bool {
+	header, err := convertToHeaderMap(message[HEADER])
+	if err != nil {
+		return false
+	}
+	id := http.Header(header).Get(selfTestHeader)
+	if id == "" {
+		return false
+	}
+	received := time.Now()
+
+	selfTestMutex.Lock()
+	probe, ok := selfTestProbes[id]
+	delete(selfTestProbes, id)
+	selfTestMutex.Unlock()
+	if !ok {
+		if klog.V(4) {
+			klog.Infof("Dropping synthetic event %v received from %v, whose self-test is not pending", id, source)
+		}
+		return true
+	}
+
+	arrival := selfTestArrival{received: received}
+	result, err := newSelfTestProcessor(source).evaluateMessage(message, source, evalOptions{dryrun: true})
+	arrival.trigger = time.Since(received)
+	if err != nil {
+		arrival.err = fmt.Errorf("unable to evaluate the self-test trigger: %v", err)
+	} else if len(result.variables) != 1 || result.variables[0]["matched"] != true {
+		arrival.err = fmt.Errorf("synthetic event did not match the self-test trigger")
+	}
+	probe <- arrival
+	return true
+}
+
+/* Wait for the synthetic event of an ID. Returns the channel of its arrival, and the function removing the probe */
+func addSelfTestProbe(id string) (chan selfTestArrival, func()) {
+	probe := make(chan selfTestArrival, 1)
+	selfTestMutex.Lock()
+	selfTestProbes[id] = probe
+	selfTestMutex.Unlock()
+	return probe, func() {
+		selfTestMutex.Lock()
+		delete(selfTestProbes, id)
+		selfTestMutex.Unlock()
+	}
+}
+
+/* Publish a synthetic event through a destination, and wait for it to come back */
+func selfTestDestination(node *EventNode, timeout time.Duration) selfTestResult {
+	result := selfTestResult{Destination: node.Name, Status: selfTestFailed}
+	if !isSelfTestListening(node.Name) {
+		result.Status = selfTestSkipped
+		result.Error = "no listener is running for the destination, which is not an event source of the triggers"
+		return result
+	}
+
+	id := newRequestID()
+	message := map[string]interface{}{
+		EVENTID: id,
+		HEADER:  map[string][]string{selfTestHeader: {id}},
+		BODY: map[string]interface{}{
+			"selftest": map[string]interface{}{"id": id, "destination": node.Name},
+		},
+	}
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	probe, remove := addSelfTestProbe(id)
+	defer remove()
+
+	start := time.Now()
+	/* spooling would hide an unhealthy destination */
+	err = sendToDestinationNow(node.Name, bytes, nil)
+	published := time.Now()
+	result.PublishMillis = durationMillis(published.Sub(start))
+	if err != nil {
+		result.Error = fmt.Sprintf("unable to publish synthetic event: %v", err)
+		return result
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case arrival := <-probe:
+		/* the event may come back before the provider returns */
+		if delivery := arrival.received.Sub(published); delivery > 0 {
+			result.DeliveryMillis = durationMillis(delivery)
+		}
+		result.TriggerMillis = durationMillis(arrival.trigger)
+		result.TotalMillis = durationMillis(arrival.received.Sub(start) + arrival.trigger)
+		if arrival.err != nil {
+			result.Error = arrival.err.Error()
+		} else {
+			result.Status = selfTestPassed
+		}
+	case <-timer.C:
+		result.Error = fmt.Sprintf("synthetic event did not come back within %v", timeout)
+	}
+	return result
+}
+
+/* Run the self-test of all the eventDestinations concurrently. The self-test passes if none failed, and one passed */
+func runSelfTest(timeout time.Duration) selfTestReport {
+	report := selfTestReport{Time: time.Now().UTC(), Results: make([]selfTestResult, 0)}
+	ed := currentEventProviders()
+	if ed == nil {
+		return report
+	}
+	results := make([]selfTestResult, len(ed.EventDestinations))
+	var wg sync.WaitGroup
+	for index, node := range ed.EventDestinations {
+		wg.Add(1)
+		go func(index int, node *EventNode) {
+			defer wg.Done()
+			results[index] = selfTestDestination(node, timeout)
+		}(index, node)
+	}
+	wg.Wait()
+
+	passed, failed := 0, 0
+	for _, result := range results {
+		switch result.Status {
+		case selfTestPassed:
+			passed++
+			klog.Infof("Self-test of eventDestination '%s' passed: published in %.1fms, received in %.1fms, matched in %.1fms",
+				result.Destination, result.PublishMillis, result.DeliveryMillis, result.TriggerMillis)
+		case selfTestFailed:
+			failed++
+			klog.Errorf("Self-test of eventDestination '%s' failed: %v", result.Destination, result.Error)
+		default:
+			klog.Infof("Self-test of eventDestination '%s' skipped: %v", result.Destination, result.Error)
+		}
+	}
+	report.Results = results
+	report.Passed = failed == 0 && passed > 0
+	incrementMetric("selftest.runs")
+	if !report.Passed {
+		incrementMetric("selftest.failures")
+	}
+	return report
+}
+
+/* Run the self-test requested by -selftest, print its report, and return the exit code */
+func runSelfTestCommand() int {
+	report := runSelfTest(selfTestTimeout)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		fmt.Fprintln(os.Stdout, string(data))
+	}
+	klog.Flush()
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
+
+/* POST /admin/selftest runs the self-test. Responds with 503 if it failed. The timeout may be set with ?timeout=<duration> */
+func adminSelfTestHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	timeout := selfTestTimeout
+	if value := req.URL.Query().Get("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			writeError(writer, req, codeInvalidParameter, fmt.Sprintf("invalid timeout %v", value))
+			return
+		}
+		timeout = parsed
+	}
+	report := runSelfTest(timeout)
+	data, err := json.Marshal(report)
+	if err != nil {
+		writeError(writer, req, codeInternalError, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if !report.Passed {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writer.Write(data)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelfTest(t *testing.T) {
+	broker := newBrokerProvider()
+	unhealthy := newBrokerProvider()
+	unhealthy.setDown(true)
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"broker": broker, "unhealthy": unhealthy}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{
+		{Name: "github", ProviderRef: "broker"},
+		{Name: "unhealthy", ProviderRef: "unhealthy"},
+		{Name: "notifications", ProviderRef: "broker"},
+	}}
+
+	go messageListener(broker, eventProviders.EventDestinations[0], nil)
+	defer broker.setDown(true)
+	waitFor(t, func() bool { return isSelfTestListening("github") })
+	setSelfTestListener("unhealthy", true)
+	defer setSelfTestListener("unhealthy", false)
+
+	report := runSelfTest(time.Second)
+	if report.Passed || len(report.Results) != 3 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for index, status := range []string{selfTestPassed, selfTestFailed, selfTestSkipped} {
+		if result := report.Results[index]; result.Status != status {
+			t.Errorf("self-test of %v %v, expected %v: %v", result.Destination, result.Status, status, result.Error)
+		}
+	}
+	if result := report.Results[0]; result.TotalMillis < result.PublishMillis || result.TriggerMillis <= 0 {
+		t.Errorf("unexpected latencies %+v", result)
+	}
+
+	/* the self-test passes once the unhealthy destination is not tested */
+	setSelfTestListener("unhealthy", false)
+	recorder := httptest.NewRecorder()
+	adminSelfTestHandler(recorder, httptest.NewRequest("POST", "/admin/selftest?timeout=1s", nil))
+	report = selfTestReport{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil || recorder.Code != http.StatusOK || !report.Passed {
+		t.Fatalf("self-test returned %v: %s", recorder.Code, recorder.Body.String())
+	}
+	setSelfTestListener("unhealthy", true)
+}
+
+func TestSelfTestEventsAreNotProcessed(t *testing.T) {
+	message := map[string]interface{}{
+		HEADER: map[string]interface{}{selfTestHeader: []interface{}{"1a2b"}},
+		BODY:   map[string]interface{}{"selftest": map[string]interface{}{"id": "1a2b", "destination": "github"}},
+	}
+	/* synthetic events whose self-test is not pending, such as those of another instance, are dropped */
+	if !completeSelfTest(message, "github") {
+		t.Fatal("synthetic event was not recognized")
+	}
+	if completeSelfTest(map[string]interface{}{HEADER: map[string]interface{}{"X-Github-Event": []interface{}{"push"}}}, "github") {
+		t.Fatal("webhook event was recognized as a synthetic event")
+	}
+
+	/* the no-op trigger only matches the events of its destination */
+	result, err := newSelfTestProcessor("notifications").evaluateMessage(message, "notifications", evalOptions{dryrun: true})
+	if err != nil || result.variables[0]["matched"] == true {
+		t.Fatalf("self-test trigger matched the event of another destination: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+/*
+Semantic versions in triggers. Comparing versions as strings orders 0.10.0 before 0.9.0, so triggers compare the
+versions of collections and stacks with semverCompare, semverValid and semverSatisfies instead. Versions follow
+Semantic Versioning 2.0.0, with an optional v prefix, and a missing minor or patch version is 0, as in the versions
+of stacks: v1.2 is 1.2.0. Pre-release versions are older than their release, and build metadata is ignored.
+*/
+
+/* A parsed semantic version */
+type semver struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+/* Parse a semantic version */
+func parseSemver(version string) (*semver, error) {
+	str := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if index := strings.Index(str, "+"); index >= 0 {
+		str = str[:index]
+	}
+	v := &semver{}
+	if index := strings.Index(str, "-"); index >= 0 {
+		v.prerelease = strings.Split(str[index+1:], ".")
+		for _, identifier := range v.prerelease {
+			if identifier == "" {
+				return nil, fmt.Errorf("version %q has an empty pre-release identifier", version)
+			}
+		}
+		str = str[:index]
+	}
+	parts := strings.Split(str, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("version %q has more than 3 numbers", version)
+	}
+	numbers := []*uint64{&v.major, &v.minor, &v.patch}
+	for index, part := range parts {
+		number, err := strconv.ParseUint(part, 10, 64)
+		if err != nil || (len(part) > 1 && part[0] == '0') {
+			return nil, fmt.Errorf("version %q is not a semantic version", version)
+		}
+		*numbers[index] = number
+	}
+	return v, nil
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+/* Compare two pre-release identifiers. Numeric identifiers are older than alphanumeric ones */
+func comparePrereleaseIdentifier(a, b string) int {
+	aNumber, aErr := strconv.ParseUint(a, 10, 64)
+	bNumber, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(aNumber, bNumber)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+/* Return -1, 0 or 1 if a version is older than, the same as, or newer than another */
+func (v *semver) compare(other *semver) int {
+	if c := compareUint(v.major, other.major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.minor, other.minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.patch, other.patch); c != 0 {
+		return c
+	}
+	/* a release is newer than its pre-releases */
+	switch {
+	case len(v.prerelease) == 0 && len(other.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(other.prerelease) == 0:
+		return -1
+	}
+	for index := 0; index < len(v.prerelease) && index < len(other.prerelease); index++ {
+		if c := comparePrereleaseIdentifier(v.prerelease[index], other.prerelease[index]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.prerelease)), uint64(len(other.prerelease)))
+}
+
+/* Compare two semantic versions */
+func compareSemver(a, b string) (int, error) {
+	aVersion, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+	bVersion, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+	return aVersion.compare(bVersion), nil
+}
+
+/* Return whether a version satisfies a comparator, such as >=1.2.0, ^1.2 or ~1.2.3 */
+func satisfiesComparator(v *semver, comparator string) (bool, error) {
+	operator := strings.TrimRight(comparator, "v0123456789.-+abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	target, err := parseSemver(comparator[len(operator):])
+	if err != nil {
+		return false, err
+	}
+	c := v.compare(target)
+	switch operator {
+	case "", "=", "==":
+		return c == 0, nil
+	case "!=":
+		return c != 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case "~":
+		/* the same major and minor version */
+		return c >= 0 && v.major == target.major && v.minor == target.minor, nil
+	case "^":
+		/* the same major version, or the same minor version for 0.x versions */
+		if target.major == 0 {
+			return c >= 0 && v.major == 0 && v.minor == target.minor, nil
+		}
+		return c >= 0 && v.major == target.major, nil
+	}
+	return false, fmt.Errorf("unknown operator %q in version constraint %q", operator, comparator)
+}
+
+/* Return whether a version satisfies a constraint: comparators separated by spaces, all satisfied, or by || */
+func satisfiesSemver(version string, constraint string) (bool, error) {
+	v, err := parseSemver(version)
+	if err != nil {
+		return false, err
+	}
+	result := false
+	for _, alternative := range strings.Split(constraint, "||") {
+		comparators := strings.Fields(alternative)
+		if len(comparators) == 0 {
+			return false, fmt.Errorf("version constraint %q has an empty alternative", constraint)
+		}
+		satisfied := true
+		for _, comparator := range comparators {
+			ok, err := satisfiesComparator(v, comparator)
+			if err != nil {
+				return false, err
+			}
+			satisfied = satisfied && ok
+		}
+		result = result || satisfied
+	}
+	return result, nil
+}
+
+/* implementation of semverCompare for CEL */
+func semverCompareCEL(aVal ref.Val, bVal ref.Val) ref.Val {
+	a, ok := aVal.(types.String)
+	if !ok {
+		return types.ValOrErr(aVal, "unexpected type '%v' passed as first parameter to function semverCompare", aVal.Type())
+	}
+	b, ok := bVal.(types.String)
+	if !ok {
+		return types.ValOrErr(bVal, "unexpected type '%v' passed as second parameter to function semverCompare", bVal.Type())
+	}
+	c, err := compareSemver(string(a), string(b))
+	if err != nil {
+		return types.NewErr("semverCompare: %v", err)
+	}
+	return types.Int(c)
+}
+
+/* implementation of semverValid for CEL */
+func semverValidCEL(param ref.Val) ref.Val {
+	str, ok := param.(types.String)
+	if !ok {
+		return types.ValOrErr(param, "unexpected type '%v' passed to semverValid", param.Type())
+	}
+	_, err := parseSemver(string(str))
+	return types.Bool(err == nil)
+}
+
+/* implementation of semverSatisfies for CEL */
+func semverSatisfiesCEL(versionVal ref.Val, constraintVal ref.Val) ref.Val {
+	version, ok := versionVal.(types.String)
+	if !ok {
+		return types.ValOrErr(versionVal, "unexpected type '%v' passed as first parameter to function semverSatisfies", versionVal.Type())
+	}
+	constraint, ok := constraintVal.(types.String)
+	if !ok {
+		return types.ValOrErr(constraintVal, "unexpected type '%v' passed as second parameter to function semverSatisfies", constraintVal.Type())
+	}
+	satisfied, err := satisfiesSemver(string(version), string(constraint))
+	if err != nil {
+		return types.NewErr("semverSatisfies: %v", err)
+	}
+	return types.Bool(satisfied)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareSemver(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.10.0", "0.9.0", 1},
+		{"v1.2", "1.2.0", 0},
+		{"1.2.3+build.5", "1.2.3", 0},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.beta", "1.0.0-alpha.1", 1},
+		{"1.0.0-rc.11", "1.0.0-rc.2", 1},
+		{"2.0.0", "10.0.0", -1},
+	} {
+		c, err := compareSemver(test.a, test.b)
+		if err != nil || c != test.expected {
+			t.Errorf("compareSemver(%v, %v) returned %v, %v instead of %v", test.a, test.b, c, err, test.expected)
+		}
+	}
+	for _, invalid := range []string{"", "1.2.3.4", "1.02.3", "1.x", "1.0.0-", "1.0.0-rc..1"} {
+		if _, err := parseSemver(invalid); err == nil {
+			t.Errorf("%q was parsed", invalid)
+		}
+	}
+}
+
+func TestSatisfiesSemver(t *testing.T) {
+	for _, test := range []struct {
+		version, constraint string
+		expected            bool
+	}{
+		{"0.3.1", ">=0.3.0 <0.4.0", true},
+		{"0.4.0", ">=0.3.0 <0.4.0", false},
+		{"1.4.0", "^1.2", true},
+		{"2.0.0", "^1.2", false},
+		{"0.3.5", "^0.3.1", true},
+		{"0.4.0", "^0.3.1", false},
+		{"1.2.9", "~1.2.3", true},
+		{"1.3.0", "~1.2.3", false},
+		{"3.0.0", "<2.0.0 || >=3.0.0", true},
+		{"1.0.0", "!=1.0.0", false},
+	} {
+		satisfied, err := satisfiesSemver(test.version, test.constraint)
+		if err != nil || satisfied != test.expected {
+			t.Errorf("satisfiesSemver(%v, %v) returned %v, %v instead of %v", test.version, test.constraint, satisfied, err, test.expected)
+		}
+	}
+	for _, invalid := range []string{"", "=>1.0.0", ">=1.0.0 ||"} {
+		if _, err := satisfiesSemver("1.0.0", invalid); err == nil {
+			t.Errorf("constraint %q was accepted", invalid)
+		}
+	}
+}
+
+func TestSemverCEL(t *testing.T) {
+	trigger := map[interface{}]interface{}{
+		NAME:        "semver",
+		EVENTSOURCE: "default",
+		INPUT:       MESSAGE,
+		BODY: []interface{}{
+			map[interface{}]interface{}{"newer": "semverCompare(message.collection, message.pinned) > 0"},
+			map[interface{}]interface{}{"valid": "semverValid(message.pinned)"},
+			map[interface{}]interface{}{"compatible": `semverSatisfies(message.collection, "^0.2")`},
+		},
+	}
+	tp := &triggerProcessor{name: "semver"}
+	tp.triggerDef = &eventTriggerDefinition{
+		setting:       []map[interface{}]interface{}{{"dryrun": true}},
+		eventTriggers: map[string][]map[interface{}]interface{}{"default": {trigger}},
+		functions:     make(map[string]map[interface{}]interface{}),
+		macros:        make(map[string]*celMacro),
+	}
+	result, err := tp.evaluateMessage(map[string]interface{}{"collection": "0.10.0", "pinned": "0.9.2"}, "default", evalOptions{dryrun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variables := result.variables[0]
+	if variables["newer"] != true || variables["valid"] != true || variables["compatible"] != false {
+		t.Fatalf("unexpected variables %v", variables)
+	}
+
+	/* invalid versions are errors rather than wrong decisions */
+	if _, err = tp.evaluateMessage(map[string]interface{}{"collection": "latest", "pinned": "0.9.2"}, "default", evalOptions{dryrun: true}); err == nil {
+		t.Fatal("an invalid version was compared")
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+/* environment variables for shadow mode */
+const (
+	SHADOWKABANEROINDEXURL = "SHADOW_KABANERO_INDEX_URL" // use the given URL to fetch the kabanero index of the shadow collection
+)
+
+var (
+	shadowIndexURL string            // URL of the Kabanero index of the shadow collection
+	shadowProc     *triggerProcessor // processor of the shadow collection. nil if there is no shadow
+)
+
+/*
+Evaluate a message with the shadow collection in dry-run, and compare the actions with those of the collection that
+processed the message. The message is decoded again from its bytes, so that the evaluation of the shadow collection can
+not observe changes made by the other evaluation.
+*/
+func evaluateShadow(shadowProc *triggerProcessor, bytes []byte, eventSource string, processedBy string, result *evalResult, processErr error) {
+	if _, ok := shadowProc.triggerDef.eventTriggers[eventSource]; !ok {
+		return
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(bytes, &message); err != nil {
+		return
+	}
+
+	incrementMetric("triggerProcessor.shadow.messages")
+	shadowResult, err := shadowProc.evaluateMessage(message, eventSource, evalOptions{dryrun: true})
+	if err != nil {
+		incrementMetric("triggerProcessor.shadow.errors")
+	}
+
+	var actions, shadowActions []string
+	if result != nil {
+		actions = result.actions
+	}
+	if shadowResult != nil {
+		shadowActions = shadowResult.actions
+	}
+
+	diverged := (err == nil) != (processErr == nil) || !equalActions(actions, shadowActions)
+	if !diverged {
+		if klog.V(5) {
+			klog.Infof("Shadow collection agrees with collection %v for message from %v: %v", processedBy, eventSource, actions)
+		}
+		return
+	}
+	incrementMetric("triggerProcessor.shadow.divergences")
+	klog.Warningf("Shadow collection diverges from collection %v for message from %v, repository %v. %v: actions [%v], error: %v. shadow: actions [%v], error: %v",
+		processedBy, eventSource, messageRepositoryURL(message), processedBy, strings.Join(actions, ", "), processErr, strings.Join(shadowActions, ", "), err)
+}
+
+/* Compare two lists of actions */
+func equalActions(actions1 []string, actions2 []string) bool {
+	if len(actions1) != len(actions2) {
+		return false
+	}
+	for index := range actions1 {
+		if actions1[index] != actions2[index] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestEvaluateShadow(t *testing.T) {
+	metricValue := func(key string) int {
+		if value := metrics.Get(key); value != nil {
+			count, _ := strconv.Atoi(value.String())
+			return count
+		}
+		return 0
+	}
+
+	live := newTriggerProcessor()
+	if err := live.initialize("test_data/trigger11"); err != nil {
+		t.Fatal(err)
+	}
+	agreeing := newTriggerProcessor()
+	agreeing.name = "shadow"
+	if err := agreeing.initialize("test_data/trigger11"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* the diverging shadow never applies resources */
+	dir, err := ioutil.TempDir("", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	collection := "eventTriggers:\n  - eventSource: default\n    input: event\n    body:\n      - result: 'event.attr1'\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "triggers.yaml"), []byte(collection), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diverging := newTriggerProcessor()
+	diverging.name = "shadow"
+	if err = diverging.initialize(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	event := map[string]interface{}{"attr1": "string1"}
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := live.evaluateMessage(event, "default", evalOptions{dryrun: true})
+	if err != nil || len(result.actions) != 1 {
+		t.Fatalf("unexpected result of the live collection %v: %v", result, err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		shadow      *triggerProcessor
+		eventSource string
+		processErr  error
+		messages    int
+		divergences int
+	}{
+		{"agreeing", agreeing, "default", nil, 1, 0},
+		{"diverging actions", diverging, "default", nil, 1, 1},
+		{"diverging errors", agreeing, "default", errors.New("failed"), 1, 1},
+		{"no shadow triggers", diverging, "unknown", nil, 0, 0},
+	} {
+		messages, divergences := metricValue("triggerProcessor.shadow.messages"), metricValue("triggerProcessor.shadow.divergences")
+		evaluateShadow(test.shadow, bytes, test.eventSource, live.name, result, test.processErr)
+		if count := metricValue("triggerProcessor.shadow.messages") - messages; count != test.messages {
+			t.Errorf("%v: expected %v shadow messages, but got %v", test.name, test.messages, count)
+		}
+		if count := metricValue("triggerProcessor.shadow.divergences") - divergences; count != test.divergences {
+			t.Errorf("%v: expected %v divergences, but got %v", test.name, test.divergences, count)
+		}
+	}
+}
+
+func TestEqualActions(t *testing.T) {
+	if !equalActions(nil, []string{}) || !equalActions([]string{"a", "b"}, []string{"a", "b"}) {
+		t.Error("equal actions were reported as different")
+	}
+	if equalActions([]string{"a", "b"}, []string{"b", "a"}) || equalActions([]string{"a"}, []string{"a", "b"}) {
+		t.Error("different actions were reported as equal")
+	}
+}
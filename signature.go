@@ -0,0 +1,283 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+/*
+Signatures of trigger collections. With -signatureKeysSecret or -signatureKeysConfigMap, the archive of a trigger
+collection must be signed by one of the public keys of the Secret or ConfigMap, in the namespace of kabanero-events,
+before its triggers are initialized, whether or not its checksum is verified. Each key of the Secret or ConfigMap is a
+PEM public key, for signatures made with cosign sign-blob, or an OpenPGP public key, armored or not, for detached GPG
+signatures. The signature is downloaded from the signature URL of the trigger in the Kabanero index, or else from the
+URL of the archive with a .sig suffix. The keys are read at each download, so that rotated keys apply to the next
+reload. Trigger collections in Git or in a local -triggerDir are not archives, and can not be loaded when signatures
+are required.
+*/
+
+const (
+	SIGNATURE       = "signature" // URL of the signature of a trigger collection in the Kabanero index
+	signatureSuffix = ".sig"      // suffix of the default URL of the signature of a trigger collection
+)
+
+var (
+	signatureKeysSecret    string // Secret holding the public keys the trigger collections must be signed with
+	signatureKeysConfigMap string // ConfigMap holding the public keys the trigger collections must be signed with
+)
+
+/* The public keys trigger collections may be signed with */
+type signatureKeys struct {
+	names   []string           // names of the PEM public keys, in the order of keys
+	keys    []crypto.PublicKey // PEM public keys, for cosign signatures
+	keyring openpgp.EntityList // OpenPGP public keys, for GPG signatures
+}
+
+// Read the data of a ConfigMap in the namespace of kabanero-events. Replaced in tests.
+var readSignatureConfigMap = func(name string) (map[string][]byte, error) {
+	if dynamicClient == nil {
+		return nil, fmt.Errorf("unable to read ConfigMap %s: no Kubernetes client", name)
+	}
+	gvr := schema.GroupVersionResource{Group: "", Version: V1, Resource: CONFIGMAPS}
+	obj, err := dynamicClient.Resource(gvr).Namespace(webhookNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string][]byte)
+	dataMap, _ := obj.Object[DATA].(map[string]interface{})
+	for key, value := range dataMap {
+		if str, ok := value.(string); ok {
+			data[key] = []byte(str)
+		}
+	}
+	return data, nil
+}
+
+/* Return whether trigger collections must be signed */
+func signatureRequired() bool {
+	return signatureKeysSecret != "" || signatureKeysConfigMap != ""
+}
+
+/* Read the public keys of the Secret and ConfigMap. nil if signatures are not required */
+func readSignatureKeys() (*signatureKeys, error) {
+	if !signatureRequired() {
+		return nil, nil
+	}
+	data := make(map[string][]byte)
+	if signatureKeysSecret != "" {
+		secretData, err := readProviderSecret(signatureKeysSecret)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the signature keys of Secret %s: %v", signatureKeysSecret, err)
+		}
+		for name, value := range secretData {
+			data["secret/"+name] = value
+		}
+	}
+	if signatureKeysConfigMap != "" {
+		configMapData, err := readSignatureConfigMap(signatureKeysConfigMap)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the signature keys of ConfigMap %s: %v", signatureKeysConfigMap, err)
+		}
+		for name, value := range configMapData {
+			data["configmap/"+name] = value
+		}
+	}
+	return parseSignatureKeys(data)
+}
+
+/* Parse public keys by name */
+func parseSignatureKeys(data map[string][]byte) (*signatureKeys, error) {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keys := &signatureKeys{}
+	for _, name := range names {
+		value := bytes.TrimSpace(data[name])
+		switch {
+		case bytes.HasPrefix(value, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")):
+			entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(value))
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the OpenPGP public key %s: %v", name, err)
+			}
+			keys.keyring = append(keys.keyring, entities...)
+		case bytes.HasPrefix(value, []byte("-----BEGIN")):
+			block, _ := pem.Decode(value)
+			if block == nil || block.Type != "PUBLIC KEY" {
+				return nil, fmt.Errorf("signature key %s is not a PEM public key", name)
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the public key %s: %v", name, err)
+			}
+			keys.names = append(keys.names, name)
+			keys.keys = append(keys.keys, key)
+		default:
+			entities, err := openpgp.ReadKeyRing(bytes.NewReader(value))
+			if err != nil {
+				return nil, fmt.Errorf("signature key %s is neither a PEM nor an OpenPGP public key: %v", name, err)
+			}
+			keys.keyring = append(keys.keyring, entities...)
+		}
+	}
+	if len(keys.keys) == 0 && len(keys.keyring) == 0 {
+		return nil, fmt.Errorf("no signature key is defined")
+	}
+	return keys, nil
+}
+
+/*
+Verify the signature of an archive: an armored or binary detached OpenPGP signature, or a base64 encoded cosign
+signature. Return the name or ID of the key that signed the archive.
+*/
+func (keys *signatureKeys) verify(archive []byte, signature []byte) (string, error) {
+	signature = bytes.TrimSpace(signature)
+	if bytes.HasPrefix(signature, []byte("-----BEGIN PGP SIGNATURE-----")) {
+		return keys.verifyOpenPGP(openpgp.CheckArmoredDetachedSignature, archive, signature)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(signature))
+	if err != nil {
+		return keys.verifyOpenPGP(openpgp.CheckDetachedSignature, archive, signature)
+	}
+
+	digest := sha256.Sum256(archive)
+	for index, key := range keys.keys {
+		verified := false
+		switch publicKey := key.(type) {
+		case *ecdsa.PublicKey:
+			verified = ecdsa.VerifyASN1(publicKey, digest[:], decoded)
+		case *rsa.PublicKey:
+			verified = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], decoded) == nil
+		case ed25519.PublicKey:
+			verified = ed25519.Verify(publicKey, archive, decoded)
+		}
+		if verified {
+			return keys.names[index], nil
+		}
+	}
+	return "", fmt.Errorf("the signature does not match any of the %v public keys", len(keys.keys))
+}
+
+/* Verify a detached OpenPGP signature with a check of the openpgp package */
+func (keys *signatureKeys) verifyOpenPGP(check func(openpgp.KeyRing, io.Reader, io.Reader) (*openpgp.Entity, error), archive []byte, signature []byte) (string, error) {
+	if len(keys.keyring) == 0 {
+		return "", fmt.Errorf("the OpenPGP signature can not be verified without OpenPGP public keys")
+	}
+	signer, err := check(keys.keyring, bytes.NewReader(archive), bytes.NewReader(signature))
+	if err != nil {
+		return "", fmt.Errorf("the OpenPGP signature does not match any of the public keys: %v", err)
+	}
+	return signer.PrimaryKey.KeyIdString(), nil
+}
+
+/* Return the URL of the signature of a trigger collection, from its entry in the Kabanero index */
+func getTriggerSignatureURL(collection map[string]interface{}, triggerURL string) (string, error) {
+	signatureURL := triggerURL + signatureSuffix
+	triggersArray, _ := collection[TRIGGERS].([]interface{})
+	for _, arrayElement := range triggersArray {
+		mapObj, _ := arrayElement.(map[interface{}]interface{})
+		if value, ok := mapObj[SIGNATURE].(string); ok && value != "" {
+			signatureURL = value
+		}
+	}
+	/* relative to the URL of the trigger collection */
+	base, err := url.Parse(triggerURL)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := base.Parse(signatureURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature URL %s: %v", redactURL(signatureURL), err)
+	}
+	return resolved.String(), nil
+}
+
+/* Verify the signature of the downloaded archive of a trigger collection, if signatures are required */
+func verifyCollectionSignature(creds *collectionCredentials, collection map[string]interface{}, triggerURL string, archiveName string) error {
+	keys, err := readSignatureKeys()
+	if err != nil || keys == nil {
+		return err
+	}
+	signatureURL, err := getTriggerSignatureURL(collection, triggerURL)
+	if err != nil {
+		return err
+	}
+	signature, err := creds.read(signatureURL)
+	if err != nil {
+		incrementMetric("collections.signature.failures")
+		return fmt.Errorf("unable to download the signature of the trigger collection: %v", err)
+	}
+	archive, err := ioutil.ReadFile(archiveName)
+	if err != nil {
+		return err
+	}
+	signer, err := keys.verify(archive, signature)
+	if err != nil {
+		incrementMetric("collections.signature.failures")
+		return fmt.Errorf("invalid signature %s of trigger collection %s: %v", redactURL(signatureURL), redactURL(triggerURL), err)
+	}
+	incrementMetric("collections.signature.verified")
+	klog.Infof("Verified the signature of trigger collection %s with key %s", redactURL(triggerURL), signer)
+	return nil
+}
+
+/* Return an error if a trigger collection can not be signed, while signatures are required */
+func checkSignatureSupported(collectionURL string) error {
+	if signatureRequired() && isGitCollectionURL(collectionURL) {
+		return fmt.Errorf("trigger collection %s in Git can not be loaded: -signatureKeysSecret or -signatureKeysConfigMap require signed archives",
+			strings.TrimPrefix(redactURL(collectionURL), gitCollectionPrefix))
+	}
+	return nil
+}
+
+/* Return an error if a trigger collection can not be loaded from a local directory, since it is not signed */
+func checkTriggerDirSupported(triggerDir string) error {
+	if signatureRequired() {
+		return fmt.Errorf("trigger collection %s can not be loaded from a local directory: -signatureKeysSecret or -signatureKeysConfigMap require signed archives", triggerDir)
+	}
+	return nil
+}
+
+/* Return an error if the EventTriggers of a namespace can not be loaded, since they are not signed */
+func checkCRDTriggersSupported(namespace string) error {
+	if signatureRequired() {
+		return fmt.Errorf("the EventTriggers of namespace %s can not be loaded: -signatureKeysSecret or -signatureKeysConfigMap require signed archives", namespace)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+/* Serve a Kabanero index, the archive of its collection, and signatures */
+func signedIndexServer(t *testing.T, signatureField string, signatures map[string][]byte) *httptest.Server {
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chkSum, err := sha256sum(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/kabanero-index.yaml":
+			fmt.Fprintf(writer, "triggers:\n - url: %s/triggers.tar.gz\n   sha256: %s\n%s", server.URL, chkSum, signatureField)
+		case "/triggers.tar.gz":
+			writer.Write(archive)
+		default:
+			if signature, ok := signatures[req.URL.Path]; ok {
+				writer.Write(signature)
+				return
+			}
+			writer.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestCosignSignature(t *testing.T) {
+	savedConfigMap, savedRead := signatureKeysConfigMap, readSignatureConfigMap
+	defer func() { signatureKeysConfigMap, readSignatureConfigMap = savedConfigMap, savedRead }()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatureKeysConfigMap = "trigger-keys"
+	readSignatureConfigMap = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{"cosign.pub": pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})}, nil
+	}
+	sign := func(data []byte) []byte {
+		digest := sha256.Sum256(data)
+		signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+	}
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the signature is found next to the archive by default */
+	signatures := map[string][]byte{"/triggers.tar.gz.sig": sign(archive)}
+	server := signedIndexServer(t, "", signatures)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = downloadCollection(server.URL+"/kabanero-index.yaml", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	/* a signature of other content, or a missing signature, fail the download */
+	signatures["/triggers.tar.gz.sig"] = sign([]byte("other content"))
+	if err = downloadCollection(server.URL+"/kabanero-index.yaml", dir); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Fatalf("unexpected error downloading a collection with an invalid signature: %v", err)
+	}
+	delete(signatures, "/triggers.tar.gz.sig")
+	if err = downloadCollection(server.URL+"/kabanero-index.yaml", dir); err == nil {
+		t.Fatal("expected an error downloading a collection without signature")
+	}
+	if err = downloadCollection("git+https://github.com/owner/triggers?ref=main", dir); err == nil {
+		t.Fatal("expected an error loading a collection in Git while signatures are required")
+	}
+}
+
+func TestOpenPGPSignature(t *testing.T) {
+	savedSecret, savedRead := signatureKeysSecret, readProviderSecret
+	defer func() { signatureKeysSecret, readProviderSecret = savedSecret, savedRead }()
+
+	entity, err := openpgp.NewEntity("kabanero", "", "kabanero@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey bytes.Buffer
+	writer, err := armor.Encode(&publicKey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.Serialize(writer); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	signatureKeysSecret = "trigger-keys"
+	readProviderSecret = func(name string) (map[string][]byte, error) {
+		return map[string][]byte{"release.asc": publicKey.Bytes()}, nil
+	}
+	archive, err := ioutil.ReadFile(GZIPTAR0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signature bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(archive), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	/* the signature URL of the index is relative to the URL of the archive */
+	server := signedIndexServer(t, "   signature: signatures/triggers.tar.gz.asc\n", map[string][]byte{"/signatures/triggers.tar.gz.asc": signature.Bytes()})
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = downloadCollection(server.URL+"/kabanero-index.yaml", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := readSignatureKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keys.verify([]byte("other content"), signature.Bytes()); err == nil {
+		t.Fatal("expected an error verifying the signature of other content")
+	}
+	if _, err = parseSignatureKeys(map[string][]byte{"invalid": []byte("not a key")}); err == nil {
+		t.Fatal("expected an error parsing an invalid key")
+	}
+}
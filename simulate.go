@@ -0,0 +1,291 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Simulating events. POST /admin/simulate evaluates an event, given as its headers and body, with the triggers of a
+loaded collection in dry-run, and returns the triggers that matched, the actions they would have executed, and the
+resources they would have created, without applying them. The collection is the one that would process the event,
+the canary or the active collection, unless one is named. The simulate subcommand does the same offline, with the
+collection of a local directory: no cluster or message broker is needed, as nothing is applied or sent in dry-run.
+*/
+
+/* The body of a simulation request */
+type simulateRequest struct {
+	EventSource string              `json:"eventSource"`
+	Collection  string              `json:"collection,omitempty"`
+	Header      map[string][]string `json:"header,omitempty"`
+	Body        interface{}         `json:"body"`
+}
+
+/* The result of a simulation */
+type simulateResult struct {
+	Collection  string            `json:"collection"`
+	EventSource string            `json:"eventSource"`
+	EventID     string            `json:"eventID"`
+	Triggers    []string          `json:"triggers"`
+	Actions     []string          `json:"actions"`
+	Rendered    []*dryRunResource `json:"dryRunResources,omitempty"`
+	Retry       *retryHint        `json:"retry,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+/* Return the loaded collection of a name */
+func loadedTriggerProcessor(name string) *triggerProcessor {
+	for _, tp := range loadedTriggerProcessors() {
+		if tp != nil && tp.name == name {
+			return tp
+		}
+	}
+	return nil
+}
+
+/* Return the event source and the message of a simulation request */
+func simulationMessage(request *simulateRequest) (string, map[string]interface{}) {
+	eventSource := request.EventSource
+	if eventSource == "" {
+		eventSource = WEBHOOKDESTINATION
+	}
+	header := request.Header
+	if header == nil {
+		header = make(map[string][]string)
+	}
+	message := map[string]interface{}{
+		HEADER:  header,
+		BODY:    request.Body,
+		EVENTID: newEventID(http.Header(header)),
+	}
+	return eventSource, message
+}
+
+/* Evaluate a simulation request in dry-run */
+func simulate(request *simulateRequest) (*simulateResult, error) {
+	eventSource, message := simulationMessage(request)
+	var tp *triggerProcessor
+	if request.Collection != "" {
+		if tp = loadedTriggerProcessor(request.Collection); tp == nil {
+			return nil, fmt.Errorf("collection %v is not loaded", request.Collection)
+		}
+	} else if tp = selectTriggerProcessor(message, eventSource); tp == nil {
+		return nil, fmt.Errorf("no trigger collection is loaded")
+	}
+	return evaluateSimulation(tp, eventSource, message), nil
+}
+
+/* Evaluate a message with the triggers of a collection in dry-run */
+func evaluateSimulation(tp *triggerProcessor, eventSource string, message map[string]interface{}) *simulateResult {
+	incrementMetric("simulate.requests")
+	result, err := tp.evaluateMessage(message, eventSource, evalOptions{dryrun: true})
+	simulated := &simulateResult{Collection: tp.name, EventSource: eventSource, EventID: message[EVENTID].(string),
+		Triggers: make([]string, 0), Actions: make([]string, 0)}
+	if result != nil {
+		if result.triggers != nil {
+			simulated.Triggers = result.triggers
+		}
+		if result.actions != nil {
+			simulated.Actions = result.actions
+		}
+		simulated.Rendered = result.rendered
+		simulated.Retry = result.retry
+	}
+	if err != nil {
+		simulated.Error = err.Error()
+	}
+	return simulated
+}
+
+/* POST /admin/simulate evaluates an event with the triggers of a collection in dry-run */
+func adminSimulateHandler(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(writer, req, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	request := &simulateRequest{}
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		writeError(writer, req, codeInvalidJSON, fmt.Sprintf("the simulation request is not JSON: %v", err))
+		return
+	}
+	result, err := simulate(request)
+	if err != nil {
+		writeError(writer, req, codeNotFound, err.Error())
+		return
+	}
+	writeJSON(writer, result)
+}
+
+/* A message provider of offline simulations, which is not connected to any broker */
+type offlineProvider struct{}
+
+func (offlineProvider) Send(*EventNode, []byte, interface{}) error { return nil }
+func (offlineProvider) Subscribe(*EventNode) error                 { return nil }
+func (offlineProvider) Receive(*EventNode) ([]byte, error) {
+	return nil, fmt.Errorf("unable to receive messages offline")
+}
+func (offlineProvider) ListenAndServe(*EventNode, ReceiverFunc) {}
+
+/*
+Read the event of an offline simulation: a webhook payload, or the header and body of a message, as printed by the
+tail subcommand. The event type defaults to the name of the file, such as push.json.
+*/
+func readSimulationEvent(fileName string, eventType string) (*simulateRequest, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	if err = json.Unmarshal(content, &body); err != nil {
+		return nil, fmt.Errorf("event %s is not a JSON object: %v", fileName, err)
+	}
+	request := &simulateRequest{Header: make(map[string][]string), Body: body}
+	if _, hasHeader := body[HEADER]; hasHeader {
+		if _, hasBody := body[BODY]; hasBody {
+			if err = json.Unmarshal(content, request); err != nil {
+				return nil, fmt.Errorf("header of event %s is invalid: %v", fileName, err)
+			}
+			if request.Header == nil {
+				request.Header = make(map[string][]string)
+			}
+		}
+	}
+	if eventType == "" {
+		name := filepath.Base(fileName)
+		if _, typed := typedEventTypes[strings.TrimSuffix(name, filepath.Ext(name))]; typed {
+			eventType = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+	}
+	if eventType != "" {
+		http.Header(request.Header).Set("X-Github-Event", eventType)
+	}
+	return request, nil
+}
+
+/* Set up the event destinations of an offline simulation, with a provider that is not connected for each */
+func initializeOfflineProviders(fileName string) error {
+	eventProviders = &EventDefinition{}
+	messageProviders = make(map[string]MessageProvider)
+	if fileName == "" {
+		return nil
+	}
+	ed, err := readEventDefinition(fileName)
+	if err != nil {
+		return err
+	}
+	eventProviders = ed
+	for _, provider := range ed.MessageProviders {
+		messageProviders[provider.Name] = offlineProvider{}
+	}
+	return nil
+}
+
+/* Return the destinations of the events sent by the actions of a simulation */
+func simulatedDestinations(actions []string) []string {
+	destinations := make([]string, 0)
+	for _, action := range actions {
+		if strings.HasPrefix(action, "sendEvent ") {
+			destinations = append(destinations, strings.TrimPrefix(action, "sendEvent "))
+		}
+	}
+	return destinations
+}
+
+/*
+simulateCommand implements "kabanero-events simulate -event <file> -trigger-dir <directory> [-eventSource <name>]
+[-eventType <type>] [-eventDefinitions <file>] [-json]". It evaluates the event with the triggers of the directory in
+dry-run, and prints the triggers that matched, the destinations of the events they would have sent, and the resources
+they would have created.
+*/
+func simulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	eventFile := flags.String("event", "", "JSON file of the webhook payload, or of the header and body of a message")
+	triggerDir := flags.String("trigger-dir", "", "directory of the trigger collection")
+	eventSource := flags.String("eventSource", WEBHOOKDESTINATION, "event source of the event")
+	eventType := flags.String("eventType", "", "X-Github-Event header of the event. By default, the name of the event file if it is push or pull_request")
+	eventDefinitions := flags.String("eventDefinitions", "", "eventDefinitions.yaml of the destinations. By default, the one of the trigger directory, if any")
+	jsonOutput := flags.Bool("json", false, "print the JSON of the result")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kabanero-events simulate -event <file> -trigger-dir <directory> [-eventSource <name>] [-eventType <type>] [-json]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *eventFile == "" || *triggerDir == "" {
+		flags.Usage()
+		return 2
+	}
+
+	request, err := readSimulationEvent(*eventFile, *eventType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: %v\n", err)
+		return 2
+	}
+	request.EventSource = *eventSource
+	if *eventDefinitions == "" {
+		if _, err = os.Stat(filepath.Join(*triggerDir, "eventDefinitions.yaml")); err == nil {
+			*eventDefinitions = filepath.Join(*triggerDir, "eventDefinitions.yaml")
+		}
+	}
+	if err = initializeOfflineProviders(*eventDefinitions); err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: unable to read %s: %v\n", *eventDefinitions, err)
+		return 2
+	}
+	tp := newTriggerProcessor()
+	if err = tp.initialize(*triggerDir); err != nil {
+		fmt.Fprintf(os.Stderr, "simulate: unable to load the triggers of %s: %v\n", *triggerDir, err)
+		return 2
+	}
+
+	source, message := simulationMessage(request)
+	result := evaluateSimulation(tp, source, message)
+	code := 0
+	if result.Error != "" {
+		code = 1
+	}
+	if *jsonOutput {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Printf("%s\n", data)
+		return code
+	}
+	fmt.Printf("Event %s from %s\n", result.EventID, result.EventSource)
+	fmt.Printf("Triggers:     %s\n", strings.Join(result.Triggers, ", "))
+	fmt.Printf("Destinations: %s\n", strings.Join(simulatedDestinations(result.Actions), ", "))
+	for _, action := range result.Actions {
+		fmt.Printf("  %s\n", action)
+	}
+	if result.Error != "" {
+		fmt.Printf("Error: %s\n", result.Error)
+	}
+	for _, rendered := range result.Rendered {
+		data, err := yaml.Marshal(rendered.Resource)
+		if err != nil {
+			data = []byte(err.Error() + "\n")
+		}
+		fmt.Printf("---\n# %s %s of trigger %s\n%s", rendered.Kind, rendered.Name, rendered.Trigger, data)
+	}
+	return code
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSimulateHandler(t *testing.T) {
+	savedProc, savedCanary := triggerProc, canaryProc
+	defer func() { triggerProc, canaryProc = savedProc, savedCanary }()
+	triggerProc, canaryProc = newTriggerProcessor(), nil
+	triggerProc.name = "active"
+	if err := triggerProc.initialize("test_data/trigger15"); err != nil {
+		t.Fatal(err)
+	}
+
+	simulate := func(body string) (int, *simulateResult) {
+		recorder := httptest.NewRecorder()
+		adminSimulateHandler(recorder, httptest.NewRequest(http.MethodPost, "/admin/simulate", strings.NewReader(body)))
+		result := &simulateResult{}
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, result
+	}
+
+	status, result := simulate(`{"eventSource": "github", "header": {"X-Github-Event": ["push"]}, "body": {"ref": "refs/heads/master"}}`)
+	if status != http.StatusOK || result.Collection != "active" || len(result.Actions) != 1 || result.Error != "" {
+		t.Fatalf("unexpected simulation %v %+v", status, result)
+	}
+	if len(result.Rendered) != 1 || result.Rendered[0].Kind != "ConfigMap" || result.Rendered[0].Resource["data"].(map[string]interface{})["ref"] != "refs/heads/master" {
+		t.Fatalf("unexpected rendered resources %+v", result.Rendered)
+	}
+	status, result = simulate(`{"eventSource": "github", "collection": "active", "body": {"ref": "refs/heads/feature"}}`)
+	if status != http.StatusOK || len(result.Actions) != 0 || len(result.Rendered) != 0 {
+		t.Fatalf("unexpected simulation of a feature branch %v %+v", status, result)
+	}
+	if status, _ = simulate(`{"eventSource": "github", "collection": "canary", "body": {}}`); status != http.StatusNotFound {
+		t.Fatalf("unexpected status %v simulating with a collection that is not loaded", status)
+	}
+	if status, _ = simulate(`not json`); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %v simulating an invalid request", status)
+	}
+}
+
+func TestSimulateCommand(t *testing.T) {
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	dir := writeCollection(t, map[string]string{
+		"eventDefinitions.yaml": validEventDefinitions,
+		"triggers.yaml": `eventTriggers:
+  - eventSource: github
+    input: message
+    body:
+      - if: 'message.header["X-Github-Event"][0] == "push"'
+        body:
+          - resources: 'applyResources("resources", message.body)'
+          - sent: 'sendEvent("notifications", message, {})'
+`,
+		"resources/configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{.repository.name}}\n  namespace: kabanero\n",
+		"push.json":                `{"ref": "refs/heads/master", "repository": {"name": "repo"}}`,
+		"message.json":             `{"header": {"X-Github-Event": ["push"]}, "body": {"repository": {"name": "other"}}}`,
+		"invalid.json":             `[]`,
+	})
+	defer os.RemoveAll(dir)
+
+	/* the event type is the name of the file, or the header of a message */
+	for _, name := range []string{"push.json", "message.json"} {
+		request, err := readSimulationEvent(filepath.Join(dir, name), "")
+		if err != nil || http.Header(request.Header).Get("X-Github-Event") != "push" {
+			t.Fatalf("unexpected event %+v read from %v: %v", request, name, err)
+		}
+	}
+	if err := initializeOfflineProviders(filepath.Join(dir, "eventDefinitions.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	tp := newTriggerProcessor()
+	if err := tp.initialize(dir); err != nil {
+		t.Fatal(err)
+	}
+	request, _ := readSimulationEvent(filepath.Join(dir, "push.json"), "")
+	eventSource, message := simulationMessage(request)
+	result := evaluateSimulation(tp, eventSource, message)
+	if result.Error != "" || len(result.Rendered) != 1 || result.Rendered[0].Name != "repo" {
+		t.Fatalf("unexpected simulation %+v", result)
+	}
+	if destinations := simulatedDestinations(result.Actions); len(destinations) != 1 || destinations[0] != "notifications" {
+		t.Fatalf("unexpected destinations %v of actions %v", destinations, result.Actions)
+	}
+
+	for args, expected := range map[string]int{
+		"-event " + filepath.Join(dir, "push.json") + " -trigger-dir " + dir:                     0,
+		"-event " + filepath.Join(dir, "message.json") + " -json -trigger-dir " + dir:            0,
+		"-event " + filepath.Join(dir, "push.json") + " -eventSource gitlab -trigger-dir " + dir: 1,
+		"-event " + filepath.Join(dir, "invalid.json") + " -trigger-dir " + dir:                  2,
+		"-event " + filepath.Join(dir, "push.json") + " -trigger-dir test_data/missing":          2,
+		"-trigger-dir " + dir: 2,
+	} {
+		if code := simulateCommand(strings.Fields(args)); code != expected {
+			t.Errorf("simulate %v exited with %v, expected %v", args, code, expected)
+		}
+	}
+}
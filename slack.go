@@ -0,0 +1,239 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Slack events. The slash commands, interactive components, such as button clicks, and Events API events of a Slack app
+pointed to /slack are normalized into events of the slack kind, so that ChatOps commands, such as "/deploy staging", or
+a "Deploy now" button, start pipelines through the triggers. The slack field of the body holds the command or action,
+its text or value, and the team, channel, and user it came from, whatever the kind of Slack request; the fields of the
+request are kept. The url_verification challenge of the Events API is answered. Requests are verified with the signing
+secret of the app.
+*/
+
+const (
+	SLACKSIGNINGSECRET = "SLACK_SIGNING_SECRET" // environment variable containing the signing secret of the Slack app
+
+	defaultSlackMiddleware = "recovery,requestID,securityHeaders,clientIP,logging,metrics,tracing,sizeLimit,rateLimit,slackAuth"
+
+	slackSignatureVersion   = "v0"
+	slackTimestampTolerance = 5 * time.Minute // maximum age of the timestamp of a Slack request, to prevent replays
+
+	slackTypeCommand     = "command"
+	slackTypeInteraction = "interaction"
+	slackTypeEvent       = "event"
+)
+
+var slackMiddleware string // comma separated middleware chain of the Slack endpoint
+
+/* Return the current time when verifying Slack requests. Replaced in tests */
+var slackNow = time.Now
+
+/*
+Middleware verifying the X-Slack-Signature header of Slack requests: v0= followed by the HMAC SHA256 of
+v0:<X-Slack-Request-Timestamp>:<body>, keyed with the signing secret in the environment variable
+SLACK_SIGNING_SECRET. Requests whose timestamp is not within 5 minutes are rejected. Requests are not verified if the
+variable is not set.
+*/
+func slackAuthMiddleware(next http.Handler) http.Handler {
+	return hmacVerifier{secretEnv: SLACKSIGNINGSECRET, headers: []string{"X-Slack-Signature"}, prefix: slackSignatureVersion + "=", hash: sha256.New,
+		content: slackSignedContent}.middleware(next)
+}
+
+/* Return the content signed by Slack, v0:<X-Slack-Request-Timestamp>:<body>, if the timestamp of the request is recent */
+func slackSignedContent(req *http.Request, body []byte) ([]byte, error) {
+	timestamp := req.Header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || slackNow().Sub(time.Unix(seconds, 0)) > slackTimestampTolerance || time.Unix(seconds, 0).Sub(slackNow()) > slackTimestampTolerance {
+		return nil, fmt.Errorf("invalid or expired timestamp")
+	}
+	return append([]byte(fmt.Sprintf("%s:%s:", slackSignatureVersion, timestamp)), body...), nil
+}
+
+/* HTTP listener of Slack slash commands, interactive components, and events */
+func slackListenerHandler(writer http.ResponseWriter, req *http.Request) {
+	var bodyMap map[string]interface{}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		/* slash commands and interactive components are forms */
+		if maxBodySize > 0 {
+			req.Body = http.MaxBytesReader(writer, req.Body, maxBodySize)
+		}
+		if err := req.ParseForm(); err != nil {
+			writeError(writer, req, codeBadRequest, "invalid form body")
+			return
+		}
+		bodyMap = slackFormBody(req.PostForm)
+	} else {
+		var ok bool
+		if bodyMap, ok = readWebhookBody(writer, req); !ok {
+			return
+		}
+		if bodyMap["type"] == "url_verification" {
+			writer.Header().Set("Content-Type", "application/json")
+			writeJSON(writer, map[string]interface{}{"challenge": bodyMap["challenge"]})
+			return
+		}
+	}
+
+	header, err := normalizeSlackRequest(req.Header, bodyMap)
+	if err != nil {
+		klog.Errorf("Unable to process Slack request: %v", err)
+		writeError(writer, req, codeBadRequest, err.Error())
+		return
+	}
+	id := assignEventID(header)
+	logReceivedEvent(id, "Slack listener received event", req.URL.Path, header, bodyMap)
+	if err = sendWebhookMessage(header, bodyMap); err != nil {
+		respondWebhook(writer, req, err)
+		return
+	}
+	/* Slack requires 200 responses, and shows the response to slash commands to the user who sent them */
+	slack := bodyMap["slack"].(map[string]interface{})
+	if slack["type"] == slackTypeCommand {
+		writer.Header().Set("Content-Type", "application/json")
+		writeJSON(writer, map[string]interface{}{
+			"response_type": "ephemeral",
+			"text":          fmt.Sprintf("Received `%v %v` as event %v", slack["command"], slack["text"], id),
+		})
+	}
+}
+
+/* Return the body of a Slack form: the fields of slash commands, or the JSON payload of interactive components */
+func slackFormBody(form url.Values) map[string]interface{} {
+	body := make(map[string]interface{}, len(form))
+	if payload := form.Get("payload"); payload != "" {
+		if err := json.Unmarshal([]byte(payload), &body); err == nil {
+			return body
+		}
+	}
+	for key := range form {
+		body[key] = form.Get(key)
+	}
+	return body
+}
+
+/* Return a string field of a map */
+func slackString(object interface{}, key string) string {
+	objectMap, _ := object.(map[string]interface{})
+	value, _ := objectMap[key].(string)
+	return value
+}
+
+/* Add the slack field to the body of a Slack request in place, and return its header */
+func normalizeSlackRequest(slackHeader http.Header, body map[string]interface{}) (http.Header, error) {
+	slack := make(map[string]interface{})
+	delivery := ""
+	switch requestType := slackString(body, "type"); {
+	case slackString(body, "command") != "":
+		text := slackString(body, "text")
+		slack["type"] = slackTypeCommand
+		slack["command"] = slackString(body, "command")
+		slack["text"] = text
+		slack["args"] = slackArgs(text)
+		slack["team_id"] = slackString(body, "team_id")
+		slack["channel_id"] = slackString(body, "channel_id")
+		slack["channel"] = slackString(body, "channel_name")
+		slack["user_id"] = slackString(body, "user_id")
+		slack["user"] = slackString(body, "user_name")
+		slack["response_url"] = slackString(body, "response_url")
+		delivery = slackString(body, "trigger_id")
+	case requestType == "block_actions" || requestType == "interactive_message":
+		slack["type"] = slackTypeInteraction
+		slack["interaction"] = requestType
+		action, value := "", ""
+		if actions, ok := body["actions"].([]interface{}); ok && len(actions) > 0 {
+			/* block actions have an action_id, the actions of legacy attachments a name */
+			action, value = slackString(actions[0], "action_id"), slackString(actions[0], "value")
+			if action == "" {
+				action = slackString(actions[0], "name")
+			}
+			if actionMap, ok := actions[0].(map[string]interface{}); ok && value == "" {
+				value = slackString(actionMap["selected_option"], "value")
+			}
+		}
+		slack["action"] = action
+		slack["value"] = value
+		slack["team_id"] = slackString(body["team"], "id")
+		slack["channel_id"] = slackString(body["channel"], "id")
+		slack["channel"] = slackString(body["channel"], "name")
+		slack["user_id"] = slackString(body["user"], "id")
+		user := slackString(body["user"], "username")
+		if user == "" {
+			user = slackString(body["user"], "name")
+		}
+		slack["user"] = user
+		slack["response_url"] = slackString(body, "response_url")
+		delivery = slackString(body, "trigger_id")
+	case requestType == "event_callback":
+		event, _ := body["event"].(map[string]interface{})
+		if event == nil {
+			return nil, fmt.Errorf("Slack event_callback does not contain event")
+		}
+		text := slackString(event, "text")
+		slack["type"] = slackTypeEvent
+		slack["event"] = slackString(event, "type")
+		slack["text"] = text
+		slack["args"] = slackArgs(text)
+		slack["team_id"] = slackString(body, "team_id")
+		slack["channel_id"] = slackString(event, "channel")
+		slack["user_id"] = slackString(event, "user")
+		delivery = slackString(body, "event_id")
+	default:
+		return nil, fmt.Errorf("unsupported Slack request type '%v'", requestType)
+	}
+	body["slack"] = slack
+	/* the deprecated verification token of slash commands is not passed on to triggers */
+	delete(body, "token")
+
+	header := make(http.Header)
+	for key, values := range slackHeader {
+		if http.CanonicalHeaderKey(key) == "X-Slack-Signature" {
+			continue
+		}
+		header[key] = values
+	}
+	header.Set("X-Github-Event", eventKindSlack)
+	if delivery != "" && header.Get("X-Github-Delivery") == "" {
+		header.Set("X-Github-Delivery", delivery)
+	}
+	return header, nil
+}
+
+/* Return the words of the text of a Slack command or message */
+func slackArgs(text string) []interface{} {
+	fields := strings.Fields(text)
+	args := make([]interface{}, len(fields))
+	for index, field := range fields {
+		args[index] = field
+	}
+	return args
+}
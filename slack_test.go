@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSlackRequest(t *testing.T) {
+	command := slackFormBody(url.Values{
+		"token": {"verification"}, "team_id": {"T0001"}, "channel_id": {"C2147483705"}, "channel_name": {"deployments"},
+		"user_id": {"U2147483697"}, "user_name": {"jdoe"}, "command": {"/deploy"}, "text": {"appsody-hello  staging"},
+		"response_url": {"https://hooks.slack.com/commands/1234/5678"}, "trigger_id": {"13345224609.738474920.8088930838d88f008e0"},
+	})
+	header, err := normalizeSlackRequest(http.Header{"X-Slack-Signature": {"v0=0123"}}, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("X-Github-Event") != eventKindSlack || header.Get("X-Github-Delivery") != "13345224609.738474920.8088930838d88f008e0" || header.Get("X-Slack-Signature") != "" {
+		t.Fatalf("unexpected header: %v", header)
+	}
+	slack := command["slack"].(map[string]interface{})
+	args := slack["args"].([]interface{})
+	if slack["type"] != slackTypeCommand || slack["command"] != "/deploy" || len(args) != 2 || args[1] != "staging" || slack["user"] != "jdoe" || slack["channel"] != "deployments" {
+		t.Fatalf("unexpected slack field of a command: %v", slack)
+	}
+	if _, ok := command["token"]; ok || command["team_id"] != "T0001" {
+		t.Fatalf("unexpected command body: %v", command)
+	}
+
+	payload := `{"type": "block_actions", "token": "verification", "trigger_id": "12466734323.1395872398",
+		"team": {"id": "T0001", "domain": "kabanero"}, "user": {"id": "U2147483697", "username": "jdoe"},
+		"channel": {"id": "C2147483705", "name": "deployments"}, "response_url": "https://hooks.slack.com/actions/1234/5678",
+		"actions": [{"action_id": "deploy-now", "block_id": "deploy", "value": "appsody-hello@1.2.0", "type": "button"}]}`
+	interaction := slackFormBody(url.Values{"payload": {payload}})
+	if _, err = normalizeSlackRequest(http.Header{}, interaction); err != nil {
+		t.Fatal(err)
+	}
+	slack = interaction["slack"].(map[string]interface{})
+	if slack["type"] != slackTypeInteraction || slack["action"] != "deploy-now" || slack["value"] != "appsody-hello@1.2.0" || slack["user"] != "jdoe" || slack["team_id"] != "T0001" {
+		t.Fatalf("unexpected slack field of an interaction: %v", slack)
+	}
+
+	event := map[string]interface{}{"type": "event_callback", "team_id": "T0001", "event_id": "Ev0PV52K21",
+		"event": map[string]interface{}{"type": "app_mention", "user": "U2147483697", "channel": "C2147483705", "text": "<@U0LAN0Z89> deploy staging"}}
+	if header, err = normalizeSlackRequest(http.Header{}, event); err != nil || header.Get("X-Github-Delivery") != "Ev0PV52K21" {
+		t.Fatalf("unexpected header %v: %v", header, err)
+	}
+	slack = event["slack"].(map[string]interface{})
+	if slack["type"] != slackTypeEvent || slack["event"] != "app_mention" || len(slack["args"].([]interface{})) != 3 {
+		t.Fatalf("unexpected slack field of an event: %v", slack)
+	}
+
+	if _, err = normalizeSlackRequest(http.Header{}, map[string]interface{}{"type": "app_rate_limited"}); err == nil {
+		t.Fatal("expected error normalizing an unsupported request")
+	}
+}
+
+func TestSlackListener(t *testing.T) {
+	provider := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": provider}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "capture", Topic: "github"}}}
+
+	/* the challenge of the Events API is answered, and not sent */
+	req := httptest.NewRequest(http.MethodPost, "/slack", strings.NewReader(`{"type": "url_verification", "challenge": "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P"}`))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	slackListenerHandler(recorder, req)
+	response := make(map[string]interface{})
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response["challenge"] != "3eZbrw1aBm2rZgRNFdxV2595E9CY3gmdALWMmHkvFXO7tYXAYM8P" {
+		t.Fatalf("unexpected response to the challenge %q: %v", recorder.Body.String(), err)
+	}
+	if len(provider.messages) != 0 {
+		t.Fatal("the challenge was sent")
+	}
+
+	form := url.Values{"command": {"/deploy"}, "text": {"staging"}, "user_name": {"jdoe"}}
+	req = httptest.NewRequest(http.MethodPost, "/slack", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder = httptest.NewRecorder()
+	slackListenerHandler(recorder, req)
+	response = make(map[string]interface{})
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || recorder.Code != http.StatusOK || !strings.HasPrefix(response["text"].(string), "Received `/deploy staging` as event") {
+		t.Fatalf("unexpected response to a command %v %q: %v", recorder.Code, recorder.Body.String(), err)
+	}
+	if len(provider.messages) != 1 {
+		t.Fatalf("unexpected %v messages sent", len(provider.messages))
+	}
+}
+
+func TestSlackAuthMiddleware(t *testing.T) {
+	os.Setenv(SLACKSIGNINGSECRET, "secret")
+	defer os.Unsetenv(SLACKSIGNINGSECRET)
+	savedNow := slackNow
+	defer func() { slackNow = savedNow }()
+	now := time.Unix(1572966245, 0)
+	slackNow = func() time.Time { return now }
+	handler := slackAuthMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {}))
+
+	body := "command=%2Fdeploy&text=staging"
+	sign := func(timestamp int64) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		fmt.Fprintf(mac, "v0:%d:%s", timestamp, body)
+		return "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	for _, test := range []struct {
+		timestamp int64
+		signature string
+		expected  int
+	}{
+		{now.Unix(), sign(now.Unix()), http.StatusOK},
+		{now.Unix() - 60, sign(now.Unix() - 60), http.StatusOK},
+		{now.Unix() - 600, sign(now.Unix() - 600), http.StatusUnauthorized},
+		{now.Unix(), sign(now.Unix() - 60), http.StatusUnauthorized},
+		{now.Unix(), "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", "/slack", strings.NewReader(body))
+		req.Header.Set("X-Slack-Request-Timestamp", fmt.Sprint(test.timestamp))
+		req.Header.Set("X-Slack-Signature", test.signature)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("signature '%v' at %v: status %v, expected %v", test.signature, test.timestamp, recorder.Code, test.expected)
+		}
+	}
+}
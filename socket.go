@@ -0,0 +1,66 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"k8s.io/klog"
+)
+
+var (
+	webhookSocket string // path of a Unix socket to serve the webhook on, in addition to the TCP port
+	adminSocket   string // path of a Unix socket to serve the admin API on, in addition to adminAddr
+)
+
+/*
+Listen on a Unix domain socket. A socket left over by a previous process is removed first. The socket is readable
+and writable by the owner and group only, as it is meant to be shared with a sidecar proxy such as Envoy that
+terminates TLS.
+*/
+func listenUnixSocket(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%v exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("unable to remove stale socket %v: %v", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+/* Serve plain HTTP on a Unix domain socket */
+func serveUnixSocket(path string, handler http.Handler) error {
+	listener, err := listenUnixSocket(path)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Starting listener on Unix socket %v", path)
+	return http.Serve(listener, handler)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kabanero-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhook.sock")
+
+	/* a stale socket from a previous process is replaced */
+	for i := 0; i < 2; i++ {
+		listener, err := listenUnixSocket(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+			continue
+		}
+		defer listener.Close()
+		go http.Serve(listener, http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			writer.Write([]byte("ok"))
+		}))
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Fatalf("unexpected response over Unix socket: %v", string(body))
+	}
+
+	/* a regular file is not removed */
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("data"), 0600)
+	if _, err = listenUnixSocket(file); err == nil {
+		t.Fatal("expected error listening on a regular file")
+	}
+}
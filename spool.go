@@ -0,0 +1,314 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+/*
+Outage buffering. When a message can not be sent to an eventDestination, the destination is unhealthy: the message,
+and all the messages sent to the destination until it recovers, are spooled to disk in order, in a directory of the
+destination under the spool directory. The spool is drained in order once the destination accepts messages again.
+The spool of each destination is bounded, the oldest messages being evicted to make room for new ones. Spools survive
+restarts, and are drained when kabanero-events starts again.
+*/
+
+const spoolSuffix = ".msg"
+
+var (
+	spoolDir           string        // directory of the spools of the destinations. Messages are not spooled if empty
+	spoolMaxBytes      int64         // maximum size of the spool of a destination
+	spoolDrainInterval time.Duration // interval between attempts to drain the spool of an unhealthy destination
+
+	spoolsMutex sync.Mutex
+	spools      = map[string]*destinationSpool{} // spools, by destination
+)
+
+/* A message in a spool */
+type spooledMessage struct {
+	Header  map[string][]string `json:"header,omitempty"`
+	Message []byte              `json:"message"`
+}
+
+/* The spool of a destination */
+type destinationSpool struct {
+	name        string // name of the spool in metrics
+	destination string
+	dir         string
+	maxBytes    int64 // maximum size of the spool. Unbounded if 0
+	reject      bool  // reject messages once the spool is full, rather than evicting the oldest ones
+	durable     bool  // sync spooled messages to disk before they are acknowledged
+
+	mutex sync.Mutex
+	files []string // spooled messages, oldest first
+	sizes map[string]int64
+	size  int64
+	next  uint64 // sequence number of the next spooled message
+}
+
+/* Send a message to the eventDestination specified by name, spooling it if the destination is unhealthy */
+func sendToDestination(name string, bytes []byte, header interface{}) error {
+	if spoolDir == "" {
+		return sendToDestinationNow(name, bytes, header)
+	}
+	spool, err := destinationSpoolFor(name)
+	if err != nil {
+		klog.Errorf("Unable to open the spool of eventDestination '%s': %v", name, err)
+		return sendToDestinationNow(name, bytes, header)
+	}
+	return spool.send(bytes, header)
+}
+
+/* Return the spool of a destination, opening it, and starting to drain it, on first use */
+func destinationSpoolFor(name string) (*destinationSpool, error) {
+	spoolsMutex.Lock()
+	defer spoolsMutex.Unlock()
+	if spool, ok := spools[name]; ok {
+		return spool, nil
+	}
+	if toDomainName(name) != name {
+		/* the name of the destination is the name of the directory of its spool */
+		return nil, fmt.Errorf("name of eventDestination '%s' is not a valid DNS name", name)
+	}
+	spool, err := openSpool(name, filepath.Join(spoolDir, name))
+	if err != nil {
+		return nil, err
+	}
+	spool.maxBytes = spoolMaxBytes
+	spools[name] = spool
+	go spool.drain(spoolDrainInterval)
+	return spool, nil
+}
+
+/* Open the spool of a destination, loading the messages spooled before a restart */
+func openSpool(destination string, dir string) (*destinationSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	spool := &destinationSpool{name: destination, destination: destination, dir: dir, files: make([]string, 0), sizes: make(map[string]int64)}
+	for _, file := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), spoolSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(file.Name(), spoolSuffix) || !file.Mode().IsRegular() {
+			continue
+		}
+		spool.files = append(spool.files, file.Name())
+		spool.sizes[file.Name()] = file.Size()
+		spool.size += file.Size()
+		if seq >= spool.next {
+			spool.next = seq + 1
+		}
+	}
+	/* names are zero padded, so that they sort in order */
+	sort.Strings(spool.files)
+	if len(spool.files) > 0 {
+		klog.Infof("Spool of eventDestination '%s' contains %v messages", destination, len(spool.files))
+	}
+	return spool, nil
+}
+
+/* Open the spools left by a previous run, so that they are drained */
+func initializeSpools() error {
+	if spoolDir == "" {
+		return nil
+	}
+	dirs, err := ioutil.ReadDir(spoolDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			if _, err := destinationSpoolFor(dir.Name()); err != nil {
+				klog.Errorf("Unable to open the spool of eventDestination '%s': %v", dir.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+/* Send a message, unless earlier messages are spooled, in which case it is spooled after them */
+func (spool *destinationSpool) send(bytes []byte, header interface{}) error {
+	if spool.length() == 0 {
+		err := sendToDestinationNow(spool.destination, bytes, header)
+		if err == nil {
+			return nil
+		}
+		klog.Warningf("eventDestination '%s' is unhealthy. Spooling its messages: %v", spool.destination, err)
+		incrementMetric("spool." + spool.name + ".outages")
+	}
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	if err := spool.append(bytes, header); err != nil {
+		return fmt.Errorf("unable to spool message to eventDestination '%s': %v", spool.destination, err)
+	}
+	return nil
+}
+
+/*
+Append a message to the spool, evicting the oldest messages, or rejecting the message, to keep the spool within its
+bound. Called with the lock held
+*/
+func (spool *destinationSpool) append(bytes []byte, header interface{}) error {
+	message := spooledMessage{Message: bytes}
+	if header != nil {
+		headerMap, err := convertToHeaderMap(header)
+		if err != nil {
+			return err
+		}
+		message.Header = headerMap
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if spool.maxBytes > 0 && size > spool.maxBytes {
+		incrementMetric("spool." + spool.name + ".evicted")
+		return fmt.Errorf("message of %v bytes is larger than the spool", size)
+	}
+	for spool.maxBytes > 0 && spool.size+size > spool.maxBytes && len(spool.files) > 0 {
+		if spool.reject {
+			incrementMetric("spool." + spool.name + ".rejected")
+			return fmt.Errorf("spool of %v bytes is full", spool.size)
+		}
+		klog.Warningf("Spool of eventDestination '%s' is full. Evicting the oldest message", spool.destination)
+		incrementMetric("spool." + spool.name + ".evicted")
+		spool.remove(spool.files[0])
+	}
+
+	name := fmt.Sprintf("%020d%s", spool.next, spoolSuffix)
+	temp, err := ioutil.TempFile(spool.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if err == nil && spool.durable {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(spool.dir, name))
+	}
+	if err == nil && spool.durable {
+		err = syncDir(spool.dir)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	spool.next++
+	spool.files = append(spool.files, name)
+	spool.sizes[name] = size
+	spool.size += size
+	incrementMetric("spool." + spool.name + ".spooled")
+	return nil
+}
+
+/* Remove the oldest message of the spool. Called with the lock held */
+func (spool *destinationSpool) remove(name string) {
+	if err := os.Remove(filepath.Join(spool.dir, name)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Unable to remove spooled message %v: %v", name, err)
+	}
+	spool.size -= spool.sizes[name]
+	delete(spool.sizes, name)
+	spool.files = spool.files[1:]
+}
+
+/* Send the oldest spooled message. Returns false once the spool is empty, or if the destination is still unhealthy */
+func (spool *destinationSpool) drainOne() bool {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	if len(spool.files) == 0 {
+		return false
+	}
+	name := spool.files[0]
+	data, err := ioutil.ReadFile(filepath.Join(spool.dir, name))
+	message := spooledMessage{}
+	if err == nil {
+		err = json.Unmarshal(data, &message)
+	}
+	if err != nil {
+		klog.Errorf("Dropping unreadable spooled message %v of eventDestination '%s': %v", name, spool.destination, err)
+		incrementMetric("spool." + spool.name + ".evicted")
+		spool.remove(name)
+		return true
+	}
+	var header interface{}
+	if message.Header != nil {
+		header = message.Header
+	}
+	if err = sendToDestinationNow(spool.destination, message.Message, header); err != nil {
+		if klog.V(4) {
+			klog.Infof("eventDestination '%s' is still unhealthy: %v", spool.destination, err)
+		}
+		return false
+	}
+	incrementMetric("spool." + spool.name + ".drained")
+	spool.remove(name)
+	if len(spool.files) == 0 {
+		klog.Infof("eventDestination '%s' recovered. Its spool is drained", spool.destination)
+	}
+	return true
+}
+
+/* Drain the spool whenever the destination recovers */
+func (spool *destinationSpool) drain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for spool.drainOne() {
+		}
+		<-ticker.C
+	}
+}
+
+/* Return the number of messages spooled for a destination */
+func (spool *destinationSpool) length() int {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	return len(spool.files)
+}
+
+/* Sync a directory, so that the files renamed into it survive a crash */
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func setupSpool(t *testing.T, broker MessageProvider) func() {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	savedDir, savedMax, savedInterval := spoolDir, spoolMaxBytes, spoolDrainInterval
+	messageProviders = map[string]MessageProvider{"broker": broker}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: "github", ProviderRef: "broker"}}}
+	spoolDir, spoolMaxBytes, spoolDrainInterval = dir, 1024, 10*time.Millisecond
+	return func() {
+		messageProviders, eventProviders = savedProviders, savedDefinitions
+		spoolDir, spoolMaxBytes, spoolDrainInterval = savedDir, savedMax, savedInterval
+		spoolsMutex.Lock()
+		spools = map[string]*destinationSpool{}
+		spoolsMutex.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSpoolOutage(t *testing.T) {
+	broker := newBrokerProvider()
+	defer setupSpool(t, broker)()
+
+	if err := sendToDestination("github", []byte(`"1"`), nil); err != nil {
+		t.Fatal(err)
+	}
+	broker.setDown(true)
+	for i := 2; i <= 4; i++ {
+		if err := sendToDestination("github", []byte(fmt.Sprintf(`"%v"`, i)), map[string][]string{"X-Index": {fmt.Sprint(i)}}); err != nil {
+			t.Fatalf("message %v was not spooled: %v", i, err)
+		}
+	}
+	spool, _ := destinationSpoolFor("github")
+	if spool.length() != 3 {
+		t.Fatalf("%v messages spooled, expected 3", spool.length())
+	}
+
+	/* the spool is drained in order once the destination recovers */
+	broker.setDown(false)
+	waitFor(t, func() bool { return spool.length() == 0 })
+	for i := 1; i <= 4; i++ {
+		if data := <-broker.messages; string(data) != fmt.Sprintf(`"%v"`, i) {
+			t.Fatalf("received message %s, expected %v", data, i)
+		}
+	}
+}
+
+func TestSpoolEviction(t *testing.T) {
+	broker := newBrokerProvider()
+	defer setupSpool(t, broker)()
+	broker.setDown(true)
+
+	/* each spooled message is about 350 bytes, base64 encoded, so the spool holds 2 of them */
+	for i := 0; i < 5; i++ {
+		message := []byte(fmt.Sprintf(`"%v%0250d"`, i, 0))
+		if err := sendToDestination("github", message, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spool, _ := destinationSpoolFor("github")
+	if spool.length() != 2 || spool.size > spoolMaxBytes {
+		t.Fatalf("spool of %v messages and %v bytes", spool.length(), spool.size)
+	}
+	if err := sendToDestination("github", make([]byte, 2048), nil); err == nil {
+		t.Fatal("expected error spooling a message larger than the spool")
+	}
+
+	/* spools are reloaded after a restart */
+	spoolsMutex.Lock()
+	spools = map[string]*destinationSpool{}
+	spoolsMutex.Unlock()
+	reopened, err := openSpool("github", spool.dir)
+	if err != nil || reopened.length() != 2 || reopened.files[0] != spool.files[0] || reopened.next != spool.next {
+		t.Fatalf("unexpected reopened spool %v: %v", reopened.files, err)
+	}
+	broker.setDown(false)
+	for reopened.drainOne() {
+	}
+	if data := <-broker.messages; data[1] != '3' {
+		t.Fatalf("oldest message left %s was not drained first", data)
+	}
+}
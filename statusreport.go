@@ -0,0 +1,203 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+)
+
+/*
+Status reporting. Every -statusInterval, each instance of kabanero-events writes its status into status.events of
+the Kabanero CRs of its namespace: its webhook URL, the version of its trigger collections, the health of its message
+providers, the time of the last event it processed, and its most recent errors, from the activity recorded for the
+admin API. The instances that did not report for three intervals are removed, and the EventsHealthy condition is set
+from the health of all instances, so that kubectl shows the health of the gateway.
+*/
+
+const (
+	eventsHealthyCondition = "EventsHealthy"
+	recentStatusErrors     = 5 // number of recent errors reported per instance
+)
+
+var (
+	statusInterval time.Duration // interval of the status reports. Not reported if 0
+	webhookURL     string        // external URL of the webhook listener, as reported in the status
+)
+
+/* An error reported in the status */
+type statusError struct {
+	time    time.Time
+	source  string
+	message string
+}
+
+/* Return the name of this instance of kabanero-events: its pod name */
+func instanceName() string {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+/* Return the most recent errors of the providers, destinations, and triggers, newest first */
+func recentActivityErrors(limit int) []statusError {
+	inspectMutex.Lock()
+	defer inspectMutex.Unlock()
+	errors := make([]statusError, 0)
+	for prefix, activities := range map[string]map[string]*activityStatus{"provider/": providerActivity, "destination/": destinationActivity} {
+		for name, activity := range activities {
+			if activity.LastErrorTime != nil {
+				errors = append(errors, statusError{*activity.LastErrorTime, prefix + name, activity.LastError})
+			}
+		}
+	}
+	for key, activity := range triggerActivities {
+		if activity.LastErrorTime != nil {
+			errors = append(errors, statusError{*activity.LastErrorTime, "trigger/" + key, activity.LastError})
+		}
+	}
+	sort.Slice(errors, func(i, j int) bool {
+		if errors[i].time.Equal(errors[j].time) {
+			return errors[i].source < errors[j].source
+		}
+		return errors[i].time.After(errors[j].time)
+	})
+	if len(errors) > limit {
+		errors = errors[:limit]
+	}
+	return errors
+}
+
+/* Return the status of this instance */
+func instanceStatus(now time.Time) map[string]interface{} {
+	report := checkHealth(true)
+	status := map[string]interface{}{
+		"instance": instanceName(),
+		"health":   report.Status,
+		"updated":  now.UTC().Format(time.RFC3339),
+	}
+	if webhookURL != "" {
+		status["webhookURL"] = redactURL(webhookURL)
+	}
+
+	collections := make([]interface{}, 0)
+	active, canary, shadow := currentCollections()
+	for _, tp := range []*triggerProcessor{active, canary, shadow} {
+		if tp == nil {
+			continue
+		}
+		collection := map[string]interface{}{"name": tp.name, "digest": tp.digest, "triggers": int64(tp.triggerCount())}
+		if tp.indexURL != "" {
+			collection["source"] = redactURL(tp.indexURL)
+		}
+		collections = append(collections, collection)
+	}
+	status["collections"] = collections
+
+	providers := make([]interface{}, 0)
+	if ed := currentEventProviders(); ed != nil {
+		for _, mpd := range ed.MessageProviders {
+			health := "not registered"
+			if provider := lookupMessageProvider(mpd.Name); provider != nil {
+				health = healthOK
+				if err := providerHealth(provider); err != nil {
+					health = err.Error()
+				}
+			}
+			providers = append(providers, map[string]interface{}{"name": mpd.Name, "type": mpd.ProviderType, "health": health})
+		}
+	}
+	status["providers"] = providers
+
+	inspectMutex.Lock()
+	if len(recentEvents) > 0 {
+		status["lastEventTime"] = recentEvents[len(recentEvents)-1].Time.UTC().Format(time.RFC3339)
+	}
+	inspectMutex.Unlock()
+
+	errors := make([]interface{}, 0)
+	for _, err := range recentActivityErrors(recentStatusErrors) {
+		errors = append(errors, map[string]interface{}{"time": err.time.UTC().Format(time.RFC3339), "source": err.source, "message": err.message})
+	}
+	status["recentErrors"] = errors
+	return status
+}
+
+/* Set the status of an instance in status.events, removing the instances that did not report since staleBefore */
+func setInstanceStatus(status map[string]interface{}, instance map[string]interface{}, staleBefore time.Time, now time.Time) {
+	events, _ := status["events"].(map[string]interface{})
+	if events == nil {
+		events = make(map[string]interface{})
+	}
+	existing, _ := events["instances"].([]interface{})
+	instances := []interface{}{instance}
+	for _, obj := range existing {
+		other, ok := obj.(map[string]interface{})
+		if !ok || other["instance"] == instance["instance"] {
+			continue
+		}
+		updated, _ := other["updated"].(string)
+		if updatedTime, err := time.Parse(time.RFC3339, updated); err != nil || updatedTime.Before(staleBefore) {
+			continue
+		}
+		instances = append(instances, other)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return fmt.Sprint(instances[i].(map[string]interface{})["instance"]) < fmt.Sprint(instances[j].(map[string]interface{})["instance"])
+	})
+	events["instances"] = instances
+	status["events"] = events
+
+	condition := map[string]interface{}{
+		"type":    eventsHealthyCondition,
+		"status":  "True",
+		"reason":  "InstancesHealthy",
+		"message": "all instances of kabanero-events are healthy",
+	}
+	for _, obj := range instances {
+		if other := obj.(map[string]interface{}); other["health"] != healthOK {
+			condition["status"], condition["reason"] = "False", "InstanceDegraded"
+			condition["message"] = fmt.Sprintf("instance %v is %v", other["instance"], other["health"])
+			break
+		}
+	}
+	conditions, _ := status["conditions"].([]interface{})
+	status["conditions"] = setStatusCondition(conditions, condition, now)
+}
+
+/* Report the status of this instance in the Kabanero CRs of a namespace */
+func reportInstanceStatus(dynInterf dynamic.Interface, namespace string) {
+	now := time.Now()
+	instance := instanceStatus(now)
+	updateKabaneroStatus(dynInterf, namespace, "the status of instance "+instanceName(), func(status map[string]interface{}) {
+		setInstanceStatus(status, instance, now.Add(-3*statusInterval), now)
+	})
+}
+
+/* Report the status of this instance every -statusInterval. Does not return */
+func reportInstanceStatusPeriodically(dynInterf dynamic.Interface, namespace string) {
+	for {
+		reportInstanceStatus(dynInterf, namespace)
+		time.Sleep(statusInterval)
+	}
+}
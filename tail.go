@@ -0,0 +1,263 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	adminclient "github.com/kabanero-io/kabanero-events/pkg/client"
+)
+
+/* An event received by the tail command */
+type tailEvent struct {
+	destination string
+	data        []byte
+}
+
+/*
+tailCommand implements "kabanero-events tail [-admin <url>] [-eventSource <name>] [-collection <name>] [-raw]".
+It follows the event stream of the admin API, and prints each event as it is processed, with the triggers it matched,
+the actions they executed, and its outcome. With -broker, it connects to the message providers defined in the
+provider config instead, and prints the messages received on the given eventDestinations, or on all destinations that
+can be tailed if none are given.
+*/
+func tailCommand(args []string) int {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	admin := flags.String("admin", "http://localhost:9091", "URL of the admin API")
+	eventSource := flags.String("eventSource", "", "only the events of the given eventSource")
+	collection := flags.String("collection", "", "only the events processed by the given collection")
+	broker := flags.Bool("broker", false, "print the messages received from the message providers of -providercfg rather than the processed events")
+	raw := flags.Bool("raw", false, "print the complete JSON of each event")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kabanero-events tail [-admin <url>] [-eventSource <name>] [-collection <name>] [-raw]\n")
+		fmt.Fprintf(flags.Output(), "       kabanero-events -providercfg <eventDefinitions.yaml> tail -broker [-raw] [destination ...]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *broker {
+		return tailBroker(flags.Args(), *raw)
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "tail: destinations are only tailed with -broker\n")
+		return 2
+	}
+	client := adminclient.New(*admin, os.Getenv(ADMINTOKEN))
+	client.UserAgent = userAgent()
+	if err := tailStream(context.Background(), client, adminclient.TailOptions{EventSource: *eventSource, Collection: *collection}, os.Stdout, *raw); err != nil {
+		fmt.Fprintf(os.Stderr, "tail: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+/* Print the events of the event stream of the admin API until the stream ends or the context is done */
+func tailStream(ctx context.Context, client *adminclient.Client, options adminclient.TailOptions, out io.Writer, raw bool) error {
+	return client.TailEvents(ctx, options, func(record *adminclient.AuditRecord) error {
+		printTailRecord(out, record, raw)
+		return nil
+	})
+}
+
+/* Print one line summarizing the processing of an event, followed by its JSON if raw is set */
+func printTailRecord(out io.Writer, record *adminclient.AuditRecord, raw bool) {
+	fields := []string{record.Time.Format(time.RFC3339), record.Outcome, "[" + record.EventSource + "]", record.Collection}
+	if record.Repository != "" {
+		fields = append(fields, record.Repository)
+	}
+	if len(record.Triggers) > 0 {
+		fields = append(fields, "triggers="+strings.Join(record.Triggers, ","))
+	}
+	if len(record.Actions) > 0 {
+		fields = append(fields, fmt.Sprintf("actions=%v", len(record.Actions)))
+	}
+	if record.EventID != "" {
+		fields = append(fields, "event="+record.EventID)
+	}
+	if record.Error != "" {
+		fields = append(fields, fmt.Sprintf("error=%q", record.Error))
+	}
+	fmt.Fprintln(out, strings.Join(fields, " "))
+
+	if raw {
+		pretty, err := json.MarshalIndent(record, "", "  ")
+		if err == nil {
+			fmt.Fprintf(out, "%s\n", pretty)
+		}
+	}
+}
+
+/* Print the messages received on eventDestinations from their message providers, until killed */
+func tailBroker(names []string, raw bool) int {
+	if providerCfg == "" {
+		fmt.Fprintf(os.Stderr, "tail: the -providercfg flag must point to an eventDefinitions.yaml file\n")
+		return 2
+	}
+
+	var err error
+	eventProviders, err = initializeEventProviders(providerCfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tail: unable to initialize event providers: %v\n", err)
+		return 1
+	}
+
+	nodes, err := tailDestinations(eventProviders, names)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tail: %v\n", err)
+		return 1
+	}
+
+	events := make(chan tailEvent)
+	for _, node := range nodes {
+		provider := eventProviders.GetMessageProvider(node.ProviderRef)
+		if provider == nil {
+			fmt.Fprintf(os.Stderr, "tail: unable to connect to messageProvider '%s' of eventDestination '%s'\n", node.ProviderRef, node.Name)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Listening on eventDestination '%s' (topic '%s')\n", node.Name, node.Topic)
+		destination := node.Name
+		go provider.ListenAndServe(node, func(data []byte) {
+			events <- tailEvent{destination: destination, data: data}
+		})
+	}
+
+	for event := range events {
+		printTailEvent(os.Stdout, event, raw)
+	}
+	return 0
+}
+
+/*
+Whether the messages of a provider type can be tailed. Only the subscriptions of the nats provider are fanned out: the
+other providers that can be listened on share a consumer group, durable consumer or queue with the running mediator,
+and acknowledge the messages they receive, so tailing them would take the messages away from the mediator.
+*/
+func tailableProviderType(providerType string) bool {
+	return providerType == "nats"
+}
+
+/* Find the destinations to tail. With no names, all destinations whose provider can be tailed are returned. */
+func tailDestinations(ed *EventDefinition, names []string) ([]*EventNode, error) {
+	nodes := make([]*EventNode, 0)
+	if len(names) == 0 {
+		for _, node := range ed.EventDestinations {
+			mpd := ed.GetMessageProviderDefinition(node.ProviderRef)
+			if mpd == nil || !tailableProviderType(mpd.ProviderType) {
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("no eventDestinations that can be tailed are defined in %s", providerCfg)
+		}
+		return nodes, nil
+	}
+
+	for _, name := range names {
+		node := ed.GetEventDestination(name)
+		if node == nil {
+			return nil, fmt.Errorf("eventDestination '%s' is not defined in %s", name, providerCfg)
+		}
+		mpd := ed.GetMessageProviderDefinition(node.ProviderRef)
+		if mpd == nil {
+			return nil, fmt.Errorf("messageProvider '%s' of eventDestination '%s' is not defined in %s", node.ProviderRef, name, providerCfg)
+		}
+		if !tailableProviderType(mpd.ProviderType) {
+			return nil, fmt.Errorf("eventDestination '%s' uses a %s provider, which can not be tailed without taking its messages away from the mediator", name, mpd.ProviderType)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+/* Print one line summarizing an event, followed by its JSON if raw is set */
+func printTailEvent(out io.Writer, event tailEvent, raw bool) {
+	timestamp := time.Now().Format(time.RFC3339)
+
+	var message map[string]interface{}
+	if err := json.Unmarshal(event.data, &message); err != nil {
+		fmt.Fprintf(out, "%s [%s] <not JSON: %v> %s\n", timestamp, event.destination, err, string(event.data))
+		return
+	}
+
+	header, _ := message[HEADER].(map[string]interface{})
+	body, _ := message[BODY].(map[string]interface{})
+
+	eventType := tailHeaderValue(header, "X-Github-Event")
+	if eventType == "" {
+		eventType = "-"
+	}
+	fields := []string{timestamp, "[" + event.destination + "]", eventType}
+
+	if repository, ok := body["repository"].(map[string]interface{}); ok {
+		if fullName, ok := repository["full_name"].(string); ok {
+			fields = append(fields, fullName)
+		} else if htmlURL, ok := repository["html_url"].(string); ok {
+			fields = append(fields, htmlURL)
+		}
+	}
+	if ref, ok := body["ref"].(string); ok {
+		fields = append(fields, ref)
+	} else if pr, ok := body["pull_request"].(map[string]interface{}); ok {
+		if head, ok := pr["head"].(map[string]interface{}); ok {
+			if ref, ok := head["ref"].(string); ok {
+				fields = append(fields, ref)
+			}
+		}
+	}
+	if action, ok := body["action"].(string); ok {
+		fields = append(fields, "action="+action)
+	}
+	if delivery := tailHeaderValue(header, "X-Github-Delivery"); delivery != "" {
+		fields = append(fields, "delivery="+delivery)
+	}
+	fmt.Fprintln(out, strings.Join(fields, " "))
+
+	if raw {
+		pretty, err := json.MarshalIndent(message, "", "  ")
+		if err == nil {
+			fmt.Fprintf(out, "%s\n", pretty)
+		}
+	}
+}
+
+/* Return the first value of a header in a decoded message. The lookup is case insensitive. */
+func tailHeaderValue(header map[string]interface{}, name string) string {
+	for key, val := range header {
+		if !strings.EqualFold(key, name) {
+			continue
+		}
+		switch v := val.(type) {
+		case string:
+			return v
+		case []interface{}:
+			if len(v) > 0 {
+				if str, ok := v[0].(string); ok {
+					return str
+				}
+			}
+		}
+	}
+	return ""
+}
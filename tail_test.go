@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	adminclient "github.com/kabanero-io/kabanero-events/pkg/client"
+)
+
+func TestTailStream(t *testing.T) {
+	savedStore := auditStore
+	defer func() { auditStore = savedStore }()
+	auditStore = newMemoryStore()
+
+	server := httptest.NewServer(http.HandlerFunc(adminEventStreamHandler))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- tailStream(ctx, adminclient.New(server.URL, ""), adminclient.TailOptions{Collection: "active"}, writer, false)
+		writer.Close()
+	}()
+
+	/* the records are published once the client is subscribed */
+	waitFor(t, func() bool {
+		auditSubscribersMutex.Lock()
+		defer auditSubscribersMutex.Unlock()
+		return len(auditSubscribers) > 0
+	})
+	message := map[string]interface{}{EVENTID: "canary-event"}
+	recordAudit(message, "github", "canary", nil, nil)
+	message[EVENTID] = "active-event"
+	recordAudit(message, "github", "active", &evalResult{triggers: []string{"build", "notify"}, actions: []string{"applyResources build"}}, fmt.Errorf("notify failed"))
+
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{" error [github] active ", " triggers=build,notify ", " actions=1 ", " event=active-event ", ` error="notify failed"`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("tailed line %q does not contain %q", line, field)
+		}
+	}
+
+	/* the end of the tail is not an error */
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tail did not stop")
+	}
+}
+
+func TestPrintTailRecord(t *testing.T) {
+	record := &adminclient.AuditRecord{Time: time.Date(2019, 11, 20, 10, 15, 4, 0, time.UTC), EventSource: "github", Collection: "active",
+		Repository: "myorg/project1", Outcome: auditOutcomeNone}
+	out := &bytes.Buffer{}
+	printTailRecord(out, record, true)
+	lines := strings.SplitN(out.String(), "\n", 2)
+	if lines[0] != "2019-11-20T10:15:04Z none [github] active myorg/project1" {
+		t.Errorf("unexpected line %q", lines[0])
+	}
+	if !strings.Contains(lines[1], `"repository": "myorg/project1"`) {
+		t.Errorf("unexpected JSON %q", lines[1])
+	}
+}
+
+func TestPrintTailEvent(t *testing.T) {
+	out := &bytes.Buffer{}
+	data := `{"header": {"X-Github-Event": ["push"], "X-Github-Delivery": ["1"]}, "body": {"ref": "refs/heads/master", "repository": {"full_name": "myorg/project1"}}}`
+	printTailEvent(out, tailEvent{destination: "github", data: []byte(data)}, false)
+	if line := out.String(); !strings.HasSuffix(line, " [github] push myorg/project1 refs/heads/master delivery=1\n") {
+		t.Errorf("unexpected line %q", line)
+	}
+}
+
+func TestTailDestinations(t *testing.T) {
+	ed := &EventDefinition{
+		MessageProviders:  []*MessageProviderDefinition{{Name: "nats", ProviderType: "nats"}, {Name: "rest", ProviderType: "rest"}, {Name: "redis", ProviderType: "redis"}},
+		EventDestinations: []*EventNode{{Name: "github", ProviderRef: "nats"}, {Name: "sink", ProviderRef: "rest"}, {Name: "stream", ProviderRef: "redis"}},
+	}
+	if nodes, err := tailDestinations(ed, nil); err != nil || len(nodes) != 1 || nodes[0].Name != "github" {
+		t.Errorf("unexpected destinations %v: %v", nodes, err)
+	}
+	if _, err := tailDestinations(ed, []string{"sink"}); err == nil {
+		t.Error("destination of a rest provider was tailed")
+	}
+	/* the messages of a consumer group would be taken away from the mediator */
+	if _, err := tailDestinations(ed, []string{"stream"}); err == nil {
+		t.Error("destination of a redis provider was tailed")
+	}
+	if _, err := tailDestinations(ed, []string{"unknown"}); err == nil {
+		t.Error("unknown destination was tailed")
+	}
+}
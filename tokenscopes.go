@@ -0,0 +1,319 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+)
+
+/*
+Validation of the git API tokens. With -validateTokens, the token of each secret of the cache of git secrets is checked
+when the secrets are first listed, and again whenever the secret is added or its token rotated, with an authenticated
+call to the GitHub API of the hosts of its URLs, which returns the OAuth scopes of the token. Tokens that are rejected,
+or lack one of the -requiredTokenScopes, fail the tokens check of the readiness probe and set the InvalidGitTokens
+condition of the Kabanero CR, so that operators find bad tokens before the first webhook fails. Tokens that do not
+report scopes, such as fine-grained tokens, are only checked to be accepted.
+*/
+
+const (
+	invalidGitTokensCondition  = "InvalidGitTokens"
+	invalidGitTokensReason     = "GitTokensRejected"
+	invalidGitTokensNoneReason = "GitTokensValid"
+	tokenValidationTimeout     = 10 * time.Second
+)
+
+var (
+	validateTokens      bool   // validate the git API tokens of the secrets
+	requiredTokenScopes string // comma separated OAuth scopes required of the git API tokens
+)
+
+/* The scopes implied by OAuth scopes that include others */
+var impliedTokenScopes = map[string][]string{
+	"repo":             {"repo:status", "repo_deployment", "public_repo", "repo:invite", "security_events"},
+	"admin:org":        {"write:org", "read:org"},
+	"write:org":        {"read:org"},
+	"admin:repo_hook":  {"write:repo_hook", "read:repo_hook"},
+	"write:repo_hook":  {"read:repo_hook"},
+	"admin:public_key": {"write:public_key", "read:public_key"},
+	"user":             {"read:user", "user:email", "user:follow"},
+}
+
+/* The result of the validation of the token of a secret on a host */
+type tokenValidation struct {
+	secret  string
+	host    string
+	digest  string   // digest of the username and token that were validated
+	scopes  []string // scopes of the token, nil if not reported
+	missing []string // required scopes the token lacks
+	err     error    // error calling the API, such as the token being rejected
+}
+
+/* Return the problem of a token, or nil if it is valid */
+func (validation *tokenValidation) problem() error {
+	if validation.err != nil {
+		return fmt.Errorf("secret %s: token rejected by %s: %v", validation.secret, validation.host, validation.err)
+	}
+	if len(validation.missing) > 0 {
+		return fmt.Errorf("secret %s: token for %s lacks scopes %s", validation.secret, validation.host, strings.Join(validation.missing, ","))
+	}
+	return nil
+}
+
+/* The validations of the tokens, by secret and host */
+type tokenValidations struct {
+	mutex       sync.Mutex
+	validations map[string]*tokenValidation
+}
+
+var (
+	gitTokenValidations  = &tokenValidations{validations: make(map[string]*tokenValidation)}
+	tokenValidationMutex sync.Mutex // validations run one at a time, so that a validation of older secrets is not stored last
+)
+
+/* Return the scopes of a token on a host. Replaced in tests */
+var fetchTokenScopes = func(apiURL string, username string, token string) ([]string, error) {
+	tp := github.BasicAuthTransport{Username: username, Password: token}
+	client, err := github.NewEnterpriseClient(apiURL, apiURL, tp.Client())
+	if err != nil {
+		return nil, err
+	}
+	client.UserAgent = userAgent()
+	ctx, cancel := context.WithTimeout(context.Background(), tokenValidationTimeout)
+	defer cancel()
+	_, resp, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	header := resp.Header.Get("X-Oauth-Scopes")
+	if _, reported := resp.Header[http.CanonicalHeaderKey("X-Oauth-Scopes")]; !reported {
+		return nil, nil
+	}
+	scopes := make([]string, 0)
+	for _, scope := range strings.Split(header, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+/* Return the GitHub API URL and the host of a URL pattern, or empty strings if it has no host */
+func gitHubAPIURL(pattern string) (string, string) {
+	if strings.HasPrefix(pattern, regexURLPatternPrefix) {
+		return "", ""
+	}
+	if index := strings.Index(pattern, "*"); index >= 0 {
+		pattern = pattern[:index]
+	}
+	if !strings.Contains(pattern, "://") {
+		pattern = "https://" + pattern
+	}
+	parsed, err := url.Parse(pattern)
+	if err != nil || parsed.Host == "" {
+		return "", ""
+	}
+	if parsed.Host == "github.com" || parsed.Host == "www.github.com" {
+		return "https://api.github.com/", parsed.Host
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/api/v3/", parsed.Host
+}
+
+/* Return the required scopes that a token lacks */
+func missingTokenScopes(scopes []string, required []string) []string {
+	granted := make(map[string]bool)
+	for _, scope := range scopes {
+		granted[scope] = true
+		for _, implied := range impliedTokenScopes[scope] {
+			granted[implied] = true
+		}
+	}
+	missing := make([]string, 0)
+	for _, scope := range required {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+/* Return the scopes of -requiredTokenScopes */
+func requiredScopes() []string {
+	scopes := make([]string, 0)
+	for _, scope := range strings.Split(requiredTokenScopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+/* Return the digest of the credentials of a secret, to find rotated tokens */
+func credentialsDigest(secret *gitSecret) string {
+	sum := sha256.Sum256([]byte(secret.username + ":" + secret.token))
+	return fmt.Sprintf("%x", sum)
+}
+
+/*
+Validate the tokens of secrets that were not validated yet, or whose token changed, and forget the validations of
+secrets that were removed. Returns whether any validation changed.
+*/
+func (tv *tokenValidations) validate(secrets []*gitSecret) bool {
+	type pendingValidation struct {
+		validation *tokenValidation
+		apiURL     string
+		username   string
+		token      string
+	}
+	current := make(map[string]*tokenValidation)
+	pending := make([]pendingValidation, 0)
+	tv.mutex.Lock()
+	for _, secret := range secrets {
+		if !secret.hasToken {
+			continue
+		}
+		digest := credentialsDigest(secret)
+		for _, pattern := range append(append([]string{}, secret.kabanero...), secret.tekton...) {
+			apiURL, host := gitHubAPIURL(pattern)
+			if apiURL == "" {
+				continue
+			}
+			key := secret.name + " " + apiURL
+			if _, ok := current[key]; ok {
+				continue
+			}
+			if existing, ok := tv.validations[key]; ok && existing.digest == digest {
+				current[key] = existing
+				continue
+			}
+			validation := &tokenValidation{secret: secret.name, host: host, digest: digest}
+			current[key] = validation
+			username, _ := base64.StdEncoding.DecodeString(secret.username)
+			token, _ := base64.StdEncoding.DecodeString(secret.token)
+			pending = append(pending, pendingValidation{validation, apiURL, string(username), string(token)})
+		}
+	}
+	removed := len(tv.validations) != len(current)-countMissing(tv.validations, current)
+	tv.mutex.Unlock()
+	if len(pending) == 0 && !removed {
+		return false
+	}
+
+	/* the API is called without the lock. The pending validations are not visible until they are stored */
+	required := requiredScopes()
+	for _, p := range pending {
+		p.validation.scopes, p.validation.err = fetchTokenScopes(p.apiURL, p.username, p.token)
+		if p.validation.err == nil && p.validation.scopes != nil {
+			p.validation.missing = missingTokenScopes(p.validation.scopes, required)
+		}
+	}
+	tv.mutex.Lock()
+	defer tv.mutex.Unlock()
+	tv.validations = current
+	invalid := 0
+	for _, validation := range current {
+		if validation.problem() != nil {
+			invalid++
+		}
+	}
+	setMetric("tokens.invalid", int64(invalid))
+	return true
+}
+
+/* Return the number of validations of current that are not in previous */
+func countMissing(previous map[string]*tokenValidation, current map[string]*tokenValidation) int {
+	count := 0
+	for key := range current {
+		if _, ok := previous[key]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+/* Return the problems of the tokens, sorted */
+func (tv *tokenValidations) problems() []string {
+	tv.mutex.Lock()
+	defer tv.mutex.Unlock()
+	problems := make([]string, 0)
+	for _, validation := range tv.validations {
+		if problem := validation.problem(); problem != nil {
+			problems = append(problems, problem.Error())
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+/* The tokens check of the readiness probe */
+func tokensHealth() error {
+	problems := gitTokenValidations.problems()
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+/* Return the conditions of a status, with the InvalidGitTokens condition set */
+func setTokenCondition(conditions []interface{}, problems []string, now time.Time) []interface{} {
+	condition := map[string]interface{}{
+		"type":    invalidGitTokensCondition,
+		"status":  "False",
+		"reason":  invalidGitTokensNoneReason,
+		"message": "the git API tokens are valid",
+	}
+	if len(problems) > 0 {
+		condition["status"] = "True"
+		condition["reason"] = invalidGitTokensReason
+		condition["message"] = strings.Join(problems, "; ")
+	}
+	return setStatusCondition(conditions, condition, now)
+}
+
+/* Validate the tokens of the cached git secrets, reporting the problems found. Called when the secrets change */
+func validateGitTokens(dynInterf dynamic.Interface, namespace string) {
+	if !validateTokens {
+		return
+	}
+	tokenValidationMutex.Lock()
+	defer tokenValidationMutex.Unlock()
+	if !gitTokenValidations.validate(gitSecrets.list()) {
+		return
+	}
+	incrementMetric("tokens.validations")
+	problems := gitTokenValidations.problems()
+	for _, problem := range problems {
+		klog.Warningf("Invalid git API token: %v", problem)
+	}
+	if dynInterf != nil {
+		updateKabaneroCondition(dynInterf, namespace, invalidGitTokensCondition, func(conditions []interface{}) []interface{} {
+			return setTokenCondition(conditions, problems, time.Now())
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestGitHubAPIURL(t *testing.T) {
+	tests := map[string]string{
+		"https://github.com/myorg":          "https://api.github.com/",
+		"https://github.com/myorg/*":        "https://api.github.com/",
+		"https://github.ibm.com/org/repo":   "https://github.ibm.com/api/v3/",
+		"github.ibm.com":                    "https://github.ibm.com/api/v3/",
+		"regex:https://github\\.com/org/.*": "",
+	}
+	for pattern, expected := range tests {
+		if apiURL, _ := gitHubAPIURL(pattern); apiURL != expected {
+			t.Errorf("gitHubAPIURL(%v) returned %v, expected %v", pattern, apiURL, expected)
+		}
+	}
+}
+
+func TestMissingTokenScopes(t *testing.T) {
+	if missing := missingTokenScopes([]string{"repo", "admin:org"}, []string{"repo", "public_repo", "read:org"}); len(missing) != 0 {
+		t.Fatalf("unexpected missing scopes %v", missing)
+	}
+	if missing := missingTokenScopes([]string{"public_repo"}, []string{"repo", "read:org"}); strings.Join(missing, ",") != "repo,read:org" {
+		t.Fatalf("unexpected missing scopes %v", missing)
+	}
+}
+
+func TestValidateGitTokens(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		calls++
+		username, token, _ := req.BasicAuth()
+		if req.URL.Path != "/api/v3/user" {
+			http.NotFound(writer, req)
+			return
+		}
+		switch token {
+		case "full":
+			writer.Header().Set("X-OAuth-Scopes", "repo, read:org")
+		case "public":
+			writer.Header().Set("X-OAuth-Scopes", "public_repo")
+		case "fine-grained":
+		default:
+			http.Error(writer, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		writer.Write([]byte(`{"login": "` + username + `"}`))
+	}))
+	defer server.Close()
+
+	savedSecrets, savedValidations, savedEnabled, savedScopes := gitSecrets, gitTokenValidations, validateTokens, requiredTokenScopes
+	defer func() {
+		gitSecrets, gitTokenValidations, validateTokens, requiredTokenScopes = savedSecrets, savedValidations, savedEnabled, savedScopes
+	}()
+	gitSecrets = newSecretsCache()
+	gitTokenValidations = &tokenValidations{validations: make(map[string]*tokenValidation)}
+	validateTokens, requiredTokenScopes = true, "repo"
+
+	gitSecrets.replace("kabanero", []unstructured.Unstructured{
+		*newTestSecret("full", map[string]string{"kabanero.io/git-0": server.URL + "/org1"}, "user", "full"),
+		*newTestSecret("public", map[string]string{"kabanero.io/git-0": server.URL + "/org2/*"}, "user", "public"),
+		*newTestSecret("fine-grained", map[string]string{"kabanero.io/git-0": server.URL + "/org3"}, "user", "fine-grained"),
+		*newTestSecret("revoked", map[string]string{"kabanero.io/git-0": server.URL + "/org4"}, "user", "revoked"),
+		*newTestSecret("regex", map[string]string{"kabanero.io/git-0": "regex:.*"}, "user", "full"),
+	})
+	validateGitTokens(nil, "kabanero")
+	if calls != 4 {
+		t.Fatalf("API was called %v times, expected 4", calls)
+	}
+	problems := gitTokenValidations.problems()
+	if len(problems) != 2 || !strings.Contains(problems[0], "secret public: ") || !strings.Contains(problems[0], "lacks scopes repo") || !strings.Contains(problems[1], "secret revoked: token rejected") {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+	if err := tokensHealth(); err == nil {
+		t.Fatal("tokens check passed with invalid tokens")
+	}
+
+	/* tokens are only validated again when rotated */
+	validateGitTokens(nil, "kabanero")
+	if calls != 4 {
+		t.Fatalf("API was called %v times without rotated tokens", calls)
+	}
+	gitSecrets.update(newTestSecret("revoked", map[string]string{"kabanero.io/git-0": server.URL + "/org4"}, "user", "full"))
+	gitSecrets.delete(newTestSecret("public", nil, "", ""))
+	validateGitTokens(nil, "kabanero")
+	if calls != 5 {
+		t.Fatalf("API was called %v times, expected 5", calls)
+	}
+	if err := tokensHealth(); err != nil {
+		t.Fatalf("tokens check failed after rotation: %v", err)
+	}
+}
+
+func TestSetTokenCondition(t *testing.T) {
+	then := time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)
+	conditions := setTokenCondition(nil, []string{"secret a: token rejected"}, then)
+	condition := conditions[0].(map[string]interface{})
+	if condition["type"] != invalidGitTokensCondition || condition["status"] != "True" || condition["reason"] != invalidGitTokensReason {
+		t.Fatalf("unexpected condition %v", condition)
+	}
+	conditions = setTokenCondition(conditions, nil, then.Add(time.Hour))
+	condition = conditions[0].(map[string]interface{})
+	if len(conditions) != 1 || condition["status"] != "False" || condition["lastTransitionTime"] != "2019-11-01T01:00:00Z" {
+		t.Fatalf("unexpected conditions %v", conditions)
+	}
+}
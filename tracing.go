@@ -0,0 +1,414 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+/*
+Distributed tracing. The webhook request, the send of its message to the event destination, the processing of the
+message, the evaluation of each trigger, and the events sent by triggers are recorded as OpenTelemetry spans of the
+trace of the W3C traceparent header of the request, or of a new trace. The trace context is kept in the traceparent
+field of the webhook message, so that the consumers of the destination, such as other NATS subscribers, join the
+trace, and is set on the PipelineRuns and TaskRuns created by triggers, for Tekton to continue the trace. With
+-otlpEndpoint, the spans are exported in batches to an OpenTelemetry collector with OTLP over HTTP, in its JSON
+encoding; otherwise only the trace context is propagated. Spans are dropped, rather than slowing the processing of
+events, when the collector can not keep up.
+*/
+
+const (
+	TRACEPARENT = "traceparent" // the W3C trace context of a message, and the header holding it
+
+	tektonPipelineRunSpanContext = "tekton.dev/pipelinerunSpanContext"
+	tektonTaskRunSpanContext     = "tekton.dev/taskrunSpanContext"
+
+	/* the kinds of OpenTelemetry spans */
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanKindProducer = 4
+	spanKindConsumer = 5
+
+	/* the status codes of OpenTelemetry spans */
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	traceBatchSize     = 256
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+)
+
+var (
+	otlpEndpoint     string  // URL of the OTLP/HTTP traces endpoint of the collector, such as http://collector:4318/v1/traces
+	otlpHeaders      string  // comma separated name=value headers sent to the collector
+	traceServiceName string  // service.name of the spans
+	traceSampleRatio float64 // ratio of the new traces that are sampled
+
+	tracer *spanExporter // nil if spans are not exported
+)
+
+/* The W3C trace context of a span */
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+/* Return whether the context identifies a span */
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+/* Return the traceparent header of the context */
+func (sc spanContext) traceparent() string {
+	if !sc.valid() {
+		return ""
+	}
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+/* Parse a traceparent header. Returns an invalid context if it is not a valid version 00 header */
+func parseTraceparent(header string) spanContext {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return spanContext{}
+	}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return spanContext{}
+	}
+	copy(sc.traceID[:], traceID)
+	copy(sc.spanID[:], spanID)
+	sc.sampled = flags[0]&1 == 1
+	if !sc.valid() {
+		return spanContext{}
+	}
+	return sc
+}
+
+/* Return the trace context of a message: its traceparent field, or the traceparent header of its event */
+func messageTraceContext(message map[string]interface{}) spanContext {
+	if traceparent, ok := message[TRACEPARENT].(string); ok {
+		if sc := parseTraceparent(traceparent); sc.valid() {
+			return sc
+		}
+	}
+	header, err := convertToHeaderMap(message[HEADER])
+	if err != nil {
+		return spanContext{}
+	}
+	return parseTraceparent(http.Header(header).Get(TRACEPARENT))
+}
+
+/* A span being recorded */
+type span struct {
+	name       string
+	kind       int
+	context    spanContext
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+/* Start a span, child of parent, or the root of a new trace if parent is not valid */
+func startSpan(name string, kind int, parent spanContext) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), attributes: make(map[string]interface{})}
+	if parent.valid() {
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = sampleTrace(s.context.traceID)
+	}
+	rand.Read(s.context.spanID[:])
+	return s
+}
+
+/* Return whether a new trace is sampled, from the ratio of -traceSampleRatio */
+func sampleTrace(traceID [16]byte) bool {
+	if traceSampleRatio >= 1 {
+		return true
+	}
+	if traceSampleRatio <= 0 {
+		return false
+	}
+	/* the lower 8 bytes of the trace ID are random, as for the TraceIdRatioBased sampler */
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>1) < traceSampleRatio*float64(uint64(1)<<63)
+}
+
+/* Set an attribute of the span */
+func (s *span) setAttribute(key string, value interface{}) {
+	if s != nil {
+		s.attributes[key] = value
+	}
+}
+
+/* End the span, failed if err is not nil, and export it if it is sampled */
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	if tracer != nil && s.context.sampled {
+		tracer.export(s)
+	}
+}
+
+/* Converts spans to the OTLP JSON encoding */
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func toOTLPAttributes(attributes map[string]interface{}) []otlpAttribute {
+	converted := make([]otlpAttribute, 0, len(attributes))
+	for key, value := range attributes {
+		var v otlpValue
+		switch typed := value.(type) {
+		case bool:
+			v.BoolValue = &typed
+		case int:
+			str := strconv.Itoa(typed)
+			v.IntValue = &str
+		case int64:
+			str := strconv.FormatInt(typed, 10)
+			v.IntValue = &str
+		case float64:
+			v.DoubleValue = &typed
+		default:
+			str := fmt.Sprintf("%v", value)
+			v.StringValue = &str
+		}
+		converted = append(converted, otlpAttribute{Key: key, Value: v})
+	}
+	return converted
+}
+
+/* Return the OTLP JSON of a span */
+func (s *span) otlp() map[string]interface{} {
+	converted := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.context.traceID[:]),
+		"spanId":            hex.EncodeToString(s.context.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        toOTLPAttributes(s.attributes),
+		"status":            map[string]interface{}{"code": spanStatusOK},
+	}
+	if s.parentID != [8]byte{} {
+		converted["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		converted["status"] = map[string]interface{}{"code": spanStatusError, "message": s.err.Error()}
+	}
+	return converted
+}
+
+/* Exports spans in batches to an OTLP/HTTP endpoint */
+type spanExporter struct {
+	endpoint string
+	headers  http.Header
+	client   *http.Client
+	queue    chan *span
+}
+
+/* Create the exporter of -otlpEndpoint, and start exporting. Returns nil if no endpoint is configured */
+func startTracing() (*spanExporter, error) {
+	if otlpEndpoint == "" {
+		return nil, nil
+	}
+	headers := make(http.Header)
+	for _, header := range strings.Split(otlpHeaders, ",") {
+		if strings.TrimSpace(header) == "" {
+			continue
+		}
+		nameValue := strings.SplitN(header, "=", 2)
+		if len(nameValue) != 2 || strings.TrimSpace(nameValue[0]) == "" {
+			return nil, fmt.Errorf("header %q of -otlpHeaders is not name=value", header)
+		}
+		headers.Set(strings.TrimSpace(nameValue[0]), strings.TrimSpace(nameValue[1]))
+	}
+	exporter := &spanExporter{
+		endpoint: otlpEndpoint,
+		headers:  headers,
+		client:   &http.Client{Transport: withUserAgent(nil), Timeout: 10 * time.Second},
+		queue:    make(chan *span, traceQueueSize),
+	}
+	go exporter.run(traceFlushInterval)
+	return exporter, nil
+}
+
+/* Queue a span to be exported */
+func (exporter *spanExporter) export(s *span) {
+	select {
+	case exporter.queue <- s:
+	default:
+		incrementMetric("tracing.dropped")
+	}
+}
+
+/* Export the queued spans every interval, or as soon as a batch is full. Does not return */
+func (exporter *spanExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case s := <-exporter.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := exporter.send(batch); err != nil {
+			incrementMetric("tracing.errors")
+			klog.Warningf("Unable to export %v spans to %v: %v", len(batch), exporter.endpoint, err)
+		} else {
+			metrics.Add("tracing.spans", int64(len(batch)))
+		}
+		batch = make([]*span, 0, traceBatchSize)
+	}
+}
+
+/* Send a batch of spans to the collector */
+func (exporter *spanExporter) send(batch []*span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": toOTLPAttributes(map[string]interface{}{"service.name": traceServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "kabanero-events"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, exporter.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range exporter.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %v", resp.Status)
+	}
+	return nil
+}
+
+/* Return a copy of the header of a message sent by a trigger, with the trace context of its span if it has none */
+func withTraceparent(header interface{}, sc spanContext) interface{} {
+	headerMap, err := convertToHeaderMap(header)
+	if err != nil || !sc.valid() {
+		return header
+	}
+	copied := make(map[string][]string, len(headerMap)+1)
+	for name, values := range headerMap {
+		copied[name] = values
+	}
+	if http.Header(copied).Get(TRACEPARENT) == "" {
+		copied[TRACEPARENT] = []string{sc.traceparent()}
+	}
+	return copied
+}
+
+/* Set the trace context of the trigger on the PipelineRuns and TaskRuns it creates, for Tekton to continue the trace */
+func traceResource(action *resourceAction, resource *unstructured.Unstructured) error {
+	if action.traceparent == "" || !strings.HasPrefix(resource.GetAPIVersion(), "tekton.dev/") {
+		return nil
+	}
+	var annotation string
+	switch resource.GetKind() {
+	case "PipelineRun":
+		annotation = tektonPipelineRunSpanContext
+	case "TaskRun":
+		annotation = tektonTaskRunSpanContext
+	default:
+		return nil
+	}
+	annotations := resource.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	if _, ok := annotations[annotation]; ok {
+		return nil
+	}
+	carrier, err := json.Marshal(map[string]string{TRACEPARENT: action.traceparent})
+	if err != nil {
+		return err
+	}
+	annotations[annotation] = string(carrier)
+	resource.SetAnnotations(annotations)
+	return nil
+}
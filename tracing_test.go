@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	sc := parseTraceparent(testTraceparent)
+	if !sc.valid() || !sc.sampled || sc.traceparent() != testTraceparent {
+		t.Fatalf("unexpected context %v", sc.traceparent())
+	}
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if parseTraceparent(header).valid() {
+			t.Errorf("traceparent %q is valid", header)
+		}
+	}
+	if sc := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); !sc.valid() || sc.sampled {
+		t.Fatal("unsampled traceparent was not parsed")
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	parent := parseTraceparent(testTraceparent)
+	child := startSpan("child", spanKindInternal, parent)
+	if child.context.traceID != parent.traceID || child.parentID != parent.spanID || child.context.spanID == parent.spanID || !child.context.sampled {
+		t.Fatalf("span %v is not a child of %v", child.context.traceparent(), testTraceparent)
+	}
+
+	saved := traceSampleRatio
+	defer func() { traceSampleRatio = saved }()
+	traceSampleRatio = 0
+	if root := startSpan("root", spanKindServer, spanContext{}); !root.context.valid() || root.context.sampled || root.parentID != [8]byte{} {
+		t.Fatalf("unexpected root span %v", root.context.traceparent())
+	}
+	/* the decision of the caller is followed */
+	if child = startSpan("child", spanKindInternal, parent); !child.context.sampled {
+		t.Fatal("sampled parent was not followed")
+	}
+}
+
+func TestTracingMiddlewareAndExport(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		request := make(map[string]interface{})
+		json.Unmarshal(data, &request)
+		if req.Header.Get("Content-Type") != "application/json" || req.Header.Get("Authorization") != "Bearer abc" {
+			http.Error(writer, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	savedEndpoint, savedHeaders, savedTracer := otlpEndpoint, otlpHeaders, tracer
+	defer func() { otlpEndpoint, otlpHeaders, tracer = savedEndpoint, savedHeaders, savedTracer }()
+	otlpEndpoint, otlpHeaders = collector.URL, "Authorization=Bearer abc"
+	exporter, err := startTracing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer = &spanExporter{endpoint: exporter.endpoint, headers: exporter.headers, client: exporter.client, queue: make(chan *span, 10)}
+
+	var traceparent string
+	handler := tracingMiddleware(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get(TRACEPARENT)
+		http.Error(writer, "failed", http.StatusBadGateway)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/webhook", nil)
+	req.Header.Set(TRACEPARENT, testTraceparent)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	/* the handler sees the context of the span of the request, in the trace of the caller */
+	sc := parseTraceparent(traceparent)
+	if !sc.valid() || sc.traceID != parseTraceparent(testTraceparent).traceID || traceparent == testTraceparent {
+		t.Fatalf("unexpected traceparent %v", traceparent)
+	}
+	s := <-tracer.queue
+	if err = tracer.send([]*span{s}); err != nil {
+		t.Fatal(err)
+	}
+	request := <-requests
+	data, _ := json.Marshal(request)
+	for _, expected := range []string{
+		`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`,
+		`"parentSpanId":"00f067aa0ba902b7"`,
+		`"name":"POST /webhook"`,
+		`"kind":2`,
+		`"code":2`,
+		`{"key":"http.response.status_code","value":{"intValue":"502"}}`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("exported spans %s do not contain %s", data, expected)
+		}
+	}
+
+	otlpHeaders = "Authorization"
+	if _, err = startTracing(); err == nil {
+		t.Fatal("expected error with an invalid header")
+	}
+}
+
+func TestMessageTraceContext(t *testing.T) {
+	message := map[string]interface{}{HEADER: map[string][]string{"Traceparent": {testTraceparent}}}
+	if sc := messageTraceContext(message); sc.traceparent() != testTraceparent {
+		t.Fatalf("context of header not found: %v", sc.traceparent())
+	}
+	child := startSpan("send", spanKindProducer, messageTraceContext(message))
+	message[TRACEPARENT] = child.context.traceparent()
+	if sc := messageTraceContext(message); sc.spanID != child.context.spanID {
+		t.Fatalf("context of message not found: %v", sc.traceparent())
+	}
+}
+
+func TestTraceResource(t *testing.T) {
+	action := &resourceAction{traceparent: testTraceparent}
+	pipelineRun := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "tekton.dev/v1beta1", "kind": "PipelineRun"}}
+	if err := traceResource(action, pipelineRun); err != nil {
+		t.Fatal(err)
+	}
+	if annotation := pipelineRun.GetAnnotations()[tektonPipelineRunSpanContext]; annotation != `{"traceparent":"`+testTraceparent+`"}` {
+		t.Fatalf("unexpected annotation %v", annotation)
+	}
+	configMap := &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "ConfigMap"}}
+	if traceResource(action, configMap); configMap.GetAnnotations() != nil {
+		t.Fatalf("ConfigMap was annotated: %v", configMap.GetAnnotations())
+	}
+}
+
+func TestWithTraceparent(t *testing.T) {
+	sc := parseTraceparent(testTraceparent)
+	header, ok := withTraceparent(nil, sc).(map[string][]string)
+	if !ok || header[TRACEPARENT][0] != testTraceparent {
+		t.Fatalf("unexpected header %v", header)
+	}
+	original := map[string][]string{"Traceparent": {"00-other"}}
+	header = withTraceparent(original, sc).(map[string][]string)
+	if header["Traceparent"][0] != "00-other" || len(header) != 1 {
+		t.Fatalf("traceparent of header was replaced: %v", header)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+)
+
+/*
+Transformations of messages. An eventDestination may declare a transform, applied to the messages sent to it before
+they are anonymized: the fields of remove, such as body.repository.owner, are deleted from the message to strip the
+large parts of webhook payloads, then the message is replaced by the result of a CEL expression, or by the output of a
+Go template, to reshape it into the schema of the consumers of the destination. The expression and the template are
+evaluated with the variables message, and kabanero, which holds the namespace and cluster of kabanero-events, and the
+name of the destination. The result of an expression is sent as JSON, and the output of a template as is.
+*/
+
+var (
+	transformsMutex    sync.Mutex
+	compiledTransforms = make(map[*TransformDefinition]*compiledTransform)
+)
+
+/* A compiled transform of an eventDestination */
+type compiledTransform struct {
+	remove   [][]string // paths of the fields removed
+	program  cel.Program
+	template *template.Template
+}
+
+/* Functions of the templates of transforms */
+var transformFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+/* Compile a CEL expression of the variables message and kabanero */
+func compileMessageExpression(expression string) (cel.Program, error) {
+	env, err := cel.NewEnv(cel.Declarations(
+		decls.NewIdent("message", decls.NewMapType(decls.String, decls.Dyn), nil),
+		decls.NewIdent(KABANERO, decls.NewMapType(decls.String, decls.String), nil)))
+	if err != nil {
+		return nil, err
+	}
+	parsed, issues := env.Parse(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	checked, issues := env.Check(parsed)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	return env.Program(checked)
+}
+
+/* Return the variables of the expressions and templates of an eventDestination */
+func messageVariables(node *EventNode, message map[string]interface{}) map[string]interface{} {
+	metadata := map[string]string{NAMESPACE: webhookNamespace, "cluster": clusterID, "destination": node.Name}
+	return map[string]interface{}{"message": message, KABANERO: metadata}
+}
+
+/* Compile a transform */
+func compileTransform(def *TransformDefinition) (*compiledTransform, error) {
+	if def.Expression != "" && def.Template != "" {
+		return nil, fmt.Errorf("a transform has either an expression or a template")
+	}
+	compiled := &compiledTransform{}
+	for _, path := range def.Remove {
+		compiled.remove = append(compiled.remove, strings.Split(path, "."))
+	}
+	if def.Expression != "" {
+		program, err := compileMessageExpression(def.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression of the transform: %v", err)
+		}
+		compiled.program = program
+	}
+	if def.Template != "" {
+		tmpl, err := template.New("transform").Funcs(transformFuncs).Option("missingkey=zero").Parse(def.Template)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the template of the transform: %v", err)
+		}
+		compiled.template = tmpl
+	}
+	return compiled, nil
+}
+
+/* Return the compiled transform of a definition, compiling it the first time */
+func getCompiledTransform(def *TransformDefinition) (*compiledTransform, error) {
+	transformsMutex.Lock()
+	defer transformsMutex.Unlock()
+	if compiled, ok := compiledTransforms[def]; ok {
+		return compiled, nil
+	}
+	compiled, err := compileTransform(def)
+	if err != nil {
+		return nil, err
+	}
+	compiledTransforms[def] = compiled
+	return compiled, nil
+}
+
+/* Compile the transforms of the eventDestinations */
+func initializeTransforms(ed *EventDefinition) error {
+	for _, node := range ed.EventDestinations {
+		if node.Transform == nil {
+			continue
+		}
+		if _, err := getCompiledTransform(node.Transform); err != nil {
+			return fmt.Errorf("invalid transform of eventDestination %s: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+/* Delete a field of a message */
+func removeMessageField(message map[string]interface{}, path []string) {
+	for index, key := range path {
+		if index == len(path)-1 {
+			delete(message, key)
+			return
+		}
+		next, ok := message[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		message = next
+	}
+}
+
+/* Apply the transform of an eventDestination to a message */
+func transformMessage(node *EventNode, data []byte) ([]byte, error) {
+	compiled, err := getCompiledTransform(node.Transform)
+	if err != nil {
+		return nil, err
+	}
+	var message map[string]interface{}
+	if err = json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	for _, path := range compiled.remove {
+		removeMessageField(message, path)
+	}
+	variables := messageVariables(node, message)
+
+	switch {
+	case compiled.program != nil:
+		out, _, err := compiled.program.Eval(variables)
+		if err != nil {
+			return nil, fmt.Errorf("unable to evaluate the expression of the transform: %v", err)
+		}
+		native, err := out.ConvertToNative(reflect.TypeOf(&structpb.Value{}))
+		if err != nil {
+			return nil, fmt.Errorf("the result of the expression of the transform is not JSON: %v", err)
+		}
+		var buffer bytes.Buffer
+		if err = (&jsonpb.Marshaler{}).Marshal(&buffer, native.(*structpb.Value)); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case compiled.template != nil:
+		var buffer bytes.Buffer
+		if err = compiled.template.Execute(&buffer, variables); err != nil {
+			return nil, fmt.Errorf("unable to execute the template of the transform: %v", err)
+		}
+		return buffer.Bytes(), nil
+	}
+	return json.Marshal(message)
+}
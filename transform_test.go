@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTransformMessage(t *testing.T) {
+	savedNamespace, savedCluster := webhookNamespace, clusterID
+	defer func() { webhookNamespace, clusterID = savedNamespace, savedCluster }()
+	webhookNamespace, clusterID = "kabanero", "prod-east"
+
+	message := []byte(`{"header":{"X-Github-Event":["push"]},"body":{"ref":"refs/heads/master",
+		"repository":{"full_name":"org/app","owner":{"login":"org"}},"commits":[{"id":"abc"}]}}`)
+
+	/* removed fields */
+	node := &EventNode{Name: "slim", Transform: &TransformDefinition{Remove: []string{"body.commits", "body.repository.owner", "body.missing.field"}}}
+	transformed, err := transformMessage(node, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(transformed), "commits") || strings.Contains(string(transformed), "owner") || !strings.Contains(string(transformed), "org/app") {
+		t.Fatalf("unexpected message %s", transformed)
+	}
+
+	/* an expression reshapes the message */
+	node = &EventNode{Name: "audit", Transform: &TransformDefinition{
+		Expression: `{"repository": message.body.repository.full_name, "event": message.header["X-Github-Event"][0], "cluster": kabanero.cluster, "destination": kabanero.destination}`,
+	}}
+	if transformed, err = transformMessage(node, message); err != nil {
+		t.Fatal(err)
+	}
+	reshaped := make(map[string]interface{})
+	if err = json.Unmarshal(transformed, &reshaped); err != nil {
+		t.Fatalf("%s: %v", transformed, err)
+	}
+	if len(reshaped) != 4 || reshaped["repository"] != "org/app" || reshaped["event"] != "push" || reshaped["cluster"] != "prod-east" || reshaped["destination"] != "audit" {
+		t.Fatalf("unexpected message %s", transformed)
+	}
+
+	/* a template writes the message as is */
+	node = &EventNode{Name: "chat", Transform: &TransformDefinition{
+		Remove:   []string{"body.ref"},
+		Template: `{"text": {{ json (printf "%s pushed to %s" .message.body.repository.full_name .kabanero.namespace) }}, "ref": {{ json .message.body.ref }}}`,
+	}}
+	if transformed, err = transformMessage(node, message); err != nil {
+		t.Fatal(err)
+	}
+	if string(transformed) != `{"text": "org/app pushed to kabanero", "ref": null}` {
+		t.Fatalf("unexpected message %s", transformed)
+	}
+
+	for _, invalid := range []*TransformDefinition{
+		{Expression: "message.", Template: ""},
+		{Expression: "message", Template: "{{ .message }}"},
+		{Template: "{{ .message "},
+	} {
+		if _, err = compileTransform(invalid); err == nil {
+			t.Errorf("invalid transform %+v was compiled", invalid)
+		}
+	}
+}
+
+func TestSendToTransformedDestination(t *testing.T) {
+	provider := &capturingProvider{}
+	savedProviders, savedDefinitions := messageProviders, eventProviders
+	defer func() { messageProviders, eventProviders = savedProviders, savedDefinitions }()
+	messageProviders = map[string]MessageProvider{"capture": provider}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{
+		{Name: "analytics", ProviderRef: "capture", Anonymize: true, Transform: &TransformDefinition{Expression: `{"body": {"sender": message.body.sender}}`}},
+		{Name: "broken", ProviderRef: "capture", Transform: &TransformDefinition{Expression: `message.body.missing`}},
+	}}
+	if err := initializeTransforms(eventProviders); err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte(`{"body":{"sender":{"login":"jdoe"},"ref":"refs/heads/master"}}`)
+	if err := sendToDestinationNow("analytics", message, nil); err != nil {
+		t.Fatal(err)
+	}
+	/* messages are transformed before they are anonymized */
+	if len(provider.messages) != 1 || strings.Contains(string(provider.messages[0]), "jdoe") || strings.Contains(string(provider.messages[0]), "refs/heads") {
+		t.Fatalf("unexpected messages %q", provider.messages)
+	}
+	if err := sendToDestinationNow("broken", message, nil); err == nil || len(provider.messages) != 1 {
+		t.Fatalf("message whose transform failed was sent: %v", err)
+	}
+}
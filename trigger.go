@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 //	"os"
@@ -141,6 +142,9 @@ const (
 	EVENTTRIGGERS = "eventTriggers"
 	SYSTEMERROR = "systemError"
 	FUNCTIONS   = "functions"
+	EVENTID     = "eventID"
+	SOURCEPATH  = "sourcePath"
+	INTERACTIVE = "interactive"
 )
 
 const (
@@ -198,19 +202,120 @@ func (td *eventTriggerDefinition) isDryRun() bool {
 	return false
 }
 
+/* Return the trigger with the given name, or nil if none exists */
+func (td *eventTriggerDefinition) findTrigger(name string) map[interface{}]interface{} {
+	for _, triggers := range td.eventTriggers {
+		for _, trigger := range triggers {
+			if trigger[NAME] == name {
+				return trigger
+			}
+		}
+	}
+	return nil
+}
+
+/* Return the name of a trigger */
+func triggerName(trigger map[interface{}]interface{}) string {
+	name, _ := trigger[NAME].(string)
+	return name
+}
+
 type eventTriggerDefinition struct {
   setting []map[interface{}]interface{} // all settings 
   eventTriggers map[string] []map[interface{}]interface{} // event source name to triggers 
   functions map[string]map[interface{}]interface{} // funtion name to function body
+  macros map[string]*celMacro // macro name to macro
+  generatedNames map[string]bool // names generated for unnamed triggers
 }
 
 type triggerProcessor struct {
+	name string // name of the collection version, such as active or canary. Used in metrics and logs
 	triggerDef *eventTriggerDefinition
 	triggerDir string // directory where trigger file is stored
+	templates *template.Template // named templates shared by the resources of the collection. nil if none
+	macroDecls cel.EnvOption // declarations of the macros of the collection. nil if none
+	disabledMutex sync.RWMutex
+	disabled map[string]bool // names of triggers disabled at runtime
+	digest string // sha256 of the files of the collection
+	indexURL string // URL of the Kabanero index the collection was loaded from
+	indexURLs []string // URLs of the Kabanero index and its mirrors, in order
+	localDir string // local directory the collection was copied from, with -triggerDir. Empty if downloaded
+	namespace string // namespace of the Kabanero instance of the collection. Empty for the namespace of kabanero-events
+	compiled *compiledCollection // compiled expressions and templates, shared by the collections with the same digest
+}
+
+/* Enable or disable the trigger with the given name */
+func (tp *triggerProcessor) setTriggerEnabled(name string, enabled bool) error {
+	if tp.triggerDef.findTrigger(name) == nil {
+		return fmt.Errorf("trigger %v not found", name)
+	}
+	tp.disabledMutex.Lock()
+	defer tp.disabledMutex.Unlock()
+	if tp.disabled == nil {
+		tp.disabled = make(map[string]bool)
+	}
+	if enabled {
+		delete(tp.disabled, name)
+	} else {
+		tp.disabled[name] = true
+	}
+	klog.Infof("Trigger %v enabled: %v", name, enabled)
+	return nil
+}
+
+/* Return true if the trigger with the given name has not been disabled */
+func (tp *triggerProcessor) isTriggerEnabled(name string) bool {
+	tp.disabledMutex.RLock()
+	defer tp.disabledMutex.RUnlock()
+	return !tp.disabled[name]
+}
+
+/* State of the evaluation of one trigger */
+type triggerEval struct {
+	tp *triggerProcessor // processor of the collection the trigger belongs to
+	trigger string // name of the trigger being evaluated
+	funcs cel.ProgramOption // implementations of CEL functions bound to this evaluation
+	macroPrograms map[string]cel.Program // programs of the macros called, by name of macro
+	opts evalOptions
+	actions []string // actions executed, or that would have been executed in dry-run
+	eventID string // ID of the event being processed
+	repository string // full name of the repository of the event being processed
+	span *span // span of the evaluation of the trigger
+	retry *retryHint // hint of the GitHub errors encountered, nil if none
+	dryrun *bool // dryrun attribute of the trigger, overriding the setting of the collection. nil if not set
+	rendered []*dryRunResource // resources rendered in dry-run
+	kubeReads int // calls of the Kubernetes functions
+	kubeVariables map[string]bool // variables whose value may come from the Kubernetes functions
+}
+
+/* Create a new evaluation of the named trigger */
+func (tp *triggerProcessor) newEval(trigger string, opts evalOptions) *triggerEval {
+	return &triggerEval{tp: tp, trigger: trigger, opts: opts}
+}
+
+/* Return true if actions are not to be executed */
+func (ev *triggerEval) isDryRun() bool {
+	if ev.opts.dryrun || dryRun {
+		return true
+	}
+	if ev.dryrun != nil {
+		return *ev.dryrun
+	}
+	return ev.tp.triggerDef.isDryRun()
+}
+
+/* Return an error if the deadline of the evaluation has passed */
+func (ev *triggerEval) checkDeadline() error {
+	return checkContext(ev.opts.ctx)
+}
+
+/* Record an action that is executed, or would have been executed in dry-run */
+func (ev *triggerEval) recordAction(format string, args ...interface{}) {
+	ev.actions = append(ev.actions, fmt.Sprintf(format, args...))
 }
 
 func newTriggerProcessor() *triggerProcessor {
-	return &triggerProcessor{}
+	return &triggerProcessor{name: "active"}
 }
 
 /* Initialize trigger directory */
@@ -224,6 +329,7 @@ func (tp *triggerProcessor) initialize(dir string) error {
 		setting: make([]map[interface{}]interface{}, 0),
 		eventTriggers: make(map[string] []map[interface{}]interface{}, 0),
 		functions: make(map[string]map[interface{}]interface{}, 0),
+		macros: make(map[string]*celMacro),
 	}
 	files, err := findFiles(dir, []string { ".yaml", ".yml"})
 	if err != nil {
@@ -238,14 +344,65 @@ func (tp *triggerProcessor) initialize(dir string) error {
 			return err
 		}
 	}
+	err = tp.compileMacros()
+	if err != nil {
+		return err
+	}
+	tp.digest, err = collectionDigest(dir)
+	if err != nil {
+		return err
+	}
+	tp.compiled = compiledCollectionFor(tp.digest)
+	err = tp.loadTemplateLibrary(dir)
+	if err != nil {
+		return err
+	}
 	tp.triggerDir = dir
 	return nil
 }
 
-func messageListener(provider MessageProvider, node *EventNode ) {
+/*
+Download the trigger collection pointed to by the Kabanero index into a new temporary directory, and initialize a processor for it.
+The index URL may be a comma separated list of mirrors, tried in order.
+*/
+func loadTriggerProcessor(name string, kabaneroIndexURL string) (*triggerProcessor, error) {
+	indexURLs := splitIndexURLs(kabaneroIndexURL)
+	dir, indexURL, err := downloadTriggerFromSources(indexURLs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download trigger pointed by kabanero_index_url at: %s, error: %s", redactURLs(kabaneroIndexURL), err)
+	}
+
+	tp := newTriggerProcessor()
+	tp.name = name
+	tp.indexURL = indexURL
+	tp.indexURLs = indexURLs
+	err = tp.initialize(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize trigger definition: %s", err)
+	}
+	if name == "active" {
+		tp.precompile()
+	} else {
+		/* the canary and shadow collections do not delay the start of the listeners */
+		go tp.precompile()
+	}
+	return tp, nil
+}
+
+/* Receive and process the messages of an event source, until receiving fails, or stop is closed */
+func messageListener(provider MessageProvider, node *EventNode, stop <-chan struct{}) {
 	klog.Infof("Starting listener event destination %v", node.Name)
+	setSelfTestListener(node.Name, true)
+	defer setSelfTestListener(node.Name, false)
 	for {
+		select {
+		case <-stop:
+			klog.Infof("Stopping listener event destination %v", node.Name)
+			return
+		default:
+		}
 		bytes, err := provider.Receive(node)
+		recordMessageActivity(node, false, err)
 		if err != nil {
 			klog.Errorf("Message listener exiting. Unable to receive message. Error: %v, type %T", err, err)
 			break
@@ -259,31 +416,101 @@ func messageListener(provider MessageProvider, node *EventNode ) {
 			klog.Errorf("Unable to unarmshal message from node %v", node.Name)
 			continue
 		}
-		_, err = triggerProc.processMessage(messageMap, node.Name)
+		if completeSelfTest(messageMap, node.Name) {
+			continue
+		}
+		if !filterReceivedMessage(node, messageMap) {
+			continue
+		}
+		if hasPipelineHooks(stagePreTriggerEval) {
+			err = runPipelineHooks(&pipelineEvent{stage: stagePreTriggerEval, eventID: messageEventID(messageMap), source: node.Name, message: messageMap})
+			if err != nil {
+				eventInfo(messageEventID(messageMap), "Message vetoed", logFields{"eventSource": node.Name, "error": err})
+				continue
+			}
+		}
+		tp := selectTriggerProcessor(messageMap, node.Name)
+		incrementMetric("triggerProcessor." + tp.name + ".messages")
+		eventID := messageEventID(messageMap)
+		if klog.V(4) {
+			eventInfo(eventID, "Processing message", logFields{"eventSource": node.Name, "collection": tp.name})
+		}
+		s := startSpan("process "+node.Name, spanKindConsumer, messageTraceContext(messageMap))
+		s.setAttribute("messaging.destination.name", node.Name)
+		s.setAttribute("kabanero.event_id", eventID)
+		s.setAttribute("kabanero.collection", tp.name)
+		messageMap[TRACEPARENT] = s.context.traceparent()
+		result, err := tp.processWithDeadline(messageMap, node.Name)
+		if result != nil {
+			s.setAttribute("kabanero.actions", len(result.actions))
+		}
+		s.finish(err)
+		recordAudit(messageMap, node.Name, tp.name, result, err)
+		requeueMessage(messageMap, node.Name, result)
 		if err != nil {
-			klog.Errorf("Error processing message from destination %v. Message: %v, Error: %v", node.Name, messageMap, err)
-		} else if klog.V(6) {
-			klog.Infof("Finished processing message for  %v", node.Name )
+			incrementMetric("triggerProcessor." + tp.name + ".errors")
+			eventError(eventID, "Error processing message", logFields{"eventSource": node.Name, "collection": tp.name, "error": err})
+		} else if klog.V(4) {
+			eventInfo(eventID, "Finished processing message", logFields{"eventSource": node.Name, "collection": tp.name, "actions": result.actions})
+		}
+		if _, _, shadow := currentCollections(); shadow != nil {
+			go evaluateShadow(shadow, bytes, node.Name, tp.name, result, err)
 		}
 	}
 }
 
-func (tp *triggerProcessor) startListeners(providers *EventDefinition) error {
-	triggers := tp.triggerDef.eventTriggers
+/* The listener of an event source */
+type sourceListener struct {
+	provider MessageProvider // provider the listener receives from
+	node     *EventNode
+	stop     chan struct{}
+}
+
+var (
+	listenersMutex sync.Mutex
+	listening      = make(map[string]*sourceListener) // listeners, by event source
+)
+
+/*
+Start a listener for each event source that has triggers in any of the processors, and does not have one yet. The
+listeners of the event sources whose provider or definition changed are restarted.
+*/
+func startListeners(providers *EventDefinition, processors ...*triggerProcessor) error {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	triggers := make(map[string]bool)
+	for _, tp := range processors {
+		if tp == nil {
+			continue
+		}
+		for dest := range tp.triggerDef.eventTriggers {
+			triggers[dest] = true
+		}
+	}
 	for dest := range triggers {
-		destNode := eventProviders.GetEventDestination(dest)
+		destNode := providers.GetEventDestination(dest)
 		if destNode == nil {
 			return fmt.Errorf("unable to find an eventDestination with the name '%s' in trigger definitions. Verify that it has been defined", dest)
 		}
-		provider := eventProviders.GetMessageProvider(destNode.ProviderRef)
+		provider := lookupMessageProvider(destNode.ProviderRef)
 		if provider == nil {
 			return fmt.Errorf("unable to find a messageProvider with the name '%s'. Verify that is has been defined", destNode.ProviderRef)
 		}
+		if current := listening[dest]; current != nil {
+			if current.provider == provider && definitionDigest(current.node) == definitionDigest(destNode) {
+				continue
+			}
+			klog.Infof("Restarting listener event destination %v, whose provider or definition changed", dest)
+			close(current.stop)
+			delete(listening, dest)
+		}
 		err := provider.Subscribe(destNode)
 		if err != nil {
 			return fmt.Errorf("unable to subscribe to provider %v", destNode.ProviderRef)
 		}
-		go messageListener(provider, destNode)
+		listener := &sourceListener{provider: provider, node: destNode, stop: make(chan struct{})}
+		listening[dest] = listener
+		go messageListener(provider, destNode, listener.stop)
 	}
 	return nil
 }
@@ -332,9 +559,37 @@ func parseTrigger(trigger map[interface{}]interface{}) ( []string, string, []int
 	return eventSourceArray, input, body, nil
 }
 
+/* Options for the evaluation of a message */
+type evalOptions struct {
+	dryrun bool // do not execute actions, regardless of the settings of the collection
+	ctx context.Context // evaluation stops, and no further actions are executed, once done. nil if unbounded
+	interactive bool // requested by a user rather than triggered by an event. Resources are created with a higher priority
+}
+
+/* Result of evaluating the triggers of an event source against a message */
+type evalResult struct {
+	variables []map[string]interface{} // variables of each trigger evaluated
+	actions []string // actions executed, or that would have been executed in dry-run, in order
+	triggers []string // names of the triggers that executed actions, or failed
+	retry *retryHint // whether and when retrying the event may succeed, if the GitHub calls of its triggers failed
+	rendered []*dryRunResource // resources rendered in dry-run, in order
+	kubeVariables map[string]bool // variables of the triggers whose value may come from the Kubernetes functions
+}
+
+var triggerParallelism int // maximum triggers of an event source evaluated concurrently. Sequential if 1 or less
+
 func (tp *triggerProcessor) processMessage(message map[string]interface{}, eventSource string ) ([]map[string]interface{}, error) {
+	result, err := tp.evaluateMessage(message, eventSource, evalOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return result.variables, nil
+}
+
+/* Evaluate the enabled triggers of an event source against a message */
+func (tp *triggerProcessor) evaluateMessage(message map[string]interface{}, eventSource string, opts evalOptions) (*evalResult, error) {
 	if klog.V(5) {
-		klog.Infof("Entering triggerProcessor.processMessage. message: %v, eventSource: %v", message, eventSource)
+		eventInfo(messageEventID(message), "Entering triggerProcessor.processMessage", logFields{"eventSource": eventSource, "message": message})
 		defer klog.Infof("Leaving triggerProcessor.processMessage")
 	}
 
@@ -351,39 +606,163 @@ func (tp *triggerProcessor) processMessage(message map[string]interface{}, event
 		klog.Infof("Found triggerArray")
 	}
 
-	savedVariables := make([]map[string]interface{}, 0)
+	result := &evalResult{variables: make([]map[string]interface{}, 0), actions: make([]string, 0), triggers: make([]string, 0)}
+	repoConfig := loadRepoConfig(message)
+	selected := make([]map[interface{}]interface{}, 0, len(triggerArray))
 	for _, trigger := range triggerArray {
-		/* evaluate all trigger definitions for the event source*/
-		eventSources, inputVariable, bodyArray, err := parseTrigger(trigger)
-		if err != nil {
-			klog.Error(err)
-			return nil, err
+		if !tp.isTriggerEnabled(triggerName(trigger)) {
+			if klog.V(5) {
+				klog.Infof("processMessage skipping disabled trigger %v", triggerName(trigger))
+			}
+			continue
 		}
-		if klog.V(5) {
-			klog.Infof("processMessage after parseTrigger: eventSources: %v", eventSources)
+		if !repoConfig.allows(triggerName(trigger)) {
+			if klog.V(5) {
+				klog.Infof("processMessage skipping trigger %v excluded by the configuration of repository %v", triggerName(trigger), messageRepositoryURL(message))
+			}
+			continue
 		}
+		selected = append(selected, trigger)
+	}
 
-		env, variables, err := initializeCELEnv( message, inputVariable)
-		if err != nil {
-			return nil, err
-		}
-		if klog.V(5) {
-			klog.Infof("processMessage after initializeCELEnv")
+	outcomes := make([]*triggerOutcome, len(selected))
+	if !opts.dryrun {
+		defer func() { recordTriggerActivity(message, eventSource, tp.name, outcomes) }()
+	}
+	if triggerParallelism <= 1 || len(selected) <= 1 {
+		/*
+		the triggers are evaluated in order, and the evaluation stops at the first error, since a trigger may depend on
+		the resources created by the triggers before it
+		*/
+		for index, trigger := range selected {
+			outcome := tp.evaluateTrigger(trigger, message, eventSource, repoConfig, opts)
+			outcomes[index] = outcome
+			if outcome.invalid {
+				return nil, outcome.err
+			}
+			if err := result.add(outcome); err != nil {
+				return result, err
+			}
 		}
+		return result, nil
+	}
 
+	/*
+	With -triggerParallelism, the triggers are evaluated concurrently, and their outcomes aggregated in the order of
+	the triggers, so that the actions are reported in the same order as when evaluated sequentially. Since the triggers
+	are independent, a trigger that fails or is invalid does not stop the others, whose actions are reported; the error
+	of the first trigger that failed is returned.
+	*/
+	semaphore := make(chan struct{}, triggerParallelism)
+	var wg sync.WaitGroup
+	for index, trigger := range selected {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(index int, trigger map[interface{}]interface{}) {
+			defer func() { <-semaphore; wg.Done() }()
+			outcomes[index] = tp.evaluateTrigger(trigger, message, eventSource, repoConfig, opts)
+		}(index, trigger)
+	}
+	wg.Wait()
+	incrementMetric("triggerProcessor." + tp.name + ".parallelEvaluations")
+	var firstErr error
+	for _, outcome := range outcomes {
+		if err := result.add(outcome); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return result, firstErr
+}
 
-		depth := 1
-		_,  err = evalArrayObject(env, variables, bodyArray, depth)
-		if err != nil {
-			klog.Errorf("Error evaluating trigger %v: ERROR MESSAGE: %v", trigger, err)
-			return nil, err
-		}
-		if klog.V(5) {
-			klog.Infof("processMessage after evalArrayObject")
+/* The outcome of the evaluation of a trigger */
+type triggerOutcome struct {
+	trigger   string
+	variables map[string]interface{}
+	actions   []string
+	err       error
+	invalid   bool // the trigger could not be evaluated, because it or its environment is invalid
+	retry     *retryHint // hint of the GitHub errors encountered, nil if none
+	rendered  []*dryRunResource // resources rendered in dry-run
+	kubeVariables map[string]bool // variables whose value may come from the Kubernetes functions
+}
+
+/* Add the outcome of a trigger to the result. Returns the error of the trigger */
+func (result *evalResult) add(outcome *triggerOutcome) error {
+	result.actions = append(result.actions, outcome.actions...)
+	result.retry = mergeRetryHints(result.retry, outcome.retry)
+	result.rendered = append(result.rendered, outcome.rendered...)
+	if outcome.invalid {
+		return outcome.err
+	}
+	if len(outcome.actions) > 0 || outcome.err != nil {
+		result.triggers = append(result.triggers, outcome.trigger)
+	}
+	if outcome.err != nil {
+		return outcome.err
+	}
+	for name := range outcome.kubeVariables {
+		if result.kubeVariables == nil {
+			result.kubeVariables = make(map[string]bool)
 		}
-		savedVariables = append(savedVariables, variables)
+		result.kubeVariables[name] = true
+	}
+	result.variables = append(result.variables, outcome.variables)
+	return nil
+}
+
+/* Evaluate a trigger against a message */
+func (tp *triggerProcessor) evaluateTrigger(trigger map[interface{}]interface{}, message map[string]interface{}, eventSource string, repoConfig *repositoryConfig, opts evalOptions) *triggerOutcome {
+	outcome := &triggerOutcome{trigger: triggerName(trigger)}
+	/* evaluate all trigger definitions for the event source*/
+	eventSources, inputVariable, bodyArray, err := parseTrigger(trigger)
+	if err != nil {
+		klog.Error(err)
+		outcome.err, outcome.invalid = err, true
+		return outcome
+	}
+	if klog.V(5) {
+		klog.Infof("processMessage after parseTrigger: eventSources: %v", eventSources)
 	}
-	return savedVariables, nil
+
+	env, variables, err := tp.initializeCELEnv( message, inputVariable)
+	if err == nil {
+		env, err = addContextVariable(env, variables, trigger, message)
+	}
+	if err == nil {
+		env, err = addRepoConfigVariable(env, variables, repoConfig)
+	}
+	if err != nil {
+		outcome.err, outcome.invalid = err, true
+		return outcome
+	}
+	if klog.V(5) {
+		klog.Infof("processMessage after initializeCELEnv")
+	}
+
+
+	depth := 1
+	ev := tp.newEval(triggerName(trigger), opts)
+	ev.eventID = messageEventID(message)
+	ev.repository = messageRepositoryName(message)
+	ev.dryrun = triggerDryRun(trigger)
+	ev.span = startSpan("trigger "+ev.trigger, spanKindInternal, messageTraceContext(message))
+	ev.span.setAttribute("kabanero.trigger", ev.trigger)
+	ev.span.setAttribute("kabanero.event_source", eventSource)
+	ev.span.setAttribute("kabanero.event_id", ev.eventID)
+	ev.span.setAttribute("kabanero.dryrun", ev.isDryRun())
+	_,  err = ev.evalArrayObject(env, variables, bodyArray, depth)
+	ev.span.setAttribute("kabanero.actions", len(ev.actions))
+	ev.span.finish(err)
+	outcome.actions, outcome.variables, outcome.err, outcome.retry, outcome.rendered = ev.actions, variables, err, ev.retry, ev.rendered
+	outcome.kubeVariables = ev.kubeVariables
+	if err != nil {
+		eventError(ev.eventID, "Error evaluating trigger", logFields{"trigger": ev.trigger, "error": err})
+		return outcome
+	}
+	if klog.V(5) {
+		klog.Infof("processMessage after evalArrayObject")
+	}
+	return outcome
 }
 
 /* Eval body  Array
@@ -395,10 +774,13 @@ func (tp *triggerProcessor) processMessage(message map[string]interface{}, event
 	 cel.Env: updated execution environment
 	 error: any error
 */
-func evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []interface{}, depth int) (cel.Env, error ) {
+func (ev *triggerEval) evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []interface{}, depth int) (cel.Env, error ) {
 
 	var err error
 	for _, objectObj := range(bodyArray) {
+		if err = ev.checkDeadline(); err != nil {
+			return env, err
+		}
 		object, ok := objectObj.(map[interface{}] interface{})
 		if !ok {
 			return env, fmt.Errorf("body object %v not map[interface{}]interface{}, but of type %T", objectObj, objectObj)
@@ -407,7 +789,7 @@ func evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []
 		switch {
 			case (flags & IfFlag) != 0 :
 				/* If statement, only allow If or If and BODY */
-				env, _, err := evalIfWithSyntaxCheck(env, variables, object, numKeywords, flags, depth)
+				env, _, err := ev.evalIfWithSyntaxCheck(env, variables, object, numKeywords, flags, depth)
 				if err != nil {
 					return env, err
 				}
@@ -421,7 +803,7 @@ func evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []
 					err = fmt.Errorf("switch also contains assignment: %v", object)
 					return env, err
 				}
-				env, err := evalSwitch(env, variables, object, numKeywords, flags, depth)
+				env, err := ev.evalSwitch(env, variables, object, numKeywords, flags, depth)
 				if err != nil {
 					return env, err
 				}
@@ -436,7 +818,7 @@ func evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []
 					err = fmt.Errorf("body also contains assignment: %v", object)
 					return env, err
 				}
-				env, err := evalBody(env, variables, object, numKeywords, flags, depth)
+				env, err := ev.evalBody(env, variables, object, numKeywords, flags, depth)
 				if err != nil {
 					return env, err
 				}
@@ -449,7 +831,7 @@ func evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []
 					err = fmt.Errorf("Multiple assignments in one object: %v", object)
 					return env, err
 				}
-				env, err = evalAssignment(env, variables, object, numKeywords, flags, depth )
+				env, err = ev.evalAssignment(env, variables, object, numKeywords, flags, depth )
 				if err != nil {
 					return env, err
 				}
@@ -458,7 +840,7 @@ func evalArrayObject(env cel.Env, variables map[string]interface{}, bodyArray []
 	return env, nil
 }
 
-func evalAssignment(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeywords int, flags uint, depth int) (cel.Env, error) {
+func (ev *triggerEval) evalAssignment(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeywords int, flags uint, depth int) (cel.Env, error) {
 	if klog.V(6) {
 		klog.Infof("Entering evalAssignment object: %v", object)
 		defer klog.Infof("Leaving evalAssignment object")
@@ -496,7 +878,7 @@ func evalAssignment(env cel.Env, variables map[string]interface{}, object map[in
 			default:
 				return env, fmt.Errorf("Value of variables not stored as  YAML primitive types or string when assgining %v to %v. Type of value is %T", variableName, valObj, valObj)
 		}
-        env, err = setOneVariable(env, variableName, val, variables ) 
+        env, err = ev.setOneVariable(env, variableName, val, variables ) 
 		if err != nil {
 			return env, err
 		}
@@ -507,19 +889,19 @@ func evalAssignment(env cel.Env, variables map[string]interface{}, object map[in
 /*
  * Evaluate body 
  */
-func evalBody(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeyword int, flags uint, depth int) (cel.Env, error) {
+func (ev *triggerEval) evalBody(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeyword int, flags uint, depth int) (cel.Env, error) {
 	/* check if recursive body exists */
 	nestedBodyObj := object[BODY]
 	nestedBody, ok := nestedBodyObj.([]interface{})
 	if ok {
-		return evalArrayObject(env, variables, nestedBody, depth );
+		return ev.evalArrayObject(env, variables, nestedBody, depth );
 	} 
 
 	err := fmt.Errorf("body %v contains nested body that is not []interface, but of type %T", nestedBodyObj, nestedBody)
 	return env, err
 }
 
-func evalIfWithSyntaxCheck(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeywords int, flags uint, depth int) (cel.Env, bool, error) {
+func (ev *triggerEval) evalIfWithSyntaxCheck(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeywords int, flags uint, depth int) (cel.Env, bool, error) {
 	if klog.V(6) {
 		klog.Infof("evalIfWithSyntaxCheck : %v", object)
 	}
@@ -542,7 +924,7 @@ func evalIfWithSyntaxCheck(env cel.Env, variables map[string]interface{}, object
 	if ( !ok ) {
 		return env, false, fmt.Errorf("condition of if object not a string: %v", object)
 	}
-	boolVal, err := evalCondition(env, condition, variables)
+	boolVal, err := ev.evalCondition(env, condition, variables)
 	if err != nil {
 		return env, false, err
 	}
@@ -561,23 +943,23 @@ func evalIfWithSyntaxCheck(env cel.Env, variables map[string]interface{}, object
 	_, ok = object[BODY]
 	if ok {
 		/* if statement also contains body */
-		env, err = evalBody(env, variables, object, numKeywords, flags, depth)
+		env, err = ev.evalBody(env, variables, object, numKeywords, flags, depth)
 		return env,  true, err
 	} 
 
 	_, ok = object[SWITCH]
 	if ok {
 		/* if statement also contains switch */
-		env, err = evalSwitch(env, variables, object, numKeywords, flags, depth)
+		env, err = ev.evalSwitch(env, variables, object, numKeywords, flags, depth)
 		return env,  true, err
 	} 
 
 	/* perform assignments */
-	env, err = evalAssignment(env, variables, object,  numKeywords, flags, depth)
+	env, err = ev.evalAssignment(env, variables, object,  numKeywords, flags, depth)
 	return env, true, err
 }
 
-func evalSwitch(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeywords int, flags uint, depth int) (cel.Env, error) {
+func (ev *triggerEval) evalSwitch(env cel.Env, variables map[string]interface{}, object map[interface{}]interface{}, numKeywords int, flags uint, depth int) (cel.Env, error) {
 	var err error
 	switchObj, ok :=  object[SWITCH]
 	if !ok {
@@ -598,7 +980,7 @@ func evalSwitch(env cel.Env, variables map[string]interface{}, object map[interf
 		_, ifOK := arrayElement[IF]
 		if ifOK {
 			/* evaluate the if statement */
-			env, conditionTrue, err := evalIfWithSyntaxCheck(env, variables, arrayElement, switchCaseNumKeywords, switchCaseFlags, depth)
+			env, conditionTrue, err := ev.evalIfWithSyntaxCheck(env, variables, arrayElement, switchCaseNumKeywords, switchCaseFlags, depth)
 			if err != nil || conditionTrue {
 				return env, err
 			}
@@ -626,7 +1008,7 @@ func evalSwitch(env cel.Env, variables map[string]interface{}, object map[interf
 	/* evaluate defaults */
 
 	if defaultArray != nil  {
-		env, err = evalArrayObject(env, variables, defaultArray, depth)
+		env, err = ev.evalArrayObject(env, variables, defaultArray, depth)
 		if err != nil {
 			return env, err
 		}
@@ -647,11 +1029,14 @@ func shallowCopy(originalMap map[string]interface{}) map[string]interface{} {
 
 /* Get initial CEL environment 
 */
-func initializeEmptyCELEnv() (cel.Env, error) {
+func (tp *triggerProcessor) initializeEmptyCELEnv() (cel.Env, error) {
 	/* initialize empty CEL environment with additional functions */
 	additionalFuncs := getAdditionalCELFuncDecls()
 //	klog.Infof("Additional Func Decls: %v", additionalFuncs)
-	return cel.NewEnv(additionalFuncs )
+	if tp.macroDecls != nil {
+		return cel.NewEnv(additionalFuncs, triggerMacros, tp.macroDecls)
+	}
+	return cel.NewEnv(additionalFuncs, triggerMacros)
 }
 
 /* Get initial CEL environment
@@ -659,14 +1044,14 @@ func initializeEmptyCELEnv() (cel.Env, error) {
 		map[string]interface{}: variables used during substitution
 		error: any error encountered
  */
-func initializeCELEnv(message map[string]interface{}, inputVariableName string) (cel.Env, map[string]interface{},  error) {
+func (tp *triggerProcessor) initializeCELEnv(message map[string]interface{}, inputVariableName string) (cel.Env, map[string]interface{},  error) {
 	if klog.V(5) {
 		klog.Infof("entering initializeCELEnv")
 		defer klog.Infof("Leaving initializeCELEnv")
 	}
 
 	/* initialize empty CEL environment with additional functions */
-	env, err := initializeEmptyCELEnv()
+	env, err := tp.initializeEmptyCELEnv()
 	if err != nil {
 		return nil, nil,  err
 	}
@@ -684,7 +1069,7 @@ func initializeCELEnv(message map[string]interface{}, inputVariableName string)
 }
 
 
-func setOneVariable(env cel.Env, name string, val string, variables map[string]interface{}) (cel.Env, error) {
+func (ev *triggerEval) setOneVariable(env cel.Env, name string, val string, variables map[string]interface{}) (cel.Env, error) {
 	if name == "" {
 		/* name not set */
 		return env, nil
@@ -692,7 +1077,7 @@ func setOneVariable(env cel.Env, name string, val string, variables map[string]i
 	
 	val = strings.Trim(val, " ")
 
-	parsed, issues := env.Parse(val)
+	parsed, issues := ev.tp.compiled.parse(env, val)
 	if issues != nil && issues.Err() != nil {
 		return env, fmt.Errorf("Parsing error setting variable %s to %s, error: %v", name, val, issues.Err())
 	}
@@ -700,15 +1085,19 @@ func setOneVariable(env cel.Env, name string, val string, variables map[string]i
 	if issues != nil && issues.Err() != nil {
 		return env, fmt.Errorf("CEL check error when setting variable %s to %s, error: %v, existing variables: %v", name, val, issues.Err(), variables)
 	}
-	prg, err := env.Program(checked, getAdditionalCELFuncs())
+	prg, err := env.Program(checked, ev.celFunctions())
 	if err != nil {
 		return env, fmt.Errorf("CEL program error when setting variable %s to %s, error: %v", name, val, err)
 	}
 	// out, details, err := prg.Eval(variables)
+	kubeReads := ev.kubeReads
 	out, _, err := prg.Eval(variables)
 	if err != nil {
 		return env, fmt.Errorf("CEL Eval error when setting variable %s to %s, error: %v", name, val, err)
 	}
+	if ev.kubeReads != kubeReads || ev.usesKubeVariables(checked) {
+		ev.markKubeVariable(name)
+	}
 
 	if klog.V(3) {
 		klog.Infof("When setting variable %s to %s, eval of value results in typename: %s, value type: %T, value: %s\n", name, val, out.Type().TypeName(), out.Value(), out.Value())
@@ -1018,6 +1407,32 @@ func readTriggerDefinition(fileName string, td *eventTriggerDefinition) error {
 						if !ok {
 							existingArray = make([]map[interface{}]interface{}, 0)
 						}
+						/*
+						name the trigger if it is not named, so that it can be referred to, with a name that no trigger
+						read before has. The name is then checked like any other, so that no trigger read after reuses it
+						*/
+						if _, ok := triggerMap[NAME]; !ok {
+							index := len(existingArray)
+							for td.findTrigger(fmt.Sprintf("%s-%d", eventSource, index)) != nil {
+								index++
+							}
+							triggerMap[NAME] = fmt.Sprintf("%s-%d", eventSource, index)
+							if td.generatedNames == nil {
+								td.generatedNames = make(map[string]bool)
+							}
+							td.generatedNames[triggerMap[NAME].(string)] = true
+							reportDeprecated(deprecationUnnamedTrigger, fmt.Sprintf("%s: eventTrigger %v", filepath.Base(fileName), triggerMap[NAME]))
+						}
+						name, ok := triggerMap[NAME].(string)
+						if !ok {
+							return fmt.Errorf("name of trigger %v is not a string but %T", triggerMap[NAME], triggerMap[NAME])
+						}
+						if td.findTrigger(name) != nil {
+							if td.generatedNames[name] {
+								return fmt.Errorf("error: event trigger redeclared: %v, which is also the name generated for an unnamed trigger. Name that trigger", name)
+							}
+							return fmt.Errorf("error: event trigger redeclared: %v", name)
+						}
 						td.eventTriggers[eventSource] = append(existingArray, triggerMap)
 					}
 				}
@@ -1027,6 +1442,11 @@ func readTriggerDefinition(fileName string, td *eventTriggerDefinition) error {
 		}
 	}
 
+	err = readMacros(yamlMap, td)
+	if err != nil {
+		return fmt.Errorf("unable to read macros from %v. Error: %v", fileName, err)
+	}
+
 	/* read functions */
 	functionsObj, ok := yamlMap[FUNCTIONS]
 	if ok {
@@ -1094,12 +1514,12 @@ func readTriggerDefinition(fileName string, td *eventTriggerDefinition) error {
 //	return nil, nil
 //}
 
-func evalCondition(env cel.Env, when string, variables map[string]interface{}) (bool, error) {
+func (ev *triggerEval) evalCondition(env cel.Env, when string, variables map[string]interface{}) (bool, error) {
 	if when == "" {
 		/* unconditional */
 		return true, nil
 	}
-	parsed, issues := env.Parse(when)
+	parsed, issues := ev.tp.compiled.parse(env, when)
 	if issues != nil && issues.Err() != nil {
 		return false, fmt.Errorf("Error evaluating condition %s, error: %v", when, issues.Err())
 	}
@@ -1107,7 +1527,7 @@ func evalCondition(env cel.Env, when string, variables map[string]interface{}) (
 	if issues != nil && issues.Err() != nil {
 		return false, fmt.Errorf("Error parsing condition %s, error: %v", when, issues.Err())
 	}
-	prg, err := env.Program(checked, getAdditionalCELFuncs())
+	prg, err := env.Program(checked, ev.celFunctions())
 	if err != nil {
 		return false, fmt.Errorf("Error creating CEL program for condition %s, error: %v", when, err)
 	}
@@ -1158,14 +1578,19 @@ func evalCondition(env cel.Env, when string, variables map[string]interface{}) (
 //	return nil, nil
 //}
 
-func substituteTemplateFile(fileName string, variables interface{}) (string, error) {
+func substituteTemplateFile(library *template.Template, fileName string, variables interface{}) (string, error) {
+	return substituteCompiledTemplateFile(nil, library, fileName, variables)
+}
+
+/* Substitute a template file, whose template is parsed once for a compiled collection, that may be nil */
+func substituteCompiledTemplateFile(compiled *compiledCollection, library *template.Template, fileName string, variables interface{}) (string, error) {
 	bytes, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return "", err
 	}
 	str := string(bytes)
 	klog.Infof("Before template substitution for %s: %s, variables type: %T", fileName, str, variables)
-	substituted, err := substituteTemplate(str, variables)
+	substituted, err := substituteCompiledTemplate(compiled, library, str, variables)
 	if err != nil {
 		klog.Errorf("Error in template substitution for %s: %s", fileName, err)
 	} else {
@@ -1175,7 +1600,17 @@ func substituteTemplateFile(fileName string, variables interface{}) (string, err
 }
 
 func substituteTemplate(templateStr string, variables interface{}) (string, error) {
-	t, err := template.New("kabanero").Parse(templateStr)
+	return substituteTemplateWithLibrary(nil, templateStr, variables)
+}
+
+/* Substitute a template that may refer to the named templates defined in a library. The library may be nil */
+func substituteTemplateWithLibrary(library *template.Template, templateStr string, variables interface{}) (string, error) {
+	return substituteCompiledTemplate(nil, library, templateStr, variables)
+}
+
+/* Substitute a template, parsed with a library, that may be nil, once for a compiled collection, that may be nil */
+func substituteCompiledTemplate(compiled *compiledCollection, library *template.Template, templateStr string, variables interface{}) (string, error) {
+	t, err := compiled.template(library, templateStr)
 	if err != nil {
 		return "", err
 	}
@@ -1187,29 +1622,34 @@ func substituteTemplate(templateStr string, variables interface{}) (string, erro
 	return buffer.String(), nil
 }
 
-/* Create resource. Assume it does not already exist */
-func createResource(resourceStr string, dynamicClient dynamic.Interface) error {
-	if klog.V(4) {
-		klog.Infof("Creating resource %s", resourceStr)
-	}
-
-	/* Convert yaml to unstructured*/
+/* Convert a resource in yaml to unstructured */
+func decodeResource(resourceStr string) (*unstructured.Unstructured, error) {
 	resourceBytes, err := k8syaml.ToJSON([]byte(resourceStr))
 	if err != nil {
-		return fmt.Errorf("Unable to convert yaml resource to JSON: %v", resourceStr)
+		return nil, fmt.Errorf("Unable to convert yaml resource to JSON: %v", resourceStr)
 	}
 	var unstructuredObj = &unstructured.Unstructured{}
 	err = unstructuredObj.UnmarshalJSON(resourceBytes)
 	if err != nil {
 		klog.Errorf("Unable to convert JSON %s to unstructured", resourceStr)
-		return err
+		return nil, err
 	}
+	return unstructuredObj, nil
+}
 
-	group, version, resource, namespace, name, err := getGroupVersionResourceNamespaceName(unstructuredObj)
-	if namespace == "" {
-		return fmt.Errorf("resource %s does not contain namepsace", resourceStr)
+/* Create resource. Assume it does not already exist */
+func createResource(unstructuredObj *unstructured.Unstructured, target *cluster) error {
+	return createResourceWithOptions(unstructuredObj, target, metav1.CreateOptions{})
+}
+
+/* Create resource with the given options, such as a server-side dry-run */
+func createResourceWithOptions(unstructuredObj *unstructured.Unstructured, target *cluster, options metav1.CreateOptions) error {
+	if klog.V(4) {
+		klog.Infof("Creating resource %v", unstructuredObj)
 	}
 
+	group, version, resource, namespace, name, err := getGroupVersionResourceNamespaceName(unstructuredObj)
+
 	/* add label kabanero.io/jobld = <jobid> */
 	/*
 	err = setJobID(unstructuredObj, jobid)
@@ -1220,21 +1660,40 @@ func createResource(resourceStr string, dynamicClient dynamic.Interface) error {
 
 	if klog.V(5) {
 		klog.Infof("Resources before creating : %v", unstructuredObj)
+	}
+	namespaced := true
+	if err == nil {
+		/* resolve the resource of the kind through discovery, rather than guessing its plural */
+		var mapping *resourceMapping
+		mapping, err = target.mapper.resolve(schema.GroupVersionKind{Group: group, Version: version, Kind: unstructuredObj.GetKind()})
+		if err == nil {
+			resource = mapping.gvr.Resource
+			namespaced = mapping.namespaced
+		}
+	}
+	if namespaced && namespace == "" {
+		return fmt.Errorf("resource %v does not contain namepsace", unstructuredObj)
 	}
 	 gvr := schema.GroupVersionResource{group, version, resource}
 	if err == nil {
-		var intfNoNS = dynamicClient.Resource(gvr)
-		var intf dynamic.ResourceInterface
-		intf = intfNoNS.Namespace(namespace)
+		var intfNoNS = target.dynamicClient.Resource(gvr)
+		var intf dynamic.ResourceInterface = intfNoNS
+		if namespaced {
+			intf = intfNoNS.Namespace(namespace)
+		} else if namespace != "" {
+			/* cluster scoped resources have no namespace */
+			unstructuredObj.SetNamespace("")
+			namespace = ""
+		}
 
-		_, err = intf.Create(unstructuredObj, metav1.CreateOptions{})
+		_, err = intf.Create(unstructuredObj, options)
 		if err != nil {
 			klog.Errorf("Unable to create resource %s/%s error: %s", namespace, name, err)
 			return err
 		}
 	} else {
-		klog.Errorf("Unable to create resource /%s.  Error: %s", resourceStr, err)
-		return fmt.Errorf("Unable to get GVR for resource %s, error: %s", resourceStr, err)
+		klog.Errorf("Unable to create resource /%v.  Error: %s", unstructuredObj, err)
+		return fmt.Errorf("Unable to get GVR for resource %v, error: %s", unstructuredObj, err)
 	}
 	if klog.V(2) {
 		klog.Infof("Created resource %s/%s", namespace, name)
@@ -1325,9 +1784,10 @@ func getGroupVersionResourceNamespaceName(unstructuredObj *unstructured.Unstruct
 		return "", "", "", "", "", fmt.Errorf("Resource name not a string: %s", unstructuredObj)
 	}
 
+	/* cluster scoped resources have no namespace */
 	nsObj, ok := metadata[NAMESPACE]
 	if !ok {
-		return "", "", "", "", "", fmt.Errorf("Resource has no namespace: %s", unstructuredObj)
+		return group, version, resource, "", name, nil
 	}
 	namespace, ok := nsObj.(string)
 	if !ok {
@@ -1409,10 +1869,10 @@ func jobIDCEL(values ...ref.Val) ref.Val {
 }
 
 
-/* Return next job ID */
-func kabaneroConfigCEL(values ...ref.Val) ref.Val {
+/* Return the configuration of the Kabanero instance of the collection */
+func (ev *triggerEval) kabaneroConfigCEL(values ...ref.Val) ref.Val {
     ret := make(map[string]interface{})
-	ret[NAMESPACE] = webhookNamespace
+	ret[NAMESPACE] = ev.tp.kabaneroNamespace()
 	return types.NewDynamicMap(types.DefaultTypeAdapter, ret)
 }
 
@@ -1424,7 +1884,7 @@ func kabaneroConfigCEL(values ...ref.Val) ref.Val {
        map["exists"] is true if the file exists, or false if it doesn't exist
 	   map["content"], if set, is the actual file content, of type map[string]interface{}
 */
-func downloadYAMLCEL(webhookMessage ref.Val, fileNameVal ref.Val) ref.Val {
+func (ev *triggerEval) downloadYAMLCEL(webhookMessage ref.Val, fileNameVal ref.Val) ref.Val {
 	klog.Infof("downloadYAMLCEL first param: %v, second param: %v", webhookMessage, fileNameVal)
 
 	if webhookMessage.Value() == nil {
@@ -1468,6 +1928,13 @@ func downloadYAMLCEL(webhookMessage ref.Val, fileNameVal ref.Val) ref.Val {
 	ret["exists"] = exists
 	if err != nil {
 		ret["error"] = fmt.Sprintf("%v", err)
+		if hint := retryHintOf(err); hint != nil {
+			/* the trigger may tell whether retrying may succeed, and the event is requeued if it can */
+			ret["reason"] = hint.Reason
+			ret["retryable"] = hint.Retryable
+			ret["retryAfter"] = hint.RetryAfter
+			ev.retry = mergeRetryHints(ev.retry, hint)
+		}
 		if klog.V(5) {
 			klog.Infof("downloadYAMLCEI error: %v", err)
 		}
@@ -1486,7 +1953,7 @@ func downloadYAMLCEL(webhookMessage ref.Val, fileNameVal ref.Val) ref.Val {
    param map[string]interface{}: param to pass to function
    Return interface{} : result
 */
-func callCEL(functionVal ref.Val, param ref.Val) ref.Val {
+func (ev *triggerEval) callCEL(functionVal ref.Val, param ref.Val) ref.Val {
 	if klog.V(6) {
 		klog.Infof("callCEL first param: %v, second param: %v", functionVal, param)
 	}
@@ -1518,10 +1985,10 @@ func callCEL(functionVal ref.Val, param ref.Val) ref.Val {
 	}
 
 	if klog.V(6) {
-		klog.Infof("callCEL: getting functions:  %v ", triggerProc.triggerDef.functions)
+		klog.Infof("callCEL: getting functions:  %v ", ev.tp.triggerDef.functions)
 	}
 
-	functionDecl, ok := triggerProc.triggerDef.functions[function]
+	functionDecl, ok := ev.tp.triggerDef.functions[function]
 	if !ok {
 		klog.Errorf("callCEL function %v not found", function)
 		return types.ValOrErr(functionVal, "function %v not found", function)
@@ -1561,7 +2028,7 @@ func callCEL(functionVal ref.Val, param ref.Val) ref.Val {
 
 
 	variables := make(map[string]interface{})
-	env, err := initializeEmptyCELEnv() 
+	env, err := ev.tp.initializeEmptyCELEnv() 
 	if err != nil {
 		klog.Infof("callCEL function %v Unable to initialize CEL environment", function)
 		return types.ValOrErr(functionVal, "callCEL Unable to initialize CEL environment. Error: %v ", err)
@@ -1574,7 +2041,7 @@ func callCEL(functionVal ref.Val, param ref.Val) ref.Val {
 	}
 
 	depth := 1
-	_,  err = evalArrayObject(env, variables, bodyArray, depth)
+	_,  err = ev.evalArrayObject(env, variables, bodyArray, depth)
 	if err != nil {
 		klog.Infof("callCEL error: %v", err)
 		return types.ValOrErr(param, "callCEL error evaluating function body. Error: %v ", err)
@@ -1630,7 +2097,7 @@ func convertToRefVal(outValueObj interface{}) (ref.Val, error) {
    variable Any: variable to pass to go template
    Return string : empty if OK, otherwise, error message
 */
-func applyResourcesCEL(dir ref.Val, variables ref.Val) ref.Val {
+func (ev *triggerEval) applyResourcesCEL(dir ref.Val, variables ref.Val) ref.Val {
 	klog.Infof("applyResourcesCEL first param: %v, second param: %v", dir, variables)
 
 	if variables.Value() == nil {
@@ -1650,7 +2117,50 @@ func applyResourcesCEL(dir ref.Val, variables ref.Val) ref.Val {
 		return types.ValOrErr(dir, "unexpected type '%v' passed as first parameter to function applyResources. It should be string", dir.Type())
 	}
 
-	err := applyResourcesHelper(triggerProc.triggerDir, dirStr, variables.Value(), triggerProc.triggerDef.isDryRun())
+	ev.recordAction("applyResources %s", dirStr)
+	return ev.applyResources(dirStr, variables.Value(), "")
+}
+
+/* implementation of call for applyResourcesToCluster.
+   cluster string: name of the remote cluster
+   dir string: directory
+   variable Any: variable to pass to go template
+   Return string : empty if OK, otherwise, error message
+*/
+func (ev *triggerEval) applyResourcesToClusterCEL(values ...ref.Val) ref.Val {
+	if len(values) != 3 {
+		return types.NewErr("applyResourcesToCluster requires 3 parameters, not %v", len(values))
+	}
+	cluster, dir, variables := values[0], values[1], values[2]
+	clusterStr, ok := cluster.Value().(string)
+	if !ok {
+		return types.ValOrErr(cluster, "unexpected type '%v' passed as first parameter to function applyResourcesToCluster. It should be string", cluster.Type())
+	}
+	dirStr, ok := dir.Value().(string)
+	if !ok {
+		return types.ValOrErr(dir, "unexpected type '%v' passed as second parameter to function applyResourcesToCluster. It should be string", dir.Type())
+	}
+	if variables.Value() == nil {
+		return types.ValOrErr(variables, "unexpected null third parameter passed to function applyResourcesToCluster.")
+	}
+
+	ev.recordAction("applyResourcesToCluster %s %s", clusterStr, dirStr)
+	return ev.applyResources(dirStr, variables.Value(), clusterStr)
+}
+
+/* Apply the resources of a directory in a cluster, returning the error message, or an empty string if OK */
+func (ev *triggerEval) applyResources(dirStr string, variables interface{}, cluster string) ref.Val {
+	action := &resourceAction{ctx: ev.opts.ctx, collection: ev.tp.name, digest: ev.tp.digest, trigger: ev.trigger, eventID: ev.eventID, repository: ev.repository, cluster: cluster, priority: priorityBulk, dryrun: ev.isDryRun(), compiled: ev.tp.compiled}
+	/* evaluations always in dry-run are not submitted to the cluster */
+	action.serverDryRun = action.dryrun && serverDryRun && !ev.opts.dryrun
+	if ev.span != nil {
+		action.traceparent = ev.span.context.traceparent()
+	}
+	if ev.opts.interactive {
+		action.priority = priorityInteractive
+	}
+	err := applyResourcesHelper(ev.tp.triggerDir, ev.tp.templates, dirStr, variables, action)
+	ev.rendered = append(ev.rendered, action.rendered...)
 	var ret ref.Val
 	if err != nil {
 		ret = types.String(fmt.Sprintf("applyResources error  applying template %v", err) )
@@ -1680,8 +2190,34 @@ func findFiles(resourceDir string, suffixes []string) ([]string, error) {
 	return ret, nil
 }
 
-func applyResourcesHelper(triggerDirectory string, directory string, variables interface{}, dryrun bool) error {
+/* The trigger applying resources */
+type resourceAction struct {
+	ctx context.Context // no resources are created once done. nil if unbounded
+	collection string // name of the trigger processor
+	digest string // digest of the collection
+	trigger string
+	eventID string
+	repository string
+	cluster string // name of the remote cluster where the resources are created. The local cluster if empty
+	priority int // priority of the creation of the resources, such as priorityInteractive
+	dryrun bool
+	serverDryRun bool // the resources rendered in dry-run are submitted with a server-side dry-run
+	rendered []*dryRunResource // resources rendered in dry-run
+	traceparent string // trace context of the trigger, propagated to the resources
+	compiled *compiledCollection // templates of the collection parsed once. nil if not cached
+}
+
+/* A check or transformation of a resource. Filters are run on all the resources of an applyResources before any is created. */
+type resourceFilter func(action *resourceAction, resource *unstructured.Unstructured) error
+
+var resourceFilters = []resourceFilter{hookResource, labelResource, traceResource, scanResourceSecrets, checkResourcePolicy, checkOPAPolicy}
 
+func applyResourcesHelper(triggerDirectory string, library *template.Template, directory string, variables interface{}, action *resourceAction) error {
+
+	target, err := targetCluster(action.cluster)
+	if err != nil {
+		return err
+	}
 	resourceDir, err := mergePathWithErrorCheck(triggerDirectory , directory)
 	if err != nil {
 		return err
@@ -1692,27 +2228,56 @@ func applyResourcesHelper(triggerDirectory string, directory string, variables i
 	}
 
 	/* ensure all files are substituted OK*/
-	substituted := make([] string, 0)
+	resources := make([] *unstructured.Unstructured, 0)
 	for _, path := range files {
-		after, err := substituteTemplateFile(path, variables)
+		after, err := substituteCompiledTemplateFile(action.compiled, library, path, variables)
+		if err != nil {
+			return err
+		}
+		resource, err := decodeResource(after)
 		if err != nil {
 			return err
 		}
-		substituted = append(substituted, after)
+		resources = append(resources, resource)
 	}
 
-    if dryrun {
+	/* ensure all resources pass the filters */
+	for _, resource := range resources {
+		for _, filter := range resourceFilters {
+			err = filter(action, resource)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+    if action.dryrun {
 		klog.Infof("applyResources: dryrun is set. Resources not created")
+		for _, resource := range resources {
+			err = action.renderDryRun(resource, target)
+			if err != nil {
+				return err
+			}
+		}
     } else {
 		/* Apply the files */
-		for _, resource:= range substituted {
+		for _, resource:= range resources {
 			if klog.V(5) {
-				klog.Infof("applying resource: %s", resource)
+				klog.Infof("applying resource: %v", resource)
 			}
-			err = createResource(resource, dynamicClient)
+			err = waitToCreate(action)
 			if err != nil {
 				return err
 			}
+			err = checkContext(action.ctx)
+			if err != nil {
+				return err
+			}
+			err = createResource(resource, target)
+			if err != nil {
+				return err
+			}
+			eventInfo(action.eventID, "Created resource", logFields{"trigger": action.trigger, "collection": action.collection, "kind": resource.GetKind(), "name": resource.GetName(), "namespace": resource.GetNamespace(), "cluster": action.cluster})
 		}
 	}
 	return nil
@@ -1770,7 +2335,7 @@ func convertToHeaderMap(value interface{}) (map[string][]string, error) {
    Return string : empty if OK, otherwise, error message
 */
 // func sendEventCEL(destination ref.Val, message ref.Val, context ref.Val) ref.Val  
-func sendEventCEL(refs ... ref.Val) ref.Val {
+func (ev *triggerEval) sendEventCEL(refs ... ref.Val) ref.Val {
 	if refs == nil {
 		klog.Error("sendEventCEL input is nil")
 		return types.ValOrErr(nil, "unexpected nil input to sendEventCEL.") 
@@ -1814,12 +2379,12 @@ func sendEventCEL(refs ... ref.Val) ref.Val {
 		return types.ValOrErr(nil, "sendEventCEL error marshalling message to JSON: %v", err)
 	} 
 
-	destNode := eventProviders.GetEventDestination(dest)
+	destNode := currentEventProviders().GetEventDestination(dest)
 	if destNode == nil {
 		klog.Errorf("Unable to find an eventDestination with the name '%s'. Verify that it has been defined.", dest)
 		return  types.ValOrErr(nil, "sendEventCEL Unable to find event destinations %v", dest)
 	}
-	provider := eventProviders.GetMessageProvider(destNode.ProviderRef)
+	provider := lookupMessageProvider(destNode.ProviderRef)
 	if provider == nil {
 		klog.Errorf("Unable to find a messageProvider with the name '%s'. Verify that is has been defined.", destNode.ProviderRef)
 		return  types.ValOrErr(nil, "sendEventCEL Unable to find message povider %v", destNode.ProviderRef)
@@ -1833,16 +2398,34 @@ func sendEventCEL(refs ... ref.Val) ref.Val {
 		}
 	}
 
-	if triggerProc.triggerDef.isDryRun() {
+	ev.recordAction("sendEvent %s", dest)
+	if ev.isDryRun() {
 		klog.Infof("sendEvent: dryrun is set. Event was not sent to destination '%s'", dest)
 		return types.String("")
 	}
 
-	err = provider.Send(destNode, bytes, header)
+	err = ev.checkDeadline()
+	if err != nil {
+		return types.ValOrErr(nil, "sendEventCEL not sending event to %v: %v", dest, err)
+	}
+	if !filterSentMessage(destNode, bytes) {
+		return types.String("")
+	}
+	var parent spanContext
+	if ev.span != nil {
+		parent = ev.span.context
+	}
+	s := startSpan("send "+dest, spanKindProducer, parent)
+	s.setAttribute("messaging.destination.name", dest)
+	s.setAttribute("kabanero.trigger", ev.trigger)
+	err = provider.Send(destNode, bytes, withTraceparent(header, s.context))
+	s.finish(err)
+	recordMessageActivity(destNode, true, err)
 	if err != nil {
 		klog.Error(err)
 		return types.ValOrErr(nil, "sendEventCEL error sending message: %v", err)
 	}
+	hookDelivered(dest, bytes)
 	if klog.V(6) {
 		klog.Infof("sendEvent successfully sent message to destination '%s'", dest)
 	}
@@ -1859,7 +2442,7 @@ func sendEventCEL(refs ... ref.Val) ref.Val {
         newHader : ' filter(header, " key.startsWith(\"X-Github\") || key.startsWith(\"github\")) '
 		newArray: ' filter(oldArray, " value < 10 " )
 */
-func filterCEL(message ref.Val, expression ref.Val) ref.Val {
+func (ev *triggerEval) filterCEL(message ref.Val, expression ref.Val) ref.Val {
 	if klog.V(6) {
 		klog.Infof("filterCEL first param: %v, second param: %v", message, expression)
 	}
@@ -1899,7 +2482,7 @@ func filterCEL(message ref.Val, expression ref.Val) ref.Val {
 		for iter := messageValue.MapRange(); iter.Next(); {
 			key := iter.Key()
 			value := iter.Value()
-			err = filterMapEntry(retMap, key, value , expressionStr ) 
+			err = ev.filterMapEntry(retMap, key, value , expressionStr ) 
 			if err != nil {
 				klog.Errorf("In built-in function filter evaluation of condition %v resulted in error  %v", expressionStr, err) 
 				return types.ValOrErr(message, "In built-in function filter evaluation of condition %v resulted in error  %v", expressionStr, err) 
@@ -1911,7 +2494,7 @@ func filterCEL(message ref.Val, expression ref.Val) ref.Val {
 		retArray := reflect.MakeSlice(reflect.SliceOf(messageType.Elem()), 0, 0)
 		for i := 0; i < messageValue.Len(); i++ {
 			value := messageValue.Index(i)
-			retArray, err = filterArraySlice(retArray, value , expressionStr ) 
+			retArray, err = ev.filterArraySlice(retArray, value , expressionStr ) 
 			if err != nil {
 				klog.Errorf("In built-in function filter evaluation of condition %v resulted in error  %v", expressionStr, err) 
 				return types.ValOrErr(message, "In built-in function filter evaluation of condition %v resulted in error  %v", expressionStr, err) 
@@ -1939,8 +2522,8 @@ func filterCEL(message ref.Val, expression ref.Val) ref.Val {
  Then then evaluates the expression in the context of the key/value variables.
  If the expression is true, it inserts the ke/value into the map
 */
-func filterMapEntry(mapVal reflect.Value, key, value reflect.Value, expression string ) error {
-	env, err := initializeEmptyCELEnv() 
+func (ev *triggerEval) filterMapEntry(mapVal reflect.Value, key, value reflect.Value, expression string ) error {
+	env, err := ev.tp.initializeEmptyCELEnv() 
 	if err != nil {
 		return err
 	}
@@ -1961,7 +2544,7 @@ func filterMapEntry(mapVal reflect.Value, key, value reflect.Value, expression s
 	if err != nil {
 		return err
 	}
-	condition, err := evalCondition(env, expression, variables) 
+	condition, err := ev.evalCondition(env, expression, variables) 
 	if err != nil {
 		return err
 	}
@@ -1984,8 +2567,8 @@ var nilValue = reflect.ValueOf(nil)
  Then then evaluates the expression in the context of the value variables.
  If the expression is true, it inserts the value into the slice
 */
-func filterArraySlice(slice reflect.Value, value reflect.Value, expression string ) (reflect.Value, error) {
-	env, err := initializeEmptyCELEnv() 
+func (ev *triggerEval) filterArraySlice(slice reflect.Value, value reflect.Value, expression string ) (reflect.Value, error) {
+	env, err := ev.tp.initializeEmptyCELEnv() 
 	if err != nil {
 		return nilValue, err
 	}
@@ -1999,7 +2582,7 @@ func filterArraySlice(slice reflect.Value, value reflect.Value, expression strin
 	if err != nil {
 		return nilValue, err
 	}
-	condition, err := evalCondition(env, expression, variables) 
+	condition, err := ev.evalCondition(env, expression, variables) 
 	if err != nil {
 		return nilValue, err
 	}
@@ -2016,13 +2599,46 @@ func getAdditionalCELFuncDecls() cel.EnvOption{
 }
 
 
-/* Get implemenations of additional overloaded CEL functions */
-func getAdditionalCELFuncs() cel.ProgramOption {
-	return triggerFuncs
+/* Get implemenations of additional overloaded CEL functions, bound to this evaluation */
+func (ev *triggerEval) celFunctions() cel.ProgramOption {
+	if ev.funcs == nil {
+		overloads := []*functions.Overload{
+			&functions.Overload{
+				Operator: "filter",
+				Binary: ev.filterCEL} ,
+			&functions.Overload{
+				Operator: "call",
+				Binary: ev.callCEL} ,
+			&functions.Overload{
+				Operator: "sendEvent",
+				Function: ev.sendEventCEL} ,
+			&functions.Overload{
+				Operator: "applyResources",
+				Binary: ev.applyResourcesCEL} ,
+			&functions.Overload{
+				Operator: "applyResourcesToCluster",
+				Function: ev.applyResourcesToClusterCEL} ,
+			&functions.Overload{
+				Operator: "kabaneroConfig",
+				Function: ev.kabaneroConfigCEL} ,
+			&functions.Overload{
+				Operator: "downloadYAML",
+				Binary: ev.downloadYAMLCEL} ,
+			&functions.Overload{
+				Operator: "kube.getConfigMap",
+				Binary: ev.kubeGetConfigMapCEL} ,
+			&functions.Overload{
+				Operator: "kube.getSecretKey",
+				Function: ev.kubeGetSecretKeyCEL} ,
+		}
+		overloads = append(overloads, ev.macroOverloads()...)
+		ev.funcs = cel.Functions(append(overloads, triggerFuncs...)...)
+	}
+	return ev.funcs
 }
 
 var triggerFuncDecls cel.EnvOption
-var triggerFuncs cel.ProgramOption
+var triggerFuncs []*functions.Overload // implementations of functions that do not depend on the evaluation
 
 func init() {
 	triggerFuncDecls = cel.Declarations (
@@ -2034,6 +2650,8 @@ func init() {
 			decls.NewOverload("sendEvent_string_any_any", []*exprpb.Type{decls.String, decls.Any, decls.Any}, decls.String)),
 		decls.NewFunction("applyResources", 
 			decls.NewOverload("applyResources_string_any", []*exprpb.Type{decls.String, decls.Any}, decls.String)),
+		decls.NewFunction("applyResourcesToCluster",
+			decls.NewOverload("applyResourcesToCluster_string_string_any", []*exprpb.Type{decls.String, decls.String, decls.Any}, decls.String)),
 		decls.NewFunction("kabaneroConfig", 
 			decls.NewOverload("kabaneroConfig", []*exprpb.Type{}, decls.NewMapType(decls.String, decls.Any))),
 		decls.NewFunction("jobID", 
@@ -2045,31 +2663,43 @@ func init() {
 		decls.NewFunction("toLabel", 
 			decls.NewOverload("toLabel_string", []*exprpb.Type{decls.String}, decls.String)),
 		decls.NewFunction("split",
-			decls.NewOverload("split_string", []*exprpb.Type{decls.String, decls.String}, decls.NewListType(decls.String))))
-
-	triggerFuncs = cel.Functions(
-		&functions.Overload{
-	        Operator: "filter",
-	        Binary: filterCEL} ,
-		&functions.Overload{
-	        Operator: "call",
-	        Binary: callCEL} ,
-		&functions.Overload{
-	        Operator: "sendEvent",
-	        Function: sendEventCEL} ,
-		&functions.Overload{
-	        Operator: "applyResources",
-	        Binary: applyResourcesCEL} ,
-		&functions.Overload{
-	        Operator: "kabaneroConfig",
-	        Function: kabaneroConfigCEL} ,
+			decls.NewOverload("split_string", []*exprpb.Type{decls.String, decls.String}, decls.NewListType(decls.String))),
+		decls.NewFunction("semverCompare",
+			decls.NewOverload("semverCompare_string_string", []*exprpb.Type{decls.String, decls.String}, decls.Int)),
+		decls.NewFunction("semverValid",
+			decls.NewOverload("semverValid_string", []*exprpb.Type{decls.String}, decls.Bool)),
+		decls.NewFunction("semverSatisfies",
+			decls.NewOverload("semverSatisfies_string_string", []*exprpb.Type{decls.String, decls.String}, decls.Bool)),
+		decls.NewFunction("inTimeWindow",
+			decls.NewOverload("inTimeWindow_string", []*exprpb.Type{decls.String}, decls.Bool)),
+		decls.NewFunction("inFreeze",
+			decls.NewOverload("inFreeze_string", []*exprpb.Type{decls.String}, decls.Bool)),
+		decls.NewFunction("regexCaptures",
+			decls.NewOverload("regexCaptures_string_string", []*exprpb.Type{decls.String, decls.String}, decls.NewListType(decls.String))),
+		decls.NewFunction("base64Encode",
+			decls.NewOverload("base64Encode_string", []*exprpb.Type{decls.String}, decls.String)),
+		decls.NewFunction("base64Decode",
+			decls.NewOverload("base64Decode_string", []*exprpb.Type{decls.String}, decls.String)),
+		decls.NewFunction("jsonPath",
+			decls.NewOverload("jsonPath_dyn_string", []*exprpb.Type{decls.Dyn, decls.String}, decls.Dyn),
+			decls.NewOverload("jsonPath_dyn_string_dyn", []*exprpb.Type{decls.Dyn, decls.String, decls.Dyn}, decls.Dyn)),
+		decls.NewFunction("parseURL",
+			decls.NewOverload("parseURL_string", []*exprpb.Type{decls.String}, decls.NewMapType(decls.String, decls.Dyn))),
+		decls.NewFunction("hash",
+			decls.NewOverload("hash_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String)),
+		decls.NewFunction("formatTime",
+			decls.NewOverload("formatTime_timestamp_string", []*exprpb.Type{decls.Timestamp, decls.String}, decls.String),
+			decls.NewOverload("formatTime_string_string", []*exprpb.Type{decls.String, decls.String}, decls.String)),
+		decls.NewFunction("kube.getConfigMap",
+			decls.NewOverload("kube_getConfigMap_string_string", []*exprpb.Type{decls.String, decls.String}, decls.NewMapType(decls.String, decls.String))),
+		decls.NewFunction("kube.getSecretKey",
+			decls.NewOverload("kube_getSecretKey_string_string_string", []*exprpb.Type{decls.String, decls.String, decls.String}, decls.String)))
+
+	triggerFuncs = []*functions.Overload{
 		&functions.Overload{
 	        Operator: "jobID",
 	        Function: jobIDCEL} ,
 		&functions.Overload{
-	        Operator: "downloadYAML",
-	        Binary: downloadYAMLCEL} ,
-		&functions.Overload{
 	        Operator: "toDomainName",
 	        Unary: toDomainNameCEL} ,
 		&functions.Overload{
@@ -2077,5 +2707,43 @@ func init() {
 	        Unary: toLabelCEL} ,
 		&functions.Overload{
 	        Operator: "split",
-	        Binary: splitCEL})
+	        Binary: splitCEL},
+		&functions.Overload{
+	        Operator: "semverCompare",
+	        Binary: semverCompareCEL},
+		&functions.Overload{
+	        Operator: "semverValid",
+	        Unary: semverValidCEL},
+		&functions.Overload{
+	        Operator: "semverSatisfies",
+	        Binary: semverSatisfiesCEL},
+		&functions.Overload{
+	        Operator: "inTimeWindow",
+	        Unary: inTimeWindowCEL},
+		&functions.Overload{
+	        Operator: "inFreeze",
+	        Unary: inFreezeCEL},
+		&functions.Overload{
+	        Operator: "regexCaptures",
+	        Binary: regexCapturesCEL},
+		&functions.Overload{
+	        Operator: "base64Encode",
+	        Unary: base64EncodeCEL},
+		&functions.Overload{
+	        Operator: "base64Decode",
+	        Unary: base64DecodeCEL},
+		&functions.Overload{
+	        Operator: "jsonPath",
+	        Binary: func(value ref.Val, path ref.Val) ref.Val { return jsonPathCEL(value, path) },
+	        Function: jsonPathCEL},
+		&functions.Overload{
+	        Operator: "parseURL",
+	        Unary: parseURLCEL},
+		&functions.Overload{
+	        Operator: "hash",
+	        Binary: hashCEL},
+		&functions.Overload{
+	        Operator: "formatTime",
+	        Binary: formatTimeCEL},
+	}
 }
@@ -0,0 +1,291 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+
+	"k8s.io/klog"
+)
+
+/* constants for parsing the macro section */
+const (
+	MACROS     = "macros"
+	PARAMS     = "params"
+	EXPRESSION = "expression"
+)
+
+/*
+A macro is a named CEL expression with parameters. It is called like a function from any expression in the collection.
+Macros are parsed and type checked once when the collection is loaded, when macros calling themselves, directly or
+through other macros, are rejected. The program of a macro is built once per evaluation of a trigger.
+*/
+type celMacro struct {
+	name       string
+	params     []string
+	expression string
+	env        cel.Env // environment the macro was checked in, with the params declared
+	checked    cel.Ast
+	calls      []string // macros called by the expression
+}
+
+const macroOverloadSuffix = "_macro"
+
+/* Read the macros section of a trigger file */
+func readMacros(yamlMap map[string]interface{}, td *eventTriggerDefinition) error {
+	macrosObj, ok := yamlMap[MACROS]
+	if !ok {
+		return nil
+	}
+	macrosArray, ok := macrosObj.([]interface{})
+	if !ok {
+		return fmt.Errorf("macros %v not of type []interface{}, but type %T", macrosObj, macrosObj)
+	}
+	for _, macroObj := range macrosArray {
+		macroMap, ok := macroObj.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("macro %v not of type map[interface{}]interface{}, but type %T", macroObj, macroObj)
+		}
+		name, ok := macroMap[NAME].(string)
+		if !ok || name == "" {
+			return fmt.Errorf("macro %v does not have a name", macroMap)
+		}
+		expression, ok := macroMap[EXPRESSION].(string)
+		if !ok {
+			return fmt.Errorf("macro %v does not have an expression", name)
+		}
+		params := make([]string, 0)
+		if paramsObj, ok := macroMap[PARAMS]; ok {
+			paramsArray, ok := paramsObj.([]interface{})
+			if !ok {
+				return fmt.Errorf("params of macro %v not an array of strings: %v", name, paramsObj)
+			}
+			for _, paramObj := range paramsArray {
+				param, ok := paramObj.(string)
+				if !ok {
+					return fmt.Errorf("param %v of macro %v not a string", paramObj, name)
+				}
+				params = append(params, param)
+			}
+		}
+		if _, existing := td.macros[name]; existing {
+			return fmt.Errorf("error: macro redeclared: %v", name)
+		}
+		if _, existing := td.functions[name]; existing {
+			return fmt.Errorf("error: macro %v has the same name as a function", name)
+		}
+		td.macros[name] = &celMacro{name: name, params: params, expression: expression}
+	}
+	return nil
+}
+
+/* Declare all the macros of the collection, then parse and check each of them */
+func (tp *triggerProcessor) compileMacros() error {
+	if len(tp.triggerDef.macros) == 0 {
+		return nil
+	}
+
+	macroDecls := make([]*exprpb.Decl, 0)
+	for name, macro := range tp.triggerDef.macros {
+		paramTypes := make([]*exprpb.Type, len(macro.params))
+		for index := range paramTypes {
+			paramTypes[index] = decls.Dyn
+		}
+		macroDecls = append(macroDecls, decls.NewFunction(name, decls.NewOverload(name+macroOverloadSuffix, paramTypes, decls.Dyn)))
+	}
+	tp.macroDecls = cel.Declarations(macroDecls...)
+
+	baseEnv, err := tp.initializeEmptyCELEnv()
+	if err != nil {
+		return fmt.Errorf("unable to declare macros: %v", err)
+	}
+	for name, macro := range tp.triggerDef.macros {
+		paramDecls := make([]*exprpb.Decl, 0)
+		for _, param := range macro.params {
+			paramDecls = append(paramDecls, decls.NewIdent(param, decls.Dyn, nil))
+		}
+		env, err := baseEnv.Extend(cel.Declarations(paramDecls...))
+		if err != nil {
+			return fmt.Errorf("unable to declare params of macro %v: %v", name, err)
+		}
+		parsed, issues := env.Parse(macro.expression)
+		if issues != nil && issues.Err() != nil {
+			return fmt.Errorf("parsing error in macro %v: %v", name, issues.Err())
+		}
+		checked, issues := env.Check(parsed)
+		if issues != nil && issues.Err() != nil {
+			return fmt.Errorf("CEL check error in macro %v: %v", name, issues.Err())
+		}
+		macro.env = env
+		macro.checked = checked
+		macro.calls, err = tp.macroCalls(checked)
+		if err != nil {
+			return fmt.Errorf("unable to find the macros called by macro %v: %v", name, err)
+		}
+		if klog.V(5) {
+			klog.Infof("Compiled macro %v(%v): %v", name, macro.params, macro.expression)
+		}
+	}
+	return tp.checkMacroCycles()
+}
+
+/* Return the names of the macros called by a checked expression */
+func (tp *triggerProcessor) macroCalls(checked cel.Ast) ([]string, error) {
+	checkedExpr, err := cel.AstToCheckedExpr(checked)
+	if err != nil {
+		return nil, err
+	}
+	called := make(map[string]bool)
+	for _, reference := range checkedExpr.GetReferenceMap() {
+		for _, overload := range reference.GetOverloadId() {
+			name := strings.TrimSuffix(overload, macroOverloadSuffix)
+			if _, ok := tp.triggerDef.macros[name]; ok && name != overload {
+				called[name] = true
+			}
+		}
+	}
+	calls := make([]string, 0, len(called))
+	for name := range called {
+		calls = append(calls, name)
+	}
+	sort.Strings(calls)
+	return calls, nil
+}
+
+/* Reject macros calling themselves, which would recurse until the stack overflows */
+func (tp *triggerProcessor) checkMacroCycles() error {
+	names := make([]string, 0, len(tp.triggerDef.macros))
+	for name := range tp.triggerDef.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checked := make(map[string]bool) // macros known not to be part of a cycle
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		for index, caller := range path {
+			if caller == name {
+				return fmt.Errorf("error: macro %v calls itself: %v", name, strings.Join(append(path[index:], name), " -> "))
+			}
+		}
+		if checked[name] {
+			return nil
+		}
+		for _, called := range tp.triggerDef.macros[name].calls {
+			if err := visit(called, append(path, name)); err != nil {
+				return err
+			}
+		}
+		checked[name] = true
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Get the implementations of the macros, bound to this evaluation */
+func (ev *triggerEval) macroOverloads() []*functions.Overload {
+	overloads := make([]*functions.Overload, 0)
+	for _, macro := range ev.tp.triggerDef.macros {
+		m := macro
+		impl := func(args ...ref.Val) ref.Val {
+			return ev.evalMacro(m, args)
+		}
+		overload := &functions.Overload{Operator: m.name, Function: impl}
+		switch len(m.params) {
+		case 1:
+			overload.Unary = func(arg ref.Val) ref.Val { return impl(arg) }
+		case 2:
+			overload.Binary = func(lhs ref.Val, rhs ref.Val) ref.Val { return impl(lhs, rhs) }
+		}
+		overloads = append(overloads, overload)
+	}
+	return overloads
+}
+
+/* Evaluate a macro with the given arguments */
+func (ev *triggerEval) evalMacro(macro *celMacro, args []ref.Val) ref.Val {
+	if len(args) != len(macro.params) {
+		return types.NewErr("macro %v expects %v arguments but got %v", macro.name, len(macro.params), len(args))
+	}
+	prg, ok := ev.macroPrograms[macro.name]
+	if !ok {
+		var err error
+		prg, err = macro.env.Program(macro.checked, ev.celFunctions())
+		if err != nil {
+			return types.NewErr("CEL program error in macro %v: %v", macro.name, err)
+		}
+		if ev.macroPrograms == nil {
+			ev.macroPrograms = make(map[string]cel.Program)
+		}
+		ev.macroPrograms[macro.name] = prg
+	}
+	variables := make(map[string]interface{})
+	for index, param := range macro.params {
+		variables[param] = args[index]
+	}
+	out, _, err := prg.Eval(variables)
+	if err != nil {
+		return types.NewErr("error evaluating macro %v: %v", macro.name, err)
+	}
+	return out
+}
+
+/*
+Load the template library of the collection: the files with suffix .tmpl in the top level directory of the collection.
+The named templates they define with {{define "name"}} may be used in the resources applied by any trigger.
+*/
+func (tp *triggerProcessor) loadTemplateLibrary(dir string) error {
+	files, err := findFiles(dir, []string{".tmpl"})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	library := template.New("library")
+	for _, fileName := range files {
+		bytes, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		_, err = library.New(filepath.Base(fileName)).Parse(string(bytes))
+		if err != nil {
+			return fmt.Errorf("unable to parse template library file %v: %v", fileName, err)
+		}
+		if klog.V(5) {
+			klog.Infof("Loaded template library file %v", fileName)
+		}
+	}
+	tp.templates = library
+	return nil
+}
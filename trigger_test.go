@@ -3,7 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"text/template"
 
@@ -23,6 +26,7 @@ const (
 	TRIGGER7 = "test_data/trigger7"
 	TRIGGER8 = "test_data/trigger8"
 	TRIGGER9 = "test_data/trigger9"
+	TRIGGER10 = "test_data/trigger10"
 )
 
 /* Simaple test to read data structure*/
@@ -745,3 +749,246 @@ func TestFilter(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDisableTrigger(t *testing.T) {
+	var event map[string]interface{}
+	err := json.Unmarshal([]byte(`{"attr1": "string1"}`), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := newTriggerProcessor()
+	err = tp.initialize(TRIGGER10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* the unnamed trigger gets a default name */
+	if tp.triggerDef.findTrigger("default-1") == nil {
+		t.Fatal("Unable to find trigger default-1")
+	}
+
+	err = tp.setTriggerEnabled("first", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variablesArray, err := tp.processMessage(event, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variablesArray) != 1 || variablesArray[0]["result"] != "second" {
+		t.Fatalf("Expected only the second trigger to be evaluated, but got %v", variablesArray)
+	}
+
+	err = tp.setTriggerEnabled("first", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	variablesArray, err = tp.processMessage(event, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variablesArray) != 2 {
+		t.Fatalf("Expected both triggers to be evaluated, but got %v", variablesArray)
+	}
+
+	if err = tp.setTriggerEnabled("unknown", false); err == nil {
+		t.Fatal("Expected an error disabling an unknown trigger")
+	}
+}
+
+func TestDryRunActions(t *testing.T) {
+	tp := newTriggerProcessor()
+	err := tp.initialize("test_data/trigger11")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attr, expected := range map[string][]string{"string1": {"applyResources resources"}, "string2": {}} {
+		event := map[string]interface{}{"attr1": attr}
+		result, err := tp.evaluateMessage(event, "default", evalOptions{dryrun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalActions(result.actions, expected) {
+			t.Fatalf("Expected actions %v for %v, but got %v", expected, attr, result.actions)
+		}
+		if result.variables[0]["result"] != nil && result.variables[0]["result"] != "" {
+			t.Fatalf("applyResources failed: %v", result.variables[0]["result"])
+		}
+	}
+}
+
+func TestLibrary(t *testing.T) {
+	tp := newTriggerProcessor()
+	err := tp.initialize("test_data/trigger12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.templates == nil || tp.templates.Lookup("labels") == nil {
+		t.Fatal("template library not loaded")
+	}
+
+	event := map[string]interface{}{"ref": "refs/heads/master", "action": "push", "repository": "repo1"}
+	result, err := tp.evaluateMessage(event, "default", evalOptions{dryrun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variables := result.variables[0]
+	if variables["master"] != true || variables["develop"] != false {
+		t.Fatalf("unexpected results of macros: %v", variables)
+	}
+	if variables["result"] != "" {
+		t.Fatalf("applyResources using template library failed: %v", variables["result"])
+	}
+
+	resource, err := substituteTemplateFile(tp.templates, "test_data/trigger12/resources/configmap.yaml", event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(resource, `ref: "refs/heads/master"`) {
+		t.Fatalf("named template not substituted: %v", resource)
+	}
+}
+
+func TestTriggerContext(t *testing.T) {
+	tp := newTriggerProcessor()
+	err := tp.initialize("test_data/trigger13")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* head_commit is missing from the message, so the author is empty instead of a missing key */
+	message := map[string]interface{}{
+		HEADER: map[string][]string{"X-Github-Event": {"push"}},
+		BODY:   map[string]interface{}{"ref": "refs/heads/master", "repository": map[string]interface{}{"full_name": "org/repo"}},
+	}
+	result, err := tp.evaluateMessage(message, "github", evalOptions{dryrun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	variables := result.variables[0]
+	if variables["eventType"] != "push" || variables["branch"] != "master" || variables["author"] != "" {
+		t.Fatalf("unexpected variables from typed context: %v", variables)
+	}
+	if variables["prNumber"] != float64(0) {
+		t.Fatalf("pull_request fields not present for a push event: %v", variables["prNumber"])
+	}
+
+	/* a field of the wrong type is reported */
+	message[BODY] = map[string]interface{}{"ref": 123}
+	_, err = tp.evaluateMessage(message, "github", evalOptions{dryrun: true})
+	if err == nil {
+		t.Fatal("expected error for ref of the wrong type")
+	}
+}
+
+func TestParallelTriggerEvaluation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	collection := "eventTriggers:\n"
+	for i := 0; i < 6; i++ {
+		body := fmt.Sprintf(`'"trigger%d"'`, i)
+		if i == 2 || i == 4 {
+			/* a missing key fails the trigger */
+			body = "'event.missing'"
+		}
+		collection += fmt.Sprintf("  - eventSource: default\n    name: trigger%d\n    input: event\n    body:\n      - result: %s\n", i, body)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "triggers.yaml"), []byte(collection), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tp := newTriggerProcessor()
+	if err = tp.initialize(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := triggerParallelism
+	defer func() { triggerParallelism = saved }()
+	event := map[string]interface{}{"attr1": "string1"}
+
+	/* sequentially, the evaluation stops at the first error */
+	triggerParallelism = 1
+	result, err := tp.evaluateMessage(event, "default", evalOptions{dryrun: true})
+	if err == nil || len(result.variables) != 2 || strings.Join(result.triggers, ",") != "trigger2" {
+		t.Fatalf("unexpected sequential result %v, %v: %v", result.variables, result.triggers, err)
+	}
+
+	/* concurrently, all triggers are evaluated, and the results are in the order of the triggers */
+	triggerParallelism = 3
+	for run := 0; run < 10; run++ {
+		result, err = tp.evaluateMessage(event, "default", evalOptions{dryrun: true})
+		if err == nil || !strings.Contains(err.Error(), "missing") || strings.Join(result.triggers, ",") != "trigger2,trigger4" {
+			t.Fatalf("unexpected parallel result %v: %v", result.triggers, err)
+		}
+		order := make([]string, 0)
+		for _, variables := range result.variables {
+			order = append(order, fmt.Sprint(variables["result"]))
+		}
+		if strings.Join(order, ",") != "trigger0,trigger1,trigger3,trigger5" {
+			t.Fatalf("unexpected order of results %v", order)
+		}
+	}
+}
+
+func TestMacroCycles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macros")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	macros := `macros:
+  - name: isEven
+    params: [ count ]
+    expression: 'count == 0 || isOdd(count - 1)'
+  - name: isOdd
+    params: [ count ]
+    expression: 'count != 0 && isEven(count - 1)'
+eventTriggers:
+  - eventSource: default
+    input: event
+    body:
+      - even: 'isEven(4)'
+`
+	if err = ioutil.WriteFile(filepath.Join(dir, "macros.yaml"), []byte(macros), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = newTriggerProcessor().initialize(dir)
+	if err == nil || !strings.Contains(err.Error(), "isEven -> isOdd -> isEven") {
+		t.Fatalf("recursive macros were not rejected: %v", err)
+	}
+}
+
+func TestGeneratedTriggerNames(t *testing.T) {
+	/* unnamed triggers are not given the name of a trigger read before */
+	td := &eventTriggerDefinition{eventTriggers: make(map[string][]map[interface{}]interface{})}
+	td.eventTriggers["github"] = []map[interface{}]interface{}{{NAME: "github-1", EVENTSOURCE: "github"}}
+	dir, err := ioutil.TempDir("", "names")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "triggers.yaml")
+	if err = ioutil.WriteFile(fileName, []byte("eventTriggers:\n- eventSource: github\n  body: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = readTriggerDefinition(fileName, td); err != nil {
+		t.Fatal(err)
+	}
+	if td.findTrigger("github-2") == nil {
+		t.Fatalf("unexpected names of triggers %v", td.eventTriggers["github"])
+	}
+
+	/* triggers read after can not have a generated name */
+	named := filepath.Join(dir, "named.yaml")
+	if err = ioutil.WriteFile(named, []byte("eventTriggers:\n- eventSource: github\n  name: github-2\n  body: []\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = readTriggerDefinition(named, td); err == nil || !strings.Contains(err.Error(), "generated") {
+		t.Fatalf("trigger with a generated name was not rejected: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+)
+
+/*
+Typed trigger context.
+
+A trigger may declare a context variable with the "context" key. The variable is built by decoding the webhook message
+into the structs below, so that it always has every field, with zero values for fields missing from the message, and
+fields of the wrong type are reported instead of silently evaluating to nil. Field names follow the GitHub payloads.
+Fields marked as enrichments are derived by kabanero-events and are not part of the payload.
+*/
+
+/* The event types with a typed payload, and the field of TriggerContext holding the payload */
+var typedEventTypes = map[string]string{
+	"push":         "push",
+	"pull_request": "pull_request",
+}
+
+/* constants for the typed context */
+const (
+	CONTEXT = "context"
+)
+
+// GitHubUser is a user or organization.
+type GitHubUser struct {
+	Login   string `json:"login"`
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	HTMLURL string `json:"html_url"`
+}
+
+// GitHubCommitAuthor is the author or committer of a commit.
+type GitHubCommitAuthor struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+// GitHubCommit is a commit included in a push.
+type GitHubCommit struct {
+	ID        string             `json:"id"`
+	Message   string             `json:"message"`
+	Timestamp string             `json:"timestamp"`
+	URL       string             `json:"url"`
+	Author    GitHubCommitAuthor `json:"author"`
+	Committer GitHubCommitAuthor `json:"committer"`
+	Added     []string           `json:"added"`
+	Removed   []string           `json:"removed"`
+	Modified  []string           `json:"modified"`
+}
+
+// GitHubRepository is the repository of an event.
+type GitHubRepository struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	FullName      string     `json:"full_name"`
+	Private       bool       `json:"private"`
+	Owner         GitHubUser `json:"owner"`
+	HTMLURL       string     `json:"html_url"`
+	CloneURL      string     `json:"clone_url"`
+	SSHURL        string     `json:"ssh_url"`
+	DefaultBranch string     `json:"default_branch"`
+}
+
+// GitHubPushEvent is the payload of a push event.
+type GitHubPushEvent struct {
+	Ref        string           `json:"ref"`
+	Before     string           `json:"before"`
+	After      string           `json:"after"`
+	Created    bool             `json:"created"`
+	Deleted    bool             `json:"deleted"`
+	Forced     bool             `json:"forced"`
+	BaseRef    string           `json:"base_ref"`
+	Compare    string           `json:"compare"`
+	Commits    []GitHubCommit   `json:"commits"`
+	HeadCommit GitHubCommit     `json:"head_commit"`
+	Repository GitHubRepository `json:"repository"`
+	Pusher     GitHubUser       `json:"pusher"`
+	Sender     GitHubUser       `json:"sender"`
+
+	Branch string `json:"branch" enrichment:"true" description:"branch pushed to, empty if a tag was pushed"`
+	Tag    string `json:"tag" enrichment:"true" description:"tag pushed, empty if a branch was pushed"`
+}
+
+// GitHubPullRequestBranch is the head or base of a pull request.
+type GitHubPullRequestBranch struct {
+	Label string           `json:"label"`
+	Ref   string           `json:"ref"`
+	SHA   string           `json:"sha"`
+	User  GitHubUser       `json:"user"`
+	Repo  GitHubRepository `json:"repo"`
+}
+
+// GitHubPullRequest is a pull request.
+type GitHubPullRequest struct {
+	ID             int64                   `json:"id"`
+	Number         int64                   `json:"number"`
+	State          string                  `json:"state"`
+	Title          string                  `json:"title"`
+	Body           string                  `json:"body"`
+	HTMLURL        string                  `json:"html_url"`
+	Draft          bool                    `json:"draft"`
+	Merged         bool                    `json:"merged"`
+	MergeCommitSHA string                  `json:"merge_commit_sha"`
+	User           GitHubUser              `json:"user"`
+	Head           GitHubPullRequestBranch `json:"head"`
+	Base           GitHubPullRequestBranch `json:"base"`
+}
+
+// GitHubPullRequestEvent is the payload of a pull_request event.
+type GitHubPullRequestEvent struct {
+	Action      string            `json:"action"`
+	Number      int64             `json:"number"`
+	PullRequest GitHubPullRequest `json:"pull_request"`
+	Repository  GitHubRepository  `json:"repository"`
+	Sender      GitHubUser        `json:"sender"`
+}
+
+// TriggerContext is the value of the context variable of a trigger. Only the field of the event type is filled in,
+// but all fields are always present.
+type TriggerContext struct {
+	EventType   string                 `json:"event_type" enrichment:"true" description:"value of the X-Github-Event header"`
+	Delivery    string                 `json:"delivery" enrichment:"true" description:"value of the X-Github-Delivery header"`
+	Push        GitHubPushEvent        `json:"push"`
+	PullRequest GitHubPullRequestEvent `json:"pull_request"`
+}
+
+/* Build the typed context of a webhook message */
+func newTriggerContext(message map[string]interface{}) (*TriggerContext, error) {
+	ctx := &TriggerContext{}
+
+	headerMap, err := convertToHeaderMap(message[HEADER])
+	if err != nil {
+		return nil, fmt.Errorf("header of message can not be converted to map[string][]string: %v", err)
+	}
+	for key, values := range headerMap {
+		if len(values) == 0 {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "x-github-event":
+			ctx.EventType = values[0]
+		case "x-github-delivery":
+			ctx.Delivery = values[0]
+		}
+	}
+
+	body, ok := message[BODY]
+	if !ok {
+		return ctx, nil
+	}
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	switch ctx.EventType {
+	case "push":
+		if err = json.Unmarshal(bytes, &ctx.Push); err != nil {
+			return nil, fmt.Errorf("unable to decode push event: %v", err)
+		}
+		switch {
+		case strings.HasPrefix(ctx.Push.Ref, "refs/heads/"):
+			ctx.Push.Branch = strings.TrimPrefix(ctx.Push.Ref, "refs/heads/")
+		case strings.HasPrefix(ctx.Push.Ref, "refs/tags/"):
+			ctx.Push.Tag = strings.TrimPrefix(ctx.Push.Ref, "refs/tags/")
+		}
+	case "pull_request":
+		if err = json.Unmarshal(bytes, &ctx.PullRequest); err != nil {
+			return nil, fmt.Errorf("unable to decode pull_request event: %v", err)
+		}
+	}
+	return ctx, nil
+}
+
+/* Convert the typed context into the map used as the value of the context variable */
+func (ctx *TriggerContext) toMap() (map[string]interface{}, error) {
+	bytes, err := json.Marshal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]interface{})
+	err = json.Unmarshal(bytes, &ret)
+	return ret, err
+}
+
+/* Declare the context variable of a trigger, if the trigger asks for one */
+func addContextVariable(env cel.Env, variables map[string]interface{}, trigger map[interface{}]interface{}, message map[string]interface{}) (cel.Env, error) {
+	contextObj, ok := trigger[CONTEXT]
+	if !ok {
+		return env, nil
+	}
+	name, ok := contextObj.(string)
+	if !ok || name == "" {
+		return env, fmt.Errorf("context of trigger %v is not a variable name: %v", triggerName(trigger), contextObj)
+	}
+	ctx, err := newTriggerContext(message)
+	if err != nil {
+		return env, fmt.Errorf("unable to build context of trigger %v: %v", triggerName(trigger), err)
+	}
+	ctxMap, err := ctx.toMap()
+	if err != nil {
+		return env, err
+	}
+	env, err = env.Extend(cel.Declarations(decls.NewIdent(name, decls.NewMapType(decls.String, decls.Dyn), nil)))
+	if err != nil {
+		return env, err
+	}
+	variables[name] = ctxMap
+	return env, nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+/*
+Attribution of outbound requests. The calls to GitHub, the message brokers, the Kubernetes API servers, and the other
+HTTP endpoints are sent with a User-Agent naming the version of the mediator and the cluster it runs in, such as
+kabanero-events/0.1.0 (cluster 6f1e...), so that enterprise proxies and GitHub admins can attribute the traffic. The
+cluster is identified by -clusterID, or else by the UID of the kube-system namespace, which is stable for the life of
+the cluster. -userAgent replaces the whole User-Agent.
+*/
+
+const userAgentProduct = "kabanero-events"
+
+var (
+	buildVersion = "dev" // version of the build, set with -ldflags "-X main.buildVersion=<version>"
+
+	clusterID     string // identity of the cluster in the User-Agent. The UID of the kube-system namespace if empty
+	userAgentFlag string // User-Agent of outbound requests, replacing the default if not empty
+)
+
+/* Return the User-Agent of outbound requests */
+func userAgent() string {
+	if userAgentFlag != "" {
+		return userAgentFlag
+	}
+	if clusterID == "" {
+		return userAgentProduct + "/" + buildVersion
+	}
+	return fmt.Sprintf("%s/%s (cluster %s)", userAgentProduct, buildVersion, clusterID)
+}
+
+/* Return the UID of the kube-system namespace, or an empty string if it can not be read */
+func discoverClusterID(cfg *rest.Config) string {
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		klog.Warningf("Unable to identify the cluster: %v", err)
+		return ""
+	}
+	namespace, err := client.CoreV1().Namespaces().Get("kube-system", metav1.GetOptions{})
+	if err != nil {
+		/* reading namespaces requires a cluster role: -clusterID may be set instead */
+		klog.Warningf("Unable to identify the cluster from the kube-system namespace: %v", err)
+		return ""
+	}
+	return string(namespace.GetUID())
+}
+
+/* A transport setting the User-Agent of requests that do not have one */
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (transport *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return transport.base.RoundTrip(req)
+	}
+	/* a RoundTripper must not modify the request */
+	withAgent := new(http.Request)
+	*withAgent = *req
+	withAgent.Header = make(http.Header, len(req.Header)+1)
+	for name, values := range req.Header {
+		withAgent.Header[name] = values
+	}
+	withAgent.Header.Set("User-Agent", userAgent())
+	return transport.base.RoundTrip(withAgent)
+}
+
+/* Wrap a transport, or the default transport if nil, to set the User-Agent */
+func withUserAgent(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &userAgentTransport{base: base}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserAgent(t *testing.T) {
+	savedID, savedFlag := clusterID, userAgentFlag
+	defer func() { clusterID, userAgentFlag = savedID, savedFlag }()
+	clusterID, userAgentFlag = "", ""
+	if agent := userAgent(); agent != "kabanero-events/"+buildVersion {
+		t.Fatalf("unexpected User-Agent %v", agent)
+	}
+	clusterID = "6f1e"
+	if agent := userAgent(); agent != "kabanero-events/"+buildVersion+" (cluster 6f1e)" {
+		t.Fatalf("unexpected User-Agent %v", agent)
+	}
+	userAgentFlag = "proxy-friendly/1.0"
+	if agent := userAgent(); agent != "proxy-friendly/1.0" {
+		t.Fatalf("unexpected User-Agent %v", agent)
+	}
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	savedID, savedFlag := clusterID, userAgentFlag
+	defer func() { clusterID, userAgentFlag = savedID, savedFlag }()
+	clusterID, userAgentFlag = "6f1e", ""
+
+	agents := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		agents <- req.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: withUserAgent(nil)}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if agent := <-agents; agent != userAgent() || req.Header.Get("User-Agent") != "" {
+		t.Fatalf("unexpected User-Agent %v, request header %v", agent, req.Header.Get("User-Agent"))
+	}
+
+	/* a User-Agent set by the caller is kept */
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("User-Agent", "poller")
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if agent := <-agents; agent != "poller" {
+		t.Fatalf("unexpected User-Agent %v", agent)
+	}
+}
@@ -0,0 +1,659 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/google/cel-go/cel"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Validation of trigger collections. `kabanero-events validate <dir|url>` checks a trigger collection, in a directory or
+pointed to by a Kabanero index, without connecting to any broker or cluster, so that changes to a collection can be
+gated in CI. The YAML of the files of the collection is parsed, the statements of the triggers and functions are
+checked, and their CEL expressions are parsed. The eventSources of the triggers, the destinations of sendEvent, the
+functions of call, and the directories of applyResources must exist, as must the messageProviders of the
+eventDestinations of eventDefinitions.yaml. The resource templates are parsed with the template library. Errors are
+printed with the file and line they are found at, the line of an expression being the first line of the file it is
+found on, and the command exits with 1 if there are errors.
+*/
+
+/* An error found validating a collection */
+type validationError struct {
+	file string
+	line int // 0 if unknown
+	msg  string
+}
+
+func (err validationError) String() string {
+	if err.line > 0 {
+		return fmt.Sprintf("%s:%d: %s", err.file, err.line, err.msg)
+	}
+	return fmt.Sprintf("%s: %s", err.file, err.msg)
+}
+
+/* The validation of a collection */
+type collectionValidator struct {
+	dir          string
+	display      func(string) string // name of a file in the errors
+	errors       []validationError
+	env          cel.Env
+	tp           *triggerProcessor // nil if the collection can not be initialized
+	destinations map[string]bool   // names of the eventDestinations. nil without eventDefinitions.yaml
+	functions    map[string]bool
+	resourceDirs map[string]bool // directories of applyResources already validated
+	triggers     int
+	cursor       int // index in the file being validated of the last text located
+}
+
+var (
+	yamlLinePattern     = regexp.MustCompile(`line (\d+)`)             // line of a YAML error
+	templateLinePattern = regexp.MustCompile(`^template: [^:]*:(\d+)`) // line of a template error
+)
+
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	eventDefinitions := flags.String("eventDefinitions", "", "eventDefinitions.yaml of the collection. The eventDefinitions.yaml of the collection directory by default")
+	plugins := flags.String("providerPlugins", "", "comma separated paths of the Go plugins of the messageProviders of the collection")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: kabanero-events validate [-eventDefinitions <file>] [-providerPlugins <plugin>,...] <directory|Kabanero index URL>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if err := loadProviderPlugins(*plugins); err != nil {
+		fmt.Fprintf(os.Stderr, "validate: %v\n", err)
+		return 2
+	}
+
+	source := flags.Arg(0)
+	dir := source
+	display := func(fileName string) string { return fileName }
+	if info, err := os.Stat(source); err != nil || !info.IsDir() {
+		if !strings.Contains(source, "://") {
+			fmt.Fprintf(os.Stderr, "validate: %s is not a directory or a URL\n", source)
+			return 2
+		}
+		dir, _, err = downloadTriggerFromSources(splitIndexURLs(source))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "validate: unable to download the trigger collection of %s: %v\n", redactURL(source), err)
+			return 2
+		}
+		defer os.RemoveAll(dir)
+		display = func(fileName string) string {
+			if relative, err := filepath.Rel(dir, fileName); err == nil {
+				return relative
+			}
+			return fileName
+		}
+	}
+
+	validator := validateCollection(dir, *eventDefinitions, display)
+	for _, err := range validator.errors {
+		fmt.Println(err.String())
+	}
+	if len(validator.errors) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %v error(s)\n", source, len(validator.errors))
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v trigger(s) are valid\n", source, validator.triggers)
+	return 0
+}
+
+/* Validate the collection of a directory, and its eventDefinitions.yaml if any */
+func validateCollection(dir string, eventDefinitions string, display func(string) string) *collectionValidator {
+	validator := &collectionValidator{dir: dir, display: display, functions: make(map[string]bool), resourceDirs: make(map[string]bool)}
+	files, err := findFiles(dir, []string{".yaml", ".yml"})
+	if err != nil || len(files) == 0 {
+		validator.add(dir, 0, "no trigger files found")
+		return validator
+	}
+
+	contents := make(map[string][]byte)
+	documents := make(map[string]map[string]interface{})
+	for _, fileName := range files {
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			validator.add(fileName, 0, "%v", err)
+			continue
+		}
+		document := make(map[string]interface{})
+		if err = yaml.Unmarshal(content, document); err != nil {
+			validator.add(fileName, yamlErrorLine(err), "%v", err)
+			continue
+		}
+		contents[fileName], documents[fileName] = content, document
+	}
+	if len(validator.errors) > 0 {
+		return validator
+	}
+
+	/* the checks across the files of the collection, such as redeclared triggers, and the macros and template library */
+	tp := newTriggerProcessor()
+	if err = tp.initialize(dir); err != nil {
+		validator.add(dir, 0, "%v", err)
+	} else {
+		validator.tp = tp
+	}
+	validator.env, err = tp.initializeEmptyCELEnv()
+	if err != nil {
+		validator.env, err = cel.NewEnv(getAdditionalCELFuncDecls(), triggerMacros)
+		if err != nil {
+			validator.add(dir, 0, "%v", err)
+			return validator
+		}
+	}
+
+	if eventDefinitions == "" {
+		eventDefinitions = filepath.Join(dir, "eventDefinitions.yaml")
+		if _, err := os.Stat(eventDefinitions); err != nil {
+			eventDefinitions = ""
+		}
+	}
+	if eventDefinitions != "" {
+		validator.validateEventDefinitions(eventDefinitions)
+	}
+
+	for _, fileName := range files {
+		if functions, ok := documents[fileName][FUNCTIONS].([]interface{}); ok {
+			for _, functionObj := range functions {
+				if function, ok := functionObj.(map[interface{}]interface{}); ok {
+					if name, ok := function[NAME].(string); ok {
+						validator.functions[name] = true
+					}
+				}
+			}
+		}
+	}
+	for _, fileName := range files {
+		validator.validateFile(fileName, string(contents[fileName]), documents[fileName])
+	}
+	sort.SliceStable(validator.errors, func(i, j int) bool {
+		if validator.errors[i].file != validator.errors[j].file {
+			return validator.errors[i].file < validator.errors[j].file
+		}
+		return validator.errors[i].line < validator.errors[j].line
+	})
+	return validator
+}
+
+func (validator *collectionValidator) add(fileName string, line int, format string, args ...interface{}) {
+	validator.errors = append(validator.errors, validationError{file: validator.display(fileName), line: line, msg: fmt.Sprintf(format, args...)})
+}
+
+/* Return the line of a YAML error, 0 if unknown */
+func yamlErrorLine(err error) int {
+	if match := yamlLinePattern.FindStringSubmatch(err.Error()); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return line
+	}
+	return 0
+}
+
+/* Return the index of the first occurrence of a text in content from an index, or of its first line, -1 if not found */
+func indexOf(content string, text string, from int) int {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return -1
+	}
+	index := strings.Index(content[from:], text)
+	if index < 0 {
+		firstLine := strings.TrimSpace(strings.SplitN(text, "\n", 2)[0])
+		if index = strings.Index(content[from:], firstLine); index < 0 {
+			return -1
+		}
+	}
+	return from + index
+}
+
+/*
+Return the line of the next occurrence of a text in the file being validated, following the order of the document, or
+else of its first occurrence. 0 if not found
+*/
+func (validator *collectionValidator) lineOf(content string, text string) int {
+	index := indexOf(content, text, validator.cursor)
+	if index >= 0 {
+		validator.cursor = index
+	} else if index = indexOf(content, text, 0); index < 0 {
+		return 0
+	}
+	return strings.Count(content[:index], "\n") + 1
+}
+
+/* Check the messageProviders and eventDestinations of eventDefinitions.yaml */
+func (validator *collectionValidator) validateEventDefinitions(fileName string) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		validator.add(fileName, 0, "%v", err)
+		return
+	}
+	ed, err := readEventDefinition(fileName)
+	if err != nil {
+		validator.add(fileName, yamlErrorLine(err), "%v", err)
+		return
+	}
+	text := string(content)
+	validator.cursor = 0
+	providers := make(map[string]bool)
+	for _, provider := range ed.MessageProviders {
+		line := validator.lineOf(text, "name: "+provider.Name)
+		switch {
+		case provider.Name == "":
+			validator.add(fileName, validator.lineOf(text, "providerType: "+provider.ProviderType), "messageProvider without a name")
+		case providers[provider.Name]:
+			validator.add(fileName, line, "messageProvider %s is defined more than once", provider.Name)
+		}
+		providers[provider.Name] = true
+		known := false
+		for _, providerType := range messageProviderTypes() {
+			known = known || provider.ProviderType == providerType
+		}
+		if !known {
+			validator.add(fileName, line, "providerType '%s' of messageProvider %s is not one of %s", provider.ProviderType, provider.Name, strings.Join(messageProviderTypes(), ", "))
+		}
+	}
+	validator.cursor = 0
+	for _, provider := range ed.MessageProviders {
+		for _, backend := range provider.Backends {
+			if !providers[backend] {
+				validator.add(fileName, validator.lineOf(text, backend), "backend %s of messageProvider %s is not a messageProvider", backend, provider.Name)
+			}
+		}
+	}
+
+	validator.cursor = 0
+	validator.destinations = make(map[string]bool)
+	for _, destination := range ed.EventDestinations {
+		line := validator.lineOf(text, "name: "+destination.Name)
+		if validator.destinations[destination.Name] {
+			validator.add(fileName, line, "eventDestination %s is defined more than once", destination.Name)
+		}
+		validator.destinations[destination.Name] = true
+		if !providers[destination.ProviderRef] {
+			validator.add(fileName, validator.lineOf(text, "providerRef: "+destination.ProviderRef), "providerRef '%s' of eventDestination %s is not a messageProvider", destination.ProviderRef, destination.Name)
+		}
+		if destination.Transform != nil {
+			if _, err := compileTransform(destination.Transform); err != nil {
+				validator.add(fileName, line, "transform of eventDestination %s is invalid: %v", destination.Name, err)
+			}
+		}
+		for _, filter := range []string{destination.Filter, destination.ReceiveFilter} {
+			if filter == "" {
+				continue
+			}
+			if _, err := compileMessageExpression(filter); err != nil {
+				validator.add(fileName, line, "filter of eventDestination %s is invalid: %v", destination.Name, err)
+			}
+		}
+		if destination.Retry != nil {
+			if err := validateRetry(destination.Retry); err != nil {
+				validator.add(fileName, line, "retry of eventDestination %s is invalid: %v", destination.Name, err)
+			}
+		}
+	}
+	validator.cursor = 0
+	if ed.Listener != nil {
+		for _, path := range ed.Listener.Paths {
+			if path.Destination != "" && !validator.destinations[path.Destination] {
+				validator.add(fileName, validator.lineOf(text, "destination: "+path.Destination), "destination '%s' of listener path %s is not an eventDestination", path.Destination, path.Path)
+			}
+		}
+	}
+	validator.cursor = 0
+	for _, poller := range ed.Pollers {
+		if !validator.destinations[poller.Destination] {
+			validator.add(fileName, validator.lineOf(text, "destination: "+poller.Destination), "destination '%s' of poller %s is not an eventDestination", poller.Destination, poller.Name)
+		}
+	}
+	validator.cursor = 0
+	for _, watcher := range ed.KubeWatchers {
+		if !validator.destinations[watcher.Destination] {
+			validator.add(fileName, validator.lineOf(text, "destination: "+watcher.Destination), "destination '%s' of kubeWatcher %s is not an eventDestination", watcher.Destination, watcher.Name)
+		}
+	}
+}
+
+/* Check the triggers and functions of a file */
+func (validator *collectionValidator) validateFile(fileName string, content string, document map[string]interface{}) {
+	validator.cursor = 0
+	if triggersObj, ok := document[EVENTTRIGGERS]; ok {
+		triggers, ok := triggersObj.([]interface{})
+		if !ok {
+			validator.add(fileName, validator.lineOf(content, EVENTTRIGGERS+":"), "eventTriggers is not an array")
+		}
+		for index, triggerObj := range triggers {
+			trigger, ok := triggerObj.(map[interface{}]interface{})
+			if !ok {
+				validator.add(fileName, validator.lineOf(content, EVENTTRIGGERS+":"), "eventTrigger %v is not an object", triggerObj)
+				continue
+			}
+			validator.triggers++
+			/* the eventSource is located first, since it usually precedes the name */
+			eventSource, hasEventSource := trigger[EVENTSOURCE].(string)
+			eventSourceLine := 0
+			if hasEventSource {
+				eventSourceLine = validator.lineOf(content, "eventSource: "+eventSource)
+			}
+			name, _ := trigger[NAME].(string)
+			line := validator.lineOf(content, "name: "+name)
+			if name == "" {
+				name = fmt.Sprintf("#%d", index+1)
+				line = eventSourceLine
+			}
+			if line == 0 {
+				line = validator.lineOf(content, EVENTTRIGGERS+":")
+			}
+			if !hasEventSource {
+				validator.add(fileName, line, "eventTrigger %s does not have an eventSource", name)
+			} else if validator.destinations != nil && !validator.destinations[eventSource] {
+				validator.add(fileName, eventSourceLine, "eventSource '%s' of eventTrigger %s is not an eventDestination", eventSource, name)
+			}
+			if _, ok := trigger[INPUT].(string); !ok {
+				validator.add(fileName, line, "eventTrigger %s does not have an input variable", name)
+			}
+			body, ok := trigger[BODY].([]interface{})
+			if !ok {
+				validator.add(fileName, line, "eventTrigger %s does not have a body array", name)
+				continue
+			}
+			validator.validateStatements(fileName, content, body)
+		}
+	}
+
+	if functionsObj, ok := document[FUNCTIONS].([]interface{}); ok {
+		for _, functionObj := range functionsObj {
+			function, ok := functionObj.(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			name, _ := function[NAME].(string)
+			body, ok := function[BODY].([]interface{})
+			if !ok {
+				validator.add(fileName, validator.lineOf(content, "name: "+name), "body of function %s is not an array", name)
+				continue
+			}
+			validator.validateStatements(fileName, content, body)
+		}
+	}
+}
+
+/* Check the statements of a body, as they are evaluated */
+func (validator *collectionValidator) validateStatements(fileName string, content string, body []interface{}) {
+	for _, statementObj := range body {
+		statement, ok := statementObj.(map[interface{}]interface{})
+		if !ok {
+			validator.add(fileName, validator.lineOf(content, fmt.Sprint(statementObj)), "statement %v is not an object", statementObj)
+			continue
+		}
+		numKeywords, flags := countKeywords(statement)
+		switch {
+		case (flags & IfFlag) != 0:
+			validator.validateIf(fileName, content, statement, numKeywords, flags)
+		case (flags & SwitchFlag) != 0:
+			if len(statement) > 1 {
+				validator.add(fileName, validator.statementLine(content, statement), "switch also contains other keywords or assignments")
+			}
+			validator.validateSwitch(fileName, content, statement)
+		case (flags & BodyFlag) != 0:
+			if len(statement) > 1 {
+				validator.add(fileName, validator.statementLine(content, statement), "body also contains other keywords or assignments")
+			}
+			validator.validateNestedBody(fileName, content, statement)
+		case (flags & DefaultFlag) != 0:
+			validator.add(fileName, validator.lineOf(content, DEFAULT+":"), "default outside of a switch")
+		default:
+			if len(statement) > 1 {
+				validator.add(fileName, validator.statementLine(content, statement), "multiple assignments in one object")
+			}
+			for nameObj, value := range statement {
+				name, ok := nameObj.(string)
+				if !ok {
+					validator.add(fileName, 0, "variable %v is not a string", nameObj)
+					continue
+				}
+				switch typed := value.(type) {
+				case string:
+					validator.validateExpression(fileName, content, typed)
+				case int, int64, float64, bool:
+				default:
+					validator.add(fileName, validator.lineOf(content, name+":"), "value of variable %s is a %T, not a YAML primitive type or string", name, value)
+				}
+			}
+		}
+	}
+}
+
+func (validator *collectionValidator) validateIf(fileName string, content string, statement map[interface{}]interface{}, numKeywords int, flags uint) {
+	condition, ok := statement[IF].(string)
+	if !ok {
+		validator.add(fileName, validator.lineOf(content, IF), "condition of if %v is not a string", statement[IF])
+		return
+	}
+	line := validator.lineOf(content, condition)
+	switch {
+	case numKeywords > 2:
+		validator.add(fileName, line, "if contains more than two keywords")
+	case numKeywords == 2 && (flags&BodyFlag) == 0 && (flags&SwitchFlag) == 0:
+		validator.add(fileName, line, "if also contains keywords other than body or switch")
+	case numKeywords == 2 && len(statement) > 2:
+		validator.add(fileName, line, "if mixes assignments with a body")
+	}
+	validator.validateExpression(fileName, content, condition)
+	if _, ok := statement[BODY]; ok {
+		validator.validateNestedBody(fileName, content, statement)
+	} else if _, ok := statement[SWITCH]; ok {
+		validator.validateSwitch(fileName, content, statement)
+	} else {
+		assignments := make(map[interface{}]interface{})
+		for key, value := range statement {
+			if key != IF {
+				assignments[key] = value
+			}
+		}
+		if len(assignments) > 0 {
+			validator.validateStatements(fileName, content, []interface{}{assignments})
+		}
+	}
+}
+
+func (validator *collectionValidator) validateNestedBody(fileName string, content string, statement map[interface{}]interface{}) {
+	body, ok := statement[BODY].([]interface{})
+	if !ok {
+		validator.add(fileName, validator.statementLine(content, statement), "body is not an array")
+		return
+	}
+	validator.validateStatements(fileName, content, body)
+}
+
+func (validator *collectionValidator) validateSwitch(fileName string, content string, statement map[interface{}]interface{}) {
+	cases, ok := statement[SWITCH].([]interface{})
+	if !ok {
+		validator.add(fileName, validator.lineOf(content, SWITCH+":"), "switch is not an array")
+		return
+	}
+	defaults := 0
+	for _, switchCaseObj := range cases {
+		switchCase, ok := switchCaseObj.(map[interface{}]interface{})
+		if !ok {
+			validator.add(fileName, validator.lineOf(content, SWITCH+":"), "case %v of switch is not an object", switchCaseObj)
+			continue
+		}
+		if _, ok := switchCase[IF]; ok {
+			numKeywords, flags := countKeywords(switchCase)
+			validator.validateIf(fileName, content, switchCase, numKeywords, flags)
+			continue
+		}
+		defaultBody, ok := switchCase[DEFAULT]
+		if !ok {
+			validator.add(fileName, validator.statementLine(content, switchCase), "switch contains %v, not an if or default", switchCase)
+			continue
+		}
+		line := validator.lineOf(content, DEFAULT+":")
+		if defaults++; defaults > 1 {
+			validator.add(fileName, line, "switch contains more than one default")
+		}
+		if len(switchCase) > 1 {
+			validator.add(fileName, line, "default of switch is not alone")
+		}
+		body, ok := defaultBody.([]interface{})
+		if !ok {
+			validator.add(fileName, line, "default of switch is not an array")
+			continue
+		}
+		validator.validateStatements(fileName, content, body)
+	}
+}
+
+/* The line of a statement, that of the first of its values that is found */
+func (validator *collectionValidator) statementLine(content string, statement map[interface{}]interface{}) int {
+	for _, value := range statement {
+		if str, ok := value.(string); ok {
+			if index := indexOf(content, str, validator.cursor); index >= 0 {
+				return strings.Count(content[:index], "\n") + 1
+			}
+		}
+	}
+	return 0
+}
+
+/* Parse a CEL expression, and check the literal arguments of the functions referring to the collection */
+func (validator *collectionValidator) validateExpression(fileName string, content string, expression string) {
+	line := validator.lineOf(content, expression)
+	parsed, issues := validator.env.Parse(strings.Trim(expression, " "))
+	if issues != nil && issues.Err() != nil {
+		validator.add(fileName, line, "invalid expression %s: %v", strings.TrimSpace(expression), strings.TrimSpace(issues.Err().Error()))
+		return
+	}
+	walkCalls(parsed.Expr(), func(function string, args []*exprpb.Expr) {
+		literal := func(index int) (string, bool) {
+			if index >= len(args) {
+				return "", false
+			}
+			constant := args[index].GetConstExpr()
+			if constant == nil {
+				return "", false
+			}
+			if _, ok := constant.ConstantKind.(*exprpb.Constant_StringValue); !ok {
+				return "", false
+			}
+			return constant.GetStringValue(), true
+		}
+		switch function {
+		case "sendEvent":
+			if destination, ok := literal(0); ok && validator.destinations != nil && !validator.destinations[destination] {
+				validator.add(fileName, line, "destination '%s' of sendEvent is not an eventDestination", destination)
+			}
+		case "call":
+			if name, ok := literal(0); ok && !validator.functions[name] {
+				validator.add(fileName, line, "function '%s' of call is not defined", name)
+			}
+		case "applyResources":
+			if dir, ok := literal(0); ok {
+				validator.validateResourceDir(fileName, line, dir)
+			}
+		case "applyResourcesToCluster":
+			if dir, ok := literal(1); ok {
+				validator.validateResourceDir(fileName, line, dir)
+			}
+		}
+	})
+}
+
+/* Call a function for each function call of an expression */
+func walkCalls(expr *exprpb.Expr, visit func(function string, args []*exprpb.Expr)) {
+	if expr == nil {
+		return
+	}
+	switch kind := expr.ExprKind.(type) {
+	case *exprpb.Expr_CallExpr:
+		visit(kind.CallExpr.Function, kind.CallExpr.Args)
+		walkCalls(kind.CallExpr.Target, visit)
+		for _, arg := range kind.CallExpr.Args {
+			walkCalls(arg, visit)
+		}
+	case *exprpb.Expr_SelectExpr:
+		walkCalls(kind.SelectExpr.Operand, visit)
+	case *exprpb.Expr_ListExpr:
+		for _, element := range kind.ListExpr.Elements {
+			walkCalls(element, visit)
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range kind.StructExpr.Entries {
+			walkCalls(entry.GetMapKey(), visit)
+			walkCalls(entry.Value, visit)
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		walkCalls(kind.ComprehensionExpr.IterRange, visit)
+		walkCalls(kind.ComprehensionExpr.LoopStep, visit)
+		walkCalls(kind.ComprehensionExpr.Result, visit)
+	}
+}
+
+/* Check that a directory of resources of applyResources exists, and that its templates parse */
+func (validator *collectionValidator) validateResourceDir(fileName string, line int, dir string) {
+	resourceDir, err := mergePathWithErrorCheck(validator.dir, dir)
+	if err != nil {
+		validator.add(fileName, line, "directory '%s' of applyResources: %v", dir, err)
+		return
+	}
+	if validator.resourceDirs[resourceDir] {
+		return
+	}
+	validator.resourceDirs[resourceDir] = true
+	if info, err := os.Stat(resourceDir); err != nil || !info.IsDir() {
+		validator.add(fileName, line, "directory '%s' of applyResources does not exist", dir)
+		return
+	}
+	files, err := findFiles(resourceDir, []string{"yaml", "yml"})
+	if err != nil {
+		validator.add(fileName, line, "directory '%s' of applyResources: %v", dir, err)
+		return
+	}
+	var library *template.Template
+	if validator.tp != nil {
+		library = validator.tp.templates
+	}
+	for _, resourceFile := range files {
+		content, err := ioutil.ReadFile(resourceFile)
+		if err != nil {
+			validator.add(resourceFile, 0, "%v", err)
+			continue
+		}
+		if _, err = parseTemplate(library, string(content)); err != nil {
+			templateLine := 0
+			if match := templateLinePattern.FindStringSubmatch(err.Error()); match != nil {
+				templateLine, _ = strconv.Atoi(match[1])
+			}
+			validator.add(resourceFile, templateLine, "invalid template: %v", err)
+		}
+	}
+}
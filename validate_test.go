@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* Write the files of a collection into a new directory */
+func writeCollection(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fileName := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+const validEventDefinitions = `messageProviders:
+- name: nats
+  providerType: nats
+  url: nats://127.0.0.1:4222
+eventDestinations:
+- name: github
+  providerRef: nats
+  topic: github
+- name: notifications
+  providerRef: nats
+  topic: notifications
+`
+
+func TestValidateCollection(t *testing.T) {
+	dir := writeCollection(t, map[string]string{
+		"eventDefinitions.yaml": validEventDefinitions,
+		"triggers.yaml": `eventTriggers:
+  - eventSource: github
+    name: build
+    input: message
+    body:
+      - build: 'message.body.ref == "refs/heads/master"'
+      - if: build
+        body:
+          - switch:
+            - if: 'message.body.created'
+              result: 'applyResources("resources", message)'
+            - default:
+              - result: 'call("notify", message)'
+functions:
+  - name: notify
+    input: message
+    output: result
+    body:
+      - result: 'sendEvent("notifications", message, {})'
+`,
+		"resources/configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{.body.repository.name}}\n",
+	})
+	defer os.RemoveAll(dir)
+	validator := validateCollection(dir, "", filepath.Base)
+	if len(validator.errors) != 0 || validator.triggers != 1 {
+		t.Fatalf("unexpected errors validating %v triggers: %v", validator.triggers, validator.errors)
+	}
+	if validator = validateCollection("test_data/trigger16", "", filepath.Base); len(validator.errors) != 0 {
+		t.Fatalf("unexpected errors validating trigger16: %v", validator.errors)
+	}
+}
+
+func TestValidateInvalidCollection(t *testing.T) {
+	dir := writeCollection(t, map[string]string{
+		"eventDefinitions.yaml": validEventDefinitions + `- name: unknown
+  providerRef: kafka
+  topic: unknown
+`,
+		"triggers.yaml": `eventTriggers:
+  - eventSource: github
+    name: first
+    input: message
+    body:
+      - result: 'applyResources("missing", message)'
+  - eventSource: gitlab
+    name: second
+    input: message
+    body:
+      - invalid: 'message.body.ref =='
+      - result: 'sendEvent("unknown-destination", message, {})'
+      - default:
+        - result: 'call("unknown", message)'
+      - result: 'applyResourcesToCluster("spoke", "resources", message)'
+`,
+		"resources/configmap.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{.body.repository.name}\n",
+	})
+	defer os.RemoveAll(dir)
+	validator := validateCollection(dir, "", filepath.Base)
+	expected := []string{
+		"configmap.yaml:4: invalid template",
+		"eventDefinitions.yaml:13: providerRef 'kafka' of eventDestination unknown is not a messageProvider",
+		"triggers.yaml:6: directory 'missing' of applyResources does not exist",
+		"triggers.yaml:7: eventSource 'gitlab' of eventTrigger second is not an eventDestination",
+		"triggers.yaml:11: invalid expression message.body.ref ==",
+		"triggers.yaml:12: destination 'unknown-destination' of sendEvent is not an eventDestination",
+		"triggers.yaml:13: default outside of a switch",
+	}
+	if len(validator.errors) != len(expected) {
+		t.Fatalf("expected %v errors, got %v", len(expected), validator.errors)
+	}
+	for index, err := range validator.errors {
+		if !strings.HasPrefix(err.String(), expected[index]) {
+			t.Errorf("expected error %q, got %q", expected[index], err.String())
+		}
+	}
+
+	/* YAML errors have the line of the error */
+	brokenDir := writeCollection(t, map[string]string{"triggers.yaml": "eventTriggers:\n  - eventSource: github\n    name: [broken\n"})
+	defer os.RemoveAll(brokenDir)
+	validator = validateCollection(brokenDir, "", filepath.Base)
+	if len(validator.errors) != 1 || validator.errors[0].line == 0 {
+		t.Fatalf("unexpected errors validating broken YAML: %v", validator.errors)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	if code := validateCommand([]string{"test_data/trigger16"}); code != 0 {
+		t.Fatalf("validate of a valid collection exited with %v", code)
+	}
+	if code := validateCommand([]string{"-eventDefinitions", "test_data/providers0/eventDefinitions.yaml", "test_data/trigger16"}); code != 1 {
+		t.Fatalf("validate of an invalid collection exited with %v", code)
+	}
+	if code := validateCommand([]string{"test_data/missing"}); code != 2 {
+		t.Fatalf("validate of a missing directory exited with %v", code)
+	}
+}
@@ -70,7 +70,7 @@ func readJSON(fileName string) (*unstructured.Unstructured, error) {
 }
 
 func downloadFileTo(url, path string) error {
-	client := http.Client{}
+	client := http.Client{Transport: withUserAgent(nil)}
 	response, err := client.Get(url)
 	if err != nil {
 		return err
@@ -90,7 +90,7 @@ func downloadFileTo(url, path string) error {
 
 func getHTTPURLReaderCloser(url string) (io.ReadCloser, error) {
 
-	client := http.Client{}
+	client := http.Client{Transport: withUserAgent(nil)}
 	response, err := client.Get(url)
 	if err != nil {
 		return nil, err
@@ -276,7 +276,11 @@ func downloadTrigger(kabaneroIndexURL string, dir string) error {
 		klog.Infof("Entering downloadTrigger kabaneroIndexURL: %s, directory to store trigger: %s", kabaneroIndexURL, dir)
 		defer klog.Infof("Leaving downloadTrigger kabaneroIndexURL: %s, directory to store trigger: %s", kabaneroIndexURL, dir)
 	}
-	kabaneroIndexBytes, err := readHTTPURL(kabaneroIndexURL)
+	creds, err := readCollectionCredentials(kabaneroIndexURL)
+	if err != nil {
+		return err
+	}
+	kabaneroIndexBytes, err := creds.read(kabaneroIndexURL)
 	if err != nil {
 		return err
 	}
@@ -297,7 +301,7 @@ func downloadTrigger(kabaneroIndexURL string, dir string) error {
 	}
 
 	triggerArchiveName := filepath.Join(dir, "incubator.trigger.tar.gz")
-	err = downloadFileTo(triggerURL, triggerArchiveName)
+	err = creds.downloadTo(triggerURL, triggerArchiveName)
 	if err != nil {
 		return err
 	}
@@ -314,11 +318,17 @@ func downloadTrigger(kabaneroIndexURL string, dir string) error {
 		}
 
 		if chkSum != triggerChkSum {
-			klog.Fatalf("trigger collection checksum does not match the checksum from the Kabanero index: found: %s, expected: %s",
+			return fmt.Errorf("trigger collection checksum does not match the checksum from the Kabanero index: found: %s, expected: %s",
 				chkSum, triggerChkSum)
 		}
 	}
 
+	// Verify the signature of the triggers collection, if required
+	err = verifyCollectionSignature(creds, kabaneroIndexMap, triggerURL, triggerArchiveName)
+	if err != nil {
+		return err
+	}
+
 	// Untar the triggers collection
 	triggerReadCloser, err := os.Open(triggerArchiveName)
 	if err != nil {
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 IBM Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"k8s.io/klog"
+)
+
+/*
+Summaries of webhook deliveries. With -webhookSummary, unless disabled by the summary=false query parameter, the
+response to a webhook request is a JSON summary of its processing rather than an empty body, so that callers such as
+the webhook deliveries page of GitHub, or smoke tests, can verify that an event was processed: its event ID and kind,
+and for each eventDestination it was routed to, whether it was sent, written to the outbox, or is being retried, and
+the triggers of the destination that match it. The triggers are evaluated in dry-run, as by POST /admin/simulate,
+since they process the event asynchronously once it is received from the destination.
+*/
+
+const (
+	SUMMARY = "summary" // query parameter requesting the summary of a webhook request
+
+	sendStatusSent     = "sent"
+	sendStatusOutbox   = "outbox"
+	sendStatusRetrying = "retrying"
+	sendStatusFailed   = "failed"
+)
+
+var webhookSummaryEnabled bool // responses to webhook requests are summaries of their processing
+
+/* The summary of the delivery of a webhook message */
+type webhookSummary struct {
+	EventID      string                `json:"eventID"`
+	Kind         string                `json:"kind,omitempty"`
+	Destinations []*destinationSummary `json:"destinations"`
+	message      map[string]interface{}
+}
+
+/* The summary of the send of a webhook message to an eventDestination */
+type destinationSummary struct {
+	Destination  string   `json:"destination"`
+	Status       string   `json:"status"`
+	Error        string   `json:"error,omitempty"`
+	Collection   string   `json:"collection,omitempty"`
+	Triggers     []string `json:"triggers,omitempty"`
+	TriggerError string   `json:"triggerError,omitempty"`
+}
+
+/*
+Return whether the response to a webhook request is the summary of its processing. Summaries are only returned with
+-webhookSummary, unless the request disables them, so that callers can not get the triggers to be evaluated otherwise.
+*/
+func webhookSummaryRequested(req *http.Request) bool {
+	if !webhookSummaryEnabled {
+		return false
+	}
+	if requested, err := strconv.ParseBool(req.URL.Query().Get(SUMMARY)); err == nil {
+		return requested
+	}
+	return true
+}
+
+/*
+Add the triggers of the collection processing the message of each destination, evaluated in dry-run. Errors of the
+triggers, which may reveal their variables, are only added if showErrors.
+*/
+func (summary *webhookSummary) evaluateTriggers(showErrors bool) {
+	for _, sent := range summary.Destinations {
+		if sent.Status == sendStatusFailed {
+			continue
+		}
+		tp := selectTriggerProcessor(summary.message, sent.Destination)
+		if tp == nil || tp.triggerDef == nil {
+			continue
+		}
+		if _, ok := tp.triggerDef.eventTriggers[sent.Destination]; !ok {
+			continue
+		}
+		sent.Collection = tp.name
+		result, err := tp.evaluateMessage(summary.message, sent.Destination, evalOptions{dryrun: true})
+		if result != nil {
+			sent.Triggers = result.triggers
+		}
+		if err != nil && showErrors {
+			sent.TriggerError = err.Error()
+		}
+	}
+}
+
+/* Send the message of a webhook request to an eventDestination, and respond with the summary of its processing if requested */
+func respondWebhookMessage(writer http.ResponseWriter, req *http.Request, destination string, sourcePath string, header http.Header, bodyMap map[string]interface{}) {
+	if !webhookSummaryRequested(req) {
+		respondWebhook(writer, req, sendWebhookMessageTo(destination, sourcePath, header, bodyMap))
+		return
+	}
+	admin := adminAuthorized(req)
+	if admin {
+		/* the admin token is not sent with the message */
+		header = header.Clone()
+		header.Del("Authorization")
+	}
+	summary, err := deliverWebhookMessage(destination, sourcePath, header, bodyMap)
+	if err != nil {
+		respondWebhook(writer, req, err)
+		return
+	}
+	incrementMetric("webhook.summaries")
+	summary.evaluateTriggers(admin)
+	if klog.V(4) {
+		eventInfo(summary.EventID, "Responding with webhook summary", logFields{"destinations": len(summary.Destinations)})
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if len(outboxes) > 0 {
+		writer.WriteHeader(http.StatusAccepted)
+	}
+	writeJSON(writer, summary)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWebhookSummary(t *testing.T) {
+	savedProc, savedCanary := triggerProc, canaryProc
+	savedProviders, savedDefinitions, savedEnabled := messageProviders, eventProviders, webhookSummaryEnabled
+	defer func() {
+		triggerProc, canaryProc = savedProc, savedCanary
+		messageProviders, eventProviders, webhookSummaryEnabled = savedProviders, savedDefinitions, savedEnabled
+	}()
+	triggerProc, canaryProc = newTriggerProcessor(), nil
+	triggerProc.name = "active"
+	if err := triggerProc.initialize("test_data/trigger15"); err != nil {
+		t.Fatal(err)
+	}
+	provider := &capturingProvider{}
+	messageProviders = map[string]MessageProvider{"capture": provider}
+	eventProviders = &EventDefinition{EventDestinations: []*EventNode{{Name: WEBHOOKDESTINATION, ProviderRef: "capture", Topic: "github"}}}
+	webhookSummaryEnabled = false
+
+	deliver := func(target string, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		req.Header.Set("X-Github-Event", "push")
+		req.Header.Set("X-Github-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		recorder := httptest.NewRecorder()
+		webhookHandler(&ListenerPath{Path: "/webhook", Destination: WEBHOOKDESTINATION})(recorder, req)
+		return recorder
+	}
+
+	/* the response is empty without -webhookSummary, even if a summary is requested */
+	for _, target := range []string{"/webhook", "/webhook?summary=true"} {
+		if recorder := deliver(target, `{"ref": "refs/heads/master"}`); recorder.Code != http.StatusOK || recorder.Body.Len() != 0 {
+			t.Fatalf("unexpected response to %v: %v %q", target, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	webhookSummaryEnabled = true
+	recorder := deliver("/webhook?summary=true", `{"ref": "refs/heads/master"}`)
+	summary := &webhookSummary{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), summary); err != nil {
+		t.Fatalf("%v: %q", err, recorder.Body.String())
+	}
+	if recorder.Code != http.StatusOK || summary.EventID == "" || summary.Kind != "push" || len(summary.Destinations) != 1 {
+		t.Fatalf("unexpected summary %v %+v", recorder.Code, summary)
+	}
+	sent := summary.Destinations[0]
+	if sent.Destination != WEBHOOKDESTINATION || sent.Status != sendStatusSent || sent.Collection != "active" || len(sent.Triggers) != 1 || sent.Error != "" {
+		t.Fatalf("unexpected summary of destination %+v", sent)
+	}
+	if len(provider.messages) != 3 {
+		t.Fatalf("unexpected %v messages sent", len(provider.messages))
+	}
+
+	/* events that do not match the triggers have a summary without triggers */
+	recorder = deliver("/webhook", `{"ref": "refs/heads/feature"}`)
+	summary = &webhookSummary{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Destinations) != 1 || len(summary.Destinations[0].Triggers) != 0 || summary.Destinations[0].TriggerError != "" {
+		t.Fatalf("unexpected summary %+v", summary.Destinations[0])
+	}
+	if recorder = deliver("/webhook?summary=false", `{"ref": "refs/heads/master"}`); recorder.Body.Len() != 0 {
+		t.Fatalf("summary was not disabled by the query parameter: %q", recorder.Body.String())
+	}
+
+	/* errors of the triggers are only reported to requests with the admin token */
+	os.Setenv(ADMINTOKEN, "admin-token")
+	defer os.Unsetenv(ADMINTOKEN)
+	for auth, reported := range map[string]bool{"": false, "Bearer other-token": false, "Bearer admin-token": true} {
+		summary = &webhookSummary{}
+		if err := json.Unmarshal(deliver("/webhook", `{}`, "Authorization", auth).Body.Bytes(), summary); err != nil {
+			t.Fatal(err)
+		}
+		if len(summary.Destinations) != 1 || (summary.Destinations[0].TriggerError != "") != reported {
+			t.Errorf("trigger error reported to request with authorization %q: %+v", auth, summary.Destinations)
+		}
+	}
+	for _, message := range provider.messages {
+		if strings.Contains(string(message), "Bearer admin-token") {
+			t.Errorf("admin token sent with the message: %s", message)
+		}
+	}
+}